@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// minSaltLength keeps pseudonyms from being reversed by hashing guesses
+const minSaltLength = 16
+
+// anonymizedColumn is a column rewritten to the value of a SQL expression
+type anonymizedColumn struct {
+	name  string
+	value string
+}
+
+// anonymization is how the personal data of one table is rewritten
+type anonymization struct {
+	table   string
+	columns []anonymizedColumn
+	delete  bool // drop the rows instead, e.g. credentials and raw payloads
+}
+
+// anonymizations lists the personal data and payment references of the
+// schema and how each is replaced. Pseudonyms are derived from the salted
+// hash of the original value, so a value appearing in several rows maps
+// to the same pseudonym, unique columns stay unique, and a later refresh
+// with the same salt gives the same pseudonyms. IDs are kept, so every
+// reference between tables still holds.
+func anonymizations(salt string) []anonymization {
+	salt = strings.ReplaceAll(salt, "'", "''")
+	pseudonym := func(column, prefix, suffix string) anonymizedColumn {
+		return anonymizedColumn{column, fmt.Sprintf(
+			"CASE WHEN %[1]s IS NULL OR %[1]s = '' THEN %[1]s ELSE '%[2]s' || left(md5('%[4]s' || %[1]s), 16) || '%[3]s' END",
+			column, prefix, suffix, salt)}
+	}
+	redacted := func(column string) anonymizedColumn {
+		return anonymizedColumn{column, fmt.Sprintf("CASE WHEN %[1]s IS NULL OR %[1]s = '' THEN %[1]s ELSE '[redacted]' END", column)}
+	}
+	set := func(column, value string) anonymizedColumn {
+		return anonymizedColumn{column, value}
+	}
+	// snapshot pseudonymizes the emails and usernames in an audit snapshot
+	// like those of users, so an entry still names the same pseudonym.
+	// Keys a snapshot lacks come out NULL and are stripped, not added.
+	snapshot := func(column string) anonymizedColumn {
+		return anonymizedColumn{column, fmt.Sprintf(
+			"CASE WHEN %[1]s IS NULL OR %[1]s = '' THEN %[1]s ELSE (%[1]s::jsonb || jsonb_strip_nulls(jsonb_build_object("+
+				"'email', 'user-' || left(md5('%[2]s' || (%[1]s::jsonb->>'email')), 16) || '@example.invalid', "+
+				"'username', 'user-' || left(md5('%[2]s' || (%[1]s::jsonb->>'username')), 16))))::text END",
+			column, salt)}
+	}
+
+	return []anonymization{
+		{table: "users", columns: []anonymizedColumn{
+			pseudonym("email", "user-", "@example.invalid"),
+			pseudonym("username", "user-", ""),
+			pseudonym("first_name", "First-", ""),
+			pseudonym("last_name", "Last-", ""),
+			pseudonym("company", "Company-", ""),
+			// Uploaded pictures give way to the generated identicons
+			set("avatar_url", "'/api/v1/identicons/' || id || '.png'"),
+			// No bcrypt hash matches, so staging users reset their password
+			set("password_hash", "'!'"),
+		}},
+		{table: "refresh_tokens", delete: true},
+		{table: "pending_actions", columns: []anonymizedColumn{
+			// A new email address, for email changes
+			pseudonym("value", "user-", "@example.invalid"),
+			redacted("request_ip"),
+		}},
+		{table: "audit_logs", columns: []anonymizedColumn{snapshot("before"), snapshot("after"), redacted("ip")}},
+		{table: "password_reset_tokens", delete: true},
+		{table: "api_keys", columns: []anonymizedColumn{
+			// Production keys stop working, and stay unique
+			pseudonym("key_hash", "", ""),
+		}},
+		{table: "service_accounts", columns: []anonymizedColumn{
+			// Neither production keys nor production key pairs work
+			pseudonym("key_hash", "", ""),
+			set("public_key", "''"),
+		}},
+		{table: "consent_events", columns: []anonymizedColumn{
+			pseudonym("ip_address", "ip-", ""),
+			redacted("user_agent"),
+		}},
+		{table: "purchases", columns: []anonymizedColumn{pseudonym("payment_id", "pay_", "")}},
+		{table: "org_purchase_requests", columns: []anonymizedColumn{pseudonym("payment_id", "pay_", "")}},
+		{table: "subscriptions", columns: []anonymizedColumn{pseudonym("provider_subscription_id", "sub_", "")}},
+		{table: "transactions", columns: []anonymizedColumn{
+			pseudonym("external_id", "txn_", ""),
+			set("metadata", "CASE WHEN metadata IS NULL THEN NULL ELSE '{}' END"),
+		}},
+		{table: "refund_requests", columns: []anonymizedColumn{
+			pseudonym("external_refund_id", "re_", ""),
+			redacted("reason"),
+			redacted("notes"),
+		}},
+		{table: "payout_accounts", columns: []anonymizedColumn{pseudonym("external_id", "acct_", "")}},
+		{table: "payouts", columns: []anonymizedColumn{pseudonym("external_id", "tr_", "")}},
+		{table: "payment_events", delete: true},
+		{table: "publisher_applications", columns: []anonymizedColumn{
+			pseudonym("company_name", "Company-", ""),
+			pseudonym("website", "https://", ".example.invalid"),
+			redacted("address"),
+			pseudonym("tax_id", "TAX-", ""),
+		}},
+		{table: "fraud_assessments", columns: []anonymizedColumn{
+			pseudonym("ip", "ip-", ""),
+			redacted("notes"),
+		}},
+		{table: "device_claims", columns: []anonymizedColumn{pseudonym("site", "Site-", "")}},
+		{table: "notifications", columns: []anonymizedColumn{redacted("title"), redacted("body")}},
+		{table: "notification_digests", columns: []anonymizedColumn{redacted("body")}},
+		// The uploaded CSVs list customers' devices and sites
+		{table: "device_imports", columns: []anonymizedColumn{set("data", "''")}},
+		// Staging must not call production receivers or request certificates
+		// for publishers' domains
+		{table: "webhook_subscriptions", columns: []anonymizedColumn{
+			set("url", "'https://example.invalid/webhooks/' || id"),
+			set("active", "false"),
+		}},
+		{table: "webhook_deliveries", delete: true},
+		{table: "custom_domains", columns: []anonymizedColumn{
+			pseudonym("domain", "", ".example.invalid"),
+			set("verified_at", "NULL"),
+			set("cert_pem", "''"),
+			set("key_pem", "''"),
+		}},
+	}
+}
+
+// anonymize rewrites the personal data of the database in one
+// transaction. target must name the database the configuration points at,
+// so a production database is not rewritten by mistake.
+func (ops *operatorServices) anonymize(ctx context.Context, database, target, salt string) (string, error) {
+	if target != database {
+		return "", fmt.Errorf("the configured database is %q, not %q", database, target)
+	}
+	if len(salt) < minSaltLength {
+		return "", fmt.Errorf("-salt must be at least %d characters", minSaltLength)
+	}
+
+	var rows int64
+	err := ops.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, a := range anonymizations(salt) {
+			statement := "DELETE FROM " + a.table
+			if !a.delete {
+				assignments := make([]string, len(a.columns))
+				for i, column := range a.columns {
+					assignments[i] = column.name + " = " + column.value
+				}
+				statement = "UPDATE " + a.table + " SET " + strings.Join(assignments, ", ")
+			}
+
+			result := tx.Exec(statement)
+			if result.Error != nil {
+				return fmt.Errorf("%s: %w", a.table, result.Error)
+			}
+			rows += result.RowsAffected
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("database %s anonymized, %d rows rewritten or deleted", database, rows), nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+const cliUsage = `Usage: marketplace <command> [flags] <target>
+       marketplace worker    run background jobs without serving requests
+
+Break-glass operations run directly against the database. Every command
+needs -reason and is written to the log as an audit event.
+
+Commands:
+  user promote -role admin|publisher|user <user ID or email>
+  agent unpublish <agent ID>
+  token revoke <user ID or email>    end all of a user's sessions
+  webhook test <subscription ID>     send a ping delivery right away
+  ratings rebuild <agent ID or all>  recompute review aggregates and the
+                                     agents' rating and review count
+  anonymize -salt <secret> <database name>
+                                     rewrite personal data of a production
+                                     snapshot restored for staging
+`
+
+// operatorCommand is a CLI subcommand. run returns what it did, for the
+// operator and the audit log.
+type operatorCommand struct {
+	flags   func(fs *flag.FlagSet)
+	run     func(ops *operatorServices, ctx context.Context, target string) (string, error)
+	timeout time.Duration // a minute if zero
+}
+
+// operatorServices are the services the CLI acts through, so changes have
+// the same side effects as through the API
+type operatorServices struct {
+	db       *gorm.DB
+	auth     *services.AuthService
+	agents   *services.AgentService
+	webhooks *services.WebhookService
+	reviews  *services.ReviewService
+	audit    *services.AuditService
+	operator string
+	reason   string
+}
+
+// runCommand runs an operator subcommand and returns the process exit code
+func runCommand(cfg *config.Config, db *gorm.DB, args []string) int {
+	var role, salt string
+	commands := map[string]operatorCommand{
+		"user promote": {
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(&role, "role", string(models.UserRoleAdmin), "role to give the user")
+			},
+			run: func(ops *operatorServices, ctx context.Context, target string) (string, error) {
+				return ops.promoteUser(ctx, target, models.UserRole(role))
+			},
+		},
+		"agent unpublish": {run: (*operatorServices).unpublishAgent},
+		"token revoke":    {run: (*operatorServices).revokeTokens},
+		"webhook test":    {run: (*operatorServices).testWebhook},
+		"ratings rebuild": {run: (*operatorServices).rebuildRatings, timeout: time.Hour},
+		"anonymize": {
+			flags: func(fs *flag.FlagSet) {
+				fs.StringVar(&salt, "salt", "", "secret the pseudonyms are derived from; the same salt gives the same pseudonyms")
+			},
+			run: func(ops *operatorServices, ctx context.Context, target string) (string, error) {
+				return ops.anonymize(ctx, cfg.Database.DBName, target, salt)
+			},
+			timeout: time.Hour,
+		},
+	}
+
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	name, flagArgs := args[0], args[1:]
+	command, ok := commands[name]
+	if !ok && len(args) > 1 {
+		name, flagArgs = args[0]+" "+args[1], args[2:]
+		command, ok = commands[name]
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, cliUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	reason := fs.String("reason", "", "why the operation is needed (required)")
+	if command.flags != nil {
+		command.flags(fs)
+	}
+	if err := fs.Parse(flagArgs); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || strings.TrimSpace(*reason) == "" {
+		fmt.Fprintf(os.Stderr, "%s needs one target and -reason\n\n%s", name, cliUsage)
+		return 2
+	}
+	target := fs.Arg(0)
+
+	ops, err := newOperatorServices(cfg, db)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to set up services")
+		return 1
+	}
+	ops.operator, ops.reason = operatorName(), *reason
+	timeout := command.timeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := command.run(ops, ctx, target)
+	event := log.Info()
+	if err != nil {
+		event = log.Error().Err(err)
+	}
+	event.Bool("audit", true).
+		Str("operator", ops.operator).
+		Str("command", name).
+		Str("target", target).
+		Str("reason", *reason).
+		Str("result", result).
+		Msg("Operator command")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	fmt.Println(result)
+	return 0
+}
+
+func newOperatorServices(cfg *config.Config, db *gorm.DB) (*operatorServices, error) {
+	redisSvc, err := services.NewRedisService(cfg.Redis)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := services.NewStorage(cfg.Storage)
+	if err != nil {
+		return nil, err
+	}
+	limitSvc := services.NewLimitService(db, cfg.Tiers, cfg.PublicAPI, cfg.Limits)
+	tierSvc := services.NewTierService(db, cfg.Tiers, limitSvc)
+	return &operatorServices{
+		db:       db,
+		auth:     services.NewAuthService(cfg, db, services.NewTokenDenylist(redisSvc, cfg.JWT.Expiration), redisSvc),
+		agents:   services.NewAgentService(db, services.NewAgentCache(db, cfg.Cache), tierSvc, storage, cfg.Storage.PresignExpiry, cfg.Scanning.Enabled),
+		webhooks: services.NewWebhookService(db, cfg.Webhooks),
+		reviews:  services.NewReviewService(db),
+		audit:    services.NewAuditService(db),
+	}, nil
+}
+
+// operatorName is who ran the command: the user who invoked sudo, if any,
+// or the current OS user
+func operatorName() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return "unknown"
+}
+
+// findUser looks a user up by ID or email
+func (ops *operatorServices) findUser(target string) (*models.User, error) {
+	var u models.User
+	query := ops.db.Where("email = ?", target)
+	if id, err := uuid.Parse(target); err == nil {
+		query = ops.db.Where("id = ?", id)
+	}
+	if err := query.First(&u).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("user %s not found", target)
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+// record adds an operator command's change to the audit log
+func (ops *operatorServices) record(action models.AuditAction, entityType string, entityID uuid.UUID, before, after models.AuditSnapshot) {
+	ops.audit.Record(&models.AuditLog{
+		ActorType:  models.AuditActorOperator,
+		ActorName:  ops.operator,
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Before:     before,
+		After:      after,
+		Reason:     ops.reason,
+	})
+}
+
+func (ops *operatorServices) promoteUser(ctx context.Context, target string, role models.UserRole) (string, error) {
+	switch role {
+	case models.UserRoleUser, models.UserRolePublisher, models.UserRoleReseller, models.UserRoleAdmin:
+	default:
+		return "", fmt.Errorf("unknown role %q", role)
+	}
+	u, err := ops.findUser(target)
+	if err != nil {
+		return "", err
+	}
+	if u.Role == role {
+		return fmt.Sprintf("user %s already has role %s", u.ID, role), nil
+	}
+	previous := u.Role
+	if err := ops.db.Model(u).Update("role", role).Error; err != nil {
+		return "", err
+	}
+	ops.record(models.AuditActionUserRole, "user", u.ID, models.AuditSnapshot{"role": previous}, models.AuditSnapshot{"role": role})
+
+	// The role is read from access tokens. Every role but user grants
+	// rights the new one lacks, so leaving it ends the user's sessions
+	// instead of waiting for their tokens to expire.
+	if previous == models.UserRoleUser {
+		return fmt.Sprintf("user %s role changed from %s to %s, effective from their next token refresh", u.ID, previous, role), nil
+	}
+	if err := ops.auth.RevokeAllTokens(ctx, u.ID); err != nil {
+		return "", fmt.Errorf("role changed but sessions not revoked: %w", err)
+	}
+	if err := ops.auth.InvalidateUser(ctx, u.ID); err != nil {
+		log.Warn().Err(err).Msg("Failed to invalidate cached user status")
+	}
+	return fmt.Sprintf("user %s role changed from %s to %s, sessions revoked", u.ID, previous, role), nil
+}
+
+func (ops *operatorServices) unpublishAgent(ctx context.Context, target string) (string, error) {
+	id, err := uuid.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid agent ID %q", target)
+	}
+	var agent models.Agent
+	if err := ops.db.Select("id", "status").First(&agent, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", fmt.Errorf("agent %s not found", id)
+		}
+		return "", err
+	}
+	if agent.Status != models.AgentStatusPublished {
+		return fmt.Sprintf("agent %s is not published (%s)", id, agent.Status), nil
+	}
+	if err := ops.agents.UnpublishAgent(id); err != nil {
+		return "", err
+	}
+	ops.record(models.AuditActionAgentUnpublish, "agent", id,
+		models.AuditSnapshot{"status": agent.Status}, models.AuditSnapshot{"status": models.AgentStatusDraft})
+	return fmt.Sprintf("agent %s unpublished", id), nil
+}
+
+func (ops *operatorServices) revokeTokens(ctx context.Context, target string) (string, error) {
+	u, err := ops.findUser(target)
+	if err != nil {
+		return "", err
+	}
+	if err := ops.auth.RevokeAllTokens(ctx, u.ID); err != nil {
+		return "", err
+	}
+	ops.record(models.AuditActionUserSessionsRevoke, "user", u.ID, nil, nil)
+	return fmt.Sprintf("all sessions of user %s revoked", u.ID), nil
+}
+
+func (ops *operatorServices) testWebhook(ctx context.Context, target string) (string, error) {
+	id, err := uuid.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid subscription ID %q", target)
+	}
+	code, err := ops.webhooks.SendTest(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", fmt.Errorf("webhook subscription %s not found", id)
+	}
+	ops.record(models.AuditActionWebhookTest, "webhook_subscription", id, nil, models.AuditSnapshot{"status_code": code})
+	if err != nil {
+		if code != 0 {
+			return fmt.Sprintf("receiver answered %d", code), err
+		}
+		return "", err
+	}
+	return fmt.Sprintf("ping delivered, receiver answered %d", code), nil
+}
+
+func (ops *operatorServices) rebuildRatings(ctx context.Context, target string) (string, error) {
+	if target == "all" {
+		rebuilt, err := ops.reviews.RebuildAllSummaries()
+		for _, id := range rebuilt {
+			ops.agents.InvalidateAgent(id)
+		}
+		return fmt.Sprintf("ratings of %d agents rebuilt", len(rebuilt)), err
+	}
+
+	id, err := uuid.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid agent ID %q", target)
+	}
+	if err := ops.reviews.RebuildSummary(id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", fmt.Errorf("agent %s not found", id)
+		}
+		return "", err
+	}
+	ops.agents.InvalidateAgent(id)
+	return fmt.Sprintf("rating of agent %s rebuilt", id), nil
+}
@@ -0,0 +1,15 @@
+package config
+
+// Build metadata, injected at link time:
+//
+//	go build -ldflags "-X github.com/edgeplug/marketplace/config.Version=1.4.0 \
+//	  -X github.com/edgeplug/marketplace/config.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/edgeplug/marketplace/config.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	// Version is the release the binary was built from
+	Version = "dev"
+	// Commit is the git SHA the binary was built from
+	Commit = "unknown"
+	// BuildDate is when the binary was built, in RFC 3339
+	BuildDate = "unknown"
+)
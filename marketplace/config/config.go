@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"strings"
 	"time"
 
@@ -14,10 +15,57 @@ type Config struct {
 	Database DatabaseConfig `mapstructure:"database"`
 	Redis    RedisConfig    `mapstructure:"redis"`
 	JWT      JWTConfig      `mapstructure:"jwt"`
+	PasswordReset PasswordResetConfig `mapstructure:"password_reset"`
+	Confirmations ConfirmationsConfig `mapstructure:"confirmations"`
+	Mail     MailConfig     `mapstructure:"mail"`
 	Storage  StorageConfig  `mapstructure:"storage"`
+	Search   SearchConfig   `mapstructure:"search"`
+	Scanning ScanningConfig `mapstructure:"scanning"`
 	Security SecurityConfig  `mapstructure:"security"`
 	Metrics  MetricsConfig  `mapstructure:"metrics"`
 	Logging  LoggingConfig  `mapstructure:"logging"`
+	Replication ReplicationConfig `mapstructure:"replication"`
+	Cache       CacheConfig       `mapstructure:"cache"`
+	ReviewReminders ReviewRemindersConfig `mapstructure:"review_reminders"`
+	ReviewInsights  ReviewInsightsConfig  `mapstructure:"review_insights"`
+	ReviewAttachments ReviewAttachmentsConfig `mapstructure:"review_attachments"`
+	Notifications   NotificationsConfig   `mapstructure:"notifications"`
+	Consent         ConsentConfig         `mapstructure:"consent"`
+	Webhooks        WebhooksConfig        `mapstructure:"webhooks"`
+	Events          EventsConfig          `mapstructure:"events"`
+	Jobs            JobsConfig            `mapstructure:"jobs"`
+	Scheduler       SchedulerConfig       `mapstructure:"scheduler"`
+	Checkout CheckoutConfig `mapstructure:"checkout"`
+	Payments PaymentsConfig `mapstructure:"payments"`
+	Payouts  PayoutsConfig  `mapstructure:"payouts"`
+	Currencies CurrenciesConfig `mapstructure:"currencies"`
+	Fraud    FraudConfig    `mapstructure:"fraud"`
+	Tiers    map[string]TierConfig `mapstructure:"tiers"` // keyed by publisher tier
+	Limits   LimitsConfig   `mapstructure:"limits"`
+	Metering MeteringConfig `mapstructure:"metering"`
+	FleetRollouts FleetRolloutsConfig `mapstructure:"fleet_rollouts"`
+	Transfers     TransfersConfig     `mapstructure:"transfers"`
+	DeviceImports DeviceImportsConfig `mapstructure:"device_imports"`
+	DeviceAPI     DeviceAPIConfig     `mapstructure:"device_api"`
+	DeviceJournal DeviceJournalConfig `mapstructure:"device_journal"`
+	DownloadCounter DownloadCounterConfig `mapstructure:"download_counter"`
+	Downloads     DownloadsConfig     `mapstructure:"downloads"`
+	Telemetry     TelemetryConfig     `mapstructure:"telemetry"`
+	Credits  CreditsConfig  `mapstructure:"credits"`
+	Licenses LicensesConfig `mapstructure:"licenses"`
+	Resellers ResellersConfig `mapstructure:"resellers"`
+	Subscriptions SubscriptionsConfig `mapstructure:"subscriptions"`
+	PublicStats PublicStatsConfig `mapstructure:"public_stats"`
+	AdminStats  AdminStatsConfig  `mapstructure:"admin_stats"`
+	SEO         SEOConfig         `mapstructure:"seo"`
+	PublicAPI   PublicAPIConfig   `mapstructure:"public_api"`
+	Curation    CurationConfig    `mapstructure:"curation"`
+	Ranking     RankingConfig     `mapstructure:"ranking"`
+	Trending    TrendingConfig    `mapstructure:"trending"`
+	StaleDrafts StaleDraftsConfig `mapstructure:"stale_drafts"`
+	UnsoldAgents UnsoldAgentsConfig `mapstructure:"unsold_agents"`
+	Domains  DomainsConfig  `mapstructure:"domains"`
+	Signing  SigningConfig  `mapstructure:"signing"`
 }
 
 // ServerConfig holds server-specific configuration
@@ -45,17 +93,78 @@ type DatabaseConfig struct {
 
 // RedisConfig holds Redis-specific configuration
 type RedisConfig struct {
+	Mode     string `mapstructure:"mode"` // "standalone", "sentinel", "cluster"
 	Host     string `mapstructure:"host"`
 	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
 	Password string `mapstructure:"password"`
 	DB       int    `mapstructure:"db"`
+
+	// Sentinel topology
+	MasterName       string   `mapstructure:"master_name"`
+	SentinelAddrs    []string `mapstructure:"sentinel_addrs"`
+	SentinelPassword string   `mapstructure:"sentinel_password"`
+
+	// Cluster topology
+	ClusterAddrs []string `mapstructure:"cluster_addrs"`
+
+	TLS            RedisTLSConfig `mapstructure:"tls"`
+	PoolSize       int            `mapstructure:"pool_size"`
+	DialTimeout    time.Duration  `mapstructure:"dial_timeout"`
+	ReadTimeout    time.Duration  `mapstructure:"read_timeout"`
+	WriteTimeout   time.Duration  `mapstructure:"write_timeout"`
+	HealthInterval time.Duration  `mapstructure:"health_interval"`
+	FailurePolicy  string         `mapstructure:"failure_policy"` // "open", "closed"
+}
+
+// RedisTLSConfig holds Redis TLS configuration
+type RedisTLSConfig struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	CAFile             string `mapstructure:"ca_file"`
+	CertFile           string `mapstructure:"cert_file"`
+	KeyFile            string `mapstructure:"key_file"`
+	ServerName         string `mapstructure:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
 }
 
 // JWTConfig holds JWT-specific configuration
 type JWTConfig struct {
 	Secret     string        `mapstructure:"secret"`
 	Expiration time.Duration `mapstructure:"expiration"`
+	RefreshExpiration time.Duration `mapstructure:"refresh_expiration"` // lifetime of refresh tokens
 	Issuer     string        `mapstructure:"issuer"`
+	UserCacheTTL time.Duration `mapstructure:"user_cache_ttl"` // how long a user's account status is cached in Redis
+}
+
+// PasswordResetConfig holds configuration of password resets by email
+type PasswordResetConfig struct {
+	TokenTTL          time.Duration `mapstructure:"token_ttl"`
+	ResetURL          string        `mapstructure:"reset_url"`            // web app page taking the token as ?token=
+	MaxPerHour        int           `mapstructure:"max_per_hour"`         // reset emails per account
+}
+
+// ConfirmationsConfig holds configuration of the emailed links confirming
+// sensitive actions
+type ConfirmationsConfig struct {
+	TokenTTL   time.Duration `mapstructure:"token_ttl"`
+	ConfirmURL string        `mapstructure:"confirm_url"`  // web app page taking the token as ?token=
+	MaxPerHour int           `mapstructure:"max_per_hour"` // confirmation emails per account
+}
+
+// MailConfig holds outgoing email configuration. The log provider only
+// logs messages, for development.
+type MailConfig struct {
+	Provider string     `mapstructure:"provider"` // "log", "smtp"
+	From     string     `mapstructure:"from"`
+	SMTP     SMTPConfig `mapstructure:"smtp"`
+}
+
+// SMTPConfig holds the SMTP server outgoing email is sent through
+type SMTPConfig struct {
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
 }
 
 // StorageConfig holds storage-specific configuration
@@ -64,6 +173,47 @@ type StorageConfig struct {
 	LocalDir string `mapstructure:"local_dir"`
 	S3       S3Config `mapstructure:"s3"`
 	MinIO    MinIOConfig `mapstructure:"minio"`
+	PresignExpiry time.Duration `mapstructure:"presign_expiry"` // lifetime of presigned download URLs
+	URLSecret     string        `mapstructure:"url_secret"`     // signs local file URLs, defaults to the JWT secret
+}
+
+// SearchConfig holds configuration of agent search. With the opensearch
+// backend, agent changes are queued in an outbox and indexed by a worker.
+type SearchConfig struct {
+	Backend      string        `mapstructure:"backend"` // "database", "opensearch"
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	BatchSize    int           `mapstructure:"batch_size"`    // outbox entries or reindexed agents per poll
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"` // doubled after each failed attempt, up to an hour
+	ConsistencyInterval time.Duration `mapstructure:"consistency_interval"` // between checks of the index against the database
+	MaxMatches   int           `mapstructure:"max_matches"`   // matches taken from the index per query
+	OpenSearch   OpenSearchConfig `mapstructure:"opensearch"`
+}
+
+// OpenSearchConfig holds OpenSearch-specific configuration
+type OpenSearchConfig struct {
+	URL      string        `mapstructure:"url"`
+	Index    string        `mapstructure:"index"`
+	Username string        `mapstructure:"username"`
+	Password string        `mapstructure:"password"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+}
+
+// ScanningConfig holds configuration of the scans of uploaded binaries. A
+// release can only be published once every scanner passed its binary.
+type ScanningConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	Scanners     []string      `mapstructure:"scanners"` // "clamav"
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	BatchSize    int           `mapstructure:"batch_size"`
+	Timeout      time.Duration `mapstructure:"timeout"`       // per scanner and binary
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"` // after a scanner error, doubled up to an hour
+	ClamAV       ClamAVConfig  `mapstructure:"clamav"`
+}
+
+// ClamAVConfig holds the address of a clamd daemon
+type ClamAVConfig struct {
+	Network string `mapstructure:"network"` // "tcp" or "unix"
+	Address string `mapstructure:"address"`
 }
 
 // S3Config holds AWS S3-specific configuration
@@ -83,12 +233,40 @@ type MinIOConfig struct {
 	Bucket          string `mapstructure:"bucket"`
 }
 
+// SigningConfig holds the key that signs download tokens. With the aws_kms
+// provider the private key stays in AWS KMS and is never loaded.
+type SigningConfig struct {
+	Provider         string        `mapstructure:"provider"` // "local", "aws_kms"
+	KeyFile          string        `mapstructure:"key_file"` // PEM P-256 private key for the local provider
+	KeyID            string        `mapstructure:"key_id"`   // KMS key ID or ARN; optional kid override for local keys
+	KMS              KMSConfig     `mapstructure:"kms"`
+	DownloadTokenTTL time.Duration `mapstructure:"download_token_ttl"`
+}
+
+// KMSConfig holds AWS KMS-specific configuration
+type KMSConfig struct {
+	Region          string `mapstructure:"region"`
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	Endpoint        string `mapstructure:"endpoint"` // e.g. a VPC endpoint, defaults to the regional endpoint
+}
+
 // SecurityConfig holds security-specific configuration
 type SecurityConfig struct {
-	RateLimitRequests int           `mapstructure:"rate_limit_requests"`
-	RateLimitWindow   time.Duration `mapstructure:"rate_limit_window"`
-	CORSOrigins       []string      `mapstructure:"cors_origins"`
-	AllowedHosts      []string      `mapstructure:"allowed_hosts"`
+	RateLimitRequests int                       `mapstructure:"rate_limit_requests"`
+	RateLimitWindow   time.Duration             `mapstructure:"rate_limit_window"`
+	RateLimitRoutes   map[string]RateLimitRoute `mapstructure:"rate_limit_routes"` // keyed by route path, e.g. /api/v1/auth/login
+	CORSOrigins       []string                  `mapstructure:"cors_origins"`
+	AllowedHosts      []string                  `mapstructure:"allowed_hosts"`
+	TrustedProxies    []string                  `mapstructure:"trusted_proxies"` // IPs or CIDRs whose X-Forwarded-For is believed; none by default
+	Disclosure        string                    `mapstructure:"disclosure"` // conceal or reveal private resources a user may not access
+}
+
+// RateLimitRoute overrides the request rate limit of one route. The route
+// gets its own budget instead of sharing the default one.
+type RateLimitRoute struct {
+	Requests int           `mapstructure:"requests"`
+	Window   time.Duration `mapstructure:"window"`
 }
 
 // MetricsConfig holds metrics-specific configuration
@@ -100,9 +278,397 @@ type MetricsConfig struct {
 
 // LoggingConfig holds logging-specific configuration
 type LoggingConfig struct {
-	Level      string `mapstructure:"level"`
-	Format     string `mapstructure:"format"` // "json", "console"
-	OutputPath string `mapstructure:"output_path"`
+	Level      string            `mapstructure:"level"`
+	Format     string            `mapstructure:"format"` // "json", "console"
+	OutputPath string            `mapstructure:"output_path"`
+	Sampling   LogSamplingConfig `mapstructure:"sampling"` // reloaded on SIGHUP
+}
+
+// LogSamplingConfig sets the share of requests written to the request log.
+// Route groups and tenants can have their own rates. A tenant's rates win
+// over those of the route group, which win over the defaults.
+type LogSamplingConfig struct {
+	Success float64                   `mapstructure:"success"` // share of requests answered below 400 that are logged, 0 to 1
+	Errors  float64                   `mapstructure:"errors"`  // share of requests answered 400 or above
+	Routes  map[string]LogSampleRates `mapstructure:"routes"`  // keyed by path prefix, e.g. /device/v1
+	Tenants map[string]LogSampleRates `mapstructure:"tenants"` // keyed by publisher ID
+}
+
+// LogSampleRates overrides the sampling rates for a route group or tenant.
+// A rate left out is inherited.
+type LogSampleRates struct {
+	Success *float64 `mapstructure:"success"`
+	Errors  *float64 `mapstructure:"errors"`
+}
+
+// ReplicationConfig holds multi-region replication configuration
+type ReplicationConfig struct {
+	Mode       string `mapstructure:"mode"` // "primary", "replica"
+	Region     string `mapstructure:"region"`
+	PrimaryURL string `mapstructure:"primary_url"` // base URL writes are redirected to in replica mode
+}
+
+// CacheConfig holds in-process cache configuration
+type CacheConfig struct {
+	Enabled             bool          `mapstructure:"enabled"`
+	AgentTTL            time.Duration `mapstructure:"agent_ttl"`
+	InvalidationChannel string        `mapstructure:"invalidation_channel"` // Postgres LISTEN/NOTIFY channel
+}
+
+// ReviewRemindersConfig holds post-purchase review reminder configuration
+type ReviewRemindersConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	Delay        time.Duration `mapstructure:"delay"` // time after purchase completion
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	BatchSize    int           `mapstructure:"batch_size"`
+}
+
+// ReviewAttachmentsConfig holds the limits of files attached to reviews.
+// Content types are sniffed from the file, not taken from the upload.
+type ReviewAttachmentsConfig struct {
+	MaxSize      int64         `mapstructure:"max_size"` // in bytes, per file
+	MaxPerReview int           `mapstructure:"max_per_review"`
+	ContentTypes []string      `mapstructure:"content_types"`
+	URLExpiry    time.Duration `mapstructure:"url_expiry"` // of the retrieval URLs in review payloads
+}
+
+// NotificationsConfig holds configuration of the worker emailing
+// notifications, alone or batched into digests
+type NotificationsConfig struct {
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	BatchSize    int           `mapstructure:"batch_size"` // users per poll
+	DailyHour    int           `mapstructure:"daily_hour"` // local hour daily digests go out
+	BaseURL      string        `mapstructure:"base_url"`   // web app that notification links are relative to
+}
+
+// ConsentConfig holds the current version of the consent text of each
+// purpose. Consents given to an older version no longer count.
+type ConsentConfig struct {
+	MarketingEmailVersion   string `mapstructure:"marketing_email_version"`
+	UsageAnalyticsVersion   string `mapstructure:"usage_analytics_version"`
+	TelemetrySharingVersion string `mapstructure:"telemetry_sharing_version"`
+}
+
+// WebhooksConfig holds configuration of the worker delivering webhook
+// events and of the detection of devices gone offline
+type WebhooksConfig struct {
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	BatchSize    int           `mapstructure:"batch_size"` // deliveries per poll
+	Timeout      time.Duration `mapstructure:"timeout"`    // per delivery attempt
+	MaxAttempts  int           `mapstructure:"max_attempts"`
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"` // doubled after each failed attempt
+	OfflineAfter time.Duration `mapstructure:"offline_after"` // silence before a device is reported offline
+	MaxPerUser   int           `mapstructure:"max_per_user"`  // subscriptions
+}
+
+// EventsConfig holds configuration of the live event streams of users and
+// of the worker relaying their events to Redis
+type EventsConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	RelayInterval time.Duration `mapstructure:"relay_interval"` // how often committed events are published
+	RelayBatch    int           `mapstructure:"relay_batch"`    // events published per relay
+	Retention     time.Duration `mapstructure:"retention"`      // how long reconnecting clients can catch up
+	Keepalive     time.Duration `mapstructure:"keepalive"`      // comment sent on idle streams
+	MaxPerUser    int           `mapstructure:"max_per_user"`   // open streams on an instance
+}
+
+// JobsConfig holds configuration of the background job queue and of the
+// workers running its jobs, in servers and `marketplace worker` processes
+type JobsConfig struct {
+	Embedded      bool          `mapstructure:"embedded"`    // servers also run jobs
+	Concurrency   int           `mapstructure:"concurrency"` // jobs run at once per process
+	PollInterval  time.Duration `mapstructure:"poll_interval"` // wait when the queue is empty
+	Timeout       time.Duration `mapstructure:"timeout"`     // per attempt, unless set for the job type
+	MaxAttempts   int           `mapstructure:"max_attempts"`
+	RetryBackoff  time.Duration `mapstructure:"retry_backoff"` // doubled after each failed attempt
+	MaxBackoff    time.Duration `mapstructure:"max_backoff"`
+	DeadLetterMax int64         `mapstructure:"dead_letter_max"` // failed jobs kept for inspection
+}
+
+// SchedulerConfig holds the cron specs of the periodic tasks run by the
+// replica elected leader. A task without a spec runs on its own interval on
+// every replica instead.
+type SchedulerConfig struct {
+	LeaseTTL time.Duration     `mapstructure:"lease_ttl"` // how long leadership outlives a leader that stopped renewing it
+	Tasks    map[string]string `mapstructure:"tasks"`     // cron spec per task, in UTC
+}
+
+// ReviewInsightsConfig holds configuration of the job summarizing the
+// keywords and sentiment of each agent's reviews
+type ReviewInsightsConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	PollInterval time.Duration `mapstructure:"poll_interval"` // how often agents with new reviews are recomputed
+	BatchSize    int           `mapstructure:"batch_size"`
+	MaxKeywords  int           `mapstructure:"max_keywords"`
+	MinMentions  int           `mapstructure:"min_mentions"` // reviews that must mention a keyword
+}
+
+// CheckoutConfig holds checkout session and abandoned-checkout recovery configuration
+type CheckoutConfig struct {
+	AbandonAfter    time.Duration `mapstructure:"abandon_after"` // inactivity before a checkout is abandoned
+	RecoveryEnabled bool          `mapstructure:"recovery_enabled"`
+	PollInterval    time.Duration `mapstructure:"poll_interval"`
+	BatchSize       int           `mapstructure:"batch_size"`
+}
+
+// PaymentsConfig holds payment provider configuration. With the manual
+// provider, approved refunds are recorded but paid out by hand.
+type PaymentsConfig struct {
+	Provider        string `mapstructure:"provider"` // "manual", "stripe"
+	StripeSecretKey string `mapstructure:"stripe_secret_key"`
+	WebhookSecret   string `mapstructure:"webhook_secret"` // signs the provider's webhook events; without it they are refused
+}
+
+// PayoutsConfig holds configuration of publisher payouts. Purchases are only
+// paid out once older than the hold period, so most refunds happen first.
+type PayoutsConfig struct {
+	Interval      time.Duration `mapstructure:"interval"` // how often payouts are aggregated and sent
+	HoldPeriod    time.Duration `mapstructure:"hold_period"`
+	MinimumMinor  int64         `mapstructure:"minimum_minor"` // smaller balances carry over to the next payout
+	OnboardingReturnURL string  `mapstructure:"onboarding_return_url"` // where the provider's onboarding sends publishers back to
+}
+
+// CurrenciesConfig holds the currencies agents can be priced in and where
+// exchange rates for display prices come from. The rates URL must answer
+// with {"base": ..., "rates": {"EUR": 0.92, ...}} relative to Base.
+type CurrenciesConfig struct {
+	Supported    []string      `mapstructure:"supported"` // seeded on startup; admins can add or disable more
+	Base         string        `mapstructure:"base"`
+	RatesURL     string        `mapstructure:"rates_url"`
+	SyncInterval time.Duration `mapstructure:"sync_interval"`
+	MaxRateAge   time.Duration `mapstructure:"max_rate_age"` // older rates are not used for conversion
+}
+
+// FraudConfig holds purchase fraud rule configuration. The rules themselves
+// are managed through the admin API.
+type FraudConfig struct {
+	Enabled         bool   `mapstructure:"enabled"`
+	IPCountryHeader string `mapstructure:"ip_country_header"` // set by the CDN or load balancer
+}
+
+// MeteringConfig holds usage metering and invoicing configuration
+type MeteringConfig struct {
+	PollInterval time.Duration `mapstructure:"poll_interval"` // how often to check for uninvoiced months
+}
+
+// FleetRolloutsConfig holds configuration of rollouts of an agent release
+// across a buyer's devices
+type FleetRolloutsConfig struct {
+	PollInterval     time.Duration `mapstructure:"poll_interval"`     // how often to advance rollouts
+	UpdateTimeout    time.Duration `mapstructure:"update_timeout"`    // a device that has not applied the release by then counts as failed
+	FailureThreshold int           `mapstructure:"failure_threshold"` // default percentage of failed devices that halts a rollout
+	MaxDevices       int           `mapstructure:"max_devices"`       // per rollout
+}
+
+// TransfersConfig holds configuration of moving a metered deployment from
+// a replaced device to its successor
+type TransfersConfig struct {
+	MaxPerPeriod int           `mapstructure:"max_per_period"` // transfers per buyer and agent
+	Period       time.Duration `mapstructure:"period"`
+	QuietPeriod  time.Duration `mapstructure:"quiet_period"` // the old device must not have checked in for this long, unless its certificates are revoked
+}
+
+// DeviceImportsConfig holds configuration of CSV device imports
+type DeviceImportsConfig struct {
+	PollInterval time.Duration `mapstructure:"poll_interval"` // how often to look for new imports
+	MaxFileSize  int64         `mapstructure:"max_file_size"` // in bytes
+	MaxRows      int           `mapstructure:"max_rows"`      // per file
+	RequeueAfter time.Duration `mapstructure:"requeue_after"` // an import still processing after this is started again
+}
+
+// DeviceAPIConfig holds configuration of the API devices call with client
+// certificates issued by the device CA. With server_cert_file set, the API
+// is served with mTLS on its own port; client_cert_header instead trusts the
+// certificate forwarded by a TLS-terminating proxy.
+type DeviceAPIConfig struct {
+	Enabled          bool          `mapstructure:"enabled"`
+	Port             string        `mapstructure:"port"`
+	ServerCertFile   string        `mapstructure:"server_cert_file"`
+	ServerKeyFile    string        `mapstructure:"server_key_file"`
+	CACertFile       string        `mapstructure:"ca_cert_file"`
+	CAKeyFile        string        `mapstructure:"ca_key_file"`
+	CertValidity     time.Duration `mapstructure:"cert_validity"`      // lifetime of issued device certificates
+	RotateBefore     time.Duration `mapstructure:"rotate_before"`      // devices are asked to rotate certificates expiring within this
+	ClientCertHeader string        `mapstructure:"client_cert_header"` // URL-escaped PEM, e.g. X-SSL-Client-Cert; only set when the proxy is the only way in
+}
+
+// DeviceJournalConfig holds configuration of the Redis stream that keeps
+// device API check-ins and telemetry while the database is down, to replay
+// them once it is back
+type DeviceJournalConfig struct {
+	Enabled        bool          `mapstructure:"enabled"`
+	MaxEntries     int64         `mapstructure:"max_entries"` // devices are asked to retry later once the journal holds this many
+	ReplayInterval time.Duration `mapstructure:"replay_interval"`
+	ReplayBatch    int           `mapstructure:"replay_batch"` // entries replayed per round
+}
+
+// DownloadCounterConfig holds configuration of agent download counting.
+// Buffered counts collect in Redis and are added to the database in
+// batches, so hot agents don't serialize downloads on their row.
+type DownloadCounterConfig struct {
+	Buffered      bool          `mapstructure:"buffered"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	FlushBatch    int           `mapstructure:"flush_batch"` // agent-days applied per transaction
+}
+
+// DownloadsConfig holds configuration of the artifact forms offered to
+// devices on constrained links and of the ranges they download large
+// artifacts in
+type DownloadsConfig struct {
+	Compression   bool          `mapstructure:"compression"`    // offer gzip-compressed binaries
+	Deltas        bool          `mapstructure:"deltas"`         // offer deltas from the release a device runs
+	MaxBuildSize  int64         `mapstructure:"max_build_size"` // largest binary compressed or diffed, in bytes
+	MinSavings    int           `mapstructure:"min_savings"`    // percent smaller than the binary an artifact must be to be offered
+	ChunkAfter    time.Duration `mapstructure:"chunk_after"`    // estimated transfer time beyond which ranges are planned
+	ChunkDuration time.Duration `mapstructure:"chunk_duration"` // estimated transfer time of each range
+	MinChunkSize  int64         `mapstructure:"min_chunk_size"`
+	MaxChunkSize  int64         `mapstructure:"max_chunk_size"`
+}
+
+// TelemetryConfig holds configuration of agent runtime telemetry
+type TelemetryConfig struct {
+	TimescaleDB    bool          `mapstructure:"timescaledb"`    // store samples in a hypertable rather than daily partitions
+	MaxBatchSize   int           `mapstructure:"max_batch_size"` // samples per request
+	MaxSampleAge   time.Duration `mapstructure:"max_sample_age"` // older samples are rejected, e.g. from devices offline longer
+	Retention      time.Duration `mapstructure:"retention"`
+	PollInterval   time.Duration `mapstructure:"poll_interval"`    // how often partitions are created and dropped
+	MinShareBuyers int           `mapstructure:"min_share_buyers"` // fewest buyers behind an aggregate shown to publishers
+}
+
+// CreditsConfig holds account credit configuration
+type CreditsConfig struct {
+	PollInterval time.Duration `mapstructure:"poll_interval"` // how often to expire lapsed credit
+}
+
+// LicensesConfig holds configuration of the license keys issued for paid
+// purchases. Keys expire so that devices verifying them offline notice a
+// refund; buyers fetch renewed keys before then.
+type LicensesConfig struct {
+	Validity          time.Duration `mapstructure:"validity"`
+	RenewBefore       time.Duration `mapstructure:"renew_before"`        // keys closer to expiry are reissued when listed
+	Seats             int           `mapstructure:"seats"`               // per personal purchase
+	OrganizationSeats int           `mapstructure:"organization_seats"`  // per purchase made for an organization
+}
+
+// ResellersConfig holds configuration of bulk entitlement provisioning by
+// resellers
+type ResellersConfig struct {
+	MaxFileSize int64 `mapstructure:"max_file_size"` // of a CSV or JSON batch, in bytes
+	MaxRows     int   `mapstructure:"max_rows"`      // entitlements per batch
+	MaxSeats    int   `mapstructure:"max_seats"`     // per entitlement
+}
+
+// SubscriptionsConfig holds configuration of subscription billing. A
+// subscription whose payment failed stays entitled for the grace period
+// while the provider retries, and ends after it.
+type SubscriptionsConfig struct {
+	PollInterval     time.Duration `mapstructure:"poll_interval"` // how often to end lapsed subscriptions
+	GracePeriod      time.Duration `mapstructure:"grace_period"`
+	WebhookTolerance time.Duration `mapstructure:"webhook_tolerance"` // maximum age of a signed webhook event
+}
+
+// PublicStatsConfig holds configuration of the public marketplace statistics
+type PublicStatsConfig struct {
+	CacheTTL        time.Duration `mapstructure:"cache_ttl"`
+	MinCategorySize int           `mapstructure:"min_category_size"` // smaller categories are reported as "other"
+}
+
+// AdminStatsConfig holds configuration of the admin dashboard statistics
+type AdminStatsConfig struct {
+	CacheTTL time.Duration `mapstructure:"cache_ttl"` // how long Redis keeps them; 0 disables caching
+}
+
+// SEOConfig holds configuration of the sitemap and structured data served
+// to search engines
+type SEOConfig struct {
+	BaseURL             string        `mapstructure:"base_url"`             // web app the agent and publisher pages are on
+	CacheTTL            time.Duration `mapstructure:"cache_ttl"`
+	InvalidationChannel string        `mapstructure:"invalidation_channel"` // Postgres LISTEN/NOTIFY channel
+}
+
+// PublicAPIConfig holds configuration of the read-only public API, used
+// with API product keys instead of user tokens
+type PublicAPIConfig struct {
+	MaxKeysPerUser    int `mapstructure:"max_keys_per_user"`
+	RequestsPerMinute int `mapstructure:"requests_per_minute"` // per key
+	RequestsPerDay    int `mapstructure:"requests_per_day"`    // per key, UTC days
+	SuspendAfter      int `mapstructure:"suspend_after"`       // rejected requests in a day before the key is suspended
+	UsageDays         int `mapstructure:"usage_days"`          // days of usage shown on the dashboard
+	WarnAt            int `mapstructure:"warn_at"`             // percent of the daily quota at which owners are warned, 0 to not warn
+	GracePercent      int `mapstructure:"grace_percent"`       // how far over its limits a key in grace mode may go
+}
+
+// RankingConfig holds the default weights of the agent ranking score,
+// until an admin overrides them
+type RankingConfig struct {
+	DownloadsWeight float64       `mapstructure:"downloads_weight"` // per log of downloads
+	RatingWeight    float64       `mapstructure:"rating_weight"`    // per star
+	RecencyWeight   float64       `mapstructure:"recency_weight"`   // for a just-published agent, halving every half-life
+	RecencyHalfLife time.Duration `mapstructure:"recency_half_life"`
+	VerifiedBoost   float64       `mapstructure:"verified_boost"` // added for verified publishers
+}
+
+// TrendingConfig holds configuration of the job scoring agents by their
+// recent activity for the trending sort
+type TrendingConfig struct {
+	PollInterval   time.Duration `mapstructure:"poll_interval"`
+	Window         time.Duration `mapstructure:"window"`    // activity older than this is left out
+	HalfLife       time.Duration `mapstructure:"half_life"` // activity counts half as much after this
+	DownloadWeight float64       `mapstructure:"download_weight"`
+	PurchaseWeight float64       `mapstructure:"purchase_weight"`
+	ReviewWeight   float64       `mapstructure:"review_weight"` // per five-star review; lower ratings count proportionally less
+}
+
+// StaleDraftsConfig holds configuration of the job flagging draft agents
+// their publishers stopped working on
+type StaleDraftsConfig struct {
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	After        time.Duration `mapstructure:"after"`         // untouched drafts are flagged after this
+	ArchiveAfter time.Duration `mapstructure:"archive_after"` // flagged drafts are archived after this; 0 never archives
+	BatchSize    int           `mapstructure:"batch_size"`
+}
+
+// UnsoldAgentsConfig holds the auto-archival policy of published agents
+// nobody downloads and their publisher no longer updates
+type UnsoldAgentsConfig struct {
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	After        time.Duration `mapstructure:"after"`        // agents without downloads or updates are flagged after this; 0 disables the policy
+	GracePeriod  time.Duration `mapstructure:"grace_period"` // flagged agents are archived after this
+	BatchSize    int           `mapstructure:"batch_size"`
+}
+
+// CurationConfig holds configuration of the job filling featured slots
+// from curation rules
+type CurationConfig struct {
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+}
+
+// DomainsConfig holds configuration of publishers' custom domains. With
+// serve_tls, their certificates are served on the HTTPS port, issued through
+// ACME unless the publisher uploaded one.
+type DomainsConfig struct {
+	ServeTLS         bool          `mapstructure:"serve_tls"` // off when TLS is terminated in front of the marketplace
+	HTTPSPort        string        `mapstructure:"https_port"`
+	ACMEEmail        string        `mapstructure:"acme_email"`
+	ACMEDirectoryURL string        `mapstructure:"acme_directory_url"` // defaults to Let's Encrypt
+	RefreshInterval  time.Duration `mapstructure:"refresh_interval"`   // how often other instances' domain changes are picked up
+}
+
+// TierConfig holds the commission rate and limits of a publisher plan tier.
+// A zero limit means unlimited.
+type TierConfig struct {
+	CommissionBps      int   `mapstructure:"commission_bps"` // marketplace commission in basis points
+	MaxPublishedAgents int   `mapstructure:"max_published_agents"`
+	StorageQuotaMB     int64 `mapstructure:"storage_quota_mb"`
+	RequestsPerMinute  int   `mapstructure:"requests_per_minute"`
+	MaxFleetSize       int   `mapstructure:"max_fleet_size"` // devices with active metered deployments
+	CustomDomains      bool  `mapstructure:"custom_domains"` // white-label storefronts on the publisher's domains
+}
+
+// LimitsConfig holds configuration of per-user limit overrides, which
+// replace the defaults of the tiers and the public API
+type LimitsConfig struct {
+	CacheTTL time.Duration `mapstructure:"cache_ttl"` // how long an instance keeps a user's overrides
 }
 
 // Load loads configuration from environment variables and config files
@@ -165,19 +731,75 @@ func setDefaults() {
 	viper.SetDefault("redis.host", "localhost")
 	viper.SetDefault("redis.port", 6379)
 	viper.SetDefault("redis.db", 0)
+	viper.SetDefault("redis.mode", "standalone")
+	viper.SetDefault("redis.pool_size", 10)
+	viper.SetDefault("redis.dial_timeout", "5s")
+	viper.SetDefault("redis.read_timeout", "3s")
+	viper.SetDefault("redis.write_timeout", "3s")
+	viper.SetDefault("redis.health_interval", "15s")
+	viper.SetDefault("redis.failure_policy", "open")
 
 	// JWT defaults
-	viper.SetDefault("jwt.expiration", "24h")
+	viper.SetDefault("jwt.expiration", "15m")
+	viper.SetDefault("jwt.refresh_expiration", "720h")
 	viper.SetDefault("jwt.issuer", "edgeplug-marketplace")
+	viper.SetDefault("jwt.user_cache_ttl", "30s")
+
+	// Password reset defaults
+	viper.SetDefault("password_reset.token_ttl", "1h")
+	viper.SetDefault("password_reset.max_per_hour", 3)
+
+	// Confirmation defaults
+	viper.SetDefault("confirmations.token_ttl", "30m")
+	viper.SetDefault("confirmations.max_per_hour", 5)
+
+	// Mail defaults
+	viper.SetDefault("mail.provider", "log")
+	viper.SetDefault("mail.from", "EdgePlug Marketplace <no-reply@edgeplug.local>")
+	viper.SetDefault("mail.smtp.port", 587)
 
 	// Storage defaults
 	viper.SetDefault("storage.type", "local")
 	viper.SetDefault("storage.local_dir", "./uploads")
+	viper.SetDefault("storage.presign_expiry", "15m")
+
+	// Search defaults
+	viper.SetDefault("search.backend", "database")
+	viper.SetDefault("search.poll_interval", "5s")
+	viper.SetDefault("search.batch_size", 200)
+	viper.SetDefault("search.retry_backoff", "10s")
+	viper.SetDefault("search.consistency_interval", "1h")
+	viper.SetDefault("search.max_matches", 1000)
+	viper.SetDefault("search.opensearch.index", "agents")
+	viper.SetDefault("search.opensearch.timeout", "10s")
+
+	// Scanning defaults
+	viper.SetDefault("scanning.enabled", true)
+	viper.SetDefault("scanning.scanners", []string{"clamav"})
+	viper.SetDefault("scanning.poll_interval", "15s")
+	viper.SetDefault("scanning.batch_size", 10)
+	viper.SetDefault("scanning.timeout", "2m")
+	viper.SetDefault("scanning.retry_backoff", "1m")
+	viper.SetDefault("scanning.clamav.network", "tcp")
+	viper.SetDefault("scanning.clamav.address", "localhost:3310")
+
+	// Signing defaults
+	viper.SetDefault("signing.provider", "local")
+	viper.SetDefault("signing.download_token_ttl", "1h")
 
 	// Security defaults
 	viper.SetDefault("security.rate_limit_requests", 100)
 	viper.SetDefault("security.rate_limit_window", "1m")
+	viper.SetDefault("security.rate_limit_routes", map[string]interface{}{
+		"/api/v1/auth/login":           map[string]interface{}{"requests": 5, "window": "1m"},
+		"/api/v1/auth/forgot-password": map[string]interface{}{"requests": 10, "window": "1m"},
+		"/api/v1/auth/reset-password":  map[string]interface{}{"requests": 10, "window": "1m"},
+		"/api/v1/auth/confirm":         map[string]interface{}{"requests": 10, "window": "1m"},
+		"/api/v1/stats/public":         map[string]interface{}{"requests": 30, "window": "1m"},
+		"/api/v1/licenses/verify":      map[string]interface{}{"requests": 60, "window": "1m"},
+	})
 	viper.SetDefault("security.cors_origins", []string{"*"})
+	viper.SetDefault("security.disclosure", "conceal")
 
 	// Metrics defaults
 	viper.SetDefault("metrics.enabled", true)
@@ -187,6 +809,246 @@ func setDefaults() {
 	// Logging defaults
 	viper.SetDefault("logging.level", "info")
 	viper.SetDefault("logging.format", "json")
+	viper.SetDefault("logging.sampling.success", 1.0)
+	viper.SetDefault("logging.sampling.errors", 1.0)
+
+	// Replication defaults
+	viper.SetDefault("replication.mode", "primary")
+
+	// Cache defaults
+	viper.SetDefault("cache.enabled", true)
+	viper.SetDefault("cache.agent_ttl", "5m")
+	viper.SetDefault("cache.invalidation_channel", "agent_cache_invalidation")
+
+	// Review reminder defaults
+	viper.SetDefault("review_reminders.enabled", true)
+	viper.SetDefault("review_reminders.delay", "72h")
+	viper.SetDefault("review_reminders.poll_interval", "5m")
+	viper.SetDefault("review_reminders.batch_size", 100)
+
+	// Review attachment defaults
+	viper.SetDefault("review_attachments.max_size", 2<<20)
+	viper.SetDefault("review_attachments.max_per_review", 4)
+	viper.SetDefault("review_attachments.content_types", []string{"image/png", "image/jpeg", "image/gif", "text/plain"})
+	viper.SetDefault("review_attachments.url_expiry", "15m")
+
+	// Notifications defaults
+	viper.SetDefault("notifications.poll_interval", "1m")
+	viper.SetDefault("notifications.batch_size", 200)
+	viper.SetDefault("notifications.daily_hour", 8)
+	viper.SetDefault("notifications.base_url", "http://localhost:3000")
+
+	// Consent defaults
+	viper.SetDefault("consent.marketing_email_version", "1")
+	viper.SetDefault("consent.usage_analytics_version", "1")
+	viper.SetDefault("consent.telemetry_sharing_version", "1")
+
+	// Webhooks defaults
+	viper.SetDefault("webhooks.poll_interval", "10s")
+	viper.SetDefault("webhooks.batch_size", 100)
+	viper.SetDefault("webhooks.timeout", "10s")
+	viper.SetDefault("webhooks.max_attempts", 8)
+	viper.SetDefault("webhooks.retry_backoff", "30s")
+	viper.SetDefault("webhooks.offline_after", "15m")
+	viper.SetDefault("webhooks.max_per_user", 10)
+
+	// Events defaults
+	viper.SetDefault("events.enabled", true)
+	viper.SetDefault("events.relay_interval", "500ms")
+	viper.SetDefault("events.relay_batch", 500)
+	viper.SetDefault("events.retention", "15m")
+	viper.SetDefault("events.keepalive", "20s")
+	viper.SetDefault("events.max_per_user", 5)
+
+	// Jobs defaults
+	viper.SetDefault("jobs.embedded", true)
+	viper.SetDefault("jobs.concurrency", 4)
+	viper.SetDefault("jobs.poll_interval", "1s")
+	viper.SetDefault("jobs.timeout", "1m")
+	viper.SetDefault("jobs.max_attempts", 5)
+	viper.SetDefault("jobs.retry_backoff", "10s")
+	viper.SetDefault("jobs.max_backoff", "1h")
+	viper.SetDefault("jobs.dead_letter_max", 10000)
+
+	// Scheduler defaults
+	viper.SetDefault("scheduler.lease_ttl", "30s")
+
+	// Review insights defaults
+	viper.SetDefault("review_insights.enabled", true)
+	viper.SetDefault("review_insights.poll_interval", "10m")
+	viper.SetDefault("review_insights.batch_size", 50)
+	viper.SetDefault("review_insights.max_keywords", 5)
+	viper.SetDefault("review_insights.min_mentions", 2)
+
+	// Checkout defaults
+	viper.SetDefault("checkout.abandon_after", "1h")
+	viper.SetDefault("checkout.recovery_enabled", true)
+	viper.SetDefault("checkout.poll_interval", "5m")
+	viper.SetDefault("checkout.batch_size", 100)
+
+	// Payments defaults
+	viper.SetDefault("payments.provider", "manual")
+
+	// Payouts defaults
+	viper.SetDefault("payouts.interval", "24h")
+	viper.SetDefault("payouts.hold_period", "336h")
+	viper.SetDefault("payouts.minimum_minor", 1000)
+
+	// Currencies defaults
+	viper.SetDefault("currencies.supported", []string{"USD", "EUR", "GBP", "JPY", "CHF", "CAD", "AUD"})
+	viper.SetDefault("currencies.base", "USD")
+	viper.SetDefault("currencies.rates_url", "https://api.frankfurter.app/latest?from=USD")
+	viper.SetDefault("currencies.sync_interval", "24h")
+	viper.SetDefault("currencies.max_rate_age", "72h")
+
+	// Fraud defaults
+	viper.SetDefault("fraud.enabled", true)
+	viper.SetDefault("fraud.ip_country_header", "CF-IPCountry")
+
+	// Metering defaults
+	viper.SetDefault("metering.poll_interval", "1h")
+
+	// Fleet rollout defaults
+	viper.SetDefault("fleet_rollouts.poll_interval", "30s")
+	viper.SetDefault("fleet_rollouts.update_timeout", "1h")
+	viper.SetDefault("fleet_rollouts.failure_threshold", 20)
+	viper.SetDefault("fleet_rollouts.max_devices", 1000)
+
+	// Transfer defaults
+	viper.SetDefault("transfers.max_per_period", 2)
+	viper.SetDefault("transfers.period", "720h")
+	viper.SetDefault("transfers.quiet_period", "24h")
+
+	// Device import defaults
+	viper.SetDefault("device_imports.poll_interval", "10s")
+	viper.SetDefault("device_imports.max_file_size", 2<<20)
+	viper.SetDefault("device_imports.max_rows", 5000)
+	viper.SetDefault("device_imports.requeue_after", "15m")
+
+	// Device API defaults
+	viper.SetDefault("device_api.enabled", false)
+	viper.SetDefault("device_api.port", "8444")
+	viper.SetDefault("device_api.cert_validity", "2160h")
+	viper.SetDefault("device_api.rotate_before", "720h")
+	viper.SetDefault("device_journal.enabled", false)
+	viper.SetDefault("device_journal.max_entries", 100000)
+	viper.SetDefault("device_journal.replay_interval", "5s")
+	viper.SetDefault("device_journal.replay_batch", 500)
+
+	// Download counter defaults
+	viper.SetDefault("download_counter.buffered", false)
+	viper.SetDefault("download_counter.flush_interval", "10s")
+	viper.SetDefault("download_counter.flush_batch", 500)
+
+	// Downloads defaults
+	viper.SetDefault("downloads.compression", true)
+	viper.SetDefault("downloads.deltas", true)
+	viper.SetDefault("downloads.max_build_size", 64<<20)
+	viper.SetDefault("downloads.min_savings", 10)
+	viper.SetDefault("downloads.chunk_after", "2m")
+	viper.SetDefault("downloads.chunk_duration", "30s")
+	viper.SetDefault("downloads.min_chunk_size", 64<<10)
+	viper.SetDefault("downloads.max_chunk_size", 8<<20)
+
+	// Telemetry defaults
+	viper.SetDefault("telemetry.timescaledb", false)
+	viper.SetDefault("telemetry.max_batch_size", 500)
+	viper.SetDefault("telemetry.max_sample_age", "168h")
+	viper.SetDefault("telemetry.retention", "2160h")
+	viper.SetDefault("telemetry.poll_interval", "1h")
+	viper.SetDefault("telemetry.min_share_buyers", 3)
+
+	// Credits defaults
+	viper.SetDefault("credits.poll_interval", "1h")
+	viper.SetDefault("licenses.validity", "8760h")
+	viper.SetDefault("licenses.renew_before", "720h")
+	viper.SetDefault("licenses.seats", 1)
+	viper.SetDefault("licenses.organization_seats", 25)
+
+	// Reseller defaults
+	viper.SetDefault("resellers.max_file_size", 1<<20)
+	viper.SetDefault("resellers.max_rows", 1000)
+	viper.SetDefault("resellers.max_seats", 10000)
+	viper.SetDefault("subscriptions.poll_interval", "1h")
+	viper.SetDefault("subscriptions.grace_period", "168h")
+	viper.SetDefault("subscriptions.webhook_tolerance", "5m")
+
+	// Public stats defaults
+	viper.SetDefault("public_stats.cache_ttl", "15m")
+	viper.SetDefault("public_stats.min_category_size", 3)
+
+	// Admin stats defaults
+	viper.SetDefault("admin_stats.cache_ttl", "30s")
+
+	// SEO defaults
+	viper.SetDefault("seo.base_url", "http://localhost:3000")
+	viper.SetDefault("seo.cache_ttl", "1h")
+	viper.SetDefault("seo.invalidation_channel", "seo_invalidation")
+
+	// Public API defaults
+	viper.SetDefault("public_api.max_keys_per_user", 5)
+	viper.SetDefault("public_api.requests_per_minute", 30)
+	viper.SetDefault("public_api.requests_per_day", 5000)
+	viper.SetDefault("public_api.suspend_after", 1000)
+	viper.SetDefault("public_api.usage_days", 30)
+	viper.SetDefault("public_api.warn_at", 80)
+	viper.SetDefault("public_api.grace_percent", 20)
+
+	// Curation defaults
+	viper.SetDefault("curation.poll_interval", "15m")
+
+	// Ranking defaults
+	viper.SetDefault("ranking.downloads_weight", 1.0)
+	viper.SetDefault("ranking.rating_weight", 1.0)
+	viper.SetDefault("ranking.recency_weight", 2.0)
+	viper.SetDefault("ranking.recency_half_life", "720h")
+	viper.SetDefault("ranking.verified_boost", 0.5)
+
+	// Stale draft defaults
+	viper.SetDefault("stale_drafts.poll_interval", "1h")
+	viper.SetDefault("stale_drafts.after", "2160h")
+	viper.SetDefault("stale_drafts.archive_after", "0s")
+	viper.SetDefault("stale_drafts.batch_size", 100)
+
+	// Unsold agent defaults
+	viper.SetDefault("unsold_agents.poll_interval", "6h")
+	viper.SetDefault("unsold_agents.after", "0s")
+	viper.SetDefault("unsold_agents.grace_period", "720h")
+	viper.SetDefault("unsold_agents.batch_size", 100)
+
+	// Trending defaults
+	viper.SetDefault("trending.poll_interval", "15m")
+	viper.SetDefault("trending.window", "720h")
+	viper.SetDefault("trending.half_life", "72h")
+	viper.SetDefault("trending.download_weight", 1.0)
+	viper.SetDefault("trending.purchase_weight", 5.0)
+	viper.SetDefault("trending.review_weight", 3.0)
+
+	// Custom domain defaults
+	viper.SetDefault("domains.serve_tls", false)
+	viper.SetDefault("domains.https_port", "8443")
+	viper.SetDefault("domains.refresh_interval", "1m")
+
+	// Publisher tier defaults
+	viper.SetDefault("tiers.free.commission_bps", 3000)
+	viper.SetDefault("tiers.free.max_published_agents", 3)
+	viper.SetDefault("tiers.free.storage_quota_mb", 500)
+	viper.SetDefault("tiers.free.requests_per_minute", 60)
+	viper.SetDefault("tiers.free.max_fleet_size", 10)
+	viper.SetDefault("tiers.pro.commission_bps", 1500)
+	viper.SetDefault("tiers.pro.max_published_agents", 25)
+	viper.SetDefault("tiers.pro.storage_quota_mb", 10240)
+	viper.SetDefault("tiers.pro.requests_per_minute", 600)
+	viper.SetDefault("tiers.pro.max_fleet_size", 500)
+	viper.SetDefault("tiers.enterprise.commission_bps", 800)
+	viper.SetDefault("tiers.enterprise.max_published_agents", 0)
+	viper.SetDefault("tiers.enterprise.storage_quota_mb", 0)
+	viper.SetDefault("tiers.enterprise.requests_per_minute", 0)
+	viper.SetDefault("tiers.enterprise.max_fleet_size", 0)
+	viper.SetDefault("tiers.enterprise.custom_domains", true)
+
+	// Limits defaults
+	viper.SetDefault("limits.cache_ttl", "30s")
 }
 
 // validateConfig validates the configuration
@@ -211,17 +1073,105 @@ func validateConfig(config *Config) error {
 	if config.JWT.Secret == "" {
 		return fmt.Errorf("JWT secret is required")
 	}
+	if config.JWT.RefreshExpiration <= config.JWT.Expiration {
+		return fmt.Errorf("JWT refresh expiration must be longer than the access token expiration")
+	}
+	if config.JWT.UserCacheTTL <= 0 {
+		return fmt.Errorf("JWT user cache TTL must be positive")
+	}
+
+	// Validate password reset config
+	if config.PasswordReset.TokenTTL <= 0 {
+		return fmt.Errorf("password reset token TTL must be positive")
+	}
+	if config.PasswordReset.ResetURL == "" {
+		return fmt.Errorf("password reset URL is required")
+	}
+	if config.PasswordReset.MaxPerHour <= 0 {
+		return fmt.Errorf("password reset emails per hour must be positive")
+	}
+
+	// Validate confirmations config
+	if config.Confirmations.TokenTTL <= 0 {
+		return fmt.Errorf("confirmation token TTL must be positive")
+	}
+	if config.Confirmations.ConfirmURL == "" {
+		return fmt.Errorf("confirmation URL is required")
+	}
+	if config.Confirmations.MaxPerHour <= 0 {
+		return fmt.Errorf("confirmation max per hour must be positive")
+	}
+
+	// Validate mail config
+	switch config.Mail.Provider {
+	case "log":
+		// Nothing is delivered, so users could never reset a password
+		if config.Logging.Level != "debug" {
+			return fmt.Errorf("mail provider log is only allowed with logging level debug; configure smtp")
+		}
+	case "smtp":
+		if config.Mail.SMTP.Host == "" {
+			return fmt.Errorf("SMTP host is required")
+		}
+	default:
+		return fmt.Errorf("unsupported mail provider: %s", config.Mail.Provider)
+	}
+	if config.Mail.From == "" {
+		return fmt.Errorf("mail sender address is required")
+	}
+
+	// Validate security config
+	if config.Security.RateLimitRequests <= 0 || config.Security.RateLimitWindow <= 0 {
+		return fmt.Errorf("rate limit requests and window must be positive")
+	}
+	// Validate logging config
+	if !validSampleRate(&config.Logging.Sampling.Success) || !validSampleRate(&config.Logging.Sampling.Errors) {
+		return fmt.Errorf("log sampling rates must be between 0 and 1")
+	}
+	for route, rates := range config.Logging.Sampling.Routes {
+		if !validSampleRate(rates.Success) || !validSampleRate(rates.Errors) {
+			return fmt.Errorf("log sampling rates of route %s must be between 0 and 1", route)
+		}
+	}
+	for tenant, rates := range config.Logging.Sampling.Tenants {
+		if !validSampleRate(rates.Success) || !validSampleRate(rates.Errors) {
+			return fmt.Errorf("log sampling rates of tenant %s must be between 0 and 1", tenant)
+		}
+	}
+
+	for _, proxy := range config.Security.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return fmt.Errorf("trusted proxy %q must be an IP address or CIDR", proxy)
+			}
+		}
+	}
+	for route, limit := range config.Security.RateLimitRoutes {
+		if limit.Requests <= 0 || limit.Window <= 0 {
+			return fmt.Errorf("rate limit of route %s must have positive requests and window", route)
+		}
+	}
+	if config.Security.Disclosure != "conceal" && config.Security.Disclosure != "reveal" {
+		return fmt.Errorf("security disclosure must be conceal or reveal")
+	}
 
 	// Validate storage config
 	if config.Storage.Type == "" {
 		return fmt.Errorf("storage type is required")
 	}
 
+	if config.Storage.PresignExpiry <= 0 || config.Storage.PresignExpiry > 7*24*time.Hour {
+		return fmt.Errorf("storage presign expiry must be between 0 and 7 days")
+	}
+
 	switch config.Storage.Type {
 	case "local":
 		if config.Storage.LocalDir == "" {
 			return fmt.Errorf("local storage directory is required")
 		}
+		if config.Storage.URLSecret == "" {
+			config.Storage.URLSecret = config.JWT.Secret
+		}
 	case "s3":
 		if config.Storage.S3.Region == "" {
 			return fmt.Errorf("S3 region is required")
@@ -252,16 +1202,483 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("unsupported storage type: %s", config.Storage.Type)
 	}
 
+	// Validate Redis config
+	switch config.Redis.Mode {
+	case "standalone":
+		if config.Redis.Host == "" {
+			return fmt.Errorf("Redis host is required")
+		}
+	case "sentinel":
+		if config.Redis.MasterName == "" {
+			return fmt.Errorf("Redis sentinel master name is required")
+		}
+		if len(config.Redis.SentinelAddrs) == 0 {
+			return fmt.Errorf("Redis sentinel addresses are required")
+		}
+	case "cluster":
+		if len(config.Redis.ClusterAddrs) == 0 {
+			return fmt.Errorf("Redis cluster addresses are required")
+		}
+	default:
+		return fmt.Errorf("unsupported Redis mode: %s", config.Redis.Mode)
+	}
+	if config.Redis.TLS.CertFile != "" && config.Redis.TLS.KeyFile == "" {
+		return fmt.Errorf("Redis TLS key file is required with a client certificate")
+	}
+	switch config.Redis.FailurePolicy {
+	case "open", "closed":
+	default:
+		return fmt.Errorf("unsupported Redis failure policy: %s", config.Redis.FailurePolicy)
+	}
+
+	// Validate cache config
+	if config.Cache.Enabled && config.Cache.InvalidationChannel == "" {
+		return fmt.Errorf("cache invalidation channel is required")
+	}
+
+	// Validate replication config
+	switch config.Replication.Mode {
+	case "primary":
+	case "replica":
+		if config.Replication.PrimaryURL == "" {
+			return fmt.Errorf("replication primary URL is required in replica mode")
+		}
+	default:
+		return fmt.Errorf("unsupported replication mode: %s", config.Replication.Mode)
+	}
+
+	// Validate review reminder config
+	if config.ReviewReminders.Enabled {
+		if config.ReviewReminders.Delay <= 0 || config.ReviewReminders.PollInterval <= 0 {
+			return fmt.Errorf("review reminder delay and poll interval must be positive")
+		}
+		if config.ReviewReminders.BatchSize <= 0 {
+			return fmt.Errorf("review reminder batch size must be positive")
+		}
+	}
+
+	// Validate review insights config
+	if config.ReviewInsights.Enabled {
+		if config.ReviewInsights.PollInterval <= 0 || config.ReviewInsights.BatchSize <= 0 {
+			return fmt.Errorf("review insights poll interval and batch size must be positive")
+		}
+		if config.ReviewInsights.MaxKeywords <= 0 || config.ReviewInsights.MinMentions <= 0 {
+			return fmt.Errorf("review insights max keywords and min mentions must be positive")
+		}
+	}
+
+	// Validate review attachments config
+	if config.ReviewAttachments.MaxSize <= 0 || config.ReviewAttachments.MaxPerReview <= 0 {
+		return fmt.Errorf("review attachments max size and max per review must be positive")
+	}
+	if len(config.ReviewAttachments.ContentTypes) == 0 {
+		return fmt.Errorf("review attachments need at least one content type")
+	}
+	if config.ReviewAttachments.URLExpiry <= 0 {
+		return fmt.Errorf("review attachments url expiry must be positive")
+	}
+
+	// Validate notifications config
+	if config.Notifications.PollInterval <= 0 || config.Notifications.BatchSize <= 0 {
+		return fmt.Errorf("notifications poll interval and batch size must be positive")
+	}
+	if config.Notifications.DailyHour < 0 || config.Notifications.DailyHour > 23 {
+		return fmt.Errorf("notifications daily hour must be between 0 and 23")
+	}
+
+	// Validate consent config
+	for _, version := range []string{config.Consent.MarketingEmailVersion, config.Consent.UsageAnalyticsVersion, config.Consent.TelemetrySharingVersion} {
+		if version == "" || len(version) > 32 {
+			return fmt.Errorf("consent versions must be set and at most 32 characters")
+		}
+	}
+
+	// Validate search config
+	switch config.Search.Backend {
+	case "database":
+	case "opensearch":
+		if config.Search.OpenSearch.URL == "" || config.Search.OpenSearch.Index == "" {
+			return fmt.Errorf("opensearch url and index are required")
+		}
+		if config.Search.OpenSearch.Timeout <= 0 {
+			return fmt.Errorf("opensearch timeout must be positive")
+		}
+	default:
+		return fmt.Errorf("unsupported search backend: %s", config.Search.Backend)
+	}
+	if config.Search.PollInterval <= 0 || config.Search.BatchSize <= 0 || config.Search.RetryBackoff <= 0 {
+		return fmt.Errorf("search poll interval, batch size and retry backoff must be positive")
+	}
+	if config.Search.ConsistencyInterval <= 0 || config.Search.MaxMatches <= 0 {
+		return fmt.Errorf("search consistency interval and max matches must be positive")
+	}
+
+	// Validate scanning config
+	if config.Scanning.Enabled {
+		if len(config.Scanning.Scanners) == 0 {
+			return fmt.Errorf("at least one scanner is required when scanning is enabled")
+		}
+		if config.Scanning.PollInterval <= 0 || config.Scanning.BatchSize <= 0 {
+			return fmt.Errorf("scanning poll interval and batch size must be positive")
+		}
+		if config.Scanning.Timeout <= 0 || config.Scanning.RetryBackoff <= 0 {
+			return fmt.Errorf("scanning timeout and retry backoff must be positive")
+		}
+	}
+
+	// Validate webhooks config
+	if config.Webhooks.PollInterval <= 0 || config.Webhooks.BatchSize <= 0 || config.Webhooks.Timeout <= 0 {
+		return fmt.Errorf("webhooks poll interval, batch size and timeout must be positive")
+	}
+	if config.Webhooks.MaxAttempts < 1 || config.Webhooks.RetryBackoff <= 0 {
+		return fmt.Errorf("webhooks max attempts and retry backoff must be positive")
+	}
+	if config.Webhooks.OfflineAfter <= 0 || config.Webhooks.MaxPerUser < 1 {
+		return fmt.Errorf("webhooks offline after and max per user must be positive")
+	}
+
+	// Validate events config
+	if config.Events.RelayInterval <= 0 || config.Events.RelayBatch < 1 || config.Events.Retention <= 0 {
+		return fmt.Errorf("events relay interval, relay batch and retention must be positive")
+	}
+	if config.Events.Keepalive <= 0 || config.Events.MaxPerUser < 1 {
+		return fmt.Errorf("events keepalive and max per user must be positive")
+	}
+
+	// Validate jobs config
+	if config.Jobs.Concurrency < 1 || config.Jobs.PollInterval <= 0 || config.Jobs.Timeout <= 0 {
+		return fmt.Errorf("jobs concurrency, poll interval and timeout must be positive")
+	}
+	if config.Jobs.MaxAttempts < 1 || config.Jobs.RetryBackoff <= 0 || config.Jobs.MaxBackoff < config.Jobs.RetryBackoff {
+		return fmt.Errorf("jobs max attempts and retry backoff must be positive, and max backoff at least the retry backoff")
+	}
+	if config.Jobs.DeadLetterMax < 1 {
+		return fmt.Errorf("jobs dead letter max must be positive")
+	}
+
+	// Validate scheduler config; the specs are parsed by the scheduler
+	if config.Scheduler.LeaseTTL <= 0 {
+		return fmt.Errorf("scheduler lease ttl must be positive")
+	}
+
+	// Validate publisher tiers
+	for _, name := range []string{"free", "pro", "enterprise"} {
+		tier, ok := config.Tiers[name]
+		if !ok {
+			return fmt.Errorf("publisher tier %s is not configured", name)
+		}
+		if tier.CommissionBps < 0 || tier.CommissionBps > 10000 {
+			return fmt.Errorf("publisher tier %s commission must be between 0 and 10000 basis points", name)
+		}
+		if tier.MaxPublishedAgents < 0 || tier.StorageQuotaMB < 0 || tier.RequestsPerMinute < 0 || tier.MaxFleetSize < 0 {
+			return fmt.Errorf("publisher tier %s limits must not be negative", name)
+		}
+	}
+
+	// Validate limits config
+	if config.Limits.CacheTTL <= 0 {
+		return fmt.Errorf("limits cache TTL must be positive")
+	}
+
+	// Validate metering config
+	if config.Metering.PollInterval <= 0 {
+		return fmt.Errorf("metering poll interval must be positive")
+	}
+
+	// Validate fleet rollouts config
+	if config.FleetRollouts.PollInterval <= 0 || config.FleetRollouts.UpdateTimeout <= 0 {
+		return fmt.Errorf("fleet rollout poll interval and update timeout must be positive")
+	}
+	if config.FleetRollouts.FailureThreshold < 1 || config.FleetRollouts.FailureThreshold > 100 {
+		return fmt.Errorf("fleet rollout failure threshold must be between 1 and 100")
+	}
+	if config.FleetRollouts.MaxDevices < 1 {
+		return fmt.Errorf("fleet rollout max devices must be positive")
+	}
+
+	// Validate transfers config
+	if config.Transfers.MaxPerPeriod < 1 || config.Transfers.Period <= 0 {
+		return fmt.Errorf("transfer limit and period must be positive")
+	}
+	if config.Transfers.QuietPeriod <= 0 {
+		return fmt.Errorf("transfer quiet period must be positive")
+	}
+
+	// Validate device imports config
+	if config.DeviceImports.PollInterval <= 0 || config.DeviceImports.RequeueAfter <= 0 {
+		return fmt.Errorf("device import poll interval and requeue delay must be positive")
+	}
+	if config.DeviceImports.MaxFileSize <= 0 || config.DeviceImports.MaxRows <= 0 {
+		return fmt.Errorf("device import file size and row limits must be positive")
+	}
+
+	// Validate device API config
+	if config.DeviceAPI.Enabled {
+		if config.DeviceAPI.CACertFile == "" || config.DeviceAPI.CAKeyFile == "" {
+			return fmt.Errorf("device API CA certificate and key files are required")
+		}
+		if config.DeviceAPI.ServerCertFile == "" && config.DeviceAPI.ClientCertHeader == "" {
+			return fmt.Errorf("device API needs a server certificate or a client certificate header")
+		}
+		if config.DeviceAPI.ServerCertFile != "" && (config.DeviceAPI.ServerKeyFile == "" || config.DeviceAPI.Port == "") {
+			return fmt.Errorf("device API server key file and port are required with a server certificate")
+		}
+		if config.DeviceAPI.CertValidity <= 0 || config.DeviceAPI.RotateBefore < 0 || config.DeviceAPI.RotateBefore >= config.DeviceAPI.CertValidity {
+			return fmt.Errorf("device API certificate validity must be positive and longer than rotate_before")
+		}
+	}
+
+	// Validate device journal config
+	if config.DeviceJournal.Enabled {
+		if config.DeviceJournal.MaxEntries < 1 || config.DeviceJournal.ReplayBatch < 1 {
+			return fmt.Errorf("device journal max entries and replay batch must be at least 1")
+		}
+		if config.DeviceJournal.ReplayInterval <= 0 {
+			return fmt.Errorf("device journal replay interval must be positive")
+		}
+	}
+
+	// Validate download counter config
+	if config.DownloadCounter.Buffered {
+		if config.DownloadCounter.FlushInterval <= 0 || config.DownloadCounter.FlushBatch < 1 {
+			return fmt.Errorf("download counter flush interval must be positive and flush batch at least 1")
+		}
+	}
+
+	// Validate downloads config
+	if config.Downloads.MaxBuildSize <= 0 || config.Downloads.MinSavings < 0 || config.Downloads.MinSavings > 100 {
+		return fmt.Errorf("downloads max build size must be positive and min savings between 0 and 100")
+	}
+	if config.Downloads.ChunkAfter <= 0 || config.Downloads.ChunkDuration <= 0 {
+		return fmt.Errorf("downloads chunk after and chunk duration must be positive")
+	}
+	if config.Downloads.MinChunkSize < 1 || config.Downloads.MaxChunkSize < config.Downloads.MinChunkSize {
+		return fmt.Errorf("downloads min chunk size must be positive and max chunk size at least the min")
+	}
+
+	// Validate telemetry config
+	if config.Telemetry.MaxBatchSize <= 0 || config.Telemetry.PollInterval <= 0 {
+		return fmt.Errorf("telemetry batch size and poll interval must be positive")
+	}
+	if config.Telemetry.MaxSampleAge <= 0 || config.Telemetry.Retention < config.Telemetry.MaxSampleAge {
+		return fmt.Errorf("telemetry max sample age must be positive and retention at least as long")
+	}
+	if config.Telemetry.MinShareBuyers < 1 {
+		return fmt.Errorf("telemetry min share buyers must be at least 1")
+	}
+
+	// Validate credits config
+	if config.Credits.PollInterval <= 0 {
+		return fmt.Errorf("credits poll interval must be positive")
+	}
+
+	// Validate licenses config
+	if config.Licenses.Validity <= 0 || config.Licenses.RenewBefore < 0 || config.Licenses.RenewBefore >= config.Licenses.Validity {
+		return fmt.Errorf("license validity must be positive and longer than the renewal window")
+	}
+	if config.Licenses.Seats < 1 || config.Licenses.OrganizationSeats < 1 {
+		return fmt.Errorf("license seats must be at least 1")
+	}
+	if config.Resellers.MaxFileSize <= 0 || config.Resellers.MaxRows < 1 || config.Resellers.MaxSeats < 1 {
+		return fmt.Errorf("reseller batch size, row and seat limits must be positive")
+	}
+
+	// Validate subscriptions config
+	if config.Subscriptions.PollInterval <= 0 || config.Subscriptions.GracePeriod < 0 {
+		return fmt.Errorf("subscription poll interval must be positive and grace period not negative")
+	}
+	if config.Subscriptions.WebhookTolerance <= 0 {
+		return fmt.Errorf("payment webhook tolerance must be positive")
+	}
+
+	// Validate SEO config
+	if config.SEO.BaseURL == "" || config.SEO.InvalidationChannel == "" {
+		return fmt.Errorf("SEO base URL and invalidation channel are required")
+	}
+	if config.SEO.CacheTTL <= 0 {
+		return fmt.Errorf("SEO cache TTL must be positive")
+	}
+
+	// Validate public stats config
+	if config.PublicStats.CacheTTL <= 0 {
+		return fmt.Errorf("public stats cache TTL must be positive")
+	}
+
+	// Validate admin stats config
+	if config.AdminStats.CacheTTL < 0 {
+		return fmt.Errorf("admin stats cache TTL must not be negative")
+	}
+
+	// Validate public API config
+	if config.PublicAPI.MaxKeysPerUser <= 0 {
+		return fmt.Errorf("public API max keys per user must be positive")
+	}
+	if config.PublicAPI.RequestsPerMinute <= 0 || config.PublicAPI.RequestsPerDay <= 0 {
+		return fmt.Errorf("public API request limits must be positive")
+	}
+	if config.PublicAPI.SuspendAfter <= 0 {
+		return fmt.Errorf("public API suspension threshold must be positive")
+	}
+	if config.PublicAPI.UsageDays <= 0 {
+		return fmt.Errorf("public API usage days must be positive")
+	}
+	if config.PublicAPI.WarnAt < 0 || config.PublicAPI.WarnAt > 100 {
+		return fmt.Errorf("public API warning threshold must be between 0 and 100")
+	}
+	if config.PublicAPI.GracePercent < 0 {
+		return fmt.Errorf("public API grace percent must not be negative")
+	}
+
+	// Validate ranking config
+	for _, weight := range []float64{config.Ranking.DownloadsWeight, config.Ranking.RatingWeight, config.Ranking.RecencyWeight, config.Ranking.VerifiedBoost} {
+		if weight < 0 || weight > 100 {
+			return fmt.Errorf("ranking weights must be between 0 and 100")
+		}
+	}
+	if config.Ranking.RecencyHalfLife < time.Hour {
+		return fmt.Errorf("ranking recency half-life must be at least an hour")
+	}
+
+	// Validate trending config
+	if config.Trending.PollInterval <= 0 {
+		return fmt.Errorf("trending poll interval must be positive")
+	}
+	if config.Trending.HalfLife < time.Hour || config.Trending.Window < config.Trending.HalfLife {
+		return fmt.Errorf("trending half-life must be at least an hour and no longer than the window")
+	}
+	if config.Trending.DownloadWeight < 0 || config.Trending.PurchaseWeight < 0 || config.Trending.ReviewWeight < 0 {
+		return fmt.Errorf("trending weights must not be negative")
+	}
+
+	// Validate stale drafts config
+	if config.StaleDrafts.PollInterval <= 0 || config.StaleDrafts.After <= 0 || config.StaleDrafts.BatchSize <= 0 {
+		return fmt.Errorf("stale draft poll interval, age and batch size must be positive")
+	}
+	if config.StaleDrafts.ArchiveAfter < 0 {
+		return fmt.Errorf("stale draft archive delay must not be negative")
+	}
+
+	// Validate unsold agents config
+	if config.UnsoldAgents.After < 0 {
+		return fmt.Errorf("unsold agent period must not be negative")
+	}
+	if config.UnsoldAgents.After > 0 && (config.UnsoldAgents.PollInterval <= 0 || config.UnsoldAgents.GracePeriod <= 0 || config.UnsoldAgents.BatchSize <= 0) {
+		return fmt.Errorf("unsold agent poll interval, grace period and batch size must be positive")
+	}
+
+	// Validate curation config
+	if config.Curation.PollInterval <= 0 {
+		return fmt.Errorf("curation poll interval must be positive")
+	}
+
+	// Validate payments config
+	switch config.Payments.Provider {
+	case "manual":
+	case "stripe":
+		if config.Payments.StripeSecretKey == "" {
+			return fmt.Errorf("Stripe secret key is required")
+		}
+	default:
+		return fmt.Errorf("unsupported payment provider: %s", config.Payments.Provider)
+	}
+
+	// Validate payouts config
+	if config.Payouts.Interval <= 0 {
+		return fmt.Errorf("payout interval must be positive")
+	}
+	if config.Payouts.HoldPeriod < 0 {
+		return fmt.Errorf("payout hold period must not be negative")
+	}
+	if config.Payouts.MinimumMinor < 1 {
+		return fmt.Errorf("payout minimum must be positive")
+	}
+	if config.Payments.Provider == "stripe" && config.Payouts.OnboardingReturnURL == "" {
+		return fmt.Errorf("payout onboarding return URL is required")
+	}
+
+	// Validate currencies config
+	baseSupported := false
+	for _, code := range config.Currencies.Supported {
+		if len(code) != 3 {
+			return fmt.Errorf("invalid supported currency: %s", code)
+		}
+		if strings.EqualFold(code, config.Currencies.Base) {
+			baseSupported = true
+		}
+	}
+	if !baseSupported {
+		return fmt.Errorf("base currency must be supported")
+	}
+	if config.Currencies.SyncInterval <= 0 {
+		return fmt.Errorf("exchange rate sync interval must be positive")
+	}
+	if config.Currencies.MaxRateAge < config.Currencies.SyncInterval {
+		return fmt.Errorf("exchange rate max age must be at least the sync interval")
+	}
+
+	// Validate signing config
+	switch config.Signing.Provider {
+	case "local":
+	case "aws_kms":
+		if config.Signing.KeyID == "" {
+			return fmt.Errorf("KMS signing key ID is required")
+		}
+		if config.Signing.KMS.Region == "" {
+			return fmt.Errorf("KMS region is required")
+		}
+		if config.Signing.KMS.AccessKeyID == "" || config.Signing.KMS.SecretAccessKey == "" {
+			return fmt.Errorf("KMS access key ID and secret access key are required")
+		}
+	default:
+		return fmt.Errorf("unsupported signing provider: %s", config.Signing.Provider)
+	}
+	if config.Signing.DownloadTokenTTL <= 0 {
+		return fmt.Errorf("download token TTL must be positive")
+	}
+
+	// Validate custom domain config
+	if config.Domains.ServeTLS && config.Domains.HTTPSPort == "" {
+		return fmt.Errorf("custom domains HTTPS port is required")
+	}
+	if config.Domains.RefreshInterval <= 0 {
+		return fmt.Errorf("custom domains refresh interval must be positive")
+	}
+
+	// Validate checkout config
+	if config.Checkout.AbandonAfter <= 0 || config.Checkout.PollInterval <= 0 {
+		return fmt.Errorf("checkout abandon timeout and poll interval must be positive")
+	}
+	if config.Checkout.BatchSize <= 0 {
+		return fmt.Errorf("checkout batch size must be positive")
+	}
+
 	return nil
 }
 
+// validSampleRate reports whether a log sampling rate, if set, is a share
+// between 0 and 1
+func validSampleRate(rate *float64) bool {
+	return rate == nil || (*rate >= 0 && *rate <= 1)
+}
+
 // GetDSN returns the database connection string
 func (c *DatabaseConfig) GetDSN() string {
 	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
 		c.Host, c.Port, c.User, c.Password, c.DBName, c.SSLMode)
 }
 
+// IsReplica reports whether the instance runs as a read-only standby
+func (c *ReplicationConfig) IsReplica() bool {
+	return c.Mode == "replica"
+}
+
 // GetRedisAddr returns the Redis address
 func (c *RedisConfig) GetRedisAddr() string {
 	return fmt.Sprintf("%s:%d", c.Host, c.Port)
+}
+
+// FailOpen reports whether Redis-backed features should let requests through
+// while Redis is unavailable
+func (c *RedisConfig) FailOpen() bool {
+	return c.FailurePolicy == "open"
 } 
\ No newline at end of file
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// About describes the running instance for support diagnostics: the build,
+// the optional features and backends it was configured with, and the
+// schema version of its database
+func (h *Handler) About(c *gin.Context) {
+	schema := gin.H{"version": 0}
+	var latest models.SchemaMigration
+	switch err := h.db.Order("version DESC").First(&latest).Error; err {
+	case nil:
+		schema = gin.H{"version": latest.Version, "migration": latest.Name, "applied_at": latest.AppliedAt}
+	case gorm.ErrRecordNotFound:
+	default:
+		log.Error().Err(err).Msg("Failed to get schema version")
+		schema = nil
+	}
+
+	cfg := h.config
+	c.JSON(http.StatusOK, gin.H{
+		"version":    config.Version,
+		"commit":     config.Commit,
+		"build_date": config.BuildDate,
+		"go_version": runtime.Version(),
+		"timestamp":  time.Now().UTC(),
+		"features": gin.H{
+			"cache":             cfg.Cache.Enabled,
+			"scanning":          cfg.Scanning.Enabled,
+			"metrics":           cfg.Metrics.Enabled,
+			"fraud":             cfg.Fraud.Enabled,
+			"device_api":        cfg.DeviceAPI.Enabled,
+			"review_reminders":  cfg.ReviewReminders.Enabled,
+			"review_insights":   cfg.ReviewInsights.Enabled,
+			"checkout_recovery": cfg.Checkout.RecoveryEnabled,
+			"draft_archiving":   cfg.StaleDrafts.ArchiveAfter > 0,
+		},
+		"backends": gin.H{
+			"storage":  cfg.Storage.Type,
+			"search":   cfg.Search.Backend,
+			"payments": cfg.Payments.Provider,
+			"mail":     cfg.Mail.Provider,
+			"signing":  cfg.Signing.Provider,
+		},
+		"replication": h.replSvc.Status(),
+		"schema":      schema,
+	})
+}
@@ -1,74 +1,28 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
 
 	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
 )
 
-// GetStats returns marketplace statistics for admin
+// GetStats returns marketplace statistics for admin, with week-over-week
+// deltas. They are cached briefly; refresh=true recomputes them.
 func (h *Handler) GetStats(c *gin.Context) {
-	var stats struct {
-		TotalUsers     int64 `json:"total_users"`
-		TotalAgents    int64 `json:"total_agents"`
-		TotalPurchases int64 `json:"total_purchases"`
-		TotalReviews   int64 `json:"total_reviews"`
-		PublishedAgents int64 `json:"published_agents"`
-		ActiveUsers    int64 `json:"active_users"`
-		TotalRevenue   float64 `json:"total_revenue"`
-	}
-
-	// Get user count
-	if err := h.db.Model(&models.User{}).Where("deleted_at IS NULL").Count(&stats.TotalUsers).Error; err != nil {
-		log.Error().Err(err).Msg("Failed to count users")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user count"})
-		return
-	}
-
-	// Get agent count
-	if err := h.db.Model(&models.Agent{}).Where("deleted_at IS NULL").Count(&stats.TotalAgents).Error; err != nil {
-		log.Error().Err(err).Msg("Failed to count agents")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get agent count"})
-		return
-	}
+	refresh, _ := strconv.ParseBool(c.Query("refresh"))
 
-	// Get published agent count
-	if err := h.db.Model(&models.Agent{}).Where("status = ? AND deleted_at IS NULL", models.AgentStatusPublished).Count(&stats.PublishedAgents).Error; err != nil {
-		log.Error().Err(err).Msg("Failed to count published agents")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get published agent count"})
-		return
-	}
-
-	// Get purchase count
-	if err := h.db.Model(&models.Purchase{}).Count(&stats.TotalPurchases).Error; err != nil {
-		log.Error().Err(err).Msg("Failed to count purchases")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get purchase count"})
-		return
-	}
-
-	// Get review count
-	if err := h.db.Model(&models.Review{}).Count(&stats.TotalReviews).Error; err != nil {
-		log.Error().Err(err).Msg("Failed to count reviews")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get review count"})
-		return
-	}
-
-	// Get active users (users with activity in last 30 days)
-	if err := h.db.Model(&models.User{}).Where("updated_at >= NOW() - INTERVAL '30 days' AND deleted_at IS NULL").Count(&stats.ActiveUsers).Error; err != nil {
-		log.Error().Err(err).Msg("Failed to count active users")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get active user count"})
-		return
-	}
-
-	// Get total revenue
-	if err := h.db.Model(&models.Purchase{}).Where("status = ?", models.PurchaseStatusCompleted).Select("COALESCE(SUM(amount), 0)").Scan(&stats.TotalRevenue).Error; err != nil {
-		log.Error().Err(err).Msg("Failed to calculate total revenue")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get total revenue"})
+	stats, err := h.adminStatsSvc.Get(c.Request.Context(), refresh)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to compute admin stats")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get statistics"})
 		return
 	}
 
@@ -77,7 +31,8 @@ func (h *Handler) GetStats(c *gin.Context) {
 	})
 }
 
-// GetUsers returns a list of users for admin
+// GetUsers returns a list of users for admin, by page number or, given a
+// cursor, newest first by keyset
 func (h *Handler) GetUsers(c *gin.Context) {
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
@@ -106,6 +61,27 @@ func (h *Handler) GetUsers(c *gin.Context) {
 	var users []models.User
 	var total int64
 
+	cursor, keyset, ok := cursorParam(c)
+	if !ok {
+		return
+	}
+	if keyset {
+		if err := services.Keyset(query, "users.created_at", true, cursor, limit).Find(&users).Error; err != nil {
+			log.Error().Err(err).Msg("Failed to get users")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		var next *services.Cursor
+		if len(users) > limit {
+			users = users[:limit]
+			last := users[limit-1]
+			next = services.NewCursor(last.CreatedAt, last.ID)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"users": users, "pagination": cursorPagination(limit, next)})
+		return
+	}
+
 	// Get total count
 	if err := query.Count(&total).Error; err != nil {
 		log.Error().Err(err).Msg("Failed to count users")
@@ -171,11 +147,24 @@ func (h *Handler) UpdateUserStatus(c *gin.Context) {
 	}
 
 	// Update user status
+	previous := user.Status
 	if err := h.db.Model(&user).Update("status", status).Error; err != nil {
 		log.Error().Err(err).Msg("Failed to update user status")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user status"})
 		return
 	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionUserStatus,
+		EntityType: "user",
+		EntityID:   user.ID,
+		Before:     models.AuditSnapshot{"status": previous},
+		After:      models.AuditSnapshot{"status": status},
+	})
+
+	// Otherwise the old status holds until the cached one expires
+	if err := h.authSvc.InvalidateUser(c.Request.Context(), user.ID); err != nil {
+		log.Warn().Err(err).Msg("Failed to invalidate cached user status")
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "User status updated successfully",
@@ -187,6 +176,66 @@ func (h *Handler) UpdateUserStatus(c *gin.Context) {
 	})
 }
 
+// UpdateUserTier assigns a publisher plan tier to a user (admin only). The
+// tier in the user's token is updated the next time a token is issued.
+func (h *Handler) UpdateUserTier(c *gin.Context) {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req struct {
+		Tier string `json:"tier" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	if err := h.db.Select("id", "tier").First(&user, userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Database error getting user")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	tier := models.PublisherTier(req.Tier)
+	if err := h.tierSvc.SetTier(userID, tier); err != nil {
+		switch err {
+		case services.ErrUnknownTier:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tier"})
+		case gorm.ErrRecordNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		default:
+			log.Error().Err(err).Msg("Failed to update user tier")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user tier"})
+		}
+		return
+	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionUserTier,
+		EntityType: "user",
+		EntityID:   userID,
+		Before:     models.AuditSnapshot{"tier": user.Tier},
+		After:      models.AuditSnapshot{"tier": tier},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "User tier updated successfully",
+		"user": gin.H{
+			"id":   userID,
+			"tier": tier,
+			"plan": h.tierSvc.Plan(tier),
+		},
+	})
+}
+
 // GetUserDetails returns detailed user information for admin
 func (h *Handler) GetUserDetails(c *gin.Context) {
 	userID, err := uuid.Parse(c.Param("id"))
@@ -275,10 +324,33 @@ func (h *Handler) ApproveAgent(c *gin.Context) {
 
 	// Update agent status to published
 	if err := h.agentSvc.PublishAgent(agentID); err != nil {
+		if err == services.ErrAgentLimitReached {
+			c.JSON(http.StatusConflict, gin.H{"error": "Publisher has reached the published agent limit of their plan"})
+			return
+		}
+		if publishError(c, err) {
+			return
+		}
 		log.Error().Err(err).Msg("Failed to approve agent")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve agent"})
 		return
 	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionAgentApprove,
+		EntityType: "agent",
+		EntityID:   agentID,
+		Before:     models.AuditSnapshot{"status": agent.Status},
+		After:      models.AuditSnapshot{"status": models.AgentStatusPublished},
+	})
+	if err := h.notificationSvc.Notify(&models.Notification{
+		UserID: agent.PublisherID,
+		Type:   models.NotificationTypeAgentApproved,
+		Title:  agent.Name + " was approved",
+		Body:   agent.Name + " is now published on the marketplace.",
+		Link:   fmt.Sprintf("/agents/%s", agent.ID),
+	}); err != nil {
+		log.Error().Err(err).Msg("Failed to notify publisher of approval")
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Agent approved successfully",
@@ -316,11 +388,34 @@ func (h *Handler) RejectAgent(c *gin.Context) {
 	}
 
 	// Update agent status to rejected
+	previous := agent.Status
 	if err := h.db.Model(&agent).Update("status", models.AgentStatusRejected).Error; err != nil {
 		log.Error().Err(err).Msg("Failed to reject agent")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reject agent"})
 		return
 	}
+	h.agentSvc.InvalidateAgent(agent.ID)
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionAgentReject,
+		EntityType: "agent",
+		EntityID:   agent.ID,
+		Before:     models.AuditSnapshot{"status": previous},
+		After:      models.AuditSnapshot{"status": models.AgentStatusRejected},
+		Reason:     req.Reason,
+	})
+	notification := &models.Notification{
+		UserID: agent.PublisherID,
+		Type:   models.NotificationTypeAgentRejected,
+		Title:  agent.Name + " was rejected",
+		Body:   agent.Name + " was not approved for the marketplace.",
+		Link:   fmt.Sprintf("/agents/%s", agent.ID),
+	}
+	if req.Reason != "" {
+		notification.Body += " Reason: " + req.Reason
+	}
+	if err := h.notificationSvc.Notify(notification); err != nil {
+		log.Error().Err(err).Msg("Failed to notify publisher of rejection")
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Agent rejected successfully",
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// GetAgentHistory lists the past versions of an agent's listing, each with
+// the period it was shown in. With ?as_of= (RFC 3339) it returns only the
+// version shown at that time.
+func (h *Handler) GetAgentHistory(c *gin.Context) {
+	agentID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
+		return
+	}
+	if c.Query("as_of") != "" {
+		h.getAgentAsOf(c, agentID)
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	history, total, err := h.agentSvc.GetAgentHistory(agentID, page, limit)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to get agent history")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"history": history,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// getAgentAsOf writes the version of an agent's listing shown at the as_of
+// query time
+func (h *Handler) getAgentAsOf(c *gin.Context, agentID uuid.UUID) {
+	asOf, err := time.Parse(time.RFC3339, c.Query("as_of"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "as_of must be an RFC 3339 time"})
+		return
+	}
+
+	entry, err := h.agentSvc.GetAgentAsOf(agentID, asOf)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"agent": entry, "as_of": asOf})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent was not listed at that time"})
+	default:
+		log.Error().Err(err).Msg("Failed to get agent history")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
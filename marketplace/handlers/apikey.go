@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetAPIKeys returns the current user's public API keys
+func (h *Handler) GetAPIKeys(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	keys, err := h.apiKeySvc.GetKeys(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get API keys")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// CreateAPIKey creates a public API key for the current user. The key is
+// only shown in this response.
+func (h *Handler) CreateAPIKey(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Name string `json:"name" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, secret, err := h.apiKeySvc.CreateKey(userID.(uuid.UUID), strings.TrimSpace(req.Name))
+	switch err {
+	case nil:
+	case services.ErrAPIKeyLimit:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to create API key")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"api_key": key, "key": secret})
+}
+
+// RevokeAPIKey permanently disables one of the current user's API keys
+func (h *Handler) RevokeAPIKey(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	keyID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	switch err := h.apiKeySvc.RevokeKey(userID.(uuid.UUID), keyID); err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+	default:
+		log.Error().Err(err).Msg("Failed to revoke API key")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// SetAPIKeyGraceMode turns grace mode on or off for one of the current
+// user's API keys, so a production integration going over its limits gets
+// warnings before it gets 429s
+func (h *Handler) SetAPIKeyGraceMode(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	keyID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	var req struct {
+		GraceMode *bool `json:"grace_mode" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, err := h.apiKeySvc.SetGraceMode(userID.(uuid.UUID), keyID, *req.GraceMode)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"api_key": key})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+	default:
+		log.Error().Err(err).Msg("Failed to set API key grace mode")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// GetAPIKeyUsage returns the daily usage and limits of one of the current
+// user's API keys
+func (h *Handler) GetAPIKeyUsage(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	keyID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	report, err := h.apiKeySvc.GetUsage(userID.(uuid.UUID), keyID)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to get API key usage")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"usage": report})
+}
+
+// GetAllAPIKeys lists the public API keys of all users (admin only)
+func (h *Handler) GetAllAPIKeys(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	status := models.APIKeyStatus(c.Query("status"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	keys, total, err := h.apiKeySvc.GetAllKeys(status, page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get API keys")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"api_keys": keys,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// UpdateAPIKeyStatus suspends or reactivates a public API key (admin only)
+func (h *Handler) UpdateAPIKeyStatus(c *gin.Context) {
+	keyID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	var req struct {
+		Status string `json:"status" binding:"required"`
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := models.APIKeyStatus(req.Status)
+	switch status {
+	case models.APIKeyStatusActive, models.APIKeyStatusSuspended:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+
+	var previous models.APIKeyStatus
+	if err := h.db.Model(&models.APIKey{}).Where("id = ?", keyID).Pluck("status", &previous).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to get API key status")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	key, err := h.apiKeySvc.SetStatus(keyID, status, req.Reason)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to update API key status")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionAPIKeyStatus,
+		EntityType: "api_key",
+		EntityID:   key.ID,
+		Before:     models.AuditSnapshot{"status": previous},
+		After:      models.AuditSnapshot{"status": key.Status},
+		Reason:     req.Reason,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"api_key": key})
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// audit records a change made by the requesting user, filling in who made
+// it and from where
+func (h *Handler) audit(c *gin.Context, entry *models.AuditLog) {
+	entry.ActorType = models.AuditActorUser
+	if account, exists := c.Get("service_account"); exists {
+		// Service accounts act for their owner but are recorded as themselves
+		sa := account.(*models.ServiceAccount)
+		entry.ActorType = models.AuditActorServiceAccount
+		entry.ActorID = &sa.ID
+		entry.ActorName = sa.Name
+	} else if userID, exists := c.Get("user_id"); exists {
+		actorID := userID.(uuid.UUID)
+		entry.ActorID = &actorID
+	}
+	entry.ActorRole = c.GetString("user_role")
+	entry.IP = c.ClientIP()
+	h.auditSvc.Record(entry)
+}
+
+// GetAuditLogs lists audit log entries, newest first, optionally filtered
+// by actor_id, actor_type, entity_type, entity_id, action and an RFC 3339
+// from/to time range (admin only)
+func (h *Handler) GetAuditLogs(c *gin.Context) {
+	filter := services.AuditLogFilter{
+		ActorType:  models.AuditActor(c.Query("actor_type")),
+		EntityType: c.Query("entity_type"),
+		Action:     models.AuditAction(c.Query("action")),
+	}
+	for param, dest := range map[string]**uuid.UUID{"actor_id": &filter.ActorID, "entity_id": &filter.EntityID} {
+		if raw := c.Query(param); raw != "" {
+			id, err := uuid.Parse(raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+				return
+			}
+			*dest = &id
+		}
+	}
+	for param, dest := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		if raw := c.Query(param); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + ", expected an RFC 3339 time"})
+				return
+			}
+			*dest = &t
+		}
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	logs, total, err := h.auditSvc.GetLogs(filter, page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get audit logs")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"audit_logs": logs,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
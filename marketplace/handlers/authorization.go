@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// notFoundMessages are the errors of resources that do not exist, also
+// returned for hidden ones under the conceal policy
+var notFoundMessages = map[services.Resource]string{
+	services.ResourceAgent:    "Agent not found",
+	services.ResourceDevice:   "Device not found",
+	services.ResourcePurchase: "Purchase not found",
+}
+
+// authorizeAgent checks that the current user may act on an agent, writing
+// the error response otherwise
+func (h *Handler) authorizeAgent(c *gin.Context, agent *models.Agent, action services.AgentAction) bool {
+	userID, _ := c.Get("user_id")
+	id, _ := userID.(uuid.UUID)
+	role := models.UserRole(c.GetString("user_role"))
+	return !h.accessError(c, services.ResourceAgent, h.authzSvc.AuthorizeAgent(agent, id, role, action))
+}
+
+// resourceNotFound answers a lookup of a resource among the current user's
+// own that found nothing
+func (h *Handler) resourceNotFound(c *gin.Context, resource services.Resource, id string) {
+	h.accessError(c, resource, h.authzSvc.Missing(resource, id))
+}
+
+// accessError writes the response for an error of the authorization
+// service and returns true, or returns false if err is nil. Denied
+// requests for hidden resources answer 404 under the conceal policy, and
+// other denied requests 403.
+func (h *Handler) accessError(c *gin.Context, resource services.Resource, err error) bool {
+	var denied *services.AccessError
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &denied):
+		if h.authzSvc.Conceals(denied) {
+			c.JSON(http.StatusNotFound, gin.H{"error": notFoundMessages[resource]})
+		} else {
+			c.JSON(http.StatusForbidden, gin.H{"error": denied.Reason})
+		}
+	case err == gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": notFoundMessages[resource]})
+	default:
+		log.Error().Err(err).Str("resource", string(resource)).Msg("Failed to authorize request")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+	return true
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/services"
+)
+
+// immutableCacheControl lets clients and CDNs keep avatars and identicons,
+// whose content never changes under a URL
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// UploadAvatar sets the current user's avatar from a multipart form. The
+// optional crop_x, crop_y and crop_size fields select the square to keep.
+func (h *Handler) UploadAvatar(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	upload, closeFile, ok := formUpload(c, services.MaxAvatarSize)
+	if !ok {
+		return
+	}
+	defer closeFile()
+	crop, ok := avatarCrop(c)
+	if !ok {
+		return
+	}
+
+	url, err := h.avatarSvc.SetUserAvatar(c.Request.Context(), userID.(uuid.UUID), upload, crop)
+	if !avatarError(c, err, "Failed to upload avatar") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"avatar_url": url})
+}
+
+// DeleteAvatar reverts the current user's avatar to their identicon
+func (h *Handler) DeleteAvatar(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	url, err := h.avatarSvc.RemoveUserAvatar(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to remove avatar")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"avatar_url": url})
+}
+
+// UploadOrgLogo sets an organization's logo from a multipart form, cropped
+// like an avatar (owners only)
+func (h *Handler) UploadOrgLogo(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, ok := orgParam(c)
+	if !ok {
+		return
+	}
+	upload, closeFile, ok := formUpload(c, services.MaxAvatarSize)
+	if !ok {
+		return
+	}
+	defer closeFile()
+	crop, ok := avatarCrop(c)
+	if !ok {
+		return
+	}
+
+	url, err := h.avatarSvc.SetOrgLogo(c.Request.Context(), orgID, userID.(uuid.UUID), upload, crop)
+	if !avatarError(c, err, "Failed to upload organization logo") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"logo_url": url})
+}
+
+// DeleteOrgLogo reverts an organization's logo to its identicon (owners
+// only)
+func (h *Handler) DeleteOrgLogo(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, ok := orgParam(c)
+	if !ok {
+		return
+	}
+
+	url, err := h.avatarSvc.RemoveOrgLogo(orgID, userID.(uuid.UUID))
+	if err != nil {
+		writeOrgError(c, err, "Failed to remove organization logo")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"logo_url": url})
+}
+
+// GetAvatar serves a processed avatar or logo
+func (h *Handler) GetAvatar(c *gin.Context) {
+	name := c.Param("name")
+	etag := `"` + strings.TrimSuffix(name, ".png") + `"`
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	body, err := h.avatarSvc.GetAvatar(c.Request.Context(), name)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound, services.ErrObjectNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Avatar not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to get avatar")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer body.Close()
+
+	c.Header("Cache-Control", immutableCacheControl)
+	c.Header("ETag", etag)
+	c.Header("Content-Type", "image/png")
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, body); err != nil {
+		log.Warn().Err(err).Str("avatar", name).Msg("Failed to send avatar")
+	}
+}
+
+// GetIdenticon serves the generated image of a user or organization, e.g.
+// /identicons/{id}.png
+func (h *Handler) GetIdenticon(c *gin.Context) {
+	id, err := uuid.Parse(strings.TrimSuffix(c.Param("name"), ".png"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identicon not found"})
+		return
+	}
+
+	image, err := h.avatarSvc.Identicon(id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to render identicon")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.Header("Cache-Control", immutableCacheControl)
+	c.Data(http.StatusOK, "image/png", image)
+}
+
+// avatarCrop reads the optional crop of an avatar upload. The three fields
+// must be sent together.
+func avatarCrop(c *gin.Context) (*services.AvatarCrop, bool) {
+	fields := []string{c.PostForm("crop_x"), c.PostForm("crop_y"), c.PostForm("crop_size")}
+	if fields[0] == "" && fields[1] == "" && fields[2] == "" {
+		return nil, true
+	}
+
+	var values [3]int
+	for i, field := range fields {
+		value, err := strconv.Atoi(field)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "crop_x, crop_y and crop_size must be sent together as integers"})
+			return nil, false
+		}
+		values[i] = value
+	}
+	return &services.AvatarCrop{X: values[0], Y: values[1], Size: values[2]}, true
+}
+
+// avatarError writes the response for a failed avatar or logo upload and
+// returns false, or returns true if err is nil
+func avatarError(c *gin.Context, err error, msg string) bool {
+	switch err {
+	case nil:
+		return true
+	case services.ErrInvalidImage:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case services.ErrImageTooLarge:
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case services.ErrInvalidCrop:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		writeOrgError(c, err, msg)
+	}
+	return false
+}
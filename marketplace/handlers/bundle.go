@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetBundles returns agent bundles
+func (h *Handler) GetBundles(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	bundles, total, err := h.bundleSvc.GetBundles(page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get bundles")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"bundles": bundles,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// GetBundle returns a bundle with its components and wiring
+func (h *Handler) GetBundle(c *gin.Context) {
+	bundle, ok := h.findBundle(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"bundle": bundle})
+}
+
+// GetBundleBudget returns a bundle's combined resource use against its
+// target device, or against the device given in the query
+func (h *Handler) GetBundleBudget(c *gin.Context) {
+	bundle, ok := h.findBundle(c)
+	if !ok {
+		return
+	}
+
+	device := services.DeviceBudget{
+		FlashSize:  bundle.TargetFlashSize,
+		SRAMSize:   bundle.TargetSRAMSize,
+		MaxLatency: bundle.TargetMaxLatency,
+	}
+	for param, limit := range map[string]*int{
+		"flash_size":  &device.FlashSize,
+		"sram_size":   &device.SRAMSize,
+		"max_latency": &device.MaxLatency,
+	} {
+		if value, ok := c.GetQuery(param); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+				return
+			}
+			*limit = n
+		}
+	}
+
+	budget, err := h.bundleSvc.Budget(bundle, device)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to compute bundle budget")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"budget": budget})
+}
+
+// CreateBundle composes agents into a bundle
+func (h *Handler) CreateBundle(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Name        string `json:"name" binding:"required"`
+		Description string `json:"description"`
+		Components  []struct {
+			Key     string    `json:"key" binding:"required"`
+			AgentID uuid.UUID `json:"agent_id" binding:"required"`
+			Version string    `json:"version"` // defaults to the agent's current version
+		} `json:"components" binding:"required,dive"`
+		Wiring []models.BundleConnection `json:"wiring"`
+		Target services.DeviceBudget     `json:"target"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Target.FlashSize < 0 || req.Target.SRAMSize < 0 || req.Target.MaxLatency < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Target device limits must not be negative"})
+		return
+	}
+
+	bundle := models.Bundle{
+		OwnerID:          userID.(uuid.UUID),
+		Name:             req.Name,
+		Description:      req.Description,
+		Wiring:           req.Wiring,
+		TargetFlashSize:  req.Target.FlashSize,
+		TargetSRAMSize:   req.Target.SRAMSize,
+		TargetMaxLatency: req.Target.MaxLatency,
+	}
+	for _, component := range req.Components {
+		bundle.Components = append(bundle.Components, models.BundleComponent{
+			Key:     component.Key,
+			AgentID: component.AgentID,
+			Version: component.Version,
+		})
+	}
+
+	budget, err := h.bundleSvc.CreateBundle(&bundle)
+	switch {
+	case err == nil:
+	case errors.Is(err, services.ErrInvalidBundle):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err == services.ErrBundleOverBudget:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "budget": budget})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to create bundle")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create bundle"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Bundle created successfully",
+		"bundle":  bundle,
+		"budget":  budget,
+	})
+}
+
+// DeleteBundle deletes one of the current user's bundles
+func (h *Handler) DeleteBundle(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bundle ID"})
+		return
+	}
+
+	if err := h.bundleSvc.DeleteBundle(id, userID.(uuid.UUID)); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Bundle not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete bundle")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete bundle"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Bundle deleted successfully"})
+}
+
+// PurchaseBundle buys every one-time agent in a bundle the user does not own yet
+func (h *Handler) PurchaseBundle(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bundle ID"})
+		return
+	}
+
+	var req struct {
+		PaymentID      string `json:"payment_id"`
+		BillingCountry string `json:"billing_country"`
+		UseCredit      bool   `json:"use_credit"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	purchases, err := h.bundleSvc.Purchase(id, userID.(uuid.UUID), services.CheckoutCompletion{
+		PaymentID:      req.PaymentID,
+		BillingCountry: req.BillingCountry,
+		IP:             c.ClientIP(),
+		IPCountry:      c.GetHeader(h.config.Fraud.IPCountryHeader),
+		UseCredit:      req.UseCredit,
+	})
+	switch {
+	case err == nil:
+	case err == gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bundle not found"})
+		return
+	case errors.Is(err, services.ErrAgentNotPurchasable), errors.Is(err, services.ErrFleetLimitReached):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "purchases": purchases})
+		return
+	case errors.Is(err, services.ErrPaymentRequired):
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error(), "purchases": purchases})
+		return
+	case errors.Is(err, services.ErrPurchaseBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Purchase could not be completed", "purchases": purchases})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to purchase bundle")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purchase bundle", "purchases": purchases})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":   "Bundle checked out successfully",
+		"purchases": purchases,
+	})
+}
+
+// DeployBundle deploys a bundle on one of the user's devices
+func (h *Handler) DeployBundle(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bundle ID"})
+		return
+	}
+
+	var req struct {
+		DeviceID string `json:"device_id" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deployments, err := h.bundleSvc.Deploy(id, userID.(uuid.UUID), req.DeviceID)
+	switch {
+	case err == nil:
+	case err == gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bundle not found"})
+		return
+	case err == services.ErrBundleNotOwned:
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "Purchase the bundle before deploying it"})
+		return
+	case errors.Is(err, services.ErrAgentNotPurchasable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "deployments": deployments})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to deploy bundle")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deploy bundle", "deployments": deployments})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":     "Bundle deployed successfully",
+		"deployments": deployments,
+	})
+}
+
+// findBundle loads the bundle in the :id parameter, writing the error
+// response and returning false if it cannot
+func (h *Handler) findBundle(c *gin.Context) (*models.Bundle, bool) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bundle ID"})
+		return nil, false
+	}
+
+	bundle, err := h.bundleSvc.GetBundle(id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Bundle not found"})
+			return nil, false
+		}
+		log.Error().Err(err).Msg("Failed to get bundle")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return nil, false
+	}
+	return bundle, true
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// GetAgentCapabilities returns the capability descriptor of an agent's
+// current version, or of the version in ?version=
+func (h *Handler) GetAgentCapabilities(c *gin.Context) {
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+
+	capabilities, err := h.capabilitySvc.GetCapabilities(agent.ID, c.DefaultQuery("version", agent.Version))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No capabilities declared for this version"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to get agent capabilities")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"capabilities": capabilities})
+}
+
+// SaveAgentCapabilities declares the capabilities of one of the publisher's
+// agents for its current version, or for the version given in the body
+func (h *Handler) SaveAgentCapabilities(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Version    string                      `json:"version"`
+		Descriptor models.CapabilityDescriptor `json:"descriptor"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.capabilitySvc.ValidateDescriptor(&req.Descriptor); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	capabilities := models.AgentCapabilities{
+		AgentID:    agent.ID,
+		Version:    req.Version,
+		Descriptor: req.Descriptor,
+	}
+	if capabilities.Version == "" {
+		capabilities.Version = agent.Version
+	}
+	if _, err := h.agentSvc.GetVersion(agent.ID, capabilities.Version); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Version not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to get agent version")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if err := h.capabilitySvc.SaveCapabilities(&capabilities); err != nil {
+		log.Error().Err(err).Msg("Failed to save agent capabilities")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save capabilities"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Capabilities saved successfully",
+		"capabilities": capabilities,
+	})
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetPlatformChangelog returns the published platform release notes, most
+// recent first, optionally of one ?category= and published after an
+// RFC 3339 ?since= for clients polling for news
+func (h *Handler) GetPlatformChangelog(c *gin.Context) {
+	h.listChangelog(c, false)
+}
+
+// GetPlatformChangelogEntry returns a published platform release note
+func (h *Handler) GetPlatformChangelogEntry(c *gin.Context) {
+	entry, ok := h.findChangelogEntry(c, false)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entry": entry})
+}
+
+// GetAdminChangelog returns the platform release notes including drafts
+// (admin only)
+func (h *Handler) GetAdminChangelog(c *gin.Context) {
+	h.listChangelog(c, true)
+}
+
+// CreateChangelogEntry adds a draft platform release note (admin only)
+func (h *Handler) CreateChangelogEntry(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Title    string `json:"title" binding:"required,max=200"`
+		Body     string `json:"body" binding:"required"`
+		Category string `json:"category" binding:"required"`
+		Version  string `json:"version" binding:"max=50"`
+		Audience string `json:"audience"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entry := models.PlatformChangelogEntry{
+		Title:    req.Title,
+		Body:     req.Body,
+		Category: models.ChangelogCategory(req.Category),
+		Version:  req.Version,
+		Audience: models.ChangelogAudience(req.Audience),
+		AuthorID: userID.(uuid.UUID),
+	}
+	if entry.Audience == "" {
+		entry.Audience = models.ChangelogAudienceAll
+	}
+	if !h.changelogError(c, h.changelogSvc.SaveEntry(&entry), "save changelog entry") {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"entry": entry})
+}
+
+// UpdateChangelogEntry changes a platform release note (admin only). Edits
+// to a published entry show in the changelog but are not announced again.
+func (h *Handler) UpdateChangelogEntry(c *gin.Context) {
+	entry, ok := h.findChangelogEntry(c, true)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Title    *string `json:"title" binding:"omitempty,min=1,max=200"`
+		Body     *string `json:"body" binding:"omitempty,min=1"`
+		Category *string `json:"category"`
+		Version  *string `json:"version" binding:"omitempty,max=50"`
+		Audience *string `json:"audience"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Title != nil {
+		entry.Title = *req.Title
+	}
+	if req.Body != nil {
+		entry.Body = *req.Body
+	}
+	if req.Category != nil {
+		entry.Category = models.ChangelogCategory(*req.Category)
+	}
+	if req.Version != nil {
+		entry.Version = *req.Version
+	}
+	if req.Audience != nil {
+		entry.Audience = models.ChangelogAudience(*req.Audience)
+	}
+	if !h.changelogError(c, h.changelogSvc.SaveEntry(entry), "save changelog entry") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entry": entry})
+}
+
+// PublishChangelogEntry publishes a platform release note and notifies its
+// audience (admin only)
+func (h *Handler) PublishChangelogEntry(c *gin.Context) {
+	entry, ok := h.findChangelogEntry(c, true)
+	if !ok {
+		return
+	}
+
+	notified, err := h.changelogSvc.Publish(entry)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to publish changelog entry")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish changelog entry"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entry": entry, "notified": notified})
+}
+
+// DeleteChangelogEntry removes a platform release note (admin only)
+func (h *Handler) DeleteChangelogEntry(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid entry ID"})
+		return
+	}
+
+	if err := h.changelogSvc.DeleteEntry(id); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Changelog entry not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete changelog entry")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete changelog entry"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Changelog entry deleted successfully"})
+}
+
+// listChangelog writes a page of changelog entries
+func (h *Handler) listChangelog(c *gin.Context, drafts bool) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	filter := services.ChangelogFilter{
+		Drafts:   drafts,
+		Category: models.ChangelogCategory(c.Query("category")),
+	}
+	if raw := c.Query("since"); raw != "" {
+		since, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be an RFC 3339 time"})
+			return
+		}
+		filter.Since = &since
+	}
+
+	entries, total, err := h.changelogSvc.GetEntries(filter, page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get changelog")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// findChangelogEntry loads the changelog entry in the :id route parameter,
+// writing the error response if it cannot
+func (h *Handler) findChangelogEntry(c *gin.Context, drafts bool) (*models.PlatformChangelogEntry, bool) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid entry ID"})
+		return nil, false
+	}
+
+	entry, err := h.changelogSvc.GetEntry(id, drafts)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Changelog entry not found"})
+			return nil, false
+		}
+		log.Error().Err(err).Msg("Failed to get changelog entry")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return nil, false
+	}
+	return entry, true
+}
+
+// changelogError writes the response for a changelog service error,
+// returning true if there was none
+func (h *Handler) changelogError(c *gin.Context, err error, action string) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, services.ErrInvalidChangelogEntry):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to " + action)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action})
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// StartCheckout opens (or resumes) a checkout session for an agent
+func (h *Handler) StartCheckout(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		AgentID string     `json:"agent_id" binding:"required"`
+		PlanID  *uuid.UUID `json:"plan_id"` // a one-time plan, instead of the agent's price
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	agentID, err := uuid.Parse(req.AgentID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
+		return
+	}
+
+	session, err := h.checkoutSvc.StartCheckout(userID.(uuid.UUID), agentID, req.PlanID)
+	switch err {
+	case nil:
+	case services.ErrAgentNotPurchasable:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	case services.ErrPlanNotAvailable:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pricing plan not found"})
+		return
+	case services.ErrPlanNotRecurring:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrAlreadyPurchased:
+		c.JSON(http.StatusConflict, gin.H{"error": "You have already purchased this agent"})
+		return
+	case services.ErrAgentMetered:
+		c.JSON(http.StatusConflict, gin.H{"error": "This agent is billed per device-month, deploy it instead"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to start checkout")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start checkout"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"checkout": session})
+}
+
+// GetCheckout returns one of the current user's checkout sessions. This is
+// the target of the recovery link, so viewing it resumes the checkout.
+func (h *Handler) GetCheckout(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid checkout ID"})
+		return
+	}
+
+	session, err := h.checkoutSvc.GetCheckout(userID.(uuid.UUID), id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Checkout not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to get checkout")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"checkout": session})
+}
+
+// CompleteCheckout records the purchase for a checkout session
+func (h *Handler) CompleteCheckout(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid checkout ID"})
+		return
+	}
+
+	var req struct {
+		PaymentID      string `json:"payment_id"`      // required unless credit covers the full amount
+		BillingCountry string `json:"billing_country"` // ISO 3166-1 alpha-2
+		UseCredit      bool   `json:"use_credit"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	purchase, err := h.checkoutSvc.CompleteCheckout(userID.(uuid.UUID), id, services.CheckoutCompletion{
+		PaymentID:      req.PaymentID,
+		BillingCountry: req.BillingCountry,
+		IP:             c.ClientIP(),
+		IPCountry:      c.GetHeader(h.config.Fraud.IPCountryHeader),
+		UseCredit:      req.UseCredit,
+	})
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Checkout not found"})
+		return
+	case services.ErrCheckoutClosed:
+		c.JSON(http.StatusConflict, gin.H{"error": "Checkout is already completed"})
+		return
+	case services.ErrPaymentRequired:
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error()})
+		return
+	case services.ErrPurchaseBlocked:
+		// Don't tell the client which rule matched
+		c.JSON(http.StatusForbidden, gin.H{"error": "Purchase could not be completed"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to complete checkout")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete checkout"})
+		return
+	}
+
+	if purchase.Status == models.PurchaseStatusOnHold {
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":  "Purchase is being reviewed",
+			"purchase": purchase,
+		})
+		return
+	}
+
+	if purchase.Status == models.PurchaseStatusCompleted {
+		receipt, err := h.receiptSvc.Issue(purchase)
+		if err != nil {
+			log.Error().Err(err).Str("purchase_id", purchase.ID.String()).Msg("Failed to issue receipt")
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"message":  "Checkout completed, paid with credit",
+			"purchase": purchase,
+			"receipt":  receipt,
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":  "Checkout completed, awaiting payment confirmation",
+		"purchase": purchase,
+	})
+}
+
+// GetCheckoutStats returns abandoned-checkout recovery statistics for admin
+func (h *Handler) GetCheckoutStats(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid days"})
+		return
+	}
+
+	stats, err := h.checkoutSvc.GetRecoveryStats(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get checkout stats")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get checkout stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"days": days, "stats": stats})
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// UploadAgentSBOM uploads the CycloneDX JSON SBOM of a draft release of one
+// of the publisher's agents
+func (h *Handler) UploadAgentSBOM(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+	release, ok := h.findUploadVersion(c, agent)
+	if !ok {
+		return
+	}
+
+	upload, closeFile, ok := formUpload(c, services.MaxAssetSize)
+	if !ok {
+		return
+	}
+	defer closeFile()
+
+	if !h.uploadError(c, h.complianceSvc.UploadSBOM(release, upload), "SBOM") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "SBOM uploaded successfully",
+		"sbom":    release.SBOM,
+	})
+}
+
+// SetAgentVersionCertifications replaces the certification evidence of a
+// release of one of the publisher's agents
+func (h *Handler) SetAgentVersionCertifications(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+	release, ok := h.findVersion(c, agent)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Certifications []models.Certification `json:"certifications" binding:"max=20,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch err := h.complianceSvc.SetCertifications(release, req.Certifications); err {
+	case nil:
+	case services.ErrInvalidCertification:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to set certifications")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set certifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"certifications": release.Certifications})
+}
+
+// GetComplianceReport returns the compliance report of a release to users
+// entitled to the agent, as JSON (optionally signed) or with format=pdf as
+// a PDF document
+func (h *Handler) GetComplianceReport(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "pdf" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format, use json or pdf"})
+		return
+	}
+	signed, err := strconv.ParseBool(c.DefaultQuery("signed", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signed flag"})
+		return
+	}
+
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+	release, ok := h.findVersion(c, agent)
+	if !ok {
+		return
+	}
+	if release.Status == models.AgentVersionStatusDraft {
+		member, ok := h.isAgentMember(c, agent, userID.(uuid.UUID))
+		if !ok {
+			return
+		}
+		if !member {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+			return
+		}
+	}
+	if err := h.agentSvc.CheckEntitlement(agent, userID.(uuid.UUID)); err != nil {
+		if err == services.ErrNotEntitled {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Purchase this agent to get its compliance report"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to check agent entitlement")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	report, err := h.complianceSvc.Report(agent, release)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to build compliance report")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	filename := fmt.Sprintf("edgeplug-compliance-%s-%s", agent.ID, release.Version)
+	if format == "pdf" {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, filename))
+		c.Data(http.StatusOK, "application/pdf", h.complianceSvc.RenderPDF(report))
+		return
+	}
+	if !signed {
+		c.JSON(http.StatusOK, gin.H{"compliance_report": report})
+		return
+	}
+
+	token, err := h.complianceSvc.Sign(report)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign compliance report")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign compliance report"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, filename))
+	c.JSON(http.StatusOK, gin.H{"compliance_report": report, "signature": token})
+}
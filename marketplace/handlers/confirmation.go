@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// confirmed reports whether a sensitive action of the current user may run
+// now, which it may when the request re-entered the user's password.
+// Without a password it emails a link confirming the action and responds
+// 202 Accepted; ConfirmAction runs the action once the link is opened.
+func (h *Handler) confirmed(c *gin.Context, action *models.PendingAction, password, description string) bool {
+	action.UserID = c.MustGet("user_id").(uuid.UUID)
+	if password == "" {
+		h.requestConfirmation(c, action, "", description)
+		return false
+	}
+
+	switch err := h.confirmSvc.Reauthenticate(action.UserID, password); err {
+	case nil:
+		return true
+	case services.ErrWrongPassword:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to check password")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+	return false
+}
+
+// requestConfirmation emails a link confirming an action of the current
+// user to the given address, or the user's own if empty
+func (h *Handler) requestConfirmation(c *gin.Context, action *models.PendingAction, to, description string) {
+	action.UserID = c.MustGet("user_id").(uuid.UUID)
+	action.RequestIP = c.ClientIP()
+
+	switch err := h.confirmSvc.Request(action, to, description); err {
+	case nil:
+	case services.ErrConfirmationLimit:
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Str("action", string(action.Action)).Msg("Failed to request confirmation")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send confirmation email"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":               "Check your email to confirm this request",
+		"confirmation_required": true,
+		"expires_at":            action.ExpiresAt,
+	})
+}
+
+// ConfirmAction runs a sensitive action from the token of its emailed
+// confirmation link. The link works once and needs no session, so the
+// action runs as the user who requested it.
+func (h *Handler) ConfirmAction(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	action, err := h.confirmSvc.Confirm(req.Token)
+	switch err {
+	case nil:
+	case services.ErrInvalidConfirmation:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to confirm action")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.Set("user_id", action.UserID)
+	c.Set("user_role", string(action.User.Role))
+
+	switch action.Action {
+	case models.PendingActionDeleteAgent:
+		var agent models.Agent
+		if err := h.db.First(&agent, "id = ?", action.TargetID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+				return
+			}
+			log.Error().Err(err).Msg("Failed to get agent")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		if h.authorizeAgent(c, &agent, services.AgentDelete) {
+			h.deleteAgent(c, &agent)
+		}
+	case models.PendingActionReplacePayoutAccount:
+		h.replacePayoutAccount(c)
+	case models.PendingActionDeleteAccount:
+		h.deleteAccount(c, &action.User)
+	case models.PendingActionChangeEmail:
+		h.changeEmail(c, &action.User, action.Value)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": services.ErrInvalidConfirmation.Error()})
+	}
+}
+
+// DeleteAccount deletes the current user's account, once confirmed with
+// their password or an emailed link
+func (h *Handler) DeleteAccount(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	action := &models.PendingAction{Action: models.PendingActionDeleteAccount}
+	if !h.confirmed(c, action, req.Password, "delete your EdgePlug Marketplace account") {
+		return
+	}
+
+	user, err := h.userSvc.GetUserByID(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get user")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	h.deleteAccount(c, user)
+}
+
+// deleteAccount deletes a user's account and ends their sessions
+func (h *Handler) deleteAccount(c *gin.Context, user *models.User) {
+	switch err := h.userSvc.DeleteUser(user.ID); err {
+	case nil:
+	case services.ErrLegalHold:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to delete account")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+	if err := h.authSvc.RevokeAllTokens(c.Request.Context(), user.ID); err != nil {
+		log.Error().Err(err).Msg("Failed to revoke tokens of deleted account")
+	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionUserDelete,
+		EntityType: "user",
+		EntityID:   user.ID,
+		Before:     models.AuditSnapshot{"email": user.Email, "username": user.Username},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
+}
+
+// ChangeEmail starts changing the current user's email address. The change
+// is made once the link emailed to the new address is confirmed, which
+// also proves the user owns it.
+func (h *Handler) ChangeEmail(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+
+	taken, err := h.userSvc.EmailTaken(userID.(uuid.UUID), email)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to check email address")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": services.ErrEmailTaken.Error()})
+		return
+	}
+
+	action := &models.PendingAction{Action: models.PendingActionChangeEmail, Value: email}
+	h.requestConfirmation(c, action, email, "use "+email+" as the email address of your EdgePlug Marketplace account")
+}
+
+// changeEmail changes a user's email address and tells the old one
+func (h *Handler) changeEmail(c *gin.Context, user *models.User, email string) {
+	switch err := h.userSvc.ChangeEmail(user.ID, email); err {
+	case nil:
+	case services.ErrEmailTaken:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to change email address")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change email address"})
+		return
+	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionUserEmail,
+		EntityType: "user",
+		EntityID:   user.ID,
+		Before:     models.AuditSnapshot{"email": user.Email},
+		After:      models.AuditSnapshot{"email": email},
+	})
+	go h.confirmSvc.Notify(user.Email, "Your EdgePlug Marketplace email address was changed",
+		fmt.Sprintf("The email address of your EdgePlug Marketplace account was changed to %s.\n\n"+
+			"If you did not make this change, contact support immediately.\n", email))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email address changed", "email": email})
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetConsents returns the current user's consent to each purpose, with the
+// version of its text they should be shown
+func (h *Handler) GetConsents(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	consents, err := h.consentSvc.GetConsents(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get consents")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"consents": consents})
+}
+
+// UpdateConsents grants or withdraws the current user's consent to some
+// purposes. Purposes left out are unchanged.
+func (h *Handler) UpdateConsents(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Consents []struct {
+			Purpose models.ConsentPurpose `json:"purpose" binding:"required"`
+			Granted bool                  `json:"granted"`
+			Version string                `json:"version" binding:"max=32"` // of the text shown, required to grant
+		} `json:"consents" binding:"required,min=1,max=10,dive"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	changes := make([]services.ConsentChange, len(req.Consents))
+	for i, consent := range req.Consents {
+		changes[i] = services.ConsentChange{Purpose: consent.Purpose, Granted: consent.Granted, Version: consent.Version}
+	}
+
+	switch err := h.consentSvc.UpdateConsents(userID.(uuid.UUID), changes, c.ClientIP(), c.Request.UserAgent()); err {
+	case nil:
+	case services.ErrUnknownConsentPurpose:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrStaleConsentVersion:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to update consents")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	consents, err := h.consentSvc.GetConsents(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get consents")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"consents": consents})
+}
+
+// GetConsentHistory lists every consent answer the current user gave,
+// newest first
+func (h *Handler) GetConsentHistory(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	events, total, err := h.consentSvc.GetConsentEvents(userID.(uuid.UUID), page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get consent history")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events": events,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
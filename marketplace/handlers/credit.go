@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetCredits returns the current user's credit balances and ledger history
+func (h *Handler) GetCredits(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	balances, err := h.creditSvc.Balances(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get credit balances")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	entries, total, err := h.creditSvc.History(userID.(uuid.UUID), page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get credit history")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"balances": balances,
+		"history":  entries,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// RedeemCreditCode adds the credit of a gift card or promotion code to the
+// current user's balance
+func (h *Handler) RedeemCreditCode(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entry, err := h.creditSvc.Redeem(userID.(uuid.UUID), req.Code)
+	switch err {
+	case nil:
+	case services.ErrInvalidCreditCode:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrCodeRedeemed:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to redeem credit code")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem code"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Credit added successfully",
+		"credit":  entry,
+	})
+}
+
+// GrantCredit grants credit to a user (admin only)
+func (h *Handler) GrantCredit(c *gin.Context) {
+	adminID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req struct {
+		Amount    json.Number `json:"amount" binding:"required"`
+		Currency  string      `json:"currency"`
+		Reason    string      `json:"reason" binding:"required"`
+		ValidDays int         `json:"valid_days" binding:"min=0"` // 0 = no expiry
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	currency := models.NormalizeCurrency(req.Currency)
+	amount, err := models.ParseMoney(req.Amount.String(), currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entry, err := h.creditSvc.Grant(userID, adminID.(uuid.UUID), amount, currency, req.Reason, req.ValidDays)
+	switch err {
+	case nil:
+	case services.ErrInvalidCreditAmount:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to grant credit")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to grant credit"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Credit granted successfully",
+		"credit":  entry,
+	})
+}
+
+// GetCreditCodes returns gift card and promotion codes (admin only)
+func (h *Handler) GetCreditCodes(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	codes, total, err := h.creditSvc.GetCodes(page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get credit codes")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"codes": codes,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// CreateCreditCode creates a gift card or promotion code (admin only)
+func (h *Handler) CreateCreditCode(c *gin.Context) {
+	adminID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Code           string      `json:"code" binding:"required,min=4,max=64"`
+		Amount         json.Number `json:"amount" binding:"required"`
+		Currency       string      `json:"currency"`
+		ValidDays      int         `json:"valid_days" binding:"min=0"`      // lifetime of the granted credit
+		MaxRedemptions int         `json:"max_redemptions" binding:"min=0"` // 0 = unlimited
+		ExpiresAt      *time.Time  `json:"expires_at"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	currency := models.NormalizeCurrency(req.Currency)
+	amount, err := models.ParseMoney(req.Amount.String(), currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	code := models.CreditCode{
+		Code:           req.Code,
+		Amount:         amount,
+		Currency:       currency,
+		ValidDays:      req.ValidDays,
+		MaxRedemptions: req.MaxRedemptions,
+		ExpiresAt:      req.ExpiresAt,
+		CreatedBy:      adminID.(uuid.UUID),
+	}
+	if err := h.creditSvc.CreateCode(&code); err != nil {
+		if err == services.ErrInvalidCreditAmount {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to create credit code")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create credit code"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Credit code created successfully",
+		"code":    code,
+	})
+}
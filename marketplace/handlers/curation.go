@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetFeatured returns the agents featured in a storefront slot
+func (h *Handler) GetFeatured(c *gin.Context) {
+	agents, err := h.curationSvc.GetFeatured(c.Param("slot"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get featured agents")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"slot": c.Param("slot"), "agents": agents})
+}
+
+// GetCurationRules returns the curation rules, optionally of one ?slot=
+// (admin only)
+func (h *Handler) GetCurationRules(c *gin.Context) {
+	rules, err := h.curationSvc.GetRules(c.Query("slot"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get curation rules")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+// CreateCurationRule adds a curation rule (admin only)
+func (h *Handler) CreateCurationRule(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Name       string     `json:"name" binding:"required"`
+		Slot       string     `json:"slot" binding:"required"`
+		Expression string     `json:"expression" binding:"required"`
+		Priority   int        `json:"priority"`
+		MaxAgents  int        `json:"max_agents"`
+		Enabled    *bool      `json:"enabled"`
+		StartsAt   *time.Time `json:"starts_at"`
+		EndsAt     *time.Time `json:"ends_at"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule := models.CurationRule{
+		Name:       req.Name,
+		Slot:       req.Slot,
+		Expression: req.Expression,
+		Priority:   req.Priority,
+		MaxAgents:  req.MaxAgents,
+		Enabled:    req.Enabled == nil || *req.Enabled,
+		StartsAt:   req.StartsAt,
+		EndsAt:     req.EndsAt,
+		CreatedBy:  userID.(uuid.UUID),
+	}
+	if rule.MaxAgents == 0 {
+		rule.MaxAgents = 10
+	}
+	if !h.curationError(c, h.curationSvc.SaveRule(&rule), "save curation rule") {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"rule": rule})
+}
+
+// UpdateCurationRule changes a curation rule (admin only)
+func (h *Handler) UpdateCurationRule(c *gin.Context) {
+	rule, ok := h.findCurationRule(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name       *string    `json:"name" binding:"omitempty,min=1"`
+		Slot       *string    `json:"slot"`
+		Expression *string    `json:"expression"`
+		Priority   *int       `json:"priority"`
+		MaxAgents  *int       `json:"max_agents"`
+		Enabled    *bool      `json:"enabled"`
+		StartsAt   *time.Time `json:"starts_at"`
+		EndsAt     *time.Time `json:"ends_at"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Name != nil {
+		rule.Name = *req.Name
+	}
+	if req.Slot != nil {
+		rule.Slot = *req.Slot
+	}
+	if req.Expression != nil {
+		rule.Expression = *req.Expression
+	}
+	if req.Priority != nil {
+		rule.Priority = *req.Priority
+	}
+	if req.MaxAgents != nil {
+		rule.MaxAgents = *req.MaxAgents
+	}
+	if req.Enabled != nil {
+		rule.Enabled = *req.Enabled
+	}
+	if req.StartsAt != nil {
+		rule.StartsAt = req.StartsAt
+	}
+	if req.EndsAt != nil {
+		rule.EndsAt = req.EndsAt
+	}
+	if !h.curationError(c, h.curationSvc.SaveRule(rule), "save curation rule") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rule": rule})
+}
+
+// DeleteCurationRule removes a curation rule and its placements (admin only)
+func (h *Handler) DeleteCurationRule(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule ID"})
+		return
+	}
+
+	if err := h.curationSvc.DeleteRule(id); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Curation rule not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete curation rule")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete curation rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Curation rule deleted successfully"})
+}
+
+// PreviewCuration returns the agents an expression would feature right
+// now, without saving anything (admin only)
+func (h *Handler) PreviewCuration(c *gin.Context) {
+	var req struct {
+		Expression string `json:"expression" binding:"required"`
+		MaxAgents  int    `json:"max_agents" binding:"omitempty,min=1,max=100"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.MaxAgents == 0 {
+		req.MaxAgents = 10
+	}
+
+	agents, total, err := h.curationSvc.Preview(req.Expression, req.MaxAgents)
+	if !h.curationError(c, err, "preview curation rule") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"agents": agents, "total_matches": total})
+}
+
+// RunCuration refills the featured slots from the curation rules now
+// instead of waiting for the next scheduled run (admin only)
+func (h *Handler) RunCuration(c *gin.Context) {
+	if err := h.curationSvc.EvaluateAll(); err != nil {
+		log.Error().Err(err).Msg("Failed to evaluate curation rules")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to evaluate curation rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Featured slots updated successfully"})
+}
+
+// SetFeaturedPins sets the agents pinned by hand to the top of a slot
+// (admin only)
+func (h *Handler) SetFeaturedPins(c *gin.Context) {
+	var req struct {
+		AgentIDs []uuid.UUID `json:"agent_ids"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !h.curationError(c, h.curationSvc.SetPins(c.Param("slot"), req.AgentIDs), "pin featured agents") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Featured agents pinned successfully"})
+}
+
+// findCurationRule loads the curation rule in the :id route parameter,
+// writing the error response if it cannot
+func (h *Handler) findCurationRule(c *gin.Context) (*models.CurationRule, bool) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule ID"})
+		return nil, false
+	}
+
+	rule, err := h.curationSvc.GetRule(id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Curation rule not found"})
+			return nil, false
+		}
+		log.Error().Err(err).Msg("Failed to get curation rule")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return nil, false
+	}
+	return rule, true
+}
+
+// curationError writes the response for a curation error and reports
+// whether the operation succeeded
+func (h *Handler) curationError(c *gin.Context, err error, action string) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, services.ErrInvalidCurationRule), errors.Is(err, services.ErrInvalidPins):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to " + action)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action})
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetCurrencies lists the currencies agents can be priced in and their
+// exchange rates to the base currency
+func (h *Handler) GetCurrencies(c *gin.Context) {
+	currencies, err := h.currencySvc.GetCurrencies(false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get currencies")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	rates, err := h.currencySvc.GetRates()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get exchange rates")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"base": h.config.Currencies.Base, "currencies": currencies, "rates": rates})
+}
+
+// AdminGetCurrencies lists all currencies, including disabled ones
+func (h *Handler) AdminGetCurrencies(c *gin.Context) {
+	currencies, err := h.currencySvc.GetCurrencies(true)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get currencies")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"currencies": currencies})
+}
+
+// AdminSetCurrency adds a supported currency, or renames, enables or
+// disables one
+func (h *Handler) AdminSetCurrency(c *gin.Context) {
+	var req struct {
+		Name    string `json:"name" binding:"max=100"`
+		Enabled *bool  `json:"enabled" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	currency, err := h.currencySvc.SetCurrency(c.Param("code"), req.Name, *req.Enabled)
+	switch err {
+	case nil:
+	case services.ErrUnsupportedCurrency:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid currency code, or the base currency cannot be disabled"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to set currency")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set currency"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"currency": currency})
+}
+
+// AdminSyncExchangeRates fetches exchange rates now rather than waiting for
+// the daily sync
+func (h *Handler) AdminSyncExchangeRates(c *gin.Context) {
+	synced, err := h.currencySvc.SyncRates(c.Request.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sync exchange rates")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to sync exchange rates"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"synced": synced})
+}
+
+// displayConverter returns the converter to the ?currency= prices should
+// also be shown in, or nil when none was asked for. It responds itself
+// and returns false if the currency cannot be shown.
+func (h *Handler) displayConverter(c *gin.Context) (*services.CurrencyConverter, bool) {
+	currency := c.Query("currency")
+	if currency == "" {
+		return nil, true
+	}
+
+	converter, err := h.currencySvc.Converter(currency)
+	switch err {
+	case nil:
+		return converter, true
+	case services.ErrUnsupportedCurrency:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency"})
+	case services.ErrRatesUnavailable:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to load exchange rates")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+	return nil, false
+}
+
+// checkCurrency responds with 400 and returns false unless publishers can
+// price in a currency
+func (h *Handler) checkCurrency(c *gin.Context, currency string) bool {
+	switch err := h.currencySvc.Supported(currency); err {
+	case nil:
+		return true
+	case services.ErrUnsupportedCurrency:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency " + currency})
+	default:
+		log.Error().Err(err).Msg("Failed to check currency")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+	return false
+}
+
+// setDisplayPrices converts the prices of listed agents, if a display
+// currency was asked for
+func setDisplayPrices(agents []models.Agent, converter *services.CurrencyConverter) {
+	if converter == nil {
+		return
+	}
+	for i := range agents {
+		agents[i].DisplayPrice = converter.Convert(agents[i].Price, agents[i].Currency)
+	}
+}
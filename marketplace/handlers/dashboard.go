@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// GetDashboard returns the current user's dashboard in one call: every user
+// gets the buyer summary, publishers also their sales and submissions, and
+// admins the moderation queues and system health
+func (h *Handler) GetDashboard(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	role := models.UserRole(c.GetString("user_role"))
+
+	buyer, err := h.dashboardSvc.Buyer(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get buyer dashboard")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	response := gin.H{"role": role, "buyer": buyer}
+
+	if role == models.UserRolePublisher || role == models.UserRoleAdmin {
+		publisher, err := h.dashboardSvc.Publisher(userID.(uuid.UUID))
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get publisher dashboard")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		response["publisher"] = publisher
+	}
+
+	if role == models.UserRoleAdmin {
+		admin, err := h.dashboardSvc.Admin()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get admin dashboard")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		response["admin"] = gin.H{
+			"queues": admin,
+			"health": gin.H{
+				"replication": h.replSvc.Status(),
+				"redis":       h.redisSvc.Status(),
+			},
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
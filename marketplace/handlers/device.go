@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// ReportDeviceResources records the free resources reported by one of the
+// user's devices
+func (h *Handler) ReportDeviceResources(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		FlashFree     int `json:"flash_free" binding:"min=0"`
+		SRAMFree      int `json:"sram_free" binding:"min=0"`
+		LatencyBudget int `json:"latency_budget" binding:"min=0"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resources := models.DeviceResources{
+		OwnerID:       userID.(uuid.UUID),
+		DeviceID:      c.Param("id"),
+		FlashFree:     req.FlashFree,
+		SRAMFree:      req.SRAMFree,
+		LatencyBudget: req.LatencyBudget,
+	}
+	if err := h.deviceSvc.ReportResources(&resources); err != nil {
+		log.Error().Err(err).Msg("Failed to record device resources")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record device resources"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"resources": resources})
+}
+
+// GetDeviceResources returns the latest resource report of one of the
+// user's devices
+func (h *Handler) GetDeviceResources(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	resources, err := h.deviceSvc.GetResources(userID.(uuid.UUID), c.Param("id"))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device has not reported its resources"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to get device resources")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"resources": resources})
+}
+
+// CheckDeviceBudget reports whether a set of candidate agents fits in the
+// free resources last reported by one of the user's devices
+func (h *Handler) CheckDeviceBudget(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Agents []services.BudgetCandidate `json:"agents" binding:"required,dive"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	check, err := h.deviceSvc.CheckBudget(userID.(uuid.UUID), c.Param("id"), req.Agents)
+	switch {
+	case err == nil:
+	case err == gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device has not reported its resources"})
+		return
+	case errors.Is(err, services.ErrInvalidCandidates):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to check device budget")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"budget": check})
+}
+
+// ProvisionDevice adds a device to the registry and returns its claim code,
+// to be shipped with the device (admin only)
+func (h *Handler) ProvisionDevice(c *gin.Context) {
+	adminID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Serial        string `json:"serial" binding:"required"`
+		HardwareModel string `json:"hardware_model" binding:"max=100"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, code, err := h.deviceSvc.ProvisionDevice(adminID.(uuid.UUID), req.Serial, req.HardwareModel)
+	switch err {
+	case nil:
+		c.JSON(http.StatusCreated, gin.H{"device": device, "claim_code": code})
+	case services.ErrInvalidSerial:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case services.ErrDeviceExists:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to provision device")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// ClaimDevice adds a registered device to the user's fleet with its serial
+// and claim code
+func (h *Handler) ClaimDevice(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Serial    string `json:"serial" binding:"required"`
+		ClaimCode string `json:"claim_code" binding:"required"`
+		Name      string `json:"name" binding:"max=100"`
+		Group     string `json:"group" binding:"max=100"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, err := h.deviceSvc.ClaimDevice(userID.(uuid.UUID), req.Serial, req.ClaimCode, req.Name, strings.TrimSpace(req.Group))
+	switch err {
+	case nil:
+		c.JSON(http.StatusCreated, gin.H{"device": device})
+	case services.ErrInvalidClaim:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case services.ErrDeviceClaimed:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to claim device")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// GetDevices returns the user's fleet: the devices they claimed, optionally
+// in one ?group=, and the agents installed on each
+func (h *Handler) GetDevices(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	devices, total, err := h.deviceSvc.GetFleet(userID.(uuid.UUID), c.Query("group"), page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get devices")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"devices": devices,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// GetDevice returns one of the user's devices, by serial, and the agents
+// installed on it
+func (h *Handler) GetDevice(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	device, err := h.deviceSvc.GetFleetDevice(userID.(uuid.UUID), c.Param("id"))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"device": device})
+	case gorm.ErrRecordNotFound:
+		h.resourceNotFound(c, services.ResourceDevice, c.Param("id"))
+	default:
+		log.Error().Err(err).Msg("Failed to get device")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// UpdateDevice renames one of the user's devices or moves it to another
+// group or site
+func (h *Handler) UpdateDevice(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Name  string `json:"name" binding:"max=100"`
+		Group string `json:"group" binding:"max=100"`
+		Site  string `json:"site" binding:"max=100"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, err := h.deviceSvc.UpdateFleetDevice(userID.(uuid.UUID), c.Param("id"), req.Name, strings.TrimSpace(req.Group), req.Site)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"device": device})
+	case gorm.ErrRecordNotFound:
+		h.resourceNotFound(c, services.ResourceDevice, c.Param("id"))
+	default:
+		log.Error().Err(err).Msg("Failed to update device")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// ReleaseDevice removes one of the user's devices from their fleet
+func (h *Handler) ReleaseDevice(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	switch err := h.deviceSvc.ReleaseDevice(userID.(uuid.UUID), c.Param("id")); err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Device released"})
+	case gorm.ErrRecordNotFound:
+		h.resourceNotFound(c, services.ResourceDevice, c.Param("id"))
+	case services.ErrDeviceInUse:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to release device")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// ImportDevices queues a CSV file of devices, in the file field, to be
+// added to the user's fleet. The file needs a hardware_id column and may
+// have mcu, site, fleet, name and claim_code columns.
+func (h *Handler) ImportDevices(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	upload, closeFile, ok := formUpload(c, h.config.DeviceImports.MaxFileSize)
+	if !ok {
+		return
+	}
+	defer closeFile()
+	var filename string
+	if form := c.Request.MultipartForm; form != nil && len(form.File["file"]) > 0 {
+		filename = form.File["file"][0].Filename
+	}
+
+	imp, err := h.importSvc.CreateImport(userID.(uuid.UUID), filename, upload.Body)
+	switch err {
+	case nil:
+		c.JSON(http.StatusAccepted, gin.H{"import": imp, "operation": services.ImportOperation(imp)})
+	case services.ErrInvalidImportHeader:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case services.ErrImportTooLarge:
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to queue device import")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// GetDeviceImport returns the progress of one of the user's device imports
+func (h *Handler) GetDeviceImport(c *gin.Context) {
+	imp, ok := h.findDeviceImport(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"import": imp})
+}
+
+// GetDeviceImportErrors downloads the rows of a device import that failed,
+// with why, as CSV
+func (h *Handler) GetDeviceImportErrors(c *gin.Context) {
+	imp, ok := h.findDeviceImport(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="device-import-`+imp.ID.String()+`-errors.csv"`)
+	c.Status(http.StatusOK)
+	if err := h.importSvc.ErrorReport(imp, c.Writer); err != nil {
+		log.Warn().Err(err).Str("import_id", imp.ID.String()).Msg("Failed to send device import errors")
+	}
+}
+
+func (h *Handler) findDeviceImport(c *gin.Context) (*models.DeviceImport, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid import ID"})
+		return nil, false
+	}
+
+	imp, err := h.importSvc.GetImport(userID.(uuid.UUID), id)
+	switch err {
+	case nil:
+		return imp, true
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Import not found"})
+	default:
+		log.Error().Err(err).Msg("Failed to get device import")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+	return nil, false
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// DeviceCheckIn records the agents a device runs and its health, and
+// returns the releases it should install or remove
+func (h *Handler) DeviceCheckIn(c *gin.Context) {
+	var req struct {
+		Agents []struct {
+			AgentID     uuid.UUID `json:"agent_id" binding:"required"`
+			Version     string    `json:"version" binding:"max=64"`
+			UpdateError string    `json:"update_error" binding:"max=2000"`
+		} `json:"agents" binding:"max=100,dive"`
+		HealthStatus string `json:"health_status" binding:"max=32"`
+		Uptime       int64  `json:"uptime" binding:"min=0"`
+		Resources    *struct {
+			FlashFree     int `json:"flash_free" binding:"min=0"`
+			SRAMFree      int `json:"sram_free" binding:"min=0"`
+			LatencyBudget int `json:"latency_budget" binding:"min=0"`
+		} `json:"resources"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report := services.DeviceReport{HealthStatus: req.HealthStatus, Uptime: req.Uptime}
+	for _, agent := range req.Agents {
+		report.Agents = append(report.Agents, services.AgentReport{
+			AgentID:     agent.AgentID,
+			Version:     agent.Version,
+			UpdateError: agent.UpdateError,
+		})
+	}
+	if req.Resources != nil {
+		report.Resources = &models.DeviceResources{
+			FlashFree:     req.Resources.FlashFree,
+			SRAMFree:      req.Resources.SRAMFree,
+			LatencyBudget: req.Resources.LatencyBudget,
+		}
+	}
+
+	value, authenticated := c.Get("device_cert")
+	if !authenticated {
+		h.journalDeviceRequest(c, services.JournalDeviceCheckIn, c.GetString("device_fingerprint"), report)
+		return
+	}
+	cert := value.(*models.DeviceCertificate)
+
+	instructions, err := h.checkInSvc.CheckIn(c.Request.Context(), &cert.Device, report)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{
+			"instructions": instructions,
+			"expires_in":   int(h.config.Storage.PresignExpiry.Seconds()),
+			"certificate": gin.H{
+				"expires_at": cert.NotAfter,
+				"rotate":     h.deviceCertSvc.RotateDue(cert),
+			},
+		})
+	case err == services.ErrDeviceNotClaimed:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case h.deviceJournal.Accepts(err):
+		h.journalDeviceRequest(c, services.JournalDeviceCheckIn, cert.Fingerprint, report)
+	default:
+		log.Error().Err(err).Msg("Failed to record device check-in")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// journalDeviceRequest keeps a device request the database cannot take
+// now, to replay it later. The device is answered 202 and must not resend
+// the request, or 503 when the journal is full.
+func (h *Handler) journalDeviceRequest(c *gin.Context, kind, fingerprint string, payload interface{}) {
+	switch err := h.deviceJournal.Append(c.Request.Context(), kind, fingerprint, payload); err {
+	case nil:
+		c.JSON(http.StatusAccepted, gin.H{"journaled": true})
+	case services.ErrJournalFull:
+		c.Header("Retry-After", strconv.Itoa(int(h.config.DeviceJournal.ReplayInterval.Seconds())+1))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Str("kind", kind).Msg("Failed to journal device request")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable"})
+	}
+}
+
+// RotateDeviceCertificate issues the calling device a certificate for a
+// new key, replacing the one it authenticated with
+func (h *Handler) RotateDeviceCertificate(c *gin.Context) {
+	current := c.MustGet("device_cert").(*models.DeviceCertificate)
+
+	var req struct {
+		CSR string `json:"csr" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cert, err := h.deviceCertSvc.RotateCertificate(current, req.CSR)
+	switch err {
+	case nil:
+		c.JSON(http.StatusCreated, gin.H{"certificate": cert})
+	case services.ErrInvalidCSR:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to rotate device certificate")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// ProvisionDeviceCertificate issues one of the user's devices its first
+// device API certificate, or a new one after a reset
+func (h *Handler) ProvisionDeviceCertificate(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		CSR string `json:"csr" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cert, err := h.deviceCertSvc.ProvisionCertificate(userID.(uuid.UUID), c.Param("id"), req.CSR)
+	switch err {
+	case nil:
+		c.JSON(http.StatusCreated, gin.H{"certificate": cert})
+	case services.ErrInvalidCSR:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case services.ErrDeviceAPIDisabled:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case gorm.ErrRecordNotFound:
+		h.resourceNotFound(c, services.ResourceDevice, c.Param("id"))
+	default:
+		log.Error().Err(err).Msg("Failed to provision device certificate")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// GetDeviceCertificates lists the certificates issued to one of the user's
+// devices
+func (h *Handler) GetDeviceCertificates(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	certs, err := h.deviceCertSvc.GetCertificates(userID.(uuid.UUID), c.Param("id"))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"certificates": certs})
+	case gorm.ErrRecordNotFound:
+		h.resourceNotFound(c, services.ResourceDevice, c.Param("id"))
+	default:
+		log.Error().Err(err).Msg("Failed to get device certificates")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// RevokeDeviceCertificate revokes a certificate of one of the user's
+// devices, e.g. when its key may have leaked
+func (h *Handler) RevokeDeviceCertificate(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("cert_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid certificate ID"})
+		return
+	}
+
+	cert, err := h.deviceCertSvc.RevokeCertificate(userID.(uuid.UUID), c.Param("id"), id)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"certificate": cert})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Certificate not found"})
+	default:
+		log.Error().Err(err).Msg("Failed to revoke device certificate")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
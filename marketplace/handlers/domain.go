@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetDomains returns the user's custom domains
+func (h *Handler) GetDomains(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	domains, err := h.domainSvc.GetDomains(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get custom domains")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"domains": domains})
+}
+
+// CreateDomain registers a custom domain and returns the TXT record the
+// publisher must create to verify it
+func (h *Handler) CreateDomain(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Domain string `json:"domain" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	domain, err := h.domainSvc.AddDomain(userID.(uuid.UUID), req.Domain)
+	switch err {
+	case nil:
+	case services.ErrInvalidDomain:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrCustomDomainsNotAllowed:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case services.ErrDomainTaken:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to add custom domain")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add custom domain"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"domain":       domain,
+		"verification": verificationRecord(domain),
+	})
+}
+
+// VerifyDomain checks the domain's verification TXT record. Once verified,
+// the domain serves the publisher's storefront.
+func (h *Handler) VerifyDomain(c *gin.Context) {
+	domain, ok := h.findDomain(c)
+	if !ok {
+		return
+	}
+	if domain.VerifiedAt != nil {
+		c.JSON(http.StatusOK, gin.H{"domain": domain})
+		return
+	}
+
+	switch err := h.domainSvc.VerifyDomain(c.Request.Context(), domain); err {
+	case nil:
+	case services.ErrDomainNotVerified:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":        err.Error(),
+			"verification": verificationRecord(domain),
+		})
+		return
+	default:
+		log.Error().Err(err).Str("domain", domain.Domain).Msg("Failed to verify custom domain")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to look up the verification record"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"domain": domain})
+}
+
+// UpdateDomain updates the branding and extra CORS origins of a custom domain
+func (h *Handler) UpdateDomain(c *gin.Context) {
+	domain, ok := h.findDomain(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		BrandName    *string  `json:"brand_name" binding:"omitempty,max=100"`
+		LogoURL      *string  `json:"logo_url" binding:"omitempty,url"`
+		PrimaryColor *string  `json:"primary_color" binding:"omitempty,hexcolor,len=7"`
+		CORSOrigins  []string `json:"cors_origins" binding:"omitempty,max=10"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := make(map[string]interface{})
+	if req.BrandName != nil {
+		updates["brand_name"] = *req.BrandName
+	}
+	if req.LogoURL != nil {
+		updates["logo_url"] = *req.LogoURL
+	}
+	if req.PrimaryColor != nil {
+		updates["primary_color"] = *req.PrimaryColor
+	}
+	if req.CORSOrigins != nil {
+		for _, origin := range req.CORSOrigins {
+			if !services.ValidOrigin(origin) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "CORS origins must be https origins without a path: " + origin})
+				return
+			}
+		}
+		updates["cors_origins"] = models.Tags(req.CORSOrigins)
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	if err := h.domainSvc.UpdateBranding(domain, updates); err != nil {
+		log.Error().Err(err).Msg("Failed to update custom domain")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update custom domain"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"domain": domain})
+}
+
+// DeleteDomain removes a custom domain
+func (h *Handler) DeleteDomain(c *gin.Context) {
+	domain, ok := h.findDomain(c)
+	if !ok {
+		return
+	}
+
+	if err := h.domainSvc.DeleteDomain(domain); err != nil {
+		log.Error().Err(err).Msg("Failed to delete custom domain")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete custom domain"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Custom domain deleted successfully"})
+}
+
+// UploadDomainCertificate installs the publisher's own certificate for a
+// custom domain instead of issuing one through ACME
+func (h *Handler) UploadDomainCertificate(c *gin.Context) {
+	domain, ok := h.findDomain(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Certificate string `json:"certificate" binding:"required"` // PEM chain, leaf first
+		PrivateKey  string `json:"private_key" binding:"required"` // PEM
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.domainSvc.UploadCertificate(domain, req.Certificate, req.PrivateKey); err != nil {
+		if errors.Is(err, services.ErrInvalidCertificate) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to save custom domain certificate")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save certificate"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"domain": domain})
+}
+
+// DeleteDomainCertificate removes an uploaded certificate so the domain's
+// certificate is issued through ACME again
+func (h *Handler) DeleteDomainCertificate(c *gin.Context) {
+	domain, ok := h.findDomain(c)
+	if !ok {
+		return
+	}
+
+	if err := h.domainSvc.RemoveCertificate(domain); err != nil {
+		log.Error().Err(err).Msg("Failed to remove custom domain certificate")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove certificate"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"domain": domain})
+}
+
+// GetBranding returns the storefront branding of the custom domain the
+// request was made on
+func (h *Handler) GetBranding(c *gin.Context) {
+	value, exists := c.Get("custom_domain")
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No custom domain for this host"})
+		return
+	}
+	domain := value.(*models.CustomDomain)
+
+	c.JSON(http.StatusOK, gin.H{"branding": gin.H{
+		"domain":        domain.Domain,
+		"publisher_id":  domain.PublisherID,
+		"brand_name":    domain.BrandName,
+		"logo_url":      domain.LogoURL,
+		"primary_color": domain.PrimaryColor,
+	}})
+}
+
+// findDomain loads one of the user's custom domains by the :id route
+// parameter, writing the error response on failure
+func (h *Handler) findDomain(c *gin.Context) (*models.CustomDomain, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid domain ID"})
+		return nil, false
+	}
+
+	domain, err := h.domainSvc.GetDomain(id, userID.(uuid.UUID))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Custom domain not found"})
+			return nil, false
+		}
+		log.Error().Err(err).Msg("Failed to get custom domain")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return nil, false
+	}
+	return domain, true
+}
+
+// verificationRecord describes the DNS record that verifies a domain
+func verificationRecord(domain *models.CustomDomain) gin.H {
+	return gin.H{
+		"type":  "TXT",
+		"name":  services.VerificationRecordName(domain.Domain),
+		"value": domain.VerificationToken,
+	}
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/services"
+)
+
+// StreamEvents streams the current user's events as server-sent events:
+// notifications, deployment progress and scan results. A client that
+// reconnects with the Last-Event-ID header first gets the events it missed.
+func (h *Handler) StreamEvents(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var lastID uuid.UUID
+	if header := c.GetHeader("Last-Event-ID"); header != "" {
+		id, err := uuid.Parse(header)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+		lastID = id
+	}
+
+	// Subscribe before catching up, so nothing falls in between
+	ctx := c.Request.Context()
+	events, unsubscribe, err := h.eventSvc.Subscribe(ctx, userID.(uuid.UUID))
+	switch err {
+	case nil:
+	case services.ErrEventsUnavailable:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	case services.ErrTooManyStreams:
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to subscribe to events")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer unsubscribe()
+
+	var missed []services.Event
+	if lastID != uuid.Nil {
+		if missed, err = h.eventSvc.Since(userID.(uuid.UUID), lastID); err != nil {
+			log.Error().Err(err).Msg("Failed to get missed events")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+	}
+
+	// The stream outlives the server's write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		log.Debug().Err(err).Msg("Failed to lift write deadline of event stream")
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	// Events are time ordered; those already sent can arrive again from the
+	// relay and are skipped
+	send := func(event services.Event) bool {
+		if bytes.Compare(event.ID[:], lastID[:]) <= 0 {
+			return true
+		}
+		lastID = event.ID
+		if _, err := fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Event, event.Data); err != nil {
+			return false
+		}
+		c.Writer.Flush()
+		return true
+	}
+	for _, event := range missed {
+		if !send(event) {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(h.config.Events.Keepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			// Closed when the stream fell behind or the server shuts down
+			if !ok || !send(event) {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// Facets of the agent listing, each named after its query parameter
+const (
+	facetCategory       = "category"
+	facetSafetyLevel    = "safety_level"
+	facetPriceRange     = "price_range"
+	facetHardwareTarget = "hardware_target"
+)
+
+// priceRange is a bucket of the price_range facet. Bounds are in minor
+// units of the listing currency; Max of -1 leaves the bucket open.
+type priceRange struct {
+	Name string
+	Min  models.Money
+	Max  models.Money
+}
+
+// priceRanges are the price_range buckets, in display order
+var priceRanges = []priceRange{
+	{Name: "free", Min: 0, Max: 0},
+	{Name: "under_50", Min: 1, Max: 4999},
+	{Name: "50_to_200", Min: 5000, Max: 19999},
+	{Name: "200_and_up", Min: 20000, Max: -1},
+}
+
+// facetCount is how many agents have one value of a facet
+type facetCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// agentFilter is the filter set of the agent listing, read from its query
+// parameters, within the agents the user may see
+type agentFilter struct {
+	visible        func(*gorm.DB) *gorm.DB
+	publisherID    *uuid.UUID
+	category       string
+	status         string
+	safetyLevel    string
+	hardwareTarget string
+	priceRange     *priceRange
+	tags           []string
+	capabilities   []string // e.g. output:trip_signal
+	search         func(*gorm.DB) *gorm.DB
+}
+
+// parseAgentFilter reads the filters of the agent listing, writing the
+// error response and returning false if one is invalid
+func (h *Handler) parseAgentFilter(c *gin.Context) (*agentFilter, bool) {
+	userID, _ := c.Get("user_id")
+	id, _ := userID.(uuid.UUID)
+	role := models.UserRole(c.GetString("user_role"))
+	filter := &agentFilter{
+		visible: func(query *gorm.DB) *gorm.DB {
+			return h.authzSvc.VisibleAgents(query, id, role)
+		},
+		category:     c.Query("category"),
+		status:       c.Query("status"),
+		safetyLevel:  c.Query("safety_level"),
+		tags:         c.QueryArray("tag"),
+		capabilities: c.QueryArray("capability"),
+	}
+
+	// A publisher's custom domain only lists their own agents
+	if domain, ok := c.Get("custom_domain"); ok {
+		filter.publisherID = &domain.(*models.CustomDomain).PublisherID
+	}
+	if targets := models.NormalizeHardwareTargets([]string{c.Query("hardware_target")}); len(targets) > 0 {
+		filter.hardwareTarget = targets[0]
+	}
+	if name := c.Query("price_range"); name != "" {
+		for i := range priceRanges {
+			if priceRanges[i].Name == name {
+				filter.priceRange = &priceRanges[i]
+			}
+		}
+		if filter.priceRange == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "price_range must be free, under_50, 50_to_200 or 200_and_up"})
+			return nil, false
+		}
+	}
+	if search := c.Query("search"); search != "" {
+		filter.search = h.searchScope(c, search)
+	}
+	return filter, true
+}
+
+// apply narrows an agent query to the filter set, leaving out the filter
+// of the facet named by except, if any
+func (f *agentFilter) apply(query *gorm.DB, except string) *gorm.DB {
+	query = f.visible(query)
+	if f.publisherID != nil {
+		query = query.Where("agents.publisher_id = ?", *f.publisherID)
+	}
+	if f.category != "" && except != facetCategory {
+		query = query.Where("agents.category = ?", f.category)
+	}
+	if f.status != "" {
+		query = query.Where("agents.status = ?", f.status)
+	}
+	if f.safetyLevel != "" && except != facetSafetyLevel {
+		query = query.Where("agents.safety_level = ?", f.safetyLevel)
+	}
+	if f.hardwareTarget != "" && except != facetHardwareTarget {
+		clause, arg := models.HardwareTargetFilter(f.hardwareTarget)
+		query = query.Where(clause, arg)
+	}
+	if f.priceRange != nil && except != facetPriceRange {
+		query = query.Where("agents.price_minor >= ?", f.priceRange.Min)
+		if f.priceRange.Max >= 0 {
+			query = query.Where("agents.price_minor <= ?", f.priceRange.Max)
+		}
+	}
+	if f.search != nil {
+		query = f.search(query)
+	}
+	for _, tag := range f.tags {
+		clause, arg := models.TagFilter(tag)
+		query = query.Where(clause, arg)
+	}
+	for _, capability := range f.capabilities {
+		clause, args := models.CapabilityFilter(capability)
+		query = query.Where(clause, args...)
+	}
+	return query
+}
+
+// GetAgentFacets returns how many agents have each category, safety level,
+// price range and hardware target under the filters of GetAgents. Each
+// facet ignores its own filter, so that the counts of its other values
+// show what selecting them instead would list.
+func (h *Handler) GetAgentFacets(c *gin.Context) {
+	filter, ok := h.parseAgentFilter(c)
+	if !ok {
+		return
+	}
+	agents := func(except string) *gorm.DB {
+		return filter.apply(h.db.Model(&models.Agent{}).Where("agents.deleted_at IS NULL"), except)
+	}
+
+	var total int64
+	if err := agents("").Count(&total).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to count agents")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	facets := make(map[string][]facetCount, 4)
+	for _, column := range []string{facetCategory, facetSafetyLevel} {
+		counts := []facetCount{}
+		if err := agents(column).
+			Select("agents." + column + " AS value, COUNT(*) AS count").
+			Group("agents." + column).Order("count DESC, value").
+			Scan(&counts).Error; err != nil {
+			log.Error().Err(err).Str("facet", column).Msg("Failed to count agent facet")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		facets[column] = counts
+	}
+
+	// Hardware targets are a JSON list, so each agent counts once per target
+	targets := []facetCount{}
+	if err := agents(facetHardwareTarget).
+		Joins("CROSS JOIN LATERAL json_array_elements_text(CAST(agents.hardware_targets AS json)) AS hardware_target(target)").
+		Select("hardware_target.target AS value, COUNT(*) AS count").
+		Group("hardware_target.target").Order("count DESC, value").
+		Scan(&targets).Error; err != nil {
+		log.Error().Err(err).Str("facet", facetHardwareTarget).Msg("Failed to count agent facet")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	facets[facetHardwareTarget] = targets
+
+	// Buckets are contiguous and ascending, so each ends where its Max is
+	bucket := "CASE"
+	var args []interface{}
+	for _, r := range priceRanges {
+		if r.Max < 0 {
+			bucket += " ELSE ?"
+			args = append(args, r.Name)
+			break
+		}
+		bucket += " WHEN agents.price_minor <= ? THEN ?"
+		args = append(args, r.Max, r.Name)
+	}
+	bucket += " END"
+	var prices []facetCount
+	if err := agents(facetPriceRange).
+		Select(bucket+" AS value, COUNT(*) AS count", args...).
+		Group("value").
+		Scan(&prices).Error; err != nil {
+		log.Error().Err(err).Str("facet", facetPriceRange).Msg("Failed to count agent facet")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	ranges := make([]facetCount, len(priceRanges))
+	for i, r := range priceRanges {
+		ranges[i].Value = r.Name
+		for _, price := range prices {
+			if price.Value == r.Name {
+				ranges[i].Count = price.Count
+			}
+		}
+	}
+	facets[facetPriceRange] = ranges
+
+	c.JSON(http.StatusOK, gin.H{"total": total, "facets": facets})
+}
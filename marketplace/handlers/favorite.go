@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// AddFavorite adds a published agent to the current user's favorites
+func (h *Handler) AddFavorite(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+	if agent.Status != models.AgentStatusPublished {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+
+	if err := h.userSvc.AddFavorite(userID.(uuid.UUID), agent.ID); err != nil {
+		log.Error().Err(err).Msg("Failed to add favorite")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add favorite"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Agent added to favorites", "is_favorited": true})
+}
+
+// RemoveFavorite removes an agent from the current user's favorites
+func (h *Handler) RemoveFavorite(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	agentID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
+		return
+	}
+
+	if err := h.userSvc.RemoveFavorite(userID.(uuid.UUID), agentID); err != nil {
+		log.Error().Err(err).Msg("Failed to remove favorite")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove favorite"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Agent removed from favorites", "is_favorited": false})
+}
+
+// GetFavorites returns the current user's favorite agents, most recently
+// added first
+func (h *Handler) GetFavorites(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	favorites, total, err := h.userSvc.GetUserFavorites(userID.(uuid.UUID), page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get favorites")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"favorites": favorites,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
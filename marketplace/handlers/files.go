@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// multipartOverhead is the room left for multipart headers and form fields
+// when limiting the size of an upload
+const multipartOverhead = 1 << 20
+
+// UploadAgentBinary uploads the binary of one of the publisher's draft
+// releases from a multipart form, with its detached signature in the
+// signature field and the ID of the signing key in key_id. The release
+// defaults to the agent's current version.
+func (h *Handler) UploadAgentBinary(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+	release, ok := h.findUploadVersion(c, agent)
+	if !ok {
+		return
+	}
+
+	// Reject bodies far larger than the binary may be before they are
+	// spooled to disk
+	var limit int64
+	if release.FlashSize > 0 {
+		limit = int64(release.FlashSize)
+	}
+	upload, closeFile, ok := formUpload(c, limit)
+	if !ok {
+		return
+	}
+	defer closeFile()
+
+	keyID, err := uuid.Parse(c.PostForm("key_id"))
+	if err != nil || c.PostForm("signature") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A signature and the key_id of its signing key must be sent with the binary"})
+		return
+	}
+	signature := services.BinarySignature{KeyID: keyID, Signature: c.PostForm("signature")}
+
+	err = h.agentSvc.UploadBinary(c.Request.Context(), agent, release, upload, signature)
+	if err == services.ErrBinaryTooLarge {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error(), "flash_size": release.FlashSize})
+		return
+	}
+	if !h.uploadError(c, err, "binary") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Binary uploaded successfully",
+		"version": release,
+	})
+}
+
+// UploadAgentManifest uploads the manifest of one of the publisher's draft
+// releases from a multipart form
+func (h *Handler) UploadAgentManifest(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+	release, ok := h.findUploadVersion(c, agent)
+	if !ok {
+		return
+	}
+
+	upload, closeFile, ok := formUpload(c, services.MaxAssetSize)
+	if !ok {
+		return
+	}
+	defer closeFile()
+
+	if !h.uploadError(c, h.agentSvc.UploadManifest(c.Request.Context(), agent, release, upload), "manifest") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Manifest uploaded successfully",
+		"version": release,
+	})
+}
+
+// UploadAgentIcon uploads the icon of one of the publisher's agents
+func (h *Handler) UploadAgentIcon(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	upload, closeFile, ok := formUpload(c, services.MaxAssetSize)
+	if !ok {
+		return
+	}
+	defer closeFile()
+
+	if !h.uploadError(c, h.agentSvc.UploadIcon(c.Request.Context(), agent, upload), "icon") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Icon uploaded successfully"})
+}
+
+// UploadAgentReadme uploads the README of one of the publisher's agents in
+// its default locale
+func (h *Handler) UploadAgentReadme(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	upload, closeFile, ok := formUpload(c, services.MaxAssetSize)
+	if !ok {
+		return
+	}
+	defer closeFile()
+
+	if !h.uploadError(c, h.agentSvc.UploadReadme(c.Request.Context(), agent, upload), "README") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "README uploaded successfully"})
+}
+
+// GetManifestSchema returns the JSON Schema of a manifest schema version,
+// e.g. /schemas/manifest/v1
+func (h *Handler) GetManifestSchema(c *gin.Context) {
+	version, err := strconv.Atoi(strings.TrimPrefix(c.Param("version"), "v"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schema not found"})
+		return
+	}
+	schema, ok := h.manifestSvc.Schema(version)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schema not found"})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Data(http.StatusOK, "application/schema+json", schema)
+}
+
+// publishError writes the response for a release that cannot be published
+// because of its manifest, signature or malware scan and returns true, or returns false
+// for other errors
+func publishError(c *gin.Context, err error) bool {
+	switch {
+	case err == services.ErrManifestRequired, errors.Is(err, services.ErrManifestMismatch):
+	case err == services.ErrSignatureRequired, err == services.ErrSigningKeyRevoked, err == services.ErrInvalidSignature:
+	case err == services.ErrScanPending, err == services.ErrScanFailed:
+	default:
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	return true
+}
+
+// GetAgentIcon redirects to an agent's icon
+func (h *Handler) GetAgentIcon(c *gin.Context) {
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+
+	url, err := h.agentSvc.GetIconURL(c.Request.Context(), agent)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get agent icon")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if url == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent has no icon"})
+		return
+	}
+
+	c.Redirect(http.StatusFound, url)
+}
+
+// findUploadVersion loads the release named in the version form field,
+// defaulting to the agent's current version
+func (h *Handler) findUploadVersion(c *gin.Context, agent *models.Agent) (*models.AgentVersion, bool) {
+	release, err := h.agentSvc.GetVersion(agent.ID, c.DefaultPostForm("version", agent.Version))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+			return nil, false
+		}
+		log.Error().Err(err).Msg("Failed to get agent version")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return nil, false
+	}
+	return release, true
+}
+
+// formUpload opens the file in the file field of a multipart form. A
+// positive limit caps the size of the request body. The returned function
+// closes the file.
+func formUpload(c *gin.Context, limit int64) (services.FileUpload, func(), bool) {
+	if limit > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+multipartOverhead)
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file must be uploaded in the file field"})
+		return services.FileUpload{}, nil, false
+	}
+	file, err := header.Open()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to open uploaded file")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return services.FileUpload{}, nil, false
+	}
+
+	contentType := header.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return services.FileUpload{
+		Body:        file,
+		Size:        header.Size,
+		ContentType: contentType,
+	}, func() { file.Close() }, true
+}
+
+// uploadError writes the response for a failed upload and returns false,
+// or returns true if err is nil
+func (h *Handler) uploadError(c *gin.Context, err error, file string) bool {
+	if errors.Is(err, services.ErrInvalidManifest) || errors.Is(err, services.ErrInvalidSBOM) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+
+	switch err {
+	case nil:
+		return true
+	case services.ErrVersionImmutable:
+		c.JSON(http.StatusConflict, gin.H{"error": "Published versions cannot be changed; create a new version"})
+	case services.ErrAssetTooLarge:
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case services.ErrUnsupportedContentType:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case services.ErrStorageQuotaExceeded:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case services.ErrInvalidSignature, services.ErrSigningKeyRevoked:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msgf("Failed to upload agent %s", file)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload " + file})
+	}
+	return false
+}
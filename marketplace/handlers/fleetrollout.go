@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/services"
+)
+
+// startFleetRollout starts a rollout for CreateDeployment
+func (h *Handler) startFleetRollout(c *gin.Context, userID uuid.UUID, req services.FleetRolloutRequest) {
+	rollout, err := h.fleetSvc.StartRollout(userID, req)
+	switch err {
+	case nil:
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":   "Rollout started",
+			"rollout":   rollout,
+			"operation": services.RolloutOperation(rollout),
+		})
+	case services.ErrAgentNotPurchasable:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+	case services.ErrAgentNotMetered:
+		c.JSON(http.StatusConflict, gin.H{"error": "This agent is sold outright, buy it through checkout instead"})
+	case services.ErrInvalidRolloutPlan, services.ErrInvalidFailureThreshold, services.ErrRolloutDevices,
+		services.ErrTooManyRolloutDevices, services.ErrVersionNotPublished:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case services.ErrFleetRolloutInProgress:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to start fleet rollout")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// GetFleetRollouts returns the current user's fleet rollouts
+func (h *Handler) GetFleetRollouts(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	rollouts, total, err := h.fleetSvc.GetRollouts(userID.(uuid.UUID), page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get fleet rollouts")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"rollouts": rollouts,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// GetFleetRollout returns a fleet rollout with the status of each device
+func (h *Handler) GetFleetRollout(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rollout ID"})
+		return
+	}
+
+	rollout, err := h.fleetSvc.GetRollout(userID.(uuid.UUID), id)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"rollout": rollout})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rollout not found"})
+	default:
+		log.Error().Err(err).Msg("Failed to get fleet rollout")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// HaltFleetRollout stops a fleet rollout before its next wave
+func (h *Handler) HaltFleetRollout(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rollout ID"})
+		return
+	}
+
+	rollout, err := h.fleetSvc.HaltRollout(userID.(uuid.UUID), id)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"rollout": rollout})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rollout not found"})
+	case services.ErrFleetRolloutFinished:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to halt fleet rollout")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// fraudRuleRequest is the body for creating or updating a fraud rule
+type fraudRuleRequest struct {
+	Name    string                 `json:"name" binding:"required"`
+	Type    models.FraudRuleType   `json:"type" binding:"required"`
+	Params  models.FraudRuleParams `json:"params"`
+	Action  models.FraudAction     `json:"action" binding:"required"`
+	Enabled *bool                  `json:"enabled"` // defaults to true
+}
+
+// rule converts the request to a fraud rule
+func (r *fraudRuleRequest) rule() models.FraudRule {
+	enabled := true
+	if r.Enabled != nil {
+		enabled = *r.Enabled
+	}
+	return models.FraudRule{
+		Name:    r.Name,
+		Type:    r.Type,
+		Params:  r.Params,
+		Action:  r.Action,
+		Enabled: enabled,
+	}
+}
+
+// GetFraudRules returns all fraud rules with their feedback counters
+func (h *Handler) GetFraudRules(c *gin.Context) {
+	rules, err := h.fraudSvc.GetRules()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get fraud rules")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+// CreateFraudRule creates a fraud rule
+func (h *Handler) CreateFraudRule(c *gin.Context) {
+	var req fraudRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule := req.rule()
+	if err := h.fraudSvc.ValidateRule(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.fraudSvc.CreateRule(&rule); err != nil {
+		log.Error().Err(err).Msg("Failed to create fraud rule")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create fraud rule"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Fraud rule created successfully",
+		"rule":    rule,
+	})
+}
+
+// UpdateFraudRule replaces a fraud rule's settings
+func (h *Handler) UpdateFraudRule(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule ID"})
+		return
+	}
+
+	var req fraudRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule := req.rule()
+	rule.ID = id
+	if err := h.fraudSvc.ValidateRule(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.fraudSvc.UpdateRule(&rule); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Fraud rule not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to update fraud rule")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update fraud rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Fraud rule updated successfully"})
+}
+
+// DeleteFraudRule deletes a fraud rule
+func (h *Handler) DeleteFraudRule(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule ID"})
+		return
+	}
+
+	if err := h.fraudSvc.DeleteRule(id); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Fraud rule not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete fraud rule")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete fraud rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Fraud rule deleted successfully"})
+}
+
+// GetFraudReviews returns the manual-review queue of held purchases
+func (h *Handler) GetFraudReviews(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	assessments, total, err := h.fraudSvc.GetReviewQueue(page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get fraud review queue")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"assessments": assessments,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// ReviewFraudAssessment approves or rejects a held purchase
+func (h *Handler) ReviewFraudAssessment(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid assessment ID"})
+		return
+	}
+
+	var req struct {
+		Decision string `json:"decision" binding:"required,oneof=approve reject"`
+		Notes    string `json:"notes"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = h.fraudSvc.ReviewPurchase(id, userID.(uuid.UUID), req.Decision == "approve", req.Notes)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Assessment not found"})
+		return
+	case services.ErrReviewClosed, services.ErrOutcomeRecorded:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to review fraud assessment")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to review assessment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Assessment reviewed successfully"})
+}
+
+// RecordFraudOutcome records whether an assessed purchase turned out to be
+// fraud, feeding back into the matched rules' counters
+func (h *Handler) RecordFraudOutcome(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid assessment ID"})
+		return
+	}
+
+	var req struct {
+		Outcome models.FraudOutcome `json:"outcome" binding:"required,oneof=fraud legitimate"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = h.fraudSvc.RecordOutcome(id, req.Outcome)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Assessment not found"})
+		return
+	case services.ErrOutcomeRecorded:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to record fraud outcome")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record outcome"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Outcome recorded successfully"})
+}
@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -19,34 +22,184 @@ import (
 
 // Handler holds all HTTP handlers
 type Handler struct {
-	config   *config.Config
-	db       *gorm.DB
-	authSvc  *services.AuthService
-	agentSvc *services.AgentService
-	userSvc  *services.UserService
+	config          *config.Config
+	db              *gorm.DB
+	authSvc         *services.AuthService
+	agentSvc        *services.AgentService
+	userSvc         *services.UserService
+	reviewSvc       *services.ReviewService
+	checkoutSvc     *services.CheckoutService
+	fraudSvc        *services.FraudService
+	tierSvc         *services.TierService
+	meteringSvc     *services.MeteringService
+	fleetSvc        *services.FleetRolloutService
+	transferSvc     *services.TransferService
+	creditSvc       *services.CreditService
+	localeSvc       *services.LocalizationService
+	capabilitySvc   *services.CapabilityService
+	bundleSvc       *services.BundleService
+	deviceSvc       *services.DeviceService
+	importSvc       *services.DeviceImportService
+	deviceCertSvc   *services.DeviceCertService
+	deviceJournal   *services.DeviceJournal
+	downloadCounter *services.DownloadCounter
+	checkInSvc      *services.DeviceCheckInService
+	telemetrySvc    *services.TelemetryService
+	templateSvc     *services.TemplateService
+	statsSvc        *services.PublicStatsService
+	adminStatsSvc   *services.AdminStatsService
+	changelogSvc    *services.ChangelogService
+	moderationSvc   *services.ModerationService
+	seoSvc          *services.SEOService
+	domainSvc       *services.DomainService
+	signer          services.Signer
+	tokenSvc        *services.DownloadTokenService
+	refundSvc       *services.RefundService
+	curationSvc     *services.CurationService
+	rankingSvc      *services.RankingService
+	trendingSvc     *services.TrendingService
+	housekeepingSvc *services.HousekeepingService
+	consentSvc      *services.ConsentService
+	payoutSvc       *services.PayoutService
+	insightSvc      *services.ReviewInsightService
+	receiptSvc      *services.ReceiptService
+	licenseSvc      *services.LicenseService
+	subscriptionSvc *services.SubscriptionService
+	traceSvc        *services.TraceService
+	currencySvc     *services.CurrencyService
+	dashboardSvc    *services.DashboardService
+	historySvc      *services.HistoryService
+	complianceSvc   *services.ComplianceService
+	resetSvc        *services.PasswordResetService
+	confirmSvc      *services.ConfirmationService
+	apiKeySvc       *services.APIKeyService
+	accountSvc      *services.ServiceAccountService
+	notificationSvc *services.NotificationService
+	webhookSvc      *services.WebhookService
+	eventSvc        *services.EventService
+	jobQueue        *services.JobQueue
+	artifactSvc     *services.ArtifactService
+	operationSvc    *services.OperationService
+	searchSvc       *services.SearchService
+	avatarSvc       *services.AvatarService
+	attachmentSvc   *services.ReviewAttachmentService
+	holdSvc         *services.LegalHoldService
+	auditSvc        *services.AuditService
+	scanSvc         *services.ScanService
+	publisherSvc    *services.PublisherApplicationService
+	orgSvc          *services.OrganizationService
+	authzSvc        *services.AuthorizationService
+	orgPurchaseSvc  *services.OrgPurchaseService
+	resellerSvc     *services.ResellerService
+	manifestSvc     *services.ManifestService
+	signingKeySvc   *services.SigningKeyService
+	limitSvc        *services.LimitService
+	replSvc         *services.ReplicationService
+	redisSvc        *services.RedisService
+	cache           *services.AgentCache
 }
 
 // NewHandler creates a new handler instance
-func NewHandler(cfg *config.Config, db *gorm.DB) *Handler {
-	authSvc := services.NewAuthService(cfg, db)
-	agentSvc := services.NewAgentService(db)
+func NewHandler(cfg *config.Config, db *gorm.DB, replSvc *services.ReplicationService, redisSvc *services.RedisService, authSvc *services.AuthService, cache *services.AgentCache, tierSvc *services.TierService, storage services.Storage, domainSvc *services.DomainService, signer services.Signer, payments services.PaymentProvider, mailer services.Mailer, apiKeySvc *services.APIKeyService, notificationSvc *services.NotificationService, webhookSvc *services.WebhookService, searchSvc *services.SearchService, scanSvc *services.ScanService, limitSvc *services.LimitService, deviceCertSvc *services.DeviceCertService, seoSvc *services.SEOService, deviceJournal *services.DeviceJournal, accountSvc *services.ServiceAccountService, eventSvc *services.EventService, jobQueue *services.JobQueue, artifactSvc *services.ArtifactService, insightSvc *services.ReviewInsightService) *Handler {
+	agentSvc := services.NewAgentService(db, cache, tierSvc, storage, cfg.Storage.PresignExpiry, cfg.Scanning.Enabled)
 	userSvc := services.NewUserService(db)
+	reviewSvc := services.NewReviewService(db)
+	fraudSvc := services.NewFraudService(db, cfg.Fraud)
+	checkoutSvc := services.NewCheckoutService(db, cfg.Checkout, fraudSvc, tierSvc)
+	meteringSvc := services.NewMeteringService(db, cfg.Metering, limitSvc)
+	rankingSvc := services.NewRankingService(db, cfg.Ranking)
+	consentSvc := services.NewConsentService(db, cfg.Consent)
+	fleetSvc := services.NewFleetRolloutService(db, cfg.FleetRollouts, meteringSvc)
+	importSvc := services.NewDeviceImportService(db, cfg.DeviceImports)
+	authzSvc := services.NewAuthorizationService(db, cfg.Security)
 
 	return &Handler{
-		config:   cfg,
-		db:       db,
-		authSvc:  authSvc,
-		agentSvc: agentSvc,
-		userSvc:  userSvc,
+		config:          cfg,
+		db:              db,
+		authSvc:         authSvc,
+		agentSvc:        agentSvc,
+		userSvc:         userSvc,
+		reviewSvc:       reviewSvc,
+		checkoutSvc:     checkoutSvc,
+		fraudSvc:        fraudSvc,
+		tierSvc:         tierSvc,
+		meteringSvc:     meteringSvc,
+		fleetSvc:        fleetSvc,
+		transferSvc:     services.NewTransferService(db, cfg.Transfers, meteringSvc),
+		creditSvc:       services.NewCreditService(db, cfg.Credits),
+		localeSvc:       services.NewLocalizationService(db),
+		capabilitySvc:   services.NewCapabilityService(db),
+		bundleSvc:       services.NewBundleService(db, checkoutSvc, meteringSvc),
+		deviceSvc:       services.NewDeviceService(db),
+		importSvc:       importSvc,
+		deviceCertSvc:   deviceCertSvc,
+		deviceJournal:   deviceJournal,
+		downloadCounter: services.NewDownloadCounter(db, redisSvc, cfg.DownloadCounter),
+		checkInSvc:      services.NewDeviceCheckInService(db, meteringSvc, agentSvc),
+		telemetrySvc:    services.NewTelemetryService(db, cfg.Telemetry, consentSvc),
+		templateSvc:     services.NewTemplateService(db, storage, cfg.Storage.PresignExpiry, consentSvc),
+		consentSvc:      consentSvc,
+		statsSvc:        services.NewPublicStatsService(db, cfg.PublicStats),
+		adminStatsSvc:   services.NewAdminStatsService(db, redisSvc, cfg.AdminStats),
+		changelogSvc:    services.NewChangelogService(db),
+		moderationSvc:   services.NewModerationService(db, reviewSvc),
+		seoSvc:          seoSvc,
+		domainSvc:       domainSvc,
+		signer:          signer,
+		tokenSvc:        services.NewDownloadTokenService(signer, cfg.JWT.Issuer, cfg.Signing.DownloadTokenTTL),
+		refundSvc:       services.NewRefundService(db, payments),
+		curationSvc:     services.NewCurationService(db, cfg.Curation, rankingSvc),
+		rankingSvc:      rankingSvc,
+		trendingSvc:     services.NewTrendingService(db, cfg.Trending),
+		housekeepingSvc: services.NewHousekeepingService(db, cfg.StaleDrafts, cfg.UnsoldAgents, agentSvc),
+		payoutSvc:       services.NewPayoutService(db, payments, cfg.Payouts),
+		insightSvc:      insightSvc,
+		receiptSvc:      services.NewReceiptService(db, signer, cfg.JWT.Issuer),
+		licenseSvc:      services.NewLicenseService(db, cfg.Licenses, signer, cfg.JWT.Issuer),
+		subscriptionSvc: services.NewSubscriptionService(db, cfg.Subscriptions, cfg.Payments.WebhookSecret, payments),
+		traceSvc:        services.NewTraceService(db),
+		currencySvc:     services.NewCurrencyService(db, cfg.Currencies),
+		dashboardSvc:    services.NewDashboardService(db),
+		historySvc:      services.NewHistoryService(db, signer, cfg.JWT.Issuer),
+		complianceSvc:   services.NewComplianceService(db, signer, cfg.JWT.Issuer),
+		resetSvc:        services.NewPasswordResetService(db, authSvc, mailer, cfg.PasswordReset),
+		confirmSvc:      services.NewConfirmationService(db, mailer, signer, cfg.JWT.Issuer, cfg.Confirmations),
+		apiKeySvc:       apiKeySvc,
+		accountSvc:      accountSvc,
+		notificationSvc: notificationSvc,
+		webhookSvc:      webhookSvc,
+		eventSvc:        eventSvc,
+		jobQueue:        jobQueue,
+		artifactSvc:     artifactSvc,
+		operationSvc:    services.NewOperationService(db, authzSvc, importSvc, fleetSvc, searchSvc),
+		searchSvc:       searchSvc,
+		avatarSvc:       services.NewAvatarService(db, storage),
+		attachmentSvc:   services.NewReviewAttachmentService(db, storage, cfg.ReviewAttachments, cfg.Scanning.Enabled),
+		holdSvc:         services.NewLegalHoldService(db),
+		auditSvc:        services.NewAuditService(db),
+		scanSvc:         scanSvc,
+		publisherSvc:    services.NewPublisherApplicationService(db),
+		orgSvc:          services.NewOrganizationService(db),
+		authzSvc:        authzSvc,
+		orgPurchaseSvc:  services.NewOrgPurchaseService(db, payments, tierSvc),
+		resellerSvc:     services.NewResellerService(db, cfg.Resellers),
+		manifestSvc:     services.NewManifestService(),
+		signingKeySvc:   services.NewSigningKeyService(db),
+		limitSvc:        limitSvc,
+		replSvc:         replSvc,
+		redisSvc:        redisSvc,
+		cache:           cache,
 	}
 }
 
 // HealthCheck handles health check requests
 func (h *Handler) HealthCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
-		"status":    "healthy",
-		"timestamp": time.Now().UTC(),
-		"version":   "1.0.0",
+		"status":      "healthy",
+		"timestamp":   time.Now().UTC(),
+		"version":     config.Version,
+		"replication": h.replSvc.Status(),
+		"redis":       h.redisSvc.Status(),
 	})
 }
 
@@ -90,6 +243,7 @@ func (h *Handler) Register(c *gin.Context) {
 		LastName:     req.LastName,
 		Company:      req.Company,
 		Role:         models.UserRoleUser,
+		Tier:         models.PublisherTierFree,
 		Status:       models.UserStatusActive,
 	}
 
@@ -100,12 +254,18 @@ func (h *Handler) Register(c *gin.Context) {
 	}
 
 	// Generate JWT token
-	token, err := h.authSvc.GenerateToken(user.ID, user.Email, string(user.Role))
+	token, err := h.authSvc.GenerateToken(user.ID, user.Email, string(user.Role), string(user.Tier))
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to generate token")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
+	refreshToken, err := h.authSvc.IssueRefreshToken(user.ID, c.Request.UserAgent())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to issue refresh token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
 
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "User registered successfully",
@@ -117,7 +277,8 @@ func (h *Handler) Register(c *gin.Context) {
 			"last_name":  user.LastName,
 			"role":       user.Role,
 		},
-		"token": token,
+		"token":         token,
+		"refresh_token": refreshToken,
 	})
 }
 
@@ -158,12 +319,18 @@ func (h *Handler) Login(c *gin.Context) {
 	}
 
 	// Generate JWT token
-	token, err := h.authSvc.GenerateToken(user.ID, user.Email, string(user.Role))
+	token, err := h.authSvc.GenerateToken(user.ID, user.Email, string(user.Role), string(user.Tier))
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to generate token")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
+	refreshToken, err := h.authSvc.IssueRefreshToken(user.ID, c.Request.UserAgent())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to issue refresh token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Login successful",
@@ -175,10 +342,135 @@ func (h *Handler) Login(c *gin.Context) {
 			"last_name":  user.LastName,
 			"role":       user.Role,
 		},
-		"token": token,
+		"token":         token,
+		"refresh_token": refreshToken,
 	})
 }
 
+// RefreshToken exchanges a refresh token for a new access token and a new
+// refresh token; the old refresh token stops working
+func (h *Handler) RefreshToken(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, refreshToken, err := h.authSvc.RotateRefreshToken(req.RefreshToken, c.Request.UserAgent())
+	switch err {
+	case nil:
+	case services.ErrInvalidRefreshToken, services.ErrRefreshTokenReused:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to rotate refresh token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	token, err := h.authSvc.GenerateToken(user.ID, user.Email, string(user.Role), string(user.Tier))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         token,
+		"refresh_token": refreshToken,
+	})
+}
+
+// Logout revokes the access token of the request and the login of the
+// given refresh token, or with all set, every login of the user
+func (h *Handler) Logout(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+		All          bool   `json:"all"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var err error
+	if req.All {
+		err = h.authSvc.RevokeAllTokens(c.Request.Context(), userID.(uuid.UUID))
+	} else {
+		if claims, ok := c.Get("claims"); ok {
+			err = h.authSvc.RevokeToken(c.Request.Context(), claims.(*services.Claims))
+		}
+		if err == nil && req.RefreshToken != "" {
+			err = h.authSvc.RevokeRefreshToken(userID.(uuid.UUID), req.RefreshToken)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to log out")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// ForgotPassword emails a password reset link if an account uses the
+// address. The response is the same either way.
+func (h *Handler) ForgotPassword(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.resetSvc.RequestReset(req.Email, c.ClientIP()); err != nil {
+		log.Error().Err(err).Msg("Failed to request password reset")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If an account uses this address, a password reset link has been sent to it"})
+}
+
+// ResetPassword sets a new password with an emailed reset token and ends
+// all of the user's sessions
+func (h *Handler) ResetPassword(c *gin.Context) {
+	var req struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required,min=8"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch err := h.resetSvc.ResetPassword(c.Request.Context(), req.Token, req.Password); err {
+	case nil:
+	case services.ErrInvalidResetToken:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to reset password")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+}
+
 // GetProfile returns the current user's profile
 func (h *Handler) GetProfile(c *gin.Context) {
 	userID, exists := c.Get("user_id")
@@ -200,16 +492,24 @@ func (h *Handler) GetProfile(c *gin.Context) {
 
 	c.JSON(http.StatusOK, gin.H{
 		"user": gin.H{
-			"id":         user.ID,
-			"email":      user.Email,
-			"username":   user.Username,
-			"first_name": user.FirstName,
-			"last_name":  user.LastName,
-			"company":    user.Company,
-			"role":       user.Role,
-			"status":     user.Status,
-			"verified":   user.Verified,
-			"created_at": user.CreatedAt,
+			"id":                        user.ID,
+			"email":                     user.Email,
+			"username":                  user.Username,
+			"first_name":                user.FirstName,
+			"last_name":                 user.LastName,
+			"company":                   user.Company,
+			"avatar_url":                user.AvatarURL,
+			"role":                      user.Role,
+			"tier":                      user.Tier,
+			"plan":                      h.tierSvc.Plan(user.Tier),
+			"limits":                    h.limitSvc.Effective(user.ID, user.Tier),
+			"storage_used_bytes":        user.StorageUsedBytes,
+			"status":                    user.Status,
+			"verified":                  user.Verified,
+			"review_reminder_opt_out":   user.ReviewReminderOptOut,
+			"checkout_recovery_enabled": user.CheckoutRecoveryEnabled,
+			"review_insights_enabled":   user.ReviewInsightsEnabled,
+			"created_at":                user.CreatedAt,
 		},
 	})
 }
@@ -223,9 +523,12 @@ func (h *Handler) UpdateProfile(c *gin.Context) {
 	}
 
 	var req struct {
-		FirstName string `json:"first_name"`
-		LastName  string `json:"last_name"`
-		Company   string `json:"company"`
+		FirstName               string `json:"first_name"`
+		LastName                string `json:"last_name"`
+		Company                 string `json:"company"`
+		ReviewReminderOptOut    *bool  `json:"review_reminder_opt_out"`
+		CheckoutRecoveryEnabled *bool  `json:"checkout_recovery_enabled"` // applies to the agents the user publishes
+		ReviewInsightsEnabled   *bool  `json:"review_insights_enabled"`   // applies to the agents the user publishes
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -239,23 +542,37 @@ func (h *Handler) UpdateProfile(c *gin.Context) {
 		"last_name":  req.LastName,
 		"company":    req.Company,
 	}
+	if req.ReviewReminderOptOut != nil {
+		updates["review_reminder_opt_out"] = *req.ReviewReminderOptOut
+	}
+	if req.CheckoutRecoveryEnabled != nil {
+		updates["checkout_recovery_enabled"] = *req.CheckoutRecoveryEnabled
+	}
+	if req.ReviewInsightsEnabled != nil {
+		updates["review_insights_enabled"] = *req.ReviewInsightsEnabled
+	}
 
 	if err := h.db.Model(&models.User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
 		log.Error().Err(err).Msg("Failed to update profile")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
 		return
 	}
+	if req.ReviewInsightsEnabled != nil {
+		if err := h.insightSvc.SetPublisherEnabled(userID.(uuid.UUID), *req.ReviewInsightsEnabled); err != nil {
+			log.Error().Err(err).Msg("Failed to apply review insights setting")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+			return
+		}
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Profile updated successfully"})
 }
 
-// GetAgents returns a list of agents with filtering and pagination
+// GetAgents returns a list of agents with filtering and pagination, by page
+// number or, given a cursor, by keyset
 func (h *Handler) GetAgents(c *gin.Context) {
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
-	category := c.Query("category")
-	status := c.Query("status")
-	search := c.Query("search")
 	sortBy := c.DefaultQuery("sort", "created_at")
 	sortOrder := c.DefaultQuery("order", "desc")
 
@@ -265,27 +582,56 @@ func (h *Handler) GetAgents(c *gin.Context) {
 	if limit < 1 || limit > 100 {
 		limit = 20
 	}
+	sort, sortable := agentSorts[sortBy]
+	if !sortable && sortBy != sortRank && sortBy != sortTrending {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be created_at, updated_at, price, rating, review_count, downloads, name, rank or trending"})
+		return
+	}
+	if sortOrder != "asc" && sortOrder != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+		return
+	}
 
 	offset := (page - 1) * limit
 
-	query := h.db.Model(&models.Agent{}).Where("deleted_at IS NULL")
-
-	// Apply filters
-	if category != "" {
-		query = query.Where("category = ?", category)
+	filter, ok := h.parseAgentFilter(c)
+	if !ok {
+		return
 	}
-	if status != "" {
-		query = query.Where("status = ?", status)
+	query := filter.apply(h.db.Model(&models.Agent{}).Where("deleted_at IS NULL"), "")
+	converter, ok := h.displayConverter(c)
+	if !ok {
+		return
 	}
-	if search != "" {
-		query = query.Where("name ILIKE ? OR description ILIKE ?", "%"+search+"%", "%"+search+"%")
+
+	cursor, keyset, ok := cursorParam(c)
+	if !ok {
+		return
 	}
+	if keyset {
+		if !sortable {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cursor pagination cannot sort by " + sortBy})
+			return
+		}
 
-	// Apply sorting
-	if sortOrder == "asc" {
-		query = query.Order(fmt.Sprintf("%s ASC", sortBy))
-	} else {
-		query = query.Order(fmt.Sprintf("%s DESC", sortBy))
+		var agents []models.Agent
+		if err := services.Keyset(query, sort.column, sortOrder == "desc", cursor, limit).
+			Preload("Publisher").Find(&agents).Error; err != nil {
+			log.Error().Err(err).Msg("Failed to get agents")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		var next *services.Cursor
+		if len(agents) > limit {
+			agents = agents[:limit]
+			last := &agents[limit-1]
+			next = services.NewCursor(sort.value(last), last.ID)
+		}
+		setDisplayPrices(agents, converter)
+		h.addPendingDownloads(c, agents)
+
+		c.JSON(http.StatusOK, gin.H{"agents": agents, "pagination": cursorPagination(limit, next)})
+		return
 	}
 
 	var agents []models.Agent
@@ -298,12 +644,31 @@ func (h *Handler) GetAgents(c *gin.Context) {
 		return
 	}
 
+	// Apply sorting; rank orders by the admin-tuned ranking score and
+	// trending by recent activity, both best first
+	switch sortBy {
+	case sortRank:
+		ranked, err := h.rankingSvc.Order(query)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get ranking weights")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		query = ranked
+	case sortTrending:
+		query = h.trendingSvc.Order(query)
+	default:
+		query = query.Order(sort.column + " " + strings.ToUpper(sortOrder) + ", agents.id")
+	}
+
 	// Get agents with pagination
 	if err := query.Offset(offset).Limit(limit).Preload("Publisher").Find(&agents).Error; err != nil {
 		log.Error().Err(err).Msg("Failed to get agents")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
+	setDisplayPrices(agents, converter)
+	h.addPendingDownloads(c, agents)
 
 	c.JSON(http.StatusOK, gin.H{
 		"agents": agents,
@@ -316,29 +681,75 @@ func (h *Handler) GetAgents(c *gin.Context) {
 	})
 }
 
-// GetAgent returns a specific agent by ID
+// addPendingDownloads adds downloads not flushed to the database yet to
+// the counts of listed agents
+func (h *Handler) addPendingDownloads(c *gin.Context, agents []models.Agent) {
+	ids := make([]uuid.UUID, len(agents))
+	for i := range agents {
+		ids[i] = agents[i].ID
+	}
+	pending := h.downloadCounter.Pending(c.Request.Context(), ids)
+	for i := range agents {
+		agents[i].Downloads += pending[agents[i].ID]
+	}
+}
+
+// GetAgent returns a specific agent by ID, or its listing at ?as_of= (RFC 3339).
+// Authenticated users also learn whether it is one of their favorites.
 func (h *Handler) GetAgent(c *gin.Context) {
 	agentID, err := uuid.Parse(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
 		return
 	}
+	if c.Query("as_of") != "" {
+		h.getAgentAsOf(c, agentID)
+		return
+	}
+	converter, ok := h.displayConverter(c)
+	if !ok {
+		return
+	}
 
-	var agent models.Agent
-	if err := h.db.Preload("Publisher").Preload("Reviews.User").First(&agent, agentID).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+	agent, cached := h.cache.Get(agentID)
+	if !cached {
+		agent = &models.Agent{}
+		if err := h.db.Preload("Publisher").Preload("SigningKey").Preload("Reviews.User").First(agent, agentID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+				return
+			}
+			log.Error().Err(err).Msg("Database error getting agent")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 			return
 		}
-		log.Error().Err(err).Msg("Database error getting agent")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		h.cache.Set(agent)
+	}
+	if !h.authorizeAgent(c, agent, services.AgentView) {
 		return
 	}
+	pending := h.downloadCounter.Pending(c.Request.Context(), []uuid.UUID{agentID})[agentID]
+	if converter != nil || pending > 0 {
+		// The cached agent is shared, so convert a copy
+		listed := *agent
+		if converter != nil {
+			listed.DisplayPrice = converter.Convert(listed.Price, listed.Currency)
+		}
+		listed.Downloads += pending
+		agent = &listed
+	}
 
-	// Increment download count
-	h.db.Model(&agent).UpdateColumn("downloads", gorm.Expr("downloads + ?", 1))
-
-	c.JSON(http.StatusOK, gin.H{"agent": agent})
+	response := gin.H{"agent": agent}
+	if userID, exists := c.Get("user_id"); exists {
+		favorited, err := h.userSvc.IsFavorite(userID.(uuid.UUID), agentID)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to check favorite")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		response["is_favorited"] = favorited
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 // CreateAgent creates a new agent
@@ -350,17 +761,22 @@ func (h *Handler) CreateAgent(c *gin.Context) {
 	}
 
 	var req struct {
-		Name        string   `json:"name" binding:"required"`
-		Description string   `json:"description"`
-		Version     string   `json:"version" binding:"required"`
-		Category    string   `json:"category" binding:"required"`
-		Tags        []string `json:"tags"`
-		Price       float64  `json:"price"`
-		Currency    string   `json:"currency"`
-		FlashSize   int      `json:"flash_size"`
-		SRAMSize    int      `json:"sram_size"`
-		MaxLatency  int      `json:"max_latency"`
-		SafetyLevel string   `json:"safety_level"`
+		Name            string      `json:"name" binding:"required"`
+		Description     string      `json:"description"`
+		Version         string      `json:"version" binding:"required"`
+		Category        string      `json:"category" binding:"required"`
+		Tags            []string    `json:"tags"`
+		HardwareTargets []string    `json:"hardware_targets" binding:"max=20,dive,min=1,max=64"`
+		Price           json.Number `json:"price"`
+		Currency        string      `json:"currency"`
+		PricingModel    string      `json:"pricing_model"`
+		DefaultLocale   string      `json:"default_locale"`
+		FlashSize       int         `json:"flash_size"`
+		SRAMSize        int         `json:"sram_size"`
+		MaxLatency      int         `json:"max_latency"`
+		SafetyLevel     string      `json:"safety_level"`
+		// Optional organization to publish under
+		OrganizationID *uuid.UUID `json:"organization_id"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -368,27 +784,79 @@ func (h *Handler) CreateAgent(c *gin.Context) {
 		return
 	}
 
+	currency := models.NormalizeCurrency(req.Currency)
+	if !h.checkCurrency(c, currency) {
+		return
+	}
+	price, err := models.ParseMoney(req.Price.String(), currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if price < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "price must not be negative"})
+		return
+	}
+	pricingModel, err := models.ParsePricingModel(req.PricingModel)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.OrganizationID != nil {
+		switch err := h.orgSvc.CanPublishFor(*req.OrganizationID, userID.(uuid.UUID)); err {
+		case nil:
+		case services.ErrNotOrgMember:
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+			return
+		case services.ErrOrgPermission:
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		default:
+			log.Error().Err(err).Msg("Failed to check organization role")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+	}
+
+	defaultLocale := models.DefaultLocale
+	if req.DefaultLocale != "" {
+		if defaultLocale, err = models.NormalizeLocale(req.DefaultLocale); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	agent := models.Agent{
-		Name:        req.Name,
-		Description: req.Description,
-		Version:     req.Version,
-		PublisherID: userID.(uuid.UUID),
-		Category:    req.Category,
-		Tags:        req.Tags,
-		Price:       req.Price,
-		Currency:    req.Currency,
-		FlashSize:   req.FlashSize,
-		SRAMSize:    req.SRAMSize,
-		MaxLatency:  req.MaxLatency,
-		SafetyLevel: models.SafetyLevel(req.SafetyLevel),
-		Status:      models.AgentStatusDraft,
-	}
-
-	if err := h.db.Create(&agent).Error; err != nil {
+		Name:            req.Name,
+		Description:     req.Description,
+		Version:         req.Version,
+		PublisherID:     userID.(uuid.UUID),
+		OrganizationID:  req.OrganizationID,
+		Category:        req.Category,
+		Tags:            req.Tags,
+		HardwareTargets: models.NormalizeHardwareTargets(req.HardwareTargets),
+		Price:           price,
+		Currency:        currency,
+		PricingModel:    pricingModel,
+		FlashSize:       req.FlashSize,
+		SRAMSize:        req.SRAMSize,
+		MaxLatency:      req.MaxLatency,
+		SafetyLevel:     models.SafetyLevel(req.SafetyLevel),
+		DefaultLocale:   defaultLocale,
+		Status:          models.AgentStatusDraft,
+	}
+
+	if err := h.agentSvc.CreateAgent(&agent); err != nil {
+		if err == services.ErrInvalidVersion {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		log.Error().Err(err).Msg("Failed to create agent")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create agent"})
 		return
 	}
+	agent.PriceDisplay = models.FormatMoney(agent.Price, agent.Currency)
 
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Agent created successfully",
@@ -398,113 +866,192 @@ func (h *Handler) CreateAgent(c *gin.Context) {
 
 // UpdateAgent updates an existing agent
 func (h *Handler) UpdateAgent(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
 		return
 	}
 
-	agentID, err := uuid.Parse(c.Param("id"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
-		return
+	var req struct {
+		Name            string      `json:"name"`
+		Description     string      `json:"description"`
+		Category        string      `json:"category"`
+		Tags            []string    `json:"tags"`
+		HardwareTargets []string    `json:"hardware_targets" binding:"max=20,dive,min=1,max=64"`
+		Price           json.Number `json:"price"`
+		Currency        string      `json:"currency"`
+		PricingModel    string      `json:"pricing_model"`
+		DefaultLocale   string      `json:"default_locale"`
+		FlashSize       int         `json:"flash_size"`
+		SRAMSize        int         `json:"sram_size"`
+		MaxLatency      int         `json:"max_latency"`
+		SafetyLevel     string      `json:"safety_level"`
+		Status          string      `json:"status"`
 	}
 
-	// Check if agent exists and belongs to user
-	var agent models.Agent
-	if err := h.db.Where("id = ? AND publisher_id = ?", agentID, userID).First(&agent).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
-			return
-		}
-		log.Error().Err(err).Msg("Database error getting agent")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	var req struct {
-		Name        string   `json:"name"`
-		Description string   `json:"description"`
-		Version     string   `json:"version"`
-		Category    string   `json:"category"`
-		Tags        []string `json:"tags"`
-		Price       float64  `json:"price"`
-		Currency    string   `json:"currency"`
-		FlashSize   int      `json:"flash_size"`
-		SRAMSize    int      `json:"sram_size"`
-		MaxLatency  int      `json:"max_latency"`
-		SafetyLevel string   `json:"safety_level"`
-		Status      string   `json:"status"`
+	currency := models.NormalizeCurrency(req.Currency)
+	if !h.checkCurrency(c, currency) {
+		return
 	}
-
-	if err := c.ShouldBindJSON(&req); err != nil {
+	price, err := models.ParseMoney(req.Price.String(), currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if price < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "price must not be negative"})
+		return
+	}
+	pricingModel, err := models.ParsePricingModel(req.PricingModel)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	updates := map[string]interface{}{
-		"name":         req.Name,
-		"description":  req.Description,
-		"version":      req.Version,
-		"category":     req.Category,
-		"tags":         req.Tags,
-		"price":        req.Price,
-		"currency":     req.Currency,
-		"flash_size":   req.FlashSize,
-		"sram_size":    req.SRAMSize,
-		"max_latency":  req.MaxLatency,
-		"safety_level": req.SafetyLevel,
-		"status":       req.Status,
+		"name":             req.Name,
+		"description":      req.Description,
+		"category":         req.Category,
+		"tags":             models.Tags(req.Tags),
+		"hardware_targets": models.NormalizeHardwareTargets(req.HardwareTargets),
+		"price_minor":      price,
+		"currency":         currency,
+		"pricing_model":    pricingModel,
+		"flash_size":       req.FlashSize,
+		"sram_size":        req.SRAMSize,
+		"max_latency":      req.MaxLatency,
+		"safety_level":     req.SafetyLevel,
+		"status":           req.Status,
+	}
+	if req.DefaultLocale != "" {
+		locale, err := models.NormalizeLocale(req.DefaultLocale)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updates["default_locale"] = locale
 	}
 
 	if req.Status == string(models.AgentStatusPublished) && agent.Status != models.AgentStatusPublished {
-		now := time.Now()
-		updates["published_at"] = &now
+		if err := h.tierSvc.CheckPublishLimit(agent.PublisherID); err != nil {
+			if err == services.ErrAgentLimitReached {
+				c.JSON(http.StatusConflict, gin.H{"error": "You have reached the published agent limit of your plan"})
+				return
+			}
+			log.Error().Err(err).Msg("Failed to check publish limit")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		// The manifest must match the specs the agent is published with
+		listed := *agent
+		listed.FlashSize = req.FlashSize
+		listed.SRAMSize = req.SRAMSize
+		listed.SafetyLevel = models.SafetyLevel(req.SafetyLevel)
+		switch err := h.agentSvc.CheckPublishable(&listed); {
+		case err == nil:
+			now := time.Now()
+			updates["published_at"] = &now
+		case err == services.ErrScanPending:
+			// Published by the scanner once the binary passes
+			updates["status"] = models.AgentStatusPending
+		case publishError(c, err):
+			return
+		default:
+			log.Error().Err(err).Msg("Failed to check agent release")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
 	}
 
-	if err := h.db.Model(&agent).Updates(updates).Error; err != nil {
+	if err := h.db.Model(agent).Updates(updates).Error; err != nil {
 		log.Error().Err(err).Msg("Failed to update agent")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update agent"})
 		return
 	}
+	h.agentSvc.InvalidateAgent(agent.ID)
+	if _, publishing := updates["published_at"]; publishing {
+		if err := h.agentSvc.PublishCurrentVersion(agent.ID); err != nil {
+			log.Error().Err(err).Msg("Failed to publish current agent version")
+		}
+	}
 
+	if updates["status"] == models.AgentStatusPending {
+		response := gin.H{
+			"message": "Agent will be published once its binary passes the malware scan",
+			"agent":   agent,
+		}
+		if release, err := h.scanSvc.GetScan(agent.ID, agent.Version); err == nil {
+			response["operation"] = services.ScanOperation(release)
+		}
+		c.JSON(http.StatusAccepted, response)
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Agent updated successfully",
 		"agent":   agent,
 	})
 }
 
-// DeleteAgent deletes an agent
+// DeleteAgent deletes an agent. Within an organization only owners can
+// delete agents, besides their publisher. Deleting an agent that has been
+// bought must be confirmed with the user's password or an emailed link.
 func (h *Handler) DeleteAgent(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+	if !h.authorizeAgent(c, agent, services.AgentDelete) {
 		return
 	}
 
-	agentID, err := uuid.Parse(c.Param("id"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Check if agent exists and belongs to user
-	var agent models.Agent
-	if err := h.db.Where("id = ? AND publisher_id = ?", agentID, userID).First(&agent).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
-			return
-		}
-		log.Error().Err(err).Msg("Database error getting agent")
+	var buyers int64
+	if err := h.db.Model(&models.Purchase{}).
+		Where("agent_id = ? AND status = ?", agent.ID, models.PurchaseStatusCompleted).
+		Distinct("buyer_id").Count(&buyers).Error; err != nil {
+		log.Error().Err(err).Msg("Failed to count agent buyers")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
+	if buyers > 0 {
+		action := &models.PendingAction{Action: models.PendingActionDeleteAgent, TargetID: &agent.ID}
+		if !h.confirmed(c, action, req.Password, fmt.Sprintf("delete the agent %s, which %d users have bought", agent.Name, buyers)) {
+			return
+		}
+	}
+
+	h.deleteAgent(c, agent)
+}
 
-	if err := h.db.Delete(&agent).Error; err != nil {
+// deleteAgent deletes an agent once the request is authorized and confirmed
+func (h *Handler) deleteAgent(c *gin.Context, agent *models.Agent) {
+	switch err := h.agentSvc.DeleteAgent(agent.ID); err {
+	case nil:
+	case services.ErrLegalHold:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
 		log.Error().Err(err).Msg("Failed to delete agent")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete agent"})
 		return
 	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionAgentDelete,
+		EntityType: "agent",
+		EntityID:   agent.ID,
+		Before:     models.AuditSnapshot{"name": agent.Name, "status": agent.Status, "version": agent.Version},
+	})
 
 	c.JSON(http.StatusOK, gin.H{"message": "Agent deleted successfully"})
 }
@@ -547,11 +1094,21 @@ func (h *Handler) CreateReview(c *gin.Context) {
 		Comment: req.Comment,
 	}
 
-	if err := h.db.Create(&review).Error; err != nil {
+	// Attribute the review to the release the user is served, so rollouts
+	// can be judged by their early reviews
+	var agent models.Agent
+	if err := h.db.First(&agent, "id = ?", agentID).Error; err == nil {
+		if release, err := h.agentSvc.ResolveVersion(&agent, review.UserID, c.GetHeader(h.config.Fraud.IPCountryHeader)); err == nil {
+			review.Version = release.Version
+		}
+	}
+
+	if err := h.reviewSvc.CreateReview(&review); err != nil {
 		log.Error().Err(err).Msg("Failed to create review")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create review"})
 		return
 	}
+	h.agentSvc.InvalidateAgent(agentID)
 
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Review created successfully",
@@ -559,7 +1116,84 @@ func (h *Handler) CreateReview(c *gin.Context) {
 	})
 }
 
-// GetReviews returns reviews for an agent
+// UpdateReview changes the rating and comment of the current user's review
+func (h *Handler) UpdateReview(c *gin.Context) {
+	review, ok := h.findOwnReview(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Rating  int    `json:"rating" binding:"required,min=1,max=5"`
+		Comment string `json:"comment"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.reviewSvc.UpdateReview(review, req.Rating, req.Comment); err != nil {
+		log.Error().Err(err).Msg("Failed to update review")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update review"})
+		return
+	}
+	h.agentSvc.InvalidateAgent(review.AgentID)
+
+	c.JSON(http.StatusOK, gin.H{"review": review})
+}
+
+// DeleteReview removes the current user's review with its votes, reply
+// and attachments
+func (h *Handler) DeleteReview(c *gin.Context) {
+	review, ok := h.findOwnReview(c)
+	if !ok {
+		return
+	}
+
+	attachments, err := h.reviewSvc.DeleteReview(review)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete review")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete review"})
+		return
+	}
+	h.attachmentSvc.DeleteFiles(c.Request.Context(), attachments)
+	h.agentSvc.InvalidateAgent(review.AgentID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Review deleted"})
+}
+
+// findOwnReview loads the review in the :id parameter if the current user
+// wrote it, writing the error response and returning false otherwise.
+// Hidden reviews cannot be changed.
+func (h *Handler) findOwnReview(c *gin.Context) (*models.Review, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	reviewID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+		return nil, false
+	}
+
+	var review models.Review
+	if err := h.db.First(&review, "id = ? AND user_id = ? AND hidden_at IS NULL", reviewID, userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+			return nil, false
+		}
+		log.Error().Err(err).Msg("Failed to get review")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return nil, false
+	}
+	return &review, true
+}
+
+// GetReviews returns reviews for an agent, newest first or with
+// sort=helpful most helpful first, by page number or, given a cursor and
+// the default order, by keyset
 func (h *Handler) GetReviews(c *gin.Context) {
 	agentID, err := uuid.Parse(c.Param("id"))
 	if err != nil {
@@ -569,6 +1203,11 @@ func (h *Handler) GetReviews(c *gin.Context) {
 
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	sortBy := c.DefaultQuery("sort", "newest")
+	if sortBy != "newest" && sortBy != "helpful" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be newest or helpful"})
+		return
+	}
 
 	if page < 1 {
 		page = 1
@@ -582,7 +1221,36 @@ func (h *Handler) GetReviews(c *gin.Context) {
 	var reviews []models.Review
 	var total int64
 
-	query := h.db.Model(&models.Review{}).Where("agent_id = ?", agentID)
+	query := h.db.Model(&models.Review{}).Where("agent_id = ? AND hidden_at IS NULL", agentID)
+
+	cursor, keyset, ok := cursorParam(c)
+	if !ok {
+		return
+	}
+	if keyset {
+		if sortBy != "newest" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cursor pagination cannot sort by " + sortBy})
+			return
+		}
+		if err := services.Keyset(query, "reviews.created_at", true, cursor, limit).
+			Preload("User").Preload("Reply").Find(&reviews).Error; err != nil {
+			log.Error().Err(err).Msg("Failed to get reviews")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		var next *services.Cursor
+		if len(reviews) > limit {
+			reviews = reviews[:limit]
+			last := reviews[limit-1]
+			next = services.NewCursor(last.CreatedAt, last.ID)
+		}
+		if !h.attachReviewFiles(c, reviews) {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"reviews": reviews, "pagination": cursorPagination(limit, next)})
+		return
+	}
 
 	// Get total count
 	if err := query.Count(&total).Error; err != nil {
@@ -592,11 +1260,18 @@ func (h *Handler) GetReviews(c *gin.Context) {
 	}
 
 	// Get reviews with pagination
-	if err := query.Offset(offset).Limit(limit).Preload("User").Order("created_at DESC").Find(&reviews).Error; err != nil {
+	order := "created_at DESC, id"
+	if sortBy == "helpful" {
+		order = "helpful_count - unhelpful_count DESC, helpful_count DESC, created_at DESC, id"
+	}
+	if err := query.Offset(offset).Limit(limit).Preload("User").Preload("Reply").Order(order).Find(&reviews).Error; err != nil {
 		log.Error().Err(err).Msg("Failed to get reviews")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 		return
 	}
+	if !h.attachReviewFiles(c, reviews) {
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"reviews": reviews,
@@ -608,3 +1283,64 @@ func (h *Handler) GetReviews(c *gin.Context) {
 		},
 	})
 }
+
+// attachReviewFiles sets the public attachments of listed reviews, writing
+// the error response and returning false if it cannot
+func (h *Handler) attachReviewFiles(c *gin.Context, reviews []models.Review) bool {
+	if err := h.attachmentSvc.Attach(c.Request.Context(), uuid.Nil, reviews, attachmentViewer(c)); err != nil {
+		log.Error().Err(err).Msg("Failed to get review attachments")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return false
+	}
+	return true
+}
+
+// GetReviewSummary returns the rating distribution and trend for an agent
+func (h *Handler) GetReviewSummary(c *gin.Context) {
+	agentID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
+		return
+	}
+
+	summary, err := h.reviewSvc.GetSummary(agentID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get review summary")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"summary": summary})
+}
+
+// GetReviewInsights returns the keywords reviews of an agent mention most
+// and their overall sentiment
+func (h *Handler) GetReviewInsights(c *gin.Context) {
+	agentID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
+		return
+	}
+
+	insight, err := h.insightSvc.GetInsight(agentID)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "No review insights for this agent yet"})
+		return
+	case services.ErrInsightsDisabled:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to get review insights")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"insights": insight})
+}
+
+// GetTiers returns the publisher plan tiers with their commission rates and limits
+func (h *Handler) GetTiers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"tiers": h.tierSvc.Plans()})
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetJobs returns the number of background jobs in each state and the most
+// recent dead jobs, up to ?limit= (admin only)
+func (h *Handler) GetJobs(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	stats, err := h.jobQueue.Stats(ctx)
+	if err == nil {
+		var dead []services.Job
+		if dead, err = h.jobQueue.DeadJobs(ctx, limit); err == nil {
+			c.JSON(http.StatusOK, gin.H{"jobs": stats, "dead": dead})
+			return
+		}
+	}
+	if err == services.ErrJobQueueUnavailable {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	log.Error().Err(err).Msg("Failed to get jobs")
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+}
+
+// RetryDeadJobs queues a dead job, or with the ID "all" every dead job, to
+// run again with fresh attempts (admin only)
+func (h *Handler) RetryDeadJobs(c *gin.Context) {
+	id := c.Param("id")
+	retried, err := h.jobQueue.RetryDead(c.Request.Context(), id)
+	switch err {
+	case nil:
+	case services.ErrDeadJobNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case services.ErrJobQueueUnavailable:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to retry dead jobs")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	// Retrying all dead jobs is recorded against the nil ID
+	jobID, _ := uuid.Parse(id)
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionJobRetry,
+		EntityType: "job",
+		EntityID:   jobID,
+		After:      models.AuditSnapshot{"retried": retried},
+	})
+	c.JSON(http.StatusOK, gin.H{"retried": retried})
+}
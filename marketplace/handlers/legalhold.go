@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetLegalHolds lists legal holds, optionally filtered by subject_type,
+// subject_id and active=true (admin only)
+func (h *Handler) GetLegalHolds(c *gin.Context) {
+	var subjectID *uuid.UUID
+	if raw := c.Query("subject_id"); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subject ID"})
+			return
+		}
+		subjectID = &id
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	holds, total, err := h.holdSvc.GetHolds(models.LegalHoldSubject(c.Query("subject_type")), subjectID, c.Query("active") == "true", page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get legal holds")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"holds": holds,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// PlaceLegalHold freezes a user's, organization's or agent's data (admin
+// only)
+func (h *Handler) PlaceLegalHold(c *gin.Context) {
+	adminID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		SubjectType string     `json:"subject_type" binding:"required"`
+		SubjectID   uuid.UUID  `json:"subject_id" binding:"required"`
+		Reason      string     `json:"reason" binding:"required,max=2000"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hold, err := h.holdSvc.PlaceHold(adminID.(uuid.UUID), models.LegalHoldSubject(req.SubjectType), req.SubjectID, strings.TrimSpace(req.Reason), req.ExpiresAt)
+	switch err {
+	case nil:
+		h.audit(c, &models.AuditLog{
+			Action:     models.AuditActionLegalHoldPlace,
+			EntityType: string(hold.SubjectType),
+			EntityID:   hold.SubjectID,
+			After:      models.AuditSnapshot{"hold_id": hold.ID, "expires_at": hold.ExpiresAt},
+			Reason:     hold.Reason,
+		})
+		c.JSON(http.StatusCreated, gin.H{"hold": hold})
+	case services.ErrInvalidHoldSubject, services.ErrInvalidHoldExpiry:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subject not found"})
+	default:
+		log.Error().Err(err).Msg("Failed to place legal hold")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// ReleaseLegalHold ends a legal hold before it expires (admin only)
+func (h *Handler) ReleaseLegalHold(c *gin.Context) {
+	adminID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	holdID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hold ID"})
+		return
+	}
+
+	hold, err := h.holdSvc.ReleaseHold(adminID.(uuid.UUID), holdID)
+	switch err {
+	case nil:
+		h.audit(c, &models.AuditLog{
+			Action:     models.AuditActionLegalHoldRelease,
+			EntityType: string(hold.SubjectType),
+			EntityID:   hold.SubjectID,
+			Before:     models.AuditSnapshot{"hold_id": hold.ID, "expires_at": hold.ExpiresAt},
+			After:      models.AuditSnapshot{"hold_id": hold.ID, "released_at": hold.ReleasedAt},
+			Reason:     hold.Reason,
+		})
+		c.JSON(http.StatusOK, gin.H{"hold": hold})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Legal hold not found"})
+	case services.ErrHoldReleased:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to release legal hold")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetLicenses returns the license keys of the current user's paid
+// purchases, including those made for their organizations
+func (h *Handler) GetLicenses(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	licenses, total, err := h.licenseSvc.GetLicenses(userID.(uuid.UUID), page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get licenses")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"licenses": licenses,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// VerifyLicense checks a license key without authentication, for devices
+// and CI systems that can reach the marketplace. Offline, the key verifies
+// against the JWK set at /signing-keys instead.
+func (h *Handler) VerifyLicense(c *gin.Context) {
+	var req struct {
+		LicenseKey string     `json:"license_key" binding:"required"`
+		AgentID    *uuid.UUID `json:"agent_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := h.licenseSvc.Verify(req.LicenseKey, req.AgentID)
+	switch err {
+	case nil:
+	case services.ErrInvalidLicense:
+		c.JSON(http.StatusOK, gin.H{"valid": false, "status": "invalid", "error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to verify license")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
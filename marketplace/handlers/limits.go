@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetLimitDefaults lists the limits that can be overridden and their
+// default for each tier (admin only)
+func (h *Handler) GetLimitDefaults(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"limits": services.LimitNames,
+		"tiers":  h.limitSvc.Defaults(),
+	})
+}
+
+// GetScopeLimits returns the limits in effect for a scope, such as
+// user:<id>, and the overrides among them (admin only)
+func (h *Handler) GetScopeLimits(c *gin.Context) {
+	limits, err := h.limitSvc.GetScope(c.Param("scope"))
+	switch err {
+	case nil:
+	case services.ErrInvalidLimitScope:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to get limits")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"limits": limits})
+}
+
+// SetScopeLimits overrides limits for a scope (admin only). A null value
+// restores the default of that limit.
+func (h *Handler) SetScopeLimits(c *gin.Context) {
+	adminID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Limits map[models.LimitName]*int64 `json:"limits" binding:"required"`
+		Reason string                      `json:"reason" binding:"max=500"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scope := c.Param("scope")
+	switch err := h.limitSvc.SetOverrides(scope, req.Limits, req.Reason, adminID.(uuid.UUID)); err {
+	case nil:
+	case services.ErrInvalidLimitScope, services.ErrUnknownLimit, services.ErrInvalidLimitValue:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to set limits")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	limits, err := h.limitSvc.GetScope(scope)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get limits")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"limits": limits})
+}
+
+// ClearScopeLimits removes every override of a scope (admin only)
+func (h *Handler) ClearScopeLimits(c *gin.Context) {
+	switch err := h.limitSvc.ClearOverrides(c.Param("scope")); err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Limits reset to their defaults"})
+	case services.ErrInvalidLimitScope:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to clear limits")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetAgentReadme returns an agent's README and media in the locale that best
+// matches the ?locale= parameter or the Accept-Language header
+func (h *Handler) GetAgentReadme(c *gin.Context) {
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+
+	preferred := models.ParseAcceptLanguage(c.GetHeader("Accept-Language"))
+	if override, err := models.NormalizeLocale(c.Query("locale")); err == nil {
+		preferred = append([]string{override}, preferred...)
+	}
+
+	localization, available, err := h.localeSvc.GetReadme(agent, preferred)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get agent readme")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.Header("Vary", "Accept-Language")
+	if localization == nil {
+		// Not localized, fall back to the README uploaded with the agent
+		readme, err := h.agentSvc.GetStoredReadme(c.Request.Context(), agent)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read stored agent readme")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+
+		c.Header("Content-Language", agent.DefaultLocale)
+		response := gin.H{
+			"locale":            agent.DefaultLocale,
+			"readme_url":        agent.ReadmeURL,
+			"media":             []string{},
+			"available_locales": available,
+		}
+		if readme != "" {
+			response["readme"] = readme
+			delete(response, "readme_url")
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	c.Header("Content-Language", localization.Locale)
+	c.JSON(http.StatusOK, gin.H{
+		"locale":            localization.Locale,
+		"readme":            localization.Readme,
+		"media":             localization.Media,
+		"available_locales": available,
+		"updated_at":        localization.UpdatedAt,
+	})
+}
+
+// GetAgentLocalizations returns the translation coverage of an agent's locales
+func (h *Handler) GetAgentLocalizations(c *gin.Context) {
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+
+	coverage, err := h.localeSvc.GetCoverage(agent)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get translation coverage")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"coverage": coverage})
+}
+
+// SaveAgentLocalization creates or replaces the README and media of one of
+// the publisher's agents for a locale
+func (h *Handler) SaveAgentLocalization(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	locale, err := models.NormalizeLocale(c.Param("locale"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req struct {
+		Readme string   `json:"readme" binding:"max=100000"`
+		Media  []string `json:"media" binding:"max=20,dive,url"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	localization := models.AgentLocalization{
+		AgentID: agent.ID,
+		Locale:  locale,
+		Readme:  req.Readme,
+		Media:   req.Media,
+	}
+	if err := h.localeSvc.SaveLocalization(&localization); err != nil {
+		log.Error().Err(err).Msg("Failed to save agent localization")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save localization"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Localization saved successfully",
+		"localization": localization,
+	})
+}
+
+// DeleteAgentLocalization removes a locale from one of the publisher's agents
+func (h *Handler) DeleteAgentLocalization(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	locale, err := models.NormalizeLocale(c.Param("locale"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.localeSvc.DeleteLocalization(agent.ID, locale); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Localization not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete agent localization")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete localization"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Localization deleted successfully"})
+}
+
+// findAgent loads the agent in the :id parameter if the current user may see
+// it, writing the error response and returning false if it cannot
+func (h *Handler) findAgent(c *gin.Context) (*models.Agent, bool) {
+	agentID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
+		return nil, false
+	}
+
+	var agent models.Agent
+	if err := h.db.First(&agent, "id = ?", agentID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+			return nil, false
+		}
+		log.Error().Err(err).Msg("Database error getting agent")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return nil, false
+	}
+	if !h.authorizeAgent(c, &agent, services.AgentView) {
+		return nil, false
+	}
+	return &agent, true
+}
+
+// findPublisherAgent is findAgent restricted to agents the current user
+// manages: their own, and those of organizations where they are an owner or
+// maintainer
+func (h *Handler) findPublisherAgent(c *gin.Context) (*models.Agent, bool) {
+	if _, exists := c.Get("user_id"); !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	agent, ok := h.findAgent(c)
+	if !ok || !h.authorizeAgent(c, agent, services.AgentEdit) {
+		return nil, false
+	}
+	return agent, true
+}
@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// CreateDeployment deploys a metered agent on one of the user's devices.
+// Given device_ids or a device group instead of a device_id, it starts a
+// fleet rollout of the version to those devices.
+func (h *Handler) CreateDeployment(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		AgentID  string `json:"agent_id" binding:"required"`
+		DeviceID string `json:"device_id"`
+		Version  string `json:"version"` // pin a release, defaults to the one the user is served
+
+		// Fleet rollouts
+		DeviceIDs        []string `json:"device_ids" binding:"omitempty,dive,max=64"`
+		Group            string   `json:"group" binding:"max=100"`
+		Strategy         string   `json:"strategy"`
+		CanaryPercent    int      `json:"canary_percent"`
+		Waves            []int    `json:"waves"`
+		WaveInterval     int      `json:"wave_interval" binding:"min=0"` // seconds
+		FailureThreshold int      `json:"failure_threshold"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	agentID, err := uuid.Parse(req.AgentID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
+		return
+	}
+
+	if len(req.DeviceIDs) > 0 || req.Group != "" {
+		if req.DeviceID != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Give device_id for one device, or device_ids or group for a rollout"})
+			return
+		}
+		if req.Version == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A rollout needs a version"})
+			return
+		}
+		h.startFleetRollout(c, userID.(uuid.UUID), services.FleetRolloutRequest{
+			AgentID:          agentID,
+			Version:          req.Version,
+			DeviceIDs:        req.DeviceIDs,
+			Group:            req.Group,
+			Strategy:         models.RolloutStrategy(req.Strategy),
+			CanaryPercent:    req.CanaryPercent,
+			Waves:            req.Waves,
+			WaveInterval:     time.Duration(req.WaveInterval) * time.Second,
+			FailureThreshold: req.FailureThreshold,
+		})
+		return
+	}
+	if req.DeviceID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device_id is required"})
+		return
+	}
+
+	deployment, err := h.meteringSvc.Deploy(userID.(uuid.UUID), agentID, req.DeviceID, req.Version,
+		c.GetHeader(h.config.Fraud.IPCountryHeader), uuid.Nil)
+	switch err {
+	case nil:
+	case services.ErrAgentNotPurchasable:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	case services.ErrAgentNotMetered:
+		c.JSON(http.StatusConflict, gin.H{"error": "This agent is sold outright, buy it through checkout instead"})
+		return
+	case services.ErrDeploymentExists, services.ErrFleetLimitReached:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case services.ErrVersionNotPublished:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to create deployment")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create deployment"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":    "Agent deployed successfully",
+		"deployment": deployment,
+	})
+}
+
+// GetDeployments returns the current user's deployments
+func (h *Handler) GetDeployments(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	deployments, total, err := h.meteringSvc.GetDeployments(userID.(uuid.UUID), page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get deployments")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deployments": deployments,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// CheckInDeployment records a telemetry check-in for a deployment, with the
+// release the device runs and any update error
+func (h *Handler) CheckInDeployment(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid deployment ID"})
+		return
+	}
+
+	// The body is optional; devices that only keep billing alive send none
+	var req struct {
+		Version     string `json:"version" binding:"max=64"`
+		UpdateError string `json:"update_error" binding:"max=2000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report := services.CheckInReport{Version: req.Version, UpdateError: req.UpdateError}
+	if !h.deploymentError(c, h.meteringSvc.RecordCheckIn(userID.(uuid.UUID), id, report), "Failed to record check-in") {
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// DecommissionDeployment stops a deployment and its billing
+func (h *Handler) DecommissionDeployment(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid deployment ID"})
+		return
+	}
+
+	deployment, err := h.meteringSvc.Decommission(userID.(uuid.UUID), id)
+	if !h.deploymentError(c, err, "Failed to decommission deployment") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Deployment decommissioned successfully",
+		"deployment": deployment,
+	})
+}
+
+// deploymentError writes the response for a deployment operation error and
+// reports whether the request can continue
+func (h *Handler) deploymentError(c *gin.Context, err error, msg string) bool {
+	switch err {
+	case nil:
+		return true
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deployment not found"})
+	case services.ErrDecommissioned:
+		c.JSON(http.StatusConflict, gin.H{"error": "Deployment is decommissioned"})
+	default:
+		log.Error().Err(err).Msg(msg)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+	}
+	return false
+}
+
+// GetInvoices returns the current user's usage invoices
+func (h *Handler) GetInvoices(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	invoices, total, err := h.meteringSvc.GetInvoices(userID.(uuid.UUID), page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get invoices")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"invoices": invoices,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// GetInvoice returns one of the current user's invoices with its lines
+func (h *Handler) GetInvoice(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice ID"})
+		return
+	}
+
+	invoice, err := h.meteringSvc.GetInvoice(userID.(uuid.UUID), id)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to get invoice")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invoice": invoice})
+}
+
+// GenerateInvoices invoices metered usage for a past month (admin only). The
+// worker does this automatically; this is for backfills and reruns.
+func (h *Handler) GenerateInvoices(c *gin.Context) {
+	var req struct {
+		Period string `json:"period" binding:"required"` // YYYY-MM
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	period, err := time.Parse("2006-01", req.Period)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period, expected YYYY-MM"})
+		return
+	}
+	if period.AddDate(0, 1, 0).After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Period has not ended"})
+		return
+	}
+
+	created, err := h.meteringSvc.GenerateInvoices(period)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate invoices")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invoices"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Invoices generated successfully",
+		"period":  req.Period,
+		"created": created,
+	})
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// CreateReport reports an abusive review, agent or user to the moderators
+func (h *Handler) CreateReport(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		TargetType string    `json:"target_type" binding:"required"`
+		TargetID   uuid.UUID `json:"target_id" binding:"required"`
+		Reason     string    `json:"reason" binding:"required"`
+		Details    string    `json:"details" binding:"max=2000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report := models.Report{
+		ReporterID: userID.(uuid.UUID),
+		TargetType: models.ReportTarget(req.TargetType),
+		TargetID:   req.TargetID,
+		Reason:     models.ReportReason(req.Reason),
+		Details:    req.Details,
+	}
+	switch err := h.moderationSvc.CreateReport(&report); err {
+	case nil:
+	case services.ErrInvalidReport:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrReportTargetNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case services.ErrAlreadyReported:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to create report")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create report"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"report": report})
+}
+
+// GetReports returns the moderation queue, optionally filtered by status
+// and target_type (admin only). Open reports are listed oldest first.
+func (h *Handler) GetReports(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	status := models.ReportStatus(c.DefaultQuery("status", string(models.ReportStatusOpen)))
+	reports, total, err := h.moderationSvc.GetReports(status, models.ReportTarget(c.Query("target_type")), page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get reports")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"reports": reports,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// ResolveReport decides a report (admin only): dismiss it with action
+// none, hide the reported review or agent, or warn or ban its author.
+// Every open report about the same content is settled with it.
+func (h *Handler) ResolveReport(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	reportID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid report ID"})
+		return
+	}
+
+	var req struct {
+		Action string `json:"action" binding:"required"`
+		Note   string `json:"note" binding:"max=2000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report := &models.Report{ID: reportID}
+	decision, err := h.moderationSvc.Resolve(report, userID.(uuid.UUID), models.ModerationAction(req.Action), req.Note)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return
+	case services.ErrInvalidModerationAction:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrReportClosed:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case services.ErrReportTargetNotFound:
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	default:
+		if decision == nil {
+			log.Error().Err(err).Msg("Failed to resolve report")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve report"})
+			return
+		}
+		// The decision stands; only the rating refresh failed
+		log.Error().Err(err).Str("report_id", report.ID.String()).Msg("Failed to refresh rating after hiding review")
+	}
+
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionReportResolve,
+		EntityType: string(report.TargetType),
+		EntityID:   report.TargetID,
+		Before:     models.AuditSnapshot{"report_id": report.ID, "reason": report.Reason},
+		After:      models.AuditSnapshot{"status": report.Status, "action": decision.Action, "author_id": decision.AuthorID, "reports": decision.Reports},
+		Reason:     req.Note,
+	})
+	switch {
+	case decision.Action == models.ModerationActionBan:
+		h.audit(c, &models.AuditLog{
+			Action:     models.AuditActionUserStatus,
+			EntityType: "user",
+			EntityID:   decision.AuthorID,
+			Before:     models.AuditSnapshot{"status": decision.Previous},
+			After:      models.AuditSnapshot{"status": decision.NewStatus},
+			Reason:     req.Note,
+		})
+		// Otherwise the ban only applies once the cached status expires
+		if err := h.authSvc.InvalidateUser(c.Request.Context(), decision.AuthorID); err != nil {
+			log.Warn().Err(err).Msg("Failed to invalidate cached user status")
+		}
+	case decision.Action == models.ModerationActionHide && report.TargetType == models.ReportTargetAgent:
+		h.agentSvc.InvalidateAgent(report.TargetID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"report": report, "decision": decision})
+}
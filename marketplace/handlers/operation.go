@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetOperation returns the status, progress and outcome of a request carried
+// out in the background
+func (h *Handler) GetOperation(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid operation ID"})
+		return
+	}
+
+	op, err := h.operationSvc.GetOperation(id, userID.(uuid.UUID), models.UserRole(c.GetString("user_role")))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"operation": op})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Operation not found"})
+	default:
+		log.Error().Err(err).Msg("Failed to get operation")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// CancelOperation stops an operation whose kind allows it. Work already
+// done is kept.
+func (h *Handler) CancelOperation(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid operation ID"})
+		return
+	}
+
+	op, err := h.operationSvc.CancelOperation(id, userID.(uuid.UUID), models.UserRole(c.GetString("user_role")))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"operation": op})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Operation not found"})
+	case services.ErrOperationDone, services.ErrOperationNotCancelable:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "operation": op})
+	default:
+		log.Error().Err(err).Msg("Failed to cancel operation")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
@@ -0,0 +1,412 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// CreateOrganization creates an organization owned by the current user
+func (h *Handler) CreateOrganization(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Name string `json:"name" binding:"required,max=200"`
+		Slug string `json:"slug" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	org, err := h.orgSvc.CreateOrganization(userID.(uuid.UUID), strings.TrimSpace(req.Name), req.Slug)
+	switch err {
+	case nil:
+	case services.ErrInvalidOrgSlug:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrOrgSlugTaken:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to create organization")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"organization": org})
+}
+
+// GetOrganizations returns the organizations the current user belongs to
+// and their role in each
+func (h *Handler) GetOrganizations(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	memberships, err := h.orgSvc.GetMemberships(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get organizations")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"memberships": memberships})
+}
+
+// GetOrganization returns an organization and its members
+func (h *Handler) GetOrganization(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, ok := orgParam(c)
+	if !ok {
+		return
+	}
+
+	org, members, err := h.orgSvc.GetOrganization(orgID, userID.(uuid.UUID))
+	if err != nil {
+		writeOrgError(c, err, "Failed to get organization")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"organization": org, "members": members})
+}
+
+// GetOrganizationAgents returns an organization's agents, drafts included
+func (h *Handler) GetOrganizationAgents(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, ok := orgParam(c)
+	if !ok {
+		return
+	}
+
+	agents, err := h.orgSvc.GetAgents(orgID, userID.(uuid.UUID))
+	if err != nil {
+		writeOrgError(c, err, "Failed to get organization agents")
+		return
+	}
+	for i := range agents {
+		agents[i].PriceDisplay = models.FormatMoney(agents[i].Price, agents[i].Currency)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"agents": agents})
+}
+
+// InviteMember invites a user to an organization by email or username
+// (owners only)
+func (h *Handler) InviteMember(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, ok := orgParam(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		User string `json:"user" binding:"required"`
+		Role string `json:"role" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	invitation, err := h.orgSvc.Invite(orgID, userID.(uuid.UUID), req.User, models.OrgRole(req.Role))
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	case services.ErrAlreadyMember, services.ErrInvitationPending:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		writeOrgError(c, err, "Failed to invite organization member")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"invitation": invitation})
+}
+
+// RevokeInvitation withdraws a pending invitation (owners only)
+func (h *Handler) RevokeInvitation(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, ok := orgParam(c)
+	if !ok {
+		return
+	}
+	invitationID, err := uuid.Parse(c.Param("invitation_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+
+	switch err := h.orgSvc.RevokeInvitation(orgID, userID.(uuid.UUID), invitationID); err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	default:
+		writeOrgError(c, err, "Failed to revoke invitation")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked"})
+}
+
+// GetInvitations returns the current user's pending organization invitations
+func (h *Handler) GetInvitations(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	invitations, err := h.orgSvc.GetInvitations(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get invitations")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitations": invitations})
+}
+
+// AcceptInvitation joins the organization of one of the current user's
+// invitations
+func (h *Handler) AcceptInvitation(c *gin.Context) {
+	h.respondInvitation(c, true)
+}
+
+// DeclineInvitation declines one of the current user's invitations
+func (h *Handler) DeclineInvitation(c *gin.Context) {
+	h.respondInvitation(c, false)
+}
+
+func (h *Handler) respondInvitation(c *gin.Context, accept bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	invitationID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+
+	switch err := h.orgSvc.RespondInvitation(invitationID, userID.(uuid.UUID), accept); err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	default:
+		writeOrgError(c, err, "Failed to answer invitation")
+		return
+	}
+
+	if accept {
+		c.JSON(http.StatusOK, gin.H{"message": "Invitation accepted"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation declined"})
+}
+
+// UpdateMemberRole changes a member's role (owners only)
+func (h *Handler) UpdateMemberRole(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, memberID, ok := memberParams(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A non-member fails the update below, so the error here can wait
+	previous, _ := h.orgSvc.Role(orgID, memberID)
+	if err := h.orgSvc.UpdateMemberRole(orgID, userID.(uuid.UUID), memberID, models.OrgRole(req.Role)); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+		writeOrgError(c, err, "Failed to update member role")
+		return
+	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionMemberRole,
+		EntityType: "organization",
+		EntityID:   orgID,
+		Before:     models.AuditSnapshot{"user_id": memberID, "role": previous},
+		After:      models.AuditSnapshot{"user_id": memberID, "role": req.Role},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member role updated"})
+}
+
+// RemoveMember removes a member from an organization. Owners can remove
+// anyone; members can remove themselves to leave.
+func (h *Handler) RemoveMember(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, memberID, ok := memberParams(c)
+	if !ok {
+		return
+	}
+
+	if err := h.orgSvc.RemoveMember(orgID, userID.(uuid.UUID), memberID); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+		writeOrgError(c, err, "Failed to remove member")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+// TransferAgent moves one of the current user's agents into an
+// organization where they are an owner or maintainer
+func (h *Handler) TransferAgent(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		OrganizationID uuid.UUID `json:"organization_id" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch err := h.orgSvc.TransferAgent(agent, userID.(uuid.UUID), req.OrganizationID); err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	default:
+		writeOrgError(c, err, "Failed to transfer agent")
+		return
+	}
+	h.agentSvc.InvalidateAgent(agent.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Agent transferred successfully",
+		"agent":   agent,
+	})
+}
+
+// isAgentMember reports whether a user can see an agent's unpublished
+// content, as its publisher or a member of its organization. It writes the
+// error response and returns false for ok if it cannot tell.
+func (h *Handler) isAgentMember(c *gin.Context, agent *models.Agent, userID uuid.UUID) (member, ok bool) {
+	switch _, err := h.orgSvc.AgentRole(agent, userID); err {
+	case nil:
+		return true, true
+	case services.ErrNotOrgMember:
+		return false, true
+	default:
+		log.Error().Err(err).Msg("Failed to get organization role")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return false, false
+	}
+}
+
+func orgParam(c *gin.Context) (uuid.UUID, bool) {
+	orgID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+		return uuid.Nil, false
+	}
+	return orgID, true
+}
+
+func memberParams(c *gin.Context) (uuid.UUID, uuid.UUID, bool) {
+	orgID, ok := orgParam(c)
+	if !ok {
+		return uuid.Nil, uuid.Nil, false
+	}
+	memberID, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return uuid.Nil, uuid.Nil, false
+	}
+	return orgID, memberID, true
+}
+
+// writeOrgError writes the response for the errors organization operations
+// share. Non-members get a 404 so organizations are not disclosed.
+func writeOrgError(c *gin.Context, err error, msg string) {
+	switch err {
+	case services.ErrNotOrgMember:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+	case services.ErrOrgPermission:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case services.ErrInvalidOrgRole:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case services.ErrLastOwner, services.ErrInvitationClosed, services.ErrAgentInOrg:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg(msg)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetPurchasePolicy returns how an organization approves purchases, and its
+// designated approvers (members only)
+func (h *Handler) GetPurchasePolicy(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, ok := orgParam(c)
+	if !ok {
+		return
+	}
+
+	policy, approvers, err := h.orgPurchaseSvc.GetPolicy(orgID, userID.(uuid.UUID))
+	if err != nil {
+		writeOrgError(c, err, "Failed to get purchase policy")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policy": policy, "approvers": approvers})
+}
+
+// SetPurchasePolicy sets the approvals an organization's purchases need,
+// the amount up to which they are approved on request, and who approves
+// them (owners only)
+func (h *Handler) SetPurchasePolicy(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, ok := orgParam(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		RequiredApprovals   int          `json:"required_approvals" binding:"required"`
+		AutoApproveMinor    models.Money `json:"auto_approve_minor"`
+		AutoApproveCurrency string       `json:"auto_approve_currency" binding:"omitempty,len=3"`
+		Approvers           []uuid.UUID  `json:"approvers" binding:"max=50"` // empty leaves approval to the owners
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	policy := &models.OrgPurchasePolicy{
+		RequiredApprovals:   req.RequiredApprovals,
+		AutoApproveMinor:    req.AutoApproveMinor,
+		AutoApproveCurrency: req.AutoApproveCurrency,
+	}
+	switch err := h.orgPurchaseSvc.SetPolicy(orgID, userID.(uuid.UUID), policy, req.Approvers); err {
+	case nil:
+	case services.ErrInvalidPurchasePolicy:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	default:
+		writeOrgError(c, err, "Failed to set purchase policy")
+		return
+	}
+
+	h.GetPurchasePolicy(c)
+}
+
+// RequestOrgPurchase asks the organization's approvers to buy an agent for
+// it. payment_id is a payment authorized for the agent's price, captured
+// once the request is approved.
+func (h *Handler) RequestOrgPurchase(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, ok := orgParam(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		AgentID       uuid.UUID `json:"agent_id" binding:"required"`
+		Justification string    `json:"justification" binding:"max=2000"`
+		PaymentID     string    `json:"payment_id"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	request, err := h.orgPurchaseSvc.RequestPurchase(c.Request.Context(), orgID, userID.(uuid.UUID), req.AgentID, req.Justification, req.PaymentID)
+	if !orgPurchaseError(c, err, "Failed to request organization purchase") {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"request": request})
+}
+
+// GetOrgPurchaseRequests lists an organization's purchase requests, newest
+// first, optionally with one status (members only)
+func (h *Handler) GetOrgPurchaseRequests(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, ok := orgParam(c)
+	if !ok {
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	requests, total, err := h.orgPurchaseSvc.GetRequests(orgID, userID.(uuid.UUID), models.OrgPurchaseStatus(c.Query("status")), page, limit)
+	if err != nil {
+		writeOrgError(c, err, "Failed to get organization purchase requests")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"requests": requests,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// ApproveOrgPurchase approves a pending purchase request (approvers only)
+func (h *Handler) ApproveOrgPurchase(c *gin.Context) {
+	h.decideOrgPurchase(c, true)
+}
+
+// RejectOrgPurchase rejects a pending purchase request (approvers only)
+func (h *Handler) RejectOrgPurchase(c *gin.Context) {
+	h.decideOrgPurchase(c, false)
+}
+
+// CancelOrgPurchase withdraws a pending purchase request (its requester or
+// an owner)
+func (h *Handler) CancelOrgPurchase(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, requestID, ok := purchaseRequestParams(c)
+	if !ok {
+		return
+	}
+
+	request, err := h.orgPurchaseSvc.Cancel(c.Request.Context(), orgID, requestID, userID.(uuid.UUID))
+	if !orgPurchaseError(c, err, "Failed to cancel organization purchase") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"request": request})
+}
+
+func (h *Handler) decideOrgPurchase(c *gin.Context, approve bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	orgID, requestID, ok := purchaseRequestParams(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Comment string `json:"comment" binding:"max=2000"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	request, err := h.orgPurchaseSvc.Decide(c.Request.Context(), orgID, requestID, userID.(uuid.UUID), approve, req.Comment)
+	if !orgPurchaseError(c, err, "Failed to decide on organization purchase") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"request": request})
+}
+
+func purchaseRequestParams(c *gin.Context) (uuid.UUID, uuid.UUID, bool) {
+	orgID, ok := orgParam(c)
+	if !ok {
+		return uuid.Nil, uuid.Nil, false
+	}
+	requestID, err := uuid.Parse(c.Param("request_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid purchase request ID"})
+		return uuid.Nil, uuid.Nil, false
+	}
+	return orgID, requestID, true
+}
+
+// orgPurchaseError writes the response for a failed purchase request
+// action and returns false, or returns true if err is nil
+func orgPurchaseError(c *gin.Context, err error, msg string) bool {
+	switch err {
+	case nil:
+		return true
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Purchase request not found"})
+	case services.ErrAgentNotPurchasable:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+	case services.ErrAgentMetered:
+		c.JSON(http.StatusConflict, gin.H{"error": "This agent is billed per device-month, deploy it instead"})
+	case services.ErrAlreadyPurchased:
+		c.JSON(http.StatusConflict, gin.H{"error": "The organization already owns this agent"})
+	case services.ErrPurchaseRequestPending, services.ErrPurchaseRequestClosed:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case services.ErrPaymentRequired:
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error()})
+	case services.ErrNotPurchaseApprover, services.ErrSelfApproval:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		writeOrgError(c, err, msg)
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// agentSort is a sort key of the agent listing: the column it orders by and
+// the value of that column on an agent, for cursors
+type agentSort struct {
+	column string
+	value  func(*models.Agent) interface{}
+}
+
+// agentSorts are the sort keys GetAgents accepts, besides rank and
+// trending. Only these columns ever reach ORDER BY. price_minor is kept as
+// an alias of price for clients of the cursor pagination.
+var agentSorts = map[string]agentSort{
+	"created_at":   {"agents.created_at", func(a *models.Agent) interface{} { return a.CreatedAt }},
+	"updated_at":   {"agents.updated_at", func(a *models.Agent) interface{} { return a.UpdatedAt }},
+	"price":        {"agents.price_minor", func(a *models.Agent) interface{} { return a.Price }},
+	"price_minor":  {"agents.price_minor", func(a *models.Agent) interface{} { return a.Price }},
+	"rating":       {"agents.rating", func(a *models.Agent) interface{} { return a.Rating }},
+	"review_count": {"agents.review_count", func(a *models.Agent) interface{} { return a.ReviewCount }},
+	"downloads":    {"agents.downloads", func(a *models.Agent) interface{} { return a.Downloads }},
+	"name":         {"agents.name", func(a *models.Agent) interface{} { return a.Name }},
+}
+
+const (
+	// sortRank orders the agent listing by the ranking score
+	sortRank = "rank"
+	// sortTrending orders it by recent activity
+	sortTrending = "trending"
+)
+
+// cursorParam reads the cursor query parameter of a list endpoint. keyset
+// is true when the parameter is present, even empty for the first page,
+// and the list is then paginated by cursor instead of page number. It
+// writes the error response and returns ok false for a malformed cursor.
+func cursorParam(c *gin.Context) (cursor *services.Cursor, keyset bool, ok bool) {
+	param, keyset := c.GetQuery("cursor")
+	if !keyset {
+		return nil, false, true
+	}
+	cursor, err := services.ParseCursor(param)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, true, false
+	}
+	return cursor, true, true
+}
+
+// cursorPagination is the pagination of a page fetched with
+// services.Keyset. next is the cursor of the following page, nil on the
+// last one.
+func cursorPagination(limit int, next *services.Cursor) gin.H {
+	var nextCursor *string
+	if next != nil {
+		encoded := next.Encode()
+		nextCursor = &encoded
+	}
+	return gin.H{"limit": limit, "next_cursor": nextCursor}
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetPayoutAccount returns the current user's payout account
+func (h *Handler) GetPayoutAccount(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	account, err := h.payoutSvc.GetAccount(c.Request.Context(), userID.(uuid.UUID))
+	switch err {
+	case nil:
+	case services.ErrNoPayoutAccount:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to get payout account")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"account": account})
+}
+
+// ConnectPayoutAccount creates the current user's payout account if needed
+// and returns a link to the payment provider's onboarding
+func (h *Handler) ConnectPayoutAccount(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	account, url, err := h.payoutSvc.ConnectAccount(c.Request.Context(), userID.(uuid.UUID))
+	switch err {
+	case nil:
+	case services.ErrPayoutsUnsupported:
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to connect payout account")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to connect payout account"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"account": account, "onboarding_url": url})
+}
+
+// ReplacePayoutAccount moves the current user's payouts to a new account
+// at the payment provider, once confirmed with their password or an
+// emailed link
+func (h *Handler) ReplacePayoutAccount(c *gin.Context) {
+	if _, exists := c.Get("user_id"); !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	action := &models.PendingAction{Action: models.PendingActionReplacePayoutAccount}
+	if !h.confirmed(c, action, req.Password, "send your EdgePlug Marketplace payouts to a new account") {
+		return
+	}
+	h.replacePayoutAccount(c)
+}
+
+// replacePayoutAccount replaces the current user's payout account
+func (h *Handler) replacePayoutAccount(c *gin.Context) {
+	userID := c.MustGet("user_id").(uuid.UUID)
+
+	var previous models.PayoutAccount
+	h.db.Select("external_id", "status").First(&previous, "publisher_id = ?", userID)
+
+	account, url, err := h.payoutSvc.ReplaceAccount(c.Request.Context(), userID)
+	switch err {
+	case nil:
+	case services.ErrNoPayoutAccount:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case services.ErrPayoutsUnsupported:
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to replace payout account")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to replace payout account"})
+		return
+	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionPayoutAccountReplace,
+		EntityType: "payout_account",
+		EntityID:   account.ID,
+		Before:     models.AuditSnapshot{"external_id": previous.ExternalID, "status": previous.Status},
+		After:      models.AuditSnapshot{"external_id": account.ExternalID, "status": account.Status},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"account": account, "onboarding_url": url})
+}
+
+// GetPayouts returns the current user's payout history
+func (h *Handler) GetPayouts(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	payouts, total, err := h.payoutSvc.GetPayouts(userID.(uuid.UUID), page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get payouts")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"payouts": payouts,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
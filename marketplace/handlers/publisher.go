@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// ApplyPublisher submits the current user's application to become a
+// publisher, to be reviewed by an admin
+func (h *Handler) ApplyPublisher(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		CompanyName string `json:"company_name" binding:"required,max=200"`
+		Website     string `json:"website" binding:"omitempty,url"`
+		Country     string `json:"country" binding:"required,len=2,alpha"`
+		Address     string `json:"address" binding:"required,max=1000"`
+		TaxID       string `json:"tax_id" binding:"required,max=50"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	application := models.PublisherApplication{
+		CompanyName: strings.TrimSpace(req.CompanyName),
+		Website:     req.Website,
+		Country:     strings.ToUpper(req.Country),
+		Address:     strings.TrimSpace(req.Address),
+		TaxID:       strings.TrimSpace(req.TaxID),
+	}
+	switch err := h.publisherSvc.Apply(userID.(uuid.UUID), &application); err {
+	case nil:
+	case services.ErrAlreadyPublisher, services.ErrApplicationPending:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to submit publisher application")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"application": application})
+}
+
+// GetPublisherApplications returns the current user's publisher
+// applications and their decisions
+func (h *Handler) GetPublisherApplications(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	applications, err := h.publisherSvc.GetApplications(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get publisher applications")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"applications": applications})
+}
+
+// GetHousekeepingReport lists what needs attention among the agents the
+// current user manages: stale drafts, missing files and releases without
+// a changelog
+func (h *Handler) GetHousekeepingReport(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	report, err := h.housekeepingSvc.GetReport(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get housekeeping report")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// KeepAgent keeps an agent flagged as unsold listed, or publishes again an
+// agent archived for inactivity
+func (h *Handler) KeepAgent(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	switch err := h.housekeepingSvc.KeepAgent(agent); err {
+	case nil:
+	case services.ErrAgentActive:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case services.ErrAgentLimitReached:
+		c.JSON(http.StatusConflict, gin.H{"error": "You have reached the published agent limit of your plan"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to keep agent")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Agent kept listed"})
+}
+
+// GetPublisherApplicationQueue returns the publisher applications awaiting
+// review, or those in the ?status= given (admin only)
+func (h *Handler) GetPublisherApplicationQueue(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	status := models.PublisherApplicationStatus(c.DefaultQuery("status", string(models.PublisherApplicationStatusPending)))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	applications, total, err := h.publisherSvc.GetQueue(status, page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get publisher applications")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"applications": applications,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// DecidePublisherApplication approves or rejects a pending publisher
+// application (admin only). Rejections need a reason.
+func (h *Handler) DecidePublisherApplication(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid application ID"})
+		return
+	}
+
+	var req struct {
+		Decision string `json:"decision" binding:"required,oneof=approve reject"`
+		Reason   string `json:"reason" binding:"max=2000"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var application *models.PublisherApplication
+	if req.Decision == "reject" {
+		application, err = h.publisherSvc.Reject(id, userID.(uuid.UUID), strings.TrimSpace(req.Reason))
+	} else {
+		application, err = h.publisherSvc.Approve(id, userID.(uuid.UUID))
+	}
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Application not found"})
+		return
+	case services.ErrRejectionReason:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrApplicationDecided:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to decide publisher application")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionPublisherApplication,
+		EntityType: "publisher_application",
+		EntityID:   application.ID,
+		Before:     models.AuditSnapshot{"status": models.PublisherApplicationStatusPending},
+		After:      models.AuditSnapshot{"status": application.Status, "user_id": application.UserID},
+		Reason:     application.RejectionReason,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"application": application})
+}
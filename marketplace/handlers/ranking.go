@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetRankingWeights returns the ranking weights in effect and the
+// configured defaults (admin only)
+func (h *Handler) GetRankingWeights(c *gin.Context) {
+	weights, err := h.rankingSvc.GetWeights()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get ranking weights")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"weights": weights, "overridden": weights.UpdatedBy != nil})
+}
+
+// SetRankingWeights replaces the ranking weights and refills the featured
+// slots with them (admin only)
+func (h *Handler) SetRankingWeights(c *gin.Context) {
+	adminID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		DownloadsWeight *float64 `json:"downloads_weight" binding:"required"`
+		RatingWeight    *float64 `json:"rating_weight" binding:"required"`
+		RecencyWeight   *float64 `json:"recency_weight" binding:"required"`
+		RecencyHalfLife int      `json:"recency_half_life" binding:"required"` // in hours
+		VerifiedBoost   *float64 `json:"verified_boost" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	weights := &models.RankingWeights{
+		DownloadsWeight: *req.DownloadsWeight,
+		RatingWeight:    *req.RatingWeight,
+		RecencyWeight:   *req.RecencyWeight,
+		RecencyHalfLife: req.RecencyHalfLife,
+		VerifiedBoost:   *req.VerifiedBoost,
+	}
+	if err := h.rankingSvc.SetWeights(adminID.(uuid.UUID), weights); err != nil {
+		if errors.Is(err, services.ErrInvalidRankingWeights) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to set ranking weights")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	h.refreshFeatured()
+
+	c.JSON(http.StatusOK, gin.H{"weights": weights, "overridden": true})
+}
+
+// ResetRankingWeights restores the configured ranking weights (admin only)
+func (h *Handler) ResetRankingWeights(c *gin.Context) {
+	if err := h.rankingSvc.ResetWeights(); err != nil {
+		log.Error().Err(err).Msg("Failed to reset ranking weights")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	h.refreshFeatured()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Ranking weights reset to their defaults"})
+}
+
+// refreshFeatured refills the featured slots after the ranking changed.
+// The weights are saved either way, so a failure only delays the slots
+// until the next scheduled run.
+func (h *Handler) refreshFeatured() {
+	if err := h.curationSvc.EvaluateAll(); err != nil {
+		log.Error().Err(err).Msg("Failed to refill featured slots with the new ranking")
+	}
+}
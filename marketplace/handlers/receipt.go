@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetPurchases lists the current user's purchases, newest first. status
+// takes a comma-separated list of purchase statuses to keep.
+func (h *Handler) GetPurchases(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var statuses []models.PurchaseStatus
+	if param := c.Query("status"); param != "" {
+		for _, value := range strings.Split(param, ",") {
+			status := models.PurchaseStatus(strings.TrimSpace(value))
+			switch status {
+			case models.PurchaseStatusPending, models.PurchaseStatusCompleted, models.PurchaseStatusFailed,
+				models.PurchaseStatusRefunded, models.PurchaseStatusOnHold:
+				statuses = append(statuses, status)
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid purchase status %q", value)})
+				return
+			}
+		}
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	cursor, keyset, ok := cursorParam(c)
+	if !ok {
+		return
+	}
+	if keyset {
+		purchases, next, err := h.userSvc.GetUserPurchasesAfter(userID.(uuid.UUID), statuses, cursor, limit)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get purchases")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"purchases": purchases, "pagination": cursorPagination(limit, next)})
+		return
+	}
+
+	purchases, total, err := h.userSvc.GetUserPurchases(userID.(uuid.UUID), statuses, page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get purchases")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"purchases": purchases,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// GetPurchaseReceipt returns the itemized receipt of one of the current
+// user's purchases. Completed purchases also get a signed token, to hand to
+// third parties for verification.
+func (h *Handler) GetPurchaseReceipt(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid purchase ID"})
+		return
+	}
+
+	receipt, err := h.receiptSvc.GetReceipt(userID.(uuid.UUID), id)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		h.resourceNotFound(c, services.ResourcePurchase, c.Param("id"))
+		return
+	case services.ErrNoReceipt:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to issue receipt")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue receipt"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"receipt": receipt})
+}
+
+// VerifyReceipt checks a purchase receipt without authentication. It only
+// reveals the agent, its publisher, the purchase date and whether the
+// purchase still stands.
+func (h *Handler) VerifyReceipt(c *gin.Context) {
+	result, err := h.receiptSvc.Verify(c.Param("token"))
+	switch err {
+	case nil:
+	case services.ErrInvalidReceipt:
+		c.JSON(http.StatusNotFound, gin.H{"valid": false, "error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to verify receipt")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// GetHistory returns the current user's purchases, entitlements and
+// reviews. With ?signed=true the response also carries the document signed
+// with the marketplace key, for attaching to compliance audits.
+func (h *Handler) GetHistory(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if format := c.DefaultQuery("format", "json"); format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format, only json is available"})
+		return
+	}
+	signed, err := strconv.ParseBool(c.DefaultQuery("signed", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signed flag"})
+		return
+	}
+
+	history, err := h.historySvc.GetHistory(userID.(uuid.UUID))
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to get history")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	if !signed {
+		c.JSON(http.StatusOK, gin.H{"history": history})
+		return
+	}
+
+	token, err := h.historySvc.Sign(history)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign history")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign history"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="edgeplug-history-%s.json"`, history.GeneratedAt.Format("2006-01-02")))
+	c.JSON(http.StatusOK, gin.H{"history": history, "signature": token})
+}
+
+// VerifyHistory checks a signed history without authentication and
+// returns the document it was signed with
+func (h *Handler) VerifyHistory(c *gin.Context) {
+	var req struct {
+		Signature string `json:"signature" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	history, err := h.historySvc.Verify(req.Signature)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"valid": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": true, "history": history})
+}
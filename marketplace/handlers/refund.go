@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// RequestRefund opens a refund request for one of the user's purchases,
+// to be decided by an admin
+func (h *Handler) RequestRefund(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid purchase ID"})
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason" binding:"required,max=2000"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	request, err := h.refundSvc.RequestRefund(userID.(uuid.UUID), id, req.Reason)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		h.resourceNotFound(c, services.ResourcePurchase, c.Param("id"))
+		return
+	case services.ErrNotRefundable, services.ErrRefundPending:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to request refund")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request refund"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"refund": request})
+}
+
+// GetRefundRequests returns the refund requests awaiting a decision, or
+// those in the ?status= given (admin only)
+func (h *Handler) GetRefundRequests(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	status := models.RefundStatus(c.DefaultQuery("status", string(models.RefundStatusPending)))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	requests, total, err := h.refundSvc.GetRefundRequests(status, page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get refund requests")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"refunds": requests,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// DecideRefund approves or denies a pending refund request (admin only).
+// Approving refunds the payment and revokes the buyer's download access.
+func (h *Handler) DecideRefund(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid refund request ID"})
+		return
+	}
+
+	var req struct {
+		Decision string `json:"decision" binding:"required,oneof=approve deny"`
+		Notes    string `json:"notes"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := models.RefundStatusApproved
+	if req.Decision == "deny" {
+		status = models.RefundStatusDenied
+		err = h.refundSvc.DenyRefund(id, userID.(uuid.UUID), req.Notes)
+	} else {
+		_, err = h.refundSvc.ApproveRefund(c.Request.Context(), id, userID.(uuid.UUID), req.Notes)
+	}
+	switch {
+	case err == nil:
+	case err == gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Refund request not found"})
+		return
+	case err == services.ErrRefundClosed, err == services.ErrNotRefundable:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, services.ErrRefundFailed):
+		log.Error().Err(err).Str("refund_request_id", id.String()).Msg("Payment provider refund failed")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Payment provider refund failed; the request is still pending"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to decide refund request")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decide refund request"})
+		return
+	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionRefundDecide,
+		EntityType: "refund_request",
+		EntityID:   id,
+		Before:     models.AuditSnapshot{"status": models.RefundStatusPending},
+		After:      models.AuditSnapshot{"status": status},
+		Reason:     req.Notes,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Refund request decided successfully"})
+}
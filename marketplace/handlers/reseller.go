@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// BulkGrantEntitlements grants entitlements to organizations from the
+// reseller's seat pools. The batch is a CSV file, uploaded in the file field
+// or sent as a text/csv body, or JSON with an entitlements list. With
+// ?dry_run=true it is only checked.
+func (h *Handler) BulkGrantEntitlements(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var entries []services.EntitlementRequest
+	var err error
+	switch contentType := c.ContentType(); {
+	case contentType == "multipart/form-data":
+		upload, closeFile, ok := formUpload(c, h.config.Resellers.MaxFileSize)
+		if !ok {
+			return
+		}
+		defer closeFile()
+		entries, err = h.resellerSvc.ReadEntitlements(upload.Body, true)
+	default:
+		entries, err = h.resellerSvc.ReadEntitlements(c.Request.Body, strings.HasSuffix(contentType, "/csv"))
+	}
+	switch err {
+	case nil:
+	case services.ErrInvalidEntitlementBatch:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrEntitlementBatchTooLarge:
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to read entitlement batch")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	dryRun := c.Query("dry_run") == "true"
+	result, err := h.resellerSvc.GrantEntitlements(userID.(uuid.UUID), entries, dryRun)
+	switch err {
+	case nil:
+	case services.ErrEntitlementBatchRejected:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "result": result})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to grant entitlements")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to grant entitlements"})
+		return
+	}
+	if dryRun || len(result.Granted) == 0 {
+		c.JSON(http.StatusOK, gin.H{"result": result})
+		return
+	}
+
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionResellerGrant,
+		EntityType: "entitlement_batch",
+		EntityID:   result.BatchID,
+		After:      models.AuditSnapshot{"entitlements": len(result.Granted), "seats": result.Seats},
+	})
+	c.JSON(http.StatusCreated, gin.H{"result": result})
+}
+
+// GetSeatPools lists the reseller's seat pools and the seats left in each
+func (h *Handler) GetSeatPools(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	pools, err := h.resellerSvc.GetSeatPools(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get seat pools")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"seat_pools": pools})
+}
+
+// GetResellerReconciliation reports the reseller's seat pools and the
+// entitlements granted between the RFC 3339 from and to, by default the
+// current month, as JSON or with ?format=csv the grants as CSV. Admins can
+// report on any reseller with ?reseller_id=.
+func (h *Handler) GetResellerReconciliation(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	resellerID := userID.(uuid.UUID)
+	if param := c.Query("reseller_id"); param != "" && models.UserRole(c.GetString("user_role")) == models.UserRoleAdmin {
+		id, err := uuid.Parse(param)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reseller ID"})
+			return
+		}
+		resellerID = id
+	}
+
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := now
+	for name, at := range map[string]*time.Time{"from": &from, "to": &to} {
+		if param := c.Query(name); param != "" {
+			parsed, err := time.Parse(time.RFC3339, param)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be an RFC 3339 time"})
+				return
+			}
+			*at = parsed
+		}
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	report, err := h.resellerSvc.Reconcile(resellerID, from, to)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to reconcile reseller grants")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, gin.H{"report": report})
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="reconciliation-`+from.Format("2006-01-02")+`.csv"`)
+	c.Status(http.StatusOK)
+	if err := services.WriteReconciliationCSV(report, c.Writer); err != nil {
+		log.Warn().Err(err).Str("reseller_id", resellerID.String()).Msg("Failed to send reconciliation report")
+	}
+}
+
+// CreateSeatPool records seats of an agent a reseller bought wholesale
+// (admin only)
+func (h *Handler) CreateSeatPool(c *gin.Context) {
+	adminID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		ResellerID uuid.UUID `json:"reseller_id" binding:"required"`
+		AgentID    uuid.UUID `json:"agent_id" binding:"required"`
+		Seats      int       `json:"seats" binding:"required,min=1"`
+		Reference  string    `json:"reference" binding:"max=100"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	pool, err := h.resellerSvc.CreateSeatPool(adminID.(uuid.UUID), req.ResellerID, req.AgentID, req.Seats, req.Reference)
+	switch err {
+	case nil:
+	case services.ErrNotReseller, services.ErrInvalidSeatPool:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to create seat pool")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create seat pool"})
+		return
+	}
+
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionSeatPoolCreate,
+		EntityType: "seat_pool",
+		EntityID:   pool.ID,
+		After:      models.AuditSnapshot{"reseller_id": pool.ResellerID, "agent_id": pool.AgentID, "seats": pool.Seats, "reference": pool.Reference},
+	})
+	c.JSON(http.StatusCreated, gin.H{"seat_pool": pool})
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// UploadReviewAttachment attaches a file from a multipart form to the
+// current user's review. The optional visibility field restricts it to the
+// agent's publisher and admins.
+func (h *Handler) UploadReviewAttachment(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	reviewID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+		return
+	}
+	upload, closeFile, ok := formUpload(c, h.config.ReviewAttachments.MaxSize)
+	if !ok {
+		return
+	}
+	defer closeFile()
+
+	fileName := ""
+	if header, err := c.FormFile("file"); err == nil {
+		fileName = header.Filename
+	}
+	visibility := models.AttachmentVisibility(c.PostForm("visibility"))
+
+	attachment, err := h.attachmentSvc.Upload(c.Request.Context(), reviewID, userID.(uuid.UUID), fileName, visibility, upload)
+	if !attachmentError(c, err, "Failed to upload review attachment") {
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"attachment": attachment})
+}
+
+// GetReviewAttachments returns the attachments of a review the current user
+// can see, including those restricted to the agent's publisher
+func (h *Handler) GetReviewAttachments(c *gin.Context) {
+	reviewID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+		return
+	}
+
+	var review models.Review
+	if err := h.db.Preload("Agent").First(&review, "id = ?", reviewID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to get review")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	reviews := []models.Review{review}
+	if err := h.attachmentSvc.Attach(c.Request.Context(), review.Agent.PublisherID, reviews, attachmentViewer(c)); err != nil {
+		log.Error().Err(err).Msg("Failed to get review attachments")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	attachments := reviews[0].Attachments
+	if attachments == nil {
+		attachments = []models.ReviewAttachment{}
+	}
+	c.JSON(http.StatusOK, gin.H{"attachments": attachments})
+}
+
+// UpdateReviewAttachment changes who can retrieve an attachment (the
+// reviewer or admins)
+func (h *Handler) UpdateReviewAttachment(c *gin.Context) {
+	reviewID, attachmentID, ok := attachmentParams(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Visibility models.AttachmentVisibility `json:"visibility" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	attachment, err := h.attachmentSvc.SetVisibility(reviewID, attachmentID, attachmentViewer(c), req.Visibility)
+	if !attachmentError(c, err, "Failed to update review attachment") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"attachment": attachment})
+}
+
+// DeleteReviewAttachment removes an attachment (the reviewer or admins)
+func (h *Handler) DeleteReviewAttachment(c *gin.Context) {
+	reviewID, attachmentID, ok := attachmentParams(c)
+	if !ok {
+		return
+	}
+
+	err := h.attachmentSvc.Delete(c.Request.Context(), reviewID, attachmentID, attachmentViewer(c))
+	if !attachmentError(c, err, "Failed to delete review attachment") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Attachment deleted"})
+}
+
+// attachmentViewer is the user of the request, if authenticated
+func attachmentViewer(c *gin.Context) services.AttachmentViewer {
+	var viewer services.AttachmentViewer
+	if userID, exists := c.Get("user_id"); exists {
+		id := userID.(uuid.UUID)
+		viewer.UserID = &id
+		viewer.Admin = models.UserRole(c.GetString("user_role")) == models.UserRoleAdmin
+	}
+	return viewer
+}
+
+// attachmentParams reads the review and attachment IDs of the path
+func attachmentParams(c *gin.Context) (uuid.UUID, uuid.UUID, bool) {
+	reviewID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+		return uuid.Nil, uuid.Nil, false
+	}
+	attachmentID, err := uuid.Parse(c.Param("attachment_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+		return uuid.Nil, uuid.Nil, false
+	}
+	return reviewID, attachmentID, true
+}
+
+// attachmentError writes the response for a failed attachment change and
+// returns false, or returns true if err is nil
+func attachmentError(c *gin.Context, err error, msg string) bool {
+	switch err {
+	case nil:
+		return true
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Review or attachment not found"})
+	case services.ErrAttachmentTooLarge:
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case services.ErrAttachmentType:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case services.ErrTooManyAttachments:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case services.ErrInvalidVisibility:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg(msg)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// ReplyToReview sets the publisher's reply to a review of one of their
+// agents, replacing the earlier one if any
+func (h *Handler) ReplyToReview(c *gin.Context) {
+	review, ok := h.findPublisherReview(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Body string `json:"body" binding:"required,max=5000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	body := strings.TrimSpace(req.Body)
+	if body == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Reply must not be empty"})
+		return
+	}
+
+	reply, created, err := h.reviewSvc.Reply(review, c.MustGet("user_id").(uuid.UUID), body)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to reply to review")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reply to review"})
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"reply": reply})
+}
+
+// DeleteReviewReply removes the publisher's reply to a review
+func (h *Handler) DeleteReviewReply(c *gin.Context) {
+	review, ok := h.findPublisherReview(c)
+	if !ok {
+		return
+	}
+
+	switch err := h.reviewSvc.DeleteReply(review.ID); err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Review has no reply"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to delete review reply")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reply deleted"})
+}
+
+// findPublisherReview loads the review in the :id parameter, with its
+// agent, if the current user may reply on behalf of the agent's publisher,
+// writing the error response and returning false otherwise
+func (h *Handler) findPublisherReview(c *gin.Context) (*models.Review, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+
+	reviewID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+		return nil, false
+	}
+
+	var review models.Review
+	if err := h.db.Preload("Agent").First(&review, "id = ?", reviewID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+			return nil, false
+		}
+		log.Error().Err(err).Msg("Failed to get review")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return nil, false
+	}
+
+	role, err := h.orgSvc.AgentRole(&review.Agent, userID.(uuid.UUID))
+	switch {
+	case err == services.ErrNotOrgMember, err == nil && role == models.OrgRoleViewer:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the agent's publisher can reply to its reviews"})
+		return nil, false
+	case err != nil:
+		log.Error().Err(err).Msg("Failed to get organization role")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return nil, false
+	}
+	return &review, true
+}
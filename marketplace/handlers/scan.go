@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetScans lists scanned releases with their reports, optionally only those
+// with a scan status (admin only)
+func (h *Handler) GetScans(c *gin.Context) {
+	status := models.ScanStatus(c.Query("status"))
+	switch status {
+	case "", models.ScanStatusPending, models.ScanStatusPassed, models.ScanStatusFailed, models.ScanStatusSkipped:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scan status"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	releases, total, err := h.scanSvc.ListScans(status, page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list binary scans")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	scans := make([]gin.H, 0, len(releases))
+	for i := range releases {
+		scans = append(scans, gin.H{"release": &releases[i], "report": releases[i].ScanReport})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"scans": scans,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// GetScanReport returns the scan report of a release (admin only)
+func (h *Handler) GetScanReport(c *gin.Context) {
+	agentID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
+		return
+	}
+
+	release, err := h.scanSvc.GetScan(agentID, c.Param("version"))
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"release": release, "report": release.ScanReport})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+	default:
+		log.Error().Err(err).Msg("Failed to get scan report")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// RescanBinary queues a draft release's binary to be scanned again (admin
+// only)
+func (h *Handler) RescanBinary(c *gin.Context) {
+	agentID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
+		return
+	}
+
+	release, err := h.scanSvc.Rescan(agentID, c.Param("version"))
+	switch err {
+	case nil:
+		c.JSON(http.StatusAccepted, gin.H{"release": release, "operation": services.ScanOperation(release)})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+	case services.ErrVersionImmutable:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to queue binary scan")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/services"
+)
+
+// searchScope returns a scope narrowing an agent query to those matching a
+// full-text search. With an external index the matches come from it, once,
+// however many queries the scope is applied to; if the index cannot be
+// reached the database is searched instead.
+func (h *Handler) searchScope(c *gin.Context, search string) func(*gorm.DB) *gorm.DB {
+	if h.searchSvc.Enabled() {
+		ids, err := h.searchSvc.MatchAgents(c.Request.Context(), search)
+		if err == nil {
+			return func(query *gorm.DB) *gorm.DB {
+				return query.Where("agents.id IN ?", ids)
+			}
+		}
+		log.Warn().Err(err).Msg("Search index unavailable, searching the database")
+	}
+	return func(query *gorm.DB) *gorm.DB {
+		return query.Where("agents.name ILIKE ? OR agents.description ILIKE ?", "%"+search+"%", "%"+search+"%")
+	}
+}
+
+// GetSearchStatus returns the indexing backlog, the latest reindex and the
+// latest consistency check (admin only)
+func (h *Handler) GetSearchStatus(c *gin.Context) {
+	status, err := h.searchSvc.GetStatus()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get search status")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"search": status})
+}
+
+// StartSearchReindex starts rebuilding the search index from the database
+// (admin only). Progress is reported by GetSearchReindex.
+func (h *Handler) StartSearchReindex(c *gin.Context) {
+	adminID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	reindex, err := h.searchSvc.StartReindex(adminID.(uuid.UUID))
+	switch err {
+	case nil:
+	case services.ErrSearchDisabled, services.ErrReindexRunning:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to start search reindex")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"reindex": reindex, "operation": services.ReindexOperation(reindex)})
+}
+
+// GetSearchReindex returns the progress of a reindex (admin only)
+func (h *Handler) GetSearchReindex(c *gin.Context) {
+	reindexID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reindex ID"})
+		return
+	}
+
+	reindex, err := h.searchSvc.GetReindex(reindexID)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reindex not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to get search reindex")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	progress := 100.0
+	if reindex.Total > 0 && reindex.Indexed < reindex.Total {
+		progress = float64(reindex.Indexed) * 100 / float64(reindex.Total)
+	}
+	c.JSON(http.StatusOK, gin.H{"reindex": reindex, "progress": progress})
+}
+
+// CheckSearchConsistency compares the search index with the database now
+// and queues the differences for indexing (admin only)
+func (h *Handler) CheckSearchConsistency(c *gin.Context) {
+	check, err := h.searchSvc.CheckConsistency(c.Request.Context())
+	switch err {
+	case nil:
+	case services.ErrSearchDisabled, services.ErrReindexRunning:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to check search consistency")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"check": check})
+}
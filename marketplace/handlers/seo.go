@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetSitemap serves sitemap.xml with the published agent and publisher
+// pages
+func (h *Handler) GetSitemap(c *gin.Context) {
+	body, err := h.seoSvc.Sitemap()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to render sitemap")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	h.serveSEO(c, "application/xml; charset=utf-8", body)
+}
+
+// GetSitemapPage serves one file of a sitemap split by a sitemap index,
+// e.g. /sitemaps/2.xml
+func (h *Handler) GetSitemapPage(c *gin.Context) {
+	n, err := strconv.Atoi(strings.TrimSuffix(c.Param("file"), ".xml"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sitemap not found"})
+		return
+	}
+
+	body, err := h.seoSvc.SitemapPage(n)
+	switch err {
+	case nil:
+		h.serveSEO(c, "application/xml; charset=utf-8", body)
+	case services.ErrSitemapPageNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sitemap not found"})
+	default:
+		log.Error().Err(err).Msg("Failed to render sitemap")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// GetAgentStructuredData returns the JSON-LD of a published agent, for the
+// web app to embed in the agent page
+func (h *Handler) GetAgentStructuredData(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
+		return
+	}
+
+	body, err := h.seoSvc.AgentStructuredData(id)
+	switch err {
+	case nil:
+		h.serveSEO(c, "application/ld+json", body)
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+	default:
+		log.Error().Err(err).Msg("Failed to render agent structured data")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// serveSEO writes a rendered document that crawlers and CDNs may cache as
+// long as it is cached here
+func (h *Handler) serveSEO(c *gin.Context, contentType string, body []byte) {
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.seoSvc.CacheTTL().Seconds())))
+	c.Data(http.StatusOK, contentType, body)
+}
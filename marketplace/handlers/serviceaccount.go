@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetServiceAccounts returns the current user's reporting service accounts
+func (h *Handler) GetServiceAccounts(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	accounts, err := h.accountSvc.List(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get service accounts")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"service_accounts": accounts})
+}
+
+// CreateServiceAccount creates a read-only service account for the current
+// user's reporting integrations. The key is only shown in this response.
+func (h *Handler) CreateServiceAccount(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Name      string   `json:"name" binding:"required"`
+		Scopes    []string `json:"scopes" binding:"required"`
+		PublicKey string   `json:"public_key"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, secret, err := h.accountSvc.Create(userID.(uuid.UUID), strings.TrimSpace(req.Name), req.Scopes, req.PublicKey)
+	switch err {
+	case nil:
+	case services.ErrInvalidScope, services.ErrInvalidSigningKey:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to create service account")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionServiceAccountCreate,
+		EntityType: "service_account",
+		EntityID:   account.ID,
+		After:      models.AuditSnapshot{"name": account.Name, "scopes": account.Scopes, "key_pair": account.PublicKey != ""},
+	})
+
+	c.JSON(http.StatusCreated, gin.H{"service_account": account, "key": secret})
+}
+
+// RevokeServiceAccount permanently disables one of the current user's
+// service accounts
+func (h *Handler) RevokeServiceAccount(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	accountID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid service account ID"})
+		return
+	}
+
+	account, err := h.accountSvc.Revoke(userID.(uuid.UUID), accountID)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service account not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to revoke service account")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionServiceAccountRevoke,
+		EntityType: "service_account",
+		EntityID:   account.ID,
+		Before:     models.AuditSnapshot{"name": account.Name, "scopes": account.Scopes},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Service account revoked"})
+}
+
+// AuditReporting records every successful read by a service account in
+// the audit log, once the reporting handler has answered
+func (h *Handler) AuditReporting(c *gin.Context) {
+	c.Next()
+	if c.Writer.Status() >= http.StatusBadRequest {
+		return
+	}
+	account := c.MustGet("service_account").(*models.ServiceAccount)
+	h.audit(c, &models.AuditLog{
+		Action:     models.AuditActionReportingRead,
+		EntityType: "service_account",
+		EntityID:   account.ID,
+		After:      models.AuditSnapshot{"route": c.FullPath(), "query": c.Request.URL.RawQuery},
+	})
+}
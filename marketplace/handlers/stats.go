@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// GetPublicStats returns anonymized marketplace statistics for embedding in
+// ecosystem sites
+func (h *Handler) GetPublicStats(c *gin.Context) {
+	stats, err := h.statsSvc.Get()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get public stats")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	// Let browsers and CDNs cache until the statistics are recomputed
+	maxAge := int(time.Until(h.statsSvc.ExpiresAt()).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+
+	c.JSON(http.StatusOK, gin.H{"stats": stats})
+}
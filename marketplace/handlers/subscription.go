@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// maxPaymentEventSize bounds the body of a payment provider webhook event
+const maxPaymentEventSize = 1 << 20
+
+// GetAgentPlans returns the pricing plans buyers can choose for an agent
+func (h *Handler) GetAgentPlans(c *gin.Context) {
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+	if agent.Status != models.AgentStatusPublished {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+
+	plans, err := h.subscriptionSvc.GetPlans(agent.ID, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get pricing plans")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"plans": plans})
+}
+
+// CreateAgentPlan adds a one-time, monthly, annual or per-device pricing
+// plan to an agent
+func (h *Handler) CreateAgentPlan(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name     string              `json:"name" binding:"required,max=100"`
+		Interval models.PlanInterval `json:"interval" binding:"required"`
+		Price    models.Money        `json:"price_minor" binding:"required"`
+		Currency string              `json:"currency" binding:"omitempty,len=3"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !h.checkCurrency(c, models.NormalizeCurrency(req.Currency)) {
+		return
+	}
+
+	plan := &models.PricingPlan{
+		Name:     req.Name,
+		Interval: req.Interval,
+		Price:    req.Price,
+		Currency: req.Currency,
+	}
+	switch err := h.subscriptionSvc.CreatePlan(agent.ID, plan); err {
+	case nil:
+	case services.ErrInvalidPlan:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to create pricing plan")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create pricing plan"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"plan": plan})
+}
+
+// RetireAgentPlan stops a pricing plan from taking new buyers. Existing
+// subscriptions keep renewing until canceled.
+func (h *Handler) RetireAgentPlan(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+	planID, err := uuid.Parse(c.Param("plan_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid plan ID"})
+		return
+	}
+
+	switch err := h.subscriptionSvc.RetirePlan(agent.ID, planID); err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pricing plan not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to retire pricing plan")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retire pricing plan"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Pricing plan retired"})
+}
+
+// Subscribe records the current user's subscription to a recurring plan.
+// provider_subscription_id is the subscription created with the payment
+// provider; it is active once the provider reports the first payment.
+func (h *Handler) Subscribe(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		PlanID                 uuid.UUID `json:"plan_id" binding:"required"`
+		ProviderSubscriptionID string    `json:"provider_subscription_id" binding:"required,max=255"`
+		Quantity               int       `json:"quantity"` // devices, for per-device plans
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+
+	subscription, err := h.subscriptionSvc.Subscribe(userID.(uuid.UUID), req.PlanID, req.ProviderSubscriptionID, req.Quantity)
+	switch err {
+	case nil:
+	case services.ErrPlanNotAvailable:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pricing plan not found"})
+		return
+	case services.ErrPlanNotRecurring, services.ErrInvalidQuantity:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrAlreadySubscribed:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to subscribe")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to subscribe"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"subscription": subscription})
+}
+
+// GetSubscriptions lists the current user's subscriptions
+func (h *Handler) GetSubscriptions(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	subscriptions, total, err := h.subscriptionSvc.GetSubscriptions(userID.(uuid.UUID), page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get subscriptions")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"subscriptions": subscriptions,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// CancelSubscription stops one of the current user's subscriptions from
+// renewing
+func (h *Handler) CancelSubscription(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+		return
+	}
+
+	subscription, err := h.subscriptionSvc.Cancel(c.Request.Context(), userID.(uuid.UUID), id)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		return
+	case services.ErrSubscriptionClosed:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to cancel subscription")
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to cancel subscription"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"subscription": subscription})
+}
+
+// PaymentWebhook receives the payment provider's events about
+// subscriptions. They are authenticated by their signature header rather
+// than a user.
+func (h *Handler) PaymentWebhook(c *gin.Context) {
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPaymentEventSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read event"})
+		return
+	}
+
+	switch err := h.subscriptionSvc.HandleEvent(payload, c.GetHeader("Stripe-Signature")); err {
+	case nil:
+	case services.ErrInvalidPaymentEvent:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrPaymentWebhookDisabled:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	default:
+		// The provider retries events that fail
+		log.Error().Err(err).Msg("Failed to handle payment event")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to handle event"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// defaultTelemetryRange is the period aggregated when none is given
+const defaultTelemetryRange = 7 * 24 * time.Hour
+
+// telemetrySample is one runtime measurement in a telemetry batch
+type telemetrySample struct {
+	DeploymentID     uuid.UUID `json:"deployment_id"`
+	AgentID          uuid.UUID `json:"agent_id"` // on the device API, instead of deployment_id
+	Version          string    `json:"version" binding:"max=64"`
+	RecordedAt       time.Time `json:"recorded_at" binding:"required"`
+	InferenceLatency *int      `json:"inference_latency" binding:"omitempty,min=0"` // in microseconds
+	TripEvents       int       `json:"trip_events" binding:"min=0"`
+	MemoryUsed       *int64    `json:"memory_used" binding:"omitempty,min=0"` // in bytes
+}
+
+// IngestTelemetry stores a batch of runtime samples from the user's
+// deployed agents
+func (h *Handler) IngestTelemetry(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	inputs, ok := bindTelemetry(c)
+	if !ok {
+		return
+	}
+	accepted, rejected, err := h.telemetrySvc.Ingest(userID.(uuid.UUID), inputs)
+	h.telemetryResult(c, accepted, rejected, err)
+}
+
+// DeviceTelemetry stores a batch of runtime samples reported by a device on
+// the device API, naming agents rather than deployments
+func (h *Handler) DeviceTelemetry(c *gin.Context) {
+	inputs, ok := bindTelemetry(c)
+	if !ok {
+		return
+	}
+
+	value, authenticated := c.Get("device_cert")
+	if !authenticated {
+		if len(inputs) > h.config.Telemetry.MaxBatchSize {
+			h.telemetryResult(c, 0, nil, services.ErrTelemetryBatchTooLarge)
+			return
+		}
+		h.journalDeviceRequest(c, services.JournalDeviceTelemetry, c.GetString("device_fingerprint"), inputs)
+		return
+	}
+	cert := value.(*models.DeviceCertificate)
+
+	accepted, rejected, err := h.telemetrySvc.IngestFromDevice(&cert.Device, inputs)
+	switch err {
+	case nil, services.ErrTelemetryBatchTooLarge, services.ErrDeviceNotClaimed:
+	default:
+		if h.deviceJournal.Accepts(err) {
+			h.journalDeviceRequest(c, services.JournalDeviceTelemetry, cert.Fingerprint, inputs)
+			return
+		}
+	}
+	h.telemetryResult(c, accepted, rejected, err)
+}
+
+// GetAgentTelemetry returns the real-world latency percentiles, trip events
+// and memory use of an agent per release, to its publisher. Only telemetry
+// buyers share counts, and releases with too few of them are left out.
+func (h *Handler) GetAgentTelemetry(c *gin.Context) {
+	agent, from, to, ok := h.telemetryQuery(c)
+	if !ok {
+		return
+	}
+
+	stats, err := h.telemetrySvc.GetVersionTelemetry(agent.ID, c.Query("version"), from, to)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "min_buyers": h.config.Telemetry.MinShareBuyers, "versions": stats})
+	case services.ErrInvalidTelemetryRange:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to aggregate agent telemetry")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// GetAgentTelemetrySeries returns an agent's latency percentiles per hour or
+// day and release
+func (h *Handler) GetAgentTelemetrySeries(c *gin.Context) {
+	bucket := c.DefaultQuery("bucket", "day")
+	if bucket != "hour" && bucket != "day" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bucket must be hour or day"})
+		return
+	}
+	agent, from, to, ok := h.telemetryQuery(c)
+	if !ok {
+		return
+	}
+
+	series, err := h.telemetrySvc.GetTelemetrySeries(agent.ID, c.Query("version"), bucket, from, to)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "bucket": bucket, "min_buyers": h.config.Telemetry.MinShareBuyers, "series": series})
+	case services.ErrInvalidTelemetryRange:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to aggregate agent telemetry")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// GetTelemetrySharing returns whether the current user shares the telemetry
+// of their deployments with the publisher of each agent they deployed
+func (h *Handler) GetTelemetrySharing(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	consented, sharing, err := h.telemetrySvc.GetSharing(userID.(uuid.UUID))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get telemetry sharing")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"consented": consented, "agents": sharing})
+}
+
+// SetTelemetrySharing opts the current user's deployments of an agent in or
+// out of sharing telemetry with its publisher
+func (h *Handler) SetTelemetrySharing(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	agentID, err := uuid.Parse(c.Param("agent_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid agent ID"})
+		return
+	}
+
+	var req struct {
+		Shared *bool `json:"shared" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch err := h.telemetrySvc.SetSharing(userID.(uuid.UUID), agentID, *req.Shared); err {
+	case nil:
+		h.GetTelemetrySharing(c)
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "No deployment of this agent"})
+	default:
+		log.Error().Err(err).Msg("Failed to set telemetry sharing")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// bindTelemetry reads a telemetry batch, writing the error response and
+// returning false if it is malformed
+func bindTelemetry(c *gin.Context) ([]services.TelemetryInput, bool) {
+	var req struct {
+		Samples []telemetrySample `json:"samples" binding:"required,min=1,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	inputs := make([]services.TelemetryInput, len(req.Samples))
+	for i, sample := range req.Samples {
+		inputs[i] = services.TelemetryInput{
+			DeploymentID:     sample.DeploymentID,
+			AgentID:          sample.AgentID,
+			Version:          sample.Version,
+			RecordedAt:       sample.RecordedAt,
+			InferenceLatency: sample.InferenceLatency,
+			TripEvents:       sample.TripEvents,
+			MemoryUsed:       sample.MemoryUsed,
+		}
+	}
+	return inputs, true
+}
+
+// telemetryResult writes the outcome of storing a telemetry batch
+func (h *Handler) telemetryResult(c *gin.Context, accepted int, rejected []services.TelemetryRejection, err error) {
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"accepted": accepted, "rejected": rejected})
+	case services.ErrTelemetryBatchTooLarge:
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error(), "max_batch_size": h.config.Telemetry.MaxBatchSize})
+	case services.ErrDeviceNotClaimed:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to store telemetry")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// telemetryQuery loads an agent the user publishes, or is a member of the
+// organization of, and the from and to query parameters. It writes the
+// error response and returns false if it cannot.
+func (h *Handler) telemetryQuery(c *gin.Context) (*models.Agent, time.Time, time.Time, bool) {
+	_, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, time.Time{}, time.Time{}, false
+	}
+
+	to := time.Now().UTC()
+	if param := c.Query("to"); param != "" {
+		parsed, err := time.Parse(time.RFC3339, param)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 time"})
+			return nil, time.Time{}, time.Time{}, false
+		}
+		to = parsed
+	}
+	from := to.Add(-defaultTelemetryRange)
+	if param := c.Query("from"); param != "" {
+		parsed, err := time.Parse(time.RFC3339, param)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 time"})
+			return nil, time.Time{}, time.Time{}, false
+		}
+		from = parsed
+	}
+
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return nil, time.Time{}, time.Time{}, false
+	}
+	if !h.authorizeAgent(c, agent, services.AgentInspect) {
+		return nil, time.Time{}, time.Time{}, false
+	}
+	return agent, from, to, true
+}
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetTemplates returns starter templates, optionally filtered by MCU family
+// and category
+func (h *Handler) GetTemplates(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	templates, total, err := h.templateSvc.GetTemplates(page, limit, c.Query("mcu_family"), c.Query("category"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get templates")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"templates": templates,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
+
+// GetTemplate returns a template with its versions, by ID or slug
+func (h *Handler) GetTemplate(c *gin.Context) {
+	template, ok := h.findTemplate(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"template": template})
+}
+
+// DownloadTemplate returns a presigned link to a template archive and
+// records the download. Clients identify themselves with ?client=, e.g. the
+// CLI's agent init sends client=cli.
+func (h *Handler) DownloadTemplate(c *gin.Context) {
+	template, ok := h.findTemplate(c)
+	if !ok {
+		return
+	}
+
+	client := c.DefaultQuery("client", "web")
+	if len(client) > 64 {
+		client = client[:64]
+	}
+	var userID *uuid.UUID
+	if id, exists := c.Get("user_id"); exists {
+		uid := id.(uuid.UUID)
+		userID = &uid
+	}
+
+	link, err := h.templateSvc.Download(c.Request.Context(), template, c.Query("version"), userID, client, !h.replSvc.IsReadOnly())
+	switch err {
+	case nil:
+	case services.ErrTemplateNotUploaded, gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template version not found"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to download template")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"download": link})
+}
+
+// CreateTemplate adds a starter template (admin only)
+func (h *Handler) CreateTemplate(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Slug        string `json:"slug" binding:"required"`
+		Name        string `json:"name" binding:"required"`
+		Description string `json:"description"`
+		MCUFamily   string `json:"mcu_family" binding:"required,max=64"`
+		Category    string `json:"category" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	template := models.Template{
+		Slug:        req.Slug,
+		Name:        req.Name,
+		Description: req.Description,
+		MCUFamily:   req.MCUFamily,
+		Category:    req.Category,
+		CreatedBy:   userID.(uuid.UUID),
+	}
+	err := h.templateSvc.CreateTemplate(&template)
+	switch err {
+	case nil:
+	case services.ErrInvalidSlug:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrTemplateExists:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to create template")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create template"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":  "Template created successfully",
+		"template": template,
+	})
+}
+
+// UpdateTemplate updates a template's name, description, MCU family or
+// category (admin only)
+func (h *Handler) UpdateTemplate(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid template ID"})
+		return
+	}
+
+	var req struct {
+		Name        *string `json:"name" binding:"omitempty,min=1"`
+		Description *string `json:"description"`
+		MCUFamily   *string `json:"mcu_family" binding:"omitempty,min=1,max=64"`
+		Category    *string `json:"category" binding:"omitempty,min=1"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := make(map[string]interface{})
+	if req.Name != nil {
+		updates["name"] = *req.Name
+	}
+	if req.Description != nil {
+		updates["description"] = *req.Description
+	}
+	if req.MCUFamily != nil {
+		updates["mcu_family"] = *req.MCUFamily
+	}
+	if req.Category != nil {
+		updates["category"] = *req.Category
+	}
+	if len(updates) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	if err := h.templateSvc.UpdateTemplate(id, updates); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to update template")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update template"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Template updated successfully"})
+}
+
+// DeleteTemplate removes a template from the catalog (admin only)
+func (h *Handler) DeleteTemplate(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid template ID"})
+		return
+	}
+
+	if err := h.templateSvc.DeleteTemplate(id); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete template")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete template"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Template deleted successfully"})
+}
+
+// UploadTemplateVersion uploads a new archive of a template from a multipart
+// form and makes it the current version (admin only)
+func (h *Handler) UploadTemplateVersion(c *gin.Context) {
+	template, ok := h.findTemplate(c)
+	if !ok {
+		return
+	}
+
+	upload, closeFile, ok := formUpload(c, services.MaxTemplateArchiveSize)
+	if !ok {
+		return
+	}
+	defer closeFile()
+
+	release := models.TemplateVersion{
+		Version:   c.PostForm("version"),
+		Changelog: c.PostForm("changelog"),
+	}
+	err := h.templateSvc.UploadVersion(c.Request.Context(), template, &release, upload)
+	switch err {
+	case nil:
+	case services.ErrInvalidVersion:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrVersionExists:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case services.ErrArchiveTooLarge:
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to upload template version")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload template version"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Template version uploaded successfully",
+		"version": release,
+	})
+}
+
+// GetTemplateStats returns download analytics for a template (admin only)
+func (h *Handler) GetTemplateStats(c *gin.Context) {
+	template, ok := h.findTemplate(c)
+	if !ok {
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid days"})
+		return
+	}
+
+	stats, err := h.templateSvc.GetUsageStats(template.ID, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get template stats")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get template stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"days": days, "template_id": template.ID, "stats": stats})
+}
+
+// findTemplate loads the template in the :id parameter, which may also be
+// its slug, writing the error response and returning false if it cannot
+func (h *Handler) findTemplate(c *gin.Context) (*models.Template, bool) {
+	template, err := h.templateSvc.GetTemplate(c.Param("id"))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+			return nil, false
+		}
+		log.Error().Err(err).Msg("Failed to get template")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return nil, false
+	}
+	return template, true
+}
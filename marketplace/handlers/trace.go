@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// GetTrace returns the purchases, licenses, refunds, downloads and
+// deployments that share a trace ID
+func (h *Handler) GetTrace(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid trace ID"})
+		return
+	}
+
+	admin := models.UserRole(c.GetString("user_role")) == models.UserRoleAdmin
+	trace, err := h.traceSvc.GetTrace(id, userID.(uuid.UUID), admin)
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"trace": trace})
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Trace not found"})
+	default:
+		log.Error().Err(err).Msg("Failed to get trace")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/services"
+)
+
+// TransferEntitlement moves the license of a metered agent from a replaced
+// device to its successor. The path names the deployment on the replaced
+// device, which must have stopped checking in or had its certificates
+// revoked.
+func (h *Handler) TransferEntitlement(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid entitlement ID"})
+		return
+	}
+
+	var req struct {
+		DeviceID string `json:"device_id" binding:"required,max=255"`
+		Reason   string `json:"reason" binding:"max=1000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	transfer, deployment, err := h.transferSvc.Transfer(userID.(uuid.UUID), id, req.DeviceID, req.Reason)
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Entitlement not found"})
+		return
+	case services.ErrDecommissioned:
+		c.JSON(http.StatusConflict, gin.H{"error": "Entitlement was already transferred or decommissioned"})
+		return
+	case services.ErrSameDevice:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrDeviceStillActive, services.ErrDeploymentExists, services.ErrFleetLimitReached:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case services.ErrTransferLimitReached:
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to transfer entitlement")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transfer entitlement"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"transfer":   transfer,
+		"deployment": deployment,
+	})
+}
+
+// GetAgentTransfers returns the audit trail of an agent's licenses moving
+// between buyers' devices, to its publisher and organization members
+func (h *Handler) GetAgentTransfers(c *gin.Context) {
+	_, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+	if !h.authorizeAgent(c, agent, services.AgentInspect) {
+		return
+	}
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	transfers, total, err := h.transferSvc.GetAgentTransfers(agent.ID, page, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get entitlement transfers")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"transfers": transfers,
+		"pagination": gin.H{
+			"page":        page,
+			"limit":       limit,
+			"total":       total,
+			"total_pages": (int(total) + limit - 1) / limit,
+		},
+	})
+}
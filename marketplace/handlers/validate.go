@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/services"
+)
+
+// ValidateManifest validates the manifest in the request body as uploading
+// it would, without storing anything, so CI pipelines can fail before
+// uploading a release
+func (h *Handler) ValidateManifest(c *gin.Context) {
+	manifest, err := h.manifestSvc.ValidateUpload(c.Request.Body)
+	if h.validationError(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": true, "manifest": manifest})
+}
+
+// ValidateConfig validates a manifest and checks it against the release
+// config an agent declares, as publishing the release would, without
+// storing anything
+func (h *Handler) ValidateConfig(c *gin.Context) {
+	var req struct {
+		services.ReleaseConfig
+		Manifest json.RawMessage `json:"manifest" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Version == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "version is required"})
+		return
+	}
+
+	manifest, err := h.manifestSvc.ValidateConfig(bytes.NewReader(req.Manifest), req.ReleaseConfig)
+	if h.validationError(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": true, "manifest": manifest})
+}
+
+// validationError writes the response for a manifest or config that failed
+// validation and returns true, or returns false if err is nil
+func (h *Handler) validationError(c *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, services.ErrInvalidManifest), errors.Is(err, services.ErrManifestMismatch):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"valid": false, "error": err.Error()})
+	case err == services.ErrAssetTooLarge:
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to validate manifest")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+	return true
+}
@@ -0,0 +1,497 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// GetAgentVersions returns an agent's published and deprecated releases
+func (h *Handler) GetAgentVersions(c *gin.Context) {
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+
+	versions, err := h.agentSvc.GetVersions(agent.ID, false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get agent versions")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"current":  agent.Version,
+		"versions": versions,
+	})
+}
+
+// GetAgentVersion returns one published or deprecated release of an agent
+func (h *Handler) GetAgentVersion(c *gin.Context) {
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+
+	release, ok := h.findVersion(c, agent)
+	if !ok {
+		return
+	}
+	if release.Status == models.AgentVersionStatusDraft {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"version": release})
+}
+
+// CreateAgentVersion adds a release to one of the publisher's agents
+func (h *Handler) CreateAgentVersion(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Version     string `json:"version" binding:"required"`
+		Changelog   string `json:"changelog"`
+		BinaryURL   string `json:"binary_url" binding:"omitempty,url"`
+		ManifestURL string `json:"manifest_url" binding:"omitempty,url"`
+		FlashSize   int    `json:"flash_size" binding:"min=0"`
+		SRAMSize    int    `json:"sram_size" binding:"min=0"`
+		MaxLatency  int    `json:"max_latency" binding:"min=0"`
+		Publish     bool   `json:"publish"` // make it the current version right away
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	release := models.AgentVersion{
+		AgentID:     agent.ID,
+		Version:     req.Version,
+		Changelog:   req.Changelog,
+		BinaryURL:   req.BinaryURL,
+		ManifestURL: req.ManifestURL,
+		FlashSize:   req.FlashSize,
+		SRAMSize:    req.SRAMSize,
+		MaxLatency:  req.MaxLatency,
+	}
+	err := h.agentSvc.CreateVersion(&release, req.Publish)
+	switch err {
+	case nil:
+	case services.ErrInvalidVersion:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrVersionExists, services.ErrManifestRequired:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to create agent version")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create version"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Version created successfully",
+		"version": release,
+	})
+}
+
+// PublishAgentVersion publishes a draft release and makes it the agent's
+// current version
+func (h *Handler) PublishAgentVersion(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	release, ok := h.findVersion(c, agent)
+	if !ok {
+		return
+	}
+
+	if err := h.agentSvc.PublishVersion(release); err != nil {
+		if err == services.ErrVersionNotPublished {
+			c.JSON(http.StatusConflict, gin.H{"error": "Only draft or staged versions can be published"})
+			return
+		}
+		if publishError(c, err) {
+			return
+		}
+		log.Error().Err(err).Msg("Failed to publish agent version")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to publish version"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Version published successfully",
+		"version": release,
+	})
+}
+
+// DeprecateAgentVersion stops a release from being newly deployed
+func (h *Handler) DeprecateAgentVersion(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	release, ok := h.findVersion(c, agent)
+	if !ok {
+		return
+	}
+
+	err := h.agentSvc.DeprecateVersion(agent, release)
+	switch err {
+	case nil:
+	case services.ErrCurrentVersion:
+		c.JSON(http.StatusConflict, gin.H{"error": "Publish a newer version before deprecating the current one"})
+		return
+	case services.ErrVersionNotPublished:
+		c.JSON(http.StatusConflict, gin.H{"error": "Only published versions can be deprecated"})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to deprecate agent version")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deprecate version"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Version deprecated successfully",
+		"version": release,
+	})
+}
+
+// StageAgentVersion rolls a draft release out to part of the audience, or
+// changes the audience of a staged release
+func (h *Handler) StageAgentVersion(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	release, ok := h.findVersion(c, agent)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Percent int      `json:"percent" binding:"min=0,max=99"`
+		Regions []string `json:"regions"` // ISO country codes
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.agentSvc.StageVersion(agent, release, req.Percent, req.Regions)
+	switch err {
+	case nil:
+	case services.ErrInvalidRollout:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case services.ErrVersionNotPublished:
+		c.JSON(http.StatusConflict, gin.H{"error": "Only draft versions can be rolled out"})
+		return
+	case services.ErrRolloutInProgress, services.ErrNoStableVersion:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		if publishError(c, err) {
+			return
+		}
+		log.Error().Err(err).Msg("Failed to stage agent version")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to roll out version"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Version rollout started",
+		"version": release,
+	})
+}
+
+// GetAgentVersionRollout compares the reviews and deployments of a staged
+// release with the current version
+func (h *Handler) GetAgentVersionRollout(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	release, ok := h.findVersion(c, agent)
+	if !ok {
+		return
+	}
+
+	report, err := h.agentSvc.GetRolloutReport(agent, release)
+	switch err {
+	case nil:
+	case services.ErrVersionNotStaged:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		log.Error().Err(err).Msg("Failed to get rollout report")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rollout": report})
+}
+
+// HaltAgentVersionRollout stops a rollout, returning the release to draft
+func (h *Handler) HaltAgentVersionRollout(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	release, ok := h.findVersion(c, agent)
+	if !ok {
+		return
+	}
+
+	switch err := h.agentSvc.HaltRollout(release); err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Version rollout halted",
+			"version": release,
+		})
+	case services.ErrVersionNotStaged:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error().Err(err).Msg("Failed to halt rollout")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// PromoteAgentVersion publishes a staged release to everyone and makes it
+// the agent's current version
+func (h *Handler) PromoteAgentVersion(c *gin.Context) {
+	agent, ok := h.findPublisherAgent(c)
+	if !ok {
+		return
+	}
+
+	release, ok := h.findVersion(c, agent)
+	if !ok {
+		return
+	}
+
+	switch err := h.agentSvc.PromoteVersion(release); err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Version promoted successfully",
+			"version": release,
+		})
+	case services.ErrVersionNotStaged:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		if publishError(c, err) {
+			return
+		}
+		log.Error().Err(err).Msg("Failed to promote agent version")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to promote version"})
+	}
+}
+
+// DownloadAgentVersion returns the files of a release to a user entitled to
+// the agent, including older and deprecated releases
+func (h *Handler) DownloadAgentVersion(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+
+	release, ok := h.findVersion(c, agent)
+	if !ok {
+		return
+	}
+	if release.Status == models.AgentVersionStatusDraft {
+		member, ok := h.isAgentMember(c, agent, userID.(uuid.UUID))
+		if !ok {
+			return
+		}
+		if !member {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+			return
+		}
+	}
+
+	h.downloadRelease(c, agent, release, userID.(uuid.UUID))
+}
+
+// DownloadAgent returns expiring download links for the current version of
+// an agent the user has bought, or of a free agent. Users in the audience of
+// a rollout get the staged release instead.
+func (h *Handler) DownloadAgent(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	agent, ok := h.findAgent(c)
+	if !ok {
+		return
+	}
+	release, err := h.agentSvc.ResolveVersion(agent, userID.(uuid.UUID), c.GetHeader(h.config.Fraud.IPCountryHeader))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get current agent version")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	h.downloadRelease(c, agent, release, userID.(uuid.UUID))
+}
+
+// downloadRelease checks that the user is entitled to an agent and returns
+// presigned links to one of its releases, counting the download. The
+// artifact is the form of the binary best suited to the device's link.
+func (h *Handler) downloadRelease(c *gin.Context, agent *models.Agent, release *models.AgentVersion, userID uuid.UUID) {
+	link, ok := linkConstraints(c)
+	if !ok {
+		return
+	}
+	if err := h.agentSvc.CheckEntitlement(agent, userID); err != nil {
+		if err == services.ErrNotEntitled {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Purchase this agent to download it"})
+			return
+		}
+		log.Error().Err(err).Msg("Failed to check agent entitlement")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	traceID, err := h.agentSvc.EntitlementTrace(agent, userID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get entitlement trace")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	files, err := h.agentSvc.GetReleaseFiles(c.Request.Context(), release)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get release files")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	artifact, err := h.artifactSvc.Negotiate(c.Request.Context(), release, files.BinaryURL, link)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to negotiate download artifact")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	token, err := h.tokenSvc.Issue(userID, release, traceID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sign download token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	// Record the download (standby replicas cannot write)
+	if !h.replSvc.IsReadOnly() {
+		if err := h.downloadCounter.Record(c.Request.Context(), &models.AgentDownload{
+			UserID:  userID,
+			AgentID: agent.ID,
+			Version: release.Version,
+			TraceID: traceID,
+		}); err != nil {
+			log.Error().Err(err).Msg("Failed to record agent download")
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"version":         release.Version,
+		"binary_url":      files.BinaryURL,
+		"binary_checksum": release.BinaryChecksum,
+		"signature":       release.BinarySignature,
+		"signing_key":     release.SigningKey,
+		"manifest_url":    files.ManifestURL,
+		"artifact":        artifact,
+		"expires_in":      int(h.config.Storage.PresignExpiry.Seconds()),
+		"download_token":  token,
+		"trace_id":        traceID,
+	})
+}
+
+// linkConstraints reads the device's link from ?max_bandwidth= (bytes per
+// second), ?metered=, ?base_version= and ?accept=, a comma-separated list of
+// delta, compressed and ranges, writing the error response and returning
+// false if they are invalid
+func linkConstraints(c *gin.Context) (services.LinkConstraints, bool) {
+	link := services.LinkConstraints{BaseVersion: c.Query("base_version")}
+	if bandwidth := c.Query("max_bandwidth"); bandwidth != "" {
+		n, err := strconv.ParseInt(bandwidth, 10, 64)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "max_bandwidth must be a positive number of bytes per second"})
+			return link, false
+		}
+		link.MaxBandwidth = n
+	}
+	if metered := c.Query("metered"); metered != "" {
+		m, err := strconv.ParseBool(metered)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "metered must be true or false"})
+			return link, false
+		}
+		link.Metered = m
+	}
+	if accept := c.Query("accept"); accept != "" {
+		for _, form := range strings.Split(accept, ",") {
+			switch strings.TrimSpace(form) {
+			case "delta":
+				link.AcceptDelta = true
+			case "compressed":
+				link.AcceptCompressed = true
+			case "ranges":
+				link.AcceptRanges = true
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": "accept must list delta, compressed or ranges"})
+				return link, false
+			}
+		}
+	}
+	return link, true
+}
+
+// GetSigningKeys returns the public keys that verify download tokens, as a
+// JSON Web Key Set
+func (h *Handler) GetSigningKeys(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, gin.H{"keys": []map[string]string{services.SigningKeyJWK(h.signer)}})
+}
+
+// findVersion loads the release in the :version parameter of an agent,
+// writing the error response and returning false if it cannot
+func (h *Handler) findVersion(c *gin.Context, agent *models.Agent) (*models.AgentVersion, bool) {
+	release, err := h.agentSvc.GetVersion(agent.ID, c.Param("version"))
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+			return nil, false
+		}
+		log.Error().Err(err).Msg("Failed to get agent version")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return nil, false
+	}
+	return release, true
+}
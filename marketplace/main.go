@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+	_ "time/tzdata" // user timezones for notification quiet hours
 
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
@@ -21,6 +22,7 @@ import (
 	"github.com/edgeplug/marketplace/handlers"
 	"github.com/edgeplug/marketplace/middleware"
 	"github.com/edgeplug/marketplace/models"
+	"github.com/edgeplug/marketplace/services"
 )
 
 func main() {
@@ -39,21 +41,167 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to connect to database")
 	}
 
-	// Auto-migrate database
-	if err := autoMigrate(db); err != nil {
-		log.Fatal().Err(err).Msg("Failed to migrate database")
+	// Workers run background jobs instead of serving requests; operator
+	// subcommands act on the database and exit
+	if len(os.Args) > 1 {
+		if os.Args[1] == "worker" {
+			os.Exit(runWorker(cfg, db))
+		}
+		os.Exit(runCommand(cfg, db, os.Args[1:]))
+	}
+
+	// Connect to Redis; an unreachable Redis degrades per the failure policy
+	redisSvc, err := services.NewRedisService(cfg.Redis)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure Redis")
+	}
+	if !redisSvc.Available() {
+		log.Warn().Str("failure_policy", cfg.Redis.FailurePolicy).Msg("Redis unavailable at startup")
+	}
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	go redisSvc.MonitorHealth(bgCtx)
+
+	storage, err := services.NewStorage(cfg.Storage)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure storage")
+	}
+
+	// Auto-migrate database and start the workers that need a writable
+	// database. Standby replicas do neither until they are promoted.
+	replSvc := services.NewReplicationService(cfg.Replication)
+	agentCache := services.NewAgentCache(db, cfg.Cache)
+	consentSvc := services.NewConsentService(db, cfg.Consent)
+	reminderSvc := services.NewReviewReminderService(db, cfg.ReviewReminders, consentSvc)
+	limitSvc := services.NewLimitService(db, cfg.Tiers, cfg.PublicAPI, cfg.Limits)
+	tierSvc := services.NewTierService(db, cfg.Tiers, limitSvc)
+	checkoutSvc := services.NewCheckoutService(db, cfg.Checkout, services.NewFraudService(db, cfg.Fraud), tierSvc)
+	meteringSvc := services.NewMeteringService(db, cfg.Metering, limitSvc)
+	fleetSvc := services.NewFleetRolloutService(db, cfg.FleetRollouts, meteringSvc)
+	importSvc := services.NewDeviceImportService(db, cfg.DeviceImports)
+	telemetrySvc := services.NewTelemetryService(db, cfg.Telemetry, consentSvc)
+	creditSvc := services.NewCreditService(db, cfg.Credits)
+	curationSvc := services.NewCurationService(db, cfg.Curation, services.NewRankingService(db, cfg.Ranking))
+	trendingSvc := services.NewTrendingService(db, cfg.Trending)
+	currencySvc := services.NewCurrencyService(db, cfg.Currencies)
+	payments, err := services.NewPaymentProvider(cfg.Payments)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure payment provider")
+	}
+	payoutSvc := services.NewPayoutService(db, payments, cfg.Payouts)
+	agentSvc := services.NewAgentService(db, agentCache, tierSvc, storage, cfg.Storage.PresignExpiry, cfg.Scanning.Enabled)
+	jobs, err := setupJobs(cfg, db, redisSvc, storage, agentSvc)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to set up jobs")
+	}
+	notificationSvc := services.NewNotificationService(db, jobs.mailer, cfg.Notifications, consentSvc)
+	webhookSvc := services.NewWebhookService(db, cfg.Webhooks)
+	// Every instance serves streams, so every instance listens for events
+	eventSvc := services.NewEventService(db, redisSvc, cfg.Events)
+	go eventSvc.Listen(bgCtx)
+	searchSvc := services.NewSearchService(db, cfg.Search)
+	seoSvc := services.NewSEOService(db, cfg.SEO)
+	housekeepingSvc := services.NewHousekeepingService(db, cfg.StaleDrafts, cfg.UnsoldAgents, agentSvc)
+	subscriptionSvc := services.NewSubscriptionService(db, cfg.Subscriptions, cfg.Payments.WebhookSecret, payments)
+	deviceCertSvc, err := services.NewDeviceCertService(db, cfg.DeviceAPI)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure device CA")
+	}
+	// Tasks given a cron spec run on the leader only, instead of on their
+	// own interval on every replica
+	adminStatsSvc := services.NewAdminStatsService(db, redisSvc, cfg.AdminStats)
+	scheduler, err := services.NewScheduler(redisSvc, cfg.Scheduler, []services.ScheduledTask{
+		{Name: services.TaskStats, Run: func(ctx context.Context) error {
+			_, err := adminStatsSvc.Get(ctx, true)
+			return err
+		}},
+		{Name: services.TaskExchangeRates, Run: func(ctx context.Context) error {
+			_, err := currencySvc.SyncRates(ctx)
+			return err
+		}},
+		{Name: services.TaskStaleDrafts, Run: func(context.Context) error {
+			return housekeepingSvc.ProcessStaleDrafts()
+		}},
+		{Name: services.TaskPayouts, Run: func(ctx context.Context) error {
+			if err := payoutSvc.CreatePayouts(time.Now()); err != nil {
+				return err
+			}
+			return payoutSvc.SendPayouts(ctx)
+		}},
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure scheduler")
+	}
+	deviceJournal := services.NewDeviceJournal(db, redisSvc, cfg.DeviceJournal, deviceCertSvc, services.NewDeviceCheckInService(db, meteringSvc, agentSvc), telemetrySvc)
+	// Loops that must not run on two replicas at once, such as payouts and
+	// credits, run on the scheduler's leader only
+	scheduler.OnLeader("reminders", reminderSvc.Run)
+	scheduler.OnLeader("review_insights", jobs.insights.Run)
+	scheduler.OnLeader("checkout", checkoutSvc.Run)
+	scheduler.OnLeader("metering", meteringSvc.Run)
+	scheduler.OnLeader("fleet", fleetSvc.Run)
+	scheduler.OnLeader("imports", importSvc.Run)
+	scheduler.OnLeader("telemetry", telemetrySvc.Run)
+	scheduler.OnLeader("credits", creditSvc.Run)
+	scheduler.OnLeader("curation", curationSvc.Run)
+	scheduler.OnLeader("trending", trendingSvc.Run)
+	if !scheduler.Scheduled(services.TaskExchangeRates) {
+		scheduler.OnLeader("exchange_rates", currencySvc.Run)
+	}
+	scheduler.OnLeader("housekeeping", func(ctx context.Context) {
+		housekeepingSvc.Run(ctx, !scheduler.Scheduled(services.TaskStaleDrafts))
+	})
+	scheduler.OnLeader("subscriptions", subscriptionSvc.Run)
+	if !scheduler.Scheduled(services.TaskPayouts) {
+		scheduler.OnLeader("payouts", payoutSvc.Run)
+	}
+	scheduler.OnLeader("notifications", notificationSvc.Run)
+	scheduler.OnLeader("webhooks", webhookSvc.Run)
+	scheduler.OnLeader("events", eventSvc.Run)
+	scheduler.OnLeader("search", searchSvc.Run)
+	scheduler.OnLeader("scans", jobs.scans.Run)
+	startPrimaryWorkers := func() {
+		go agentCache.Listen(bgCtx)
+		go seoSvc.Listen(bgCtx)
+		go deviceJournal.Run(bgCtx)
+		go services.NewDownloadCounter(db, redisSvc, cfg.DownloadCounter).Run(bgCtx)
+		go scheduler.Run(bgCtx)
+		if cfg.Jobs.Embedded {
+			go jobs.queue.Work(bgCtx)
+		}
+	}
+	if !replSvc.IsReadOnly() {
+		if err := autoMigrate(db, cfg); err != nil {
+			log.Fatal().Err(err).Msg("Failed to migrate database")
+		}
+		startPrimaryWorkers()
 	}
 
 	// Create handlers
-	handler := handlers.NewHandler(cfg, db)
+	signer, err := services.NewSigner(cfg.Signing)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure signing key")
+	}
+	domainSvc := services.NewDomainService(db, cfg.Domains, tierSvc)
+	go domainSvc.Run(bgCtx)
+	denylist := services.NewTokenDenylist(redisSvc, cfg.JWT.Expiration)
+	authSvc := services.NewAuthService(cfg, db, denylist, redisSvc)
+	apiKeySvc := services.NewAPIKeyService(db, cfg.PublicAPI, limitSvc)
+	accountSvc := services.NewServiceAccountService(db)
+	handler := handlers.NewHandler(cfg, db, replSvc, redisSvc, authSvc, agentCache, tierSvc, storage, domainSvc, signer, payments, jobs.mailer, apiKeySvc, notificationSvc, webhookSvc, searchSvc, jobs.scans, limitSvc, deviceCertSvc, seoSvc, deviceJournal, accountSvc, eventSvc, jobs.queue, jobs.artifacts, jobs.insights)
 
 	// Setup router
-	router := setupRouter(cfg, handler)
-
-	// Create server
+	logSampler := services.NewLogSampler(cfg.Logging.Sampling)
+	router := setupRouter(cfg, handler, replSvc, authSvc, tierSvc, storage, domainSvc, apiKeySvc, deviceCertSvc, deviceJournal, accountSvc, services.NewRateLimiter(redisSvc), logSampler)
+
+	// Create server. With TLS served here, it also answers ACME HTTP-01
+	// challenges for custom domains.
+	var serverHandler http.Handler = router
+	if cfg.Domains.ServeTLS {
+		serverHandler = domainSvc.HTTPHandler(router)
+	}
 	server := &http.Server{
 		Addr:         fmt.Sprintf("%s:%s", cfg.Server.Host, cfg.Server.Port),
-		Handler:      router,
+		Handler:      serverHandler,
 		ReadTimeout:  cfg.Server.ReadTimeout,
 		WriteTimeout: cfg.Server.WriteTimeout,
 		IdleTimeout:  cfg.Server.IdleTimeout,
@@ -67,11 +215,63 @@ func main() {
 		}
 	}()
 
+	// Serve custom domains over HTTPS, picking certificates by SNI
+	var tlsServer *http.Server
+	if cfg.Domains.ServeTLS {
+		tlsServer = &http.Server{
+			Addr:         fmt.Sprintf("%s:%s", cfg.Server.Host, cfg.Domains.HTTPSPort),
+			Handler:      router,
+			TLSConfig:    domainSvc.TLSConfig(),
+			ReadTimeout:  cfg.Server.ReadTimeout,
+			WriteTimeout: cfg.Server.WriteTimeout,
+			IdleTimeout:  cfg.Server.IdleTimeout,
+		}
+		go func() {
+			log.Info().Msgf("Starting custom domain TLS server on %s:%s", cfg.Server.Host, cfg.Domains.HTTPSPort)
+			if err := tlsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				log.Fatal().Err(err).Msg("Failed to start custom domain TLS server")
+			}
+		}()
+	}
+
+	// Serve the device API with mTLS. Client certificates are optional in
+	// the handshake so that requests without one get a JSON error.
+	var deviceServer *http.Server
+	if cfg.DeviceAPI.Enabled && cfg.DeviceAPI.ServerCertFile != "" {
+		tlsConfig, err := deviceCertSvc.TLSConfig()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to configure device API TLS")
+		}
+		deviceServer = &http.Server{
+			Addr:         fmt.Sprintf("%s:%s", cfg.Server.Host, cfg.DeviceAPI.Port),
+			Handler:      router,
+			TLSConfig:    tlsConfig,
+			ReadTimeout:  cfg.Server.ReadTimeout,
+			WriteTimeout: cfg.Server.WriteTimeout,
+			IdleTimeout:  cfg.Server.IdleTimeout,
+		}
+		go func() {
+			log.Info().Msgf("Starting device API server on %s:%s", cfg.Server.Host, cfg.DeviceAPI.Port)
+			if err := deviceServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				log.Fatal().Err(err).Msg("Failed to start device API server")
+			}
+		}()
+	}
+
 	// Start metrics server if enabled
 	if cfg.Metrics.Enabled {
 		go startMetricsServer(cfg)
 	}
 
+	// Reload replication and log sampling settings on SIGHUP to promote or
+	// demote the instance and adjust how much is logged
+	go watchConfig(replSvc, logSampler, func() {
+		if err := autoMigrate(db, cfg); err != nil {
+			log.Error().Err(err).Msg("Failed to migrate database after promotion")
+		}
+		startPrimaryWorkers()
+	})
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -83,10 +283,25 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	if tlsServer != nil {
+		if err := tlsServer.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("Custom domain TLS server forced to shutdown")
+		}
+	}
+	if deviceServer != nil {
+		if err := deviceServer.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("Device API server forced to shutdown")
+		}
+	}
 	if err := server.Shutdown(ctx); err != nil {
 		log.Fatal().Err(err).Msg("Server forced to shutdown")
 	}
 
+	stopBackground()
+	if err := redisSvc.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close Redis client")
+	}
+
 	log.Info().Msg("Server exited")
 }
 
@@ -140,14 +355,105 @@ func connectDatabase(cfg *config.Config) (*gorm.DB, error) {
 }
 
 // autoMigrate runs database migrations
-func autoMigrate(db *gorm.DB) error {
+func autoMigrate(db *gorm.DB, cfg *config.Config) error {
+	if err := runDataMigrations(db); err != nil {
+		return err
+	}
+
 	models := []interface{}{
 		&models.User{},
+		&models.RefreshToken{},
+		&models.PasswordResetToken{},
+		&models.PendingAction{},
+		&models.APIKey{},
+		&models.ServiceAccount{},
+		&models.PublisherKey{},
+		&models.LegalHold{},
+		&models.AuditLog{},
+		&models.SchemaMigration{},
+		&models.APIKeyUsage{},
+		&models.LimitOverride{},
+		&models.RankingWeights{},
 		&models.Agent{},
+		&models.AgentVersion{},
+		&models.AgentHistory{},
 		&models.Purchase{},
 		&models.Review{},
+		&models.ReviewAttachment{},
+		&models.ReviewReply{},
+		&models.ReviewVote{},
+		&models.PlatformChangelogEntry{},
+		&models.Report{},
+		&models.ReviewSummary{},
+		&models.ReviewDailyStat{},
+		&models.AgentDownloadDay{},
+		&models.AgentPopularity{},
+		&models.ReviewInsight{},
 		&models.Favorite{},
+		&models.SearchOutboxEntry{},
+		&models.SearchReindex{},
+		&models.SearchConsistencyCheck{},
 		&models.Transaction{},
+		&models.Notification{},
+		&models.NotificationPreference{},
+		&models.Consent{},
+		&models.ConsentEvent{},
+		&models.TelemetrySharingOptOut{},
+		&models.NotificationDigest{},
+		&models.WebhookSubscription{},
+		&models.WebhookDelivery{},
+		&models.StreamEvent{},
+		&models.ReviewReminder{},
+		&models.CheckoutSession{},
+		&models.RefundRequest{},
+		&models.PublisherApplication{},
+		&models.Organization{},
+		&models.Membership{},
+		&models.OrgInvitation{},
+		&models.OrgPurchasePolicy{},
+		&models.OrgPurchaseRequest{},
+		&models.OrgPurchaseApproval{},
+		&models.PayoutAccount{},
+		&models.Payout{},
+		&models.FraudRule{},
+		&models.FraudAssessment{},
+		&models.Deployment{},
+		&models.DeploymentUsage{},
+		&models.FleetRollout{},
+		&models.FleetRolloutTarget{},
+		&models.DeploymentTransfer{},
+		&models.License{},
+		&models.SeatPool{},
+		&models.ResellerGrant{},
+		&models.ReleaseArtifact{},
+		&models.PricingPlan{},
+		&models.Subscription{},
+		&models.PaymentEvent{},
+		&models.DeviceResources{},
+		&models.Device{},
+		&models.DeviceCertificate{},
+		&models.DeviceClaim{},
+		&models.DeviceImport{},
+		&models.Invoice{},
+		&models.InvoiceLine{},
+		&models.AgentLocalization{},
+		&models.AgentCapabilities{},
+		&models.AgentCapabilityTerm{},
+		&models.CurationRule{},
+		&models.FeaturedAgent{},
+		&models.Bundle{},
+		&models.BundleComponent{},
+		&models.CreditEntry{},
+		&models.CreditCode{},
+		&models.CreditRedemption{},
+		&models.Template{},
+		&models.TemplateVersion{},
+		&models.TemplateDownload{},
+		&models.AgentDownload{},
+		&models.CustomDomain{},
+		&models.ACMECacheEntry{},
+		&models.Currency{},
+		&models.ExchangeRate{},
 	}
 
 	for _, model := range models {
@@ -156,12 +462,69 @@ func autoMigrate(db *gorm.DB) error {
 		}
 	}
 
+	// Publishing became gated on the publisher role; users who published
+	// agents before that keep publishing
+	if err := db.Exec("UPDATE users SET role = 'publisher' WHERE role = 'user' AND id IN (SELECT publisher_id FROM agents)").Error; err != nil {
+		return fmt.Errorf("failed to backfill publisher roles: %w", err)
+	}
+	// Users and organizations created before avatars get an identicon
+	if err := db.Exec("UPDATE users SET avatar_url = '/api/v1/identicons/' || id || '.png' WHERE avatar_url IS NULL OR avatar_url = ''").Error; err != nil {
+		return fmt.Errorf("failed to backfill avatars: %w", err)
+	}
+	if err := db.Exec("UPDATE organizations SET logo_url = '/api/v1/identicons/' || id || '.png' WHERE logo_url IS NULL OR logo_url = ''").Error; err != nil {
+		return fmt.Errorf("failed to backfill organization logos: %w", err)
+	}
+	// Operator commands were logged before audit entries had an actor type
+	if err := db.Exec("UPDATE audit_logs SET actor_type = 'operator' WHERE actor_id IS NULL AND actor_name <> '' AND actor_type = 'user'").Error; err != nil {
+		return fmt.Errorf("failed to backfill audit actor types: %w", err)
+	}
+	if err := createTelemetryTable(db, cfg.Telemetry); err != nil {
+		return fmt.Errorf("failed to create telemetry table: %w", err)
+	}
+	if err := syncAgentHistory(db); err != nil {
+		return fmt.Errorf("failed to set up agent history: %w", err)
+	}
+	if err := syncSearchOutbox(db, cfg.Search.Backend == "opensearch"); err != nil {
+		return fmt.Errorf("failed to set up the search outbox: %w", err)
+	}
+	if err := syncSEONotifications(db, cfg.SEO.InvalidationChannel); err != nil {
+		return fmt.Errorf("failed to set up SEO notifications: %w", err)
+	}
+	if err := seedCurrencies(db, cfg.Currencies.Supported); err != nil {
+		return fmt.Errorf("failed to seed currencies: %w", err)
+	}
+	if err := recordDataMigrations(db); err != nil {
+		return fmt.Errorf("failed to record data migrations: %w", err)
+	}
+
 	log.Info().Msg("Database migrations completed")
 	return nil
 }
 
+// watchConfig re-reads the configuration on SIGHUP, applies any
+// replication mode change, calling onPromote when a replica is promoted,
+// and switches to the new log sampling rates
+func watchConfig(replSvc *services.ReplicationService, logSampler *services.LogSampler, onPromote func()) {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	for range reload {
+		cfg, err := config.Load()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to reload configuration")
+			continue
+		}
+
+		logSampler.Apply(cfg.Logging.Sampling)
+		if replSvc.Apply(cfg.Replication) {
+			log.Info().Msg("Promoted to primary")
+			onPromote()
+		}
+	}
+}
+
 // setupRouter configures the HTTP router with middleware and routes
-func setupRouter(cfg *config.Config, handler *handlers.Handler) *gin.Engine {
+func setupRouter(cfg *config.Config, handler *handlers.Handler, replSvc *services.ReplicationService, authSvc *services.AuthService, tierSvc *services.TierService, storage services.Storage, domainSvc *services.DomainService, apiKeySvc *services.APIKeyService, deviceCertSvc *services.DeviceCertService, deviceJournal *services.DeviceJournal, accountSvc *services.ServiceAccountService, limiter *services.RateLimiter, logSampler *services.LogSampler) *gin.Engine {
 	// Set Gin mode
 	if cfg.Logging.Level == "debug" {
 		gin.SetMode(gin.DebugMode)
@@ -170,11 +533,18 @@ func setupRouter(cfg *config.Config, handler *handlers.Handler) *gin.Engine {
 	}
 
 	router := gin.New()
+	// Client IPs key rate limits and audit entries, so X-Forwarded-For is
+	// only believed from the configured proxies
+	if err := router.SetTrustedProxies(cfg.Security.TrustedProxies); err != nil {
+		log.Fatal().Err(err).Msg("Invalid trusted proxies")
+	}
 
 	// Add middleware
 	router.Use(gin.Recovery())
-	router.Use(middleware.Logger())
-	router.Use(middleware.CORS(cfg.Security.CORSOrigins))
+	router.Use(middleware.Logger(logSampler))
+	router.Use(middleware.CustomDomain(domainSvc))
+	router.Use(middleware.CORS(cfg.Security.CORSOrigins, domainSvc.AllowOrigin))
+	router.Use(middleware.ReadOnlyReplica(replSvc))
 
 	// Add pprof endpoints in debug mode
 	if cfg.Logging.Level == "debug" {
@@ -183,45 +553,400 @@ func setupRouter(cfg *config.Config, handler *handlers.Handler) *gin.Engine {
 
 	// Health check endpoint
 	router.GET("/health", handler.HealthCheck)
+	router.GET("/about", handler.About)
+
+	// Search engine sitemap
+	router.GET("/sitemap.xml", handler.GetSitemap)
+	router.GET("/sitemaps/:file", handler.GetSitemapPage)
+
+	// Files in local storage, served through presigned URLs only
+	if files, ok := storage.(http.Handler); ok {
+		router.GET(services.LocalFilesPath+"/*key", gin.WrapH(http.StripPrefix(services.LocalFilesPath, files)))
+	}
 
 	// API routes
 	api := router.Group("/api/v1")
+	api.Use(middleware.IdentifyUser(authSvc), middleware.RateLimit(limiter, cfg.Security))
 	{
 		// Public routes
 		api.POST("/auth/register", handler.Register)
 		api.POST("/auth/login", handler.Login)
+		api.POST("/auth/refresh", handler.RefreshToken)
+		api.POST("/auth/forgot-password", handler.ForgotPassword)
+		api.POST("/auth/reset-password", handler.ResetPassword)
+		api.POST("/auth/confirm", handler.ConfirmAction)
+
+		api.GET("/currencies", handler.GetCurrencies)
+		api.GET("/platform/changelog", handler.GetPlatformChangelog)
+		api.GET("/platform/changelog/:id", handler.GetPlatformChangelogEntry)
 
 		// Agent routes (public)
 		api.GET("/agents", handler.GetAgents)
-		api.GET("/agents/:id", handler.GetAgent)
+		api.GET("/agents/facets", handler.GetAgentFacets)
+		api.GET("/agents/:id", middleware.OptionalAuth(authSvc), handler.GetAgent)
+		api.GET("/agents/:id/history", handler.GetAgentHistory)
+		api.GET("/agents/:id/structured-data", handler.GetAgentStructuredData)
 		api.GET("/agents/:id/reviews", handler.GetReviews)
+		api.GET("/agents/:id/reviews/summary", handler.GetReviewSummary)
+		api.GET("/agents/:id/reviews/insights", handler.GetReviewInsights)
+		api.GET("/agents/:id/readme", handler.GetAgentReadme)
+		api.GET("/agents/:id/localizations", handler.GetAgentLocalizations)
+		api.GET("/agents/:id/capabilities", handler.GetAgentCapabilities)
+		api.GET("/agents/:id/icon", handler.GetAgentIcon)
+		api.GET("/avatars/:name", handler.GetAvatar)
+		api.GET("/identicons/:name", handler.GetIdenticon)
+		api.GET("/agents/:id/versions", handler.GetAgentVersions)
+		api.GET("/agents/:id/versions/:version", handler.GetAgentVersion)
+		api.GET("/tiers", handler.GetTiers)
+		api.GET("/featured/:slot", handler.GetFeatured)
+		api.GET("/bundles", handler.GetBundles)
+		api.GET("/bundles/:id", handler.GetBundle)
+		api.GET("/bundles/:id/budget", handler.GetBundleBudget)
+		api.GET("/stats/public", handler.GetPublicStats)
+		api.GET("/templates", handler.GetTemplates)
+		api.GET("/templates/:id", handler.GetTemplate)
+		api.GET("/templates/:id/download", handler.DownloadTemplate)
+		api.GET("/branding", handler.GetBranding)
+		api.GET("/schemas/manifest/:version", handler.GetManifestSchema)
+		api.GET("/signing-keys", handler.GetSigningKeys)
+		api.GET("/verify/receipt/:token", handler.VerifyReceipt)
+		api.GET("/agents/:id/plans", handler.GetAgentPlans)
+		api.POST("/payments/webhook", handler.PaymentWebhook)
+		api.POST("/licenses/verify", handler.VerifyLicense)
+		api.POST("/verify/history", handler.VerifyHistory)
+
+		// Read-only public API, used with API product keys
+		public := api.Group("/public")
+		public.Use(middleware.APIKeyAuth(apiKeySvc))
+		{
+			public.GET("/agents", handler.GetAgents)
+			public.GET("/agents/facets", handler.GetAgentFacets)
+			public.GET("/agents/:id", handler.GetAgent)
+			public.GET("/agents/:id/versions", handler.GetAgentVersions)
+			public.GET("/agents/:id/capabilities", handler.GetAgentCapabilities)
+			public.GET("/agents/:id/reviews/summary", handler.GetReviewSummary)
+			public.GET("/featured/:slot", handler.GetFeatured)
+		}
+
+		// Read-only reporting API for BI tools, used with service accounts.
+		// Every read is recorded in the audit log.
+		reporting := api.Group("/reporting")
+		reporting.Use(middleware.ServiceAccountAuth(accountSvc), handler.AuditReporting)
+		{
+			purchases := middleware.RequireScope(models.ServiceAccountScopePurchases)
+			reporting.GET("/purchases", purchases, handler.GetPurchases)
+			reporting.GET("/purchases/:id/receipt", purchases, handler.GetPurchaseReceipt)
+			reporting.GET("/invoices", purchases, handler.GetInvoices)
+			reporting.GET("/invoices/:id", purchases, handler.GetInvoice)
+			reporting.GET("/payouts", purchases, handler.GetPayouts)
+
+			analytics := middleware.RequireScope(models.ServiceAccountScopeAnalytics)
+			reporting.GET("/dashboard", analytics, handler.GetDashboard)
+			reporting.GET("/agents/:id/telemetry", analytics, handler.GetAgentTelemetry)
+			reporting.GET("/agents/:id/telemetry/series", analytics, handler.GetAgentTelemetrySeries)
+			reporting.GET("/admin/stats", analytics, middleware.RequireRole(models.UserRoleAdmin), handler.GetStats)
+		}
 
 		// Protected routes
 		protected := api.Group("/")
-		protected.Use(middleware.Auth(cfg))
+		protected.Use(middleware.Auth(authSvc))
+		protected.Use(middleware.TierRateLimit(tierSvc))
 		{
 			// User routes
+			protected.POST("/auth/logout", handler.Logout)
 			protected.GET("/profile", handler.GetProfile)
 			protected.PUT("/profile", handler.UpdateProfile)
+			protected.DELETE("/profile", handler.DeleteAccount)
+			protected.PUT("/profile/email", handler.ChangeEmail)
+			protected.GET("/dashboard", handler.GetDashboard)
+			protected.PUT("/profile/avatar", handler.UploadAvatar)
+			protected.DELETE("/profile/avatar", handler.DeleteAvatar)
+			protected.GET("/api-keys", handler.GetAPIKeys)
+			protected.POST("/api-keys", handler.CreateAPIKey)
+			protected.DELETE("/api-keys/:id", handler.RevokeAPIKey)
+			protected.GET("/api-keys/:id/usage", handler.GetAPIKeyUsage)
+			protected.PUT("/api-keys/:id/grace", handler.SetAPIKeyGraceMode)
+			protected.GET("/service-accounts", handler.GetServiceAccounts)
+			protected.POST("/service-accounts", handler.CreateServiceAccount)
+			protected.DELETE("/service-accounts/:id", handler.RevokeServiceAccount)
+			protected.GET("/profile/credits", handler.GetCredits)
+			protected.GET("/profile/history", handler.GetHistory)
+			protected.GET("/events", handler.StreamEvents)
+			protected.GET("/operations/:id", handler.GetOperation)
+			protected.POST("/operations/:id/cancel", handler.CancelOperation)
+			protected.GET("/notifications", handler.GetNotifications)
+			protected.POST("/notifications/read", handler.MarkAllNotificationsRead)
+			protected.POST("/notifications/:id/read", handler.MarkNotificationRead)
+			protected.DELETE("/notifications/:id/read", handler.MarkNotificationUnread)
+			protected.GET("/notifications/settings", handler.GetNotificationSettings)
+			protected.PUT("/notifications/settings", handler.UpdateNotificationSettings)
+			protected.GET("/notifications/digests", handler.GetNotificationDigests)
+			protected.GET("/consents", handler.GetConsents)
+			protected.PUT("/consents", handler.UpdateConsents)
+			protected.GET("/consents/history", handler.GetConsentHistory)
+			protected.POST("/profile/credits/redeem", handler.RedeemCreditCode)
+
+			// Publisher onboarding
+			protected.POST("/publisher/apply", handler.ApplyPublisher)
+			protected.GET("/publisher/applications", handler.GetPublisherApplications)
+			protected.GET("/publisher/housekeeping", handler.GetHousekeepingReport)
+			protected.POST("/agents/:id/keep", handler.KeepAgent)
+			protected.GET("/publisher/keys", handler.GetPublisherKeys)
+			protected.POST("/publisher/keys", handler.RegisterPublisherKey)
+			protected.DELETE("/publisher/keys/:id", handler.RevokePublisherKey)
+
+			// Organizations
+			protected.POST("/orgs", handler.CreateOrganization)
+			protected.GET("/orgs", handler.GetOrganizations)
+			protected.GET("/orgs/invitations", handler.GetInvitations)
+			protected.POST("/orgs/invitations/:id/accept", handler.AcceptInvitation)
+			protected.POST("/orgs/invitations/:id/decline", handler.DeclineInvitation)
+			protected.GET("/orgs/:id", handler.GetOrganization)
+			protected.GET("/orgs/:id/agents", handler.GetOrganizationAgents)
+			protected.PUT("/orgs/:id/logo", handler.UploadOrgLogo)
+			protected.DELETE("/orgs/:id/logo", handler.DeleteOrgLogo)
+			protected.POST("/orgs/:id/invitations", handler.InviteMember)
+			protected.DELETE("/orgs/:id/invitations/:invitation_id", handler.RevokeInvitation)
+			protected.PUT("/orgs/:id/members/:user_id", handler.UpdateMemberRole)
+			protected.DELETE("/orgs/:id/members/:user_id", handler.RemoveMember)
+			protected.GET("/orgs/:id/purchase-policy", handler.GetPurchasePolicy)
+			protected.PUT("/orgs/:id/purchase-policy", handler.SetPurchasePolicy)
+			protected.GET("/orgs/:id/purchase-requests", handler.GetOrgPurchaseRequests)
+			protected.POST("/orgs/:id/purchase-requests", handler.RequestOrgPurchase)
+			protected.POST("/orgs/:id/purchase-requests/:request_id/approve", handler.ApproveOrgPurchase)
+			protected.POST("/orgs/:id/purchase-requests/:request_id/reject", handler.RejectOrgPurchase)
+			protected.POST("/orgs/:id/purchase-requests/:request_id/cancel", handler.CancelOrgPurchase)
+
+			// Webhooks
+			protected.GET("/webhooks", handler.GetWebhooks)
+			protected.POST("/webhooks", handler.CreateWebhook)
+			protected.PUT("/webhooks/:id", handler.UpdateWebhook)
+			protected.DELETE("/webhooks/:id", handler.DeleteWebhook)
+			protected.GET("/webhooks/:id/deliveries", handler.GetWebhookDeliveries)
 
 			// Agent management (publishers only)
-			protected.POST("/agents", handler.CreateAgent)
+			protected.POST("/agents", authSvc.RequireRole(models.UserRolePublisher), handler.CreateAgent)
 			protected.PUT("/agents/:id", handler.UpdateAgent)
 			protected.DELETE("/agents/:id", handler.DeleteAgent)
+			protected.POST("/agents/:id/favorite", handler.AddFavorite)
+			protected.DELETE("/agents/:id/favorite", handler.RemoveFavorite)
+			protected.GET("/favorites", handler.GetFavorites)
+			protected.POST("/agents/:id/transfer", handler.TransferAgent)
+			protected.PUT("/agents/:id/localizations/:locale", handler.SaveAgentLocalization)
+			protected.DELETE("/agents/:id/localizations/:locale", handler.DeleteAgentLocalization)
+			protected.PUT("/agents/:id/capabilities", handler.SaveAgentCapabilities)
+			protected.POST("/agents/:id/binary", handler.UploadAgentBinary)
+			protected.POST("/agents/:id/manifest", handler.UploadAgentManifest)
+			protected.POST("/agents/:id/sbom", handler.UploadAgentSBOM)
+			protected.POST("/agents/:id/icon", handler.UploadAgentIcon)
+			protected.POST("/agents/:id/readme", handler.UploadAgentReadme)
+			// Dry runs of the manifest checks of uploads and publishing, for CI pipelines
+			protected.POST("/validate/manifest", handler.ValidateManifest)
+			protected.POST("/validate/config", handler.ValidateConfig)
+			protected.POST("/agents/:id/versions", handler.CreateAgentVersion)
+			protected.POST("/agents/:id/versions/:version/publish", handler.PublishAgentVersion)
+			protected.POST("/agents/:id/versions/:version/deprecate", handler.DeprecateAgentVersion)
+			protected.POST("/agents/:id/versions/:version/rollout", handler.StageAgentVersion)
+			protected.GET("/agents/:id/telemetry", handler.GetAgentTelemetry)
+			protected.GET("/agents/:id/telemetry/series", handler.GetAgentTelemetrySeries)
+			protected.GET("/agents/:id/entitlement-transfers", handler.GetAgentTransfers)
+			protected.GET("/agents/:id/versions/:version/rollout", handler.GetAgentVersionRollout)
+			protected.DELETE("/agents/:id/versions/:version/rollout", handler.HaltAgentVersionRollout)
+			protected.POST("/agents/:id/versions/:version/promote", handler.PromoteAgentVersion)
+			protected.GET("/agents/:id/download", handler.DownloadAgent)
+			protected.GET("/agents/:id/versions/:version/download", handler.DownloadAgentVersion)
+			protected.GET("/agents/:id/versions/:version/compliance-report", handler.GetComplianceReport)
+			protected.PUT("/agents/:id/versions/:version/certifications", handler.SetAgentVersionCertifications)
 
 			// Reviews
 			protected.POST("/agents/:id/reviews", handler.CreateReview)
+			protected.PUT("/reviews/:id", handler.UpdateReview)
+			protected.DELETE("/reviews/:id", handler.DeleteReview)
+			protected.POST("/reviews/:id/reply", handler.ReplyToReview)
+			protected.DELETE("/reviews/:id/reply", handler.DeleteReviewReply)
+			protected.POST("/reviews/:id/vote", handler.VoteReview)
+			protected.POST("/reports", handler.CreateReport)
+			protected.GET("/reviews/:id/attachments", handler.GetReviewAttachments)
+			protected.POST("/reviews/:id/attachments", handler.UploadReviewAttachment)
+			protected.PUT("/reviews/:id/attachments/:attachment_id", handler.UpdateReviewAttachment)
+			protected.DELETE("/reviews/:id/attachments/:attachment_id", handler.DeleteReviewAttachment)
+
+			// Checkout
+			protected.POST("/checkout", handler.StartCheckout)
+			protected.GET("/checkout/:id", handler.GetCheckout)
+			protected.POST("/checkout/:id/complete", handler.CompleteCheckout)
+			protected.GET("/purchases", handler.GetPurchases)
+			protected.GET("/trace/:id", handler.GetTrace)
+			protected.GET("/licenses", handler.GetLicenses)
+			protected.GET("/subscriptions", handler.GetSubscriptions)
+			protected.POST("/subscriptions", handler.Subscribe)
+			protected.POST("/subscriptions/:id/cancel", handler.CancelSubscription)
+			protected.POST("/agents/:id/plans", handler.CreateAgentPlan)
+			protected.DELETE("/agents/:id/plans/:plan_id", handler.RetireAgentPlan)
+			protected.GET("/purchases/:id/receipt", handler.GetPurchaseReceipt)
+			protected.POST("/purchases/:id/refund", handler.RequestRefund)
+
+			// Publisher payouts
+			protected.GET("/payouts", handler.GetPayouts)
+			protected.GET("/payouts/account", handler.GetPayoutAccount)
+			protected.POST("/payouts/account", handler.ConnectPayoutAccount)
+			protected.PUT("/payouts/account", handler.ReplacePayoutAccount)
+
+			// Bundles
+			protected.POST("/bundles", handler.CreateBundle)
+			protected.DELETE("/bundles/:id", handler.DeleteBundle)
+			protected.POST("/bundles/:id/purchase", handler.PurchaseBundle)
+			protected.POST("/bundles/:id/deploy", handler.DeployBundle)
+
+			// Metered deployments and usage invoices
+			protected.GET("/deployments", handler.GetDeployments)
+			protected.POST("/deployments", handler.CreateDeployment)
+			protected.POST("/deployments/:id/checkin", handler.CheckInDeployment)
+			protected.POST("/telemetry", handler.IngestTelemetry)
+			protected.GET("/telemetry/sharing", handler.GetTelemetrySharing)
+			protected.PUT("/telemetry/sharing/:agent_id", handler.SetTelemetrySharing)
+			protected.POST("/deployments/:id/decommission", handler.DecommissionDeployment)
+			protected.POST("/entitlements/:id/transfer", handler.TransferEntitlement)
+			protected.GET("/fleet-rollouts", handler.GetFleetRollouts)
+			protected.GET("/fleet-rollouts/:id", handler.GetFleetRollout)
+			protected.POST("/fleet-rollouts/:id/halt", handler.HaltFleetRollout)
+			protected.GET("/invoices", handler.GetInvoices)
+			protected.GET("/invoices/:id", handler.GetInvoice)
+
+			// Device resources
+			protected.POST("/devices", handler.ClaimDevice)
+			protected.GET("/devices", handler.GetDevices)
+			protected.POST("/devices/import", handler.ImportDevices)
+			protected.GET("/devices/imports/:id", handler.GetDeviceImport)
+			protected.GET("/devices/imports/:id/errors", handler.GetDeviceImportErrors)
+			protected.GET("/devices/:id", handler.GetDevice)
+			protected.PUT("/devices/:id", handler.UpdateDevice)
+			protected.DELETE("/devices/:id", handler.ReleaseDevice)
+			protected.GET("/devices/:id/resources", handler.GetDeviceResources)
+			protected.PUT("/devices/:id/resources", handler.ReportDeviceResources)
+			protected.POST("/devices/:id/budget-check", handler.CheckDeviceBudget)
+			protected.GET("/devices/:id/certificates", handler.GetDeviceCertificates)
+			protected.POST("/devices/:id/certificates", handler.ProvisionDeviceCertificate)
+			protected.DELETE("/devices/:id/certificates/:cert_id", handler.RevokeDeviceCertificate)
+
+			// Custom domains for white-label storefronts
+			protected.GET("/domains", handler.GetDomains)
+			protected.POST("/domains", handler.CreateDomain)
+			protected.PUT("/domains/:id", handler.UpdateDomain)
+			protected.DELETE("/domains/:id", handler.DeleteDomain)
+			protected.POST("/domains/:id/verify", handler.VerifyDomain)
+			protected.PUT("/domains/:id/certificate", handler.UploadDomainCertificate)
+			protected.DELETE("/domains/:id/certificate", handler.DeleteDomainCertificate)
+		}
+
+		// Reseller routes
+		reseller := api.Group("/reseller")
+		reseller.Use(middleware.Auth(authSvc))
+		reseller.Use(middleware.RequireRole(models.UserRoleReseller))
+		{
+			reseller.GET("/seat-pools", handler.GetSeatPools)
+			reseller.POST("/entitlements/bulk", handler.BulkGrantEntitlements)
+			reseller.GET("/reconciliation", handler.GetResellerReconciliation)
 		}
 
 		// Admin routes
 		admin := api.Group("/admin")
-		admin.Use(middleware.Auth(cfg))
+		admin.Use(middleware.Auth(authSvc))
 		admin.Use(middleware.RequireRole(models.UserRoleAdmin))
 		{
 			// Add admin-specific routes here
 			admin.GET("/stats", handler.GetStats)
+			admin.GET("/search", handler.GetSearchStatus)
+			admin.GET("/jobs", handler.GetJobs)
+			admin.POST("/jobs/dead/:id/retry", handler.RetryDeadJobs)
+			admin.POST("/search/reindex", handler.StartSearchReindex)
+			admin.GET("/search/reindex/:id", handler.GetSearchReindex)
+			admin.POST("/search/check", handler.CheckSearchConsistency)
+			admin.GET("/legal-holds", handler.GetLegalHolds)
+			admin.GET("/audit-logs", handler.GetAuditLogs)
+
+			admin.POST("/legal-holds", handler.PlaceLegalHold)
+			admin.POST("/legal-holds/:id/release", handler.ReleaseLegalHold)
+			admin.POST("/devices", handler.ProvisionDevice)
+			admin.GET("/scans", handler.GetScans)
+			admin.GET("/agents/:id/versions/:version/scan", handler.GetScanReport)
+			admin.POST("/agents/:id/versions/:version/scan", handler.RescanBinary)
+			admin.GET("/checkout/stats", handler.GetCheckoutStats)
+
+			// Moderation queue
+			admin.GET("/reports", handler.GetReports)
+			admin.POST("/reports/:id/resolve", handler.ResolveReport)
+
+			// Fraud rules and held purchases
+			admin.GET("/fraud/rules", handler.GetFraudRules)
+			admin.POST("/fraud/rules", handler.CreateFraudRule)
+			admin.PUT("/fraud/rules/:id", handler.UpdateFraudRule)
+			admin.DELETE("/fraud/rules/:id", handler.DeleteFraudRule)
+			admin.GET("/fraud/reviews", handler.GetFraudReviews)
+			admin.POST("/fraud/reviews/:id", handler.ReviewFraudAssessment)
+			admin.POST("/fraud/assessments/:id/outcome", handler.RecordFraudOutcome)
+			admin.GET("/refunds", handler.GetRefundRequests)
+			admin.POST("/refunds/:id", handler.DecideRefund)
 			admin.GET("/users", handler.GetUsers)
 			admin.PUT("/users/:id/status", handler.UpdateUserStatus)
+			admin.PUT("/users/:id/tier", handler.UpdateUserTier)
+			admin.GET("/limits", handler.GetLimitDefaults)
+			admin.GET("/limits/:scope", handler.GetScopeLimits)
+			admin.PUT("/limits/:scope", handler.SetScopeLimits)
+			admin.DELETE("/limits/:scope", handler.ClearScopeLimits)
+			admin.GET("/publisher-applications", handler.GetPublisherApplicationQueue)
+			admin.POST("/publisher-applications/:id", handler.DecidePublisherApplication)
+			admin.POST("/invoices/generate", handler.GenerateInvoices)
+			admin.GET("/api-keys", handler.GetAllAPIKeys)
+			admin.PUT("/api-keys/:id/status", handler.UpdateAPIKeyStatus)
+			admin.GET("/currencies", handler.AdminGetCurrencies)
+			admin.PUT("/currencies/:code", handler.AdminSetCurrency)
+			admin.POST("/currencies/sync", handler.AdminSyncExchangeRates)
+
+			// Account credit
+			admin.POST("/users/:id/credits", handler.GrantCredit)
+			admin.GET("/credit-codes", handler.GetCreditCodes)
+			admin.POST("/credit-codes", handler.CreateCreditCode)
+
+			// Reseller seat pools
+			admin.POST("/seat-pools", handler.CreateSeatPool)
+
+			// Starter templates
+			admin.POST("/templates", handler.CreateTemplate)
+			admin.PUT("/templates/:id", handler.UpdateTemplate)
+			admin.DELETE("/templates/:id", handler.DeleteTemplate)
+			admin.POST("/templates/:id/versions", handler.UploadTemplateVersion)
+			admin.GET("/templates/:id/stats", handler.GetTemplateStats)
+
+			// Storefront curation
+			admin.GET("/curation/rules", handler.GetCurationRules)
+			admin.POST("/curation/rules", handler.CreateCurationRule)
+			admin.PUT("/curation/rules/:id", handler.UpdateCurationRule)
+			admin.DELETE("/curation/rules/:id", handler.DeleteCurationRule)
+			admin.POST("/curation/preview", handler.PreviewCuration)
+			admin.POST("/curation/run", handler.RunCuration)
+			admin.PUT("/featured/:slot", handler.SetFeaturedPins)
+			admin.GET("/ranking", handler.GetRankingWeights)
+			admin.PUT("/ranking", handler.SetRankingWeights)
+			admin.DELETE("/ranking", handler.ResetRankingWeights)
+
+			// Platform changelog
+			admin.GET("/platform/changelog", handler.GetAdminChangelog)
+			admin.POST("/platform/changelog", handler.CreateChangelogEntry)
+			admin.PUT("/platform/changelog/:id", handler.UpdateChangelogEntry)
+			admin.POST("/platform/changelog/:id/publish", handler.PublishChangelogEntry)
+			admin.DELETE("/platform/changelog/:id", handler.DeleteChangelogEntry)
+		}
+	}
+
+	// Device API, authenticated with device certificates rather than users.
+	// Check-ins and telemetry are journaled while the database is down.
+	if cfg.DeviceAPI.Enabled {
+		device := router.Group("/device/v1")
+		{
+			device.POST("/checkin", middleware.DeviceAuth(deviceCertSvc, deviceJournal), handler.DeviceCheckIn)
+			device.POST("/certificate", middleware.DeviceAuth(deviceCertSvc, nil), handler.RotateDeviceCertificate)
+			device.POST("/telemetry", middleware.DeviceAuth(deviceCertSvc, deviceJournal), handler.DeviceTelemetry)
 		}
 	}
 
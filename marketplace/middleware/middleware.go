@@ -2,7 +2,10 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,42 +19,99 @@ import (
 	"github.com/edgeplug/marketplace/services"
 )
 
-// Auth middleware validates JWT tokens and sets user context
-func Auth(cfg *config.Config) gin.HandlerFunc {
-	authService := services.NewAuthService(cfg, nil) // We'll set the DB later
-
+// Auth middleware validates JWT tokens, checks that their user is still
+// active and sets user context
+func Auth(authService *services.AuthService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
+		if c.GetHeader("Authorization") == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
 			c.Abort()
 			return
 		}
+		if authenticate(c, authService) {
+			c.Next()
+		}
+	}
+}
 
-		// Check if it's a Bearer token
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header format"})
-			c.Abort()
+// OptionalAuth middleware sets the user context like Auth when a token is
+// given, and lets requests without one through anonymously. A token that
+// is given but invalid is still rejected.
+func OptionalAuth(authService *services.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "" && !authenticate(c, authService) {
 			return
 		}
+		c.Next()
+	}
+}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+// IdentifyUser middleware sets the user context when a request carries a
+// valid token, so that RateLimit can count it against its user. Unlike
+// OptionalAuth it never rejects a request; routes that need a user still
+// run Auth, which reports why a token was not accepted.
+func IdentifyUser(authService *services.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if strings.HasPrefix(authHeader, "Bearer ") {
+			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+			if claims, err := authService.Authenticate(c.Request.Context(), tokenString); err == nil {
+				setUserContext(c, claims)
+			}
+		}
+		c.Next()
+	}
+}
 
-		// Validate token
-		claims, err := authService.ValidateToken(tokenString)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+// authenticate validates the bearer token of a request and sets the user
+// context. It writes the error response and aborts if the token is not
+// valid. A request already identified by IdentifyUser is not checked
+// again.
+func authenticate(c *gin.Context, authService *services.AuthService) bool {
+	if _, exists := c.Get("claims"); exists {
+		return true
+	}
+
+	authHeader := c.GetHeader("Authorization")
+
+	// Check if it's a Bearer token
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header format"})
+		c.Abort()
+		return false
+	}
+
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+
+	// Validate token and check that it was not revoked
+	claims, err := authService.Authenticate(c.Request.Context(), tokenString)
+	if err != nil {
+		if errors.Is(err, services.ErrRedisUnavailable) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable"})
 			c.Abort()
-			return
+			return false
 		}
+		if err == services.ErrUserInactive {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Account is not active"})
+			c.Abort()
+			return false
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return false
+	}
 
-		// Set user context
-		c.Set("user_id", claims.UserID)
-		c.Set("user_email", claims.Email)
-		c.Set("user_role", claims.Role)
+	setUserContext(c, claims)
+	return true
+}
 
-		c.Next()
-	}
+// setUserContext stores the claims of an authenticated request
+func setUserContext(c *gin.Context, claims *services.Claims) {
+	c.Set("claims", claims)
+	c.Set("user_id", claims.UserID)
+	c.Set("user_email", claims.Email)
+	c.Set("user_role", claims.Role)
+	c.Set("user_tier", claims.Tier)
 }
 
 // RequireRole middleware checks if user has required role
@@ -75,29 +135,264 @@ func RequireRole(requiredRole models.UserRole) gin.HandlerFunc {
 	}
 }
 
-// Logger middleware logs HTTP requests
-func Logger() gin.HandlerFunc {
+// TierRateLimit middleware enforces the per-minute API request limit of the
+// user's publisher tier. It must run after Auth.
+func TierRateLimit(tiers *services.TierService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, exists := c.Get("user_id")
+		if !exists {
+			c.Next()
+			return
+		}
+
+		tier := models.PublisherTier(c.GetString("user_tier"))
+		if !tiers.AllowRequest(userID.(uuid.UUID), tier) {
+			c.Header("Retry-After", strconv.Itoa(60-time.Now().Second()))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "API request limit of your plan exceeded"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// APIKeyAuth middleware authenticates public API requests by their
+// X-API-Key header and enforces the key's quotas. Responses carry the
+// X-RateLimit-* headers of the quota closest to running out, and a Warning
+// header while a key in grace mode is over its limits.
+func APIKeyAuth(keys *services.APIKeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret := c.GetHeader("X-API-Key")
+		if secret == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "X-API-Key header required"})
+			c.Abort()
+			return
+		}
+
+		key, quota, err := keys.Authorize(secret)
+		if quota != nil {
+			c.Header("X-RateLimit-Limit", strconv.FormatInt(quota.Limit, 10))
+			c.Header("X-RateLimit-Remaining", strconv.FormatInt(quota.Remaining, 10))
+			c.Header("X-RateLimit-Reset", strconv.FormatInt(quota.Reset.Unix(), 10))
+			if err == nil && quota.Grace {
+				c.Header("Warning", `299 - "API key is over its limits; requests are let through in grace mode"`)
+			}
+		}
+		switch err {
+		case nil:
+		case services.ErrInvalidAPIKey:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		case services.ErrAPIKeySuspended:
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		case services.ErrAPIRateLimited:
+			c.Header("Retry-After", strconv.Itoa(60-time.Now().Second()))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		case services.ErrAPIQuotaExceeded:
+			now := time.Now().UTC()
+			reset := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+			c.Header("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		default:
+			log.Error().Err(err).Msg("Failed to authorize API key")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			c.Abort()
+			return
+		}
+
+		c.Set("api_key_id", key.ID)
+		c.Next()
+	}
+}
+
+// ServiceAccountAuth middleware authenticates reporting requests by a
+// service account's bearer key or signed JWT. It only lets reads through.
+// Handlers see the account's owner as the user, so they return the owner's
+// data, and the account itself as service_account.
+func ServiceAccountAuth(accounts *services.ServiceAccountService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Service accounts are read-only"})
+			c.Abort()
+			return
+		}
+
+		authHeader := c.GetHeader("Authorization")
+		if !strings.HasPrefix(authHeader, "Bearer ") {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header with a service account key or signed JWT required"})
+			c.Abort()
+			return
+		}
+
+		account, owner, err := accounts.Authenticate(strings.TrimPrefix(authHeader, "Bearer "))
+		switch err {
+		case nil:
+		case services.ErrInvalidServiceAccount:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		case services.ErrUserInactive:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Account is not active"})
+			c.Abort()
+			return
+		default:
+			log.Error().Err(err).Msg("Failed to authenticate service account")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			c.Abort()
+			return
+		}
+
+		c.Set("service_account", account)
+		c.Set("user_id", owner.ID)
+		c.Set("user_role", string(owner.Role))
+		c.Set("user_tier", string(owner.Tier))
+		c.Next()
+	}
+}
+
+// RequireScope middleware rejects service accounts without a scope. It must
+// run after ServiceAccountAuth.
+func RequireScope(scope models.ServiceAccountScope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		account, exists := c.Get("service_account")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+		if !services.HasScope(account.(*models.ServiceAccount), scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Service account lacks the " + string(scope) + " scope"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// DeviceAuth middleware authenticates device API requests by their client
+// certificate and sets the certificate, with its device, in the context.
+// With a journal, a certificate signed by the device CA is let through
+// while the database is down, with only its fingerprint in the context.
+func DeviceAuth(certs *services.DeviceCertService, journal *services.DeviceJournal) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cert, err := certs.ClientCertificate(c.Request)
+		if err == nil {
+			var record *models.DeviceCertificate
+			record, err = certs.Authenticate(cert)
+			if err == nil {
+				c.Set("device_cert", record)
+				c.Next()
+				return
+			}
+		}
+
+		switch err {
+		case services.ErrNoDeviceCert, services.ErrInvalidDeviceCert:
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		case services.ErrDeviceAPIDisabled:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			if journal != nil && journal.Accepts(err) {
+				c.Set("device_fingerprint", certs.Fingerprint(cert))
+				c.Next()
+				return
+			}
+			log.Error().Err(err).Msg("Failed to authenticate device")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		}
+		c.Abort()
+	}
+}
+
+// CustomDomain middleware resolves requests made on a publisher's verified
+// custom domain, storing the domain in the context for tenant scoping and
+// branding
+func CustomDomain(domains *services.DomainService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if domain := domains.Resolve(c.Request.Host); domain != nil {
+			c.Set("custom_domain", domain)
+		}
+		c.Next()
+	}
+}
+
+// ReadOnlyReplica middleware redirects write requests to the primary region
+// while the instance runs as a standby replica
+func ReadOnlyReplica(replication *services.ReplicationService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		if !replication.IsReadOnly() {
+			c.Next()
+			return
+		}
+
+		// 307 preserves the method and body so clients can replay the write
+		c.Header("Location", strings.TrimSuffix(replication.PrimaryURL(), "/")+c.Request.URL.RequestURI())
+		c.JSON(http.StatusTemporaryRedirect, gin.H{"error": "This instance is a read-only replica, writes must go to the primary region"})
+		c.Abort()
+	}
+}
+
+// Logger middleware logs HTTP requests, keeping the share of them the
+// sampler gives for their route group, tenant and outcome. Sampled entries
+// carry their sample_rate so that counts can be scaled back up.
+func Logger(sampler *services.LogSampler) gin.HandlerFunc {
 	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
-		log.Info().
+		rate := sampler.Rate(param.Request.URL.Path, requestTenant(param.Keys), param.StatusCode >= http.StatusBadRequest)
+		if rate < 1 && rand.Float64() >= rate {
+			return ""
+		}
+
+		event := log.Info().
 			Str("method", param.Method).
 			Str("path", param.Path).
 			Int("status", param.StatusCode).
 			Dur("latency", param.Latency).
 			Str("client_ip", param.ClientIP).
-			Str("user_agent", param.Request.UserAgent()).
-			Msg("HTTP Request")
+			Str("user_agent", param.Request.UserAgent())
+		if rate < 1 {
+			event = event.Float64("sample_rate", rate)
+		}
+		event.Msg("HTTP Request")
 		return ""
 	})
 }
 
+// requestTenant returns the publisher a request was made for, on their
+// custom domain, or by, as the signed-in user
+func requestTenant(keys map[string]interface{}) string {
+	if domain, ok := keys["custom_domain"].(*models.CustomDomain); ok {
+		return domain.PublisherID.String()
+	}
+	if userID, ok := keys["user_id"].(uuid.UUID); ok {
+		return userID.String()
+	}
+	return ""
+}
+
 // CORS middleware configures CORS headers
-func CORS(origins []string) gin.HandlerFunc {
+func CORS(origins []string, allowOrigin func(origin string) bool) gin.HandlerFunc {
 	config := cors.DefaultConfig()
 
 	if len(origins) == 0 || (len(origins) == 1 && origins[0] == "*") {
 		config.AllowAllOrigins = true
 	} else {
 		config.AllowOrigins = origins
+		// Checked for origins not in the list, e.g. custom domains
+		config.AllowOriginFunc = allowOrigin
 	}
 
 	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
@@ -108,11 +403,40 @@ func CORS(origins []string) gin.HandlerFunc {
 	return cors.New(config)
 }
 
-// RateLimit middleware for rate limiting
-func RateLimit(limiter interface{}) gin.HandlerFunc {
+// RateLimit middleware limits requests per user when IdentifyUser has
+// found one, and per client IP otherwise. Routes listed in the security config's
+// rate_limit_routes have their own budget; all others share the default.
+func RateLimit(limiter *services.RateLimiter, cfg config.SecurityConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Simple rate limiting implementation
-		// In a production environment, you would use a proper rate limiting library
+		bucket := "default"
+		requests, window := cfg.RateLimitRequests, cfg.RateLimitWindow
+		if route, ok := cfg.RateLimitRoutes[c.FullPath()]; ok {
+			bucket = c.FullPath()
+			requests, window = route.Requests, route.Window
+		}
+
+		subject := "ip:" + c.ClientIP()
+		if userID, exists := c.Get("user_id"); exists {
+			subject = "user:" + userID.(uuid.UUID).String()
+		}
+
+		result, err := limiter.Allow(c.Request.Context(), bucket+":"+subject, requests, window)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable"})
+			c.Abort()
+			return
+		}
+
+		c.Header("X-RateLimit-Limit", strconv.Itoa(requests))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		if !result.Allowed {
+			retryAfter := int((result.RetryAfter + time.Second - 1) / time.Second)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+			c.Abort()
+			return
+		}
+
 		c.Next()
 	}
 }
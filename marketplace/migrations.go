@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// dataMigration converts existing data that AutoMigrate cannot handle on its
+// own. Each migration must be idempotent since they run on every startup.
+type dataMigration struct {
+	name string
+	run  func(db *gorm.DB) error
+}
+
+// dataMigrations run in order before AutoMigrate
+var dataMigrations = []dataMigration{
+	{name: "uuid_v7_function", run: createUUIDv7Function},
+	{name: "agent_tags_to_json", run: migrateAgentTagsToJSON},
+	{name: "money_to_minor_units", run: migrateMoneyToMinorUnits},
+	{name: "agent_versions_backfill", run: migrateAgentVersions},
+	{name: "agent_version_scan_status", run: migrateScanStatus},
+	{name: "trace_ids_backfill", run: migrateTraceIDs},
+}
+
+// runDataMigrations applies all data migrations
+func runDataMigrations(db *gorm.DB) error {
+	for _, m := range dataMigrations {
+		if err := m.run(db); err != nil {
+			return fmt.Errorf("data migration %s failed: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+// recordDataMigrations notes the data migrations in schema_migrations once
+// they have run, keeping when each was first applied
+func recordDataMigrations(db *gorm.DB) error {
+	now := time.Now()
+	applied := make([]models.SchemaMigration, len(dataMigrations))
+	for i, m := range dataMigrations {
+		applied[i] = models.SchemaMigration{Version: i + 1, Name: m.name, AppliedAt: now}
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&applied).Error
+}
+
+// createUUIDv7Function defines uuid_v7(), the SQL counterpart of
+// models.NewID for rows inserted by migrations and triggers. It turns a
+// random v4 UUID into a v7 one by writing the Unix milliseconds over its
+// first 48 bits and setting the version to 7.
+func createUUIDv7Function(db *gorm.DB) error {
+	if db.Dialector.Name() != "postgres" {
+		return nil
+	}
+	return db.Exec(`CREATE OR REPLACE FUNCTION uuid_v7() RETURNS uuid AS $$
+		SELECT encode(
+			set_bit(set_bit(
+				overlay(uuid_send(gen_random_uuid())
+					PLACING substring(int8send(floor(extract(epoch FROM clock_timestamp()) * 1000)::bigint) FROM 3)
+					FROM 1 FOR 6),
+				52, 1), 53, 1),
+			'hex')::uuid
+		$$ LANGUAGE sql VOLATILE`).Error
+}
+
+// migrateAgentTagsToJSON converts the Postgres text[] tags column to the
+// portable JSON text representation. array_to_json leaves <, >, & and the
+// Unicode line separators as they are, unlike the json.Marshal behind
+// models.Tags and TagFilter, so tags holding them are encoded again in Go.
+func migrateAgentTagsToJSON(db *gorm.DB) error {
+	if db.Dialector.Name() != "postgres" {
+		return nil
+	}
+
+	var dataType string
+	if err := db.Raw(`SELECT data_type FROM information_schema.columns
+		WHERE table_schema = CURRENT_SCHEMA() AND table_name = 'agents' AND column_name = 'tags'`).
+		Scan(&dataType).Error; err != nil {
+		return err
+	}
+	if dataType != "ARRAY" {
+		return nil
+	}
+
+	log.Info().Msg("Converting agent tags from text[] to JSON")
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`ALTER TABLE agents ALTER COLUMN tags TYPE text
+			USING COALESCE(array_to_json(tags)::text, '[]')`).Error; err != nil {
+			return err
+		}
+
+		var agents []models.Agent
+		if err := tx.Unscoped().Select("id", "tags").Where(`tags ~ '[<>&\u2028\u2029]'`).Find(&agents).Error; err != nil {
+			return err
+		}
+		for _, agent := range agents {
+			if err := tx.Unscoped().Model(&models.Agent{}).Where("id = ?", agent.ID).UpdateColumn("tags", agent.Tags).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// migrateMoneyToMinorUnits replaces the float amount columns with integer
+// minor-unit columns, scaling each row by its currency's exponent
+func migrateMoneyToMinorUnits(db *gorm.DB) error {
+	columns := []struct {
+		model     interface{}
+		table     string
+		field     string
+		oldColumn string
+		newColumn string
+	}{
+		{&models.Agent{}, "agents", "Price", "price", "price_minor"},
+		{&models.Purchase{}, "purchases", "Amount", "amount", "amount_minor"},
+		{&models.Transaction{}, "transactions", "Amount", "amount", "amount_minor"},
+	}
+
+	for _, col := range columns {
+		migrator := db.Migrator()
+		if !migrator.HasTable(col.model) || !migrator.HasColumn(col.model, col.oldColumn) {
+			continue
+		}
+
+		log.Info().Str("table", col.table).Msgf("Converting %s to minor units", col.oldColumn)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(col.model, col.newColumn) {
+				if err := tx.Migrator().AddColumn(col.model, col.field); err != nil {
+					return err
+				}
+			}
+			update := fmt.Sprintf("UPDATE %s SET %s = ROUND(%s * %s)",
+				col.table, col.newColumn, col.oldColumn, minorUnitScaleSQL())
+			if err := tx.Exec(update).Error; err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(col.model, col.oldColumn)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to convert %s.%s: %w", col.table, col.oldColumn, err)
+		}
+	}
+	return nil
+}
+
+// minorUnitScaleSQL returns a CASE expression giving 10^exponent for the
+// row's currency column
+func minorUnitScaleSQL() string {
+	currencies := make([]string, 0, len(models.CurrencyExponents))
+	for currency := range models.CurrencyExponents {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	var b strings.Builder
+	b.WriteString("CASE UPPER(currency)")
+	for _, currency := range currencies {
+		scale := 1
+		for i := 0; i < models.CurrencyExponents[currency]; i++ {
+			scale *= 10
+		}
+		fmt.Fprintf(&b, " WHEN '%s' THEN %d", currency, scale)
+	}
+	b.WriteString(" ELSE 100 END")
+	return b.String()
+}
+
+// migrateAgentVersions creates a release for the current version of every
+// agent that predates versioned releases
+func migrateAgentVersions(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&models.Agent{}) {
+		return nil
+	}
+	if err := db.AutoMigrate(&models.AgentVersion{}); err != nil {
+		return err
+	}
+
+	result := db.Exec(`INSERT INTO agent_versions
+		(id, agent_id, version, binary_url, manifest_url, flash_size, sram_size, max_latency, status, published_at, created_at)
+		SELECT uuid_v7(), a.id, a.version, a.binary_url, a.manifest_url, a.flash_size, a.sram_size, a.max_latency,
+			CASE WHEN a.status = ? THEN ? ELSE ? END, a.published_at, a.created_at
+		FROM agents a
+		WHERE NOT EXISTS (SELECT 1 FROM agent_versions v WHERE v.agent_id = a.id AND v.version = a.version)`,
+		models.AgentStatusPublished, models.AgentVersionStatusPublished, models.AgentVersionStatusDraft)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Info().Int64("count", result.RowsAffected).Msg("Backfilled agent versions")
+	}
+	return nil
+}
+
+// migrateScanStatus adds the scan status of releases. Releases that were
+// already out are not scanned retroactively; drafts are queued for a scan.
+func migrateScanStatus(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&models.AgentVersion{}) || db.Migrator().HasColumn(&models.AgentVersion{}, "scan_status") {
+		return nil
+	}
+	if err := db.AutoMigrate(&models.AgentVersion{}); err != nil {
+		return err
+	}
+	return db.Model(&models.AgentVersion{}).
+		Where("status <> ?", models.AgentVersionStatusDraft).
+		Update("scan_status", models.ScanStatusSkipped).Error
+}
+
+// migrateTraceIDs gives purchases and deployments made before trace IDs
+// their own ID as trace ID, so that AutoMigrate can require the column
+func migrateTraceIDs(db *gorm.DB) error {
+	tables := []struct {
+		model interface{}
+		table string
+	}{
+		{&models.Purchase{}, "purchases"},
+		{&models.Deployment{}, "deployments"},
+	}
+
+	for _, t := range tables {
+		migrator := db.Migrator()
+		if !migrator.HasTable(t.model) || migrator.HasColumn(t.model, "trace_id") {
+			continue
+		}
+
+		log.Info().Str("table", t.table).Msg("Backfilling trace IDs")
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN trace_id uuid", t.table)).Error; err != nil {
+				return err
+			}
+			return tx.Exec(fmt.Sprintf("UPDATE %s SET trace_id = id", t.table)).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncSearchOutbox installs the triggers that queue agent changes in the
+// search outbox when an external index is enabled, and removes them
+// otherwise so the outbox does not grow unread. Downloads are counted
+// without touching updated_at and so are not queued.
+func syncSearchOutbox(db *gorm.DB, enabled bool) error {
+	if db.Dialector.Name() != "postgres" {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`DROP TRIGGER IF EXISTS agents_search_outbox ON agents`).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DROP TRIGGER IF EXISTS agents_search_outbox_update ON agents`).Error; err != nil {
+			return err
+		}
+		if !enabled {
+			return nil
+		}
+
+		if err := tx.Exec(`CREATE OR REPLACE FUNCTION queue_agent_search() RETURNS trigger AS $$
+			BEGIN
+				INSERT INTO search_outbox_entries (agent_id, attempts, next_attempt_at, created_at)
+				VALUES (CASE WHEN TG_OP = 'DELETE' THEN OLD.id ELSE NEW.id END, 0, now(), now());
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql`).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`CREATE TRIGGER agents_search_outbox AFTER INSERT OR DELETE ON agents
+			FOR EACH ROW EXECUTE FUNCTION queue_agent_search()`).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`CREATE TRIGGER agents_search_outbox_update AFTER UPDATE ON agents
+			FOR EACH ROW WHEN (OLD.updated_at IS DISTINCT FROM NEW.updated_at OR OLD.deleted_at IS DISTINCT FROM NEW.deleted_at)
+			EXECUTE FUNCTION queue_agent_search()`).Error
+	})
+}
+
+// syncSEONotifications installs the triggers that notify every instance
+// when a published agent changes, or an agent is published or withdrawn, so
+// the cached sitemap and structured data are rendered again
+func syncSEONotifications(db *gorm.DB, channel string) error {
+	if db.Dialector.Name() != "postgres" {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`DROP TRIGGER IF EXISTS agents_seo ON agents`).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DROP TRIGGER IF EXISTS agents_seo_update ON agents`).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Exec(fmt.Sprintf(`CREATE OR REPLACE FUNCTION notify_seo() RETURNS trigger AS $$
+			BEGIN
+				PERFORM pg_notify('%s', NEW.id::text);
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql`, strings.ReplaceAll(channel, "'", "''"))).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`CREATE TRIGGER agents_seo AFTER INSERT ON agents
+			FOR EACH ROW WHEN (NEW.status = 'published')
+			EXECUTE FUNCTION notify_seo()`).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`CREATE TRIGGER agents_seo_update AFTER UPDATE ON agents
+			FOR EACH ROW WHEN ((OLD.status = 'published' OR NEW.status = 'published')
+				AND (OLD.status IS DISTINCT FROM NEW.status OR OLD.updated_at IS DISTINCT FROM NEW.updated_at
+					OR OLD.deleted_at IS DISTINCT FROM NEW.deleted_at))
+			EXECUTE FUNCTION notify_seo()`).Error
+	})
+}
+
+// currencyNames names the currencies commonly configured as supported
+var currencyNames = map[string]string{
+	"AUD": "Australian Dollar",
+	"CAD": "Canadian Dollar",
+	"CHF": "Swiss Franc",
+	"EUR": "Euro",
+	"GBP": "Pound Sterling",
+	"JPY": "Japanese Yen",
+	"USD": "US Dollar",
+}
+
+// seedCurrencies adds the configured currencies to the supported-currency
+// table. Currencies already there are left alone, so ones an admin disabled
+// stay disabled.
+func seedCurrencies(db *gorm.DB, codes []string) error {
+	if len(codes) == 0 {
+		return nil
+	}
+	currencies := make([]models.Currency, len(codes))
+	for i, code := range codes {
+		code = models.NormalizeCurrency(code)
+		name := currencyNames[code]
+		if name == "" {
+			name = code
+		}
+		currencies[i] = models.Currency{Code: code, Name: name, Enabled: true}
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&currencies).Error
+}
+
+// createTelemetryTable creates telemetry_samples, which AutoMigrate cannot
+// partition. On Postgres it is partitioned by day, the partitions being
+// managed by the telemetry service, or made a TimescaleDB hypertable with a
+// retention policy.
+func createTelemetryTable(db *gorm.DB, cfg config.TelemetryConfig) error {
+	if db.Dialector.Name() != "postgres" {
+		return db.AutoMigrate(&models.TelemetrySample{})
+	}
+
+	partitioning := " PARTITION BY RANGE (recorded_at)"
+	if cfg.TimescaleDB {
+		partitioning = ""
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`CREATE TABLE IF NOT EXISTS telemetry_samples (
+			deployment_id uuid NOT NULL,
+			agent_id uuid NOT NULL,
+			version text NOT NULL,
+			recorded_at timestamptz NOT NULL,
+			inference_latency integer,
+			trip_events integer NOT NULL DEFAULT 0,
+			memory_used bigint,
+			received_at timestamptz NOT NULL
+		)` + partitioning).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`CREATE INDEX IF NOT EXISTS idx_telemetry_agent
+			ON telemetry_samples (agent_id, version, recorded_at)`).Error; err != nil {
+			return err
+		}
+		if !cfg.TimescaleDB {
+			return nil
+		}
+
+		if err := tx.Exec(`CREATE EXTENSION IF NOT EXISTS timescaledb`).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`SELECT create_hypertable('telemetry_samples', 'recorded_at',
+			chunk_time_interval => INTERVAL '1 day', if_not_exists => TRUE)`).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`SELECT remove_retention_policy('telemetry_samples', if_exists => TRUE)`).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`SELECT add_retention_policy('telemetry_samples', ?::interval)`,
+			fmt.Sprintf("%d seconds", int64(cfg.Retention.Seconds()))).Error
+	})
+}
+
+// agentHistoryColumns are the listing columns copied into agent_histories.
+// A change to any of them closes the current history row and opens a new
+// one.
+var agentHistoryColumns = []string{
+	"name", "description", "version", "publisher_id", "organization_id", "category", "tags",
+	"price_minor", "currency", "pricing_model", "status", "flash_size", "sram_size",
+	"max_latency", "safety_level", "binary_checksum", "default_locale",
+}
+
+// syncAgentHistory installs the triggers that record every change to an
+// agent's listing in agent_histories, and opens a history row for agents
+// that predate them. Deleting an agent closes its last row.
+func syncAgentHistory(db *gorm.DB) error {
+	if db.Dialector.Name() != "postgres" {
+		return nil
+	}
+
+	columns := strings.Join(agentHistoryColumns, ", ")
+	values := "NEW." + strings.Join(agentHistoryColumns, ", NEW.")
+	old := "OLD." + strings.Join(agentHistoryColumns, ", OLD.")
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`DROP TRIGGER IF EXISTS agents_history ON agents`).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DROP TRIGGER IF EXISTS agents_history_update ON agents`).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Exec(fmt.Sprintf(`CREATE OR REPLACE FUNCTION record_agent_history() RETURNS trigger AS $$
+			BEGIN
+				UPDATE agent_histories SET valid_to = now() WHERE agent_id = NEW.id AND valid_to IS NULL;
+				IF NEW.deleted_at IS NULL THEN
+					INSERT INTO agent_histories (id, agent_id, %s, valid_from)
+					VALUES (uuid_v7(), NEW.id, %s, now());
+				END IF;
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql`, columns, values)).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`CREATE TRIGGER agents_history AFTER INSERT ON agents
+			FOR EACH ROW EXECUTE FUNCTION record_agent_history()`).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(fmt.Sprintf(`CREATE TRIGGER agents_history_update AFTER UPDATE ON agents
+			FOR EACH ROW WHEN ((%s, OLD.deleted_at) IS DISTINCT FROM (%s, NEW.deleted_at))
+			EXECUTE FUNCTION record_agent_history()`, old, values)).Error; err != nil {
+			return err
+		}
+
+		// History of older agents starts with their state at their last update
+		result := tx.Exec(fmt.Sprintf(`INSERT INTO agent_histories (id, agent_id, %s, valid_from)
+			SELECT uuid_v7(), a.id, a.%s, a.updated_at FROM agents a
+			WHERE a.deleted_at IS NULL AND NOT EXISTS (SELECT 1 FROM agent_histories h WHERE h.agent_id = a.id)`,
+			columns, strings.Join(agentHistoryColumns, ", a.")))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			log.Info().Int64("count", result.RowsAffected).Msg("Backfilled agent history")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ArtifactForm is how a release's binary is packaged for download
+type ArtifactForm string
+
+const (
+	ArtifactFormFull       ArtifactForm = "full"       // the binary as uploaded
+	ArtifactFormCompressed ArtifactForm = "compressed" // the binary gzipped
+	ArtifactFormDelta      ArtifactForm = "delta"      // the changes from an older release of the agent
+)
+
+// ArtifactStatus is whether an artifact can be served
+type ArtifactStatus string
+
+const (
+	ArtifactStatusPending   ArtifactStatus = "pending" // being built
+	ArtifactStatusReady     ArtifactStatus = "ready"
+	ArtifactStatusDiscarded ArtifactStatus = "discarded" // not small enough to be worth serving, or could not be built
+)
+
+// ReleaseArtifact is a form of a release's binary built for devices on slow
+// or metered links. Binaries don't change once a release leaves draft, so
+// artifacts are only built for released versions and never go stale.
+type ReleaseArtifact struct {
+	ID          uuid.UUID      `gorm:"type:uuid;primary_key" json:"id"`
+	ReleaseID   uuid.UUID      `gorm:"type:uuid;not null;uniqueIndex:idx_release_artifact" json:"release_id"`
+	Form        ArtifactForm   `gorm:"type:varchar(20);not null;uniqueIndex:idx_release_artifact" json:"form"`
+	BaseVersion string         `gorm:"not null;default:'';uniqueIndex:idx_release_artifact" json:"base_version,omitempty"` // the release a delta applies to
+	Status      ArtifactStatus `gorm:"type:varchar(20);not null;default:'pending'" json:"status"`
+	Size        int64          `json:"size"`     // in bytes
+	Checksum    string         `json:"checksum"` // hex SHA-256 of the artifact
+	Error       string         `json:"error,omitempty"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+}
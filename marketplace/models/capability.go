@@ -0,0 +1,74 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// CapabilitySchemaVersion is the version of the capability descriptor schema
+// that new descriptors are validated against
+const CapabilitySchemaVersion = 1
+
+// CapabilityDescriptor is the machine-readable description of what an agent
+// version consumes, produces and controls, and how it fails
+type CapabilityDescriptor struct {
+	Inputs         []CapabilitySignal `json:"inputs"`
+	Outputs        []CapabilitySignal `json:"outputs"`
+	ActuationTypes []string           `json:"actuation_types"`
+	FailureModes   []FailureMode      `json:"failure_modes"`
+	Accessibility  []string           `json:"accessibility,omitempty"` // e.g. "screen_reader_labels", "high_contrast_ui"
+}
+
+// CapabilitySignal is a signal an agent reads or writes
+type CapabilitySignal struct {
+	Name        string `json:"name"` // snake_case identifier, e.g. "trip_signal"
+	Type        string `json:"type"` // digital, analog, waveform, event or counter
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// FailureMode describes how an agent fails and the state it leaves its outputs in
+type FailureMode struct {
+	Name        string `json:"name"`
+	SafeState   string `json:"safe_state"` // hold, de_energize, trip or last_value
+	Description string `json:"description,omitempty"`
+}
+
+// Value implements driver.Valuer
+func (d CapabilityDescriptor) Value() (driver.Value, error) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (d *CapabilityDescriptor) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*d = CapabilityDescriptor{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, d)
+	case string:
+		return json.Unmarshal([]byte(v), d)
+	default:
+		return fmt.Errorf("unsupported capability descriptor value %T", value)
+	}
+}
+
+// CapabilityFilter returns a WHERE clause and arguments matching agents
+// whose current version has a capability. The term is "kind:name", e.g.
+// "output:trip_signal", or a bare name to match any kind.
+func CapabilityFilter(term string) (string, []interface{}) {
+	kind, name, found := strings.Cut(term, ":")
+	if !found {
+		return "id IN (SELECT agent_id FROM agent_capability_terms WHERE agent_capability_terms.version = agents.version AND name = ?)",
+			[]interface{}{kind}
+	}
+	return "id IN (SELECT agent_id FROM agent_capability_terms WHERE agent_capability_terms.version = agents.version AND kind = ? AND name = ?)",
+		[]interface{}{kind, name}
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SBOMSummary is what the marketplace keeps of a release's software bill of
+// materials: its components and their licenses
+type SBOMSummary struct {
+	Format       string          `json:"format"` // e.g. "CycloneDX 1.5"
+	SerialNumber string          `json:"serial_number,omitempty"`
+	Components   []SBOMComponent `json:"components"`
+	Licenses     []string        `json:"licenses"` // of all components, sorted
+	UploadedAt   time.Time       `json:"uploaded_at"`
+}
+
+// SBOMComponent is a library or other component the release is built from
+type SBOMComponent struct {
+	Name     string   `json:"name"`
+	Version  string   `json:"version,omitempty"`
+	Type     string   `json:"type,omitempty"` // e.g. library, firmware
+	PURL     string   `json:"purl,omitempty"`
+	Licenses []string `json:"licenses,omitempty"` // SPDX IDs or expressions
+}
+
+// Certification is evidence that a release was certified against a
+// standard, e.g. an IEC 61508 SIL 2 certificate
+type Certification struct {
+	Standard      string     `json:"standard" binding:"required,max=100"`
+	Level         string     `json:"level,omitempty" binding:"max=50"`
+	Issuer        string     `json:"issuer" binding:"required,max=200"`
+	CertificateID string     `json:"certificate_id,omitempty" binding:"max=100"`
+	EvidenceURL   string     `json:"evidence_url,omitempty" binding:"omitempty,url"`
+	IssuedAt      *time.Time `json:"issued_at,omitempty"`
+	ValidUntil    *time.Time `json:"valid_until,omitempty"`
+}
+
+// Certifications are a release's certifications, stored as a JSON array in
+// a text column
+type Certifications []Certification
+
+// Value implements driver.Valuer
+func (s SBOMSummary) Value() (driver.Value, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (s *SBOMSummary) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*s = SBOMSummary{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	default:
+		return fmt.Errorf("unsupported SBOM summary value %T", value)
+	}
+}
+
+// Value implements driver.Valuer
+func (c Certifications) Value() (driver.Value, error) {
+	if c == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]Certification(c))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (c *Certifications) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*c = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, c)
+	case string:
+		return json.Unmarshal([]byte(v), c)
+	default:
+		return fmt.Errorf("unsupported certifications value %T", value)
+	}
+}
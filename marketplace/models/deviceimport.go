@@ -0,0 +1,82 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DeviceImportStatus is the state of a CSV device import
+type DeviceImportStatus string
+
+const (
+	DeviceImportStatusPending    DeviceImportStatus = "pending"
+	DeviceImportStatusProcessing DeviceImportStatus = "processing"
+	DeviceImportStatusCompleted  DeviceImportStatus = "completed"
+	DeviceImportStatusFailed     DeviceImportStatus = "failed" // the file itself could not be read
+	DeviceImportStatusCanceled   DeviceImportStatus = "canceled"
+)
+
+// DeviceImport is a CSV file of devices a user uploaded to add to their
+// fleet, processed in the background. Rows are imported one by one; those
+// that fail are listed in Errors and do not stop the rest.
+type DeviceImport struct {
+	ID          uuid.UUID          `gorm:"type:uuid;primary_key" json:"id"`
+	UserID      uuid.UUID          `gorm:"type:uuid;not null;index" json:"user_id"`
+	Filename    string             `json:"filename"`
+	Checksum    string             `gorm:"index" json:"checksum"` // hex SHA-256 of the file
+	Data        string             `gorm:"type:text" json:"-"`    // the file, cleared once processed
+	Status      DeviceImportStatus `gorm:"type:varchar(20);default:'pending';index" json:"status"`
+	Rows        int                `json:"rows"`
+	Processed   int                `json:"processed"` // rows done so far
+	Created     int                `json:"created"`   // devices added to the fleet
+	Updated     int                `json:"updated"`   // devices already in the fleet whose details changed
+	Unchanged   int                `json:"unchanged"` // devices already in the fleet as listed
+	Failed      int                `json:"failed"`
+	Errors      DeviceImportErrors `gorm:"type:text" json:"-"` // served as a CSV report
+	Error       string             `json:"error,omitempty"`    // why the file could not be read
+	CreatedAt   time.Time          `json:"created_at"`
+	StartedAt   *time.Time         `json:"started_at,omitempty"`
+	CompletedAt *time.Time         `json:"completed_at,omitempty"`
+}
+
+// DeviceImportError is why one row of an import failed
+type DeviceImportError struct {
+	Row        int    `json:"row"` // 1 is the first row after the header
+	HardwareID string `json:"hardware_id"`
+	Error      string `json:"error"`
+}
+
+// DeviceImportErrors is the list of failed rows of an import, stored as a
+// JSON array in a text column
+type DeviceImportErrors []DeviceImportError
+
+// Value implements driver.Valuer
+func (e DeviceImportErrors) Value() (driver.Value, error) {
+	if e == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]DeviceImportError(e))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (e *DeviceImportErrors) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*e = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, e)
+	case string:
+		return json.Unmarshal([]byte(v), e)
+	default:
+		return fmt.Errorf("unsupported device import errors value %T", value)
+	}
+}
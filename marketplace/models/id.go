@@ -0,0 +1,32 @@
+package models
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// NewID returns a UUIDv7 for a new record: 48 bits of Unix milliseconds
+// followed by random bits. IDs created later sort after earlier ones, which
+// keeps new rows together at the end of primary key indexes. Records
+// created before the switch keep their random v4 IDs.
+func NewID() uuid.UUID {
+	id := uuid.New()
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(id[:6], ms[2:])
+	id[6] = id[6]&0x0f | 0x70 // version 7; the variant bits are already set
+	return id
+}
+
+// IDTime returns the creation time encoded in a UUIDv7, or false for IDs of
+// other versions, which carry no time
+func IDTime(id uuid.UUID) (time.Time, bool) {
+	if id.Version() != 7 {
+		return time.Time{}, false
+	}
+	var ms [8]byte
+	copy(ms[2:], id[:6])
+	return time.UnixMilli(int64(binary.BigEndian.Uint64(ms[:]))).UTC(), true
+}
@@ -0,0 +1,110 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLocale is the locale of an agent's main README unless the publisher
+// chooses another
+const DefaultLocale = "en"
+
+// localePattern matches a BCP 47 language tag of a language and optional
+// script, region or variant subtags
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// NormalizeLocale validates a BCP 47 language tag and puts it in canonical
+// case, e.g. "pt-br" becomes "pt-BR" and "zh-hant" becomes "zh-Hant"
+func NormalizeLocale(locale string) (string, error) {
+	locale = strings.ReplaceAll(strings.TrimSpace(locale), "_", "-")
+	if !localePattern.MatchString(locale) {
+		return "", fmt.Errorf("invalid locale %q", locale)
+	}
+
+	parts := strings.Split(locale, "-")
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		switch len(parts[i]) {
+		case 2:
+			parts[i] = strings.ToUpper(parts[i])
+		case 4:
+			parts[i] = strings.ToUpper(parts[i][:1]) + strings.ToLower(parts[i][1:])
+		default:
+			parts[i] = strings.ToLower(parts[i])
+		}
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// baseLanguage returns the language subtag of a normalized locale
+func baseLanguage(locale string) string {
+	if i := strings.IndexByte(locale, '-'); i >= 0 {
+		return locale[:i]
+	}
+	return locale
+}
+
+// ParseAcceptLanguage returns the locales of an Accept-Language header in
+// order of preference. Invalid entries, wildcards and q=0 are skipped.
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	var prefs []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		locale, err := NormalizeLocale(fields[0])
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, weighted{locale, q})
+		}
+	}
+
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	locales := make([]string, len(prefs))
+	for i, p := range prefs {
+		locales[i] = p.locale
+	}
+	return locales
+}
+
+// MatchLocale picks the available locale that best fits the preferred ones.
+// An exact match wins, then one with the same language (so "pt-BR" accepts
+// "pt" or "pt-PT"), then the fallback. It returns "" if nothing is available.
+func MatchLocale(preferred, available []string, fallback string) string {
+	for _, want := range preferred {
+		for _, have := range available {
+			if have == want {
+				return have
+			}
+		}
+		for _, have := range available {
+			if baseLanguage(have) == baseLanguage(want) {
+				return have
+			}
+		}
+	}
+	for _, have := range available {
+		if have == fallback {
+			return have
+		}
+	}
+	if len(available) > 0 {
+		return available[0]
+	}
+	return ""
+}
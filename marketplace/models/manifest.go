@@ -0,0 +1,70 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// ManifestSchemaVersion is the version of the EdgePlug manifest schema that
+// uploaded manifests are validated against
+const ManifestSchemaVersion = 1
+
+// AgentManifest is the EdgePlug manifest shipped with an agent release. It
+// tells the device runtime how to load the binary and wire it to the
+// controller's I/O.
+type AgentManifest struct {
+	SchemaVersion int                  `json:"schema_version"`
+	Name          string               `json:"name"`
+	Version       string               `json:"version"` // must match the release
+	EntryPoints   []ManifestEntryPoint `json:"entry_points"`
+	Memory        ManifestMemory       `json:"memory"`
+	Signals       []ManifestSignal     `json:"signals"`
+	SafetyLevel   SafetyLevel          `json:"safety_level"`
+}
+
+// ManifestEntryPoint is a function the runtime calls in the agent binary
+type ManifestEntryPoint struct {
+	Kind     string `json:"kind"`                // init, process or shutdown
+	Symbol   string `json:"symbol"`              // exported symbol in the binary
+	PeriodUS int    `json:"period_us,omitempty"` // for process, the call period in microseconds
+}
+
+// ManifestMemory is the memory the agent needs on the device
+type ManifestMemory struct {
+	FlashBytes int `json:"flash_bytes"`
+	SRAMBytes  int `json:"sram_bytes"`
+}
+
+// ManifestSignal maps one of the agent's signals to a controller channel
+type ManifestSignal struct {
+	Name      string `json:"name"`      // snake_case identifier
+	Direction string `json:"direction"` // input or output
+	Type      string `json:"type"`      // digital, analog, waveform, event or counter
+	Channel   string `json:"channel"`   // controller channel, e.g. "ai0" or "modbus:40001"
+	Unit      string `json:"unit,omitempty"`
+}
+
+// Value implements driver.Valuer
+func (m AgentManifest) Value() (driver.Value, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (m *AgentManifest) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*m = AgentManifest{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, m)
+	case string:
+		return json.Unmarshal([]byte(v), m)
+	default:
+		return fmt.Errorf("unsupported agent manifest value %T", value)
+	}
+}
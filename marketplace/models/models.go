@@ -1,6 +1,10 @@
 package models
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -9,16 +13,26 @@ import (
 
 // User represents a marketplace user
 type User struct {
-	ID           uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ID           uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
 	Email        string    `gorm:"uniqueIndex;not null" json:"email"`
 	Username     string    `gorm:"uniqueIndex;not null" json:"username"`
 	PasswordHash string    `gorm:"not null" json:"-"`
 	FirstName   string    `json:"first_name"`
 	LastName    string    `json:"last_name"`
 	Company     string    `json:"company"`
+	AvatarURL   string    `json:"avatar_url"` // uploaded image or generated identicon
 	Role        UserRole  `gorm:"type:varchar(20);default:'user'" json:"role"`
+	Tier        PublisherTier `gorm:"type:varchar(20);default:'free'" json:"tier"`
+	StorageUsedBytes int64 `gorm:"default:0" json:"storage_used_bytes"` // counted against the tier's storage quota
 	Status      UserStatus `gorm:"type:varchar(20);default:'active'" json:"status"`
+	Warnings    int       `gorm:"not null;default:0" json:"warnings"` // moderation warnings received
 	Verified    bool      `gorm:"default:false" json:"verified"`
+	ReviewReminderOptOut bool `gorm:"default:false" json:"review_reminder_opt_out"`
+	CheckoutRecoveryEnabled bool `gorm:"default:true" json:"checkout_recovery_enabled"` // publisher setting for their agents
+	ReviewInsightsEnabled bool `gorm:"default:true" json:"review_insights_enabled"` // publisher setting for their agents
+	Timezone    string    `gorm:"default:'UTC'" json:"timezone"` // IANA name, for quiet hours and daily digests
+	QuietHoursStart *int  `json:"quiet_hours_start,omitempty"` // local hour notifications stop being emailed
+	QuietHoursEnd   *int  `json:"quiet_hours_end,omitempty"`   // local hour they resume
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
@@ -30,17 +44,202 @@ type User struct {
 	Favorites   []Favorite   `gorm:"foreignKey:UserID" json:"favorites,omitempty"`
 }
 
+// RefreshToken is a long-lived token a client exchanges for a new access
+// token. Each use rotates it: the token is revoked and replaced by a new one
+// in the same family. Presenting a revoked token revokes the whole family.
+type RefreshToken struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	UserID     uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	FamilyID   uuid.UUID  `gorm:"type:uuid;not null;index" json:"family_id"` // the login the token descends from
+	TokenHash  string     `gorm:"not null;uniqueIndex" json:"-"`            // hex SHA-256 of the token
+	UserAgent  string     `json:"user_agent"`
+	ExpiresAt  time.Time  `gorm:"not null" json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	ReplacedBy *uuid.UUID `gorm:"type:uuid" json:"replaced_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// PasswordResetToken is a single-use token emailed to reset a password
+type PasswordResetToken struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	TokenHash string     `gorm:"not null;uniqueIndex" json:"-"` // hex SHA-256 of the token
+	RequestIP string     `json:"request_ip"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `gorm:"index" json:"created_at"`
+}
+
+// PendingActionType is a sensitive action that must be confirmed by email
+// link or by re-entering the password
+type PendingActionType string
+
+const (
+	PendingActionDeleteAgent          PendingActionType = "delete_agent" // only for agents with buyers
+	PendingActionReplacePayoutAccount PendingActionType = "replace_payout_account"
+	PendingActionDeleteAccount        PendingActionType = "delete_account"
+	PendingActionChangeEmail          PendingActionType = "change_email"
+)
+
+// PendingAction is a sensitive action awaiting confirmation through the
+// signed link emailed for it. It can be confirmed once, before it expires.
+type PendingAction struct {
+	ID          uuid.UUID         `gorm:"type:uuid;primary_key" json:"id"`
+	UserID      uuid.UUID         `gorm:"type:uuid;not null;index" json:"user_id"`
+	Action      PendingActionType `gorm:"type:varchar(40);not null" json:"action"`
+	TargetID    *uuid.UUID        `gorm:"type:uuid" json:"target_id,omitempty"` // e.g. the agent to delete
+	Value       string            `json:"value,omitempty"`                      // e.g. the new email address
+	RequestIP   string            `json:"request_ip"`
+	ExpiresAt   time.Time         `gorm:"not null" json:"expires_at"`
+	ConfirmedAt *time.Time        `json:"confirmed_at,omitempty"`
+	CreatedAt   time.Time         `gorm:"index" json:"created_at"`
+
+	User User `gorm:"foreignKey:UserID" json:"-"`
+}
+
+// APIKey is a self-service key for the read-only public API. Only a hash
+// of the key is stored; Prefix lets owners tell their keys apart.
+type APIKey struct {
+	ID              uuid.UUID    `gorm:"type:uuid;primary_key" json:"id"`
+	OwnerID         uuid.UUID    `gorm:"type:uuid;not null;index" json:"owner_id"`
+	Name            string       `gorm:"not null" json:"name"`
+	Prefix          string       `gorm:"not null" json:"prefix"`
+	KeyHash         string       `gorm:"not null;uniqueIndex" json:"-"` // hex SHA-256 of the key
+	Status          APIKeyStatus `gorm:"not null;default:'active';index" json:"status"`
+	SuspendedReason string       `json:"suspended_reason,omitempty"`
+	SuspendedAt     *time.Time   `json:"suspended_at,omitempty"`
+	GraceMode       bool         `gorm:"not null;default:false" json:"grace_mode"` // let requests a little over the limits through, with a warning
+	LastUsedAt      *time.Time   `json:"last_used_at,omitempty"`
+	CreatedAt       time.Time    `json:"created_at"`
+	RevokedAt       *time.Time   `json:"revoked_at,omitempty"`
+}
+
+// ServiceAccount is a non-interactive principal for reporting integrations
+// such as BI tools. It has no password and cannot log in. It authenticates
+// with its key or, when it has a public key, with a short-lived JWT signed
+// by the matching private key. It reads its owner's data within its scopes
+// and cannot change anything.
+type ServiceAccount struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	OwnerID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"owner_id"`
+	Name       string     `gorm:"not null" json:"name"`
+	Scopes     Tags       `gorm:"type:text" json:"scopes"`
+	Prefix     string     `gorm:"not null" json:"prefix"`
+	KeyHash    string     `gorm:"not null;uniqueIndex" json:"-"` // hex SHA-256 of the key
+	PublicKey  string     `gorm:"type:text" json:"public_key,omitempty"` // PKIX PEM, Ed25519 or ECDSA P-256
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// PublisherKey is a public key a publisher signs agent binaries with. A
+// revoked key no longer verifies releases that are not published yet.
+type PublisherKey struct {
+	ID          uuid.UUID          `gorm:"type:uuid;primary_key" json:"id"`
+	UserID      uuid.UUID          `gorm:"type:uuid;not null;index;uniqueIndex:idx_publisher_key" json:"user_id"`
+	Name        string             `gorm:"not null" json:"name"`
+	Algorithm   SignatureAlgorithm `gorm:"type:varchar(20);not null" json:"algorithm"`
+	PublicKey   string             `gorm:"type:text;not null" json:"public_key"` // PKIX PEM
+	Fingerprint string             `gorm:"not null;uniqueIndex:idx_publisher_key" json:"fingerprint"` // hex SHA-256 of the DER key
+	CreatedAt   time.Time          `json:"created_at"`
+	RevokedAt   *time.Time         `json:"revoked_at,omitempty"`
+}
+
+// LegalHold freezes the data of a user, organization or agent: it cannot
+// be deleted or purged while the hold is active. Holds are never deleted, so
+// they record who placed and released each one and why.
+type LegalHold struct {
+	ID          uuid.UUID        `gorm:"type:uuid;primary_key" json:"id"`
+	SubjectType LegalHoldSubject `gorm:"type:varchar(20);not null;index:idx_legal_hold_subject" json:"subject_type"`
+	SubjectID   uuid.UUID        `gorm:"type:uuid;not null;index:idx_legal_hold_subject" json:"subject_id"`
+	Reason      string           `gorm:"type:text;not null" json:"reason"`
+	PlacedBy    uuid.UUID        `gorm:"type:uuid;not null" json:"placed_by"`
+	ExpiresAt   *time.Time       `json:"expires_at,omitempty"` // none until released
+	ReleasedBy  *uuid.UUID       `gorm:"type:uuid" json:"released_by,omitempty"`
+	ReleasedAt  *time.Time       `json:"released_at,omitempty"`
+	CreatedAt   time.Time        `json:"created_at"`
+}
+
+// AuditLog records a sensitive change: who made it, to what, and the
+// fields it changed before and after. Entries are never updated or deleted.
+type AuditLog struct {
+	ID         uuid.UUID     `gorm:"type:uuid;primary_key" json:"id"`
+	ActorID    *uuid.UUID    `gorm:"type:uuid;index" json:"actor_id,omitempty"` // the user or service account; none for operator commands
+	ActorName  string        `json:"actor_name,omitempty"`                      // the operator, for operator commands
+	ActorRole  string        `gorm:"type:varchar(20)" json:"actor_role,omitempty"`
+	ActorType  AuditActor    `gorm:"type:varchar(20);default:'user'" json:"actor_type"`
+	Action     AuditAction   `gorm:"type:varchar(40);not null;index" json:"action"`
+	EntityType string        `gorm:"type:varchar(40);not null;index:idx_audit_entity" json:"entity_type"`
+	EntityID   uuid.UUID     `gorm:"type:uuid;not null;index:idx_audit_entity" json:"entity_id"`
+	Before     AuditSnapshot `gorm:"type:text" json:"before,omitempty"`
+	After      AuditSnapshot `gorm:"type:text" json:"after,omitempty"`
+	Reason     string        `gorm:"type:text" json:"reason,omitempty"`
+	IP         string        `gorm:"type:varchar(45)" json:"ip,omitempty"`
+	CreatedAt  time.Time     `gorm:"index" json:"created_at"`
+}
+
+// SchemaMigration records a data migration applied to the database.
+// Version is the migration's position in the list, so the highest one is
+// the schema version of the database.
+type SchemaMigration struct {
+	Version   int       `gorm:"primary_key;autoIncrement:false" json:"version"`
+	Name      string    `gorm:"not null" json:"name"`
+	AppliedAt time.Time `gorm:"not null" json:"applied_at"`
+}
+
+// RankingWeights are the weights of the agent ranking score set by an
+// admin. The single row, with ID 1, overrides the configured defaults.
+type RankingWeights struct {
+	ID              int        `gorm:"primaryKey" json:"-"`
+	DownloadsWeight float64    `gorm:"not null" json:"downloads_weight"`
+	RatingWeight    float64    `gorm:"not null" json:"rating_weight"`
+	RecencyWeight   float64    `gorm:"not null" json:"recency_weight"`
+	RecencyHalfLife int        `gorm:"not null" json:"recency_half_life"` // in hours
+	VerifiedBoost   float64    `gorm:"not null" json:"verified_boost"`
+	UpdatedBy       *uuid.UUID `gorm:"type:uuid" json:"updated_by,omitempty"` // nil for the configured defaults
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// LimitOverride replaces the default of one limit within a scope, such as
+// a single user. A value of 0 means unlimited.
+type LimitOverride struct {
+	Scope     string    `gorm:"primaryKey" json:"scope"` // e.g. user:<id>
+	Name      LimitName `gorm:"type:varchar(40);primaryKey" json:"name"`
+	Value     int64     `gorm:"not null" json:"value"`
+	Reason    string    `gorm:"type:text" json:"reason,omitempty"`
+	UpdatedBy uuid.UUID `gorm:"type:uuid" json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// APIKeyUsage counts the requests made with an API key per UTC day.
+// Rejected requests were over the key's limits.
+type APIKeyUsage struct {
+	KeyID       uuid.UUID `gorm:"type:uuid;primaryKey" json:"key_id"`
+	Day         time.Time `gorm:"type:date;primaryKey" json:"day"`
+	Requests    int       `gorm:"not null;default:0" json:"requests"`
+	Rejected    int       `gorm:"not null;default:0" json:"rejected"`
+	Graced      int       `gorm:"not null;default:0" json:"graced"` // let through over the limits by grace mode
+	Warned      bool      `gorm:"not null;default:false" json:"-"`  // owner notified of nearing the quota
+	GraceWarned bool      `gorm:"not null;default:false" json:"-"`  // owner notified of going over it
+}
+
+
 // Agent represents an EdgePlug agent available in the marketplace
 type Agent struct {
-	ID          uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ID          uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
 	Name        string    `gorm:"not null" json:"name"`
 	Description string    `gorm:"type:text" json:"description"`
 	Version     string    `gorm:"not null" json:"version"`
 	PublisherID uuid.UUID `gorm:"type:uuid;not null" json:"publisher_id"`
+	OrganizationID *uuid.UUID `gorm:"type:uuid;index" json:"organization_id,omitempty"` // team that manages the agent; the publisher is still paid
 	Category    string    `gorm:"not null" json:"category"`
-	Tags        []string  `gorm:"type:text[]" json:"tags"`
-	Price       float64   `gorm:"not null;default:0" json:"price"`
+	Tags        Tags      `gorm:"type:text" json:"tags"`
+	HardwareTargets Tags  `gorm:"type:text" json:"hardware_targets"` // MCU families it runs on, e.g. stm32f4
+	Price       Money     `gorm:"column:price_minor;not null;default:0" json:"price_minor"`
+	PriceDisplay string   `gorm:"-" json:"price"`
 	Currency    string    `gorm:"default:'USD'" json:"currency"`
+	DisplayPrice *DisplayPrice `gorm:"-" json:"display_price,omitempty"` // set when listed with ?currency=
+	PricingModel PricingModel `gorm:"type:varchar(20);default:'one_time'" json:"pricing_model"` // for metered agents Price is per device-month
 	Status      AgentStatus `gorm:"type:varchar(20);default:'draft'" json:"status"`
 	
 	// Technical specifications
@@ -50,10 +249,16 @@ type Agent struct {
 	SafetyLevel SafetyLevel `gorm:"type:varchar(20);default:'basic'" json:"safety_level"`
 	
 	// Files and metadata
-	BinaryURL   string    `json:"binary_url"`
+	BinaryURL   string    `json:"-"` // handed out through the download endpoints only
+	BinarySize  int64     `json:"binary_size"`     // in bytes
+	BinaryChecksum string `json:"binary_checksum"` // hex SHA-256
+	BinaryContentType string `json:"binary_content_type"`
+	BinarySignature string `json:"binary_signature,omitempty"` // base64, over the SHA-256 digest
+	SigningKeyID *uuid.UUID `gorm:"type:uuid" json:"signing_key_id,omitempty"`
 	ManifestURL string    `json:"manifest_url"`
 	IconURL     string    `json:"icon_url"`
 	ReadmeURL   string    `json:"readme_url"`
+	DefaultLocale string  `gorm:"type:varchar(35);default:'en'" json:"default_locale"` // locale of the main README
 	
 	// Statistics
 	Downloads   int       `gorm:"default:0" json:"downloads"`
@@ -64,10 +269,14 @@ type Agent struct {
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	PublishedAt *time.Time `json:"published_at,omitempty"`
+	StaleSince  *time.Time `json:"stale_since,omitempty"` // set on drafts left untouched, cleared when edited
+	InactiveSince  *time.Time `json:"inactive_since,omitempty"`   // set on published agents without downloads or updates, cleared when either happens
+	AutoArchivedAt *time.Time `json:"auto_archived_at,omitempty"` // set when archived for inactivity, so the publisher can restore it
 	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
 
 	// Relationships
 	Publisher   User       `gorm:"foreignKey:PublisherID" json:"publisher,omitempty"`
+	SigningKey  *PublisherKey `gorm:"foreignKey:SigningKeyID" json:"signing_key,omitempty"`
 	Reviews     []Review   `gorm:"foreignKey:AgentID" json:"reviews,omitempty"`
 	Purchases   []Purchase `gorm:"foreignKey:AgentID" json:"purchases,omitempty"`
 	Favorites   []Favorite `gorm:"foreignKey:AgentID" json:"favorites,omitempty"`
@@ -75,13 +284,21 @@ type Agent struct {
 
 // Purchase represents a user's purchase of an agent
 type Purchase struct {
-	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ID        uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
 	BuyerID   uuid.UUID `gorm:"type:uuid;not null" json:"buyer_id"`
 	AgentID   uuid.UUID `gorm:"type:uuid;not null" json:"agent_id"`
-	Amount    float64   `gorm:"not null" json:"amount"`
+	Amount    Money     `gorm:"column:amount_minor;not null" json:"amount_minor"`
+	AmountDisplay string `gorm:"-" json:"amount"`
 	Currency  string    `gorm:"not null" json:"currency"`
 	Status    PurchaseStatus `gorm:"type:varchar(20);default:'pending'" json:"status"`
 	PaymentID string    `json:"payment_id"`
+	Commission Money    `gorm:"column:commission_minor;not null;default:0" json:"commission_minor"` // marketplace fee from the publisher's tier
+	CreditApplied Money `gorm:"column:credit_minor;not null;default:0" json:"credit_minor"` // paid from the buyer's credit balance
+	PayoutID  *uuid.UUID `gorm:"type:uuid;index" json:"payout_id,omitempty"`          // the payout that paid the publisher for it
+	ReversalPayoutID *uuid.UUID `gorm:"type:uuid" json:"reversal_payout_id,omitempty"` // the payout that took it back after a refund
+	OrganizationID *uuid.UUID `gorm:"type:uuid;index" json:"organization_id,omitempty"` // bought for the organization, whose members are all entitled
+	PlanID    *uuid.UUID `gorm:"type:uuid" json:"plan_id,omitempty"` // the one-time pricing plan bought, if not the agent's own price
+	TraceID   uuid.UUID `gorm:"type:uuid;not null;index" json:"trace_id"` // follows the purchase to its downloads and deployments; defaults to the purchase ID
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
@@ -90,26 +307,329 @@ type Purchase struct {
 	Agent Agent `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
 }
 
+// License is the signed license key of a paid purchase. Key is an ES256
+// JWT naming the agent, buyer, seats and expiry, verifiable offline with
+// the marketplace signing key. It is reissued with a later expiry while the
+// purchase stands.
+type License struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	PurchaseID     uuid.UUID  `gorm:"type:uuid;not null;uniqueIndex" json:"purchase_id"`
+	BuyerID        uuid.UUID  `gorm:"type:uuid;not null;index" json:"buyer_id"`
+	AgentID        uuid.UUID  `gorm:"type:uuid;not null" json:"agent_id"`
+	OrganizationID *uuid.UUID `gorm:"type:uuid" json:"organization_id,omitempty"`
+	Seats          int        `gorm:"not null" json:"seats"`
+	Key            string     `gorm:"type:text;not null" json:"license_key"`
+	ExpiresAt      time.Time  `gorm:"not null" json:"expires_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"` // when the key was last issued
+
+	// Relationships
+	Agent Agent `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+}
+
+// PricingPlan is a way of paying for an agent besides its own price: once,
+// or through a subscription renewed every month or year. A per-device plan
+// is a monthly subscription charged for each device covered.
+type PricingPlan struct {
+	ID           uuid.UUID    `gorm:"type:uuid;primary_key" json:"id"`
+	AgentID      uuid.UUID    `gorm:"type:uuid;not null;index" json:"agent_id"`
+	Name         string       `gorm:"not null" json:"name"`
+	Interval     PlanInterval `gorm:"type:varchar(20);not null" json:"interval"`
+	Price        Money        `gorm:"column:price_minor;not null" json:"price_minor"`
+	PriceDisplay string       `gorm:"-" json:"price"`
+	Currency     string       `gorm:"not null" json:"currency"`
+	Active       bool         `gorm:"not null;default:true" json:"active"` // retired plans keep their subscriptions but take no new ones
+	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+}
+
+// Subscription is a buyer's recurring payment for an agent under a pricing
+// plan. The payment provider bills it; its webhooks move the subscription
+// through its lifecycle.
+type Subscription struct {
+	ID                     uuid.UUID          `gorm:"type:uuid;primary_key" json:"id"`
+	BuyerID                uuid.UUID          `gorm:"type:uuid;not null;index" json:"buyer_id"`
+	AgentID                uuid.UUID          `gorm:"type:uuid;not null;index" json:"agent_id"`
+	PlanID                 uuid.UUID          `gorm:"type:uuid;not null" json:"plan_id"`
+	ProviderSubscriptionID string             `gorm:"not null;uniqueIndex" json:"provider_subscription_id"`
+	Quantity               int                `gorm:"not null;default:1" json:"quantity"` // devices covered by a per-device plan
+	Status                 SubscriptionStatus `gorm:"type:varchar(20);not null;index" json:"status"`
+	CurrentPeriodStart     *time.Time         `json:"current_period_start,omitempty"`
+	CurrentPeriodEnd       *time.Time         `json:"current_period_end,omitempty"`
+	CancelAtPeriodEnd      bool               `gorm:"not null;default:false" json:"cancel_at_period_end"`
+	FailedPayments         int                `gorm:"not null;default:0" json:"failed_payments"` // since the last successful one
+	PastDueSince           *time.Time         `json:"past_due_since,omitempty"`
+	CanceledAt             *time.Time         `json:"canceled_at,omitempty"`
+	CreatedAt              time.Time          `json:"created_at"`
+	UpdatedAt              time.Time          `json:"updated_at"`
+
+	// Relationships
+	Plan  PricingPlan `gorm:"foreignKey:PlanID" json:"plan,omitempty"`
+	Agent Agent       `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+}
+
+// PaymentEvent records a payment provider webhook event once processed, so
+// redeliveries are ignored
+type PaymentEvent struct {
+	ID         string    `gorm:"primary_key" json:"id"` // the provider's event ID
+	Type       string    `gorm:"not null" json:"type"`
+	ReceivedAt time.Time `gorm:"not null" json:"received_at"`
+}
+
+// AgentVersion is one release of an agent. The agent's own version, files
+// and specs mirror its most recently published release.
+type AgentVersion struct {
+	ID          uuid.UUID          `gorm:"type:uuid;primary_key" json:"id"`
+	AgentID     uuid.UUID          `gorm:"type:uuid;not null;uniqueIndex:idx_agent_version" json:"agent_id"`
+	Version     string             `gorm:"not null;uniqueIndex:idx_agent_version" json:"version"`
+	Changelog   string             `gorm:"type:text" json:"changelog"`
+	BinaryURL   string             `json:"-"`
+	BinarySize  int64              `json:"binary_size"`     // in bytes
+	BinaryChecksum string          `json:"binary_checksum"` // hex SHA-256
+	BinaryContentType string       `json:"binary_content_type"`
+	BinarySignature string         `json:"binary_signature,omitempty"` // base64, over the SHA-256 digest
+	SigningKeyID *uuid.UUID        `gorm:"type:uuid" json:"signing_key_id,omitempty"`
+	SigningKey  *PublisherKey      `gorm:"foreignKey:SigningKeyID" json:"signing_key,omitempty"`
+	ScanStatus  ScanStatus         `gorm:"type:varchar(20);default:'pending';index" json:"scan_status"`
+	ScanReport  *ScanReport        `gorm:"type:text" json:"-"` // shown to admins only
+	ScanAfter   *time.Time         `json:"-"`                  // earliest next scan attempt
+	ManifestURL string             `json:"manifest_url"`
+	Manifest    *AgentManifest     `gorm:"type:text" json:"manifest,omitempty"` // parsed from the uploaded manifest
+	SBOM        *SBOMSummary       `gorm:"type:text" json:"-"`                  // from the uploaded CycloneDX SBOM, shown in the compliance report
+	Certifications Certifications  `gorm:"type:text" json:"certifications,omitempty"`
+	FlashSize   int                `json:"flash_size"`  // in bytes
+	SRAMSize    int                `json:"sram_size"`   // in bytes
+	MaxLatency  int                `json:"max_latency"` // in microseconds
+	Status      AgentVersionStatus `gorm:"type:varchar(20);default:'draft'" json:"status"`
+	CreatedAt   time.Time          `json:"created_at"`
+	PublishedAt *time.Time         `json:"published_at,omitempty"`
+
+	// Audience of a staged release: the percentage of users, and the
+	// countries (ISO 3166-1 alpha-2) whose users, it is served to
+	RolloutPercent int        `gorm:"not null;default:0" json:"rollout_percent,omitempty"`
+	RolloutRegions Tags       `gorm:"type:text" json:"rollout_regions,omitempty"`
+	StagedAt       *time.Time `json:"staged_at,omitempty"`
+}
+
+// AgentHistory is what an agent's listing said between ValidFrom and
+// ValidTo. Rows are written by a database trigger on every listing change;
+// the current one has no ValidTo.
+type AgentHistory struct {
+	ID             uuid.UUID    `gorm:"type:uuid;primary_key" json:"id"`
+	AgentID        uuid.UUID    `gorm:"type:uuid;not null;index:idx_agent_history_period" json:"agent_id"`
+	Name           string       `json:"name"`
+	Description    string       `gorm:"type:text" json:"description"`
+	Version        string       `json:"version"`
+	PublisherID    uuid.UUID    `gorm:"type:uuid" json:"publisher_id"`
+	OrganizationID *uuid.UUID   `gorm:"type:uuid" json:"organization_id,omitempty"`
+	Category       string       `json:"category"`
+	Tags           Tags         `gorm:"type:text" json:"tags"`
+	Price          Money        `gorm:"column:price_minor" json:"price_minor"`
+	PriceDisplay   string       `gorm:"-" json:"price"`
+	Currency       string       `json:"currency"`
+	PricingModel   PricingModel `gorm:"type:varchar(20)" json:"pricing_model"`
+	Status         AgentStatus  `gorm:"type:varchar(20)" json:"status"`
+	FlashSize      int          `json:"flash_size"`
+	SRAMSize       int          `json:"sram_size"`
+	MaxLatency     int          `json:"max_latency"`
+	SafetyLevel    SafetyLevel  `gorm:"type:varchar(20)" json:"safety_level"`
+	BinaryChecksum string       `json:"binary_checksum"`
+	DefaultLocale  string       `gorm:"type:varchar(35)" json:"default_locale"`
+	ValidFrom      time.Time    `gorm:"not null;index:idx_agent_history_period" json:"valid_from"`
+	ValidTo        *time.Time   `json:"valid_to,omitempty"`
+}
+
+// AgentLocalization holds an agent's README and media for one locale
+type AgentLocalization struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	AgentID   uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_agent_locale" json:"agent_id"`
+	Locale    string    `gorm:"type:varchar(35);not null;uniqueIndex:idx_agent_locale" json:"locale"` // BCP 47 tag
+	Readme    string    `gorm:"type:text" json:"readme"` // Markdown
+	Media     Tags      `gorm:"type:text" json:"media"`  // screenshot and video URLs, in display order
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// AgentCapabilities holds the capability descriptor of one agent version
+type AgentCapabilities struct {
+	ID            uuid.UUID            `gorm:"type:uuid;primary_key" json:"id"`
+	AgentID       uuid.UUID            `gorm:"type:uuid;not null;uniqueIndex:idx_agent_capabilities_version" json:"agent_id"`
+	Version       string               `gorm:"not null;uniqueIndex:idx_agent_capabilities_version" json:"version"`
+	SchemaVersion int                  `gorm:"not null" json:"schema_version"`
+	Descriptor    CapabilityDescriptor `gorm:"type:text" json:"descriptor"`
+	CreatedAt     time.Time            `json:"created_at"`
+	UpdatedAt     time.Time            `json:"updated_at"`
+}
+
+// AgentCapabilityTerm indexes one entry of a capability descriptor for
+// capability-based search, e.g. kind "output" and name "trip_signal"
+type AgentCapabilityTerm struct {
+	AgentID uuid.UUID      `gorm:"type:uuid;primaryKey" json:"agent_id"`
+	Version string         `gorm:"primaryKey" json:"version"`
+	Kind    CapabilityKind `gorm:"type:varchar(20);primaryKey;index:idx_capability_term,priority:1" json:"kind"`
+	Name    string         `gorm:"primaryKey;index:idx_capability_term,priority:2" json:"name"`
+}
+
 // Review represents a user's review of an agent
 type Review struct {
-	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ID        uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
 	UserID    uuid.UUID `gorm:"type:uuid;not null" json:"user_id"`
 	AgentID   uuid.UUID `gorm:"type:uuid;not null" json:"agent_id"`
 	Rating    int       `gorm:"not null;check:rating >= 1 AND rating <= 5" json:"rating"`
 	Comment   string    `gorm:"type:text" json:"comment"`
+	VerifiedPurchase bool `gorm:"default:false" json:"verified_purchase"`
+	Version   string    `gorm:"index" json:"version,omitempty"` // release the reviewer was served
+	HelpfulCount   int `gorm:"not null;default:0" json:"helpful_count"`
+	UnhelpfulCount int `gorm:"not null;default:0" json:"unhelpful_count"`
+	HiddenAt  *time.Time `gorm:"index" json:"-"` // hidden by a moderator; left out of listings and ratings
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
 	// Relationships
-	User  User  `gorm:"foreignKey:UserID" json:"user,omitempty"`
-	Agent Agent `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+	User        User               `gorm:"foreignKey:UserID" json:"user,omitempty"`
+	Agent       Agent              `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+	Attachments []ReviewAttachment `gorm:"foreignKey:ReviewID" json:"attachments,omitempty"`
+	Reply       *ReviewReply       `gorm:"foreignKey:ReviewID" json:"reply,omitempty"`
+}
+
+// ReviewReply is the publisher's public response to a review. A review has
+// at most one; replying again edits it.
+type ReviewReply struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	ReviewID  uuid.UUID `gorm:"type:uuid;not null;uniqueIndex" json:"review_id"`
+	AuthorID  uuid.UUID `gorm:"type:uuid;not null" json:"author_id"` // the publisher, or an owner or maintainer of their organization
+	Body      string    `gorm:"type:text;not null" json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ReviewVote is a user's verdict on whether a review was helpful. Each user
+// has at most one vote per review; voting again changes it.
+type ReviewVote struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	ReviewID  uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_review_vote" json:"review_id"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_review_vote" json:"user_id"`
+	Helpful   bool      `gorm:"not null" json:"helpful"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Report is a user's report of abusive content: a review, an agent or
+// another user. Reports wait in the moderation queue until an admin
+// resolves or dismisses them; a decision settles every open report about
+// the same target.
+type Report struct {
+	ID            uuid.UUID        `gorm:"type:uuid;primary_key" json:"id"`
+	ReporterID    uuid.UUID        `gorm:"type:uuid;not null;index" json:"reporter_id"`
+	TargetType    ReportTarget     `gorm:"type:varchar(20);not null;index:idx_report_target" json:"target_type"`
+	TargetID      uuid.UUID        `gorm:"type:uuid;not null;index:idx_report_target" json:"target_id"`
+	Reason        ReportReason     `gorm:"type:varchar(30);not null" json:"reason"`
+	Details       string           `gorm:"type:text" json:"details,omitempty"`
+	Status        ReportStatus     `gorm:"type:varchar(20);not null;default:'open';index" json:"status"`
+	Action        ModerationAction `gorm:"type:varchar(20)" json:"action,omitempty"` // taken when the report was resolved
+	ModeratorID   *uuid.UUID       `gorm:"type:uuid" json:"moderator_id,omitempty"`
+	ModeratorNote string           `gorm:"type:text" json:"moderator_note,omitempty"`
+	ResolvedAt    *time.Time       `json:"resolved_at,omitempty"`
+	CreatedAt     time.Time        `gorm:"index" json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+}
+
+// ReviewAttachment is a small file a reviewer attached to a review, e.g. a
+// waveform screenshot or a log. It can only be retrieved once it passed
+// the malware scan.
+type ReviewAttachment struct {
+	ID          uuid.UUID            `gorm:"type:uuid;primary_key" json:"id"`
+	ReviewID    uuid.UUID            `gorm:"type:uuid;not null;index" json:"review_id"`
+	FileName    string               `gorm:"not null" json:"file_name"`
+	ContentType string               `gorm:"not null" json:"content_type"` // sniffed from the content
+	Size        int64                `gorm:"not null" json:"size"`
+	Checksum    string               `gorm:"not null" json:"checksum"` // hex SHA-256
+	Visibility  AttachmentVisibility `gorm:"type:varchar(20);not null;default:'public'" json:"visibility"`
+	ScanStatus  ScanStatus           `gorm:"type:varchar(20);default:'pending';index" json:"scan_status"`
+	ScanAfter   *time.Time           `json:"-"` // earliest next scan attempt
+	CreatedAt   time.Time            `json:"created_at"`
+
+	URL string `gorm:"-" json:"url,omitempty"` // presigned, for viewers allowed to retrieve it
+}
+
+// ReviewSummary is the maintained review aggregate for an agent, updated
+// alongside every review write
+type ReviewSummary struct {
+	AgentID       uuid.UUID `gorm:"type:uuid;primaryKey" json:"agent_id"`
+	ReviewCount   int       `gorm:"not null;default:0" json:"review_count"`
+	RatingSum     int       `gorm:"not null;default:0" json:"-"`
+	OneStar       int       `gorm:"not null;default:0" json:"one_star"`
+	TwoStar       int       `gorm:"not null;default:0" json:"two_star"`
+	ThreeStar     int       `gorm:"not null;default:0" json:"three_star"`
+	FourStar      int       `gorm:"not null;default:0" json:"four_star"`
+	FiveStar      int       `gorm:"not null;default:0" json:"five_star"`
+	VerifiedCount int       `gorm:"not null;default:0" json:"verified_count"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// ReviewInsight is the summary of what an agent's reviews say: the phrases
+// they mention most and their average sentiment from -1 to 1. New reviews
+// mark it stale until the insights job recomputes it.
+type ReviewInsight struct {
+	AgentID       uuid.UUID  `gorm:"type:uuid;primaryKey" json:"agent_id"`
+	Keywords      Tags       `gorm:"type:text" json:"keywords"` // most mentioned first
+	Sentiment     float64    `gorm:"not null;default:0" json:"sentiment"`
+	PositiveCount int        `gorm:"not null;default:0" json:"positive_count"`
+	NegativeCount int        `gorm:"not null;default:0" json:"negative_count"`
+	ReviewCount   int        `gorm:"not null;default:0" json:"review_count"` // reviews with a comment
+	Stale         bool       `gorm:"not null;default:true;index" json:"-"`
+	ComputedAt    *time.Time `json:"computed_at,omitempty"`
+}
+
+// ReviewDailyStat buckets review counts per agent and UTC day for trend reporting
+type ReviewDailyStat struct {
+	AgentID     uuid.UUID `gorm:"type:uuid;primaryKey" json:"agent_id"`
+	Day         time.Time `gorm:"type:date;primaryKey" json:"day"`
+	ReviewCount int       `gorm:"not null;default:0" json:"review_count"`
+	RatingSum   int       `gorm:"not null;default:0" json:"rating_sum"`
+}
+
+// AgentDownloadDay counts an agent's downloads per UTC day
+type AgentDownloadDay struct {
+	AgentID   uuid.UUID `gorm:"type:uuid;primaryKey" json:"agent_id"`
+	Day       time.Time `gorm:"type:date;primaryKey;index" json:"day"`
+	Downloads int64     `gorm:"not null;default:0" json:"downloads"`
+}
+
+// AgentPopularity is the trending score of a published agent: its recent
+// downloads, purchases and reviews, each counting less the older it is.
+// Scores are recomputed periodically; agents without recent activity have
+// none.
+type AgentPopularity struct {
+	AgentID    uuid.UUID `gorm:"type:uuid;primaryKey" json:"agent_id"`
+	Score      float64   `gorm:"not null;index" json:"score"`
+	Downloads  int64     `gorm:"not null" json:"downloads"` // within the window
+	Purchases  int64     `gorm:"not null" json:"purchases"`
+	Reviews    int64     `gorm:"not null" json:"reviews"`
+	ComputedAt time.Time `gorm:"not null;index" json:"computed_at"`
+}
+
+// StarColumn returns the ReviewSummary column counting reviews with rating
+func StarColumn(rating int) string {
+	switch rating {
+	case 1:
+		return "one_star"
+	case 2:
+		return "two_star"
+	case 3:
+		return "three_star"
+	case 4:
+		return "four_star"
+	default:
+		return "five_star"
+	}
 }
 
 // Favorite represents a user's favorite agent
 type Favorite struct {
-	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
-	UserID    uuid.UUID `gorm:"type:uuid;not null" json:"user_id"`
-	AgentID   uuid.UUID `gorm:"type:uuid;not null" json:"agent_id"`
+	ID        uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_favorite_user_agent" json:"user_id"`
+	AgentID   uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_favorite_user_agent" json:"agent_id"`
 	CreatedAt time.Time `json:"created_at"`
 
 	// Relationships
@@ -117,118 +637,2098 @@ type Favorite struct {
 	Agent Agent `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
 }
 
-// Transaction represents a financial transaction
-type Transaction struct {
-	ID          uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
-	PurchaseID  uuid.UUID `gorm:"type:uuid;not null" json:"purchase_id"`
-	Amount      float64   `gorm:"not null" json:"amount"`
-	Currency    string    `gorm:"not null" json:"currency"`
-	Type        TransactionType `gorm:"type:varchar(20);not null" json:"type"`
-	Status      TransactionStatus `gorm:"type:varchar(20);default:'pending'" json:"status"`
-	PaymentMethod string  `gorm:"type:varchar(50)" json:"payment_method"`
-	ExternalID  string    `json:"external_id"`
-	Metadata    string    `gorm:"type:jsonb" json:"metadata"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+// Notification is an in-app message delivered to a user
+type Notification struct {
+	ID        uuid.UUID        `gorm:"type:uuid;primary_key" json:"id"`
+	UserID    uuid.UUID        `gorm:"type:uuid;not null;index" json:"user_id"`
+	Type      NotificationType `gorm:"type:varchar(40);not null" json:"type"`
+	Title     string           `gorm:"not null" json:"title"`
+	Body      string           `gorm:"type:text" json:"body"`
+	Link      string           `json:"link"`
+	ReadAt    *time.Time       `json:"read_at,omitempty"`
+	DigestID  *uuid.UUID       `gorm:"type:uuid;index" json:"digest_id,omitempty"` // set once emailed, alone or batched
+	HideInApp bool             `gorm:"not null;default:false" json:"-"`            // the user turned the in-app channel off for its type
+	SkipEmail bool             `gorm:"not null;default:false" json:"-"`            // the user turned the email channel off for its type
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// NotificationPreference sets the channels a user gets notifications of
+// one type on, and how often they are emailed. Types without a preference
+// go to every channel and are emailed immediately.
+type NotificationPreference struct {
+	UserID    uuid.UUID        `gorm:"type:uuid;primaryKey" json:"-"`
+	Type      NotificationType `gorm:"type:varchar(40);primaryKey" json:"type"`
+	Frequency DigestFrequency  `gorm:"type:varchar(20);not null" json:"frequency"`
+	Channels  Tags             `gorm:"type:text" json:"channels"` // NotificationChannel values; NULL for every channel
+}
+
+// NotificationDigest is one email sent to a user, combining the
+// notifications that were due. It is kept so digests can be shown in-app.
+type NotificationDigest struct {
+	ID        uuid.UUID       `gorm:"type:uuid;primary_key" json:"id"`
+	UserID    uuid.UUID       `gorm:"type:uuid;not null;index:idx_digest_user_sent" json:"user_id"`
+	Frequency DigestFrequency `gorm:"type:varchar(20);not null" json:"frequency"`
+	Subject   string          `gorm:"not null" json:"subject"`
+	Body      string          `gorm:"type:text" json:"body"`
+	Count     int             `gorm:"not null" json:"count"`
+	SentAt    time.Time       `gorm:"not null;index:idx_digest_user_sent" json:"sent_at"`
+}
+
+// Consent is a user's current answer for one purpose of data use. Without
+// a row the purpose is not consented to.
+type Consent struct {
+	UserID    uuid.UUID      `gorm:"type:uuid;primaryKey" json:"-"`
+	Purpose   ConsentPurpose `gorm:"type:varchar(40);primaryKey" json:"purpose"`
+	Granted   bool           `gorm:"not null" json:"granted"`
+	Version   string         `gorm:"type:varchar(32);not null" json:"version"` // of the consent text answered
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// ConsentEvent records one consent answer, kept as proof of consent after
+// the answer is changed
+type ConsentEvent struct {
+	ID        uuid.UUID      `gorm:"type:uuid;primary_key" json:"id"`
+	UserID    uuid.UUID      `gorm:"type:uuid;not null;index" json:"user_id"`
+	Purpose   ConsentPurpose `gorm:"type:varchar(40);not null" json:"purpose"`
+	Granted   bool           `gorm:"not null" json:"granted"`
+	Version   string         `gorm:"type:varchar(32);not null" json:"version"`
+	IPAddress string         `gorm:"type:varchar(45)" json:"ip_address"`
+	UserAgent string         `gorm:"type:varchar(255)" json:"user_agent"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// ReviewReminder records the review prompt sent (or suppressed) for a purchase
+type ReviewReminder struct {
+	ID          uuid.UUID            `gorm:"type:uuid;primary_key" json:"id"`
+	PurchaseID  uuid.UUID            `gorm:"type:uuid;not null;uniqueIndex" json:"purchase_id"`
+	UserID      uuid.UUID            `gorm:"type:uuid;not null" json:"user_id"`
+	AgentID     uuid.UUID            `gorm:"type:uuid;not null" json:"agent_id"`
+	Status      ReviewReminderStatus `gorm:"type:varchar(20);not null" json:"status"`
+	Reason      string               `json:"reason,omitempty"`
+	ProcessedAt time.Time            `json:"processed_at"`
+}
+
+// RefundRequest is a buyer's request to refund a purchase. Admins approve
+// or deny it; an approved refund is paid back through the payment provider
+// and, for the part paid with credit, as credit.
+type RefundRequest struct {
+	ID               uuid.UUID    `gorm:"type:uuid;primary_key" json:"id"`
+	PurchaseID       uuid.UUID    `gorm:"type:uuid;not null;index" json:"purchase_id"`
+	BuyerID          uuid.UUID    `gorm:"type:uuid;not null;index" json:"buyer_id"`
+	Reason           string       `gorm:"type:text" json:"reason"`
+	Status           RefundStatus `gorm:"type:varchar(20);default:'pending';index" json:"status"`
+	ReviewedBy       *uuid.UUID   `gorm:"type:uuid" json:"reviewed_by,omitempty"`
+	ReviewedAt       *time.Time   `json:"reviewed_at,omitempty"`
+	Notes            string       `gorm:"type:text" json:"notes,omitempty"`
+	ExternalRefundID string       `json:"external_refund_id,omitempty"` // the payment provider's refund
+	CreatedAt        time.Time    `gorm:"index" json:"created_at"`
+	UpdatedAt        time.Time    `json:"updated_at"`
 
 	// Relationships
-	Purchase Purchase `gorm:"foreignKey:PurchaseID" json:"purchase,omitempty"`
+	Purchase *Purchase `gorm:"foreignKey:PurchaseID" json:"purchase,omitempty"`
 }
 
-// Enums
-type UserRole string
-const (
-	UserRoleUser    UserRole = "user"
-	UserRolePublisher UserRole = "publisher"
-	UserRoleAdmin   UserRole = "admin"
-)
+// Organization is a team that manages agents together. Its members have
+// a role in it through their membership.
+type Organization struct {
+	ID        uuid.UUID      `gorm:"type:uuid;primary_key" json:"id"`
+	Name      string         `gorm:"not null" json:"name"`
+	Slug      string         `gorm:"not null;uniqueIndex" json:"slug"`
+	LogoURL   string         `json:"logo_url"` // uploaded image or generated identicon
+	CreatedBy uuid.UUID      `gorm:"type:uuid;not null" json:"created_by"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+}
 
-type UserStatus string
-const (
-	UserStatusActive   UserStatus = "active"
-	UserStatusInactive UserStatus = "inactive"
-	UserStatusBanned   UserStatus = "banned"
-)
+// Membership is a user's role in an organization
+type Membership struct {
+	OrganizationID   uuid.UUID `gorm:"type:uuid;primaryKey" json:"organization_id"`
+	UserID           uuid.UUID `gorm:"type:uuid;primaryKey;index" json:"user_id"`
+	Role             OrgRole   `gorm:"type:varchar(20);not null" json:"role"`
+	PurchaseApprover bool      `gorm:"not null;default:false" json:"purchase_approver"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
 
-type AgentStatus string
-const (
-	AgentStatusDraft     AgentStatus = "draft"
-	AgentStatusPending   AgentStatus = "pending"
-	AgentStatusPublished AgentStatus = "published"
-	AgentStatusRejected  AgentStatus = "rejected"
-	AgentStatusArchived  AgentStatus = "archived"
-)
+	// Relationships
+	Organization *Organization `gorm:"foreignKey:OrganizationID" json:"organization,omitempty"`
+	User         *User         `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
 
-type SafetyLevel string
-const (
-	SafetyLevelBasic    SafetyLevel = "basic"
-	SafetyLevelStandard SafetyLevel = "standard"
-	SafetyLevelAdvanced SafetyLevel = "advanced"
-	SafetyLevelCritical SafetyLevel = "critical"
-)
+// OrgInvitation invites a user to join an organization with a role. It
+// stays pending until the user accepts or declines it.
+type OrgInvitation struct {
+	ID             uuid.UUID           `gorm:"type:uuid;primary_key" json:"id"`
+	OrganizationID uuid.UUID           `gorm:"type:uuid;not null;index" json:"organization_id"`
+	UserID         uuid.UUID           `gorm:"type:uuid;not null;index" json:"user_id"`
+	Role           OrgRole             `gorm:"type:varchar(20);not null" json:"role"`
+	Status         OrgInvitationStatus `gorm:"type:varchar(20);default:'pending';index" json:"status"`
+	InvitedBy      uuid.UUID           `gorm:"type:uuid;not null" json:"invited_by"`
+	RespondedAt    *time.Time          `json:"responded_at,omitempty"`
+	CreatedAt      time.Time           `json:"created_at"`
 
-type PurchaseStatus string
-const (
-	PurchaseStatusPending   PurchaseStatus = "pending"
-	PurchaseStatusCompleted PurchaseStatus = "completed"
-	PurchaseStatusFailed    PurchaseStatus = "failed"
-	PurchaseStatusRefunded  PurchaseStatus = "refunded"
-)
+	// Relationships
+	Organization *Organization `gorm:"foreignKey:OrganizationID" json:"organization,omitempty"`
+}
 
-type TransactionType string
-const (
-	TransactionTypePurchase TransactionType = "purchase"
-	TransactionTypeRefund  TransactionType = "refund"
-	TransactionTypeFee     TransactionType = "fee"
-)
+// OrgPurchasePolicy is how an organization approves the purchases its
+// members request. Without one, a single approval is needed.
+type OrgPurchasePolicy struct {
+	OrganizationID      uuid.UUID `gorm:"type:uuid;primaryKey" json:"organization_id"`
+	RequiredApprovals   int       `gorm:"not null;default:1" json:"required_approvals"`
+	AutoApproveMinor    Money     `gorm:"column:auto_approve_minor;not null;default:0" json:"auto_approve_minor"` // requests up to this amount need no approval
+	AutoApproveCurrency string    `json:"auto_approve_currency,omitempty"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
 
-type TransactionStatus string
-const (
-	TransactionStatusPending   TransactionStatus = "pending"
-	TransactionStatusCompleted TransactionStatus = "completed"
-	TransactionStatusFailed    TransactionStatus = "failed"
-	TransactionStatusCancelled TransactionStatus = "cancelled"
-)
+// OrgPurchaseRequest is a member's request to buy an agent for their
+// organization. The payment is authorized when it is requested and only
+// captured once approved, and the purchase then belongs to the organization.
+type OrgPurchaseRequest struct {
+	ID             uuid.UUID         `gorm:"type:uuid;primary_key" json:"id"`
+	OrganizationID uuid.UUID         `gorm:"type:uuid;not null;index" json:"organization_id"`
+	RequesterID    uuid.UUID         `gorm:"type:uuid;not null;index" json:"requester_id"`
+	AgentID        uuid.UUID         `gorm:"type:uuid;not null" json:"agent_id"`
+	Amount         Money             `gorm:"column:amount_minor;not null" json:"amount_minor"`
+	AmountDisplay  string            `gorm:"-" json:"amount"`
+	Currency       string            `gorm:"not null" json:"currency"`
+	Justification  string            `gorm:"type:text" json:"justification"`
+	PaymentID      string            `json:"-"`
+	Status         OrgPurchaseStatus `gorm:"type:varchar(20);default:'pending';index" json:"status"`
+	AutoApproved   bool              `gorm:"not null;default:false" json:"auto_approved"`
+	FailureReason  string            `json:"failure_reason,omitempty"`
+	PurchaseID     *uuid.UUID        `gorm:"type:uuid" json:"purchase_id,omitempty"`
+	DecidedAt      *time.Time        `json:"decided_at,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
 
-// BeforeCreate hooks
-func (u *User) BeforeCreate(tx *gorm.DB) error {
-	if u.ID == uuid.Nil {
-		u.ID = uuid.New()
-	}
-	return nil
+	// Relationships
+	Agent     *Agent                `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+	Requester *User                 `gorm:"foreignKey:RequesterID" json:"requester,omitempty"`
+	Approvals []OrgPurchaseApproval `gorm:"foreignKey:RequestID" json:"approvals,omitempty"`
 }
 
-func (a *Agent) BeforeCreate(tx *gorm.DB) error {
-	if a.ID == uuid.Nil {
-		a.ID = uuid.New()
-	}
-	return nil
+// OrgPurchaseApproval is an approver's decision on a purchase request
+type OrgPurchaseApproval struct {
+	RequestID  uuid.UUID `gorm:"type:uuid;primaryKey" json:"request_id"`
+	ApproverID uuid.UUID `gorm:"type:uuid;primaryKey" json:"approver_id"`
+	Approved   bool      `gorm:"not null" json:"approved"`
+	Comment    string    `gorm:"type:text" json:"comment,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
 }
 
-func (p *Purchase) BeforeCreate(tx *gorm.DB) error {
-	if p.ID == uuid.Nil {
-		p.ID = uuid.New()
-	}
-	return nil
+// PublisherApplication is a user's request to become a publisher, with the
+// business details an admin reviews before approving it
+type PublisherApplication struct {
+	ID              uuid.UUID                  `gorm:"type:uuid;primary_key" json:"id"`
+	UserID          uuid.UUID                  `gorm:"type:uuid;not null;index" json:"user_id"`
+	CompanyName     string                     `gorm:"not null" json:"company_name"`
+	Website         string                     `json:"website,omitempty"`
+	Country         string                     `gorm:"type:char(2);not null" json:"country"` // ISO 3166-1 alpha-2
+	Address         string                     `gorm:"type:text;not null" json:"address"`
+	TaxID           string                     `gorm:"not null" json:"tax_id"` // e.g. EIN or VAT number
+	Status          PublisherApplicationStatus `gorm:"type:varchar(20);default:'pending';index" json:"status"`
+	RejectionReason string                     `gorm:"type:text" json:"rejection_reason,omitempty"`
+	ReviewedBy      *uuid.UUID                 `gorm:"type:uuid" json:"reviewed_by,omitempty"`
+	ReviewedAt      *time.Time                 `json:"reviewed_at,omitempty"`
+	CreatedAt       time.Time                  `gorm:"index" json:"created_at"`
+	UpdatedAt       time.Time                  `json:"updated_at"`
+
+	// Relationships
+	User *User `gorm:"foreignKey:UserID" json:"user,omitempty"`
 }
 
-func (r *Review) BeforeCreate(tx *gorm.DB) error {
-	if r.ID == uuid.Nil {
-		r.ID = uuid.New()
-	}
-	return nil
+// PayoutAccount is the account at the payment provider that a publisher's
+// earnings are paid into. It becomes active once the publisher finished the
+// provider's onboarding.
+type PayoutAccount struct {
+	ID          uuid.UUID           `gorm:"type:uuid;primary_key" json:"id"`
+	PublisherID uuid.UUID           `gorm:"type:uuid;not null;uniqueIndex" json:"publisher_id"`
+	Provider    string              `gorm:"not null" json:"provider"`
+	ExternalID  string              `gorm:"not null" json:"external_id"` // e.g. the Stripe Connect account
+	Status      PayoutAccountStatus `gorm:"type:varchar(20);default:'pending'" json:"status"`
+	CreatedAt   time.Time           `json:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at"`
 }
 
-func (f *Favorite) BeforeCreate(tx *gorm.DB) error {
-	if f.ID == uuid.Nil {
-		f.ID = uuid.New()
+// Payout is one payment of a publisher's earnings in a currency: their
+// completed purchases less marketplace commission, less purchases refunded
+// after an earlier payout.
+type Payout struct {
+	ID             uuid.UUID    `gorm:"type:uuid;primary_key" json:"id"`
+	PublisherID    uuid.UUID    `gorm:"type:uuid;not null;index" json:"publisher_id"`
+	Currency       string       `gorm:"not null" json:"currency"`
+	Gross          Money        `gorm:"column:gross_minor;not null" json:"gross_minor"`
+	Commission     Money        `gorm:"column:commission_minor;not null" json:"commission_minor"`
+	Reversals      Money        `gorm:"column:reversals_minor;not null;default:0" json:"reversals_minor"`
+	Amount         Money        `gorm:"column:amount_minor;not null" json:"amount_minor"`
+	AmountDisplay  string       `gorm:"-" json:"amount"`
+	PurchaseCount  int          `json:"purchase_count"`
+	Status         PayoutStatus `gorm:"type:varchar(20);default:'pending';index" json:"status"`
+	ExternalID     string       `json:"external_id,omitempty"` // the payment provider's transfer
+	FailureReason  string       `gorm:"type:text" json:"failure_reason,omitempty"`
+	PaidAt         *time.Time   `json:"paid_at,omitempty"`
+	CreatedAt      time.Time    `gorm:"index" json:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at"`
+}
+
+// CheckoutSession tracks a buyer's checkout of an agent so that abandoned
+// checkouts can be detected and recovered
+type CheckoutSession struct {
+	ID                 uuid.UUID      `gorm:"type:uuid;primary_key" json:"id"`
+	BuyerID            uuid.UUID      `gorm:"type:uuid;not null;index" json:"buyer_id"`
+	AgentID            uuid.UUID      `gorm:"type:uuid;not null" json:"agent_id"`
+	Amount             Money          `gorm:"column:amount_minor;not null" json:"amount_minor"`
+	AmountDisplay      string         `gorm:"-" json:"amount"`
+	Currency           string         `gorm:"not null" json:"currency"`
+	Status             CheckoutStatus `gorm:"type:varchar(20);default:'open';index" json:"status"`
+	PlanID             *uuid.UUID     `gorm:"type:uuid" json:"plan_id,omitempty"`
+	PurchaseID         *uuid.UUID     `gorm:"type:uuid" json:"purchase_id,omitempty"`
+	LastActivityAt     time.Time      `gorm:"index" json:"last_activity_at"`
+	AbandonedAt        *time.Time     `json:"abandoned_at,omitempty"`
+	RecoveryNotifiedAt *time.Time     `json:"recovery_notified_at,omitempty"`
+	CompletedAt        *time.Time     `json:"completed_at,omitempty"`
+	CreatedAt          time.Time      `json:"created_at"`
+	UpdatedAt          time.Time      `json:"updated_at"`
+
+	// Relationships
+	Buyer User  `gorm:"foreignKey:BuyerID" json:"buyer,omitempty"`
+	Agent Agent `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+}
+
+// FraudRule is an admin-configured check evaluated when a checkout completes
+type FraudRule struct {
+	ID        uuid.UUID       `gorm:"type:uuid;primary_key" json:"id"`
+	Name      string          `gorm:"not null" json:"name"`
+	Type      FraudRuleType   `gorm:"type:varchar(40);not null" json:"type"`
+	Params    FraudRuleParams `gorm:"type:text" json:"params"`
+	Action    FraudAction     `gorm:"type:varchar(20);not null" json:"action"`
+	Enabled   bool            `json:"enabled"`
+
+	// Outcome feedback on the purchases this rule matched
+	Matches        int `gorm:"default:0" json:"matches"`
+	ConfirmedFraud int `gorm:"default:0" json:"confirmed_fraud"`
+	FalsePositives int `gorm:"default:0" json:"false_positives"`
+
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// FraudRuleParams holds the type-specific settings of a fraud rule
+type FraudRuleParams struct {
+	Scope   string   `json:"scope,omitempty"`   // velocity: "buyer" or "ip"
+	Max     int      `json:"max,omitempty"`     // velocity: checkouts allowed per window
+	Window  string   `json:"window,omitempty"`  // velocity: duration such as "1h"
+	Domains []string `json:"domains,omitempty"` // disposable_email: domains added to the built-in list
+}
+
+// Value implements driver.Valuer
+func (p FraudRuleParams) Value() (driver.Value, error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return string(b), nil
 }
 
-func (t *Transaction) BeforeCreate(tx *gorm.DB) error {
-	if t.ID == uuid.Nil {
-		t.ID = uuid.New()
+// Scan implements sql.Scanner
+func (p *FraudRuleParams) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*p = FraudRuleParams{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, p)
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	default:
+		return fmt.Errorf("unsupported fraud rule params value %T", value)
 	}
-	return nil
-} 
\ No newline at end of file
+}
+
+// FraudAssessment records the fraud rule evaluation of a checkout and, for
+// held purchases, the manual review
+type FraudAssessment struct {
+	ID                uuid.UUID         `gorm:"type:uuid;primary_key" json:"id"`
+	CheckoutSessionID uuid.UUID         `gorm:"type:uuid;not null;index" json:"checkout_session_id"`
+	PurchaseID        *uuid.UUID        `gorm:"type:uuid;index" json:"purchase_id,omitempty"` // nil when blocked
+	BuyerID           uuid.UUID         `gorm:"type:uuid;not null;index" json:"buyer_id"`
+	IP                string            `gorm:"index" json:"ip"`
+	IPCountry         string            `json:"ip_country"`
+	BillingCountry    string            `json:"billing_country"`
+	Decision          FraudAction       `gorm:"type:varchar(20);not null" json:"decision"`
+	ReviewStatus      FraudReviewStatus `gorm:"type:varchar(20);default:'none';index" json:"review_status"`
+	ReviewedBy        *uuid.UUID        `gorm:"type:uuid" json:"reviewed_by,omitempty"`
+	ReviewedAt        *time.Time        `json:"reviewed_at,omitempty"`
+	Outcome           FraudOutcome      `gorm:"type:varchar(20)" json:"outcome,omitempty"`
+	Notes             string            `gorm:"type:text" json:"notes,omitempty"`
+	CreatedAt         time.Time         `gorm:"index" json:"created_at"`
+
+	// Relationships
+	MatchedRules []FraudRule `gorm:"many2many:fraud_assessment_rules" json:"matched_rules,omitempty"`
+	Purchase     *Purchase   `gorm:"foreignKey:PurchaseID" json:"purchase,omitempty"`
+	Buyer        User        `gorm:"foreignKey:BuyerID" json:"buyer,omitempty"`
+}
+
+// Deployment is a metered agent running on one of a buyer's devices. It is
+// billed per device-month for months in which the device checked in.
+type Deployment struct {
+	ID               uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	BuyerID          uuid.UUID  `gorm:"type:uuid;not null;index" json:"buyer_id"`
+	AgentID          uuid.UUID  `gorm:"type:uuid;not null;index" json:"agent_id"`
+	DeviceID         string     `gorm:"not null" json:"device_id"` // buyer-assigned device identifier
+	Version          string     `json:"version"`                   // release pinned on the device
+	DeployedAt       time.Time  `gorm:"not null" json:"deployed_at"`
+	DecommissionedAt *time.Time `json:"decommissioned_at,omitempty"`
+	LastCheckInAt    *time.Time `json:"last_check_in_at,omitempty"`
+	RunningVersion   string     `json:"running_version,omitempty"`                // last release the device reported applied
+	OfflineAt        *time.Time `json:"offline_at,omitempty"`                     // set when the device was reported offline, cleared on check-in
+	TraceID          uuid.UUID  `gorm:"type:uuid;not null;index" json:"trace_id"` // of the bundle purchase it was deployed from, or its own ID
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+
+	// Relationships
+	Agent Agent `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+}
+
+// FleetRollout pins a release of a metered agent on a set of a buyer's
+// devices, wave by wave. Waves are cumulative percentages of the devices;
+// the rollout halts when the share of failed devices exceeds
+// FailureThreshold.
+type FleetRollout struct {
+	ID               uuid.UUID           `gorm:"type:uuid;primary_key" json:"id"`
+	BuyerID          uuid.UUID           `gorm:"type:uuid;not null;index" json:"buyer_id"`
+	AgentID          uuid.UUID           `gorm:"type:uuid;not null" json:"agent_id"`
+	Version          string              `gorm:"not null" json:"version"`
+	Strategy         RolloutStrategy     `gorm:"type:varchar(20);not null" json:"strategy"`
+	Waves            Percentages         `gorm:"type:text" json:"waves"`
+	WaveInterval     int                 `gorm:"not null;default:0" json:"wave_interval"` // minimum seconds between waves
+	FailureThreshold int                 `gorm:"not null" json:"failure_threshold"`       // percentage of failed devices
+	Status           FleetRolloutStatus  `gorm:"type:varchar(20);default:'in_progress';index" json:"status"`
+	CurrentWave      int                 `gorm:"not null;default:0" json:"current_wave"` // index into Waves
+	WaveStartedAt    time.Time           `json:"wave_started_at"`
+	HaltReason       string              `json:"halt_reason,omitempty"`
+	CreatedAt        time.Time           `json:"created_at"`
+	UpdatedAt        time.Time           `json:"updated_at"`
+	FinishedAt       *time.Time          `json:"finished_at,omitempty"`
+
+	// Relationships
+	Targets []FleetRolloutTarget `gorm:"foreignKey:RolloutID" json:"targets,omitempty"`
+}
+
+// FleetRolloutTarget is one device of a fleet rollout and how the release
+// fared on it
+type FleetRolloutTarget struct {
+	ID           uuid.UUID          `gorm:"type:uuid;primary_key" json:"id"`
+	RolloutID    uuid.UUID          `gorm:"type:uuid;not null;index" json:"rollout_id"`
+	DeviceID     string             `gorm:"not null" json:"device_id"`
+	Wave         int                `gorm:"not null" json:"wave"`
+	Status       RolloutTargetStatus `gorm:"type:varchar(20);default:'pending';index" json:"status"`
+	DeploymentID *uuid.UUID         `gorm:"type:uuid;index" json:"deployment_id,omitempty"`
+	Error        string             `gorm:"type:text" json:"error,omitempty"`
+	StartedAt    *time.Time         `json:"started_at,omitempty"`
+	FinishedAt   *time.Time         `json:"finished_at,omitempty"`
+}
+
+// DeploymentTransfer records a buyer moving a deployment from a replaced
+// device to its successor. The old deployment is decommissioned and a new
+// one carries on with the same release.
+type DeploymentTransfer struct {
+	ID               uuid.UUID            `gorm:"type:uuid;primary_key" json:"id"`
+	BuyerID          uuid.UUID            `gorm:"type:uuid;not null;index:idx_transfer_buyer,priority:1" json:"buyer_id"`
+	AgentID          uuid.UUID            `gorm:"type:uuid;not null;index:idx_transfer_buyer,priority:2;index" json:"agent_id"`
+	FromDeploymentID uuid.UUID            `gorm:"type:uuid;not null" json:"from_deployment_id"`
+	ToDeploymentID   uuid.UUID            `gorm:"type:uuid;not null" json:"to_deployment_id"`
+	FromDeviceID     string               `gorm:"not null" json:"from_device_id"`
+	ToDeviceID       string               `gorm:"not null" json:"to_device_id"`
+	Verification     TransferVerification `gorm:"type:varchar(20);not null" json:"verification"`
+	LastSeenAt       *time.Time           `json:"last_seen_at,omitempty"` // of the old device, when transferred
+	Reason           string               `gorm:"type:text" json:"reason,omitempty"`
+	CreatedAt        time.Time            `gorm:"index:idx_transfer_buyer,priority:3" json:"created_at"`
+}
+
+// WebhookSubscription sends a user's events of the subscribed types to a URL.
+// Each delivery is signed with the subscription's secret.
+type WebhookSubscription struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index" json:"user_id"`
+	URL       string    `gorm:"not null" json:"url"`
+	Secret    string    `gorm:"not null" json:"-"`
+	Events    Tags      `gorm:"type:text" json:"events"`
+	Active    bool      `gorm:"not null;default:true" json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery is one event queued for, or sent to, a subscription
+type WebhookDelivery struct {
+	ID             uuid.UUID             `gorm:"type:uuid;primary_key" json:"id"`
+	SubscriptionID uuid.UUID             `gorm:"type:uuid;not null;index" json:"subscription_id"`
+	Event          WebhookEvent          `gorm:"type:varchar(40);not null" json:"event"`
+	Payload        string                `gorm:"type:text;not null" json:"payload"` // JSON body sent
+	Status         WebhookDeliveryStatus `gorm:"type:varchar(20);not null;index:idx_webhook_delivery_due,priority:1" json:"status"`
+	Attempts       int                   `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt  time.Time             `gorm:"not null;index:idx_webhook_delivery_due,priority:2" json:"next_attempt_at"`
+	ResponseCode   int                   `json:"response_code,omitempty"`
+	LastError      string                `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time            `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time             `json:"created_at"`
+}
+
+// StreamEvent is an event for a user's live event streams. It is written in
+// the transaction of the change it reports, published to Redis once
+// committed, and kept for a while so that reconnecting clients catch up.
+type StreamEvent struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"` // time ordered, so it orders a user's events
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	Event     string     `gorm:"type:varchar(40);not null" json:"event"`
+	Payload   string     `gorm:"type:text;not null" json:"payload"` // JSON sent to the streams
+	RelayedAt *time.Time `gorm:"index" json:"relayed_at,omitempty"` // when it was published to Redis
+	CreatedAt time.Time  `gorm:"index" json:"created_at"`
+}
+
+// SearchOutboxEntry records that an agent changed and must be indexed
+// again. Entries are written by triggers on agents, in the transaction of
+// the change, and removed once the index has caught up.
+type SearchOutboxEntry struct {
+	ID            int64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	AgentID       uuid.UUID `gorm:"type:uuid;not null;index" json:"agent_id"`
+	Attempts      int       `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt time.Time `gorm:"not null;default:now();index" json:"next_attempt_at"`
+	LastError     string    `gorm:"type:text" json:"last_error,omitempty"`
+	CreatedAt     time.Time `gorm:"not null;default:now()" json:"created_at"`
+}
+
+// SearchReindex is a rebuild of the search index from the database. It is
+// indexed in batches ordered by agent ID, so it resumes after a restart.
+type SearchReindex struct {
+	ID          uuid.UUID           `gorm:"type:uuid;primary_key" json:"id"`
+	Status      SearchReindexStatus `gorm:"type:varchar(20);not null;default:'running';index" json:"status"`
+	Total       int64               `gorm:"not null;default:0" json:"total"`   // agents when it started
+	Indexed     int64               `gorm:"not null;default:0" json:"indexed"`
+	Removed     int64               `gorm:"not null;default:0" json:"removed"` // documents of agents no longer in the database
+	Cursor      *uuid.UUID          `gorm:"type:uuid" json:"-"`                // last agent indexed
+	LastError   string              `gorm:"type:text" json:"last_error,omitempty"`
+	RequestedBy uuid.UUID           `gorm:"type:uuid;not null" json:"requested_by"`
+	StartedAt   time.Time           `json:"started_at"`
+	CompletedAt *time.Time          `json:"completed_at,omitempty"`
+}
+
+// SearchConsistencyCheck is the outcome of comparing the search index with
+// the database. Missing, stale and orphaned agents are queued for indexing.
+type SearchConsistencyCheck struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	Agents    int       `gorm:"not null" json:"agents"`   // in the database
+	Documents int       `gorm:"not null" json:"documents"` // in the index
+	Missing   int       `gorm:"not null" json:"missing"`
+	Stale     int       `gorm:"not null" json:"stale"`
+	Orphaned  int       `gorm:"not null" json:"orphaned"`
+	CheckedAt time.Time `gorm:"index" json:"checked_at"`
+}
+
+// Device is an edge device in the registry. Devices are provisioned with a
+// claim code, shipped with the device, that a user enters to add it to
+// their fleet; users can also register their own devices by importing them.
+// Deployments refer to a registered device by its serial.
+type Device struct {
+	ID            uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	Serial        string     `gorm:"not null;uniqueIndex" json:"serial"`
+	HardwareModel string     `json:"hardware_model"`
+	MCU           string     `json:"mcu,omitempty"`     // microcontroller, e.g. STM32F407
+	ClaimCodeHash string     `gorm:"not null" json:"-"` // bcrypt; empty for devices users registered themselves
+	ProvisionedBy uuid.UUID  `gorm:"type:uuid;not null" json:"-"`
+	LastSeenAt    *time.Time `json:"last_seen_at,omitempty"`  // last check-in on the device API
+	HealthStatus  string     `json:"health_status,omitempty"` // as last reported by the device, e.g. ok, degraded
+	Uptime        int64      `json:"uptime,omitempty"`        // in seconds, as last reported
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// DeviceCertificate is a client certificate issued to a device for the
+// device API. A certificate issued by rotation replaces the one the device
+// rotated with, which is revoked once the new certificate is first used.
+type DeviceCertificate struct {
+	ID           uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	DeviceID     uuid.UUID  `gorm:"type:uuid;not null;index" json:"device_id"`
+	SerialNumber string     `gorm:"not null;uniqueIndex" json:"serial_number"` // hex
+	Fingerprint  string     `gorm:"not null;uniqueIndex" json:"fingerprint"`   // hex SHA-256 of the DER certificate
+	CertPEM      string     `gorm:"type:text;not null" json:"certificate"`
+	Replaces     *uuid.UUID `gorm:"type:uuid" json:"replaces,omitempty"`
+	NotBefore    time.Time  `gorm:"not null" json:"not_before"`
+	NotAfter     time.Time  `gorm:"not null" json:"not_after"`
+	FirstUsedAt  *time.Time `json:"first_used_at,omitempty"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+
+	// Relationships
+	Device Device `gorm:"foreignKey:DeviceID" json:"-"`
+}
+
+// DeviceClaim is a user's ownership of a device, from claiming it until
+// releasing it. A device has at most one active claim.
+type DeviceClaim struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	DeviceID   uuid.UUID  `gorm:"type:uuid;not null;index" json:"device_id"`
+	UserID     uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	Name       string     `json:"name"` // given by the user
+	Group      string     `gorm:"column:device_group;index" json:"group,omitempty"` // given by the user, to roll out to several devices at once
+	Site       string     `json:"site,omitempty"` // where the device is installed
+	ClaimedAt  time.Time  `gorm:"not null" json:"claimed_at"`
+	ReleasedAt *time.Time `json:"released_at,omitempty"`
+
+	// Relationships
+	Device Device `gorm:"foreignKey:DeviceID" json:"device"`
+}
+
+// DeviceResources is the latest free-resource report of one of a user's
+// devices, identified like deployments by the buyer-assigned device ID
+type DeviceResources struct {
+	OwnerID       uuid.UUID `gorm:"type:uuid;primaryKey" json:"owner_id"`
+	DeviceID      string    `gorm:"primaryKey" json:"device_id"`
+	FlashFree     int       `gorm:"not null" json:"flash_free"`     // in bytes
+	SRAMFree      int       `gorm:"not null" json:"sram_free"`      // in bytes
+	LatencyBudget int       `gorm:"not null" json:"latency_budget"` // in microseconds, 0 = no deadline
+	ReportedAt    time.Time `gorm:"not null" json:"reported_at"`
+}
+
+// CurationRule fills a featured storefront slot with the published agents
+// matching its expression, e.g. "category=protection AND rating>=4.5 AND
+// verified_publisher". A rule only applies between StartsAt and EndsAt.
+type CurationRule struct {
+	ID          uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	Name        string     `gorm:"not null" json:"name"`
+	Slot        string     `gorm:"type:varchar(64);not null;index" json:"slot"` // e.g. home, protection
+	Expression  string     `gorm:"type:text;not null" json:"expression"`
+	Priority    int        `gorm:"default:0" json:"priority"` // lower fills the slot first
+	MaxAgents   int        `gorm:"default:10" json:"max_agents"`
+	Enabled     bool       `gorm:"default:true" json:"enabled"`
+	StartsAt    *time.Time `json:"starts_at,omitempty"`
+	EndsAt      *time.Time `json:"ends_at,omitempty"`
+	CreatedBy   uuid.UUID  `gorm:"type:uuid;not null" json:"created_by"`
+	LastRunAt   *time.Time `json:"last_run_at,omitempty"`
+	LastMatched int        `json:"last_matched"` // agents placed by the last run
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// PlatformChangelogEntry is a release note about the marketplace itself,
+// written by admins. It is a draft until published; publishing notifies
+// its audience, once.
+type PlatformChangelogEntry struct {
+	ID          uuid.UUID         `gorm:"type:uuid;primary_key" json:"id"`
+	Title       string            `gorm:"not null" json:"title"`
+	Body        string            `gorm:"type:text;not null" json:"body"` // Markdown
+	Category    ChangelogCategory `gorm:"type:varchar(20);not null;index" json:"category"`
+	Version     string            `json:"version,omitempty"` // e.g. the API version the change shipped in
+	Audience    ChangelogAudience `gorm:"type:varchar(20);not null;default:'all'" json:"audience"`
+	AuthorID    uuid.UUID         `gorm:"type:uuid;not null" json:"author_id"`
+	PublishedAt *time.Time        `gorm:"index" json:"published_at,omitempty"`
+	NotifiedAt  *time.Time        `json:"notified_at,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+// FeaturedAgent is an agent shown in a featured slot, pinned by an admin
+// or placed by a curation rule
+type FeaturedAgent struct {
+	Slot      string     `gorm:"type:varchar(64);primaryKey" json:"slot"`
+	AgentID   uuid.UUID  `gorm:"type:uuid;primaryKey" json:"agent_id"`
+	Position  int        `gorm:"not null" json:"position"`
+	RuleID    *uuid.UUID `gorm:"type:uuid;index" json:"rule_id,omitempty"` // nil when pinned by hand
+	CreatedAt time.Time  `json:"created_at"`
+
+	// Relationships
+	Agent Agent `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+}
+
+// Bundle is a pipeline of agent versions deployed together on one device,
+// e.g. filter → detector → actuator
+type Bundle struct {
+	ID          uuid.UUID    `gorm:"type:uuid;primary_key" json:"id"`
+	OwnerID     uuid.UUID    `gorm:"type:uuid;not null;index" json:"owner_id"`
+	Name        string       `gorm:"not null" json:"name"`
+	Description string       `gorm:"type:text" json:"description"`
+	Wiring      BundleWiring `gorm:"type:text" json:"wiring"`
+
+	// Target device the combined resource budget is validated against, 0 = unchecked
+	TargetFlashSize  int `json:"target_flash_size"`  // in bytes
+	TargetSRAMSize   int `json:"target_sram_size"`   // in bytes
+	TargetMaxLatency int `json:"target_max_latency"` // end-to-end, in microseconds
+
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+
+	// Relationships
+	Owner      User              `gorm:"foreignKey:OwnerID" json:"owner,omitempty"`
+	Components []BundleComponent `gorm:"foreignKey:BundleID" json:"components"`
+}
+
+// BundleComponent is one agent version in a bundle
+type BundleComponent struct {
+	ID       uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	BundleID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_bundle_component_key" json:"bundle_id"`
+	Key      string    `gorm:"not null;uniqueIndex:idx_bundle_component_key" json:"key"` // name used in the wiring, e.g. "detector"
+	AgentID  uuid.UUID `gorm:"type:uuid;not null;index" json:"agent_id"`
+	Version  string    `gorm:"not null" json:"version"`
+	Position int       `gorm:"not null" json:"position"`
+
+	// Relationships
+	Agent   Agent         `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+	Release *AgentVersion `gorm:"-" json:"release,omitempty"` // specs of the pinned version
+}
+
+// BundleConnection wires an output signal of one component to an input
+// signal of another, as "key.signal"
+type BundleConnection struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// BundleWiring is the list of connections between a bundle's components
+type BundleWiring []BundleConnection
+
+// Value implements driver.Valuer
+func (w BundleWiring) Value() (driver.Value, error) {
+	if w == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]BundleConnection(w))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (w *BundleWiring) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*w = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, w)
+	case string:
+		return json.Unmarshal([]byte(v), w)
+	default:
+		return fmt.Errorf("unsupported bundle wiring value %T", value)
+	}
+}
+
+// DeploymentUsage marks a day on which a deployment checked in
+type DeploymentUsage struct {
+	DeploymentID uuid.UUID `gorm:"type:uuid;primaryKey" json:"deployment_id"`
+	Day          time.Time `gorm:"type:date;primaryKey" json:"day"`
+	CheckIns     int       `gorm:"not null;default:0" json:"check_ins"`
+}
+
+// TelemetrySample is one runtime measurement of an agent on a deployed
+// device. Samples are append-only and have no primary key: on Postgres the
+// table is partitioned by day of RecordedAt, or a TimescaleDB hypertable,
+// and old samples are dropped a partition at a time.
+type TelemetrySample struct {
+	DeploymentID     uuid.UUID `gorm:"type:uuid;not null" json:"deployment_id"`
+	AgentID          uuid.UUID `gorm:"type:uuid;not null;index:idx_telemetry_agent,priority:1" json:"agent_id"`
+	Version          string    `gorm:"not null;index:idx_telemetry_agent,priority:2" json:"version"`
+	RecordedAt       time.Time `gorm:"not null;index:idx_telemetry_agent,priority:3" json:"recorded_at"`
+	InferenceLatency *int      `json:"inference_latency,omitempty"` // in microseconds
+	TripEvents       int       `gorm:"not null;default:0" json:"trip_events"`
+	MemoryUsed       *int64    `json:"memory_used,omitempty"` // in bytes
+	ReceivedAt       time.Time `gorm:"not null" json:"received_at"`
+}
+
+// TelemetrySharingOptOut keeps the telemetry of a buyer's deployments of
+// one agent from its publisher, even though the buyer consents to sharing
+// telemetry in general
+type TelemetrySharingOptOut struct {
+	BuyerID   uuid.UUID `gorm:"type:uuid;primaryKey" json:"-"`
+	AgentID   uuid.UUID `gorm:"type:uuid;primaryKey" json:"agent_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Invoice bills a buyer for a month of metered usage in one currency
+type Invoice struct {
+	ID            uuid.UUID     `gorm:"type:uuid;primary_key" json:"id"`
+	BuyerID       uuid.UUID     `gorm:"type:uuid;not null;uniqueIndex:idx_invoice_period" json:"buyer_id"`
+	PeriodStart   time.Time     `gorm:"type:date;not null;uniqueIndex:idx_invoice_period" json:"period_start"`
+	PeriodEnd     time.Time     `gorm:"type:date;not null" json:"period_end"` // exclusive
+	Currency      string        `gorm:"not null;uniqueIndex:idx_invoice_period" json:"currency"`
+	Total         Money         `gorm:"column:total_minor;not null" json:"total_minor"`
+	TotalDisplay  string        `gorm:"-" json:"total"`
+	Status        InvoiceStatus `gorm:"type:varchar(20);default:'issued'" json:"status"`
+	CreatedAt     time.Time     `json:"created_at"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+
+	// Relationships
+	Lines []InvoiceLine `gorm:"foreignKey:InvoiceID" json:"lines,omitempty"`
+}
+
+// InvoiceLine is the charge for one deployment in an invoice period
+type InvoiceLine struct {
+	ID            uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	InvoiceID     uuid.UUID `gorm:"type:uuid;not null;index" json:"invoice_id"`
+	DeploymentID  uuid.UUID `gorm:"type:uuid;not null" json:"deployment_id"`
+	AgentID       uuid.UUID `gorm:"type:uuid;not null" json:"agent_id"`
+	DeviceID      string    `json:"device_id"`
+	DaysBilled    int       `json:"days_billed"` // days deployed within the period
+	DaysInPeriod  int       `json:"days_in_period"`
+	CheckInDays   int       `json:"check_in_days"`
+	UnitPrice     Money     `gorm:"column:unit_price_minor;not null" json:"unit_price_minor"` // per device-month
+	Amount        Money     `gorm:"column:amount_minor;not null" json:"amount_minor"`
+	AmountDisplay string    `gorm:"-" json:"amount"`
+	Currency      string    `gorm:"not null" json:"currency"`
+}
+
+// CreditEntry is a line in a user's credit ledger. Grants carry a positive
+// amount and track how much of it is left to spend; spends and expiries
+// carry a negative amount.
+type CreditEntry struct {
+	ID         uuid.UUID       `gorm:"type:uuid;primary_key" json:"id"`
+	UserID     uuid.UUID       `gorm:"type:uuid;not null;index" json:"user_id"`
+	Type       CreditEntryType `gorm:"type:varchar(20);not null" json:"type"`
+	Amount     Money           `gorm:"column:amount_minor;not null" json:"amount_minor"`
+	AmountDisplay string       `gorm:"-" json:"amount"`
+	Remaining  Money           `gorm:"column:remaining_minor;not null;default:0" json:"remaining_minor"` // unspent part of a grant
+	Currency   string          `gorm:"not null" json:"currency"`
+	Reason     string          `json:"reason,omitempty"`
+	ExpiresAt  *time.Time      `gorm:"index" json:"expires_at,omitempty"`
+	PurchaseID *uuid.UUID      `gorm:"type:uuid" json:"purchase_id,omitempty"`
+	CodeID     *uuid.UUID      `gorm:"type:uuid" json:"code_id,omitempty"`
+	GrantedBy  *uuid.UUID      `gorm:"type:uuid" json:"granted_by,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// CreditCode is a gift card or promotion code that grants credit when redeemed
+type CreditCode struct {
+	ID             uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	Code           string     `gorm:"uniqueIndex;not null" json:"code"`
+	Amount         Money      `gorm:"column:amount_minor;not null" json:"amount_minor"`
+	AmountDisplay  string     `gorm:"-" json:"amount"`
+	Currency       string     `gorm:"not null" json:"currency"`
+	ValidDays      int        `json:"valid_days"` // lifetime of the granted credit, 0 = no expiry
+	MaxRedemptions int        `json:"max_redemptions"` // 0 = unlimited
+	Redemptions    int        `gorm:"default:0" json:"redemptions"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"` // last day the code can be redeemed
+	CreatedBy      uuid.UUID  `gorm:"type:uuid;not null" json:"created_by"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// CreditRedemption records that a user redeemed a credit code
+type CreditRedemption struct {
+	CodeID     uuid.UUID `gorm:"type:uuid;primaryKey" json:"code_id"`
+	UserID     uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+}
+
+// Template is a starter project for new agents, scaffolded by the CLI's
+// agent init. Admins manage templates; their archives are versioned.
+type Template struct {
+	ID          uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	Slug        string    `gorm:"type:varchar(64);uniqueIndex;not null" json:"slug"`
+	Name        string    `gorm:"not null" json:"name"`
+	Description string    `gorm:"type:text" json:"description"`
+	MCUFamily   string    `gorm:"type:varchar(64);index;not null" json:"mcu_family"` // e.g. stm32f4, esp32, nrf52
+	Category    string    `gorm:"index;not null" json:"category"`
+	Version     string    `json:"version"` // latest uploaded version, empty until the first upload
+	Downloads   int       `gorm:"default:0" json:"downloads"`
+	CreatedBy   uuid.UUID `gorm:"type:uuid;not null" json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+
+	// Relationships
+	Versions []TemplateVersion `gorm:"foreignKey:TemplateID" json:"versions,omitempty"`
+}
+
+// TemplateVersion is one uploaded archive of a template
+type TemplateVersion struct {
+	ID              uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	TemplateID      uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_template_version" json:"template_id"`
+	Version         string    `gorm:"not null;uniqueIndex:idx_template_version" json:"version"`
+	Changelog       string    `gorm:"type:text" json:"changelog"`
+	ArchiveURL      string    `json:"-"` // handed out as presigned URLs only
+	ArchiveSize     int64     `json:"archive_size"`     // in bytes
+	ArchiveChecksum string    `json:"archive_checksum"` // hex SHA-256
+	ContentType     string    `json:"content_type"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// TemplateDownload records one download of a template for usage analytics
+type TemplateDownload struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	TemplateID uuid.UUID  `gorm:"type:uuid;not null;index" json:"template_id"`
+	Version    string     `gorm:"not null" json:"version"`
+	UserID     *uuid.UUID `gorm:"type:uuid" json:"user_id,omitempty"` // nil for anonymous downloads
+	Client     string     `gorm:"type:varchar(64)" json:"client"`     // e.g. cli, web
+	CreatedAt  time.Time  `gorm:"index" json:"created_at"`
+}
+
+// AgentDownload records a user's download of an agent release, under the
+// trace of the purchase that entitled them to it
+type AgentDownload struct {
+	ID        uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	AgentID   uuid.UUID  `gorm:"type:uuid;not null;index" json:"agent_id"`
+	Version   string     `gorm:"not null" json:"version"`
+	TraceID   *uuid.UUID `gorm:"type:uuid;index" json:"trace_id,omitempty"` // nil without a purchase, e.g. free agents and subscriptions
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// CustomDomain is a publisher's own domain serving a white-label storefront.
+// It only serves traffic once the publisher proved control of it through DNS.
+type CustomDomain struct {
+	ID                uuid.UUID  `gorm:"type:uuid;primary_key" json:"id"`
+	PublisherID       uuid.UUID  `gorm:"type:uuid;not null;index" json:"publisher_id"`
+	Domain            string     `gorm:"type:varchar(253);uniqueIndex;not null" json:"domain"`
+	VerificationToken string     `gorm:"not null" json:"verification_token"` // expected in a TXT record
+	VerifiedAt        *time.Time `json:"verified_at,omitempty"`
+	CertSource        CertSource `gorm:"type:varchar(20);default:'acme'" json:"cert_source"`
+	CertPEM           string     `gorm:"type:text" json:"-"`
+	KeyPEM            string     `gorm:"type:text" json:"-"`
+	CertExpiresAt     *time.Time `json:"cert_expires_at,omitempty"` // uploaded certificates only
+	BrandName         string     `json:"brand_name"`
+	LogoURL           string     `json:"logo_url"`
+	PrimaryColor      string     `gorm:"type:varchar(7)" json:"primary_color"` // e.g. #1a73e8
+	CORSOrigins       Tags       `gorm:"type:text" json:"cors_origins"`        // extra origins allowed besides the domain itself
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// ACMECacheEntry is an item of the ACME client's cache, such as an account
+// key or issued certificate, shared by all instances
+type ACMECacheEntry struct {
+	Key       string    `gorm:"primary_key" json:"key"`
+	Data      []byte    `gorm:"not null" json:"-"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Transaction represents a financial transaction
+type Transaction struct {
+	ID          uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	PurchaseID  uuid.UUID `gorm:"type:uuid;not null" json:"purchase_id"`
+	Amount      Money     `gorm:"column:amount_minor;not null" json:"amount_minor"`
+	AmountDisplay string  `gorm:"-" json:"amount"`
+	Currency    string    `gorm:"not null" json:"currency"`
+	Type        TransactionType `gorm:"type:varchar(20);not null" json:"type"`
+	Status      TransactionStatus `gorm:"type:varchar(20);default:'pending'" json:"status"`
+	PaymentMethod string  `gorm:"type:varchar(50)" json:"payment_method"`
+	ExternalID  string    `json:"external_id"`
+	Metadata    string    `gorm:"type:jsonb" json:"metadata"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Relationships
+	Purchase Purchase `gorm:"foreignKey:PurchaseID" json:"purchase,omitempty"`
+}
+
+// Tags is a list of agent tags stored as a JSON array in a text column so
+// the schema stays portable across Postgres, MySQL and SQLite
+type Tags []string
+
+// Value implements driver.Valuer
+func (t Tags) Value() (driver.Value, error) {
+	if t == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]string(t))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (t *Tags) Scan(value interface{}) error {
+	var raw []byte
+	switch v := value.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return fmt.Errorf("unsupported tags value %T", value)
+	}
+
+	var tags []string
+	if err := json.Unmarshal(raw, &tags); err != nil {
+		return fmt.Errorf("failed to decode tags: %w", err)
+	}
+	*t = tags
+	return nil
+}
+
+// AuditSnapshot is the audited fields of an entity, stored as a JSON object
+// in a text column
+type AuditSnapshot map[string]interface{}
+
+// Value implements driver.Valuer
+func (s AuditSnapshot) Value() (driver.Value, error) {
+	if s == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(map[string]interface{}(s))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (s *AuditSnapshot) Scan(value interface{}) error {
+	var raw []byte
+	switch v := value.(type) {
+	case nil:
+		*s = nil
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return fmt.Errorf("unsupported audit snapshot value %T", value)
+	}
+
+	var snapshot map[string]interface{}
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		return fmt.Errorf("failed to decode audit snapshot: %w", err)
+	}
+	*s = snapshot
+	return nil
+}
+
+// Percentages is a list of whole percentages stored as a JSON array in a
+// text column, like Tags
+type Percentages []int
+
+// Value implements driver.Valuer
+func (p Percentages) Value() (driver.Value, error) {
+	if p == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal([]int(p))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (p *Percentages) Scan(value interface{}) error {
+	var raw []byte
+	switch v := value.(type) {
+	case nil:
+		*p = nil
+		return nil
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	default:
+		return fmt.Errorf("unsupported percentages value %T", value)
+	}
+
+	var percentages []int
+	if err := json.Unmarshal(raw, &percentages); err != nil {
+		return fmt.Errorf("failed to decode percentages: %w", err)
+	}
+	*p = percentages
+	return nil
+}
+
+// TagFilter returns a portable WHERE clause and argument matching agents
+// tagged with tag. "!" is the LIKE escape character because MySQL parses
+// a backslash literal differently from Postgres and SQLite.
+func TagFilter(tag string) (string, interface{}) {
+	return "tags LIKE ? ESCAPE '!'", jsonListPattern(tag)
+}
+
+// HardwareTargetFilter returns a WHERE clause and argument matching agents
+// that list target among their hardware targets, like TagFilter
+func HardwareTargetFilter(target string) (string, interface{}) {
+	return "hardware_targets LIKE ? ESCAPE '!'", jsonListPattern(target)
+}
+
+// NormalizeHardwareTargets lower-cases and trims MCU family names and drops
+// blanks and duplicates, so that stm32f4 and STM32F4 facet together
+func NormalizeHardwareTargets(targets []string) Tags {
+	normalized := Tags{}
+	seen := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		target = strings.ToLower(strings.TrimSpace(target))
+		if target == "" || seen[target] {
+			continue
+		}
+		seen[target] = true
+		normalized = append(normalized, target)
+	}
+	return normalized
+}
+
+// jsonListPattern returns a LIKE pattern matching a JSON array in a text
+// column that contains value
+func jsonListPattern(value string) string {
+	encoded, _ := json.Marshal(value)
+	escaper := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return "%" + escaper.Replace(string(encoded)) + "%"
+}
+
+// Enums
+type UserRole string
+const (
+	UserRoleUser    UserRole = "user"
+	UserRolePublisher UserRole = "publisher"
+	UserRoleAdmin   UserRole = "admin"
+	UserRoleReseller UserRole = "reseller" // grants entitlements from seat pools bought offline
+)
+
+// PublisherTier is a publisher's plan, which sets their commission rate and limits
+type PublisherTier string
+const (
+	PublisherTierFree       PublisherTier = "free"
+	PublisherTierPro        PublisherTier = "pro"
+	PublisherTierEnterprise PublisherTier = "enterprise"
+)
+
+type UserStatus string
+const (
+	UserStatusActive   UserStatus = "active"
+	UserStatusInactive UserStatus = "inactive"
+	UserStatusBanned   UserStatus = "banned"
+)
+
+// AgentVersionStatus is the lifecycle of a release. A staged release is
+// served to part of the audience until it is promoted to published.
+// Deprecated releases can still be downloaded by their owners but not newly
+// deployed.
+type AgentVersionStatus string
+const (
+	AgentVersionStatusDraft      AgentVersionStatus = "draft"
+	AgentVersionStatusStaged     AgentVersionStatus = "staged"
+	AgentVersionStatusPublished  AgentVersionStatus = "published"
+	AgentVersionStatusDeprecated AgentVersionStatus = "deprecated"
+)
+
+type AgentStatus string
+const (
+	AgentStatusDraft     AgentStatus = "draft"
+	AgentStatusPending   AgentStatus = "pending"
+	AgentStatusPublished AgentStatus = "published"
+	AgentStatusRejected  AgentStatus = "rejected"
+	AgentStatusArchived  AgentStatus = "archived"
+)
+
+type SafetyLevel string
+const (
+	SafetyLevelBasic    SafetyLevel = "basic"
+	SafetyLevelStandard SafetyLevel = "standard"
+	SafetyLevelAdvanced SafetyLevel = "advanced"
+	SafetyLevelCritical SafetyLevel = "critical"
+)
+
+type PurchaseStatus string
+const (
+	PurchaseStatusPending   PurchaseStatus = "pending"
+	PurchaseStatusCompleted PurchaseStatus = "completed"
+	PurchaseStatusFailed    PurchaseStatus = "failed"
+	PurchaseStatusRefunded  PurchaseStatus = "refunded"
+	PurchaseStatusOnHold    PurchaseStatus = "on_hold" // held for fraud review
+)
+
+type PricingModel string
+const (
+	PricingModelOneTime PricingModel = "one_time"
+	PricingModelMetered PricingModel = "metered"
+)
+
+// ParsePricingModel validates a pricing model, defaulting to one-time
+func ParsePricingModel(model string) (PricingModel, error) {
+	switch PricingModel(model) {
+	case "":
+		return PricingModelOneTime, nil
+	case PricingModelOneTime, PricingModelMetered:
+		return PricingModel(model), nil
+	}
+	return "", fmt.Errorf("unsupported pricing model: %s", model)
+}
+
+// PlanInterval is how often a pricing plan is paid for
+type PlanInterval string
+const (
+	PlanIntervalOneTime   PlanInterval = "one_time"
+	PlanIntervalMonthly   PlanInterval = "monthly"
+	PlanIntervalAnnual    PlanInterval = "annual"
+	PlanIntervalPerDevice PlanInterval = "per_device" // monthly, per device
+)
+
+// SubscriptionStatus is where a subscription is in its lifecycle. It is
+// incomplete until its first payment and past due while the provider
+// retries a failed one.
+type SubscriptionStatus string
+const (
+	SubscriptionStatusIncomplete SubscriptionStatus = "incomplete"
+	SubscriptionStatusActive     SubscriptionStatus = "active"
+	SubscriptionStatusPastDue    SubscriptionStatus = "past_due"
+	SubscriptionStatusCanceled   SubscriptionStatus = "canceled"
+)
+
+type InvoiceStatus string
+const (
+	InvoiceStatusIssued InvoiceStatus = "issued"
+	InvoiceStatusPaid   InvoiceStatus = "paid"
+	InvoiceStatusVoid   InvoiceStatus = "void"
+)
+
+// CapabilityKind is the part of a capability descriptor a search term comes from
+type CapabilityKind string
+const (
+	CapabilityKindInput         CapabilityKind = "input"
+	CapabilityKindOutput        CapabilityKind = "output"
+	CapabilityKindActuation     CapabilityKind = "actuation"
+	CapabilityKindFailureMode   CapabilityKind = "failure_mode"
+	CapabilityKindAccessibility CapabilityKind = "accessibility"
+)
+
+type CreditEntryType string
+const (
+	CreditEntryTypeGrant     CreditEntryType = "grant"     // granted by an admin
+	CreditEntryTypePromotion CreditEntryType = "promotion" // redeemed from a credit code
+	CreditEntryTypeRefund    CreditEntryType = "refund"    // returned from a cancelled or refunded purchase
+	CreditEntryTypeSpend     CreditEntryType = "spend"
+	CreditEntryTypeExpiry    CreditEntryType = "expiry"
+)
+
+type TransactionType string
+const (
+	TransactionTypePurchase TransactionType = "purchase"
+	TransactionTypeRefund  TransactionType = "refund"
+	TransactionTypeFee     TransactionType = "fee"
+)
+
+type TransactionStatus string
+const (
+	TransactionStatusPending   TransactionStatus = "pending"
+	TransactionStatusCompleted TransactionStatus = "completed"
+	TransactionStatusFailed    TransactionStatus = "failed"
+	TransactionStatusCancelled TransactionStatus = "cancelled"
+)
+
+type NotificationType string
+const (
+	NotificationTypeReviewReminder   NotificationType = "review_reminder"
+	NotificationTypeCheckoutRecovery NotificationType = "checkout_recovery"
+	NotificationTypePublisherApplication NotificationType = "publisher_application"
+	NotificationTypeOrgInvitation        NotificationType = "org_invitation"
+	NotificationTypeBinaryScan           NotificationType = "binary_scan"
+	NotificationTypeOrgPurchase          NotificationType = "org_purchase"
+	NotificationTypeStaleDraft           NotificationType = "stale_draft"
+	NotificationTypeSubscription         NotificationType = "subscription"
+	NotificationTypeAPIUsage             NotificationType = "api_usage"
+	NotificationTypeUnsoldAgent          NotificationType = "unsold_agent"
+	NotificationTypeReviewReply          NotificationType = "review_reply"
+	NotificationTypePlatformUpdate       NotificationType = "platform_update"
+	NotificationTypeModeration           NotificationType = "moderation"
+	NotificationTypeAgentApproved        NotificationType = "agent_approved"
+	NotificationTypeAgentRejected        NotificationType = "agent_rejected"
+	NotificationTypeNewReview            NotificationType = "new_review"
+	NotificationTypeNewPurchase          NotificationType = "new_purchase"
+	NotificationTypeDeploymentFinished   NotificationType = "deployment_finished"
+)
+
+// NotificationChannel is a way notifications reach a user
+type NotificationChannel string
+const (
+	NotificationChannelInApp   NotificationChannel = "in_app"
+	NotificationChannelEmail   NotificationChannel = "email"
+	NotificationChannelWebhook NotificationChannel = "webhook" // the user's webhooks subscribed to notification events
+)
+
+// ConsentPurpose is a use of personal data that needs the user's consent
+type ConsentPurpose string
+const (
+	ConsentMarketingEmail   ConsentPurpose = "marketing_email"   // review reminders and checkout recovery emails
+	ConsentUsageAnalytics   ConsentPurpose = "usage_analytics"   // attributing downloads to the user in usage analytics
+	ConsentTelemetrySharing ConsentPurpose = "telemetry_sharing" // device telemetry in publishers' field data
+)
+
+// AttachmentVisibility is who can retrieve a review attachment
+type AttachmentVisibility string
+const (
+	AttachmentVisibilityPublic    AttachmentVisibility = "public"
+	AttachmentVisibilityPublisher AttachmentVisibility = "publisher" // the reviewer, the agent's publisher and admins
+)
+
+// DigestFrequency is how often notifications of a type are emailed.
+// Immediate ones are still batched when several are due at once, e.g.
+// after quiet hours.
+type DigestFrequency string
+const (
+	DigestFrequencyImmediate DigestFrequency = "immediate"
+	DigestFrequencyHourly    DigestFrequency = "hourly"
+	DigestFrequencyDaily     DigestFrequency = "daily"
+)
+
+type CheckoutStatus string
+const (
+	CheckoutStatusOpen      CheckoutStatus = "open"
+	CheckoutStatusAbandoned CheckoutStatus = "abandoned"
+	CheckoutStatusCompleted CheckoutStatus = "completed"
+)
+
+type FraudRuleType string
+const (
+	FraudRuleTypeVelocity        FraudRuleType = "velocity"
+	FraudRuleTypeCountryMismatch FraudRuleType = "country_mismatch"
+	FraudRuleTypeDisposableEmail FraudRuleType = "disposable_email"
+)
+
+// FraudAction is what happens to a checkout matching a rule. A rule with
+// the allow action only records its matches, which is useful for tuning.
+type FraudAction string
+const (
+	FraudActionAllow  FraudAction = "allow"
+	FraudActionReview FraudAction = "review"
+	FraudActionBlock  FraudAction = "block"
+)
+
+// LimitName identifies a limit that can be overridden. Tier limits default
+// to the user's plan, the others to the public API settings.
+type LimitName string
+const (
+	LimitMaxPublishedAgents   LimitName = "max_published_agents"
+	LimitStorageQuotaMB       LimitName = "storage_quota_mb"
+	LimitRequestsPerMinute    LimitName = "requests_per_minute"
+	LimitMaxFleetSize         LimitName = "max_fleet_size"
+	LimitMaxAPIKeys           LimitName = "max_api_keys"
+	LimitAPIRequestsPerMinute LimitName = "api_requests_per_minute"
+	LimitAPIRequestsPerDay    LimitName = "api_requests_per_day"
+)
+
+// APIKeyStatus is the state of an API product key. Suspended keys were
+// stopped for abuse and only an admin can reactivate them.
+type APIKeyStatus string
+const (
+	APIKeyStatusActive    APIKeyStatus = "active"
+	APIKeyStatusSuspended APIKeyStatus = "suspended"
+	APIKeyStatusRevoked   APIKeyStatus = "revoked"
+)
+
+// SignatureAlgorithm is the algorithm of a publisher's signing key. Both
+// sign the SHA-256 digest of a binary; ecdsa-p256 matches cosign's
+// sign-blob.
+type LegalHoldSubject string
+const (
+	LegalHoldSubjectUser         LegalHoldSubject = "user"
+	LegalHoldSubjectOrganization LegalHoldSubject = "organization"
+	LegalHoldSubjectAgent        LegalHoldSubject = "agent"
+)
+
+// ChangelogCategory classifies a platform changelog entry
+type ChangelogCategory string
+const (
+	ChangelogCategoryFeature     ChangelogCategory = "feature"
+	ChangelogCategoryImprovement ChangelogCategory = "improvement"
+	ChangelogCategoryFix         ChangelogCategory = "fix"
+	ChangelogCategoryDeprecation ChangelogCategory = "deprecation"
+)
+
+// ChangelogAudience is who is notified of a platform changelog entry
+type ChangelogAudience string
+const (
+	ChangelogAudienceAll        ChangelogAudience = "all" // publishers and API consumers
+	ChangelogAudiencePublishers ChangelogAudience = "publishers"
+	ChangelogAudienceAPI        ChangelogAudience = "api" // owners of active API keys
+)
+
+// ReportTarget is the kind of content a report is about
+type ReportTarget string
+const (
+	ReportTargetReview ReportTarget = "review"
+	ReportTargetAgent  ReportTarget = "agent"
+	ReportTargetUser   ReportTarget = "user"
+)
+
+// ReportReason is why content was reported
+type ReportReason string
+const (
+	ReportReasonSpam          ReportReason = "spam"
+	ReportReasonHarassment    ReportReason = "harassment"
+	ReportReasonInappropriate ReportReason = "inappropriate"
+	ReportReasonMalware       ReportReason = "malware"
+	ReportReasonImpersonation ReportReason = "impersonation"
+	ReportReasonCopyright     ReportReason = "copyright"
+	ReportReasonOther         ReportReason = "other"
+)
+
+// ReportStatus is where a report is in the moderation queue
+type ReportStatus string
+const (
+	ReportStatusOpen      ReportStatus = "open"
+	ReportStatusResolved  ReportStatus = "resolved"  // action was taken
+	ReportStatusDismissed ReportStatus = "dismissed" // no action was needed
+)
+
+// ModerationAction is what a moderator did about reported content. Warn
+// and ban apply to the content's author: the reviewer, the publisher or
+// the reported user.
+type ModerationAction string
+const (
+	ModerationActionNone ModerationAction = "none"
+	ModerationActionHide ModerationAction = "hide" // reviews are hidden, agents rejected
+	ModerationActionWarn ModerationAction = "warn"
+	ModerationActionBan  ModerationAction = "ban"
+)
+
+// AuditActor is the kind of principal that acted
+type AuditActor string
+const (
+	AuditActorUser           AuditActor = "user"
+	AuditActorServiceAccount AuditActor = "service_account"
+	AuditActorOperator       AuditActor = "operator" // a CLI operator command
+)
+
+// ServiceAccountScope is what a service account may read
+type ServiceAccountScope string
+const (
+	ServiceAccountScopePurchases ServiceAccountScope = "purchases:read" // purchases, receipts, invoices and payouts
+	ServiceAccountScopeAnalytics ServiceAccountScope = "analytics:read" // dashboards, telemetry and, for admins, platform stats
+)
+
+// AuditAction is the kind of change an audit log entry records
+type AuditAction string
+const (
+	AuditActionUserStatus           AuditAction = "user.status"
+	AuditActionUserTier             AuditAction = "user.tier"
+	AuditActionUserRole             AuditAction = "user.role"
+	AuditActionUserEmail            AuditAction = "user.email"
+	AuditActionUserDelete           AuditAction = "user.delete"
+	AuditActionMemberRole           AuditAction = "organization.member_role"
+	AuditActionPublisherApplication AuditAction = "publisher_application.decide"
+	AuditActionAgentApprove         AuditAction = "agent.approve"
+	AuditActionAgentReject          AuditAction = "agent.reject"
+	AuditActionAgentDelete          AuditAction = "agent.delete"
+	AuditActionRefundDecide         AuditAction = "refund.decide"
+	AuditActionAPIKeyStatus         AuditAction = "api_key.status"
+	AuditActionLegalHoldPlace       AuditAction = "legal_hold.place"
+	AuditActionLegalHoldRelease     AuditAction = "legal_hold.release"
+	AuditActionPayoutAccountReplace AuditAction = "payout_account.replace"
+	AuditActionReportResolve        AuditAction = "report.resolve"
+	AuditActionServiceAccountCreate AuditAction = "service_account.create"
+	AuditActionServiceAccountRevoke AuditAction = "service_account.revoke"
+	AuditActionReportingRead        AuditAction = "reporting.read"
+	AuditActionSeatPoolCreate       AuditAction = "seat_pool.create"
+	AuditActionResellerGrant        AuditAction = "reseller.grant" // a bulk entitlement batch
+	AuditActionJobRetry             AuditAction = "job.retry"      // dead jobs queued again
+	AuditActionAgentUnpublish       AuditAction = "agent.unpublish"
+	AuditActionUserSessionsRevoke   AuditAction = "user.sessions_revoke"
+	AuditActionWebhookTest          AuditAction = "webhook.test"
+)
+
+type SignatureAlgorithm string
+const (
+	SignatureAlgorithmEd25519   SignatureAlgorithm = "ed25519"
+	SignatureAlgorithmECDSAP256 SignatureAlgorithm = "ecdsa-p256"
+)
+
+// PayoutAccountStatus is the onboarding state of a payout account
+type PayoutAccountStatus string
+const (
+	PayoutAccountStatusPending PayoutAccountStatus = "pending"
+	PayoutAccountStatusActive  PayoutAccountStatus = "active"
+)
+
+// PayoutStatus is the state of a payout. A payout stays pending until the
+// publisher has an active payout account and the transfer succeeded.
+type PayoutStatus string
+const (
+	PayoutStatusPending PayoutStatus = "pending"
+	PayoutStatusPaid    PayoutStatus = "paid"
+)
+
+// OrgRole is a member's role in an organization. Owners manage the
+// organization and its members, maintainers manage its agents, and viewers
+// can see its agents, including drafts.
+type OrgRole string
+const (
+	OrgRoleOwner      OrgRole = "owner"
+	OrgRoleMaintainer OrgRole = "maintainer"
+	OrgRoleViewer     OrgRole = "viewer"
+)
+
+// WebhookEvent is the type of an event sent to webhook subscriptions
+type WebhookEvent string
+const (
+	WebhookEventDeviceRegistered     WebhookEvent = "device.registered"
+	WebhookEventDeviceOffline        WebhookEvent = "device.offline"
+	WebhookEventRolloutWaveCompleted WebhookEvent = "rollout.wave_completed"
+	WebhookEventFleetRolloutCompleted WebhookEvent = "fleet_rollout.completed"
+	WebhookEventFleetRolloutHalted   WebhookEvent = "fleet_rollout.halted"
+	WebhookEventUpdateApplied        WebhookEvent = "update.applied"
+	WebhookEventUpdateFailed         WebhookEvent = "update.failed"
+	WebhookEventNotification         WebhookEvent = "notification"
+	WebhookEventPing                 WebhookEvent = "ping" // test deliveries, not subscribable
+)
+
+// RolloutStrategy is how a fleet rollout reaches its devices: all at once,
+// a canary share first, or in staged waves
+type RolloutStrategy string
+const (
+	RolloutStrategyImmediate RolloutStrategy = "immediate"
+	RolloutStrategyCanary    RolloutStrategy = "canary"
+	RolloutStrategyWaves     RolloutStrategy = "waves"
+)
+
+type FleetRolloutStatus string
+const (
+	FleetRolloutStatusInProgress FleetRolloutStatus = "in_progress"
+	FleetRolloutStatusCompleted  FleetRolloutStatus = "completed"
+	FleetRolloutStatusHalted     FleetRolloutStatus = "halted"
+)
+
+// TransferVerification is how a replaced device was shown to be out of
+// service: it stopped checking in, or its certificates were revoked
+type TransferVerification string
+const (
+	TransferVerificationQuiet   TransferVerification = "quiet"
+	TransferVerificationRevoked TransferVerification = "revoked"
+)
+
+// RolloutTargetStatus is the state of the release on one device: pending
+// until its wave starts, then deploying until the device reports it applied
+// or failed
+type RolloutTargetStatus string
+const (
+	RolloutTargetStatusPending   RolloutTargetStatus = "pending"
+	RolloutTargetStatusDeploying RolloutTargetStatus = "deploying"
+	RolloutTargetStatusSucceeded RolloutTargetStatus = "succeeded"
+	RolloutTargetStatusFailed    RolloutTargetStatus = "failed"
+)
+
+type WebhookDeliveryStatus string
+const (
+	WebhookDeliveryStatusPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryStatusDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryStatusFailed    WebhookDeliveryStatus = "failed"
+)
+
+// SearchReindexStatus is the state of a reindex
+type SearchReindexStatus string
+const (
+	SearchReindexStatusRunning   SearchReindexStatus = "running"
+	SearchReindexStatusCompleted SearchReindexStatus = "completed"
+	SearchReindexStatusCanceled  SearchReindexStatus = "canceled"
+)
+
+type OrgInvitationStatus string
+const (
+	OrgInvitationStatusPending  OrgInvitationStatus = "pending"
+	OrgInvitationStatusAccepted OrgInvitationStatus = "accepted"
+	OrgInvitationStatusDeclined OrgInvitationStatus = "declined"
+	OrgInvitationStatusRevoked  OrgInvitationStatus = "revoked"
+)
+
+type OrgPurchaseStatus string
+const (
+	OrgPurchaseStatusPending   OrgPurchaseStatus = "pending"
+	OrgPurchaseStatusApproved  OrgPurchaseStatus = "approved" // payment being captured
+	OrgPurchaseStatusCompleted OrgPurchaseStatus = "completed"
+	OrgPurchaseStatusRejected  OrgPurchaseStatus = "rejected"
+	OrgPurchaseStatusCancelled OrgPurchaseStatus = "cancelled"
+	OrgPurchaseStatusFailed    OrgPurchaseStatus = "failed" // the payment could not be captured
+)
+
+type PublisherApplicationStatus string
+const (
+	PublisherApplicationStatusPending  PublisherApplicationStatus = "pending"
+	PublisherApplicationStatusApproved PublisherApplicationStatus = "approved"
+	PublisherApplicationStatusRejected PublisherApplicationStatus = "rejected"
+)
+
+// RefundStatus is the state of a refund request. A request is processing
+// while the payment provider refund is in flight.
+type RefundStatus string
+const (
+	RefundStatusPending    RefundStatus = "pending"
+	RefundStatusProcessing RefundStatus = "processing"
+	RefundStatusApproved   RefundStatus = "approved"
+	RefundStatusDenied     RefundStatus = "denied"
+)
+
+type FraudReviewStatus string
+const (
+	FraudReviewStatusNone     FraudReviewStatus = "none"
+	FraudReviewStatusPending  FraudReviewStatus = "pending"
+	FraudReviewStatusApproved FraudReviewStatus = "approved"
+	FraudReviewStatusRejected FraudReviewStatus = "rejected"
+)
+
+type FraudOutcome string
+const (
+	FraudOutcomeFraud      FraudOutcome = "fraud"
+	FraudOutcomeLegitimate FraudOutcome = "legitimate"
+)
+
+// CertSource is where the TLS certificate of a custom domain comes from
+type CertSource string
+const (
+	CertSourceACME     CertSource = "acme"
+	CertSourceUploaded CertSource = "uploaded"
+)
+
+type ReviewReminderStatus string
+const (
+	ReviewReminderStatusSent       ReviewReminderStatus = "sent"
+	ReviewReminderStatusSuppressed ReviewReminderStatus = "suppressed"
+)
+
+// AvatarURL is where an uploaded avatar or logo is served, by the name of
+// its processed image. The content never changes under a name.
+func AvatarURL(name string) string {
+	return "/api/v1/avatars/" + name
+}
+
+// IdenticonURL is where the generated image of a user or organization
+// without an uploaded one is served
+func IdenticonURL(id uuid.UUID) string {
+	return "/api/v1/identicons/" + id.String() + ".png"
+}
+
+// BeforeCreate hooks
+func (u *User) BeforeCreate(tx *gorm.DB) error {
+	if u.ID == uuid.Nil {
+		u.ID = NewID()
+	}
+	if u.AvatarURL == "" {
+		u.AvatarURL = IdenticonURL(u.ID)
+	}
+	return nil
+}
+
+func (t *RefreshToken) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = NewID()
+	}
+	return nil
+}
+
+func (t *PasswordResetToken) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = NewID()
+	}
+	return nil
+}
+
+func (a *PendingAction) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = NewID()
+	}
+	return nil
+}
+
+func (a *ServiceAccount) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = NewID()
+	}
+	return nil
+}
+
+func (k *APIKey) BeforeCreate(tx *gorm.DB) error {
+	if k.ID == uuid.Nil {
+		k.ID = NewID()
+	}
+	return nil
+}
+
+func (d *Device) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = NewID()
+	}
+	return nil
+}
+
+func (c *DeviceCertificate) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = NewID()
+	}
+	return nil
+}
+
+func (c *DeviceClaim) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = NewID()
+	}
+	return nil
+}
+
+func (h *LegalHold) BeforeCreate(tx *gorm.DB) error {
+	if h.ID == uuid.Nil {
+		h.ID = NewID()
+	}
+	return nil
+}
+
+func (l *AuditLog) BeforeCreate(tx *gorm.DB) error {
+	if l.ID == uuid.Nil {
+		l.ID = NewID()
+	}
+	return nil
+}
+
+func (k *PublisherKey) BeforeCreate(tx *gorm.DB) error {
+	if k.ID == uuid.Nil {
+		k.ID = NewID()
+	}
+	return nil
+}
+
+func (r *SearchReindex) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = NewID()
+	}
+	return nil
+}
+
+func (c *SearchConsistencyCheck) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = NewID()
+	}
+	return nil
+}
+
+func (d *NotificationDigest) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = NewID()
+	}
+	return nil
+}
+
+func (a *Agent) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = NewID()
+	}
+	return nil
+}
+
+func (p *Purchase) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = NewID()
+	}
+	if p.TraceID == uuid.Nil {
+		p.TraceID = p.ID
+	}
+	return nil
+}
+
+func (r *Review) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = NewID()
+	}
+	return nil
+}
+
+func (a *ReviewAttachment) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = NewID()
+	}
+	return nil
+}
+
+func (r *ReviewReply) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = NewID()
+	}
+	return nil
+}
+
+func (e *PlatformChangelogEntry) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = NewID()
+	}
+	return nil
+}
+
+func (r *Report) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = NewID()
+	}
+	return nil
+}
+
+func (v *ReviewVote) BeforeCreate(tx *gorm.DB) error {
+	if v.ID == uuid.Nil {
+		v.ID = NewID()
+	}
+	return nil
+}
+
+func (f *Favorite) BeforeCreate(tx *gorm.DB) error {
+	if f.ID == uuid.Nil {
+		f.ID = NewID()
+	}
+	return nil
+}
+
+func (e *ConsentEvent) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = NewID()
+	}
+	return nil
+}
+
+func (n *Notification) BeforeCreate(tx *gorm.DB) error {
+	if n.ID == uuid.Nil {
+		n.ID = NewID()
+	}
+	return nil
+}
+
+func (r *ReviewReminder) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = NewID()
+	}
+	return nil
+}
+
+func (o *Organization) BeforeCreate(tx *gorm.DB) error {
+	if o.ID == uuid.Nil {
+		o.ID = NewID()
+	}
+	if o.LogoURL == "" {
+		o.LogoURL = IdenticonURL(o.ID)
+	}
+	return nil
+}
+
+func (i *OrgInvitation) BeforeCreate(tx *gorm.DB) error {
+	if i.ID == uuid.Nil {
+		i.ID = NewID()
+	}
+	return nil
+}
+
+func (r *OrgPurchaseRequest) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = NewID()
+	}
+	return nil
+}
+
+func (a *PublisherApplication) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = NewID()
+	}
+	return nil
+}
+
+func (r *RefundRequest) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = NewID()
+	}
+	return nil
+}
+
+func (a *PayoutAccount) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = NewID()
+	}
+	return nil
+}
+
+func (p *Payout) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = NewID()
+	}
+	return nil
+}
+
+func (c *CheckoutSession) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = NewID()
+	}
+	return nil
+}
+
+func (w *WebhookSubscription) BeforeCreate(tx *gorm.DB) error {
+	if w.ID == uuid.Nil {
+		w.ID = NewID()
+	}
+	return nil
+}
+
+func (d *WebhookDelivery) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = NewID()
+	}
+	return nil
+}
+
+func (d *Deployment) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = NewID()
+	}
+	if d.TraceID == uuid.Nil {
+		d.TraceID = d.ID
+	}
+	return nil
+}
+
+func (i *Invoice) BeforeCreate(tx *gorm.DB) error {
+	if i.ID == uuid.Nil {
+		i.ID = NewID()
+	}
+	return nil
+}
+
+func (l *InvoiceLine) BeforeCreate(tx *gorm.DB) error {
+	if l.ID == uuid.Nil {
+		l.ID = NewID()
+	}
+	return nil
+}
+
+func (r *CurationRule) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = NewID()
+	}
+	return nil
+}
+
+func (b *Bundle) BeforeCreate(tx *gorm.DB) error {
+	if b.ID == uuid.Nil {
+		b.ID = NewID()
+	}
+	return nil
+}
+
+func (c *BundleComponent) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = NewID()
+	}
+	return nil
+}
+
+func (a *AgentCapabilities) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = NewID()
+	}
+	return nil
+}
+
+func (v *AgentVersion) BeforeCreate(tx *gorm.DB) error {
+	if v.ID == uuid.Nil {
+		v.ID = NewID()
+	}
+	return nil
+}
+
+func (h *AgentHistory) BeforeCreate(tx *gorm.DB) error {
+	if h.ID == uuid.Nil {
+		h.ID = NewID()
+	}
+	return nil
+}
+
+func (i *DeviceImport) BeforeCreate(tx *gorm.DB) error {
+	if i.ID == uuid.Nil {
+		i.ID = NewID()
+	}
+	return nil
+}
+
+func (r *FleetRollout) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = NewID()
+	}
+	return nil
+}
+
+func (t *FleetRolloutTarget) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = NewID()
+	}
+	return nil
+}
+
+func (t *DeploymentTransfer) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = NewID()
+	}
+	return nil
+}
+
+func (l *License) BeforeCreate(tx *gorm.DB) error {
+	if l.ID == uuid.Nil {
+		l.ID = NewID()
+	}
+	return nil
+}
+
+func (p *PricingPlan) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = NewID()
+	}
+	return nil
+}
+
+func (s *Subscription) BeforeCreate(tx *gorm.DB) error {
+	if s.ID == uuid.Nil {
+		s.ID = NewID()
+	}
+	return nil
+}
+
+func (l *AgentLocalization) BeforeCreate(tx *gorm.DB) error {
+	if l.ID == uuid.Nil {
+		l.ID = NewID()
+	}
+	return nil
+}
+
+func (e *CreditEntry) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = NewID()
+	}
+	return nil
+}
+
+func (c *CreditCode) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = NewID()
+	}
+	return nil
+}
+
+func (r *FraudRule) BeforeCreate(tx *gorm.DB) error {
+	if r.ID == uuid.Nil {
+		r.ID = NewID()
+	}
+	return nil
+}
+
+func (a *FraudAssessment) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = NewID()
+	}
+	return nil
+}
+
+func (t *Template) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = NewID()
+	}
+	return nil
+}
+
+func (v *TemplateVersion) BeforeCreate(tx *gorm.DB) error {
+	if v.ID == uuid.Nil {
+		v.ID = NewID()
+	}
+	return nil
+}
+
+func (d *AgentDownload) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = NewID()
+	}
+	return nil
+}
+
+func (d *TemplateDownload) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = NewID()
+	}
+	return nil
+}
+
+func (d *CustomDomain) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = NewID()
+	}
+	return nil
+}
+
+func (t *Transaction) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == uuid.Nil {
+		t.ID = NewID()
+	}
+	return nil
+}
+
+func (p *SeatPool) BeforeCreate(tx *gorm.DB) error {
+	if p.ID == uuid.Nil {
+		p.ID = NewID()
+	}
+	return nil
+}
+
+func (g *ResellerGrant) BeforeCreate(tx *gorm.DB) error {
+	if g.ID == uuid.Nil {
+		g.ID = NewID()
+	}
+	return nil
+}
+
+func (a *ReleaseArtifact) BeforeCreate(tx *gorm.DB) error {
+	if a.ID == uuid.Nil {
+		a.ID = NewID()
+	}
+	return nil
+}
+
+// AfterFind hooks fill in currency-formatted amounts
+func (a *Agent) AfterFind(tx *gorm.DB) error {
+	a.PriceDisplay = FormatMoney(a.Price, a.Currency)
+	return nil
+}
+
+func (h *AgentHistory) AfterFind(tx *gorm.DB) error {
+	h.PriceDisplay = FormatMoney(h.Price, h.Currency)
+	return nil
+}
+
+func (p *Purchase) AfterFind(tx *gorm.DB) error {
+	p.AmountDisplay = FormatMoney(p.Amount, p.Currency)
+	return nil
+}
+
+func (t *Transaction) AfterFind(tx *gorm.DB) error {
+	t.AmountDisplay = FormatMoney(t.Amount, t.Currency)
+	return nil
+}
+
+func (e *CreditEntry) AfterFind(tx *gorm.DB) error {
+	e.AmountDisplay = FormatMoney(e.Amount, e.Currency)
+	return nil
+}
+
+func (c *CreditCode) AfterFind(tx *gorm.DB) error {
+	c.AmountDisplay = FormatMoney(c.Amount, c.Currency)
+	return nil
+}
+
+func (p *PricingPlan) AfterFind(tx *gorm.DB) error {
+	p.PriceDisplay = FormatMoney(p.Price, p.Currency)
+	return nil
+}
+
+func (i *Invoice) AfterFind(tx *gorm.DB) error {
+	i.TotalDisplay = FormatMoney(i.Total, i.Currency)
+	return nil
+}
+
+func (l *InvoiceLine) AfterFind(tx *gorm.DB) error {
+	l.AmountDisplay = FormatMoney(l.Amount, l.Currency)
+	return nil
+}
+
+func (p *Payout) AfterFind(tx *gorm.DB) error {
+	p.AmountDisplay = FormatMoney(p.Amount, p.Currency)
+	return nil
+}
+
+func (c *CheckoutSession) AfterFind(tx *gorm.DB) error {
+	c.AmountDisplay = FormatMoney(c.Amount, c.Currency)
+	return nil
+}
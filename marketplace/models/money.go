@@ -0,0 +1,127 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Money is an amount in the minor units of its currency (e.g. cents for USD)
+type Money int64
+
+// DefaultCurrency is used when an amount has no currency
+const DefaultCurrency = "USD"
+
+// Currency is a currency publishers can price agents in
+type Currency struct {
+	Code      string    `gorm:"type:varchar(3);primary_key" json:"code"`
+	Name      string    `json:"name"`
+	Enabled   bool      `gorm:"not null;default:true" json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ExchangeRate is how many units of a currency one unit of the configured
+// base currency buys. Rates are kept as exact decimal strings.
+type ExchangeRate struct {
+	Currency  string    `gorm:"type:varchar(3);primary_key" json:"currency"`
+	Rate      string    `gorm:"type:numeric(24,12);not null" json:"rate"`
+	FetchedAt time.Time `gorm:"not null" json:"fetched_at"`
+}
+
+// DisplayPrice is a price converted to a currency the buyer asked for. It is
+// informational; purchases are still charged in the agent's own currency.
+type DisplayPrice struct {
+	Amount        Money     `json:"amount_minor"`
+	AmountDisplay string    `json:"amount"`
+	Currency      string    `json:"currency"`
+	RatesAt       time.Time `json:"rates_at"` // when the rates used were fetched
+}
+
+// CurrencyExponents lists ISO 4217 currencies whose minor unit is not 1/100.
+// Any currency not listed here uses two decimal places.
+var CurrencyExponents = map[string]int{
+	"CLP": 0,
+	"ISK": 0,
+	"JPY": 0,
+	"KRW": 0,
+	"VND": 0,
+	"BHD": 3,
+	"JOD": 3,
+	"KWD": 3,
+	"OMR": 3,
+	"TND": 3,
+}
+
+// NormalizeCurrency upper-cases a currency code and applies the default
+func NormalizeCurrency(currency string) string {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if currency == "" {
+		return DefaultCurrency
+	}
+	return currency
+}
+
+// CurrencyExponent returns the number of decimal places of a currency
+func CurrencyExponent(currency string) int {
+	if exp, ok := CurrencyExponents[NormalizeCurrency(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// ParseMoney converts a decimal string such as "19.99" to minor units without
+// going through floating point. Negative amounts are rejected.
+func ParseMoney(amount, currency string) (Money, error) {
+	amount = strings.TrimSpace(amount)
+	if amount == "" {
+		return 0, nil
+	}
+	if strings.HasPrefix(amount, "-") {
+		return 0, fmt.Errorf("amount %s must not be negative", amount)
+	}
+
+	whole, frac, _ := strings.Cut(amount, ".")
+	exp := CurrencyExponent(currency)
+	if len(frac) > exp {
+		return 0, fmt.Errorf("amount %s has more than %d decimal places for %s", amount, exp, NormalizeCurrency(currency))
+	}
+	if whole == "" {
+		whole = "0"
+	}
+
+	var minor int64
+	for _, r := range whole + frac + strings.Repeat("0", exp-len(frac)) {
+		if r < '0' || r > '9' {
+			return 0, fmt.Errorf("invalid amount %q", amount)
+		}
+		digit := int64(r - '0')
+		if minor > (math.MaxInt64-digit)/10 {
+			return 0, fmt.Errorf("amount %s is out of range", amount)
+		}
+		minor = minor*10 + digit
+	}
+	return Money(minor), nil
+}
+
+// FormatMoney renders minor units as a decimal string using the currency's
+// number of decimal places, e.g. 1999 USD as "19.99"
+func FormatMoney(amount Money, currency string) string {
+	exp := CurrencyExponent(currency)
+	sign := ""
+	value := int64(amount)
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	if exp == 0 {
+		return fmt.Sprintf("%s%d", sign, value)
+	}
+
+	scale := int64(1)
+	for i := 0; i < exp; i++ {
+		scale *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, value/scale, exp, value%scale)
+}
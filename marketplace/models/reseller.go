@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SeatPool is a block of seats of an agent a reseller bought wholesale,
+// outside the marketplace checkout. Admins record pools; resellers spend
+// them granting entitlements to their customers' organizations.
+type SeatPool struct {
+	ID         uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	ResellerID uuid.UUID `gorm:"type:uuid;not null;index" json:"reseller_id"`
+	AgentID    uuid.UUID `gorm:"type:uuid;not null" json:"agent_id"`
+	Seats      int       `gorm:"not null" json:"seats"`
+	Used       int       `gorm:"not null;default:0" json:"used"`
+	Reference  string    `json:"reference,omitempty"` // the wholesale order, e.g. a contract or invoice number
+	CreatedBy  uuid.UUID `gorm:"type:uuid;not null" json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	// Relationships
+	Agent *Agent `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+}
+
+// Remaining returns the seats of a pool not granted yet
+func (p *SeatPool) Remaining() int {
+	return p.Seats - p.Used
+}
+
+// ResellerGrant is an entitlement a reseller granted to an organization
+// from one of their seat pools. The organization gets a completed purchase
+// of the agent with a license for the seats granted.
+type ResellerGrant struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key" json:"id"`
+	ResellerID     uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_reseller_grant_reference" json:"reseller_id"`
+	BatchID        uuid.UUID `gorm:"type:uuid;not null;index" json:"batch_id"` // the bulk request it was granted in
+	PoolID         uuid.UUID `gorm:"type:uuid;not null;index" json:"pool_id"`
+	OrganizationID uuid.UUID `gorm:"type:uuid;not null;index" json:"organization_id"`
+	AgentID        uuid.UUID `gorm:"type:uuid;not null" json:"agent_id"`
+	Seats          int       `gorm:"not null" json:"seats"`
+	Reference      string    `gorm:"not null;uniqueIndex:idx_reseller_grant_reference" json:"reference"` // the reseller's order, which makes a retried grant a no-op
+	PurchaseID     uuid.UUID `gorm:"type:uuid;not null;uniqueIndex" json:"purchase_id"`
+	CreatedAt      time.Time `json:"created_at"`
+
+	// Relationships
+	Organization *Organization `gorm:"foreignKey:OrganizationID" json:"organization,omitempty"`
+	Agent        *Agent        `gorm:"foreignKey:AgentID" json:"agent,omitempty"`
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ScanStatus is the state of the scans of a release's binary. Releases
+// without an uploaded binary stay pending.
+type ScanStatus string
+
+const (
+	ScanStatusPending ScanStatus = "pending"
+	ScanStatusPassed  ScanStatus = "passed"
+	ScanStatusFailed  ScanStatus = "failed"
+	ScanStatusSkipped ScanStatus = "skipped" // uploaded while scanning was disabled
+)
+
+// ScanVerdict is a scanner's conclusion about a binary
+type ScanVerdict string
+
+const (
+	ScanVerdictClean    ScanVerdict = "clean"
+	ScanVerdictInfected ScanVerdict = "infected"
+)
+
+// ScanReport is the outcome of scanning a release's binary with every
+// configured scanner
+type ScanReport struct {
+	Checksum    string       `json:"checksum"` // of the binary scanned
+	Results     []ScanResult `json:"results"`
+	Attempts    int          `json:"attempts"`
+	LastError   string       `json:"last_error,omitempty"` // of the last attempt that could not complete
+	CompletedAt *time.Time   `json:"completed_at,omitempty"`
+}
+
+// ScanResult is one scanner's verdict
+type ScanResult struct {
+	Scanner   string      `json:"scanner"`
+	Verdict   ScanVerdict `json:"verdict"`
+	Findings  []string    `json:"findings,omitempty"` // e.g. signature names
+	Duration  string      `json:"duration"`
+	ScannedAt time.Time   `json:"scanned_at"`
+}
+
+// Value implements driver.Valuer
+func (r ScanReport) Value() (driver.Value, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (r *ScanReport) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*r = ScanReport{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, r)
+	case string:
+		return json.Unmarshal([]byte(v), r)
+	default:
+		return fmt.Errorf("unsupported scan report value %T", value)
+	}
+}
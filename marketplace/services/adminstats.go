@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// adminStatsKey is the Redis key caching the admin statistics
+const adminStatsKey = "admin:stats"
+
+// WeekDelta compares a count over the last seven days with the seven days
+// before
+type WeekDelta struct {
+	ThisWeek      int64    `json:"this_week"`
+	LastWeek      int64    `json:"last_week"`
+	ChangePercent *float64 `json:"change_percent"` // nil when last week is zero
+}
+
+// AdminStatsDeltas is the week-over-week activity shown on the admin home page
+type AdminStatsDeltas struct {
+	NewUsers  WeekDelta `json:"new_users"`
+	NewAgents WeekDelta `json:"new_agents"`
+	Purchases WeekDelta `json:"purchases"`
+	Reviews   WeekDelta `json:"reviews"`
+}
+
+// AdminStats is the marketplace statistics for admins
+type AdminStats struct {
+	TotalUsers      int64             `json:"total_users"`
+	TotalAgents     int64             `json:"total_agents"`
+	TotalPurchases  int64             `json:"total_purchases"`
+	TotalReviews    int64             `json:"total_reviews"`
+	PublishedAgents int64             `json:"published_agents"`
+	ActiveUsers     int64             `json:"active_users"`
+	TotalRevenue    map[string]string `json:"total_revenue"` // formatted amount per currency
+	WeekOverWeek    AdminStatsDeltas  `json:"week_over_week"`
+	GeneratedAt     time.Time         `json:"generated_at"`
+}
+
+// AdminStatsService computes the admin statistics, running the queries
+// concurrently, and caches them in Redis so every instance shares them
+type AdminStatsService struct {
+	db    *gorm.DB
+	redis *RedisService
+	cfg   config.AdminStatsConfig
+}
+
+// NewAdminStatsService creates a new admin stats service
+func NewAdminStatsService(db *gorm.DB, redis *RedisService, cfg config.AdminStatsConfig) *AdminStatsService {
+	return &AdminStatsService{db: db, redis: redis, cfg: cfg}
+}
+
+// Get returns the cached statistics, computing them if they are missing,
+// expired or refresh is set. The database is used directly while Redis is
+// unavailable.
+func (s *AdminStatsService) Get(ctx context.Context, refresh bool) (*AdminStats, error) {
+	cache := s.cfg.CacheTTL > 0 && s.redis.Available()
+	if cache && !refresh {
+		data, err := s.redis.Client().Get(ctx, adminStatsKey).Bytes()
+		switch {
+		case err == nil:
+			var stats AdminStats
+			if err := json.Unmarshal(data, &stats); err == nil {
+				return &stats, nil
+			}
+			log.Warn().Msg("Ignoring malformed cached admin stats")
+		case err != redis.Nil:
+			log.Warn().Err(err).Msg("Failed to read cached admin stats")
+		}
+	}
+
+	stats, err := s.compute(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache {
+		data, err := json.Marshal(stats)
+		if err == nil {
+			err = s.redis.Client().Set(ctx, adminStatsKey, data, s.cfg.CacheTTL).Err()
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to cache admin stats")
+		}
+	}
+	return stats, nil
+}
+
+// compute runs the statistics queries concurrently, failing as soon as one
+// of them does
+func (s *AdminStatsService) compute(ctx context.Context) (*AdminStats, error) {
+	now := time.Now()
+	weekAgo := now.AddDate(0, 0, -7)
+	twoWeeksAgo := now.AddDate(0, 0, -14)
+	stats := &AdminStats{GeneratedAt: now}
+
+	g, ctx := errgroup.WithContext(ctx)
+	db := s.db.WithContext(ctx)
+
+	count := func(what string, dest *int64, query func() *gorm.DB) {
+		g.Go(func() error {
+			if err := query().Count(dest).Error; err != nil {
+				return fmt.Errorf("failed to count %s: %w", what, err)
+			}
+			return nil
+		})
+	}
+	count("users", &stats.TotalUsers, func() *gorm.DB {
+		return db.Model(&models.User{})
+	})
+	count("agents", &stats.TotalAgents, func() *gorm.DB {
+		return db.Model(&models.Agent{})
+	})
+	count("published agents", &stats.PublishedAgents, func() *gorm.DB {
+		return db.Model(&models.Agent{}).Where("status = ?", models.AgentStatusPublished)
+	})
+	count("purchases", &stats.TotalPurchases, func() *gorm.DB {
+		return db.Model(&models.Purchase{})
+	})
+	count("reviews", &stats.TotalReviews, func() *gorm.DB {
+		return db.Model(&models.Review{})
+	})
+	// Users with activity in the last 30 days
+	count("active users", &stats.ActiveUsers, func() *gorm.DB {
+		return db.Model(&models.User{}).Where("updated_at >= ?", now.AddDate(0, 0, -30))
+	})
+
+	g.Go(func() error {
+		var revenue []struct {
+			Currency string
+			Total    models.Money
+		}
+		if err := db.Model(&models.Purchase{}).Where("status = ?", models.PurchaseStatusCompleted).
+			Select("currency, COALESCE(SUM(amount_minor), 0) AS total").Group("currency").Scan(&revenue).Error; err != nil {
+			return fmt.Errorf("failed to calculate total revenue: %w", err)
+		}
+		stats.TotalRevenue = make(map[string]string, len(revenue))
+		for _, r := range revenue {
+			stats.TotalRevenue[r.Currency] = models.FormatMoney(r.Total, r.Currency)
+		}
+		return nil
+	})
+
+	delta := func(what string, dest *WeekDelta, model interface{}) {
+		g.Go(func() error {
+			if err := db.Model(model).
+				Select("COUNT(*) FILTER (WHERE created_at >= ?) AS this_week, COUNT(*) FILTER (WHERE created_at < ?) AS last_week", weekAgo, weekAgo).
+				Where("created_at >= ?", twoWeeksAgo).
+				Scan(dest).Error; err != nil {
+				return fmt.Errorf("failed to count weekly %s: %w", what, err)
+			}
+			if dest.LastWeek > 0 {
+				change := float64(dest.ThisWeek-dest.LastWeek) / float64(dest.LastWeek) * 100
+				dest.ChangePercent = &change
+			}
+			return nil
+		})
+	}
+	delta("users", &stats.WeekOverWeek.NewUsers, &models.User{})
+	delta("agents", &stats.WeekOverWeek.NewAgents, &models.Agent{})
+	delta("purchases", &stats.WeekOverWeek.Purchases, &models.Purchase{})
+	delta("reviews", &stats.WeekOverWeek.Reviews, &models.Review{})
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
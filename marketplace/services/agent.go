@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 
 	"github.com/edgeplug/marketplace/models"
@@ -12,23 +13,51 @@ import (
 
 // AgentService handles agent-related business logic
 type AgentService struct {
-	db *gorm.DB
+	db      *gorm.DB
+	cache   *AgentCache
+	tiers   *TierService
+	storage Storage
+
+	manifests *ManifestService
+
+	// scanning is set when uploaded binaries are scanned before release
+	scanning bool
+
+	// presignExpiry is the lifetime of presigned file URLs
+	presignExpiry time.Duration
 }
 
 // NewAgentService creates a new agent service
-func NewAgentService(db *gorm.DB) *AgentService {
-	return &AgentService{db: db}
+func NewAgentService(db *gorm.DB, cache *AgentCache, tiers *TierService, storage Storage, presignExpiry time.Duration, scanning bool) *AgentService {
+	return &AgentService{db: db, cache: cache, tiers: tiers, storage: storage, presignExpiry: presignExpiry, scanning: scanning, manifests: NewManifestService()}
 }
 
-// CreateAgent creates a new agent
+// CreateAgent creates a new agent along with a draft release of its version
 func (s *AgentService) CreateAgent(agent *models.Agent) error {
-	return s.db.Create(agent).Error
+	if !versionPattern.MatchString(agent.Version) {
+		return ErrInvalidVersion
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(agent).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.AgentVersion{
+			AgentID:     agent.ID,
+			Version:     agent.Version,
+			BinaryURL:   agent.BinaryURL,
+			ManifestURL: agent.ManifestURL,
+			FlashSize:   agent.FlashSize,
+			SRAMSize:    agent.SRAMSize,
+			MaxLatency:  agent.MaxLatency,
+			Status:      models.AgentVersionStatusDraft,
+		}).Error
+	})
 }
 
 // GetAgentByID retrieves an agent by ID
 func (s *AgentService) GetAgentByID(id uuid.UUID) (*models.Agent, error) {
 	var agent models.Agent
-	if err := s.db.Preload("Publisher").Preload("Reviews.User").First(&agent, id).Error; err != nil {
+	if err := s.db.Preload("Publisher").Preload("SigningKey").Preload("Reviews.User").First(&agent, id).Error; err != nil {
 		return nil, err
 	}
 	return &agent, nil
@@ -64,22 +93,64 @@ func (s *AgentService) GetAgents(page, limit int, filters map[string]interface{}
 
 // UpdateAgent updates an agent
 func (s *AgentService) UpdateAgent(id uuid.UUID, updates map[string]interface{}) error {
-	return s.db.Model(&models.Agent{}).Where("id = ?", id).Updates(updates).Error
+	if err := s.db.Model(&models.Agent{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		return err
+	}
+	s.InvalidateAgent(id)
+	return nil
 }
 
-// DeleteAgent deletes an agent
+// DeleteAgent deletes an agent unless it, its publisher or its organization
+// is under legal hold
 func (s *AgentService) DeleteAgent(id uuid.UUID) error {
-	return s.db.Delete(&models.Agent{}, id).Error
+	var agent models.Agent
+	if err := s.db.Select("id", "publisher_id", "organization_id").First(&agent, "id = ?", id).Error; err != nil {
+		return err
+	}
+	if err := checkLegalHold(s.db, agentHoldSubjects(&agent)...); err != nil {
+		return err
+	}
+	if err := s.db.Delete(&models.Agent{}, id).Error; err != nil {
+		return err
+	}
+	s.InvalidateAgent(id)
+	return nil
 }
 
-// PublishAgent publishes an agent
+// InvalidateAgent drops an agent from the cache on every instance. Failures
+// are logged rather than returned since the write itself has succeeded and
+// the entry still expires after the cache TTL.
+func (s *AgentService) InvalidateAgent(id uuid.UUID) {
+	if err := s.cache.Invalidate(id); err != nil {
+		log.Warn().Err(err).Str("agent_id", id.String()).Msg("Failed to invalidate cached agent")
+	}
+}
+
+// PublishAgent publishes an agent if its publisher's plan allows another
+// published agent
 func (s *AgentService) PublishAgent(id uuid.UUID) error {
+	var agent models.Agent
+	if err := s.db.Select("id", "publisher_id", "organization_id", "status", "version", "flash_size", "sram_size", "safety_level").First(&agent, "id = ?", id).Error; err != nil {
+		return err
+	}
+	if agent.Status != models.AgentStatusPublished {
+		if err := s.tiers.CheckPublishLimit(agent.PublisherID); err != nil {
+			return err
+		}
+		if err := s.CheckPublishable(&agent); err != nil {
+			return err
+		}
+	}
+
 	now := time.Now()
 	updates := map[string]interface{}{
 		"status":       models.AgentStatusPublished,
 		"published_at": &now,
 	}
-	return s.UpdateAgent(id, updates)
+	if err := s.UpdateAgent(id, updates); err != nil {
+		return err
+	}
+	return s.PublishCurrentVersion(id)
 }
 
 // UnpublishAgent unpublishes an agent
@@ -91,11 +162,6 @@ func (s *AgentService) UnpublishAgent(id uuid.UUID) error {
 	return s.UpdateAgent(id, updates)
 }
 
-// IncrementDownloads increments the download count for an agent
-func (s *AgentService) IncrementDownloads(id uuid.UUID) error {
-	return s.db.Model(&models.Agent{}).Where("id = ?", id).UpdateColumn("downloads", gorm.Expr("downloads + ?", 1)).Error
-}
-
 // GetAgentStats returns statistics for an agent
 func (s *AgentService) GetAgentStats(id uuid.UUID) (map[string]interface{}, error) {
 	var agent models.Agent
@@ -107,12 +173,12 @@ func (s *AgentService) GetAgentStats(id uuid.UUID) (map[string]interface{}, erro
 	var avgRating float64
 
 	// Get review statistics
-	if err := s.db.Model(&models.Review{}).Where("agent_id = ?", id).Count(&reviewCount).Error; err != nil {
+	if err := s.db.Model(&models.Review{}).Where("agent_id = ? AND hidden_at IS NULL", id).Count(&reviewCount).Error; err != nil {
 		return nil, err
 	}
 
 	if reviewCount > 0 {
-		if err := s.db.Model(&models.Review{}).Where("agent_id = ?", id).Select("AVG(rating)").Scan(&avgRating).Error; err != nil {
+		if err := s.db.Model(&models.Review{}).Where("agent_id = ? AND hidden_at IS NULL", id).Select("AVG(rating)").Scan(&avgRating).Error; err != nil {
 			return nil, err
 		}
 	}
@@ -170,16 +236,15 @@ func (s *AgentService) GetAgentsByPublisher(publisherID uuid.UUID, page, limit i
 	return s.GetAgents(page, limit, filters)
 }
 
-// GetFeaturedAgents gets featured agents (high rating, many downloads)
+// GetFeaturedAgents gets the agents trending most
 func (s *AgentService) GetFeaturedAgents(limit int) ([]models.Agent, error) {
 	var agents []models.Agent
 
 	query := s.db.Model(&models.Agent{}).
-		Where("deleted_at IS NULL").
-		Where("status = ?", models.AgentStatusPublished).
-		Where("rating >= ?", 4.0).
-		Where("downloads >= ?", 10).
-		Order("rating DESC, downloads DESC").
+		Joins("JOIN agent_popularities ON agent_popularities.agent_id = agents.id").
+		Where("agents.deleted_at IS NULL").
+		Where("agents.status = ?", models.AgentStatusPublished).
+		Order("agent_popularities.score DESC, agents.id").
 		Limit(limit).
 		Preload("Publisher")
 
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// GetAgentHistory returns the versions of an agent's listing, newest first.
+// Deleted agents keep their history.
+func (s *AgentService) GetAgentHistory(id uuid.UUID, page, limit int) ([]models.AgentHistory, int64, error) {
+	if err := s.agentExisted(id); err != nil {
+		return nil, 0, err
+	}
+	query := s.db.Model(&models.AgentHistory{}).Where("agent_id = ?", id)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var history []models.AgentHistory
+	if err := query.Order("valid_from DESC").Offset((page - 1) * limit).Limit(limit).Find(&history).Error; err != nil {
+		return nil, 0, err
+	}
+	return history, total, nil
+}
+
+// GetAgentAsOf returns an agent's listing as it was at asOf. It returns
+// gorm.ErrRecordNotFound if the agent was not listed then.
+func (s *AgentService) GetAgentAsOf(id uuid.UUID, asOf time.Time) (*models.AgentHistory, error) {
+	var entry models.AgentHistory
+	if err := s.db.Where("agent_id = ? AND valid_from <= ? AND (valid_to IS NULL OR valid_to > ?)", id, asOf, asOf).
+		Order("valid_from DESC").
+		First(&entry).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *AgentService) agentExisted(id uuid.UUID) error {
+	var count int64
+	if err := s.db.Unscoped().Model(&models.Agent{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
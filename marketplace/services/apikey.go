@@ -0,0 +1,430 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// apiKeyPrefix starts every API product key, so leaked keys are easy to spot
+const apiKeyPrefix = "epk_"
+
+var (
+	// ErrInvalidAPIKey is returned for an unknown or revoked API key
+	ErrInvalidAPIKey = errors.New("API key is invalid or revoked")
+	// ErrAPIKeySuspended is returned for a key suspended for abuse
+	ErrAPIKeySuspended = errors.New("API key is suspended")
+	// ErrAPIKeyLimit is returned when a user already has the maximum number of keys
+	ErrAPIKeyLimit = errors.New("maximum number of API keys reached")
+	// ErrAPIRateLimited is returned when a key exceeds its per-minute limit
+	ErrAPIRateLimited = errors.New("API key request limit exceeded")
+	// ErrAPIQuotaExceeded is returned when a key used up its daily quota
+	ErrAPIQuotaExceeded = errors.New("API key daily quota exceeded")
+)
+
+// APIKeyUsageReport is the usage dashboard of an API key
+type APIKeyUsageReport struct {
+	Key               *models.APIKey       `json:"key"`
+	RequestsPerMinute int64                `json:"requests_per_minute"`
+	RequestsPerDay    int64                `json:"requests_per_day"`
+	Today             models.APIKeyUsage   `json:"today"`
+	Days              []models.APIKeyUsage `json:"days"` // oldest first, days without requests are left out
+}
+
+// APIKeyQuota is where a key stands against whichever of its limits is
+// closest to running out, for the X-RateLimit-* response headers
+type APIKeyQuota struct {
+	Limit     int64
+	Remaining int64
+	Reset     time.Time
+	Grace     bool // over the limit, and let through by grace mode
+}
+
+// APIKeyService manages the API product keys of the public API and
+// enforces their quotas. Per-minute counts are kept per instance; daily
+// counts are stored so they hold across instances and feed the dashboard.
+type APIKeyService struct {
+	db     *gorm.DB
+	cfg    config.PublicAPIConfig
+	limits *LimitService
+
+	mu     sync.Mutex
+	window time.Time
+	counts map[uuid.UUID]int
+}
+
+// NewAPIKeyService creates a new API key service
+func NewAPIKeyService(db *gorm.DB, cfg config.PublicAPIConfig, limits *LimitService) *APIKeyService {
+	return &APIKeyService{db: db, cfg: cfg, limits: limits, counts: make(map[uuid.UUID]int)}
+}
+
+// CreateKey creates an API key for a user. The key itself is only returned
+// here; afterwards only its prefix is known.
+func (s *APIKeyService) CreateKey(ownerID uuid.UUID, name string) (*models.APIKey, string, error) {
+	var count int64
+	if err := s.db.Model(&models.APIKey{}).
+		Where("owner_id = ? AND status <> ?", ownerID, models.APIKeyStatusRevoked).
+		Count(&count).Error; err != nil {
+		return nil, "", err
+	}
+	if max := s.limits.Get(ownerID, "", models.LimitMaxAPIKeys); max > 0 && count >= max {
+		return nil, "", ErrAPIKeyLimit
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	secret := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	key := &models.APIKey{
+		OwnerID: ownerID,
+		Name:    name,
+		Prefix:  secret[:len(apiKeyPrefix)+6],
+		KeyHash: hashToken(secret),
+		Status:  models.APIKeyStatusActive,
+	}
+	if err := s.db.Create(key).Error; err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// GetKeys returns a user's keys that are not revoked
+func (s *APIKeyService) GetKeys(ownerID uuid.UUID) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	err := s.db.Where("owner_id = ? AND status <> ?", ownerID, models.APIKeyStatusRevoked).
+		Order("created_at DESC").
+		Find(&keys).Error
+	return keys, err
+}
+
+// RevokeKey permanently disables one of a user's keys
+func (s *APIKeyService) RevokeKey(ownerID, id uuid.UUID) error {
+	result := s.db.Model(&models.APIKey{}).
+		Where("id = ? AND owner_id = ? AND status <> ?", id, ownerID, models.APIKeyStatusRevoked).
+		Updates(map[string]interface{}{"status": models.APIKeyStatusRevoked, "revoked_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetUsage returns the usage dashboard of one of a user's keys
+func (s *APIKeyService) GetUsage(ownerID, id uuid.UUID) (*APIKeyUsageReport, error) {
+	var key models.APIKey
+	if err := s.db.First(&key, "id = ? AND owner_id = ? AND status <> ?", id, ownerID, models.APIKeyStatusRevoked).Error; err != nil {
+		return nil, err
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	var days []models.APIKeyUsage
+	if err := s.db.Where("key_id = ? AND day > ?", key.ID, today.AddDate(0, 0, -s.cfg.UsageDays)).
+		Order("day ASC").
+		Find(&days).Error; err != nil {
+		return nil, err
+	}
+
+	report := &APIKeyUsageReport{
+		Key:               &key,
+		RequestsPerMinute: s.limits.Get(ownerID, "", models.LimitAPIRequestsPerMinute),
+		RequestsPerDay:    s.limits.Get(ownerID, "", models.LimitAPIRequestsPerDay),
+		Today:             models.APIKeyUsage{KeyID: key.ID, Day: today},
+		Days:              days,
+	}
+	if n := len(days); n > 0 && days[n-1].Day.Equal(today) {
+		report.Today = days[n-1]
+	}
+	return report, nil
+}
+
+// GetAllKeys returns keys of every user for admins, optionally filtered by status
+func (s *APIKeyService) GetAllKeys(status models.APIKeyStatus, page, limit int) ([]models.APIKey, int64, error) {
+	query := s.db.Model(&models.APIKey{})
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var keys []models.APIKey
+	offset := (page - 1) * limit
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&keys).Error; err != nil {
+		return nil, 0, err
+	}
+	return keys, total, nil
+}
+
+// SetStatus suspends or reactivates a key on behalf of an admin. Revoked
+// keys cannot be changed.
+func (s *APIKeyService) SetStatus(id uuid.UUID, status models.APIKeyStatus, reason string) (*models.APIKey, error) {
+	var key models.APIKey
+	if err := s.db.First(&key, "id = ? AND status <> ?", id, models.APIKeyStatusRevoked).Error; err != nil {
+		return nil, err
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if status == models.APIKeyStatusSuspended {
+			now := time.Now()
+			key.SuspendedReason = reason
+			key.SuspendedAt = &now
+		} else {
+			key.SuspendedReason = ""
+			key.SuspendedAt = nil
+
+			// Otherwise the rejections that suspended the key would suspend
+			// it again on its next rejected request
+			if err := tx.Model(&models.APIKeyUsage{}).
+				Where("key_id = ? AND day = ?", key.ID, time.Now().UTC().Truncate(24*time.Hour)).
+				Update("rejected", 0).Error; err != nil {
+				return err
+			}
+		}
+		key.Status = status
+		return tx.Model(&key).Select("status", "suspended_reason", "suspended_at").Updates(&key).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// SetGraceMode turns grace mode on or off for one of a user's keys
+func (s *APIKeyService) SetGraceMode(ownerID, id uuid.UUID, grace bool) (*models.APIKey, error) {
+	var key models.APIKey
+	if err := s.db.First(&key, "id = ? AND owner_id = ? AND status <> ?", id, ownerID, models.APIKeyStatusRevoked).Error; err != nil {
+		return nil, err
+	}
+	key.GraceMode = grace
+	if err := s.db.Model(&key).Update("grace_mode", grace).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// Authorize checks an API key and counts a request against its quotas,
+// returning the quota closest to running out, also when a limit was hit.
+// Keys in grace mode may go grace_percent over their limits; their owner
+// is notified once a day when a key nears its daily quota or goes over a
+// limit. A key whose requests keep being rejected in a day is suspended.
+func (s *APIKeyService) Authorize(secret string) (*models.APIKey, *APIKeyQuota, error) {
+	var key models.APIKey
+	if err := s.db.First(&key, "key_hash = ?", hashToken(secret)).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil, ErrInvalidAPIKey
+		}
+		return nil, nil, err
+	}
+	switch key.Status {
+	case models.APIKeyStatusActive:
+	case models.APIKeyStatusSuspended:
+		return nil, nil, ErrAPIKeySuspended
+	default:
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	now := time.Now()
+	day := now.UTC().Truncate(24 * time.Hour)
+
+	// Concurrent requests may go slightly over the daily quota; it is a
+	// budget, not a hard limit
+	var usage models.APIKeyUsage
+	if err := s.db.Where("key_id = ? AND day = ?", key.ID, day).Limit(1).Find(&usage).Error; err != nil {
+		return nil, nil, err
+	}
+
+	perDay := s.limits.Get(key.OwnerID, "", models.LimitAPIRequestsPerDay)
+	perMinute := s.limits.Get(key.OwnerID, "", models.LimitAPIRequestsPerMinute)
+	dayCap, minuteCap := perDay, perMinute
+	if key.GraceMode {
+		dayCap, minuteCap = s.withGrace(perDay), s.withGrace(perMinute)
+	}
+
+	// Both counts include this request
+	requests := int64(usage.Requests) + 1
+	var minute int64
+	var limitErr error
+	if dayCap > 0 && requests > dayCap {
+		limitErr = ErrAPIQuotaExceeded
+	} else {
+		var allowed bool
+		if minute, allowed = s.allowMinute(key.ID, minuteCap, now); !allowed {
+			limitErr = ErrAPIRateLimited
+		}
+	}
+
+	dayQuota := quotaOf(perDay, requests, day.Add(24*time.Hour))
+	minuteQuota := quotaOf(perMinute, minute, now.Truncate(time.Minute).Add(time.Minute))
+	quota := tighterQuota(dayQuota, minuteQuota)
+	switch limitErr {
+	case ErrAPIQuotaExceeded:
+		quota = dayQuota
+	case ErrAPIRateLimited:
+		quota = minuteQuota
+	}
+	if limitErr != nil {
+		if err := s.reject(&key, day, usage.Rejected+1); err != nil {
+			return nil, nil, err
+		}
+		return nil, quota, limitErr
+	}
+
+	if err := s.recordUsage(key.ID, day, "requests"); err != nil {
+		return nil, nil, err
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > time.Minute {
+		if err := s.db.Model(&key).Update("last_used_at", now).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if (dayQuota != nil && dayQuota.Grace) || (minuteQuota != nil && minuteQuota.Grace) {
+		if quota != nil {
+			quota.Grace = true
+		}
+		if err := s.recordUsage(key.ID, day, "graced"); err != nil {
+			return nil, nil, err
+		}
+		s.warnOnce(&key, day, "grace_warned", "Your API key "+key.Name+" is over its limits",
+			fmt.Sprintf("Requests with %s... went over its limits today and were only let through by grace mode. Once %d%% over, they are refused with 429.", key.Prefix, s.cfg.GracePercent))
+	} else if s.cfg.WarnAt > 0 && perDay > 0 && requests*100 >= perDay*int64(s.cfg.WarnAt) {
+		s.warnOnce(&key, day, "warned", "Your API key "+key.Name+" is nearing its daily quota",
+			fmt.Sprintf("Requests with %s... used %d of the %d allowed today. Further requests are refused with 429 once the quota is used up, until midnight UTC.", key.Prefix, requests, perDay))
+	}
+	return &key, quota, nil
+}
+
+// withGrace raises a limit by the grace percentage
+func (s *APIKeyService) withGrace(limit int64) int64 {
+	return limit + limit*int64(s.cfg.GracePercent)/100
+}
+
+// quotaOf returns the quota of a limit used count times, or nil when there
+// is no limit
+func quotaOf(limit, count int64, reset time.Time) *APIKeyQuota {
+	if limit == 0 {
+		return nil
+	}
+	quota := &APIKeyQuota{Limit: limit, Remaining: limit - count, Reset: reset}
+	if quota.Remaining < 0 {
+		quota.Remaining = 0
+		quota.Grace = true
+	}
+	return quota
+}
+
+// tighterQuota returns the quota with fewer requests remaining
+func tighterQuota(a, b *APIKeyQuota) *APIKeyQuota {
+	if a == nil || (b != nil && b.Remaining < a.Remaining) {
+		return b
+	}
+	return a
+}
+
+// allowMinute counts a request in the key's current one-minute window and
+// returns the window's count
+func (s *APIKeyService) allowMinute(keyID uuid.UUID, limit int64, now time.Time) (int64, bool) {
+	if limit == 0 {
+		return 0, true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if window := now.Truncate(time.Minute); !window.Equal(s.window) {
+		s.window = window
+		s.counts = make(map[uuid.UUID]int)
+	}
+	if int64(s.counts[keyID]) >= limit {
+		return limit, false
+	}
+	s.counts[keyID]++
+	return int64(s.counts[keyID]), true
+}
+
+// warnOnce notifies the owner of a key unless the flag column of its usage
+// of day says they already were. Failures are only logged, so the request
+// still goes through.
+func (s *APIKeyService) warnOnce(key *models.APIKey, day time.Time, flag, title, body string) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.APIKeyUsage{}).
+			Where("key_id = ? AND day = ? AND "+flag+" = ?", key.ID, day, false).
+			Update(flag, true)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return notify(tx, &models.Notification{
+			UserID: key.OwnerID,
+			Type:   models.NotificationTypeAPIUsage,
+			Title:  title,
+			Body:   body,
+			Link:   fmt.Sprintf("/api-keys/%s/usage", key.ID),
+		})
+	})
+	if err != nil {
+		log.Error().Err(err).Str("api_key_id", key.ID.String()).Msg("Failed to warn API key owner")
+	}
+}
+
+// reject records a rejected request and suspends the key once rejected
+// requests reach the threshold
+func (s *APIKeyService) reject(key *models.APIKey, day time.Time, rejected int) error {
+	if err := s.recordUsage(key.ID, day, "rejected"); err != nil {
+		return err
+	}
+	if rejected < s.cfg.SuspendAfter {
+		return nil
+	}
+
+	result := s.db.Model(&models.APIKey{}).
+		Where("id = ? AND status = ?", key.ID, models.APIKeyStatusActive).
+		Updates(map[string]interface{}{
+			"status":           models.APIKeyStatusSuspended,
+			"suspended_reason": "Too many requests over the key's limits",
+			"suspended_at":     time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Warn().Str("api_key_id", key.ID.String()).Str("owner_id", key.OwnerID.String()).
+			Int("rejected", rejected).Msg("Suspended API key for abuse")
+	}
+	return nil
+}
+
+// recordUsage adds one to a counter column of the key's usage of day
+func (s *APIKeyService) recordUsage(keyID uuid.UUID, day time.Time, column string) error {
+	usage := models.APIKeyUsage{KeyID: keyID, Day: day}
+	switch column {
+	case "rejected":
+		usage.Rejected = 1
+	case "graced":
+		usage.Graced = 1
+	default:
+		usage.Requests = 1
+	}
+	return s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "key_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			column: gorm.Expr("api_key_usages." + column + " + 1"),
+		}),
+	}).Create(&usage).Error
+}
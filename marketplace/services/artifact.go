@@ -0,0 +1,481 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// JobTypeArtifact is the job building a form of a release's binary
+const JobTypeArtifact = "artifact.build"
+
+// deltaMagic starts every delta, ahead of its operations
+const deltaMagic = "EPD1"
+
+// deltaBlockSize is the length of the base release's blocks a delta copies
+// from. Smaller blocks find more matches but index more of the base.
+const deltaBlockSize = 4096
+
+// Operations of a delta
+const (
+	deltaOpCopy = 'C' // offset and length in the base release, as uvarints
+	deltaOpData = 'D' // length as a uvarint, then that many bytes
+	deltaOpEnd  = 'E'
+)
+
+// errArtifactTooLarge is returned when a binary is over downloads.max_build_size
+var errArtifactTooLarge = errors.New("binary is larger than downloads.max_build_size")
+
+// LinkConstraints describe a device's connection and which artifact forms
+// it can handle. The zero value gets the binary as uploaded.
+type LinkConstraints struct {
+	MaxBandwidth     int64  // bytes per second, 0 if unknown
+	Metered          bool   // the device pays for what it downloads
+	BaseVersion      string // the release the device runs, for a delta
+	AcceptDelta      bool
+	AcceptCompressed bool
+	AcceptRanges     bool // the device can download in ranges and resume them
+}
+
+// ArtifactRange is a byte range of an artifact, inclusive at both ends as
+// in a Range header
+type ArtifactRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// DownloadArtifact is the form of a release's binary chosen for a device
+type DownloadArtifact struct {
+	Form             models.ArtifactForm   `json:"form"`
+	URL              string                `json:"url"`
+	Size             int64                 `json:"size"`
+	Checksum         string                `json:"sha256"`                      // of the artifact; the binary's is binary_checksum
+	Encoding         string                `json:"encoding,omitempty"`          // gzip for compressed forms and deltas
+	BaseVersion      string                `json:"base_version,omitempty"`      // the release a delta applies to
+	Ranges           []ArtifactRange       `json:"ranges,omitempty"`            // planned for slow or metered links
+	EstimatedSeconds *int64                `json:"estimated_seconds,omitempty"` // at the stated bandwidth
+	Building         []models.ArtifactForm `json:"building,omitempty"`          // smaller forms a later download may get
+}
+
+// artifactJob is the payload of an artifact job
+type artifactJob struct {
+	ArtifactID uuid.UUID `json:"artifact_id"`
+}
+
+// ArtifactService picks the form of a release's binary that suits a
+// device's link: the binary as uploaded, gzipped, or a delta from the
+// release the device runs, whichever is smallest. Forms are built by
+// background jobs the first time a device could use them, so until then
+// devices get the next best form. Large artifacts come with a plan of
+// ranges sized to the link, which devices download and resume one by one.
+type ArtifactService struct {
+	db            *gorm.DB
+	storage       Storage
+	queue         *JobQueue
+	cfg           config.DownloadsConfig
+	presignExpiry time.Duration
+}
+
+// NewArtifactService creates a new artifact service and registers the job
+// building artifacts
+func NewArtifactService(db *gorm.DB, storage Storage, queue *JobQueue, cfg config.DownloadsConfig, presignExpiry time.Duration) *ArtifactService {
+	s := &ArtifactService{db: db, storage: storage, queue: queue, cfg: cfg, presignExpiry: presignExpiry}
+	queue.Register(JobTypeArtifact, JobOptions{Timeout: 10 * time.Minute}, s.build)
+	return s
+}
+
+func artifactKey(release *models.AgentVersion, form models.ArtifactForm, baseVersion string) string {
+	if form == models.ArtifactFormDelta {
+		return fmt.Sprintf("agents/%s/%s/artifacts/delta-%s", release.AgentID, release.Version, baseVersion)
+	}
+	return fmt.Sprintf("agents/%s/%s/artifacts/%s", release.AgentID, release.Version, form)
+}
+
+// Negotiate returns the smallest ready form of a release's binary that the
+// device accepts, with ranges planned for its link. binaryURL is where the
+// binary as uploaded is downloaded. Forms the device could use that were
+// never built are queued for building.
+func (s *ArtifactService) Negotiate(ctx context.Context, release *models.AgentVersion, binaryURL string, link LinkConstraints) (*DownloadArtifact, error) {
+	best := &DownloadArtifact{
+		Form:     models.ArtifactFormFull,
+		URL:      binaryURL,
+		Size:     release.BinarySize,
+		Checksum: release.BinaryChecksum,
+	}
+	stored := isStored(release.BinaryURL, binaryKey(release))
+
+	wanted, err := s.wantedForms(release, link, stored)
+	if err != nil {
+		return nil, err
+	}
+	if len(wanted) > 0 {
+		var built []models.ReleaseArtifact
+		if err := s.db.Where("release_id = ? AND base_version IN ?", release.ID, []string{"", link.BaseVersion}).
+			Find(&built).Error; err != nil {
+			return nil, err
+		}
+
+		var ready *models.ReleaseArtifact
+		for _, want := range wanted {
+			artifact := findArtifact(built, want.Form, want.BaseVersion)
+			if artifact == nil {
+				if err := s.queueBuild(ctx, &want); err != nil {
+					return nil, err
+				}
+				artifact = &want
+			}
+			switch artifact.Status {
+			case models.ArtifactStatusPending:
+				best.Building = append(best.Building, artifact.Form)
+			case models.ArtifactStatusReady:
+				if artifact.Size < best.Size && (ready == nil || artifact.Size < ready.Size) {
+					ready = artifact
+				}
+			}
+		}
+
+		if ready != nil {
+			url, err := s.storage.PresignedURL(ctx, artifactKey(release, ready.Form, ready.BaseVersion), s.presignExpiry)
+			if err != nil {
+				return nil, err
+			}
+			best.Form = ready.Form
+			best.URL = url
+			best.Size = ready.Size
+			best.Checksum = ready.Checksum
+			best.Encoding = "gzip"
+			best.BaseVersion = ready.BaseVersion
+		}
+	}
+
+	if link.MaxBandwidth > 0 {
+		seconds := (best.Size + link.MaxBandwidth - 1) / link.MaxBandwidth
+		best.EstimatedSeconds = &seconds
+	}
+	// Ranges need a server that honors them, which storage does but an
+	// external URL may not
+	if link.AcceptRanges && stored {
+		best.Ranges = s.planRanges(best.Size, link)
+	}
+	return best, nil
+}
+
+// wantedForms returns the artifacts that would serve a device better than
+// the binary as uploaded, or none if the release cannot have artifacts
+func (s *ArtifactService) wantedForms(release *models.AgentVersion, link LinkConstraints, stored bool) ([]models.ReleaseArtifact, error) {
+	if !stored || release.Status == models.AgentVersionStatusDraft || release.BinarySize > s.cfg.MaxBuildSize {
+		return nil, nil
+	}
+
+	var wanted []models.ReleaseArtifact
+	if link.AcceptCompressed && s.cfg.Compression {
+		wanted = append(wanted, models.ReleaseArtifact{ReleaseID: release.ID, Form: models.ArtifactFormCompressed})
+	}
+	if link.AcceptDelta && s.cfg.Deltas && link.BaseVersion != "" && link.BaseVersion != release.Version {
+		var base models.AgentVersion
+		err := s.db.Select("id", "agent_id", "version", "binary_url", "binary_size", "status").
+			Where("agent_id = ? AND version = ?", release.AgentID, link.BaseVersion).First(&base).Error
+		switch {
+		case err == gorm.ErrRecordNotFound:
+			// An unknown base only rules out a delta
+		case err != nil:
+			return nil, err
+		case base.Status != models.AgentVersionStatusDraft && isStored(base.BinaryURL, binaryKey(&base)) && base.BinarySize <= s.cfg.MaxBuildSize:
+			wanted = append(wanted, models.ReleaseArtifact{ReleaseID: release.ID, Form: models.ArtifactFormDelta, BaseVersion: base.Version})
+		}
+	}
+	return wanted, nil
+}
+
+// findArtifact returns the artifact of a form among those built, or nil
+func findArtifact(built []models.ReleaseArtifact, form models.ArtifactForm, baseVersion string) *models.ReleaseArtifact {
+	for i := range built {
+		if built[i].Form == form && built[i].BaseVersion == baseVersion {
+			return &built[i]
+		}
+	}
+	return nil
+}
+
+// queueBuild records a pending artifact and queues the job building it. A
+// concurrent download may have recorded it first, in which case it queues
+// nothing. Without a job queue the record is dropped so a later download
+// tries again.
+func (s *ArtifactService) queueBuild(ctx context.Context, artifact *models.ReleaseArtifact) error {
+	artifact.Status = models.ArtifactStatusPending
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(artifact)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+
+	if _, err := s.queue.Enqueue(ctx, JobTypeArtifact, artifactJob{ArtifactID: artifact.ID}); err != nil {
+		if err != ErrJobQueueUnavailable {
+			log.Warn().Err(err).Str("release_id", artifact.ReleaseID.String()).Msg("Failed to queue artifact build")
+		}
+		if err := s.db.Delete(&models.ReleaseArtifact{}, "id = ?", artifact.ID).Error; err != nil {
+			log.Error().Err(err).Str("release_id", artifact.ReleaseID.String()).Msg("Failed to drop unqueued artifact")
+		}
+		artifact.Status = models.ArtifactStatusDiscarded
+	}
+	return nil
+}
+
+// planRanges splits an artifact into ranges a device downloads one at a
+// time, when its link is metered or the whole would take longer than
+// downloads.chunk_after. Each range takes about downloads.chunk_duration at
+// the stated bandwidth, so little is lost when the link drops.
+func (s *ArtifactService) planRanges(size int64, link LinkConstraints) []ArtifactRange {
+	chunk := s.cfg.MaxChunkSize
+	if link.MaxBandwidth > 0 {
+		if !link.Metered && time.Duration(size/link.MaxBandwidth)*time.Second <= s.cfg.ChunkAfter {
+			return nil
+		}
+		chunk = min(max(link.MaxBandwidth*int64(s.cfg.ChunkDuration/time.Second), s.cfg.MinChunkSize), s.cfg.MaxChunkSize)
+	} else if !link.Metered {
+		return nil
+	}
+	if size <= chunk {
+		return nil
+	}
+
+	ranges := make([]ArtifactRange, 0, (size+chunk-1)/chunk)
+	for start := int64(0); start < size; start += chunk {
+		ranges = append(ranges, ArtifactRange{Start: start, End: min(start+chunk, size) - 1})
+	}
+	return ranges
+}
+
+// build is the job building an artifact. Artifacts that come out less than
+// downloads.min_savings smaller than the binary are discarded rather than
+// stored, as are those whose binaries are gone or too large.
+func (s *ArtifactService) build(ctx context.Context, payload json.RawMessage) error {
+	var job artifactJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return PermanentJobError(err)
+	}
+	var artifact models.ReleaseArtifact
+	if err := s.db.First(&artifact, "id = ?", job.ArtifactID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+	if artifact.Status != models.ArtifactStatusPending {
+		return nil
+	}
+	var release models.AgentVersion
+	if err := s.db.First(&release, "id = ?", artifact.ReleaseID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+
+	data, err := s.encode(ctx, &release, &artifact)
+	if err == ErrObjectNotFound || err == errArtifactTooLarge {
+		return s.discard(&artifact, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if int64(len(data))*100 > release.BinarySize*int64(100-s.cfg.MinSavings) {
+		return s.discard(&artifact, fmt.Sprintf("not %d%% smaller than the binary", s.cfg.MinSavings))
+	}
+
+	if _, err := s.storage.Put(ctx, artifactKey(&release, artifact.Form, artifact.BaseVersion), bytes.NewReader(data), int64(len(data)), "application/gzip"); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if err := s.db.Model(&artifact).Where("status = ?", models.ArtifactStatusPending).Updates(map[string]interface{}{
+		"status":   models.ArtifactStatusReady,
+		"size":     len(data),
+		"checksum": hex.EncodeToString(sum[:]),
+	}).Error; err != nil {
+		return err
+	}
+	log.Info().Str("release_id", release.ID.String()).Str("form", string(artifact.Form)).Int64("binary_size", release.BinarySize).
+		Int("size", len(data)).Msg("Release artifact built")
+	return nil
+}
+
+// discard records that an artifact will not be served
+func (s *ArtifactService) discard(artifact *models.ReleaseArtifact, reason string) error {
+	return s.db.Model(artifact).Where("status = ?", models.ArtifactStatusPending).Updates(map[string]interface{}{
+		"status": models.ArtifactStatusDiscarded,
+		"error":  reason,
+	}).Error
+}
+
+// encode returns the gzipped content of an artifact
+func (s *ArtifactService) encode(ctx context.Context, release *models.AgentVersion, artifact *models.ReleaseArtifact) ([]byte, error) {
+	target, err := s.readBinary(ctx, release)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	switch artifact.Form {
+	case models.ArtifactFormCompressed:
+		_, err = gz.Write(target)
+	case models.ArtifactFormDelta:
+		var base models.AgentVersion
+		if err := s.db.Where("agent_id = ? AND version = ?", release.AgentID, artifact.BaseVersion).First(&base).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, ErrObjectNotFound
+			}
+			return nil, err
+		}
+		var source []byte
+		if source, err = s.readBinary(ctx, &base); err != nil {
+			return nil, err
+		}
+		err = writeDelta(gz, source, target)
+	default:
+		return nil, PermanentJobError(fmt.Errorf("unknown artifact form %q", artifact.Form))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readBinary reads a release's binary from storage
+func (s *ArtifactService) readBinary(ctx context.Context, release *models.AgentVersion) ([]byte, error) {
+	body, err := s.storage.Get(ctx, binaryKey(release))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(body, s.cfg.MaxBuildSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.cfg.MaxBuildSize {
+		return nil, errArtifactTooLarge
+	}
+	return data, nil
+}
+
+// writeDelta writes the operations rebuilding target from base. Blocks of
+// the base are indexed by a rolling checksum, as in rsync, so matches are
+// found at any offset of the target, then extended byte by byte.
+func writeDelta(w io.Writer, base, target []byte) error {
+	blocks := map[uint32][]int{}
+	for off := 0; off+deltaBlockSize <= len(base); off += deltaBlockSize {
+		sum := blockChecksum(base[off : off+deltaBlockSize])
+		blocks[sum] = append(blocks[sum], off)
+	}
+
+	d := deltaWriter{w: w}
+	d.write([]byte(deltaMagic))
+	literal := 0 // where the target's unmatched bytes start
+	var a, b uint32
+	rolling := false
+	for i := 0; i+deltaBlockSize <= len(target); {
+		if !rolling {
+			a, b = blockSums(target[i : i+deltaBlockSize])
+			rolling = true
+		}
+		if off, ok := matchBlock(blocks[a|b<<16], base, target[i:i+deltaBlockSize]); ok {
+			n := deltaBlockSize
+			for i+n < len(target) && off+n < len(base) && target[i+n] == base[off+n] {
+				n++
+			}
+			d.data(target[literal:i])
+			d.copy(off, n)
+			i += n
+			literal = i
+			rolling = false
+			continue
+		}
+
+		// Slide the window one byte
+		if i+deltaBlockSize < len(target) {
+			out, in := uint32(target[i]), uint32(target[i+deltaBlockSize])
+			a = (a - out + in) & 0xffff
+			b = (b - deltaBlockSize*out + a) & 0xffff
+		}
+		i++
+	}
+	d.data(target[literal:])
+	d.write([]byte{deltaOpEnd})
+	return d.err
+}
+
+// blockSums returns the two halves of a block's rolling checksum
+func blockSums(block []byte) (a, b uint32) {
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(len(block)-i) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// blockChecksum returns a block's rolling checksum
+func blockChecksum(block []byte) uint32 {
+	a, b := blockSums(block)
+	return a | b<<16
+}
+
+// matchBlock returns the offset of a base block with the same checksum that
+// really holds the same bytes
+func matchBlock(offsets []int, base, block []byte) (int, bool) {
+	for _, off := range offsets {
+		if bytes.Equal(base[off:off+len(block)], block) {
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+// deltaWriter writes delta operations, keeping the first error
+type deltaWriter struct {
+	w   io.Writer
+	err error
+	buf [2*binary.MaxVarintLen64 + 1]byte
+}
+
+func (d *deltaWriter) write(p []byte) {
+	if d.err == nil {
+		_, d.err = d.w.Write(p)
+	}
+}
+
+func (d *deltaWriter) copy(off, n int) {
+	op := append(d.buf[:0], deltaOpCopy)
+	op = binary.AppendUvarint(op, uint64(off))
+	d.write(binary.AppendUvarint(op, uint64(n)))
+}
+
+func (d *deltaWriter) data(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	op := append(d.buf[:0], deltaOpData)
+	d.write(binary.AppendUvarint(op, uint64(len(p))))
+	d.write(p)
+}
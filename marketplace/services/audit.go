@@ -0,0 +1,82 @@
+package services
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// AuditLogFilter narrows the audit logs returned by GetLogs. Zero fields
+// match everything.
+type AuditLogFilter struct {
+	ActorID    *uuid.UUID
+	ActorType  models.AuditActor
+	EntityType string
+	EntityID   *uuid.UUID
+	Action     models.AuditAction
+	From       *time.Time // inclusive
+	To         *time.Time // exclusive
+}
+
+// AuditService records sensitive changes, such as status and role changes,
+// agent reviews, refunds and deletions, and reads by reporting service
+// accounts, and lists them for admins
+type AuditService struct {
+	db *gorm.DB
+}
+
+// NewAuditService creates a new audit service
+func NewAuditService(db *gorm.DB) *AuditService {
+	return &AuditService{db: db}
+}
+
+// Record stores an audit log entry. It is called once the change has been
+// made, so failures are logged rather than returned.
+func (s *AuditService) Record(entry *models.AuditLog) {
+	if err := s.db.Create(entry).Error; err != nil {
+		log.Error().Err(err).
+			Str("action", string(entry.Action)).
+			Str("entity_id", entry.EntityID.String()).
+			Msg("Failed to record audit log")
+	}
+}
+
+// GetLogs returns the audit logs matching a filter, newest first
+func (s *AuditService) GetLogs(filter AuditLogFilter, page, limit int) ([]models.AuditLog, int64, error) {
+	query := s.db.Model(&models.AuditLog{})
+	if filter.ActorID != nil {
+		query = query.Where("actor_id = ?", *filter.ActorID)
+	}
+	if filter.ActorType != "" {
+		query = query.Where("actor_type = ?", filter.ActorType)
+	}
+	if filter.EntityType != "" {
+		query = query.Where("entity_type = ?", filter.EntityType)
+	}
+	if filter.EntityID != nil {
+		query = query.Where("entity_id = ?", *filter.EntityID)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.From != nil {
+		query = query.Where("created_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		query = query.Where("created_at < ?", *filter.To)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var logs []models.AuditLog
+	if err := query.Order("created_at DESC").Offset((page - 1) * limit).Limit(limit).Find(&logs).Error; err != nil {
+		return nil, 0, err
+	}
+	return logs, total, nil
+}
@@ -1,6 +1,12 @@
 package services
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -8,6 +14,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 
@@ -15,17 +22,32 @@ import (
 	"github.com/edgeplug/marketplace/models"
 )
 
+var (
+	// ErrInvalidRefreshToken is returned for an unknown or expired refresh token
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token is used after
+	// rotation, which revokes all tokens of its login
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+	// ErrUserInactive is returned for the token of a user who was deleted,
+	// deactivated or banned after it was issued
+	ErrUserInactive = errors.New("user account is not active")
+)
+
 // AuthService handles authentication and authorization
 type AuthService struct {
-	config *config.Config
-	db     *gorm.DB
+	config   *config.Config
+	db       *gorm.DB
+	denylist *TokenDenylist
+	redis    *RedisService
 }
 
 // NewAuthService creates a new auth service
-func NewAuthService(cfg *config.Config, db *gorm.DB) *AuthService {
+func NewAuthService(cfg *config.Config, db *gorm.DB, denylist *TokenDenylist, redisSvc *RedisService) *AuthService {
 	return &AuthService{
-		config: cfg,
-		db:     db,
+		config:   cfg,
+		db:       db,
+		denylist: denylist,
+		redis:    redisSvc,
 	}
 }
 
@@ -34,23 +56,26 @@ type Claims struct {
 	UserID uuid.UUID `json:"user_id"`
 	Email  string    `json:"email"`
 	Role   string    `json:"role"`
+	Tier   string    `json:"tier"` // publisher plan, refreshed when a new token is issued
 	jwt.RegisteredClaims
 }
 
 // GenerateToken generates a JWT token for a user
-func (s *AuthService) GenerateToken(userID uuid.UUID, email, role string) (string, error) {
+func (s *AuthService) GenerateToken(userID uuid.UUID, email, role, tier string) (string, error) {
 	expirationTime := time.Now().Add(s.config.JWT.Expiration)
 
 	claims := &Claims{
 		UserID: userID,
 		Email:  email,
 		Role:   role,
+		Tier:   tier,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 			Issuer:    s.config.JWT.Issuer,
 			Subject:   userID.String(),
+			ID:        uuid.NewString(),
 		},
 	}
 
@@ -85,6 +110,78 @@ func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
+// Authenticate validates an access token and checks it against the denylist
+func (s *AuthService) Authenticate(ctx context.Context, tokenString string) (*Claims, error) {
+	claims, err := s.ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := s.denylist.IsRevoked(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, fmt.Errorf("token has been revoked")
+	}
+
+	if err := s.checkUserActive(ctx, claims.UserID); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// InvalidateUser drops a user's cached account status, so a status change
+// applies to their next request
+func (s *AuthService) InvalidateUser(ctx context.Context, userID uuid.UUID) error {
+	return s.redis.Degrade(s.redis.Client().Del(ctx, userStatusKey(userID)).Err())
+}
+
+// checkUserActive returns ErrUserInactive unless the user still exists and
+// is active. Statuses are cached in Redis for the user cache TTL; the
+// database is read directly while Redis is unavailable.
+func (s *AuthService) checkUserActive(ctx context.Context, userID uuid.UUID) error {
+	client := s.redis.Client()
+	key := userStatusKey(userID)
+
+	var status string
+	var err error = redis.Nil
+	if s.redis.Available() {
+		status, err = client.Get(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			log.Warn().Err(err).Msg("Failed to read cached user status")
+		}
+	}
+
+	if err != nil {
+		var user models.User
+		switch err := s.db.Select("status").First(&user, "id = ?", userID).Error; err {
+		case nil:
+			status = string(user.Status)
+		case gorm.ErrRecordNotFound:
+			status = "deleted"
+		default:
+			return err
+		}
+
+		if s.redis.Available() {
+			if err := client.Set(ctx, key, status, s.config.JWT.UserCacheTTL).Err(); err != nil {
+				log.Warn().Err(err).Msg("Failed to cache user status")
+			}
+		}
+	}
+
+	if status != string(models.UserStatusActive) {
+		return ErrUserInactive
+	}
+	return nil
+}
+
+// userStatusKey is the Redis key caching a user's account status
+func userStatusKey(userID uuid.UUID) string {
+	return "auth:user_status:" + userID.String()
+}
+
 // GetUserByID retrieves a user by ID
 func (s *AuthService) GetUserByID(userID uuid.UUID) (*models.User, error) {
 	var user models.User
@@ -134,15 +231,147 @@ func (s *AuthService) RefreshToken(userID uuid.UUID) (string, error) {
 		return "", fmt.Errorf("user not found: %w", err)
 	}
 
-	return s.GenerateToken(user.ID, user.Email, string(user.Role))
+	return s.GenerateToken(user.ID, user.Email, string(user.Role), string(user.Tier))
 }
 
-// RevokeToken revokes a token (in a real implementation, you would store revoked tokens)
-func (s *AuthService) RevokeToken(tokenString string) error {
-	// In a production environment, you would store revoked tokens in Redis or database
-	// For now, we'll just log the revocation
-	log.Info().Msgf("Token revoked: %s", tokenString)
-	return nil
+// RevokeToken denies an access token for the rest of its lifetime
+func (s *AuthService) RevokeToken(ctx context.Context, claims *Claims) error {
+	return s.denylist.Revoke(ctx, claims)
+}
+
+// IssueRefreshToken starts a new login family for a user and returns its
+// first refresh token
+func (s *AuthService) IssueRefreshToken(userID uuid.UUID, userAgent string) (string, error) {
+	token, record, err := s.newRefreshToken(userID, uuid.New(), userAgent)
+	if err != nil {
+		return "", err
+	}
+	if err := s.db.Create(record).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same
+// family and returns the user it belongs to. Using a token that was already
+// rotated means it leaked, so its whole family is revoked.
+func (s *AuthService) RotateRefreshToken(token, userAgent string) (*models.User, string, error) {
+	var current models.RefreshToken
+	if err := s.db.First(&current, "token_hash = ?", hashToken(token)).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, "", ErrInvalidRefreshToken
+		}
+		return nil, "", err
+	}
+	if current.RevokedAt != nil {
+		return nil, "", s.revokeReusedFamily(&current)
+	}
+	if time.Now().After(current.ExpiresAt) {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	user, err := s.GetUserByID(current.UserID)
+	if err != nil {
+		return nil, "", err
+	}
+	if user.Status != models.UserStatusActive {
+		return nil, "", ErrInvalidRefreshToken
+	}
+
+	next, record, err := s.newRefreshToken(user.ID, current.FamilyID, userAgent)
+	if err != nil {
+		return nil, "", err
+	}
+	reused := false
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.RefreshToken{}).
+			Where("id = ? AND revoked_at IS NULL", current.ID).
+			Updates(map[string]interface{}{"revoked_at": time.Now(), "replaced_by": record.ID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			// A concurrent request rotated it first
+			reused = true
+			return nil
+		}
+		return tx.Create(record).Error
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if reused {
+		return nil, "", s.revokeReusedFamily(&current)
+	}
+	return user, next, nil
+}
+
+// RevokeRefreshToken ends the login a refresh token belongs to, if it is
+// the user's
+func (s *AuthService) RevokeRefreshToken(userID uuid.UUID, token string) error {
+	var current models.RefreshToken
+	if err := s.db.First(&current, "token_hash = ? AND user_id = ?", hashToken(token), userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+	return s.revokeFamily(current.FamilyID)
+}
+
+// RevokeAllTokens ends every login of a user: their refresh tokens are
+// revoked and access tokens issued so far are denied
+func (s *AuthService) RevokeAllTokens(ctx context.Context, userID uuid.UUID) error {
+	if err := s.db.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error; err != nil {
+		return err
+	}
+	return s.denylist.RevokeUser(ctx, userID)
+}
+
+// newRefreshToken generates a refresh token and the record storing its hash
+func (s *AuthService) newRefreshToken(userID, familyID uuid.UUID, userAgent string) (string, *models.RefreshToken, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	return token, &models.RefreshToken{
+		ID:        models.NewID(),
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: hashToken(token),
+		UserAgent: userAgent,
+		ExpiresAt: time.Now().Add(s.config.JWT.RefreshExpiration),
+	}, nil
+}
+
+// revokeReusedFamily revokes the family of a refresh token presented after
+// it was rotated
+func (s *AuthService) revokeReusedFamily(token *models.RefreshToken) error {
+	log.Warn().
+		Str("user_id", token.UserID.String()).
+		Str("family_id", token.FamilyID.String()).
+		Msg("Refresh token reused, revoking its login")
+	if err := s.revokeFamily(token.FamilyID); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// revokeFamily revokes the unrevoked refresh tokens of a login
+func (s *AuthService) revokeFamily(familyID uuid.UUID) error {
+	return s.db.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// hashToken returns the hex SHA-256 under which a refresh or reset token is stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 // CheckPermission checks if a user has a specific permission
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// Disclosure policies, set with security.disclosure
+const (
+	// DisclosureConceal answers requests for private resources a user may
+	// not access as if the resources did not exist
+	DisclosureConceal = "conceal"
+	// DisclosureReveal answers them with 403, telling the user the
+	// resource exists
+	DisclosureReveal = "reveal"
+)
+
+// Resource is a kind of resource whose access is authorized centrally
+type Resource string
+
+const (
+	ResourceAgent    Resource = "agent"
+	ResourceDevice   Resource = "device"
+	ResourcePurchase Resource = "purchase"
+)
+
+// AgentAction is what a user wants to do with an agent
+type AgentAction int
+
+const (
+	// AgentView is seeing an agent: anyone if it is published, otherwise its
+	// publisher and organization members
+	AgentView AgentAction = iota
+	// AgentInspect is seeing an agent's private content, such as telemetry
+	// and transfers: its publisher and organization members
+	AgentInspect
+	// AgentEdit is changing an agent: its publisher, and organization
+	// owners and maintainers
+	AgentEdit
+	// AgentDelete is deleting an agent: its publisher and organization
+	// owners
+	AgentDelete
+)
+
+// AccessError is returned when a user may not access a resource. Hidden is
+// set when the user may not learn that the resource exists either: it is
+// private to others, like an unpublished agent or another user's device.
+type AccessError struct {
+	Resource Resource
+	Hidden   bool
+	Reason   string
+}
+
+func (e *AccessError) Error() string {
+	return e.Reason
+}
+
+// AuthorizationService decides who may access agents, devices and
+// purchases, and how a denied request is answered under the disclosure
+// policy. Devices and purchases are looked up among the user's own, so
+// their handlers only ask it about lookups that found nothing.
+type AuthorizationService struct {
+	db  *gorm.DB
+	cfg config.SecurityConfig
+}
+
+// NewAuthorizationService creates a new authorization service
+func NewAuthorizationService(db *gorm.DB, cfg config.SecurityConfig) *AuthorizationService {
+	return &AuthorizationService{db: db, cfg: cfg}
+}
+
+// AuthorizeAgent returns nil if a user may act on an agent, or an
+// AccessError. Admins may see any agent but only change those of their
+// organizations. Unpublished agents are hidden from everyone else outside
+// the agent's organization; published ones are public, so denying an action
+// on them hides nothing.
+func (s *AuthorizationService) AuthorizeAgent(agent *models.Agent, userID uuid.UUID, role models.UserRole, action AgentAction) error {
+	admin := role == models.UserRoleAdmin
+	if admin && action <= AgentInspect {
+		return nil
+	}
+	hidden := agent.Status != models.AgentStatusPublished && !admin
+	if action == AgentView && !hidden {
+		return nil
+	}
+
+	orgRole, err := agentRole(s.db, agent, userID)
+	switch {
+	case err == ErrNotOrgMember:
+		return &AccessError{Resource: ResourceAgent, Hidden: hidden, Reason: ErrOrgPermission.Error()}
+	case err != nil:
+		return err
+	}
+
+	switch {
+	case action == AgentEdit && orgRole == models.OrgRoleViewer,
+		action == AgentDelete && orgRole != models.OrgRoleOwner:
+		// Members may see the agent, so nothing is hidden from them
+		return &AccessError{Resource: ResourceAgent, Reason: ErrOrgPermission.Error()}
+	}
+	return nil
+}
+
+// VisibleAgents narrows an agent query to the agents a user may see, as
+// AuthorizeAgent decides for AgentView: published ones and those of the
+// user's organizations, or every agent for admins. userID is uuid.Nil for
+// anonymous requests, which only see published agents.
+func (s *AuthorizationService) VisibleAgents(query *gorm.DB, userID uuid.UUID, role models.UserRole) *gorm.DB {
+	if role == models.UserRoleAdmin {
+		return query
+	}
+	if userID == uuid.Nil {
+		return query.Where("agents.status = ?", models.AgentStatusPublished)
+	}
+	memberOf := s.db.Model(&models.Membership{}).
+		Joins("JOIN organizations ON organizations.id = memberships.organization_id AND organizations.deleted_at IS NULL").
+		Where("memberships.user_id = ?", userID).
+		Select("memberships.organization_id")
+	return query.Where("agents.status = ? OR agents.publisher_id = ? OR agents.organization_id IN (?)",
+		models.AgentStatusPublished, userID, memberOf)
+}
+
+// Missing returns the error for a lookup of a resource among a user's own
+// that found nothing: gorm.ErrRecordNotFound if it does not exist at all,
+// or a hidden AccessError if it belongs to someone else. The two only
+// differ under the reveal policy, so other policies skip the query.
+func (s *AuthorizationService) Missing(resource Resource, id string) error {
+	if s.cfg.Disclosure != DisclosureReveal {
+		return gorm.ErrRecordNotFound
+	}
+
+	var query *gorm.DB
+	switch resource {
+	case ResourceDevice:
+		query = s.db.Model(&models.Device{}).Where("serial = ?", id)
+	case ResourcePurchase:
+		purchaseID, err := uuid.Parse(id)
+		if err != nil {
+			return gorm.ErrRecordNotFound
+		}
+		query = s.db.Model(&models.Purchase{}).Where("id = ?", purchaseID)
+	case ResourceAgent:
+		agentID, err := uuid.Parse(id)
+		if err != nil {
+			return gorm.ErrRecordNotFound
+		}
+		query = s.db.Model(&models.Agent{}).Where("id = ?", agentID)
+	default:
+		return gorm.ErrRecordNotFound
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return &AccessError{Resource: resource, Hidden: true, Reason: fmt.Sprintf("you may not access this %s", resource)}
+}
+
+// Conceals reports whether a denied request is answered as if the
+// resource did not exist: it is hidden and the policy does not reveal it
+func (s *AuthorizationService) Conceals(err *AccessError) bool {
+	return err.Hidden && s.cfg.Disclosure != DisclosureReveal
+}
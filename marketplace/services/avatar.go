@@ -0,0 +1,279 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif" // decoders for uploaded avatars
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"regexp"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+const (
+	// AvatarSize is the width and height of processed avatars and logos
+	AvatarSize = 256
+	// MaxAvatarSize caps the size of an uploaded avatar or logo
+	MaxAvatarSize = 5 << 20
+	// maxAvatarPixels caps the decoded size of an upload, so a small file
+	// cannot expand into a huge image
+	maxAvatarPixels = 50_000_000
+	// identiconGrid is the number of cells across an identicon
+	identiconGrid = 5
+)
+
+var (
+	// ErrInvalidImage is returned for an upload that is not a PNG, JPEG or
+	// GIF image
+	ErrInvalidImage = errors.New("image must be a PNG, JPEG or GIF")
+	// ErrImageTooLarge is returned for an upload over MaxAvatarSize or with
+	// too many pixels
+	ErrImageTooLarge = errors.New("image must be at most 5 MiB and 50 megapixels")
+	// ErrInvalidCrop is returned for a crop that is not a square inside the
+	// image
+	ErrInvalidCrop = errors.New("crop must be a square inside the image")
+)
+
+// avatarNamePattern matches the names avatars are served under: the hex
+// SHA-256 of the processed image
+var avatarNamePattern = regexp.MustCompile(`^[0-9a-f]{64}\.png$`)
+
+// AvatarCrop is the square of an uploaded image to keep, in pixels from its
+// top left corner. Without one the largest centered square is kept.
+type AvatarCrop struct {
+	X, Y, Size int
+}
+
+// AvatarService processes and serves the avatars of users and the logos of
+// organizations. Uploads are cropped to a square, scaled down to
+// AvatarSize and re-encoded as PNG, which drops EXIF and other metadata.
+// Processed images are stored under their hash, so their URLs can be
+// cached forever.
+type AvatarService struct {
+	db      *gorm.DB
+	storage Storage
+}
+
+// NewAvatarService creates a new avatar service
+func NewAvatarService(db *gorm.DB, storage Storage) *AvatarService {
+	return &AvatarService{db: db, storage: storage}
+}
+
+// SetUserAvatar processes and stores a user's avatar and returns its URL
+func (s *AvatarService) SetUserAvatar(ctx context.Context, userID uuid.UUID, upload FileUpload, crop *AvatarCrop) (string, error) {
+	url, err := s.store(ctx, upload, crop)
+	if err != nil {
+		return "", err
+	}
+	if err := s.db.Model(&models.User{}).Where("id = ?", userID).Update("avatar_url", url).Error; err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// RemoveUserAvatar reverts a user's avatar to their identicon and returns
+// its URL
+func (s *AvatarService) RemoveUserAvatar(userID uuid.UUID) (string, error) {
+	url := models.IdenticonURL(userID)
+	if err := s.db.Model(&models.User{}).Where("id = ?", userID).Update("avatar_url", url).Error; err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// SetOrgLogo processes and stores an organization's logo and returns its
+// URL. Only owners can change the logo.
+func (s *AvatarService) SetOrgLogo(ctx context.Context, orgID, userID uuid.UUID, upload FileUpload, crop *AvatarCrop) (string, error) {
+	if err := s.requireOrgOwner(orgID, userID); err != nil {
+		return "", err
+	}
+	url, err := s.store(ctx, upload, crop)
+	if err != nil {
+		return "", err
+	}
+	if err := s.db.Model(&models.Organization{}).Where("id = ?", orgID).Update("logo_url", url).Error; err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// RemoveOrgLogo reverts an organization's logo to its identicon and returns
+// its URL
+func (s *AvatarService) RemoveOrgLogo(orgID, userID uuid.UUID) (string, error) {
+	if err := s.requireOrgOwner(orgID, userID); err != nil {
+		return "", err
+	}
+	url := models.IdenticonURL(orgID)
+	if err := s.db.Model(&models.Organization{}).Where("id = ?", orgID).Update("logo_url", url).Error; err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// GetAvatar opens a processed avatar or logo by the name in its URL. It
+// returns gorm.ErrRecordNotFound for names that cannot be an avatar.
+func (s *AvatarService) GetAvatar(ctx context.Context, name string) (io.ReadCloser, error) {
+	if !avatarNamePattern.MatchString(name) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return s.storage.Get(ctx, avatarKey(name))
+}
+
+// Identicon renders the default image of a user or organization: a
+// symmetric pattern of cells in a color derived from its ID
+func (s *AvatarService) Identicon(id uuid.UUID) ([]byte, error) {
+	sum := sha256.Sum256(id[:])
+	fg := color.NRGBA{R: sum[0]/2 + 64, G: sum[1]/2 + 64, B: sum[2]/2 + 64, A: 255}
+	bg := color.NRGBA{R: 240, G: 240, B: 240, A: 255}
+
+	img := image.NewNRGBA(image.Rect(0, 0, AvatarSize, AvatarSize))
+	cell := AvatarSize / (identiconGrid + 1)
+	margin := (AvatarSize - cell*identiconGrid) / 2
+	for y := 0; y < AvatarSize; y++ {
+		for x := 0; x < AvatarSize; x++ {
+			img.SetNRGBA(x, y, bg)
+		}
+	}
+	for row := 0; row < identiconGrid; row++ {
+		// Columns are mirrored, so only the left half and middle come from
+		// the hash
+		for col := 0; col < (identiconGrid+1)/2; col++ {
+			if sum[3+row*identiconGrid+col]%2 == 0 {
+				continue
+			}
+			for _, c := range []int{col, identiconGrid - 1 - col} {
+				for y := margin + row*cell; y < margin+(row+1)*cell; y++ {
+					for x := margin + c*cell; x < margin+(c+1)*cell; x++ {
+						img.SetNRGBA(x, y, fg)
+					}
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// store processes an upload and stores it under its hash
+func (s *AvatarService) store(ctx context.Context, upload FileUpload, crop *AvatarCrop) (string, error) {
+	if upload.Size > MaxAvatarSize {
+		return "", ErrImageTooLarge
+	}
+	data, err := processAvatar(upload.Body, crop)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:]) + ".png"
+	if _, err := s.storage.Put(ctx, avatarKey(name), bytes.NewReader(data), int64(len(data)), "image/png"); err != nil {
+		return "", err
+	}
+	return models.AvatarURL(name), nil
+}
+
+func (s *AvatarService) requireOrgOwner(orgID, userID uuid.UUID) error {
+	role, err := orgRole(s.db, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if role != models.OrgRoleOwner {
+		return ErrOrgPermission
+	}
+	return nil
+}
+
+func avatarKey(name string) string {
+	return "avatars/" + name
+}
+
+// processAvatar decodes an image, crops it to a square and scales it down
+// to at most AvatarSize, returning it as PNG
+func processAvatar(r io.Reader, crop *AvatarCrop) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxAvatarSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxAvatarSize {
+		return nil, ErrImageTooLarge
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if config.Width*config.Height > maxAvatarPixels {
+		return nil, ErrImageTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+
+	bounds := src.Bounds()
+	var square image.Rectangle
+	if crop != nil {
+		square = image.Rect(crop.X, crop.Y, crop.X+crop.Size, crop.Y+crop.Size).Add(bounds.Min)
+		if crop.Size <= 0 || crop.X < 0 || crop.Y < 0 || !square.In(bounds) {
+			return nil, ErrInvalidCrop
+		}
+	} else {
+		side := bounds.Dx()
+		if bounds.Dy() < side {
+			side = bounds.Dy()
+		}
+		corner := bounds.Min.Add(image.Pt((bounds.Dx()-side)/2, (bounds.Dy()-side)/2))
+		square = image.Rectangle{Min: corner, Max: corner.Add(image.Pt(side, side))}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleDown(src, square, AvatarSize)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleDown scales the square area of src to size pixels across, averaging
+// the source pixels under each target pixel. Squares smaller than size are
+// kept at their size rather than scaled up.
+func scaleDown(src image.Image, area image.Rectangle, size int) *image.RGBA {
+	side := area.Dx()
+	if side < size {
+		size = side
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := area.Min.Y+y*side/size, area.Min.Y+(y+1)*side/size
+		for x := 0; x < size; x++ {
+			x0, x1 := area.Min.X+x*side/size, area.Min.X+(x+1)*side/size
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
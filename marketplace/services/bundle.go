@@ -0,0 +1,425 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// maxBundleComponents caps the number of agents in a bundle
+const maxBundleComponents = 16
+
+var (
+	// ErrInvalidBundle is returned for a bundle whose components or wiring are invalid
+	ErrInvalidBundle = errors.New("invalid bundle")
+	// ErrBundleOverBudget is returned when a bundle does not fit its target device
+	ErrBundleOverBudget = errors.New("bundle exceeds the resource budget of its target device")
+	// ErrBundleNotOwned is returned when deploying a bundle with agents the buyer has not bought
+	ErrBundleNotOwned = errors.New("bundle contains agents that have not been purchased")
+)
+
+// BundleService composes agents into bundles, checks their combined resource
+// budget and buys or deploys all of their agents at once
+type BundleService struct {
+	db       *gorm.DB
+	checkout *CheckoutService
+	metering *MeteringService
+}
+
+// NewBundleService creates a new bundle service
+func NewBundleService(db *gorm.DB, checkout *CheckoutService, metering *MeteringService) *BundleService {
+	return &BundleService{db: db, checkout: checkout, metering: metering}
+}
+
+// DeviceBudget is the resources available on a target device. A zero limit is
+// not checked.
+type DeviceBudget struct {
+	FlashSize  int `json:"flash_size"`  // in bytes
+	SRAMSize   int `json:"sram_size"`   // in bytes
+	MaxLatency int `json:"max_latency"` // end-to-end, in microseconds
+}
+
+// BundleBudget is the combined resource use of a bundle's agents. All agents
+// are resident at once, so flash and SRAM add up; latency is that of the
+// slowest chain through the wiring.
+type BundleBudget struct {
+	FlashSize  int          `json:"flash_size"`
+	SRAMSize   int          `json:"sram_size"`
+	Latency    int          `json:"latency"`
+	Device     DeviceBudget `json:"device"`
+	Fits       bool         `json:"fits"`
+	Violations []string     `json:"violations,omitempty"`
+}
+
+// CreateBundle validates a bundle's components and wiring and stores it. It
+// returns the bundle's budget against its target device, and
+// ErrBundleOverBudget if it does not fit.
+func (s *BundleService) CreateBundle(bundle *models.Bundle) (*BundleBudget, error) {
+	if err := s.validate(bundle); err != nil {
+		return nil, err
+	}
+
+	budget, err := s.Budget(bundle, DeviceBudget{
+		FlashSize:  bundle.TargetFlashSize,
+		SRAMSize:   bundle.TargetSRAMSize,
+		MaxLatency: bundle.TargetMaxLatency,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !budget.Fits {
+		return budget, ErrBundleOverBudget
+	}
+
+	for i := range bundle.Components {
+		bundle.Components[i].Position = i
+	}
+	if err := s.db.Omit("Components.Agent").Create(bundle).Error; err != nil {
+		return nil, err
+	}
+	return budget, nil
+}
+
+// invalidBundle returns an ErrInvalidBundle with details
+func invalidBundle(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidBundle}, args...)...)
+}
+
+// validate checks that a bundle's agents are published at the given versions
+// and that its wiring connects existing signals without cycles. It loads each
+// component's agent.
+func (s *BundleService) validate(bundle *models.Bundle) error {
+	if len(bundle.Components) == 0 || len(bundle.Components) > maxBundleComponents {
+		return invalidBundle("a bundle must have between 1 and %d components", maxBundleComponents)
+	}
+
+	components := make(map[string]*models.BundleComponent, len(bundle.Components))
+	for i := range bundle.Components {
+		component := &bundle.Components[i]
+		if !capabilityNamePattern.MatchString(component.Key) {
+			return invalidBundle("components[%d].key must be a snake_case identifier", i)
+		}
+		if components[component.Key] != nil {
+			return invalidBundle("components[%d]: duplicate key %q", i, component.Key)
+		}
+		components[component.Key] = component
+
+		if err := s.db.Where("id = ? AND status = ?", component.AgentID, models.AgentStatusPublished).
+			First(&component.Agent).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return invalidBundle("components[%d]: agent not found", i)
+			}
+			return err
+		}
+		if component.Version == "" {
+			component.Version = component.Agent.Version
+		}
+		component.Release = &models.AgentVersion{}
+		if err := s.db.Where("agent_id = ? AND version = ? AND status = ?", component.AgentID, component.Version, models.AgentVersionStatusPublished).
+			First(component.Release).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return invalidBundle("components[%d]: version %s of agent %s is not available", i, component.Version, component.Agent.Name)
+			}
+			return err
+		}
+	}
+
+	// Signals are checked against the capability descriptors of components that declare one
+	descriptors := make(map[string]*models.CapabilityDescriptor, len(components))
+	for key, component := range components {
+		var capabilities models.AgentCapabilities
+		err := s.db.Where("agent_id = ? AND version = ?", component.AgentID, component.Version).First(&capabilities).Error
+		if err == nil {
+			descriptors[key] = &capabilities.Descriptor
+		} else if err != gorm.ErrRecordNotFound {
+			return err
+		}
+	}
+
+	connected := make(map[string]bool, len(bundle.Wiring))
+	for i, conn := range bundle.Wiring {
+		fromKey, fromSignal, ok := strings.Cut(conn.From, ".")
+		if !ok || components[fromKey] == nil {
+			return invalidBundle("wiring[%d].from must be <component key>.<output signal>", i)
+		}
+		toKey, toSignal, ok := strings.Cut(conn.To, ".")
+		if !ok || components[toKey] == nil {
+			return invalidBundle("wiring[%d].to must be <component key>.<input signal>", i)
+		}
+		if fromKey == toKey {
+			return invalidBundle("wiring[%d]: a component cannot be wired to itself", i)
+		}
+		if connected[conn.To] {
+			return invalidBundle("wiring[%d]: input %s is already connected", i, conn.To)
+		}
+		connected[conn.To] = true
+
+		output := findSignal(descriptors[fromKey], fromSignal, true)
+		input := findSignal(descriptors[toKey], toSignal, false)
+		if descriptors[fromKey] != nil && output == nil {
+			return invalidBundle("wiring[%d]: %s has no output %q", i, fromKey, fromSignal)
+		}
+		if descriptors[toKey] != nil && input == nil {
+			return invalidBundle("wiring[%d]: %s has no input %q", i, toKey, toSignal)
+		}
+		if output != nil && input != nil && output.Type != input.Type {
+			return invalidBundle("wiring[%d]: cannot connect %s output %s to %s input %s", i, output.Type, conn.From, input.Type, conn.To)
+		}
+	}
+
+	if _, err := topoOrder(bundle); err != nil {
+		return err
+	}
+	return nil
+}
+
+// findSignal returns the named output or input of a descriptor, or nil
+func findSignal(d *models.CapabilityDescriptor, name string, output bool) *models.CapabilitySignal {
+	if d == nil {
+		return nil
+	}
+	signals := d.Inputs
+	if output {
+		signals = d.Outputs
+	}
+	for i := range signals {
+		if signals[i].Name == name {
+			return &signals[i]
+		}
+	}
+	return nil
+}
+
+// topoOrder returns a bundle's component keys in wiring order, or an error
+// if the wiring has a cycle
+func topoOrder(bundle *models.Bundle) ([]string, error) {
+	indegree := make(map[string]int, len(bundle.Components))
+	next := make(map[string][]string, len(bundle.Components))
+	for _, component := range bundle.Components {
+		indegree[component.Key] = 0
+	}
+	for _, conn := range bundle.Wiring {
+		fromKey, _, _ := strings.Cut(conn.From, ".")
+		toKey, _, _ := strings.Cut(conn.To, ".")
+		next[fromKey] = append(next[fromKey], toKey)
+		indegree[toKey]++
+	}
+
+	var order, ready []string
+	for _, component := range bundle.Components {
+		if indegree[component.Key] == 0 {
+			ready = append(ready, component.Key)
+		}
+	}
+	for len(ready) > 0 {
+		key := ready[0]
+		ready = ready[1:]
+		order = append(order, key)
+		for _, to := range next[key] {
+			if indegree[to]--; indegree[to] == 0 {
+				ready = append(ready, to)
+			}
+		}
+	}
+	if len(order) != len(bundle.Components) {
+		return nil, invalidBundle("wiring must not contain cycles")
+	}
+	return order, nil
+}
+
+// Budget computes a bundle's combined resource use against a device from the
+// specs of each component's pinned release, falling back to the agent's
+// current specs if the release is not loaded
+func (s *BundleService) Budget(bundle *models.Bundle, device DeviceBudget) (*BundleBudget, error) {
+	order, err := topoOrder(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	budget := BundleBudget{Device: device}
+	latency := make(map[string]int, len(bundle.Components))
+	for _, component := range bundle.Components {
+		flash, sram := component.Agent.FlashSize, component.Agent.SRAMSize
+		latency[component.Key] = component.Agent.MaxLatency
+		if component.Release != nil {
+			flash, sram = component.Release.FlashSize, component.Release.SRAMSize
+			latency[component.Key] = component.Release.MaxLatency
+		}
+		budget.FlashSize += flash
+		budget.SRAMSize += sram
+	}
+
+	// Longest path through the wiring, weighted by each agent's latency
+	upstream := make(map[string]int, len(order))
+	finish := make(map[string]int, len(order))
+	for _, key := range order {
+		finish[key] = upstream[key] + latency[key]
+		if finish[key] > budget.Latency {
+			budget.Latency = finish[key]
+		}
+		for _, conn := range bundle.Wiring {
+			fromKey, _, _ := strings.Cut(conn.From, ".")
+			toKey, _, _ := strings.Cut(conn.To, ".")
+			if fromKey == key && finish[key] > upstream[toKey] {
+				upstream[toKey] = finish[key]
+			}
+		}
+	}
+
+	if device.FlashSize > 0 && budget.FlashSize > device.FlashSize {
+		budget.Violations = append(budget.Violations, fmt.Sprintf("flash: needs %d bytes, device has %d", budget.FlashSize, device.FlashSize))
+	}
+	if device.SRAMSize > 0 && budget.SRAMSize > device.SRAMSize {
+		budget.Violations = append(budget.Violations, fmt.Sprintf("sram: needs %d bytes, device has %d", budget.SRAMSize, device.SRAMSize))
+	}
+	if device.MaxLatency > 0 && budget.Latency > device.MaxLatency {
+		budget.Violations = append(budget.Violations, fmt.Sprintf("latency: %dus end to end, device allows %dus", budget.Latency, device.MaxLatency))
+	}
+	budget.Fits = len(budget.Violations) == 0
+	return &budget, nil
+}
+
+// GetBundle returns a bundle with its components in order
+func (s *BundleService) GetBundle(id uuid.UUID) (*models.Bundle, error) {
+	var bundle models.Bundle
+	if err := s.db.Preload("Owner").
+		Preload("Components", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Preload("Components.Agent").
+		First(&bundle, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range bundle.Components {
+		component := &bundle.Components[i]
+		var release models.AgentVersion
+		err := s.db.Where("agent_id = ? AND version = ?", component.AgentID, component.Version).First(&release).Error
+		if err == nil {
+			component.Release = &release
+		} else if err != gorm.ErrRecordNotFound {
+			return nil, err
+		}
+	}
+	return &bundle, nil
+}
+
+// GetBundles returns bundles, most recent first
+func (s *BundleService) GetBundles(page, limit int) ([]models.Bundle, int64, error) {
+	var bundles []models.Bundle
+	var total int64
+
+	query := s.db.Model(&models.Bundle{})
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Preload("Components", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Order("created_at DESC").Offset(offset).Limit(limit).Find(&bundles).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return bundles, total, nil
+}
+
+// DeleteBundle deletes one of the owner's bundles
+func (s *BundleService) DeleteBundle(id, ownerID uuid.UUID) error {
+	result := s.db.Where("id = ? AND owner_id = ?", id, ownerID).Delete(&models.Bundle{})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+// Purchase checks out every one-time agent in a bundle that the buyer does
+// not own yet, under one trace ID. Agents already bought are skipped, so a
+// purchase that failed part way can be retried.
+func (s *BundleService) Purchase(bundleID, buyerID uuid.UUID, completion CheckoutCompletion) ([]models.Purchase, error) {
+	bundle, err := s.GetBundle(bundleID)
+	if err != nil {
+		return nil, err
+	}
+	if completion.TraceID == uuid.Nil {
+		completion.TraceID = models.NewID()
+	}
+
+	var purchases []models.Purchase
+	seen := make(map[uuid.UUID]bool, len(bundle.Components))
+	for _, component := range bundle.Components {
+		if seen[component.AgentID] || component.Agent.PricingModel == models.PricingModelMetered {
+			continue
+		}
+		seen[component.AgentID] = true
+
+		session, err := s.checkout.StartCheckout(buyerID, component.AgentID, nil)
+		if err == ErrAlreadyPurchased {
+			continue
+		}
+		if err != nil {
+			return purchases, fmt.Errorf("%s: %w", component.Key, err)
+		}
+		purchase, err := s.checkout.CompleteCheckout(buyerID, session.ID, completion)
+		if err != nil {
+			return purchases, fmt.Errorf("%s: %w", component.Key, err)
+		}
+		purchases = append(purchases, *purchase)
+	}
+	return purchases, nil
+}
+
+// Deploy deploys a bundle on one of the buyer's devices. Every one-time agent
+// must have been bought; metered agents start billing for the device.
+// Metered agents already running on the device are left as they are. The
+// deployments continue the trace of the latest purchase of the bundle's
+// agents, or start a trace of their own.
+func (s *BundleService) Deploy(bundleID, buyerID uuid.UUID, deviceID string) ([]models.Deployment, error) {
+	bundle, err := s.GetBundle(bundleID)
+	if err != nil {
+		return nil, err
+	}
+
+	var traceID uuid.UUID
+	var tracedAt time.Time
+	for _, component := range bundle.Components {
+		if component.Agent.PricingModel == models.PricingModelMetered {
+			continue
+		}
+		var purchase models.Purchase
+		if err := ownedBy(s.db, s.db.Model(&models.Purchase{}), buyerID).
+			Where("agent_id = ? AND status = ?", component.AgentID, models.PurchaseStatusCompleted).
+			Order("created_at DESC").
+			First(&purchase).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, ErrBundleNotOwned
+			}
+			return nil, err
+		}
+		if purchase.CreatedAt.After(tracedAt) {
+			traceID, tracedAt = purchase.TraceID, purchase.CreatedAt
+		}
+	}
+	if traceID == uuid.Nil {
+		traceID = models.NewID()
+	}
+
+	var deployments []models.Deployment
+	for _, component := range bundle.Components {
+		if component.Agent.PricingModel != models.PricingModelMetered {
+			continue
+		}
+		deployment, err := s.metering.Deploy(buyerID, component.AgentID, deviceID, component.Version, "", traceID)
+		if err == ErrDeploymentExists {
+			continue
+		}
+		if err != nil {
+			return deployments, fmt.Errorf("%s: %w", component.Key, err)
+		}
+		deployments = append(deployments, *deployment)
+	}
+	return deployments, nil
+}
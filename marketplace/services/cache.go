@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// AgentCache is an in-process cache of agent details kept coherent across
+// instances with Postgres LISTEN/NOTIFY
+type AgentCache struct {
+	db      *gorm.DB
+	cfg     config.CacheConfig
+	mu      sync.RWMutex
+	entries map[uuid.UUID]agentCacheEntry
+}
+
+type agentCacheEntry struct {
+	agent     *models.Agent
+	expiresAt time.Time
+}
+
+// NewAgentCache creates a new agent cache
+func NewAgentCache(db *gorm.DB, cfg config.CacheConfig) *AgentCache {
+	return &AgentCache{
+		db:      db,
+		cfg:     cfg,
+		entries: make(map[uuid.UUID]agentCacheEntry),
+	}
+}
+
+// Get returns a cached agent; callers must treat it as read-only
+func (c *AgentCache) Get(id uuid.UUID) (*models.Agent, bool) {
+	if !c.cfg.Enabled {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	entry, ok := c.entries[id]
+	c.mu.RUnlock()
+
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.agent, true
+}
+
+// Set stores an agent in the cache
+func (c *AgentCache) Set(agent *models.Agent) {
+	if !c.cfg.Enabled {
+		return
+	}
+
+	c.mu.Lock()
+	c.entries[agent.ID] = agentCacheEntry{agent: agent, expiresAt: time.Now().Add(c.cfg.AgentTTL)}
+	c.mu.Unlock()
+}
+
+// Invalidate evicts an agent locally and notifies every other instance
+func (c *AgentCache) Invalidate(id uuid.UUID) error {
+	if !c.cfg.Enabled {
+		return nil
+	}
+
+	c.evict(id)
+	if err := c.db.Exec("SELECT pg_notify(?, ?)", c.cfg.InvalidationChannel, id.String()).Error; err != nil {
+		return fmt.Errorf("failed to broadcast cache invalidation: %w", err)
+	}
+	return nil
+}
+
+// evict removes a single agent from the local cache
+func (c *AgentCache) evict(id uuid.UUID) {
+	c.mu.Lock()
+	delete(c.entries, id)
+	c.mu.Unlock()
+}
+
+// flush empties the local cache
+func (c *AgentCache) flush() {
+	c.mu.Lock()
+	c.entries = make(map[uuid.UUID]agentCacheEntry)
+	c.mu.Unlock()
+}
+
+// Listen consumes invalidation notifications until ctx is done, reconnecting
+// on failure. The cache is flushed after every reconnect since notifications
+// sent while disconnected are lost.
+func (c *AgentCache) Listen(ctx context.Context) {
+	if !c.cfg.Enabled {
+		return
+	}
+
+	listenChannel(ctx, c.db, c.cfg.InvalidationChannel, func(payload string) {
+		id, err := uuid.Parse(payload)
+		if err != nil {
+			log.Warn().Str("payload", payload).Msg("Ignoring malformed cache invalidation")
+			return
+		}
+		c.evict(id)
+	}, c.flush)
+}
+
+// listenChannel passes the payloads of notifications on a Postgres channel
+// to handle until ctx is done, reconnecting with backoff. reset is called
+// after every disconnect, for listeners to drop what they may have missed.
+func listenChannel(ctx context.Context, db *gorm.DB, channel string, handle func(payload string), reset func()) {
+	backoff := time.Second
+	for {
+		err := listenOnce(ctx, db, channel, handle)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Error().Err(err).Str("channel", channel).Dur("retry_in", backoff).Msg("Notification listener disconnected")
+		reset()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// listenOnce holds a dedicated connection subscribed to a channel
+func listenOnce(ctx context.Context, db *gorm.DB, channel string, handle func(payload string)) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return fmt.Errorf("failed to get database instance: %w", err)
+	}
+
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire listener connection: %w", err)
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		pgConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+
+		if _, err := pgConn.Conn().Exec(ctx, fmt.Sprintf("LISTEN %q", channel)); err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", channel, err)
+		}
+		log.Info().Str("channel", channel).Msg("Listening for notifications")
+
+		for {
+			notification, err := pgConn.Conn().WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+			handle(notification.Payload)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// Allowed values of the enumerated descriptor fields
+var (
+	capabilitySignalTypes = map[string]bool{"digital": true, "analog": true, "waveform": true, "event": true, "counter": true}
+	capabilityActuations  = map[string]bool{"relay": true, "breaker_trip": true, "pwm": true, "analog_out": true, "digital_out": true, "valve": true, "motor": true, "alarm": true}
+	capabilitySafeStates  = map[string]bool{"hold": true, "de_energize": true, "trip": true, "last_value": true}
+)
+
+// capabilityNamePattern matches the snake_case identifiers used for names in
+// capability descriptors
+var capabilityNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// CapabilityService stores agent capability descriptors and indexes them for search
+type CapabilityService struct {
+	db *gorm.DB
+}
+
+// NewCapabilityService creates a new capability service
+func NewCapabilityService(db *gorm.DB) *CapabilityService {
+	return &CapabilityService{db: db}
+}
+
+// ValidateDescriptor checks a capability descriptor against the current
+// descriptor schema
+func (s *CapabilityService) ValidateDescriptor(d *models.CapabilityDescriptor) error {
+	if len(d.Outputs) == 0 && len(d.ActuationTypes) == 0 {
+		return fmt.Errorf("descriptor must declare at least one output or actuation type")
+	}
+	if err := validateSignals("inputs", d.Inputs); err != nil {
+		return err
+	}
+	if err := validateSignals("outputs", d.Outputs); err != nil {
+		return err
+	}
+	if err := validateNames("actuation_types", d.ActuationTypes, capabilityActuations); err != nil {
+		return err
+	}
+	if err := validateNames("accessibility", d.Accessibility, nil); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(d.FailureModes))
+	for i, mode := range d.FailureModes {
+		if !capabilityNamePattern.MatchString(mode.Name) {
+			return fmt.Errorf("failure_modes[%d].name must be a snake_case identifier", i)
+		}
+		if seen[mode.Name] {
+			return fmt.Errorf("failure_modes[%d]: duplicate name %q", i, mode.Name)
+		}
+		seen[mode.Name] = true
+		if !capabilitySafeStates[mode.SafeState] {
+			return fmt.Errorf("failure_modes[%d].safe_state must be one of hold, de_energize, trip, last_value", i)
+		}
+	}
+	return nil
+}
+
+// validateSignals checks the signals of a descriptor field
+func validateSignals(field string, signals []models.CapabilitySignal) error {
+	seen := make(map[string]bool, len(signals))
+	for i, signal := range signals {
+		if !capabilityNamePattern.MatchString(signal.Name) {
+			return fmt.Errorf("%s[%d].name must be a snake_case identifier", field, i)
+		}
+		if seen[signal.Name] {
+			return fmt.Errorf("%s[%d]: duplicate name %q", field, i, signal.Name)
+		}
+		seen[signal.Name] = true
+		if !capabilitySignalTypes[signal.Type] {
+			return fmt.Errorf("%s[%d].type must be one of digital, analog, waveform, event, counter", field, i)
+		}
+	}
+	return nil
+}
+
+// validateNames checks a list of identifiers, restricted to allowed if it is not nil
+func validateNames(field string, names []string, allowed map[string]bool) error {
+	seen := make(map[string]bool, len(names))
+	for i, name := range names {
+		if !capabilityNamePattern.MatchString(name) {
+			return fmt.Errorf("%s[%d] must be a snake_case identifier", field, i)
+		}
+		if allowed != nil && !allowed[name] {
+			return fmt.Errorf("%s[%d]: unknown value %q", field, i, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("%s[%d]: duplicate value %q", field, i, name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// GetCapabilities returns the capability descriptor of an agent version
+func (s *CapabilityService) GetCapabilities(agentID uuid.UUID, version string) (*models.AgentCapabilities, error) {
+	var capabilities models.AgentCapabilities
+	if err := s.db.Where("agent_id = ? AND version = ?", agentID, version).First(&capabilities).Error; err != nil {
+		return nil, err
+	}
+	return &capabilities, nil
+}
+
+// SaveCapabilities stores the capability descriptor of an agent version and
+// replaces its search terms
+func (s *CapabilityService) SaveCapabilities(capabilities *models.AgentCapabilities) error {
+	capabilities.SchemaVersion = models.CapabilitySchemaVersion
+	capabilities.UpdatedAt = time.Now()
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "agent_id"}, {Name: "version"}},
+			DoUpdates: clause.AssignmentColumns([]string{"schema_version", "descriptor", "updated_at"}),
+		}).Create(capabilities).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("agent_id = ? AND version = ?", capabilities.AgentID, capabilities.Version).
+			Delete(&models.AgentCapabilityTerm{}).Error; err != nil {
+			return err
+		}
+		terms := capabilityTerms(capabilities)
+		if len(terms) == 0 {
+			return nil
+		}
+		return tx.Create(&terms).Error
+	})
+}
+
+// capabilityTerms lists the search terms of a capability descriptor
+func capabilityTerms(capabilities *models.AgentCapabilities) []models.AgentCapabilityTerm {
+	d := capabilities.Descriptor
+	var terms []models.AgentCapabilityTerm
+	add := func(kind models.CapabilityKind, name string) {
+		terms = append(terms, models.AgentCapabilityTerm{
+			AgentID: capabilities.AgentID,
+			Version: capabilities.Version,
+			Kind:    kind,
+			Name:    name,
+		})
+	}
+	for _, signal := range d.Inputs {
+		add(models.CapabilityKindInput, signal.Name)
+	}
+	for _, signal := range d.Outputs {
+		add(models.CapabilityKindOutput, signal.Name)
+	}
+	for _, actuation := range d.ActuationTypes {
+		add(models.CapabilityKindActuation, actuation)
+	}
+	for _, mode := range d.FailureModes {
+		add(models.CapabilityKindFailureMode, mode.Name)
+	}
+	for _, feature := range d.Accessibility {
+		add(models.CapabilityKindAccessibility, feature)
+	}
+	return terms
+}
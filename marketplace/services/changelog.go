@@ -0,0 +1,171 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// changelogFanOutBatch is how many notifications are inserted at a time
+// when a changelog entry is published
+const changelogFanOutBatch = 500
+
+// ErrInvalidChangelogEntry is returned for a changelog entry with an
+// unknown category or audience
+var ErrInvalidChangelogEntry = errors.New("category must be feature, improvement, fix or deprecation and audience all, publishers or api")
+
+// ChangelogFilter narrows the entries returned by GetEntries
+type ChangelogFilter struct {
+	Drafts   bool // include unpublished entries, for admins
+	Category models.ChangelogCategory
+	Since    *time.Time // only entries published after
+}
+
+// ChangelogService manages the marketplace's own release notes and tells
+// publishers and API consumers about new ones
+type ChangelogService struct {
+	db *gorm.DB
+}
+
+// NewChangelogService creates a new changelog service
+func NewChangelogService(db *gorm.DB) *ChangelogService {
+	return &ChangelogService{db: db}
+}
+
+// GetEntries returns changelog entries, most recently published first and
+// drafts, if included, before them
+func (s *ChangelogService) GetEntries(filter ChangelogFilter, page, limit int) ([]models.PlatformChangelogEntry, int64, error) {
+	query := s.db.Model(&models.PlatformChangelogEntry{})
+	if !filter.Drafts {
+		query = query.Where("published_at IS NOT NULL")
+	}
+	if filter.Category != "" {
+		query = query.Where("category = ?", filter.Category)
+	}
+	if filter.Since != nil {
+		query = query.Where("published_at > ?", *filter.Since)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var entries []models.PlatformChangelogEntry
+	if err := query.Order("published_at DESC NULLS FIRST, created_at DESC").
+		Offset((page - 1) * limit).Limit(limit).Find(&entries).Error; err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+// GetEntry returns a changelog entry; drafts only when asked to
+func (s *ChangelogService) GetEntry(id uuid.UUID, drafts bool) (*models.PlatformChangelogEntry, error) {
+	query := s.db
+	if !drafts {
+		query = query.Where("published_at IS NOT NULL")
+	}
+	var entry models.PlatformChangelogEntry
+	if err := query.First(&entry, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// SaveEntry creates or updates a changelog entry
+func (s *ChangelogService) SaveEntry(entry *models.PlatformChangelogEntry) error {
+	switch entry.Category {
+	case models.ChangelogCategoryFeature, models.ChangelogCategoryImprovement,
+		models.ChangelogCategoryFix, models.ChangelogCategoryDeprecation:
+	default:
+		return ErrInvalidChangelogEntry
+	}
+	switch entry.Audience {
+	case models.ChangelogAudienceAll, models.ChangelogAudiencePublishers, models.ChangelogAudienceAPI:
+	default:
+		return ErrInvalidChangelogEntry
+	}
+	return s.db.Save(entry).Error
+}
+
+// DeleteEntry removes a changelog entry
+func (s *ChangelogService) DeleteEntry(id uuid.UUID) error {
+	result := s.db.Delete(&models.PlatformChangelogEntry{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Publish publishes a changelog entry and notifies its audience. An entry
+// is only ever announced once, so republishing after an edit does not
+// notify again. It returns the number of users notified.
+func (s *ChangelogService) Publish(entry *models.PlatformChangelogEntry) (int, error) {
+	notified := 0
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(entry, "id = ?", entry.ID).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		if entry.PublishedAt == nil {
+			entry.PublishedAt = &now
+		}
+		if entry.NotifiedAt == nil {
+			var err error
+			if notified, err = s.fanOut(tx, entry); err != nil {
+				return err
+			}
+			entry.NotifiedAt = &now
+		}
+		return tx.Model(entry).Updates(map[string]interface{}{
+			"published_at": entry.PublishedAt,
+			"notified_at":  entry.NotifiedAt,
+		}).Error
+	})
+	return notified, err
+}
+
+// fanOut creates a notification of a changelog entry for each active user
+// in its audience
+func (s *ChangelogService) fanOut(tx *gorm.DB, entry *models.PlatformChangelogEntry) (int, error) {
+	apiConsumers := tx.Model(&models.APIKey{}).Select("owner_id").
+		Where("status = ? AND revoked_at IS NULL", models.APIKeyStatusActive)
+	recipients := tx.Model(&models.User{}).Select("id").Where("status = ?", models.UserStatusActive)
+	switch entry.Audience {
+	case models.ChangelogAudiencePublishers:
+		recipients = recipients.Where("role = ?", models.UserRolePublisher)
+	case models.ChangelogAudienceAPI:
+		recipients = recipients.Where("id IN (?)", apiConsumers)
+	default:
+		recipients = recipients.Where("role = ? OR id IN (?)", models.UserRolePublisher, apiConsumers)
+	}
+
+	title := "New on EdgePlug Marketplace: " + entry.Title
+	link := fmt.Sprintf("/platform/changelog/%s", entry.ID)
+	notified := 0
+	var users []models.User
+	err := recipients.FindInBatches(&users, changelogFanOutBatch, func(batch *gorm.DB, _ int) error {
+		notifications := make([]models.Notification, len(users))
+		for i, user := range users {
+			notifications[i] = models.Notification{
+				UserID: user.ID,
+				Type:   models.NotificationTypePlatformUpdate,
+				Title:  title,
+				Body:   entry.Body,
+				Link:   link,
+			}
+		}
+		created, err := notifyAll(tx, notifications)
+		notified += created
+		return err
+	}).Error
+	return notified, err
+}
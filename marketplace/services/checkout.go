@@ -0,0 +1,395 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrAgentNotPurchasable is returned when checking out an agent that is not published
+	ErrAgentNotPurchasable = errors.New("agent is not available for purchase")
+	// ErrAlreadyPurchased is returned when the buyer already owns the agent
+	ErrAlreadyPurchased = errors.New("agent already purchased")
+	// ErrCheckoutClosed is returned when completing a checkout that is already completed
+	ErrCheckoutClosed = errors.New("checkout is already completed")
+	// ErrPaymentRequired is returned when credit does not cover a checkout and no payment was given
+	ErrPaymentRequired = errors.New("payment required for the amount not covered by credit")
+)
+
+// checkoutEvents counts checkout lifecycle events. Recovery conversion is
+// recovered / recovery_sent.
+var checkoutEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "edgeplug_checkout_events_total",
+	Help: "Checkout session events (started, completed, blocked, abandoned, recovery_sent, recovered)",
+}, []string{"event"})
+
+func init() {
+	prometheus.MustRegister(checkoutEvents)
+}
+
+// CheckoutService tracks checkout sessions and recovers abandoned ones
+type CheckoutService struct {
+	db    *gorm.DB
+	cfg   config.CheckoutConfig
+	fraud *FraudService
+	tiers *TierService
+}
+
+// NewCheckoutService creates a new checkout service
+func NewCheckoutService(db *gorm.DB, cfg config.CheckoutConfig, fraud *FraudService, tiers *TierService) *CheckoutService {
+	return &CheckoutService{db: db, cfg: cfg, fraud: fraud, tiers: tiers}
+}
+
+// CheckoutCompletion is the payment and client data submitted to complete a checkout
+type CheckoutCompletion struct {
+	PaymentID      string
+	BillingCountry string
+	IP             string
+	IPCountry      string
+	UseCredit      bool      // pay from the buyer's credit balance first
+	TraceID        uuid.UUID // shared by the purchases of one order, e.g. a bundle; a purchase starts its own trace without it
+}
+
+// StartCheckout opens a checkout session for an agent at its own price, or
+// at the price of one of its one-time plans, resuming the buyer's unfinished
+// session for the same agent and plan if there is one
+func (s *CheckoutService) StartCheckout(buyerID, agentID uuid.UUID, planID *uuid.UUID) (*models.CheckoutSession, error) {
+	var agent models.Agent
+	if err := s.db.Where("id = ? AND status = ?", agentID, models.AgentStatusPublished).First(&agent).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrAgentNotPurchasable
+		}
+		return nil, err
+	}
+	if agent.PricingModel == models.PricingModelMetered {
+		return nil, ErrAgentMetered
+	}
+	price, currency := agent.Price, agent.Currency
+	if planID != nil {
+		plan, err := availablePlan(s.db, *planID)
+		if err != nil {
+			return nil, err
+		}
+		if plan.AgentID != agentID {
+			return nil, ErrPlanNotAvailable
+		}
+		if plan.Interval != models.PlanIntervalOneTime {
+			return nil, ErrPlanNotRecurring
+		}
+		price, currency = plan.Price, plan.Currency
+	}
+
+	var purchases int64
+	if err := s.db.Model(&models.Purchase{}).
+		Where("buyer_id = ? AND agent_id = ? AND status = ?", buyerID, agentID, models.PurchaseStatusCompleted).
+		Count(&purchases).Error; err != nil {
+		return nil, err
+	}
+	if purchases > 0 {
+		return nil, ErrAlreadyPurchased
+	}
+
+	var session models.CheckoutSession
+	query := s.db.Where("buyer_id = ? AND agent_id = ? AND status IN ?", buyerID, agentID,
+		[]models.CheckoutStatus{models.CheckoutStatusOpen, models.CheckoutStatusAbandoned})
+	if planID != nil {
+		query = query.Where("plan_id = ?", *planID)
+	} else {
+		query = query.Where("plan_id IS NULL")
+	}
+	err := query.Order("created_at DESC").First(&session).Error
+	if err == nil {
+		return &session, s.touch(&session)
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	session = models.CheckoutSession{
+		BuyerID:        buyerID,
+		AgentID:        agentID,
+		PlanID:         planID,
+		Amount:         price,
+		Currency:       currency,
+		Status:         models.CheckoutStatusOpen,
+		LastActivityAt: time.Now(),
+	}
+	if err := s.db.Create(&session).Error; err != nil {
+		return nil, err
+	}
+	session.AmountDisplay = models.FormatMoney(session.Amount, session.Currency)
+	checkoutEvents.WithLabelValues("started").Inc()
+	return &session, nil
+}
+
+// GetCheckout returns a buyer's checkout session and records the activity,
+// reopening it if it had been abandoned
+func (s *CheckoutService) GetCheckout(buyerID, id uuid.UUID) (*models.CheckoutSession, error) {
+	var session models.CheckoutSession
+	if err := s.db.Preload("Agent").Where("id = ? AND buyer_id = ?", id, buyerID).First(&session).Error; err != nil {
+		return nil, err
+	}
+	if session.Status == models.CheckoutStatusCompleted {
+		return &session, nil
+	}
+	return &session, s.touch(&session)
+}
+
+// touch records activity on an unfinished session
+func (s *CheckoutService) touch(session *models.CheckoutSession) error {
+	session.LastActivityAt = time.Now()
+	session.Status = models.CheckoutStatusOpen
+	return s.db.Model(session).Updates(map[string]interface{}{
+		"status":           session.Status,
+		"last_activity_at": session.LastActivityAt,
+	}).Error
+}
+
+// CompleteCheckout runs the fraud rules and turns a checkout session into a
+// purchase awaiting payment confirmation, or held for review if a rule says so.
+// A purchase paid in full from credit needs no payment confirmation.
+func (s *CheckoutService) CompleteCheckout(buyerID, id uuid.UUID, completion CheckoutCompletion) (*models.Purchase, error) {
+	var session models.CheckoutSession
+	if err := s.db.Preload("Buyer").Preload("Agent.Publisher").Where("id = ? AND buyer_id = ?", id, buyerID).First(&session).Error; err != nil {
+		return nil, err
+	}
+	if session.Status == models.CheckoutStatusCompleted {
+		return nil, ErrCheckoutClosed
+	}
+
+	assessment, err := s.fraud.Evaluate(FraudInput{
+		CheckoutSessionID: session.ID,
+		BuyerID:           buyerID,
+		Email:             session.Buyer.Email,
+		IP:                completion.IP,
+		IPCountry:         completion.IPCountry,
+		BillingCountry:    completion.BillingCountry,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if assessment != nil && assessment.Decision == models.FraudActionBlock {
+		if err := s.fraud.Record(s.db, assessment); err != nil {
+			return nil, err
+		}
+		checkoutEvents.WithLabelValues("blocked").Inc()
+		return nil, ErrPurchaseBlocked
+	}
+
+	var purchase models.Purchase
+	var recovered bool
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		purchase = models.Purchase{
+			ID:        models.NewID(),
+			BuyerID:   buyerID,
+			AgentID:   session.AgentID,
+			Amount:    session.Amount,
+			Currency:  session.Currency,
+			Status:    models.PurchaseStatusPending,
+			PaymentID: completion.PaymentID,
+			PlanID:    session.PlanID,
+			TraceID:   completion.TraceID,
+			// The commission is fixed at purchase time so later plan changes don't affect it
+			Commission: s.tiers.Commission(session.Agent.Publisher.Tier, session.Amount),
+		}
+		if completion.UseCredit {
+			credit, err := spendCredit(tx, buyerID, session.Currency, session.Amount, purchase.ID)
+			if err != nil {
+				return err
+			}
+			purchase.CreditApplied = credit
+		}
+		if purchase.CreditApplied > 0 && purchase.CreditApplied == purchase.Amount {
+			purchase.Status = models.PurchaseStatusCompleted
+		} else if completion.PaymentID == "" {
+			return ErrPaymentRequired
+		}
+		if assessment != nil && assessment.Decision == models.FraudActionReview {
+			purchase.Status = models.PurchaseStatusOnHold
+		}
+		if err := tx.Create(&purchase).Error; err != nil {
+			return err
+		}
+
+		// Guard on the status so a concurrent completion cannot create a second purchase
+		now := time.Now()
+		result := tx.Model(&models.CheckoutSession{}).
+			Where("id = ? AND status <> ?", session.ID, models.CheckoutStatusCompleted).
+			Updates(map[string]interface{}{
+				"status":           models.CheckoutStatusCompleted,
+				"purchase_id":      purchase.ID,
+				"completed_at":     now,
+				"last_activity_at": now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrCheckoutClosed
+		}
+
+		if assessment != nil {
+			assessment.PurchaseID = &purchase.ID
+			if err := s.fraud.Record(tx, assessment); err != nil {
+				return err
+			}
+		}
+		if purchase.Status != models.PurchaseStatusOnHold {
+			// Held purchases are announced once a reviewer releases them
+			if err := notifySale(tx, &session.Agent, &purchase); err != nil {
+				return err
+			}
+		}
+
+		recovered = session.RecoveryNotifiedAt != nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	purchase.AmountDisplay = models.FormatMoney(purchase.Amount, purchase.Currency)
+	checkoutEvents.WithLabelValues("completed").Inc()
+	if recovered {
+		checkoutEvents.WithLabelValues("recovered").Inc()
+	}
+	return &purchase, nil
+}
+
+// notifySale tells the publisher of an agent it was bought
+func notifySale(tx *gorm.DB, agent *models.Agent, purchase *models.Purchase) error {
+	return notify(tx, &models.Notification{
+		UserID: agent.PublisherID,
+		Type:   models.NotificationTypeNewPurchase,
+		Title:  agent.Name + " was purchased",
+		Body:   fmt.Sprintf("A buyer purchased %s for %s.", agent.Name, models.FormatMoney(purchase.Amount, purchase.Currency)),
+		Link:   fmt.Sprintf("/agents/%s", agent.ID),
+	})
+}
+
+// CheckoutRecoveryStats summarizes abandoned-checkout recovery
+type CheckoutRecoveryStats struct {
+	Started        int64   `json:"started"`
+	Completed      int64   `json:"completed"`
+	Abandoned      int64   `json:"abandoned"`
+	RecoverySent   int64   `json:"recovery_sent"`
+	Recovered      int64   `json:"recovered"`
+	ConversionRate float64 `json:"conversion_rate"` // recovered / recovery_sent
+}
+
+// GetRecoveryStats returns recovery statistics for sessions started since the given time
+func (s *CheckoutService) GetRecoveryStats(since time.Time) (*CheckoutRecoveryStats, error) {
+	var stats CheckoutRecoveryStats
+	err := s.db.Model(&models.CheckoutSession{}).
+		Where("created_at >= ?", since).
+		Select(`COUNT(*) AS started,
+			COALESCE(SUM(CASE WHEN status = ? THEN 1 ELSE 0 END), 0) AS completed,
+			COALESCE(SUM(CASE WHEN abandoned_at IS NOT NULL THEN 1 ELSE 0 END), 0) AS abandoned,
+			COALESCE(SUM(CASE WHEN recovery_notified_at IS NOT NULL THEN 1 ELSE 0 END), 0) AS recovery_sent,
+			COALESCE(SUM(CASE WHEN recovery_notified_at IS NOT NULL AND status = ? THEN 1 ELSE 0 END), 0) AS recovered`,
+			models.CheckoutStatusCompleted, models.CheckoutStatusCompleted).
+		Scan(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+	if stats.RecoverySent > 0 {
+		stats.ConversionRate = float64(stats.Recovered) / float64(stats.RecoverySent)
+	}
+	return &stats, nil
+}
+
+// Run marks inactive checkouts as abandoned every poll interval until ctx is done
+func (s *CheckoutService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.ProcessAbandoned(); err != nil {
+				log.Error().Err(err).Msg("Failed to process abandoned checkouts")
+			}
+		}
+	}
+}
+
+// ProcessAbandoned marks open sessions without recent activity as abandoned
+// and sends recovery notifications where enabled
+func (s *CheckoutService) ProcessAbandoned() error {
+	var sessions []models.CheckoutSession
+	if err := s.db.Preload("Agent.Publisher").
+		Where("status = ? AND last_activity_at <= ?", models.CheckoutStatusOpen, time.Now().Add(-s.cfg.AbandonAfter)).
+		Order("last_activity_at").
+		Limit(s.cfg.BatchSize).
+		Find(&sessions).Error; err != nil {
+		return err
+	}
+
+	for i := range sessions {
+		if err := s.abandon(&sessions[i]); err != nil {
+			return fmt.Errorf("checkout %s: %w", sessions[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// abandon marks a session abandoned and notifies the buyer unless recovery
+// is disabled globally or by the agent's publisher
+func (s *CheckoutService) abandon(session *models.CheckoutSession) error {
+	var abandoned, notified bool
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		// Guard on the status and activity so a buyer returning meanwhile
+		// or another instance processing the same session wins
+		result := tx.Model(&models.CheckoutSession{}).
+			Where("id = ? AND status = ? AND last_activity_at = ?", session.ID, models.CheckoutStatusOpen, session.LastActivityAt).
+			Updates(map[string]interface{}{
+				"status":       models.CheckoutStatusAbandoned,
+				"abandoned_at": now,
+			})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		abandoned = true
+
+		if !s.cfg.RecoveryEnabled || !session.Agent.Publisher.CheckoutRecoveryEnabled || session.RecoveryNotifiedAt != nil {
+			return nil
+		}
+
+		if err := notify(tx, &models.Notification{
+			UserID: session.BuyerID,
+			Type:   models.NotificationTypeCheckoutRecovery,
+			Title:  fmt.Sprintf("Finish getting %s", session.Agent.Name),
+			Body:   "Your checkout is saved. Pick up where you left off.",
+			Link:   fmt.Sprintf("/checkout/%s", session.ID),
+		}); err != nil {
+			return err
+		}
+		notified = true
+		return tx.Model(&models.CheckoutSession{}).Where("id = ?", session.ID).
+			Update("recovery_notified_at", now).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if abandoned {
+		checkoutEvents.WithLabelValues("abandoned").Inc()
+	}
+	if notified {
+		checkoutEvents.WithLabelValues("recovery_sent").Inc()
+	}
+	return nil
+}
@@ -0,0 +1,408 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrInvalidSBOM is returned for an SBOM that is not a CycloneDX JSON
+	// document
+	ErrInvalidSBOM = errors.New("invalid SBOM")
+	// ErrInvalidCertification is returned for a certification that expires
+	// before it was issued
+	ErrInvalidCertification = errors.New("certification valid_until must be after issued_at")
+)
+
+// ComplianceReport gathers the evidence about a release that purchasers'
+// auditors ask for: how the binary was signed and scanned, what it is built
+// from, its certifications and the marketplace's approval decisions
+type ComplianceReport struct {
+	AgentID        uuid.UUID                 `json:"agent_id"`
+	AgentName      string                    `json:"agent_name"`
+	Publisher      string                    `json:"publisher"`
+	Version        string                    `json:"version"`
+	Status         models.AgentVersionStatus `json:"status"`
+	PublishedAt    *time.Time                `json:"published_at,omitempty"`
+	GeneratedAt    time.Time                 `json:"generated_at"`
+	SafetyLevel    models.SafetyLevel        `json:"safety_level,omitempty"` // declared in the manifest
+	Binary         *ComplianceBinary         `json:"binary"`                 // none before the binary is uploaded
+	Signature      ComplianceSignature       `json:"signature"`
+	Scan           ComplianceScan            `json:"scan"`
+	SBOM           *models.SBOMSummary       `json:"sbom"`
+	Certifications []ComplianceCertification `json:"certifications"`
+	Approvals      []ComplianceApproval      `json:"approvals"`
+}
+
+// ComplianceBinary identifies the binary a report is about
+type ComplianceBinary struct {
+	Checksum    string `json:"checksum"` // hex SHA-256
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+// ComplianceSignature is how a release's binary was signed. Signatures are
+// verified against the publisher's key when the binary is uploaded.
+type ComplianceSignature struct {
+	Signed         bool   `json:"signed"`
+	Algorithm      string `json:"algorithm,omitempty"`
+	KeyFingerprint string `json:"key_fingerprint,omitempty"`
+	KeyRevoked     bool   `json:"key_revoked"`
+}
+
+// ComplianceScan is the outcome of the malware scans of the binary
+type ComplianceScan struct {
+	Status      models.ScanStatus   `json:"status"`
+	CompletedAt *time.Time          `json:"completed_at,omitempty"`
+	Results     []models.ScanResult `json:"results"`
+}
+
+// ComplianceCertification is a certification with whether it has expired
+// as of the report
+type ComplianceCertification struct {
+	models.Certification
+	Expired bool `json:"expired"`
+}
+
+// ComplianceApproval is an admin's approval or rejection of the agent for
+// the catalog
+type ComplianceApproval struct {
+	Decision  string    `json:"decision"` // approved or rejected
+	DecidedAt time.Time `json:"decided_at"`
+}
+
+// ComplianceClaims are the claims of a signed compliance report
+type ComplianceClaims struct {
+	Report ComplianceReport `json:"compliance_report"`
+	jwt.RegisteredClaims
+}
+
+// cycloneDX is the part of a CycloneDX JSON document the summary is made of
+type cycloneDX struct {
+	BOMFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Components   []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXComponent struct {
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	PURL     string `json:"purl"`
+	Licenses []struct {
+		License struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"license"`
+		Expression string `json:"expression"`
+	} `json:"licenses"`
+	Components []cycloneDXComponent `json:"components"` // nested, e.g. in a firmware image
+}
+
+// ComplianceService keeps releases' SBOMs and certifications and builds
+// their compliance reports
+type ComplianceService struct {
+	db     *gorm.DB
+	signer Signer
+	issuer string
+}
+
+// NewComplianceService creates a new compliance service
+func NewComplianceService(db *gorm.DB, signer Signer, issuer string) *ComplianceService {
+	return &ComplianceService{db: db, signer: signer, issuer: issuer}
+}
+
+// UploadSBOM summarizes the CycloneDX JSON SBOM of a draft release
+func (s *ComplianceService) UploadSBOM(release *models.AgentVersion, upload FileUpload) error {
+	if release.Status != models.AgentVersionStatusDraft {
+		return ErrVersionImmutable
+	}
+	data, err := io.ReadAll(io.LimitReader(upload.Body, MaxAssetSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxAssetSize {
+		return ErrAssetTooLarge
+	}
+	summary, err := parseSBOM(data)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.Model(release).Update("sbom", summary).Error; err != nil {
+		return err
+	}
+	release.SBOM = summary
+	return nil
+}
+
+// parseSBOM summarizes a CycloneDX JSON document
+func parseSBOM(data []byte) (*models.SBOMSummary, error) {
+	var bom cycloneDX
+	if err := json.Unmarshal(data, &bom); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSBOM, err)
+	}
+	if bom.BOMFormat != "CycloneDX" || bom.SpecVersion == "" {
+		return nil, fmt.Errorf("%w: bomFormat must be CycloneDX, with a specVersion", ErrInvalidSBOM)
+	}
+
+	summary := &models.SBOMSummary{
+		Format:       "CycloneDX " + bom.SpecVersion,
+		SerialNumber: bom.SerialNumber,
+		Components:   []models.SBOMComponent{},
+		Licenses:     []string{},
+		UploadedAt:   time.Now().UTC(),
+	}
+	licenses := make(map[string]bool)
+	var add func(components []cycloneDXComponent)
+	add = func(components []cycloneDXComponent) {
+		for _, c := range components {
+			if c.Name == "" {
+				continue
+			}
+			component := models.SBOMComponent{Name: c.Name, Version: c.Version, Type: c.Type, PURL: c.PURL}
+			for _, l := range c.Licenses {
+				license := l.Expression
+				if license == "" {
+					license = l.License.ID
+				}
+				if license == "" {
+					license = l.License.Name
+				}
+				if license == "" {
+					continue
+				}
+				component.Licenses = append(component.Licenses, license)
+				licenses[license] = true
+			}
+			summary.Components = append(summary.Components, component)
+			add(c.Components)
+		}
+	}
+	add(bom.Components)
+
+	for license := range licenses {
+		summary.Licenses = append(summary.Licenses, license)
+	}
+	sort.Strings(summary.Licenses)
+	return summary, nil
+}
+
+// SetCertifications replaces the certifications of a release. They can be
+// added after it is published, since certification usually takes longer.
+func (s *ComplianceService) SetCertifications(release *models.AgentVersion, certifications models.Certifications) error {
+	for _, c := range certifications {
+		if c.IssuedAt != nil && c.ValidUntil != nil && !c.ValidUntil.After(*c.IssuedAt) {
+			return ErrInvalidCertification
+		}
+	}
+	if certifications == nil {
+		certifications = models.Certifications{}
+	}
+
+	if err := s.db.Model(release).Update("certifications", certifications).Error; err != nil {
+		return err
+	}
+	release.Certifications = certifications
+	return nil
+}
+
+// Report builds the compliance report of a release as of now. The release
+// must have its signing key loaded.
+func (s *ComplianceService) Report(agent *models.Agent, release *models.AgentVersion) (*ComplianceReport, error) {
+	var publisher models.User
+	if err := s.db.Unscoped().Select("username", "company").First(&publisher, "id = ?", agent.PublisherID).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	report := &ComplianceReport{
+		AgentID:        agent.ID,
+		AgentName:      agent.Name,
+		Publisher:      publisherName(&publisher),
+		Version:        release.Version,
+		Status:         release.Status,
+		PublishedAt:    release.PublishedAt,
+		GeneratedAt:    now,
+		SBOM:           release.SBOM,
+		Scan:           ComplianceScan{Status: release.ScanStatus, Results: []models.ScanResult{}},
+		Certifications: []ComplianceCertification{},
+		Approvals:      []ComplianceApproval{},
+	}
+	if release.Manifest != nil {
+		report.SafetyLevel = release.Manifest.SafetyLevel
+	}
+	if release.BinaryURL != "" {
+		report.Binary = &ComplianceBinary{
+			Checksum:    release.BinaryChecksum,
+			Size:        release.BinarySize,
+			ContentType: release.BinaryContentType,
+		}
+	}
+	if release.BinarySignature != "" && release.SigningKey != nil {
+		report.Signature = ComplianceSignature{
+			Signed:         true,
+			Algorithm:      string(release.SigningKey.Algorithm),
+			KeyFingerprint: release.SigningKey.Fingerprint,
+			KeyRevoked:     release.SigningKey.RevokedAt != nil,
+		}
+	}
+	if release.ScanReport != nil {
+		report.Scan.CompletedAt = release.ScanReport.CompletedAt
+		report.Scan.Results = append(report.Scan.Results, release.ScanReport.Results...)
+	}
+	for _, c := range release.Certifications {
+		report.Certifications = append(report.Certifications, ComplianceCertification{
+			Certification: c,
+			Expired:       c.ValidUntil != nil && c.ValidUntil.Before(now),
+		})
+	}
+
+	// Who decided is left out: purchasers only need to know it was reviewed
+	var decisions []models.AuditLog
+	if err := s.db.Select("action", "created_at").
+		Where("entity_type = ? AND entity_id = ? AND action IN ?", "agent", agent.ID,
+			[]models.AuditAction{models.AuditActionAgentApprove, models.AuditActionAgentReject}).
+		Order("created_at").
+		Find(&decisions).Error; err != nil {
+		return nil, err
+	}
+	for _, d := range decisions {
+		decision := "approved"
+		if d.Action == models.AuditActionAgentReject {
+			decision = "rejected"
+		}
+		report.Approvals = append(report.Approvals, ComplianceApproval{Decision: decision, DecidedAt: d.CreatedAt.UTC()})
+	}
+
+	return report, nil
+}
+
+// Sign returns a report as a JWS token signed with the marketplace key,
+// verifiable with the published signing keys
+func (s *ComplianceService) Sign(report *ComplianceReport) (string, error) {
+	claims := ComplianceClaims{
+		Report: *report,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   s.issuer,
+			Subject:  report.AgentID.String() + "@" + report.Version,
+			IssuedAt: jwt.NewNumericDate(report.GeneratedAt),
+		},
+	}
+
+	token := jwt.NewWithClaims(signerMethod{}, claims)
+	token.Header["kid"] = s.signer.KeyID()
+	return token.SignedString(s.signer)
+}
+
+// RenderPDF lays a report out as a PDF document
+func (s *ComplianceService) RenderPDF(report *ComplianceReport) []byte {
+	const date = "2006-01-02"
+	heading := func(text string) pdfLine { return pdfLine{text: text, bold: true} }
+	text := func(format string, args ...interface{}) pdfLine { return pdfLine{text: fmt.Sprintf(format, args...)} }
+	blank := pdfLine{}
+
+	title := fmt.Sprintf("Compliance report: %s %s", report.AgentName, report.Version)
+	lines := []pdfLine{
+		heading(title),
+		text("Publisher: %s", report.Publisher),
+		text("Agent ID: %s", report.AgentID),
+		text("Release status: %s", report.Status),
+	}
+	if report.PublishedAt != nil {
+		lines = append(lines, text("Published: %s", report.PublishedAt.UTC().Format(date)))
+	}
+	if report.SafetyLevel != "" {
+		lines = append(lines, text("Declared safety level: %s", report.SafetyLevel))
+	}
+	lines = append(lines, text("Generated: %s", report.GeneratedAt.Format(time.RFC3339)), blank)
+
+	lines = append(lines, heading("Binary and signature"))
+	if report.Binary == nil {
+		lines = append(lines, text("No binary uploaded"))
+	} else {
+		lines = append(lines,
+			text("SHA-256: %s", report.Binary.Checksum),
+			text("Size: %d bytes (%s)", report.Binary.Size, report.Binary.ContentType))
+	}
+	if report.Signature.Signed {
+		lines = append(lines, text("Signed with %s key %s", report.Signature.Algorithm, report.Signature.KeyFingerprint))
+		if report.Signature.KeyRevoked {
+			lines = append(lines, text("The signing key has since been revoked"))
+		}
+	} else {
+		lines = append(lines, text("Not signed"))
+	}
+	lines = append(lines, blank)
+
+	lines = append(lines, heading("Malware scan"), text("Status: %s", report.Scan.Status))
+	for _, r := range report.Scan.Results {
+		line := text("%s: %s on %s", r.Scanner, r.Verdict, r.ScannedAt.UTC().Format(date))
+		if len(r.Findings) > 0 {
+			line.text += " (" + strings.Join(r.Findings, ", ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, blank)
+
+	lines = append(lines, heading("Software bill of materials"))
+	if report.SBOM == nil {
+		lines = append(lines, text("No SBOM provided"))
+	} else {
+		lines = append(lines,
+			text("%s, %d components, uploaded %s", report.SBOM.Format, len(report.SBOM.Components), report.SBOM.UploadedAt.Format(date)),
+			text("Licenses: %s", strings.Join(report.SBOM.Licenses, ", ")))
+		for _, c := range report.SBOM.Components {
+			line := text("- %s %s", c.Name, c.Version)
+			if len(c.Licenses) > 0 {
+				line.text += " [" + strings.Join(c.Licenses, ", ") + "]"
+			}
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, blank)
+
+	lines = append(lines, heading("Certifications"))
+	if len(report.Certifications) == 0 {
+		lines = append(lines, text("None provided"))
+	}
+	for _, c := range report.Certifications {
+		line := text("- %s %s, issued by %s", c.Standard, c.Level, c.Issuer)
+		if c.CertificateID != "" {
+			line.text += ", certificate " + c.CertificateID
+		}
+		if c.ValidUntil != nil {
+			line.text += ", valid until " + c.ValidUntil.UTC().Format(date)
+		}
+		if c.Expired {
+			line.text += " (expired)"
+		}
+		lines = append(lines, line)
+		if c.EvidenceURL != "" {
+			lines = append(lines, text("  Evidence: %s", c.EvidenceURL))
+		}
+	}
+	lines = append(lines, blank)
+
+	lines = append(lines, heading("Marketplace review"))
+	if len(report.Approvals) == 0 {
+		lines = append(lines, text("No review decisions recorded"))
+	}
+	for _, a := range report.Approvals {
+		lines = append(lines, text("- %s on %s", a.Decision, a.DecidedAt.Format(date)))
+	}
+
+	return renderPDF(title, lines)
+}
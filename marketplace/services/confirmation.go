@@ -0,0 +1,180 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrInvalidConfirmation is returned for a confirmation link that is
+	// forged, used or expired
+	ErrInvalidConfirmation = errors.New("confirmation link is invalid or has expired")
+	// ErrWrongPassword is returned when re-authentication fails
+	ErrWrongPassword = errors.New("password is incorrect")
+	// ErrConfirmationLimit is returned when a user asked for too many
+	// confirmation emails in the last hour
+	ErrConfirmationLimit = errors.New("too many confirmation emails, try again later")
+)
+
+// ActionClaims are the claims of a confirmation link token. The token ID
+// is the pending action's.
+type ActionClaims struct {
+	Action models.PendingActionType `json:"action"`
+	jwt.RegisteredClaims
+}
+
+// ConfirmationService guards sensitive actions. Handlers either check the
+// user's password again or store the action as pending and email a signed,
+// expiring link, running the action once the link is confirmed.
+type ConfirmationService struct {
+	db     *gorm.DB
+	mailer Mailer
+	signer Signer
+	issuer string
+	cfg    config.ConfirmationsConfig
+}
+
+// NewConfirmationService creates a new confirmation service
+func NewConfirmationService(db *gorm.DB, mailer Mailer, signer Signer, issuer string, cfg config.ConfirmationsConfig) *ConfirmationService {
+	return &ConfirmationService{db: db, mailer: mailer, signer: signer, issuer: issuer, cfg: cfg}
+}
+
+// Reauthenticate checks a user's current password
+func (s *ConfirmationService) Reauthenticate(userID uuid.UUID, password string) error {
+	var user models.User
+	if err := s.db.Select("password_hash").First(&user, "id = ?", userID).Error; err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// Request stores a pending action and emails a link confirming it, to the
+// given address or, if empty, the user's own. description completes
+// "confirm that you want to".
+func (s *ConfirmationService) Request(action *models.PendingAction, to, description string) error {
+	var user models.User
+	if err := s.db.Select("id", "email").First(&user, "id = ?", action.UserID).Error; err != nil {
+		return err
+	}
+	if to == "" {
+		to = user.Email
+	}
+
+	var recent int64
+	if err := s.db.Model(&models.PendingAction{}).
+		Where("user_id = ? AND created_at > ?", user.ID, time.Now().Add(-time.Hour)).
+		Count(&recent).Error; err != nil {
+		return err
+	}
+	if recent >= int64(s.cfg.MaxPerHour) {
+		return ErrConfirmationLimit
+	}
+
+	action.ExpiresAt = time.Now().Add(s.cfg.TokenTTL)
+	if err := s.db.Create(action).Error; err != nil {
+		return err
+	}
+
+	token, err := s.sign(action)
+	if err != nil {
+		return err
+	}
+	link, err := url.Parse(s.cfg.ConfirmURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	body := fmt.Sprintf("Please confirm that you want to %s.\n\n"+
+		"Open this link within %s to confirm:\n\n%s\n\n"+
+		"If you did not ask for this, ignore this email and consider changing your password.\n",
+		description, s.cfg.TokenTTL, link.String())
+	return s.mailer.Send(to, "Confirm your EdgePlug Marketplace request", body)
+}
+
+// Confirm verifies a confirmation token and claims its pending action, so
+// the link cannot be used again. The action is returned with its user, who
+// must still be active.
+func (s *ConfirmationService) Confirm(token string) (*models.PendingAction, error) {
+	claims := &ActionClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		if kid, _ := token.Header["kid"].(string); kid != s.signer.KeyID() {
+			return nil, errors.New("unknown signing key")
+		}
+		return s.signer.Public(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}), jwt.WithIssuer(s.issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, ErrInvalidConfirmation
+	}
+	id, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return nil, ErrInvalidConfirmation
+	}
+
+	var action models.PendingAction
+	if err := s.db.Preload("User").
+		First(&action, "id = ? AND user_id = ? AND action = ?", id, claims.Subject, claims.Action).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidConfirmation
+		}
+		return nil, err
+	}
+	if action.User.ID == uuid.Nil || action.User.Status != models.UserStatusActive || time.Now().After(action.ExpiresAt) {
+		return nil, ErrInvalidConfirmation
+	}
+
+	now := time.Now()
+	result := s.db.Model(&models.PendingAction{}).
+		Where("id = ? AND confirmed_at IS NULL", action.ID).
+		Update("confirmed_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidConfirmation
+	}
+	action.ConfirmedAt = &now
+	return &action, nil
+}
+
+// Notify emails a user about a sensitive action that has been carried out,
+// logging rather than returning failures
+func (s *ConfirmationService) Notify(to, subject, body string) {
+	if err := s.mailer.Send(to, subject, body); err != nil {
+		log.Error().Err(err).Msg("Failed to send confirmation notice")
+	}
+}
+
+// sign returns the token of a pending action's confirmation link
+func (s *ConfirmationService) sign(action *models.PendingAction) (string, error) {
+	claims := ActionClaims{
+		Action: action.Action,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   action.UserID.String(),
+			ExpiresAt: jwt.NewNumericDate(action.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        action.ID.String(),
+		},
+	}
+
+	token := jwt.NewWithClaims(signerMethod{}, claims)
+	token.Header["kid"] = s.signer.KeyID()
+	return token.SignedString(s.signer)
+}
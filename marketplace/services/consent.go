@@ -0,0 +1,176 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrUnknownConsentPurpose is returned for a purpose that does not exist
+	ErrUnknownConsentPurpose = errors.New("unknown consent purpose")
+	// ErrStaleConsentVersion is returned when granting a consent to a
+	// version of its text that is no longer current
+	ErrStaleConsentVersion = errors.New("consent text version is not current")
+)
+
+// ConsentPurposes lists every purpose a user can consent to
+var ConsentPurposes = []models.ConsentPurpose{
+	models.ConsentMarketingEmail,
+	models.ConsentUsageAnalytics,
+	models.ConsentTelemetrySharing,
+}
+
+// ConsentStatus is a user's consent to one purpose. It is granted only if
+// the user accepted the current version of its text.
+type ConsentStatus struct {
+	Purpose        models.ConsentPurpose `json:"purpose"`
+	Granted        bool                  `json:"granted"`
+	Version        string                `json:"version,omitempty"` // answered, empty if never asked
+	CurrentVersion string                `json:"current_version"`
+	UpdatedAt      *time.Time            `json:"updated_at,omitempty"`
+}
+
+// ConsentChange is a user's answer for one purpose, to the version of its
+// text they were shown
+type ConsentChange struct {
+	Purpose models.ConsentPurpose
+	Granted bool
+	Version string
+}
+
+// ConsentService records what users consent to and answers whether a use
+// of their data is allowed. Nothing is consented to by default.
+type ConsentService struct {
+	db  *gorm.DB
+	cfg config.ConsentConfig
+}
+
+// NewConsentService creates a new consent service
+func NewConsentService(db *gorm.DB, cfg config.ConsentConfig) *ConsentService {
+	return &ConsentService{db: db, cfg: cfg}
+}
+
+// CurrentVersion returns the version of a purpose's consent text, or ""
+// for an unknown purpose
+func (s *ConsentService) CurrentVersion(purpose models.ConsentPurpose) string {
+	switch purpose {
+	case models.ConsentMarketingEmail:
+		return s.cfg.MarketingEmailVersion
+	case models.ConsentUsageAnalytics:
+		return s.cfg.UsageAnalyticsVersion
+	case models.ConsentTelemetrySharing:
+		return s.cfg.TelemetrySharingVersion
+	default:
+		return ""
+	}
+}
+
+// GetConsents returns a user's consent to every purpose
+func (s *ConsentService) GetConsents(userID uuid.UUID) ([]ConsentStatus, error) {
+	var consents []models.Consent
+	if err := s.db.Where("user_id = ?", userID).Find(&consents).Error; err != nil {
+		return nil, err
+	}
+	answered := make(map[models.ConsentPurpose]models.Consent, len(consents))
+	for _, consent := range consents {
+		answered[consent.Purpose] = consent
+	}
+
+	statuses := make([]ConsentStatus, len(ConsentPurposes))
+	for i, purpose := range ConsentPurposes {
+		status := ConsentStatus{Purpose: purpose, CurrentVersion: s.CurrentVersion(purpose)}
+		if consent, ok := answered[purpose]; ok {
+			updatedAt := consent.UpdatedAt
+			status.Granted = consent.Granted && consent.Version == status.CurrentVersion
+			status.Version = consent.Version
+			status.UpdatedAt = &updatedAt
+		}
+		statuses[i] = status
+	}
+	return statuses, nil
+}
+
+// UpdateConsents records a user's answers, each also kept as a consent
+// event with where it came from. A grant must be to the current version of
+// the text; a refusal always applies.
+func (s *ConsentService) UpdateConsents(userID uuid.UUID, changes []ConsentChange, ipAddress, userAgent string) error {
+	for i, change := range changes {
+		current := s.CurrentVersion(change.Purpose)
+		if current == "" {
+			return ErrUnknownConsentPurpose
+		}
+		if !change.Granted {
+			changes[i].Version = current
+		} else if change.Version != current {
+			return ErrStaleConsentVersion
+		}
+	}
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, change := range changes {
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "user_id"}, {Name: "purpose"}},
+				DoUpdates: clause.AssignmentColumns([]string{"granted", "version", "updated_at"}),
+			}).Create(&models.Consent{
+				UserID:  userID,
+				Purpose: change.Purpose,
+				Granted: change.Granted,
+				Version: change.Version,
+			}).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(&models.ConsentEvent{
+				UserID:    userID,
+				Purpose:   change.Purpose,
+				Granted:   change.Granted,
+				Version:   change.Version,
+				IPAddress: ipAddress,
+				UserAgent: userAgent,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetConsentEvents returns a user's consent answers, newest first
+func (s *ConsentService) GetConsentEvents(userID uuid.UUID, page, limit int) ([]models.ConsentEvent, int64, error) {
+	var events []models.ConsentEvent
+	var total int64
+
+	query := s.db.Model(&models.ConsentEvent{}).Where("user_id = ?", userID)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Order("created_at DESC").Offset((page - 1) * limit).Limit(limit).Find(&events).Error
+	return events, total, err
+}
+
+// Granted reports whether a user consented to a purpose
+func (s *ConsentService) Granted(userID uuid.UUID, purpose models.ConsentPurpose) (bool, error) {
+	var count int64
+	err := s.consenting(purpose).Where("user_id = ?", userID).Count(&count).Error
+	return count > 0, err
+}
+
+// ConsentingUsers returns a subquery of the IDs of users who consented to
+// a purpose, for filtering other queries with IN (?)
+func (s *ConsentService) ConsentingUsers(purpose models.ConsentPurpose) *gorm.DB {
+	return s.consenting(purpose).Select("user_id")
+}
+
+func (s *ConsentService) consenting(purpose models.ConsentPurpose) *gorm.DB {
+	return s.db.Model(&models.Consent{}).
+		Where("purpose = ? AND granted = ? AND version = ?", purpose, true, s.CurrentVersion(purpose))
+}
@@ -0,0 +1,299 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrInvalidCreditAmount is returned when granting a non-positive amount of credit
+	ErrInvalidCreditAmount = errors.New("credit amount must be positive")
+	// ErrInvalidCreditCode is returned for an unknown, expired or used-up credit code
+	ErrInvalidCreditCode = errors.New("credit code is invalid or expired")
+	// ErrCodeRedeemed is returned when the user already redeemed the credit code
+	ErrCodeRedeemed = errors.New("credit code already redeemed")
+)
+
+// CreditService manages account credit: grants, promotion codes, spending at
+// checkout and expiry. Every change is an entry in the user's credit ledger.
+type CreditService struct {
+	db  *gorm.DB
+	cfg config.CreditsConfig
+}
+
+// NewCreditService creates a new credit service
+func NewCreditService(db *gorm.DB, cfg config.CreditsConfig) *CreditService {
+	return &CreditService{db: db, cfg: cfg}
+}
+
+// CreditBalance is a user's spendable credit in one currency
+type CreditBalance struct {
+	Currency       string       `json:"currency"`
+	Balance        models.Money `json:"balance_minor"`
+	BalanceDisplay string       `json:"balance"`
+	NextExpiry     *time.Time   `json:"next_expiry,omitempty"` // when the earliest expiring credit lapses
+}
+
+// Balances returns a user's unexpired credit per currency
+func (s *CreditService) Balances(userID uuid.UUID) ([]CreditBalance, error) {
+	var balances []CreditBalance
+	if err := s.db.Model(&models.CreditEntry{}).
+		Select("currency, SUM(remaining_minor) AS balance, MIN(expires_at) AS next_expiry").
+		Where("user_id = ? AND remaining_minor > 0 AND (expires_at IS NULL OR expires_at > ?)", userID, time.Now()).
+		Group("currency").
+		Scan(&balances).Error; err != nil {
+		return nil, err
+	}
+	for i := range balances {
+		balances[i].BalanceDisplay = models.FormatMoney(balances[i].Balance, balances[i].Currency)
+	}
+	return balances, nil
+}
+
+// History returns a user's credit ledger, most recent first
+func (s *CreditService) History(userID uuid.UUID, page, limit int) ([]models.CreditEntry, int64, error) {
+	var entries []models.CreditEntry
+	var total int64
+
+	query := s.db.Model(&models.CreditEntry{}).Where("user_id = ?", userID)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&entries).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return entries, total, nil
+}
+
+// Grant credits a user's account on behalf of an admin. The credit expires
+// after validDays, or never if validDays is 0.
+func (s *CreditService) Grant(userID, adminID uuid.UUID, amount models.Money, currency, reason string, validDays int) (*models.CreditEntry, error) {
+	if amount <= 0 {
+		return nil, ErrInvalidCreditAmount
+	}
+	var user models.User
+	if err := s.db.Select("id").First(&user, "id = ?", userID).Error; err != nil {
+		return nil, err
+	}
+
+	entry := creditGrant(userID, models.CreditEntryTypeGrant, amount, currency, reason, validDays)
+	entry.GrantedBy = &adminID
+	if err := s.db.Create(&entry).Error; err != nil {
+		return nil, err
+	}
+	entry.AmountDisplay = models.FormatMoney(entry.Amount, entry.Currency)
+	return &entry, nil
+}
+
+// creditGrant builds a ledger entry that adds spendable credit
+func creditGrant(userID uuid.UUID, entryType models.CreditEntryType, amount models.Money, currency, reason string, validDays int) models.CreditEntry {
+	entry := models.CreditEntry{
+		UserID:    userID,
+		Type:      entryType,
+		Amount:    amount,
+		Remaining: amount,
+		Currency:  currency,
+		Reason:    reason,
+	}
+	if validDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, validDays)
+		entry.ExpiresAt = &expiresAt
+	}
+	return entry
+}
+
+// CreateCode creates a gift card or promotion code
+func (s *CreditService) CreateCode(code *models.CreditCode) error {
+	if code.Amount <= 0 {
+		return ErrInvalidCreditAmount
+	}
+	code.Code = strings.ToUpper(strings.TrimSpace(code.Code))
+	if err := s.db.Create(code).Error; err != nil {
+		return err
+	}
+	code.AmountDisplay = models.FormatMoney(code.Amount, code.Currency)
+	return nil
+}
+
+// GetCodes returns credit codes, most recent first
+func (s *CreditService) GetCodes(page, limit int) ([]models.CreditCode, int64, error) {
+	var codes []models.CreditCode
+	var total int64
+
+	query := s.db.Model(&models.CreditCode{})
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&codes).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return codes, total, nil
+}
+
+// Redeem grants the credit of a code to a user. Each user can redeem a code once.
+func (s *CreditService) Redeem(userID uuid.UUID, code string) (*models.CreditEntry, error) {
+	var entry models.CreditEntry
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var creditCode models.CreditCode
+		// Lock the code so concurrent redemptions cannot exceed its limit
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code = ?", strings.ToUpper(strings.TrimSpace(code))).
+			First(&creditCode).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return ErrInvalidCreditCode
+			}
+			return err
+		}
+		if creditCode.ExpiresAt != nil && creditCode.ExpiresAt.Before(time.Now()) {
+			return ErrInvalidCreditCode
+		}
+		if creditCode.MaxRedemptions > 0 && creditCode.Redemptions >= creditCode.MaxRedemptions {
+			return ErrInvalidCreditCode
+		}
+
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.CreditRedemption{
+			CodeID:     creditCode.ID,
+			UserID:     userID,
+			RedeemedAt: time.Now(),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrCodeRedeemed
+		}
+		if err := tx.Model(&creditCode).UpdateColumn("redemptions", gorm.Expr("redemptions + 1")).Error; err != nil {
+			return err
+		}
+
+		entry = creditGrant(userID, models.CreditEntryTypePromotion, creditCode.Amount, creditCode.Currency, "Redeemed code "+creditCode.Code, creditCode.ValidDays)
+		entry.CodeID = &creditCode.ID
+		return tx.Create(&entry).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry.AmountDisplay = models.FormatMoney(entry.Amount, entry.Currency)
+	return &entry, nil
+}
+
+// spendCredit spends up to max of a user's credit in currency on a purchase,
+// drawing on the credit that expires first, and returns the amount spent
+func spendCredit(tx *gorm.DB, userID uuid.UUID, currency string, max models.Money, purchaseID uuid.UUID) (models.Money, error) {
+	var grants []models.CreditEntry
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND currency = ? AND remaining_minor > 0 AND (expires_at IS NULL OR expires_at > ?)", userID, currency, time.Now()).
+		Order("expires_at, created_at").
+		Find(&grants).Error; err != nil {
+		return 0, err
+	}
+
+	var spent models.Money
+	for _, grant := range grants {
+		if spent == max {
+			break
+		}
+		take := grant.Remaining
+		if take > max-spent {
+			take = max - spent
+		}
+		if err := tx.Model(&models.CreditEntry{}).Where("id = ?", grant.ID).
+			UpdateColumn("remaining_minor", grant.Remaining-take).Error; err != nil {
+			return 0, err
+		}
+		spent += take
+	}
+	if spent == 0 {
+		return 0, nil
+	}
+
+	return spent, tx.Create(&models.CreditEntry{
+		UserID:     userID,
+		Type:       models.CreditEntryTypeSpend,
+		Amount:     -spent,
+		Currency:   currency,
+		PurchaseID: &purchaseID,
+	}).Error
+}
+
+// refundCredit returns the credit spent on a purchase that did not go
+// through or was refunded. Refunded credit does not expire.
+func refundCredit(tx *gorm.DB, purchase *models.Purchase, reason string) error {
+	if purchase.CreditApplied == 0 {
+		return nil
+	}
+	entry := creditGrant(purchase.BuyerID, models.CreditEntryTypeRefund, purchase.CreditApplied, purchase.Currency, reason, 0)
+	entry.PurchaseID = &purchase.ID
+	return tx.Create(&entry).Error
+}
+
+// Run expires lapsed credit every poll interval until ctx is done
+func (s *CreditService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.ExpireCredits(); err != nil {
+				log.Error().Err(err).Msg("Failed to expire credits")
+			}
+		}
+	}
+}
+
+// ExpireCredits writes off the unspent part of lapsed grants with an expiry
+// entry, so the ledger always sums to the spendable balance
+func (s *CreditService) ExpireCredits() error {
+	var grants []models.CreditEntry
+	if err := s.db.Where("remaining_minor > 0 AND expires_at <= ?", time.Now()).Find(&grants).Error; err != nil {
+		return err
+	}
+
+	expired := 0
+	for _, grant := range grants {
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			// Guard on the remaining amount so credit spent meanwhile is not written off
+			result := tx.Model(&models.CreditEntry{}).
+				Where("id = ? AND remaining_minor = ?", grant.ID, grant.Remaining).
+				UpdateColumn("remaining_minor", 0)
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			expired++
+			return tx.Create(&models.CreditEntry{
+				UserID:   grant.UserID,
+				Type:     models.CreditEntryTypeExpiry,
+				Amount:   -grant.Remaining,
+				Currency: grant.Currency,
+				Reason:   "Credit expired",
+			}).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if expired > 0 {
+		log.Info().Int("grants", expired).Msg("Expired account credit")
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// maxFeaturedPins caps the agents an admin can pin to one slot
+const maxFeaturedPins = 50
+
+var (
+	// ErrInvalidCurationRule is returned for a rule whose expression, slot or schedule is invalid
+	ErrInvalidCurationRule = errors.New("invalid curation rule")
+	// ErrInvalidPins is returned when pinning agents that are not published
+	ErrInvalidPins = errors.New("only published agents can be featured")
+)
+
+// slotPattern matches featured slot names
+var slotPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// Curation expressions are conditions joined by AND. A condition compares a
+// field with a value, e.g. rating>=4.5, or is a flag such as
+// verified_publisher.
+var (
+	curationAndPattern       = regexp.MustCompile(`(?i)\s+and\s+`)
+	curationConditionPattern = regexp.MustCompile(`^([a-z_]+)\s*(>=|<=|!=|=|>|<)\s*(.+)$`)
+)
+
+// curationColumns are the agent columns curation expressions can compare,
+// and whether they are numeric
+var curationColumns = map[string]bool{
+	"category":      false,
+	"pricing_model": false,
+	"safety_level":  false,
+	"rating":        true,
+	"review_count":  true,
+	"downloads":     true,
+	"price_minor":   true,
+}
+
+// curationFlags are the value-less conditions of curation expressions
+var curationFlags = map[string]string{
+	"verified_publisher": "publisher_id IN (SELECT id FROM users WHERE verified = true)",
+}
+
+// curationCondition is one compiled condition on agents
+type curationCondition struct {
+	clause string
+	args   []interface{}
+}
+
+// compileCurationExpression turns an expression into SQL conditions on
+// the agents table. Fields are whitelisted and values always bound.
+func compileCurationExpression(expr string) ([]curationCondition, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, fmt.Errorf("%w: expression is empty", ErrInvalidCurationRule)
+	}
+
+	var conditions []curationCondition
+	for _, part := range curationAndPattern.Split(expr, -1) {
+		part = strings.TrimSpace(part)
+		if flag, ok := curationFlags[strings.ReplaceAll(strings.ToLower(part), " ", "_")]; ok {
+			conditions = append(conditions, curationCondition{clause: flag})
+			continue
+		}
+
+		m := curationConditionPattern.FindStringSubmatch(part)
+		if m == nil {
+			return nil, fmt.Errorf("%w: cannot parse %q", ErrInvalidCurationRule, part)
+		}
+		field, op, value := m[1], m[2], strings.Trim(strings.TrimSpace(m[3]), `"'`)
+		equality := op == "=" || op == "!="
+
+		switch numeric, known := curationColumns[field]; {
+		case field == "tag":
+			if op != "=" {
+				return nil, fmt.Errorf("%w: tag only supports =", ErrInvalidCurationRule)
+			}
+			clause, arg := models.TagFilter(value)
+			conditions = append(conditions, curationCondition{clause: clause, args: []interface{}{arg}})
+		case field == "publisher_tier":
+			if !equality {
+				return nil, fmt.Errorf("%w: publisher_tier only supports = and !=", ErrInvalidCurationRule)
+			}
+			conditions = append(conditions, curationCondition{
+				clause: "publisher_id IN (SELECT id FROM users WHERE tier " + op + " ?)",
+				args:   []interface{}{value},
+			})
+		case !known:
+			return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidCurationRule, field)
+		case numeric:
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s needs a number, got %q", ErrInvalidCurationRule, field, value)
+			}
+			conditions = append(conditions, curationCondition{clause: field + " " + op + " ?", args: []interface{}{n}})
+		default:
+			if !equality {
+				return nil, fmt.Errorf("%w: %s only supports = and !=", ErrInvalidCurationRule, field)
+			}
+			conditions = append(conditions, curationCondition{clause: field + " " + op + " ?", args: []interface{}{value}})
+		}
+	}
+	return conditions, nil
+}
+
+// CurationService fills featured storefront slots from admin pins and
+// curation rules
+type CurationService struct {
+	db      *gorm.DB
+	cfg     config.CurationConfig
+	ranking *RankingService
+}
+
+// NewCurationService creates a new curation service
+func NewCurationService(db *gorm.DB, cfg config.CurationConfig, ranking *RankingService) *CurationService {
+	return &CurationService{db: db, cfg: cfg, ranking: ranking}
+}
+
+// Run re-evaluates the curation rules every poll interval until ctx is
+// done, which also starts and ends scheduled rules
+func (s *CurationService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.EvaluateAll(); err != nil {
+				log.Error().Err(err).Msg("Failed to evaluate curation rules")
+			}
+		}
+	}
+}
+
+// GetRules returns the curation rules, optionally of one slot, in the
+// order they fill their slots
+func (s *CurationService) GetRules(slot string) ([]models.CurationRule, error) {
+	query := s.db.Order("slot, priority, created_at")
+	if slot != "" {
+		query = query.Where("slot = ?", slot)
+	}
+	var rules []models.CurationRule
+	if err := query.Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// GetRule returns a curation rule
+func (s *CurationService) GetRule(id uuid.UUID) (*models.CurationRule, error) {
+	var rule models.CurationRule
+	if err := s.db.First(&rule, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// SaveRule validates and creates or updates a curation rule. The rule's
+// slot is filled again on the next evaluation.
+func (s *CurationService) SaveRule(rule *models.CurationRule) error {
+	if !slotPattern.MatchString(rule.Slot) {
+		return fmt.Errorf("%w: slot must be 1-64 lowercase letters, digits or '-'", ErrInvalidCurationRule)
+	}
+	if rule.MaxAgents < 1 || rule.MaxAgents > 100 {
+		return fmt.Errorf("%w: max_agents must be between 1 and 100", ErrInvalidCurationRule)
+	}
+	if rule.StartsAt != nil && rule.EndsAt != nil && !rule.EndsAt.After(*rule.StartsAt) {
+		return fmt.Errorf("%w: ends_at must be after starts_at", ErrInvalidCurationRule)
+	}
+	if _, err := compileCurationExpression(rule.Expression); err != nil {
+		return err
+	}
+	return s.db.Save(rule).Error
+}
+
+// DeleteRule removes a curation rule and the agents it placed
+func (s *CurationService) DeleteRule(id uuid.UUID) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&models.CurationRule{}, "id = ?", id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Where("rule_id = ?", id).Delete(&models.FeaturedAgent{}).Error
+	})
+}
+
+// Preview returns the agents an expression currently matches, in the
+// order a rule would place them, and how many match in total
+func (s *CurationService) Preview(expression string, limit int) ([]models.Agent, int64, error) {
+	conditions, err := compileCurationExpression(expression)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := s.matching(conditions)
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	ranked, err := s.ranking.Order(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	var agents []models.Agent
+	if err := ranked.Limit(limit).Find(&agents).Error; err != nil {
+		return nil, 0, err
+	}
+	return agents, total, nil
+}
+
+// matching returns a query for the published agents meeting all conditions
+func (s *CurationService) matching(conditions []curationCondition) *gorm.DB {
+	query := s.db.Model(&models.Agent{}).Where("status = ?", models.AgentStatusPublished)
+	for _, condition := range conditions {
+		query = query.Where(condition.clause, condition.args...)
+	}
+	return query
+}
+
+// GetFeatured returns the published agents in a slot, in display order
+func (s *CurationService) GetFeatured(slot string) ([]models.Agent, error) {
+	var featured []models.FeaturedAgent
+	if err := s.db.Preload("Agent").Where("slot = ?", slot).Order("position").Find(&featured).Error; err != nil {
+		return nil, err
+	}
+
+	agents := make([]models.Agent, 0, len(featured))
+	for _, f := range featured {
+		if f.Agent.Status == models.AgentStatusPublished && !f.Agent.DeletedAt.Valid {
+			agents = append(agents, f.Agent)
+		}
+	}
+	return agents, nil
+}
+
+// SetPins replaces the agents pinned by hand to the top of a slot
+func (s *CurationService) SetPins(slot string, agentIDs []uuid.UUID) error {
+	if !slotPattern.MatchString(slot) {
+		return fmt.Errorf("%w: slot must be 1-64 lowercase letters, digits or '-'", ErrInvalidCurationRule)
+	}
+	if len(agentIDs) > maxFeaturedPins {
+		return fmt.Errorf("%w: at most %d agents can be pinned", ErrInvalidPins, maxFeaturedPins)
+	}
+
+	seen := make(map[uuid.UUID]bool, len(agentIDs))
+	for _, id := range agentIDs {
+		if seen[id] {
+			return fmt.Errorf("%w: agent %s is pinned twice", ErrInvalidPins, id)
+		}
+		seen[id] = true
+	}
+	var published int64
+	if len(agentIDs) > 0 {
+		if err := s.db.Model(&models.Agent{}).
+			Where("id IN ? AND status = ?", agentIDs, models.AgentStatusPublished).
+			Count(&published).Error; err != nil {
+			return err
+		}
+	}
+	if published != int64(len(agentIDs)) {
+		return ErrInvalidPins
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Rule placements are rebuilt below around the new pins
+		if err := tx.Where("slot = ?", slot).Delete(&models.FeaturedAgent{}).Error; err != nil {
+			return err
+		}
+		for i, id := range agentIDs {
+			if err := tx.Create(&models.FeaturedAgent{Slot: slot, AgentID: id, Position: i}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.evaluateSlot(slot, time.Now())
+}
+
+// EvaluateAll refills every slot that has rules or rule placements
+func (s *CurationService) EvaluateAll() error {
+	var slots []string
+	if err := s.db.Raw("SELECT DISTINCT slot FROM curation_rules UNION SELECT DISTINCT slot FROM featured_agents WHERE rule_id IS NOT NULL").
+		Scan(&slots).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, slot := range slots {
+		if err := s.evaluateSlot(slot, now); err != nil {
+			return fmt.Errorf("slot %s: %w", slot, err)
+		}
+	}
+	return nil
+}
+
+// evaluateSlot replaces a slot's rule placements with the current matches
+// of its active rules. Pinned agents stay first; each rule then adds up to
+// its maximum of agents not already in the slot.
+func (s *CurationService) evaluateSlot(slot string, now time.Time) error {
+	var rules []models.CurationRule
+	if err := s.db.Where("slot = ? AND enabled = ?", slot, true).
+		Where("starts_at IS NULL OR starts_at <= ?", now).
+		Where("ends_at IS NULL OR ends_at > ?", now).
+		Order("priority, created_at").
+		Find(&rules).Error; err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("slot = ? AND rule_id IS NOT NULL", slot).Delete(&models.FeaturedAgent{}).Error; err != nil {
+			return err
+		}
+
+		var pins []models.FeaturedAgent
+		if err := tx.Where("slot = ?", slot).Order("position").Find(&pins).Error; err != nil {
+			return err
+		}
+		taken := make(map[uuid.UUID]bool, len(pins))
+		for _, pin := range pins {
+			taken[pin.AgentID] = true
+		}
+		position := len(pins)
+
+		for _, rule := range rules {
+			conditions, err := compileCurationExpression(rule.Expression)
+			if err != nil {
+				log.Warn().Err(err).Str("rule_id", rule.ID.String()).Msg("Skipping invalid curation rule")
+				continue
+			}
+
+			ranked, err := s.ranking.Order(s.matching(conditions))
+			if err != nil {
+				return err
+			}
+			var ids []uuid.UUID
+			if err := ranked.Limit(rule.MaxAgents+len(taken)).Pluck("id", &ids).Error; err != nil {
+				return err
+			}
+
+			placed := 0
+			for _, id := range ids {
+				if placed == rule.MaxAgents {
+					break
+				}
+				if taken[id] {
+					continue
+				}
+				ruleID := rule.ID
+				if err := tx.Create(&models.FeaturedAgent{Slot: slot, AgentID: id, Position: position, RuleID: &ruleID}).Error; err != nil {
+					return err
+				}
+				taken[id] = true
+				position++
+				placed++
+			}
+
+			if err := tx.Model(&models.CurationRule{}).Where("id = ?", rule.ID).Updates(map[string]interface{}{
+				"last_run_at":  now,
+				"last_matched": placed,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,275 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// ratesTimeout bounds a request to the exchange rate source
+const ratesTimeout = 30 * time.Second
+
+var (
+	// ErrUnsupportedCurrency is returned for currencies that are not
+	// supported, or were disabled
+	ErrUnsupportedCurrency = errors.New("unsupported currency")
+	// ErrRatesUnavailable is returned when there is no recent exchange rate
+	// for a currency
+	ErrRatesUnavailable = errors.New("exchange rates are unavailable")
+)
+
+// CurrencyService keeps the supported currencies and their exchange rates,
+// which are synced daily from the configured source and used to show
+// prices in the buyer's currency
+type CurrencyService struct {
+	db     *gorm.DB
+	cfg    config.CurrenciesConfig
+	client *http.Client
+}
+
+// NewCurrencyService creates a new currency service
+func NewCurrencyService(db *gorm.DB, cfg config.CurrenciesConfig) *CurrencyService {
+	return &CurrencyService{db: db, cfg: cfg, client: &http.Client{Timeout: ratesTimeout}}
+}
+
+// Supported returns ErrUnsupportedCurrency unless a currency is enabled
+func (s *CurrencyService) Supported(code string) error {
+	var count int64
+	if err := s.db.Model(&models.Currency{}).
+		Where("code = ? AND enabled = ?", models.NormalizeCurrency(code), true).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrUnsupportedCurrency
+	}
+	return nil
+}
+
+// GetCurrencies lists the enabled currencies, or all of them
+func (s *CurrencyService) GetCurrencies(all bool) ([]models.Currency, error) {
+	query := s.db.Order("code")
+	if !all {
+		query = query.Where("enabled = ?", true)
+	}
+	var currencies []models.Currency
+	if err := query.Find(&currencies).Error; err != nil {
+		return nil, err
+	}
+	return currencies, nil
+}
+
+// GetRates returns the exchange rates, relative to the base currency
+func (s *CurrencyService) GetRates() ([]models.ExchangeRate, error) {
+	var rates []models.ExchangeRate
+	if err := s.db.Order("currency").Find(&rates).Error; err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// SetCurrency adds a currency or changes its name and whether publishers
+// can price in it. Disabling a currency leaves agents already priced in it
+// alone. The base currency cannot be disabled.
+func (s *CurrencyService) SetCurrency(code, name string, enabled bool) (*models.Currency, error) {
+	code = models.NormalizeCurrency(code)
+	if len(code) != 3 || (!enabled && strings.EqualFold(code, s.cfg.Base)) {
+		return nil, ErrUnsupportedCurrency
+	}
+	if name == "" {
+		name = code
+	}
+
+	currency := &models.Currency{Code: code, Name: name, Enabled: enabled}
+	if err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "code"}},
+		DoUpdates: clause.AssignmentColumns([]string{"name", "enabled", "updated_at"}),
+	}).Create(currency).Error; err != nil {
+		return nil, err
+	}
+	return currency, nil
+}
+
+// Run syncs exchange rates every sync interval until ctx is done. Rates
+// older than the interval are synced right away.
+func (s *CurrencyService) Run(ctx context.Context) {
+	var latest models.ExchangeRate
+	err := s.db.Order("fetched_at DESC").First(&latest).Error
+	if err != nil || time.Since(latest.FetchedAt) >= s.cfg.SyncInterval {
+		s.sync(ctx)
+	}
+
+	ticker := time.NewTicker(s.cfg.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sync(ctx)
+		}
+	}
+}
+
+func (s *CurrencyService) sync(ctx context.Context) {
+	synced, err := s.SyncRates(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sync exchange rates")
+		return
+	}
+	log.Info().Int("rates", synced).Msg("Synced exchange rates")
+}
+
+// SyncRates fetches the exchange rates from the configured source and
+// returns how many it stored
+func (s *CurrencyService) SyncRates(ctx context.Context) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.cfg.RatesURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("exchange rates: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var body struct {
+		Base  string                 `json:"base"`
+		Rates map[string]json.Number `json:"rates"`
+	}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return 0, fmt.Errorf("exchange rates: %w", err)
+	}
+	base := models.NormalizeCurrency(s.cfg.Base)
+	if models.NormalizeCurrency(body.Base) != base {
+		return 0, fmt.Errorf("exchange rates are relative to %s, not %s", body.Base, base)
+	}
+
+	now := time.Now().UTC()
+	rates := []models.ExchangeRate{{Currency: base, Rate: "1", FetchedAt: now}}
+	for code, value := range body.Rates {
+		code = models.NormalizeCurrency(code)
+		rate, ok := new(big.Rat).SetString(value.String())
+		if len(code) != 3 || code == base || !ok || rate.Sign() <= 0 {
+			continue
+		}
+		rates = append(rates, models.ExchangeRate{Currency: code, Rate: value.String(), FetchedAt: now})
+	}
+
+	if err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "currency"}},
+		DoUpdates: clause.AssignmentColumns([]string{"rate", "fetched_at"}),
+	}).Create(&rates).Error; err != nil {
+		return 0, err
+	}
+	return len(rates), nil
+}
+
+// CurrencyConverter converts prices to one currency with the exchange rates
+// of the time it was created
+type CurrencyConverter struct {
+	target  string
+	rates   map[string]*big.Rat
+	ratesAt time.Time
+}
+
+// Converter returns a converter to a currency. It fails with
+// ErrUnsupportedCurrency if the currency is not enabled, and with
+// ErrRatesUnavailable if its rate is older than the maximum rate age.
+func (s *CurrencyService) Converter(target string) (*CurrencyConverter, error) {
+	target = models.NormalizeCurrency(target)
+	if err := s.Supported(target); err != nil {
+		return nil, err
+	}
+
+	var stored []models.ExchangeRate
+	if err := s.db.Where("fetched_at >= ?", time.Now().Add(-s.cfg.MaxRateAge)).Find(&stored).Error; err != nil {
+		return nil, err
+	}
+	converter := &CurrencyConverter{target: target, rates: make(map[string]*big.Rat, len(stored)+1)}
+	for _, rate := range stored {
+		value, ok := new(big.Rat).SetString(rate.Rate)
+		if !ok || value.Sign() <= 0 {
+			continue
+		}
+		converter.rates[rate.Currency] = value
+		if converter.ratesAt.IsZero() || rate.FetchedAt.Before(converter.ratesAt) {
+			converter.ratesAt = rate.FetchedAt
+		}
+	}
+	// The base currency converts to itself whether synced or not
+	base := models.NormalizeCurrency(s.cfg.Base)
+	if _, ok := converter.rates[base]; !ok {
+		converter.rates[base] = big.NewRat(1, 1)
+	}
+	if converter.ratesAt.IsZero() {
+		converter.ratesAt = time.Now().UTC()
+	}
+	if _, ok := converter.rates[target]; !ok {
+		return nil, ErrRatesUnavailable
+	}
+	return converter, nil
+}
+
+// Convert converts an amount in minor units of a currency, rounding half
+// away from zero to the target's minor unit. It returns nil when there is
+// no recent rate for the currency.
+func (c *CurrencyConverter) Convert(amount models.Money, currency string) *models.DisplayPrice {
+	currency = models.NormalizeCurrency(currency)
+	from, ok := c.rates[currency]
+	if !ok {
+		return nil
+	}
+
+	value := new(big.Rat).SetFrac(big.NewInt(int64(amount)), pow10(models.CurrencyExponent(currency)))
+	value.Quo(value, from)
+	value.Mul(value, c.rates[c.target])
+	value.Mul(value, new(big.Rat).SetInt(pow10(models.CurrencyExponent(c.target))))
+
+	converted := models.Money(roundRat(value))
+	return &models.DisplayPrice{
+		Amount:        converted,
+		AmountDisplay: models.FormatMoney(converted, c.target),
+		Currency:      c.target,
+		RatesAt:       c.ratesAt,
+	}
+}
+
+// pow10 returns 10^exp
+func pow10(exp int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil)
+}
+
+// roundRat rounds a rational to the nearest integer, halves away from zero
+func roundRat(r *big.Rat) int64 {
+	num := new(big.Int).Abs(r.Num())
+	den := r.Denom()
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Mul(rem, big.NewInt(2)).Cmp(den) >= 0 {
+		quo.Add(quo, big.NewInt(1))
+	}
+	if r.Sign() < 0 {
+		quo.Neg(quo)
+	}
+	return quo.Int64()
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+const (
+	// dashboardWindow is how far back "recent" dashboard figures look
+	dashboardWindow = 30 * 24 * time.Hour
+	// maxDashboardUpdates bounds the agents listed with updates available
+	maxDashboardUpdates = 20
+)
+
+// BuyerDashboard summarizes what a user bought and runs
+type BuyerDashboard struct {
+	Entitlements        int64         `json:"entitlements"` // agents bought by the user or their organizations
+	ActiveSubscriptions int64         `json:"active_subscriptions"`
+	ActiveDeployments   int64         `json:"active_deployments"`
+	OpenRefunds         int64         `json:"open_refunds"`
+	UpdatesAvailable    []AgentUpdate `json:"updates_available"`
+}
+
+// AgentUpdate is an agent with active deployments pinned on an older
+// release than its current version
+type AgentUpdate struct {
+	AgentID        uuid.UUID `json:"agent_id"`
+	Name           string    `json:"name"`
+	CurrentVersion string    `json:"current_version"`
+	Deployments    int64     `json:"deployments"`
+}
+
+// PublisherDashboard summarizes a publisher's recent sales and reviews and
+// the submissions they are waiting on
+type PublisherDashboard struct {
+	PublishedAgents    int64        `json:"published_agents"`
+	Sales              []SalesTotal `json:"sales"` // within the last 30 days
+	Reviews            int64        `json:"reviews"`
+	NewReviews         int64        `json:"new_reviews"` // within the last 30 days
+	AverageRating      float64      `json:"average_rating"`
+	PendingSubmissions int64        `json:"pending_submissions"` // agents awaiting approval
+	PendingScans       int64        `json:"pending_scans"`       // releases whose binary is not scanned yet
+}
+
+// SalesTotal is the completed purchases in one currency
+type SalesTotal struct {
+	Currency      string       `json:"currency"`
+	Purchases     int64        `json:"purchases"`
+	Amount        models.Money `json:"amount_minor"`
+	AmountDisplay string       `json:"amount"`
+}
+
+// AdminDashboard is the depth of each moderation queue
+type AdminDashboard struct {
+	PendingAgents                int64 `json:"pending_agents"`
+	PendingPublisherApplications int64 `json:"pending_publisher_applications"`
+	PendingRefunds               int64 `json:"pending_refunds"`
+	PendingFraudReviews          int64 `json:"pending_fraud_reviews"`
+	PendingScans                 int64 `json:"pending_scans"`
+	FailedWebhookDeliveries      int64 `json:"failed_webhook_deliveries"` // within the last 30 days
+}
+
+// DashboardService computes the summaries shown on each persona's
+// dashboard, so a frontend needs one request instead of a dozen
+type DashboardService struct {
+	db *gorm.DB
+}
+
+// NewDashboardService creates a new dashboard service
+func NewDashboardService(db *gorm.DB) *DashboardService {
+	return &DashboardService{db: db}
+}
+
+// countAll counts each query into its destination, stopping at the first
+// error
+func countAll(queries map[*int64]*gorm.DB) error {
+	for dest, query := range queries {
+		if err := query.Count(dest).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Buyer returns a user's buyer dashboard
+func (s *DashboardService) Buyer(userID uuid.UUID) (*BuyerDashboard, error) {
+	dashboard := &BuyerDashboard{}
+	if err := countAll(map[*int64]*gorm.DB{
+		&dashboard.Entitlements: ownedBy(s.db, s.db.Model(&models.Purchase{}), userID).
+			Where("status = ?", models.PurchaseStatusCompleted).Distinct("agent_id"),
+		&dashboard.ActiveSubscriptions: s.db.Model(&models.Subscription{}).
+			Where("buyer_id = ? AND status IN ?", userID, entitlingSubscriptions),
+		&dashboard.ActiveDeployments: s.db.Model(&models.Deployment{}).
+			Where("buyer_id = ? AND decommissioned_at IS NULL", userID),
+		&dashboard.OpenRefunds: s.db.Model(&models.RefundRequest{}).
+			Where("buyer_id = ? AND status IN ?", userID, []models.RefundStatus{models.RefundStatusPending, models.RefundStatusProcessing}),
+	}); err != nil {
+		return nil, err
+	}
+
+	dashboard.UpdatesAvailable = []AgentUpdate{}
+	if err := s.db.Table("deployments").
+		Select("agents.id AS agent_id, agents.name, agents.version AS current_version, COUNT(*) AS deployments").
+		Joins("JOIN agents ON agents.id = deployments.agent_id AND agents.deleted_at IS NULL").
+		Where("deployments.buyer_id = ? AND deployments.decommissioned_at IS NULL", userID).
+		Where("deployments.version <> '' AND deployments.version <> agents.version").
+		Group("agents.id, agents.name, agents.version").
+		Order("agents.name").
+		Limit(maxDashboardUpdates).
+		Scan(&dashboard.UpdatesAvailable).Error; err != nil {
+		return nil, err
+	}
+	return dashboard, nil
+}
+
+// Publisher returns a publisher's dashboard, over the agents they publish
+func (s *DashboardService) Publisher(publisherID uuid.UUID) (*PublisherDashboard, error) {
+	since := time.Now().Add(-dashboardWindow)
+	agents := s.db.Model(&models.Agent{}).Select("id").Where("publisher_id = ?", publisherID)
+
+	dashboard := &PublisherDashboard{}
+	if err := countAll(map[*int64]*gorm.DB{
+		&dashboard.PublishedAgents: s.db.Model(&models.Agent{}).
+			Where("publisher_id = ? AND status = ?", publisherID, models.AgentStatusPublished),
+		&dashboard.Reviews: s.db.Model(&models.Review{}).Where("agent_id IN (?)", agents),
+		&dashboard.NewReviews: s.db.Model(&models.Review{}).
+			Where("agent_id IN (?) AND created_at >= ?", agents, since),
+		&dashboard.PendingSubmissions: s.db.Model(&models.Agent{}).
+			Where("publisher_id = ? AND status = ?", publisherID, models.AgentStatusPending),
+		&dashboard.PendingScans: s.db.Model(&models.AgentVersion{}).
+			Where("agent_id IN (?) AND scan_status = ? AND binary_url <> ''", agents, models.ScanStatusPending),
+	}); err != nil {
+		return nil, err
+	}
+
+	var rating struct{ Average float64 }
+	if err := s.db.Model(&models.Review{}).
+		Select("COALESCE(AVG(rating), 0) AS average").
+		Where("agent_id IN (?)", agents).
+		Scan(&rating).Error; err != nil {
+		return nil, err
+	}
+	dashboard.AverageRating = rating.Average
+
+	dashboard.Sales = []SalesTotal{}
+	if err := s.db.Model(&models.Purchase{}).
+		Select("currency, COUNT(*) AS purchases, COALESCE(SUM(amount_minor), 0) AS amount").
+		Where("agent_id IN (?) AND status = ? AND created_at >= ?", agents, models.PurchaseStatusCompleted, since).
+		Group("currency").
+		Order("currency").
+		Scan(&dashboard.Sales).Error; err != nil {
+		return nil, err
+	}
+	for i := range dashboard.Sales {
+		dashboard.Sales[i].AmountDisplay = models.FormatMoney(dashboard.Sales[i].Amount, dashboard.Sales[i].Currency)
+	}
+	return dashboard, nil
+}
+
+// Admin returns the admin dashboard
+func (s *DashboardService) Admin() (*AdminDashboard, error) {
+	dashboard := &AdminDashboard{}
+	if err := countAll(map[*int64]*gorm.DB{
+		&dashboard.PendingAgents: s.db.Model(&models.Agent{}).
+			Where("status = ?", models.AgentStatusPending),
+		&dashboard.PendingPublisherApplications: s.db.Model(&models.PublisherApplication{}).
+			Where("status = ?", models.PublisherApplicationStatusPending),
+		&dashboard.PendingRefunds: s.db.Model(&models.RefundRequest{}).
+			Where("status = ?", models.RefundStatusPending),
+		&dashboard.PendingFraudReviews: s.db.Model(&models.FraudAssessment{}).
+			Where("review_status = ?", models.FraudReviewStatusPending),
+		&dashboard.PendingScans: s.db.Model(&models.AgentVersion{}).
+			Where("scan_status = ? AND binary_url <> ''", models.ScanStatusPending),
+		&dashboard.FailedWebhookDeliveries: s.db.Model(&models.WebhookDelivery{}).
+			Where("status = ? AND created_at >= ?", models.WebhookDeliveryStatusFailed, time.Now().Add(-dashboardWindow)),
+	}); err != nil {
+		return nil, err
+	}
+	return dashboard, nil
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// TokenDenylist records revoked access tokens in Redis until they would
+// have expired anyway
+type TokenDenylist struct {
+	redis     *RedisService
+	accessTTL time.Duration
+}
+
+// NewTokenDenylist creates a denylist for access tokens living accessTTL
+func NewTokenDenylist(redisSvc *RedisService, accessTTL time.Duration) *TokenDenylist {
+	return &TokenDenylist{redis: redisSvc, accessTTL: accessTTL}
+}
+
+// Revoke denies one access token for the rest of its lifetime
+func (d *TokenDenylist) Revoke(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if ttl <= 0 {
+		return nil
+	}
+	return d.redis.Degrade(d.redis.Client().Set(ctx, "jwt:revoked:"+claims.ID, 1, ttl).Err())
+}
+
+// RevokeUser denies every access token issued to a user until now
+func (d *TokenDenylist) RevokeUser(ctx context.Context, userID uuid.UUID) error {
+	cutoff := strconv.FormatInt(time.Now().Unix(), 10)
+	return d.redis.Degrade(d.redis.Client().Set(ctx, "jwt:revoked_before:"+userID.String(), cutoff, d.accessTTL).Err())
+}
+
+// IsRevoked reports whether an access token was revoked. When Redis is
+// unavailable, the failure policy decides.
+func (d *TokenDenylist) IsRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	client := d.redis.Client()
+
+	if claims.ID != "" {
+		n, err := client.Exists(ctx, "jwt:revoked:"+claims.ID).Result()
+		if err != nil {
+			return false, d.redis.Degrade(err)
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+
+	cutoff, err := client.Get(ctx, "jwt:revoked_before:"+claims.UserID.String()).Int64()
+	switch {
+	case err == redis.Nil:
+		return false, nil
+	case err != nil:
+		return false, d.redis.Degrade(err)
+	}
+	return claims.IssuedAt == nil || claims.IssuedAt.Unix() < cutoff, nil
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// maxBudgetCandidates caps the number of agents in one budget check
+const maxBudgetCandidates = 32
+
+var (
+	// ErrInvalidCandidates is returned for a budget check with unknown or unpublished agents
+	ErrInvalidCandidates = errors.New("invalid candidate agents")
+)
+
+// DeviceService keeps the resources reported by users' devices and checks
+// whether agents fit on them
+type DeviceService struct {
+	db *gorm.DB
+}
+
+// NewDeviceService creates a new device service
+func NewDeviceService(db *gorm.DB) *DeviceService {
+	return &DeviceService{db: db}
+}
+
+// BudgetCandidate is an agent release considered for a device. The version
+// defaults to the agent's current version.
+type BudgetCandidate struct {
+	AgentID uuid.UUID `json:"agent_id" binding:"required"`
+	Version string    `json:"version"`
+}
+
+// ResourceUsage is the resources needed by one or more agents against a
+// device's free resources. Headroom is the percentage of the free resource
+// left over, negative when it does not fit, and nil when the device reports
+// nothing free or no latency deadline.
+type ResourceUsage struct {
+	FlashSize       int      `json:"flash_size"`
+	SRAMSize        int      `json:"sram_size"`
+	Latency         int      `json:"latency"`
+	FlashHeadroom   *float64 `json:"flash_headroom_pct"`
+	SRAMHeadroom    *float64 `json:"sram_headroom_pct"`
+	LatencyHeadroom *float64 `json:"latency_headroom_pct"`
+	Fits            bool     `json:"fits"`
+}
+
+// AgentBudget is one candidate's resource use on its own
+type AgentBudget struct {
+	AgentID uuid.UUID `json:"agent_id"`
+	Name    string    `json:"name"`
+	Version string    `json:"version"`
+	ResourceUsage
+}
+
+// BudgetCheck is the feasibility of a set of candidate agents on a device.
+// The candidates run side by side, so every requirement adds up.
+type BudgetCheck struct {
+	Device    models.DeviceResources `json:"device"`
+	Agents    []AgentBudget          `json:"agents"`
+	Aggregate ResourceUsage          `json:"aggregate"`
+}
+
+// ReportResources records the free resources of a device, replacing its
+// previous report
+func (s *DeviceService) ReportResources(resources *models.DeviceResources) error {
+	resources.ReportedAt = time.Now()
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "owner_id"}, {Name: "device_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"flash_free", "sram_free", "latency_budget", "reported_at"}),
+	}).Create(resources).Error
+}
+
+// GetResources returns the latest resource report of a device
+func (s *DeviceService) GetResources(ownerID uuid.UUID, deviceID string) (*models.DeviceResources, error) {
+	var resources models.DeviceResources
+	if err := s.db.First(&resources, "owner_id = ? AND device_id = ?", ownerID, deviceID).Error; err != nil {
+		return nil, err
+	}
+	return &resources, nil
+}
+
+// CheckBudget sums the requirements of the candidate agents against the
+// device's reported free resources
+func (s *DeviceService) CheckBudget(ownerID uuid.UUID, deviceID string, candidates []BudgetCandidate) (*BudgetCheck, error) {
+	if len(candidates) == 0 || len(candidates) > maxBudgetCandidates {
+		return nil, fmt.Errorf("%w: between 1 and %d agents can be checked", ErrInvalidCandidates, maxBudgetCandidates)
+	}
+
+	device, err := s.GetResources(ownerID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	check := BudgetCheck{Device: *device}
+	for i, candidate := range candidates {
+		var agent models.Agent
+		if err := s.db.Where("status = ?", models.AgentStatusPublished).First(&agent, "id = ?", candidate.AgentID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, fmt.Errorf("%w: agents[%d] is not a published agent", ErrInvalidCandidates, i)
+			}
+			return nil, err
+		}
+		version := candidate.Version
+		if version == "" {
+			version = agent.Version
+		}
+		var release models.AgentVersion
+		if err := s.db.Where("agent_id = ? AND version = ? AND status = ?", agent.ID, version, models.AgentVersionStatusPublished).
+			First(&release).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, fmt.Errorf("%w: version %s of agent %s is not available", ErrInvalidCandidates, version, agent.Name)
+			}
+			return nil, err
+		}
+
+		check.Agents = append(check.Agents, AgentBudget{
+			AgentID:       agent.ID,
+			Name:          agent.Name,
+			Version:       release.Version,
+			ResourceUsage: resourceUsage(device, release.FlashSize, release.SRAMSize, release.MaxLatency),
+		})
+		check.Aggregate.FlashSize += release.FlashSize
+		check.Aggregate.SRAMSize += release.SRAMSize
+		check.Aggregate.Latency += release.MaxLatency
+	}
+	check.Aggregate = resourceUsage(device, check.Aggregate.FlashSize, check.Aggregate.SRAMSize, check.Aggregate.Latency)
+	return &check, nil
+}
+
+// resourceUsage computes the headroom left on a device by the given requirements
+func resourceUsage(d *models.DeviceResources, flash, sram, latency int) ResourceUsage {
+	u := ResourceUsage{FlashSize: flash, SRAMSize: sram, Latency: latency}
+	u.FlashHeadroom = headroom(flash, d.FlashFree)
+	u.SRAMHeadroom = headroom(sram, d.SRAMFree)
+	if d.LatencyBudget > 0 {
+		u.LatencyHeadroom = headroom(latency, d.LatencyBudget)
+	}
+	u.Fits = flash <= d.FlashFree && sram <= d.SRAMFree && (d.LatencyBudget == 0 || latency <= d.LatencyBudget)
+	return u
+}
+
+// headroom returns the percentage of available left after used, or nil if
+// nothing is available to compare against
+func headroom(used, available int) *float64 {
+	if available <= 0 {
+		return nil
+	}
+	pct := math.Round(float64(available-used)*1000/float64(available)) / 10
+	return &pct
+}
@@ -0,0 +1,377 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// certBackdate covers devices whose clock runs a little behind ours
+const certBackdate = 5 * time.Minute
+
+var (
+	// ErrDeviceAPIDisabled is returned when the device API is not configured
+	ErrDeviceAPIDisabled = errors.New("the device API is not enabled")
+	// ErrInvalidCSR is returned for a certificate signing request that does
+	// not parse, is not self-signed or has a weak key
+	ErrInvalidCSR = errors.New("certificate signing request must be a PEM CSR with an ECDSA, Ed25519 or 2048-bit RSA key")
+	// ErrNoDeviceCert is returned for a device API request without a client
+	// certificate
+	ErrNoDeviceCert = errors.New("client certificate required")
+	// ErrInvalidDeviceCert is returned for a client certificate that was not
+	// issued by the device CA, has expired or was revoked
+	ErrInvalidDeviceCert = errors.New("client certificate is not valid")
+)
+
+// DeviceCertService issues and verifies the client certificates devices
+// use on the device API
+type DeviceCertService struct {
+	db      *gorm.DB
+	cfg     config.DeviceAPIConfig
+	devices *DeviceService
+	ca      *x509.Certificate
+	caKey   crypto.Signer
+	roots   *x509.CertPool
+}
+
+// NewDeviceCertService loads the device CA. Without the device API enabled,
+// the service only refuses to issue certificates.
+func NewDeviceCertService(db *gorm.DB, cfg config.DeviceAPIConfig) (*DeviceCertService, error) {
+	s := &DeviceCertService{db: db, cfg: cfg, devices: NewDeviceService(db)}
+	if !cfg.Enabled {
+		return s, nil
+	}
+
+	certPEM, err := os.ReadFile(cfg.CACertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device CA certificate: %w", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("device CA certificate is not PEM encoded")
+	}
+	s.ca, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device CA certificate: %w", err)
+	}
+	if !s.ca.IsCA {
+		return nil, errors.New("device CA certificate is not a CA")
+	}
+
+	keyPEM, err := os.ReadFile(cfg.CAKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read device CA key: %w", err)
+	}
+	s.caKey, err = parseCAKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	s.roots = x509.NewCertPool()
+	s.roots.AddCert(s.ca)
+	return s, nil
+}
+
+// TLSConfig returns the TLS configuration of the device API listener.
+// Certificates are verified against the device CA when given; requests
+// without one get an error response from the API rather than a failed
+// handshake.
+func (s *DeviceCertService) TLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.cfg.ServerCertFile, s.cfg.ServerKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device API server certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    s.roots,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ProvisionCertificate issues a certificate for the public key in a CSR to
+// one of a user's devices. The device generates its key and keeps it.
+func (s *DeviceCertService) ProvisionCertificate(userID uuid.UUID, serial, csrPEM string) (*models.DeviceCertificate, error) {
+	if s.ca == nil {
+		return nil, ErrDeviceAPIDisabled
+	}
+	claim, err := s.devices.activeClaim(userID, serial)
+	if err != nil {
+		return nil, err
+	}
+	return s.issue(s.db, &claim.Device, csrPEM, nil)
+}
+
+// GetCertificates returns the certificates issued to one of a user's
+// devices, most recent first
+func (s *DeviceCertService) GetCertificates(userID uuid.UUID, serial string) ([]models.DeviceCertificate, error) {
+	claim, err := s.devices.activeClaim(userID, serial)
+	if err != nil {
+		return nil, err
+	}
+	var certs []models.DeviceCertificate
+	if err := s.db.Where("device_id = ?", claim.DeviceID).Order("created_at DESC").Find(&certs).Error; err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// RevokeCertificate revokes a certificate issued to one of a user's
+// devices. Revoking a revoked certificate is a no-op.
+func (s *DeviceCertService) RevokeCertificate(userID uuid.UUID, serial string, id uuid.UUID) (*models.DeviceCertificate, error) {
+	claim, err := s.devices.activeClaim(userID, serial)
+	if err != nil {
+		return nil, err
+	}
+	var cert models.DeviceCertificate
+	if err := s.db.First(&cert, "id = ? AND device_id = ?", id, claim.DeviceID).Error; err != nil {
+		return nil, err
+	}
+	if cert.RevokedAt == nil {
+		now := time.Now()
+		if err := s.db.Model(&cert).Where("revoked_at IS NULL").Update("revoked_at", now).Error; err != nil {
+			return nil, err
+		}
+		cert.RevokedAt = &now
+	}
+	return &cert, nil
+}
+
+// RotateCertificate issues a device a new certificate replacing the one it
+// authenticated with. The current certificate keeps working until the new
+// one is first used, so a device that misses the response can rotate again;
+// earlier unused replacements are revoked when it does.
+func (s *DeviceCertService) RotateCertificate(current *models.DeviceCertificate, csrPEM string) (*models.DeviceCertificate, error) {
+	if s.ca == nil {
+		return nil, ErrDeviceAPIDisabled
+	}
+	var cert *models.DeviceCertificate
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.DeviceCertificate{}).
+			Where("replaces = ? AND first_used_at IS NULL AND revoked_at IS NULL", current.ID).
+			Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+		issued, err := s.issue(tx, &current.Device, csrPEM, &current.ID)
+		cert = issued
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// ClientCertificate returns the client certificate of a device API
+// request: the one presented in the TLS handshake or, on plain requests
+// from a TLS-terminating proxy, the one it forwards in the configured
+// header
+func (s *DeviceCertService) ClientCertificate(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS != nil {
+		if len(r.TLS.PeerCertificates) == 0 {
+			return nil, ErrNoDeviceCert
+		}
+		return r.TLS.PeerCertificates[0], nil
+	}
+	if s.cfg.ClientCertHeader == "" {
+		return nil, ErrNoDeviceCert
+	}
+	value := r.Header.Get(s.cfg.ClientCertHeader)
+	if value == "" {
+		return nil, ErrNoDeviceCert
+	}
+	certPEM, err := url.QueryUnescape(value)
+	if err != nil {
+		return nil, ErrInvalidDeviceCert
+	}
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, ErrInvalidDeviceCert
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, ErrInvalidDeviceCert
+	}
+	return cert, nil
+}
+
+// Authenticate checks that a client certificate was issued by the device CA
+// and has not been revoked, and returns its record with the device. The
+// first use of a rotated certificate revokes the one it replaces.
+func (s *DeviceCertService) Authenticate(cert *x509.Certificate) (*models.DeviceCertificate, error) {
+	if s.ca == nil {
+		return nil, ErrDeviceAPIDisabled
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:     s.roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, ErrInvalidDeviceCert
+	}
+
+	var record models.DeviceCertificate
+	if err := s.db.Preload("Device").
+		First(&record, "fingerprint = ? AND revoked_at IS NULL", certFingerprint(cert.Raw)).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidDeviceCert
+		}
+		return nil, err
+	}
+
+	if record.FirstUsedAt == nil {
+		now := time.Now()
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&record).Where("first_used_at IS NULL").Update("first_used_at", now)
+			if result.Error != nil || result.RowsAffected == 0 || record.Replaces == nil {
+				return result.Error
+			}
+			return tx.Model(&models.DeviceCertificate{}).
+				Where("id = ? AND revoked_at IS NULL", *record.Replaces).
+				Update("revoked_at", now).Error
+		})
+		if err != nil {
+			return nil, err
+		}
+		record.FirstUsedAt = &now
+	}
+	return &record, nil
+}
+
+// Fingerprint identifies a client certificate in the certificate records
+func (s *DeviceCertService) Fingerprint(cert *x509.Certificate) string {
+	return certFingerprint(cert.Raw)
+}
+
+// Lookup returns the unrevoked certificate with a fingerprint and its
+// device, for requests authenticated while the database was down
+func (s *DeviceCertService) Lookup(fingerprint string) (*models.DeviceCertificate, error) {
+	var record models.DeviceCertificate
+	if err := s.db.Preload("Device").
+		First(&record, "fingerprint = ? AND revoked_at IS NULL", fingerprint).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidDeviceCert
+		}
+		return nil, err
+	}
+	return &record, nil
+}
+
+// RotateDue reports whether a device should rotate its certificate
+func (s *DeviceCertService) RotateDue(cert *models.DeviceCertificate) bool {
+	return time.Until(cert.NotAfter) < s.cfg.RotateBefore
+}
+
+// issue signs a CSR into a certificate for a device, named after its
+// serial, and records it
+func (s *DeviceCertService) issue(tx *gorm.DB, device *models.Device, csrPEM string, replaces *uuid.UUID) (*models.DeviceCertificate, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, ErrInvalidCSR
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil || csr.CheckSignature() != nil {
+		return nil, ErrInvalidCSR
+	}
+	switch key := csr.PublicKey.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return nil, ErrInvalidCSR
+		}
+	default:
+		return nil, ErrInvalidCSR
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(s.cfg.CertValidity)
+	if notAfter.After(s.ca.NotAfter) {
+		notAfter = s.ca.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: device.Serial},
+		NotBefore:             now.Add(-certBackdate),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := models.DeviceCertificate{
+		DeviceID:     device.ID,
+		SerialNumber: hex.EncodeToString(serialNumber.Bytes()),
+		Fingerprint:  certFingerprint(der),
+		CertPEM:      string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Replaces:     replaces,
+		NotBefore:    template.NotBefore,
+		NotAfter:     template.NotAfter,
+	}
+	if err := tx.Create(&cert).Error; err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// certFingerprint is the hex SHA-256 of a DER certificate
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseCAKey parses a PEM private key in PKCS #8, SEC 1 or PKCS #1 form
+func parseCAKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("device CA key is not PEM encoded")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported device CA key PEM type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid device CA key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("device CA key cannot sign")
+	}
+	return signer, nil
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// Actions a device is instructed to take on check-in
+const (
+	DeviceActionInstall = "install"
+	DeviceActionRemove  = "remove"
+)
+
+// ErrDeviceNotClaimed is returned when a device checks in while no user has
+// it in their fleet
+var ErrDeviceNotClaimed = errors.New("device is not claimed")
+
+// DeviceCheckInService records what devices report on the device API and
+// tells them which releases to install or remove
+type DeviceCheckInService struct {
+	db       *gorm.DB
+	devices  *DeviceService
+	metering *MeteringService
+	agents   *AgentService
+}
+
+// NewDeviceCheckInService creates a new device check-in service
+func NewDeviceCheckInService(db *gorm.DB, metering *MeteringService, agents *AgentService) *DeviceCheckInService {
+	return &DeviceCheckInService{db: db, devices: NewDeviceService(db), metering: metering, agents: agents}
+}
+
+// DeviceReport is what a device reports when checking in: the agents it
+// runs, its health and optionally its free resources
+type DeviceReport struct {
+	Agents       []AgentReport
+	HealthStatus string
+	Uptime       int64                   // in seconds
+	Resources    *models.DeviceResources // owner and device are filled in
+	ReceivedAt   time.Time               // zero for now; set when replaying the device journal
+}
+
+// AgentReport is the release of an agent a device runs, and why installing
+// another release failed if it did
+type AgentReport struct {
+	AgentID     uuid.UUID
+	Version     string
+	UpdateError string
+}
+
+// DeviceInstruction tells a device to install a deployment's pinned
+// release, with presigned download links, or to remove an agent that is no
+// longer deployed on it
+type DeviceInstruction struct {
+	Action         string               `json:"action"`
+	AgentID        uuid.UUID            `json:"agent_id"`
+	DeploymentID   *uuid.UUID           `json:"deployment_id,omitempty"`
+	Version        string               `json:"version,omitempty"`
+	BinaryURL      string               `json:"binary_url,omitempty"`
+	BinaryChecksum string               `json:"binary_checksum,omitempty"`
+	Signature      string               `json:"signature,omitempty"`
+	SigningKey     *models.PublisherKey `json:"signing_key,omitempty"`
+	ManifestURL    string               `json:"manifest_url,omitempty"`
+	TraceID        *uuid.UUID           `json:"trace_id,omitempty"`
+}
+
+// CheckIn records a device's report against its owner's deployments and
+// returns what the device should change. Reported agents count as a
+// check-in of their deployment, which also settles pending updates.
+func (s *DeviceCheckInService) CheckIn(ctx context.Context, device *models.Device, report DeviceReport) ([]DeviceInstruction, error) {
+	var claim models.DeviceClaim
+	if err := s.db.Where("device_id = ? AND released_at IS NULL", device.ID).First(&claim).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrDeviceNotClaimed
+		}
+		return nil, err
+	}
+
+	at := report.ReceivedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	// A replayed check-in must not overwrite a newer one
+	if err := s.db.Model(device).Where("last_seen_at IS NULL OR last_seen_at < ?", at).Updates(map[string]interface{}{
+		"last_seen_at":  at,
+		"health_status": report.HealthStatus,
+		"uptime":        report.Uptime,
+	}).Error; err != nil {
+		return nil, err
+	}
+	if report.Resources != nil {
+		report.Resources.OwnerID = claim.UserID
+		report.Resources.DeviceID = device.Serial
+		if err := s.devices.ReportResources(report.Resources); err != nil {
+			return nil, err
+		}
+	}
+
+	var deployments []models.Deployment
+	if err := s.db.Where("buyer_id = ? AND device_id = ? AND decommissioned_at IS NULL", claim.UserID, device.Serial).
+		Order("deployed_at").
+		Find(&deployments).Error; err != nil {
+		return nil, err
+	}
+
+	reported := make(map[uuid.UUID]AgentReport, len(report.Agents))
+	for _, agent := range report.Agents {
+		reported[agent.AgentID] = agent
+	}
+
+	instructions := []DeviceInstruction{}
+	for i := range deployments {
+		deployment := &deployments[i]
+		agent, ok := reported[deployment.AgentID]
+		if ok {
+			delete(reported, deployment.AgentID)
+			err := s.metering.RecordCheckIn(claim.UserID, deployment.ID, CheckInReport{Version: agent.Version, UpdateError: agent.UpdateError, ReceivedAt: report.ReceivedAt})
+			// Decommissioned since it was loaded; the next check-in removes it
+			if err != nil && err != ErrDecommissioned {
+				return nil, err
+			}
+		}
+		if agent.Version == deployment.Version {
+			continue
+		}
+		instruction, err := s.install(ctx, deployment)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, *instruction)
+	}
+
+	// Whatever else the device runs is no longer deployed on it
+	for _, agent := range report.Agents {
+		if _, ok := reported[agent.AgentID]; ok {
+			delete(reported, agent.AgentID)
+			instructions = append(instructions, DeviceInstruction{Action: DeviceActionRemove, AgentID: agent.AgentID})
+		}
+	}
+	return instructions, nil
+}
+
+// install returns the instruction to install a deployment's pinned release
+func (s *DeviceCheckInService) install(ctx context.Context, deployment *models.Deployment) (*DeviceInstruction, error) {
+	release, err := s.agents.GetVersion(deployment.AgentID, deployment.Version)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.agents.GetReleaseFiles(ctx, release)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceInstruction{
+		Action:         DeviceActionInstall,
+		AgentID:        deployment.AgentID,
+		DeploymentID:   &deployment.ID,
+		Version:        release.Version,
+		BinaryURL:      files.BinaryURL,
+		BinaryChecksum: release.BinaryChecksum,
+		Signature:      release.BinarySignature,
+		SigningKey:     release.SigningKey,
+		ManifestURL:    files.ManifestURL,
+		TraceID:        &deployment.TraceID,
+	}, nil
+}
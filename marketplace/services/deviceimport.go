@@ -0,0 +1,446 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+const (
+	// maxDeviceFieldLength caps the MCU, site, fleet and name of an imported
+	// device
+	maxDeviceFieldLength = 100
+	// importProgressRows is how often an import records its progress, which
+	// is also when it notices being canceled
+	importProgressRows = 100
+)
+
+var (
+	// ErrImportTooLarge is returned for a file over the configured size or
+	// row limit
+	ErrImportTooLarge = errors.New("import file has too many bytes or rows")
+	// ErrInvalidImportHeader is returned for a file whose first row is not a
+	// header with a hardware_id column
+	ErrInvalidImportHeader = errors.New("first row must be a header with a hardware_id column, and optionally mcu, site, fleet, name and claim_code")
+
+	errDeviceFieldTooLong = fmt.Errorf("mcu, site, fleet and name must be at most %d characters", maxDeviceFieldLength)
+)
+
+// importColumns maps accepted header names to columns
+var importColumns = map[string]string{
+	"hardware_id": "hardware_id",
+	"serial":      "hardware_id",
+	"mcu":         "mcu",
+	"site":        "site",
+	"fleet":       "fleet",
+	"group":       "fleet",
+	"name":        "name",
+	"claim_code":  "claim_code",
+}
+
+// importOutcome is what importing a row did to the user's fleet
+type importOutcome int
+
+const (
+	importCreated importOutcome = iota
+	importUpdated
+	importUnchanged
+)
+
+// DeviceImportService adds devices to users' fleets from CSV files. Files
+// are checked and stored when uploaded and imported by a background
+// worker. Each row is matched on its hardware ID, so importing a file again
+// only applies what changed.
+type DeviceImportService struct {
+	db  *gorm.DB
+	cfg config.DeviceImportsConfig
+}
+
+// NewDeviceImportService creates a new device import service
+func NewDeviceImportService(db *gorm.DB, cfg config.DeviceImportsConfig) *DeviceImportService {
+	return &DeviceImportService{db: db, cfg: cfg}
+}
+
+// CreateImport checks the header and size of a CSV file and queues it for
+// import. If the same file is already queued for the user, that import is
+// returned instead.
+func (s *DeviceImportService) CreateImport(userID uuid.UUID, filename string, r io.Reader) (*models.DeviceImport, error) {
+	data, err := io.ReadAll(io.LimitReader(r, s.cfg.MaxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.cfg.MaxFileSize {
+		return nil, ErrImportTooLarge
+	}
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, ErrInvalidImportHeader
+	}
+	if _, err := importHeader(header); err != nil {
+		return nil, err
+	}
+	rows := 0
+	for {
+		if _, err := reader.Read(); err != nil {
+			// Malformed rows are reported per row when processing
+			if err == io.EOF {
+				break
+			}
+		}
+		rows++
+		if rows > s.cfg.MaxRows {
+			return nil, ErrImportTooLarge
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	var queued models.DeviceImport
+	err = s.db.Where("user_id = ? AND checksum = ? AND status IN ?", userID, checksum,
+		[]models.DeviceImportStatus{models.DeviceImportStatusPending, models.DeviceImportStatusProcessing}).
+		First(&queued).Error
+	if err == nil {
+		return &queued, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	imp := models.DeviceImport{
+		UserID:   userID,
+		Filename: filename,
+		Checksum: checksum,
+		Data:     string(data),
+		Status:   models.DeviceImportStatusPending,
+		Rows:     rows,
+	}
+	if err := s.db.Create(&imp).Error; err != nil {
+		return nil, err
+	}
+	return &imp, nil
+}
+
+// GetImport returns one of a user's imports
+func (s *DeviceImportService) GetImport(userID, id uuid.UUID) (*models.DeviceImport, error) {
+	var imp models.DeviceImport
+	if err := s.db.Where("id = ? AND user_id = ?", id, userID).First(&imp).Error; err != nil {
+		return nil, err
+	}
+	return &imp, nil
+}
+
+// CancelImport stops one of a user's imports. A pending import is never
+// started; one being processed stops within importProgressRows rows and
+// keeps the devices already imported.
+func (s *DeviceImportService) CancelImport(userID, id uuid.UUID) error {
+	result := s.db.Model(&models.DeviceImport{}).
+		Where("id = ? AND user_id = ? AND status IN ?", id, userID,
+			[]models.DeviceImportStatus{models.DeviceImportStatusPending, models.DeviceImportStatusProcessing}).
+		Updates(map[string]interface{}{"status": models.DeviceImportStatusCanceled, "data": "", "completed_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrOperationDone
+	}
+	return nil
+}
+
+// Run imports queued files every poll interval until ctx is done
+func (s *DeviceImportService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.ProcessPending(); err != nil {
+				log.Error().Err(err).Msg("Failed to process device imports")
+			}
+		}
+	}
+}
+
+// ProcessPending imports every queued file, and those whose processing was
+// interrupted
+func (s *DeviceImportService) ProcessPending() error {
+	var ids []uuid.UUID
+	if err := s.db.Model(&models.DeviceImport{}).
+		Where("status = ? OR (status = ? AND started_at < ?)", models.DeviceImportStatusPending,
+			models.DeviceImportStatusProcessing, time.Now().Add(-s.cfg.RequeueAfter)).
+		Order("created_at").
+		Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := s.process(id); err != nil {
+			log.Error().Err(err).Str("import_id", id.String()).Msg("Failed to process device import")
+		}
+	}
+	return nil
+}
+
+// process claims an import and imports its rows. Rows are idempotent, so an
+// import interrupted half way is simply run again from the start.
+func (s *DeviceImportService) process(id uuid.UUID) error {
+	var imp models.DeviceImport
+	if err := s.db.First(&imp, "id = ?", id).Error; err != nil {
+		return err
+	}
+	if imp.Status != models.DeviceImportStatusPending && imp.Status != models.DeviceImportStatusProcessing {
+		return nil
+	}
+	now := time.Now()
+	claim := s.db.Model(&models.DeviceImport{}).Where("id = ? AND status = ?", id, imp.Status)
+	if imp.StartedAt != nil {
+		claim = claim.Where("started_at = ?", *imp.StartedAt)
+	}
+	result := claim.Updates(map[string]interface{}{"status": models.DeviceImportStatusProcessing, "started_at": now})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+
+	done := map[string]interface{}{
+		"status": models.DeviceImportStatusCompleted,
+		"data":   "",
+	}
+	reader := csv.NewReader(strings.NewReader(imp.Data))
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	var columns map[string]int
+	if err == nil {
+		columns, err = importHeader(header)
+	}
+	if err != nil {
+		done["status"] = models.DeviceImportStatusFailed
+		done["error"] = ErrInvalidImportHeader.Error()
+		done["completed_at"] = time.Now()
+		return s.db.Model(&imp).Updates(done).Error
+	}
+
+	var created, updated, unchanged int
+	var rowErrors models.DeviceImportErrors
+	canceled := false
+	for row := 1; ; row++ {
+		if row%importProgressRows == 0 {
+			result := s.db.Model(&models.DeviceImport{}).
+				Where("id = ? AND status = ?", imp.ID, models.DeviceImportStatusProcessing).
+				Update("processed", row-1)
+			if result.Error != nil {
+				return result.Error
+			}
+			if canceled = result.RowsAffected == 0; canceled {
+				break
+			}
+		}
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		field := func(column string) (string, bool) {
+			i, ok := columns[column]
+			if !ok || i >= len(record) {
+				return "", ok
+			}
+			return strings.TrimSpace(record[i]), true
+		}
+		hardwareID, _ := field("hardware_id")
+		if err != nil {
+			rowErrors = append(rowErrors, models.DeviceImportError{Row: row, HardwareID: hardwareID, Error: "malformed CSV row"})
+			continue
+		}
+
+		outcome, err := s.importRow(imp.UserID, field)
+		switch err {
+		case nil:
+		case ErrInvalidSerial, ErrInvalidClaim, ErrDeviceClaimed, errDeviceFieldTooLong:
+			rowErrors = append(rowErrors, models.DeviceImportError{Row: row, HardwareID: hardwareID, Error: err.Error()})
+			continue
+		default:
+			return err
+		}
+		switch outcome {
+		case importCreated:
+			created++
+		case importUpdated:
+			updated++
+		default:
+			unchanged++
+		}
+	}
+
+	done["processed"] = created + updated + unchanged + len(rowErrors)
+	done["created"] = created
+	done["updated"] = updated
+	done["unchanged"] = unchanged
+	done["failed"] = len(rowErrors)
+	done["errors"] = rowErrors
+	done["completed_at"] = time.Now()
+	if !canceled {
+		result := s.db.Model(&imp).Where("status = ?", models.DeviceImportStatusProcessing).Updates(done)
+		if result.Error != nil {
+			return result.Error
+		}
+		canceled = result.RowsAffected == 0
+		if !canceled {
+			log.Info().Str("import_id", imp.ID.String()).Int("created", created).Int("updated", updated).
+				Int("failed", len(rowErrors)).Msg("Device import completed")
+			return nil
+		}
+	}
+
+	// Canceled meanwhile: the counts still tell what was imported
+	delete(done, "status")
+	delete(done, "completed_at")
+	if err := s.db.Model(&imp).Where("status = ?", models.DeviceImportStatusCanceled).Updates(done).Error; err != nil {
+		return err
+	}
+	log.Info().Str("import_id", imp.ID.String()).Int("created", created).Int("updated", updated).
+		Msg("Device import canceled")
+	return nil
+}
+
+// importRow adds or updates one device in the user's fleet. Columns left
+// out of the file keep their current values.
+func (s *DeviceImportService) importRow(userID uuid.UUID, field func(string) (string, bool)) (importOutcome, error) {
+	serial, _ := field("hardware_id")
+	if !serialPattern.MatchString(serial) {
+		return 0, ErrInvalidSerial
+	}
+	values := map[string]string{}
+	for _, column := range []string{"mcu", "site", "fleet", "name"} {
+		value, ok := field(column)
+		if !ok {
+			continue
+		}
+		if len(value) > maxDeviceFieldLength {
+			return 0, errDeviceFieldTooLong
+		}
+		values[column] = value
+	}
+	claimCode, _ := field("claim_code")
+
+	outcome := importUnchanged
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var device models.Device
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&device, "serial = ?", serial).Error
+		if err == gorm.ErrRecordNotFound {
+			// Registered by the user themselves, so there is no claim code
+			device = models.Device{Serial: serial, MCU: values["mcu"], ProvisionedBy: userID}
+			if err := tx.Create(&device).Error; err != nil {
+				return err
+			}
+			outcome = importCreated
+			return tx.Create(&models.DeviceClaim{
+				DeviceID:  device.ID,
+				UserID:    userID,
+				Name:      values["name"],
+				Group:     values["fleet"],
+				Site:      values["site"],
+				ClaimedAt: time.Now(),
+			}).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		var claim models.DeviceClaim
+		err = tx.Where("device_id = ? AND released_at IS NULL", device.ID).First(&claim).Error
+		switch {
+		case err == gorm.ErrRecordNotFound:
+			if device.ClaimCodeHash != "" &&
+				bcrypt.CompareHashAndPassword([]byte(device.ClaimCodeHash), []byte(normalizeClaimCode(claimCode))) != nil {
+				return ErrInvalidClaim
+			}
+			claim = models.DeviceClaim{DeviceID: device.ID, UserID: userID, ClaimedAt: time.Now()}
+			outcome = importCreated
+		case err != nil:
+			return err
+		case claim.UserID != userID:
+			return ErrDeviceClaimed
+		}
+
+		changes := map[string]interface{}{}
+		for column, current := range map[string]*string{"name": &claim.Name, "fleet": &claim.Group, "site": &claim.Site} {
+			if value, ok := values[column]; ok && value != *current {
+				*current = value
+				changes[column] = value
+			}
+		}
+		// Only the user who registered a device can describe its hardware
+		if mcu, ok := values["mcu"]; ok && mcu != device.MCU && device.ClaimCodeHash == "" && device.ProvisionedBy == userID {
+			if err := tx.Model(&device).Update("mcu", mcu).Error; err != nil {
+				return err
+			}
+			changes["mcu"] = mcu
+		}
+
+		if outcome == importCreated {
+			return tx.Create(&claim).Error
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+		outcome = importUpdated
+		return tx.Model(&claim).Updates(map[string]interface{}{
+			"name":         claim.Name,
+			"device_group": claim.Group,
+			"site":         claim.Site,
+		}).Error
+	})
+	return outcome, err
+}
+
+// ErrorReport writes the failed rows of an import as CSV
+func (s *DeviceImportService) ErrorReport(imp *models.DeviceImport, w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"row", "hardware_id", "error"}); err != nil {
+		return err
+	}
+	for _, rowError := range imp.Errors {
+		if err := writer.Write([]string{fmt.Sprint(rowError.Row), rowError.HardwareID, rowError.Error}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// importHeader returns the index of each known column in a header row.
+// Unknown columns are ignored.
+func importHeader(header []string) (map[string]int, error) {
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if column, ok := importColumns[name]; ok {
+			if _, dup := columns[column]; dup {
+				return nil, ErrInvalidImportHeader
+			}
+			columns[column] = i
+		}
+	}
+	if _, ok := columns["hardware_id"]; !ok {
+		return nil, ErrInvalidImportHeader
+	}
+	return columns, nil
+}
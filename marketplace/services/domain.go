@@ -0,0 +1,400 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// verificationPrefix is the DNS label under which publishers publish the
+// TXT record proving control of a domain
+const verificationPrefix = "_edgeplug-challenge."
+
+var (
+	// ErrInvalidDomain is returned for a domain that is not a valid hostname
+	ErrInvalidDomain = errors.New("invalid domain name")
+	// ErrDomainTaken is returned when adding a domain already claimed by a publisher
+	ErrDomainTaken = errors.New("domain is already registered")
+	// ErrCustomDomainsNotAllowed is returned when the publisher's plan has no custom domains
+	ErrCustomDomainsNotAllowed = errors.New("custom domains are not included in the publisher's plan")
+	// ErrDomainNotVerified is returned when the verification TXT record is missing
+	ErrDomainNotVerified = errors.New("verification TXT record not found")
+	// ErrInvalidCertificate is returned for an uploaded certificate that cannot serve the domain
+	ErrInvalidCertificate = errors.New("invalid certificate")
+)
+
+// domainPattern matches lowercase fully qualified hostnames
+var domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// VerificationRecordName returns the name of the TXT record that verifies a domain
+func VerificationRecordName(domain string) string {
+	return verificationPrefix + domain
+}
+
+// servedDomain is a verified domain with its parsed uploaded certificate, if any
+type servedDomain struct {
+	domain models.CustomDomain
+	cert   *tls.Certificate
+}
+
+// DomainService manages publishers' custom domains. It keeps the verified
+// domains in memory to route requests and pick TLS certificates by SNI.
+type DomainService struct {
+	db    *gorm.DB
+	cfg   config.DomainsConfig
+	tiers *TierService
+	acme  *autocert.Manager
+
+	mu      sync.RWMutex
+	served  map[string]*servedDomain // by domain
+	origins map[string]bool          // CORS origins allowed by verified domains
+}
+
+// NewDomainService creates a new custom domain service. ACME state is kept
+// in the database so every instance serves the same certificates.
+func NewDomainService(db *gorm.DB, cfg config.DomainsConfig, tiers *TierService) *DomainService {
+	s := &DomainService{
+		db:      db,
+		cfg:     cfg,
+		tiers:   tiers,
+		served:  make(map[string]*servedDomain),
+		origins: make(map[string]bool),
+	}
+	s.acme = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      acmeCache{db: db},
+		HostPolicy: s.acmeHostPolicy,
+		Email:      cfg.ACMEEmail,
+	}
+	if cfg.ACMEDirectoryURL != "" {
+		s.acme.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL}
+	}
+	return s
+}
+
+// Run reloads the verified domains every refresh interval until ctx is
+// done, picking up changes made through other instances
+func (s *DomainService) Run(ctx context.Context) {
+	if err := s.Reload(); err != nil {
+		log.Error().Err(err).Msg("Failed to load custom domains")
+	}
+
+	ticker := time.NewTicker(s.cfg.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Reload(); err != nil {
+				log.Error().Err(err).Msg("Failed to reload custom domains")
+			}
+		}
+	}
+}
+
+// Reload replaces the in-memory view of verified domains
+func (s *DomainService) Reload() error {
+	var domains []models.CustomDomain
+	if err := s.db.Where("verified_at IS NOT NULL").Find(&domains).Error; err != nil {
+		return err
+	}
+
+	served := make(map[string]*servedDomain, len(domains))
+	origins := make(map[string]bool)
+	for _, domain := range domains {
+		entry := &servedDomain{domain: domain}
+		if domain.CertSource == models.CertSourceUploaded {
+			cert, err := tls.X509KeyPair([]byte(domain.CertPEM), []byte(domain.KeyPEM))
+			if err != nil {
+				log.Warn().Err(err).Str("domain", domain.Domain).Msg("Skipping unusable uploaded certificate")
+			} else {
+				entry.cert = &cert
+			}
+		}
+		served[domain.Domain] = entry
+
+		origins["https://"+domain.Domain] = true
+		for _, origin := range domain.CORSOrigins {
+			origins[origin] = true
+		}
+	}
+
+	s.mu.Lock()
+	s.served = served
+	s.origins = origins
+	s.mu.Unlock()
+	return nil
+}
+
+// lookup returns the verified domain serving a host, or nil
+func (s *DomainService) lookup(host string) *servedDomain {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.served[host]
+}
+
+// Resolve returns the verified custom domain a request's Host header
+// points at, or nil for the marketplace's own hosts
+func (s *DomainService) Resolve(host string) *models.CustomDomain {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	entry := s.lookup(host)
+	if entry == nil {
+		return nil
+	}
+	domain := entry.domain
+	return &domain
+}
+
+// AllowOrigin reports whether a CORS origin belongs to a verified custom
+// domain or was allowed by one's publisher
+func (s *DomainService) AllowOrigin(origin string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.origins[origin]
+}
+
+// GetCertificate picks the certificate for a TLS handshake by SNI: the
+// uploaded one if the domain has it, otherwise one issued through ACME
+func (s *DomainService) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if entry := s.lookup(hello.ServerName); entry != nil && entry.cert != nil {
+		return entry.cert, nil
+	}
+	return s.acme.GetCertificate(hello)
+}
+
+// TLSConfig returns the TLS configuration of the custom domain listener,
+// which also answers ACME TLS-ALPN-01 challenges
+func (s *DomainService) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// HTTPHandler answers ACME HTTP-01 challenges and passes other requests
+// to fallback
+func (s *DomainService) HTTPHandler(fallback http.Handler) http.Handler {
+	return s.acme.HTTPHandler(fallback)
+}
+
+// acmeHostPolicy only lets the ACME client request certificates for
+// verified domains without an uploaded certificate
+func (s *DomainService) acmeHostPolicy(ctx context.Context, host string) error {
+	entry := s.lookup(host)
+	if entry == nil || entry.domain.CertSource != models.CertSourceACME {
+		return fmt.Errorf("%s is not a verified custom domain using ACME", host)
+	}
+	return nil
+}
+
+// GetDomains returns a publisher's custom domains
+func (s *DomainService) GetDomains(publisherID uuid.UUID) ([]models.CustomDomain, error) {
+	var domains []models.CustomDomain
+	if err := s.db.Where("publisher_id = ?", publisherID).Order("domain").Find(&domains).Error; err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// GetDomain returns one of a publisher's custom domains
+func (s *DomainService) GetDomain(id, publisherID uuid.UUID) (*models.CustomDomain, error) {
+	var domain models.CustomDomain
+	if err := s.db.First(&domain, "id = ? AND publisher_id = ?", id, publisherID).Error; err != nil {
+		return nil, err
+	}
+	return &domain, nil
+}
+
+// AddDomain registers an unverified domain for a publisher with a fresh
+// verification token
+func (s *DomainService) AddDomain(publisherID uuid.UUID, name string) (*models.CustomDomain, error) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if len(name) > 253 || !domainPattern.MatchString(name) {
+		return nil, ErrInvalidDomain
+	}
+
+	var publisher models.User
+	if err := s.db.Select("id", "tier").First(&publisher, "id = ?", publisherID).Error; err != nil {
+		return nil, err
+	}
+	if !s.tiers.Plan(publisher.Tier).CustomDomains {
+		return nil, ErrCustomDomainsNotAllowed
+	}
+
+	var existing int64
+	if err := s.db.Model(&models.CustomDomain{}).Where("domain = ?", name).Count(&existing).Error; err != nil {
+		return nil, err
+	}
+	if existing > 0 {
+		return nil, ErrDomainTaken
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	domain := models.CustomDomain{
+		PublisherID:       publisherID,
+		Domain:            name,
+		VerificationToken: hex.EncodeToString(token),
+		CertSource:        models.CertSourceACME,
+	}
+	if err := s.db.Create(&domain).Error; err != nil {
+		return nil, err
+	}
+	return &domain, nil
+}
+
+// VerifyDomain looks up the domain's verification TXT record and marks the
+// domain verified once it holds the token
+func (s *DomainService) VerifyDomain(ctx context.Context, domain *models.CustomDomain) error {
+	records, err := net.DefaultResolver.LookupTXT(ctx, VerificationRecordName(domain.Domain))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return ErrDomainNotVerified
+		}
+		return err
+	}
+
+	for _, record := range records {
+		if strings.TrimSpace(record) == domain.VerificationToken {
+			now := time.Now()
+			if err := s.db.Model(domain).Update("verified_at", now).Error; err != nil {
+				return err
+			}
+			domain.VerifiedAt = &now
+			return s.Reload()
+		}
+	}
+	return ErrDomainNotVerified
+}
+
+// UpdateBranding updates a domain's storefront branding and CORS origins
+func (s *DomainService) UpdateBranding(domain *models.CustomDomain, updates map[string]interface{}) error {
+	if err := s.db.Model(domain).Updates(updates).Error; err != nil {
+		return err
+	}
+	return s.Reload()
+}
+
+// UploadCertificate replaces ACME issuance for a domain with a certificate
+// chain and private key in PEM. The certificate must cover the domain and
+// be currently valid.
+func (s *DomainService) UploadCertificate(domain *models.CustomDomain, certPEM, keyPEM string) error {
+	pair, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+	if err := leaf.VerifyHostname(domain.Domain); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("%w: certificate is not valid at this time", ErrInvalidCertificate)
+	}
+
+	expiresAt := leaf.NotAfter
+	if err := s.db.Model(domain).Updates(map[string]interface{}{
+		"cert_source":     models.CertSourceUploaded,
+		"cert_pem":        certPEM,
+		"key_pem":         keyPEM,
+		"cert_expires_at": expiresAt,
+	}).Error; err != nil {
+		return err
+	}
+	domain.CertSource = models.CertSourceUploaded
+	domain.CertExpiresAt = &expiresAt
+	return s.Reload()
+}
+
+// RemoveCertificate drops an uploaded certificate, returning the domain to
+// ACME issuance
+func (s *DomainService) RemoveCertificate(domain *models.CustomDomain) error {
+	if err := s.db.Model(domain).Updates(map[string]interface{}{
+		"cert_source":     models.CertSourceACME,
+		"cert_pem":        "",
+		"key_pem":         "",
+		"cert_expires_at": nil,
+	}).Error; err != nil {
+		return err
+	}
+	domain.CertSource = models.CertSourceACME
+	domain.CertExpiresAt = nil
+	return s.Reload()
+}
+
+// DeleteDomain stops serving a custom domain and removes it
+func (s *DomainService) DeleteDomain(domain *models.CustomDomain) error {
+	if err := s.db.Delete(domain).Error; err != nil {
+		return err
+	}
+	return s.Reload()
+}
+
+// ValidOrigin reports whether origin is a bare https origin, as accepted
+// in a domain's CORS origins
+func ValidOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Scheme == "https" && u.Host != "" && u.Path == "" && u.RawQuery == "" && u.User == nil
+}
+
+// acmeCache stores the ACME account key and issued certificates in the database
+type acmeCache struct {
+	db *gorm.DB
+}
+
+// Get implements autocert.Cache
+func (c acmeCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var entry models.ACMECacheEntry
+	if err := c.db.WithContext(ctx).First(&entry, "key = ?", key).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, autocert.ErrCacheMiss
+		}
+		return nil, err
+	}
+	return entry.Data, nil
+}
+
+// Put implements autocert.Cache
+func (c acmeCache) Put(ctx context.Context, key string, data []byte) error {
+	return c.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "updated_at"}),
+	}).Create(&models.ACMECacheEntry{Key: key, Data: data}).Error
+}
+
+// Delete implements autocert.Cache
+func (c acmeCache) Delete(ctx context.Context, key string) error {
+	return c.db.WithContext(ctx).Delete(&models.ACMECacheEntry{}, "key = ?", key).Error
+}
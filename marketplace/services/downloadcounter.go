@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// The buffered counts share a hash tag so they can be taken in one
+// transaction on a Redis cluster
+const (
+	// downloadCounterTotals holds downloads not flushed yet by agent ID
+	downloadCounterTotals = "{downloads}:pending"
+	// downloadCounterDays holds the same downloads by "<agent ID>:<day>"
+	downloadCounterDays = "{downloads}:pending:days"
+	// downloadCounterLock is held by the instance flushing
+	downloadCounterLock    = "{downloads}:flush"
+	downloadCounterLockTTL = time.Minute
+	downloadDayLayout      = "2006-01-02"
+)
+
+var downloadsFlushed = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "edgeplug_downloads_flushed_total",
+	Help: "Buffered agent downloads added to the database",
+})
+
+func init() {
+	prometheus.MustRegister(downloadsFlushed)
+}
+
+// DownloadCounter counts agent downloads. Unbuffered, every download
+// increments its agent's row right away. Buffered, the download itself is
+// still recorded right away but the counts collect in Redis and are added
+// to the agent and its daily downloads in batches, which keeps the database
+// authoritative while hot agents no longer serialize downloads on their row.
+// Counts not flushed yet are added to agents on display.
+type DownloadCounter struct {
+	db    *gorm.DB
+	redis *RedisService
+	cfg   config.DownloadCounterConfig
+}
+
+// NewDownloadCounter creates a new download counter
+func NewDownloadCounter(db *gorm.DB, redisSvc *RedisService, cfg config.DownloadCounterConfig) *DownloadCounter {
+	return &DownloadCounter{db: db, redis: redisSvc, cfg: cfg}
+}
+
+// Record records a download and counts it for its agent, in total and for
+// the day. Downloads are counted in the database directly while Redis is
+// unavailable.
+func (c *DownloadCounter) Record(ctx context.Context, download *models.AgentDownload) error {
+	id := download.AgentID
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	if !c.cfg.Buffered || !c.redis.Available() {
+		return c.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(download).Error; err != nil {
+				return err
+			}
+			return addDownloads(tx, id, day, 1)
+		})
+	}
+
+	if err := c.db.Create(download).Error; err != nil {
+		return err
+	}
+	if _, err := c.redis.Client().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, downloadCounterTotals, id.String(), 1)
+		pipe.HIncrBy(ctx, downloadCounterDays, id.String()+":"+day.Format(downloadDayLayout), 1)
+		return nil
+	}); err != nil {
+		log.Warn().Err(err).Str("agent_id", id.String()).Msg("Failed to buffer download, counting it directly")
+		return c.db.Transaction(func(tx *gorm.DB) error {
+			return addDownloads(tx, id, day, 1)
+		})
+	}
+	return nil
+}
+
+// Pending returns the downloads of agents not flushed to the database yet.
+// It is empty when downloads aren't buffered or Redis doesn't answer, so
+// counts fall back to the database's.
+func (c *DownloadCounter) Pending(ctx context.Context, ids []uuid.UUID) map[uuid.UUID]int {
+	if !c.cfg.Buffered || len(ids) == 0 || !c.redis.Available() {
+		return nil
+	}
+	fields := make([]string, len(ids))
+	for i, id := range ids {
+		fields[i] = id.String()
+	}
+	values, err := c.redis.Client().HMGet(ctx, downloadCounterTotals, fields...).Result()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get buffered downloads")
+		return nil
+	}
+
+	pending := make(map[uuid.UUID]int, len(ids))
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			pending[ids[i]] = n
+		}
+	}
+	return pending
+}
+
+// Run flushes buffered downloads periodically until ctx is done
+func (c *DownloadCounter) Run(ctx context.Context) {
+	if !c.cfg.Buffered {
+		return
+	}
+	ticker := time.NewTicker(c.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			flushed, err := c.Flush(ctx)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to flush buffered downloads")
+			}
+			if flushed > 0 {
+				log.Debug().Int64("downloads", flushed).Msg("Flushed buffered downloads")
+			}
+		}
+	}
+}
+
+// pendingDay is a buffered count of an agent's downloads on a day
+type pendingDay struct {
+	field   string
+	agentID uuid.UUID
+	day     time.Time
+	count   int64
+}
+
+// Flush takes the buffered downloads out of Redis and adds them to the
+// database in transactions of up to flush_batch agent-days, and returns how
+// many it added. Counts of a batch that fails are put back for the next
+// flush. The flush lock is extended before each batch and only released by
+// the flush holding it.
+func (c *DownloadCounter) Flush(ctx context.Context) (int64, error) {
+	client := c.redis.Client()
+	token := models.NewID().String()
+	locked, err := client.SetNX(ctx, downloadCounterLock, token, downloadCounterLockTTL).Result()
+	if err != nil || !locked {
+		return 0, err
+	}
+	defer releaseLock.Run(context.WithoutCancel(ctx), client, []string{downloadCounterLock}, token)
+
+	var taken *redis.MapStringStringCmd
+	if _, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		taken = pipe.HGetAll(ctx, downloadCounterDays)
+		pipe.Del(ctx, downloadCounterDays, downloadCounterTotals)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	days := make([]pendingDay, 0, len(taken.Val()))
+	for field, value := range taken.Val() {
+		pending, ok := parsePendingDay(field, value)
+		if !ok {
+			log.Warn().Str("field", field).Str("value", value).Msg("Dropped malformed buffered download count")
+			continue
+		}
+		days = append(days, pending)
+	}
+	// Agents are updated in the same order by every flush
+	sort.Slice(days, func(i, j int) bool { return days[i].field < days[j].field })
+
+	var flushed int64
+	for start := 0; start < len(days); start += c.cfg.FlushBatch {
+		batch := days[start:min(start+c.cfg.FlushBatch, len(days))]
+		// The counts were taken out of Redis, so they are still this
+		// flush's alone if the lock expired; extending it keeps the next
+		// flush from starting early
+		if held, err := renewLock.Run(ctx, client, []string{downloadCounterLock}, token, downloadCounterLockTTL.Milliseconds()).Bool(); err != nil || !held {
+			log.Warn().Err(err).Msg("Download flush lock expired before all batches were added")
+		}
+		if err := c.db.Transaction(func(tx *gorm.DB) error {
+			for _, pending := range batch {
+				if err := addDownloads(tx, pending.agentID, pending.day, pending.count); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			c.restore(context.WithoutCancel(ctx), days[start:])
+			return flushed, err
+		}
+		var added int64
+		for _, pending := range batch {
+			added += pending.count
+		}
+		flushed += added
+		downloadsFlushed.Add(float64(added))
+	}
+	return flushed, nil
+}
+
+// restore puts counts that could not be flushed back into Redis
+func (c *DownloadCounter) restore(ctx context.Context, days []pendingDay) {
+	if _, err := c.redis.Client().TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, pending := range days {
+			pipe.HIncrBy(ctx, downloadCounterTotals, pending.agentID.String(), pending.count)
+			pipe.HIncrBy(ctx, downloadCounterDays, pending.field, pending.count)
+		}
+		return nil
+	}); err != nil {
+		log.Error().Err(err).Int("agent_days", len(days)).Msg("Failed to restore buffered downloads, counts are lost")
+	}
+}
+
+// parsePendingDay parses a buffered count of an agent's downloads on a day
+func parsePendingDay(field, value string) (pendingDay, bool) {
+	agent, day, ok := strings.Cut(field, ":")
+	if !ok {
+		return pendingDay{}, false
+	}
+	agentID, err := uuid.Parse(agent)
+	if err != nil {
+		return pendingDay{}, false
+	}
+	at, err := time.Parse(downloadDayLayout, day)
+	if err != nil {
+		return pendingDay{}, false
+	}
+	count, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || count < 1 {
+		return pendingDay{}, false
+	}
+	return pendingDay{field: field, agentID: agentID, day: at, count: count}, true
+}
+
+// addDownloads adds n downloads to an agent, in total and for the day. The
+// total is updated without touching updated_at, which downloads are not an
+// edit of.
+func addDownloads(tx *gorm.DB, agentID uuid.UUID, day time.Time, n int64) error {
+	if err := tx.Model(&models.Agent{}).Where("id = ?", agentID).UpdateColumn("downloads", gorm.Expr("downloads + ?", n)).Error; err != nil {
+		return err
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "agent_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"downloads": gorm.Expr("agent_download_days.downloads + ?", n),
+		}),
+	}).Create(&models.AgentDownloadDay{
+		AgentID:   agentID,
+		Day:       day,
+		Downloads: n,
+	}).Error
+}
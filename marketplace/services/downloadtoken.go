@@ -0,0 +1,99 @@
+package services
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// DownloadClaims are the claims of a download token. A device checks the
+// token's signature against the published signing key and the checksum
+// against the binary it received, proving the binary came from an
+// entitled download.
+type DownloadClaims struct {
+	AgentID  uuid.UUID  `json:"agent_id"`
+	Version  string     `json:"version"`
+	Checksum string     `json:"sha256"`
+	TraceID  *uuid.UUID `json:"trace_id,omitempty"` // of the purchase entitling the download
+	jwt.RegisteredClaims
+}
+
+// DownloadTokenService issues download tokens signed by the marketplace
+// signing key
+type DownloadTokenService struct {
+	signer Signer
+	issuer string
+	ttl    time.Duration
+}
+
+// NewDownloadTokenService creates a new download token service
+func NewDownloadTokenService(signer Signer, issuer string, ttl time.Duration) *DownloadTokenService {
+	return &DownloadTokenService{signer: signer, issuer: issuer, ttl: ttl}
+}
+
+// Issue returns a token for a user's download of an agent release
+func (s *DownloadTokenService) Issue(userID uuid.UUID, release *models.AgentVersion, traceID *uuid.UUID) (string, error) {
+	now := time.Now()
+	claims := DownloadClaims{
+		AgentID:  release.AgentID,
+		Version:  release.Version,
+		Checksum: release.BinaryChecksum,
+		TraceID:  traceID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   userID.String(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        uuid.New().String(),
+		},
+	}
+
+	token := jwt.NewWithClaims(signerMethod{}, claims)
+	token.Header["kid"] = s.signer.KeyID()
+	return token.SignedString(s.signer)
+}
+
+// signerMethod is the ES256 JWT signing method for a Signer, whose key
+// may not be in process memory. Tokens verify with the standard ES256
+// method and the signer's public key.
+type signerMethod struct{}
+
+func (signerMethod) Alg() string {
+	return "ES256"
+}
+
+func (signerMethod) Verify(signingString string, sig []byte, key interface{}) error {
+	return errors.New("verify ES256 tokens with jwt.SigningMethodES256")
+}
+
+func (signerMethod) Sign(signingString string, key interface{}) ([]byte, error) {
+	signer, ok := key.(Signer)
+	if !ok {
+		return nil, errors.New("signing key is not a Signer")
+	}
+
+	digest := sha256.Sum256([]byte(signingString))
+	der, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	// JWS takes the fixed-size r || s form rather than DER
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 64)
+	sig.R.FillBytes(out[:32])
+	sig.S.FillBytes(out[32:])
+	return out, nil
+}
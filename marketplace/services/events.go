@@ -0,0 +1,313 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// Events sent to live streams besides the webhook events
+const (
+	// StreamEventNotification is an in-app notification
+	StreamEventNotification = "notification"
+	// StreamEventScanCompleted is the malware scan of a release's binary
+	// finishing, sent to its publisher
+	StreamEventScanCompleted = "scan.completed"
+)
+
+const (
+	// eventChannelPrefix is followed by the user ID in the Redis channel of
+	// a user's events
+	eventChannelPrefix = "events:"
+	// eventBuffer is how many events a stream can fall behind before it is
+	// closed, to catch up by reconnecting
+	eventBuffer = 64
+)
+
+var (
+	// ErrEventsUnavailable is returned when opening a stream while live
+	// events are disabled or Redis is down
+	ErrEventsUnavailable = errors.New("live events are unavailable")
+	// ErrTooManyStreams is returned when a user opens more streams than
+	// allowed
+	ErrTooManyStreams = errors.New("too many open event streams")
+)
+
+var (
+	eventsRelayed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "edgeplug_events_relayed_total",
+		Help: "Events published to Redis for live streams",
+	})
+	eventStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "edgeplug_event_streams",
+		Help: "Live event streams open on this instance",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(eventsRelayed, eventStreams)
+}
+
+// Event is an event sent to a user's live streams
+type Event struct {
+	ID        uuid.UUID       `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// EventService streams users' events to them as they happen. Events are
+// written to the database with the change they report and a relay
+// publishes the committed ones to Redis, where every instance listens for
+// the users with streams open on it. Events are kept for the retention
+// period, so a client that reconnects gets what it missed.
+type EventService struct {
+	db    *gorm.DB
+	redis *RedisService
+	cfg   config.EventsConfig
+
+	mu        sync.Mutex
+	pubsub    *redis.PubSub
+	listeners map[uuid.UUID]map[chan Event]bool
+}
+
+// NewEventService creates a new event service
+func NewEventService(db *gorm.DB, redisSvc *RedisService, cfg config.EventsConfig) *EventService {
+	return &EventService{db: db, redis: redisSvc, cfg: cfg, listeners: map[uuid.UUID]map[chan Event]bool{}}
+}
+
+// streamEvent records an event for a user's live streams. Call it in the
+// transaction of the change the event reports, like emitWebhook.
+func streamEvent(tx *gorm.DB, userID uuid.UUID, event string, data interface{}) error {
+	row, err := newStreamEvent(userID, event, data)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&row).Error
+}
+
+func newStreamEvent(userID uuid.UUID, event string, data interface{}) (models.StreamEvent, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return models.StreamEvent{}, err
+	}
+	e := Event{ID: models.NewID(), Event: event, CreatedAt: time.Now().UTC(), Data: raw}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return models.StreamEvent{}, err
+	}
+	return models.StreamEvent{ID: e.ID, UserID: userID, Event: event, Payload: string(payload), CreatedAt: e.CreatedAt}, nil
+}
+
+// emitEvent reports a change to a user's live streams and to their webhook
+// subscriptions to the event
+func emitEvent(tx *gorm.DB, userID uuid.UUID, event models.WebhookEvent, data interface{}) error {
+	if err := streamEvent(tx, userID, string(event), data); err != nil {
+		return err
+	}
+	return emitWebhook(tx, userID, event, data)
+}
+
+// Run relays committed events to Redis every relay interval, and deletes
+// those past the retention period, until ctx is done
+func (s *EventService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.RelayInterval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(time.Minute)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.cfg.Enabled || !s.redis.Available() {
+				continue
+			}
+			if err := s.relay(ctx); err != nil {
+				log.Error().Err(err).Msg("Failed to relay events")
+			}
+		case <-cleanup.C:
+			if err := s.db.Where("created_at < ?", time.Now().Add(-s.cfg.Retention)).Delete(&models.StreamEvent{}).Error; err != nil {
+				log.Error().Err(err).Msg("Failed to delete expired events")
+			}
+		}
+	}
+}
+
+// relay publishes a batch of events not relayed yet, in order. Instances
+// relay different events concurrently; an event whose batch fails to be
+// marked may be published twice, which streams ignore.
+func (s *EventService) relay(ctx context.Context) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var events []models.StreamEvent
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("relayed_at IS NULL").Order("id").Limit(s.cfg.RelayBatch).
+			Find(&events).Error; err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		ids := make([]uuid.UUID, len(events))
+		if _, err := s.redis.Client().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, event := range events {
+				ids[i] = event.ID
+				pipe.Publish(ctx, eventChannelPrefix+event.UserID.String(), event.Payload)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		eventsRelayed.Add(float64(len(events)))
+		return tx.Model(&models.StreamEvent{}).Where("id IN ?", ids).Update("relayed_at", time.Now()).Error
+	})
+}
+
+// Listen receives the events of users with streams open on this instance
+// until ctx is done, then closes their streams. The subscription reconnects
+// by itself after Redis failures; events published meanwhile are caught up
+// by clients reconnecting.
+func (s *EventService) Listen(ctx context.Context) {
+	if !s.cfg.Enabled {
+		return
+	}
+	pubsub := s.redis.Client().Subscribe(ctx)
+	s.mu.Lock()
+	s.pubsub = pubsub
+	s.mu.Unlock()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.pubsub = nil
+			for userID, streams := range s.listeners {
+				for stream := range streams {
+					close(stream)
+				}
+				delete(s.listeners, userID)
+			}
+			eventStreams.Set(0)
+			s.mu.Unlock()
+			pubsub.Close()
+			return
+		case msg := <-messages:
+			s.dispatch(msg)
+		}
+	}
+}
+
+// dispatch passes an event to the streams of its user. A stream too far
+// behind is closed rather than holding the others up.
+func (s *EventService) dispatch(msg *redis.Message) {
+	userID, err := uuid.Parse(msg.Channel[len(eventChannelPrefix):])
+	if err != nil {
+		return
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+		log.Warn().Err(err).Str("channel", msg.Channel).Msg("Ignoring malformed event")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for stream := range s.listeners[userID] {
+		select {
+		case stream <- event:
+		default:
+			log.Warn().Str("user_id", userID.String()).Msg("Closing event stream that fell behind")
+			s.remove(userID, stream)
+		}
+	}
+}
+
+// Subscribe opens a stream of a user's events. Call the returned function
+// once done with it. The stream is closed early if it falls behind or the
+// instance shuts down, for the client to reconnect and catch up.
+func (s *EventService) Subscribe(ctx context.Context, userID uuid.UUID) (<-chan Event, func(), error) {
+	if !s.cfg.Enabled || !s.redis.Available() {
+		return nil, nil, ErrEventsUnavailable
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pubsub == nil {
+		return nil, nil, ErrEventsUnavailable
+	}
+	streams := s.listeners[userID]
+	if len(streams) >= s.cfg.MaxPerUser {
+		return nil, nil, ErrTooManyStreams
+	}
+	if streams == nil {
+		if err := s.pubsub.Subscribe(ctx, eventChannelPrefix+userID.String()); err != nil {
+			return nil, nil, err
+		}
+		streams = map[chan Event]bool{}
+		s.listeners[userID] = streams
+	}
+	stream := make(chan Event, eventBuffer)
+	streams[stream] = true
+	eventStreams.Inc()
+
+	return stream, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.remove(userID, stream)
+	}, nil
+}
+
+// remove closes a stream and unsubscribes from its user's events after
+// their last stream. It is a no-op for a stream already removed.
+func (s *EventService) remove(userID uuid.UUID, stream chan Event) {
+	streams := s.listeners[userID]
+	if !streams[stream] {
+		return
+	}
+	delete(streams, stream)
+	close(stream)
+	eventStreams.Dec()
+	if len(streams) > 0 {
+		return
+	}
+	delete(s.listeners, userID)
+	if s.pubsub != nil {
+		if err := s.pubsub.Unsubscribe(context.Background(), eventChannelPrefix+userID.String()); err != nil {
+			log.Warn().Err(err).Str("user_id", userID.String()).Msg("Failed to unsubscribe from events")
+		}
+	}
+}
+
+// Since returns a user's events after the one with the given ID that are
+// still kept, oldest first, for a client catching up
+func (s *EventService) Since(userID, lastID uuid.UUID) ([]Event, error) {
+	var rows []models.StreamEvent
+	if err := s.db.Where("user_id = ? AND id > ? AND created_at >= ?", userID, lastID, time.Now().Add(-s.cfg.Retention)).
+		Order("id").Limit(s.cfg.RelayBatch).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	events := make([]Event, 0, len(rows))
+	for _, row := range rows {
+		var event Event
+		if err := json.Unmarshal([]byte(row.Payload), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
@@ -0,0 +1,303 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// MaxAssetSize caps the size of manifests, icons and READMEs. Unlike
+// binaries they are not counted against the publisher's storage quota.
+const MaxAssetSize = 1 << 20
+
+var (
+	// ErrBinaryTooLarge is returned for a binary larger than the release's flash size
+	ErrBinaryTooLarge = errors.New("binary is larger than the declared flash size")
+	// ErrAssetTooLarge is returned for a manifest, icon or README over MaxAssetSize
+	ErrAssetTooLarge = errors.New("file is larger than 1 MiB")
+	// ErrUnsupportedContentType is returned for an icon or README of the wrong type
+	ErrUnsupportedContentType = errors.New("unsupported content type")
+	// ErrVersionImmutable is returned when changing the files of a release that is no longer a draft
+	ErrVersionImmutable = errors.New("only draft versions can be changed")
+)
+
+// FileUpload is an agent file being uploaded
+type FileUpload struct {
+	Body        io.Reader
+	Size        int64
+	ContentType string
+}
+
+// Storage keys of agent files. Release files live under the version so
+// older releases stay downloadable.
+func binaryKey(release *models.AgentVersion) string {
+	return fmt.Sprintf("agents/%s/%s/binary", release.AgentID, release.Version)
+}
+
+func manifestKey(release *models.AgentVersion) string {
+	return fmt.Sprintf("agents/%s/%s/manifest", release.AgentID, release.Version)
+}
+
+func iconKey(agentID uuid.UUID) string {
+	return fmt.Sprintf("agents/%s/icon", agentID)
+}
+
+func readmeKey(agentID uuid.UUID) string {
+	return fmt.Sprintf("agents/%s/README.md", agentID)
+}
+
+// isStored reports whether a file URL points at the object stored under key
+// rather than at an external location
+func isStored(url, key string) bool {
+	return url != "" && strings.HasSuffix(strings.SplitN(url, "?", 2)[0], "/"+key)
+}
+
+// UploadBinary streams a draft release's binary to storage, recording its
+// size, checksum, content type and signature and charging it to the
+// publisher's storage quota. The signature is verified before anything is
+// stored, so a bad one leaves the current binary in place. A binary uploaded
+// for the agent's current version is mirrored onto the agent. The new
+// binary has to be scanned again before the release can be published.
+func (s *AgentService) UploadBinary(ctx context.Context, agent *models.Agent, release *models.AgentVersion, upload FileUpload, signature BinarySignature) error {
+	if release.Status != models.AgentVersionStatusDraft {
+		return ErrVersionImmutable
+	}
+	if release.FlashSize > 0 && upload.Size > int64(release.FlashSize) {
+		return ErrBinaryTooLarge
+	}
+	if err := s.tiers.CheckStorageQuota(agent.PublisherID, upload.Size-release.BinarySize); err != nil {
+		return err
+	}
+
+	key, err := signingKeyFor(s.db, agent, signature.KeyID)
+	if err != nil {
+		return err
+	}
+	body, ok := upload.Body.(io.ReadSeeker)
+	if !ok {
+		return errors.New("binary upload is not seekable")
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.LimitReader(body, upload.Size)); err != nil {
+		return err
+	}
+	digest := hash.Sum(nil)
+	if err := verifyBinarySignature(key, digest, signature.Signature); err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	url, err := s.storage.Put(ctx, binaryKey(release), io.LimitReader(body, upload.Size), upload.Size, upload.ContentType)
+	if err != nil {
+		return fmt.Errorf("failed to store binary: %w", err)
+	}
+
+	files := map[string]interface{}{
+		"binary_url":          url,
+		"binary_size":         upload.Size,
+		"binary_checksum":     hex.EncodeToString(digest),
+		"binary_content_type": upload.ContentType,
+		"binary_signature":    strings.TrimSpace(signature.Signature),
+		"signing_key_id":      key.ID,
+	}
+	scanStatus := models.ScanStatusPending
+	if !s.scanning {
+		scanStatus = models.ScanStatusSkipped
+	}
+	previousSize := release.BinarySize
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		// The agent has no scan columns, so these only go on the release
+		scan := map[string]interface{}{"scan_status": scanStatus, "scan_report": nil, "scan_after": nil}
+		for column, value := range files {
+			scan[column] = value
+		}
+		if err := tx.Model(release).Updates(scan).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.User{}).Where("id = ?", agent.PublisherID).
+			Update("storage_used_bytes", gorm.Expr("storage_used_bytes + ?", upload.Size-previousSize)).Error; err != nil {
+			return err
+		}
+		if release.Version != agent.Version {
+			return nil
+		}
+		return tx.Model(&models.Agent{}).Where("id = ?", agent.ID).Updates(files).Error
+	})
+	if err != nil {
+		log.Error().Err(err).Str("key", binaryKey(release)).Msg("Stored binary could not be recorded")
+		return err
+	}
+
+	release.BinaryURL = url
+	release.BinarySize = upload.Size
+	release.BinaryChecksum = files["binary_checksum"].(string)
+	release.BinaryContentType = upload.ContentType
+	release.BinarySignature = files["binary_signature"].(string)
+	release.SigningKeyID = &key.ID
+	release.SigningKey = key
+	release.ScanStatus = scanStatus
+	release.ScanReport = nil
+	release.ScanAfter = nil
+	if release.Version == agent.Version {
+		s.InvalidateAgent(agent.ID)
+	}
+	return nil
+}
+
+// UploadManifest validates and stores a draft release's manifest. A
+// manifest uploaded for the agent's current version is mirrored onto the
+// agent.
+func (s *AgentService) UploadManifest(ctx context.Context, agent *models.Agent, release *models.AgentVersion, upload FileUpload) error {
+	if release.Status != models.AgentVersionStatusDraft {
+		return ErrVersionImmutable
+	}
+	if upload.Size > MaxAssetSize {
+		return ErrAssetTooLarge
+	}
+
+	manifest, data, err := s.manifests.parseUpload(upload)
+	if err != nil {
+		return err
+	}
+	if manifest.Version != release.Version {
+		return invalidManifest("version is %s but the manifest was uploaded for %s", manifest.Version, release.Version)
+	}
+
+	url, err := s.storage.Put(ctx, manifestKey(release), bytes.NewReader(data), int64(len(data)), "application/json")
+	if err != nil {
+		return fmt.Errorf("failed to store manifest: %w", err)
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(release).Updates(map[string]interface{}{
+			"manifest_url": url,
+			"manifest":     manifest,
+		}).Error; err != nil {
+			return err
+		}
+		if release.Version != agent.Version {
+			return nil
+		}
+		return tx.Model(&models.Agent{}).Where("id = ?", agent.ID).Update("manifest_url", url).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	release.ManifestURL = url
+	release.Manifest = manifest
+	if release.Version == agent.Version {
+		s.InvalidateAgent(agent.ID)
+	}
+	return nil
+}
+
+// UploadIcon stores an agent's icon, which must be a PNG, JPEG, WebP or SVG image
+func (s *AgentService) UploadIcon(ctx context.Context, agent *models.Agent, upload FileUpload) error {
+	switch upload.ContentType {
+	case "image/png", "image/jpeg", "image/webp", "image/svg+xml":
+	default:
+		return ErrUnsupportedContentType
+	}
+	return s.uploadAsset(ctx, agent, "icon_url", iconKey(agent.ID), upload)
+}
+
+// UploadReadme stores an agent's README in its default locale, which must be
+// Markdown or plain text
+func (s *AgentService) UploadReadme(ctx context.Context, agent *models.Agent, upload FileUpload) error {
+	mediaType, _, _ := strings.Cut(upload.ContentType, ";")
+	switch strings.TrimSpace(mediaType) {
+	case "text/markdown", "text/plain":
+	default:
+		return ErrUnsupportedContentType
+	}
+	return s.uploadAsset(ctx, agent, "readme_url", readmeKey(agent.ID), upload)
+}
+
+// uploadAsset stores an agent-wide file and records its URL in column
+func (s *AgentService) uploadAsset(ctx context.Context, agent *models.Agent, column, key string, upload FileUpload) error {
+	if upload.Size > MaxAssetSize {
+		return ErrAssetTooLarge
+	}
+
+	url, err := s.storage.Put(ctx, key, io.LimitReader(upload.Body, upload.Size), upload.Size, upload.ContentType)
+	if err != nil {
+		return fmt.Errorf("failed to store %s: %w", key, err)
+	}
+	if err := s.db.Model(agent).Update(column, url).Error; err != nil {
+		return err
+	}
+
+	s.InvalidateAgent(agent.ID)
+	return nil
+}
+
+// ReleaseFiles is where a release's binary and manifest can be downloaded
+type ReleaseFiles struct {
+	BinaryURL   string `json:"binary_url"`
+	ManifestURL string `json:"manifest_url"`
+}
+
+// GetReleaseFiles returns download URLs for a release's files. Files kept in
+// storage get presigned URLs that expire; external URLs are returned as is.
+func (s *AgentService) GetReleaseFiles(ctx context.Context, release *models.AgentVersion) (*ReleaseFiles, error) {
+	binaryURL, err := s.fileURL(ctx, release.BinaryURL, binaryKey(release))
+	if err != nil {
+		return nil, err
+	}
+	manifestURL, err := s.fileURL(ctx, release.ManifestURL, manifestKey(release))
+	if err != nil {
+		return nil, err
+	}
+	return &ReleaseFiles{BinaryURL: binaryURL, ManifestURL: manifestURL}, nil
+}
+
+// GetIconURL returns a URL the agent's icon can be loaded from, or "" if it
+// has none
+func (s *AgentService) GetIconURL(ctx context.Context, agent *models.Agent) (string, error) {
+	return s.fileURL(ctx, agent.IconURL, iconKey(agent.ID))
+}
+
+// GetStoredReadme returns the README uploaded for an agent, or "" if its
+// README is not kept in storage
+func (s *AgentService) GetStoredReadme(ctx context.Context, agent *models.Agent) (string, error) {
+	if !isStored(agent.ReadmeURL, readmeKey(agent.ID)) {
+		return "", nil
+	}
+
+	body, err := s.storage.Get(ctx, readmeKey(agent.ID))
+	if err != nil {
+		if err == ErrObjectNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	defer body.Close()
+
+	readme, err := io.ReadAll(io.LimitReader(body, MaxAssetSize))
+	if err != nil {
+		return "", err
+	}
+	return string(readme), nil
+}
+
+// fileURL presigns url if it points at the object stored under key
+func (s *AgentService) fileURL(ctx context.Context, url, key string) (string, error) {
+	if !isStored(url, key) {
+		return url, nil
+	}
+	return s.storage.PresignedURL(ctx, key, s.presignExpiry)
+}
@@ -0,0 +1,502 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// maxRolloutWaves caps the number of waves of a staged rollout
+const maxRolloutWaves = 10
+
+var (
+	// ErrInvalidRolloutPlan is returned for an unknown strategy, a canary
+	// percentage outside 1 to 99, or waves that are not increasing
+	// percentages ending at 100
+	ErrInvalidRolloutPlan = errors.New("strategy must be immediate, canary with canary_percent from 1 to 99, or waves of increasing percentages ending at 100")
+	// ErrInvalidFailureThreshold is returned for a threshold outside 1 to 100
+	ErrInvalidFailureThreshold = errors.New("failure_threshold must be a percentage from 1 to 100")
+	// ErrRolloutDevices is returned unless exactly one of device_ids and
+	// group names at least one device
+	ErrRolloutDevices = errors.New("give either device_ids or a group with at least one claimed device")
+	// ErrTooManyRolloutDevices is returned for a rollout over the configured
+	// device limit
+	ErrTooManyRolloutDevices = errors.New("too many devices for one rollout")
+	// ErrFleetRolloutInProgress is returned when rolling out an agent that
+	// is already being rolled out to the buyer's devices
+	ErrFleetRolloutInProgress = errors.New("this agent is already being rolled out to your devices; halt that rollout first")
+	// ErrFleetRolloutFinished is returned when halting a rollout that has
+	// completed or was halted
+	ErrFleetRolloutFinished = errors.New("rollout has already finished")
+)
+
+// rolloutHaltedByBuyer is the halt reason of rollouts the buyer stopped
+const rolloutHaltedByBuyer = "halted by the buyer"
+
+// FleetRolloutRequest describes a release to roll out to a buyer's devices:
+// the devices by ID or by group, and how to reach them
+type FleetRolloutRequest struct {
+	AgentID          uuid.UUID
+	Version          string
+	DeviceIDs        []string
+	Group            string
+	Strategy         models.RolloutStrategy
+	CanaryPercent    int
+	Waves            []int
+	WaveInterval     time.Duration
+	FailureThreshold int // percentage; 0 uses the configured default
+}
+
+// FleetRolloutProgress is a rollout and how many of its devices are in
+// each state
+type FleetRolloutProgress struct {
+	*models.FleetRollout
+	Devices map[models.RolloutTargetStatus]int64 `json:"devices"`
+}
+
+// FleetRolloutService rolls a release out to many of a buyer's devices.
+// Each wave pins the release on its devices through their deployments; a
+// device succeeds when it checks in with the release and fails when it
+// reports an update error or times out. The worker starts the next wave
+// once the current one has settled, and halts the rollout as soon as too
+// many devices have failed.
+type FleetRolloutService struct {
+	db       *gorm.DB
+	cfg      config.FleetRolloutsConfig
+	metering *MeteringService
+}
+
+// NewFleetRolloutService creates a new fleet rollout service
+func NewFleetRolloutService(db *gorm.DB, cfg config.FleetRolloutsConfig, metering *MeteringService) *FleetRolloutService {
+	return &FleetRolloutService{db: db, cfg: cfg, metering: metering}
+}
+
+// StartRollout plans a rollout and starts its first wave
+func (s *FleetRolloutService) StartRollout(buyerID uuid.UUID, req FleetRolloutRequest) (*FleetRolloutProgress, error) {
+	waves, err := rolloutWaves(req)
+	if err != nil {
+		return nil, err
+	}
+	threshold := req.FailureThreshold
+	if threshold == 0 {
+		threshold = s.cfg.FailureThreshold
+	}
+	if threshold < 1 || threshold > 100 {
+		return nil, ErrInvalidFailureThreshold
+	}
+	devices, err := s.rolloutDevices(buyerID, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkRelease(req.AgentID, req.Version); err != nil {
+		return nil, err
+	}
+
+	var running int64
+	if err := s.db.Model(&models.FleetRollout{}).
+		Where("buyer_id = ? AND agent_id = ? AND status = ?", buyerID, req.AgentID, models.FleetRolloutStatusInProgress).
+		Count(&running).Error; err != nil {
+		return nil, err
+	}
+	if running > 0 {
+		return nil, ErrFleetRolloutInProgress
+	}
+
+	rollout := models.FleetRollout{
+		BuyerID:          buyerID,
+		AgentID:          req.AgentID,
+		Version:          req.Version,
+		Strategy:         req.Strategy,
+		Waves:            waves,
+		WaveInterval:     int(req.WaveInterval / time.Second),
+		FailureThreshold: threshold,
+		Status:           models.FleetRolloutStatusInProgress,
+		WaveStartedAt:    time.Now(),
+	}
+	// Device i joins the first wave whose share of the fleet, rounded up,
+	// covers it, so a canary always gets at least one device
+	wave := 0
+	for i, device := range devices {
+		for i >= (waves[wave]*len(devices)+99)/100 {
+			wave++
+		}
+		rollout.Targets = append(rollout.Targets, models.FleetRolloutTarget{
+			DeviceID: device,
+			Wave:     wave,
+			Status:   models.RolloutTargetStatusPending,
+		})
+	}
+	if err := s.db.Create(&rollout).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.startWave(&rollout); err != nil {
+		return nil, err
+	}
+	return s.GetRollout(buyerID, rollout.ID)
+}
+
+// GetRollouts returns a buyer's fleet rollouts, most recent first
+func (s *FleetRolloutService) GetRollouts(buyerID uuid.UUID, page, limit int) ([]models.FleetRollout, int64, error) {
+	query := s.db.Model(&models.FleetRollout{}).Where("buyer_id = ?", buyerID)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var rollouts []models.FleetRollout
+	if err := query.Order("created_at DESC").Offset((page - 1) * limit).Limit(limit).Find(&rollouts).Error; err != nil {
+		return nil, 0, err
+	}
+	return rollouts, total, nil
+}
+
+// GetRollout returns one of a buyer's rollouts with the status of every
+// device
+func (s *FleetRolloutService) GetRollout(buyerID, id uuid.UUID) (*FleetRolloutProgress, error) {
+	var rollout models.FleetRollout
+	if err := s.db.Preload("Targets", func(db *gorm.DB) *gorm.DB { return db.Order("wave, device_id") }).
+		Where("id = ? AND buyer_id = ?", id, buyerID).
+		First(&rollout).Error; err != nil {
+		return nil, err
+	}
+
+	progress := &FleetRolloutProgress{FleetRollout: &rollout, Devices: map[models.RolloutTargetStatus]int64{}}
+	for _, target := range rollout.Targets {
+		progress.Devices[target.Status]++
+	}
+	return progress, nil
+}
+
+// HaltRollout stops a rollout before its next wave. Devices already in a
+// wave keep the release pinned.
+func (s *FleetRolloutService) HaltRollout(buyerID, id uuid.UUID) (*FleetRolloutProgress, error) {
+	var rollout models.FleetRollout
+	if err := s.db.Where("id = ? AND buyer_id = ?", id, buyerID).First(&rollout).Error; err != nil {
+		return nil, err
+	}
+	halted, err := s.halt(&rollout, rolloutHaltedByBuyer)
+	if err != nil {
+		return nil, err
+	}
+	if !halted {
+		return nil, ErrFleetRolloutFinished
+	}
+	return s.GetRollout(buyerID, id)
+}
+
+// Run advances rollouts every poll interval until ctx is done
+func (s *FleetRolloutService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Advance(); err != nil {
+				log.Error().Err(err).Msg("Failed to advance fleet rollouts")
+			}
+		}
+	}
+}
+
+// Advance times out devices that have not applied the release, halts
+// rollouts over their failure threshold and starts the next wave of those
+// whose current wave has settled
+func (s *FleetRolloutService) Advance() error {
+	now := time.Now()
+	if err := s.db.Model(&models.FleetRolloutTarget{}).
+		Where("status = ? AND started_at < ?", models.RolloutTargetStatusDeploying, now.Add(-s.cfg.UpdateTimeout)).
+		Updates(map[string]interface{}{
+			"status":      models.RolloutTargetStatusFailed,
+			"error":       "device did not apply the release in time",
+			"finished_at": now,
+		}).Error; err != nil {
+		return err
+	}
+
+	var rollouts []models.FleetRollout
+	if err := s.db.Where("status = ?", models.FleetRolloutStatusInProgress).Find(&rollouts).Error; err != nil {
+		return err
+	}
+	for i := range rollouts {
+		if err := s.advance(&rollouts[i], now); err != nil {
+			log.Error().Err(err).Str("rollout_id", rollouts[i].ID.String()).Msg("Failed to advance fleet rollout")
+		}
+	}
+	return nil
+}
+
+func (s *FleetRolloutService) advance(rollout *models.FleetRollout, now time.Time) error {
+	var counts []struct {
+		Status models.RolloutTargetStatus
+		Count  int64
+	}
+	if err := s.db.Model(&models.FleetRolloutTarget{}).
+		Select("status, COUNT(*) AS count").
+		Where("rollout_id = ? AND wave <= ?", rollout.ID, rollout.CurrentWave).
+		Group("status").
+		Scan(&counts).Error; err != nil {
+		return err
+	}
+	var started, failed, unsettled int64
+	for _, c := range counts {
+		switch c.Status {
+		case models.RolloutTargetStatusFailed:
+			failed += c.Count
+		case models.RolloutTargetStatusPending, models.RolloutTargetStatusDeploying:
+			unsettled += c.Count
+		}
+		if c.Status != models.RolloutTargetStatusPending {
+			started += c.Count
+		}
+	}
+
+	if failed*100 > int64(rollout.FailureThreshold)*started {
+		_, err := s.halt(rollout, "failure threshold exceeded")
+		return err
+	}
+	if unsettled > 0 || now.Before(rollout.WaveStartedAt.Add(time.Duration(rollout.WaveInterval)*time.Second)) {
+		return nil
+	}
+
+	if rollout.CurrentWave == len(rollout.Waves)-1 {
+		result := s.db.Model(rollout).Where("status = ?", models.FleetRolloutStatusInProgress).Updates(map[string]interface{}{
+			"status":      models.FleetRolloutStatusCompleted,
+			"finished_at": now,
+		})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		var agent models.Agent
+		if err := s.db.Select("id", "name").First(&agent, "id = ?", rollout.AgentID).Error; err != nil {
+			return err
+		}
+		if err := notify(s.db, &models.Notification{
+			UserID: rollout.BuyerID,
+			Type:   models.NotificationTypeDeploymentFinished,
+			Title:  fmt.Sprintf("%s %s is deployed to your fleet", agent.Name, rollout.Version),
+			Body:   fmt.Sprintf("The rollout of %s %s finished its last wave.", agent.Name, rollout.Version),
+			Link:   fmt.Sprintf("/fleet-rollouts/%s", rollout.ID),
+		}); err != nil {
+			return err
+		}
+		return emitEvent(s.db, rollout.BuyerID, models.WebhookEventFleetRolloutCompleted, fleetRolloutEvent(rollout))
+	}
+
+	// Claim the next wave so it is started once
+	result := s.db.Model(rollout).
+		Where("status = ? AND current_wave = ?", models.FleetRolloutStatusInProgress, rollout.CurrentWave).
+		Updates(map[string]interface{}{
+			"current_wave":    rollout.CurrentWave + 1,
+			"wave_started_at": now,
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	rollout.CurrentWave++
+	rollout.WaveStartedAt = now
+	return s.startWave(rollout)
+}
+
+// halt marks a rollout halted and reports whether it was still in progress
+func (s *FleetRolloutService) halt(rollout *models.FleetRollout, reason string) (bool, error) {
+	now := time.Now()
+	result := s.db.Model(rollout).Where("status = ?", models.FleetRolloutStatusInProgress).Updates(map[string]interface{}{
+		"status":      models.FleetRolloutStatusHalted,
+		"halt_reason": reason,
+		"finished_at": now,
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+
+	log.Info().Str("rollout_id", rollout.ID.String()).Str("reason", reason).Msg("Fleet rollout halted")
+	data := fleetRolloutEvent(rollout)
+	data["reason"] = reason
+	return true, emitEvent(s.db, rollout.BuyerID, models.WebhookEventFleetRolloutHalted, data)
+}
+
+// startWave pins the release on the pending devices of the current wave
+func (s *FleetRolloutService) startWave(rollout *models.FleetRollout) error {
+	var targets []models.FleetRolloutTarget
+	if err := s.db.Where("rollout_id = ? AND wave = ? AND status = ?", rollout.ID, rollout.CurrentWave, models.RolloutTargetStatusPending).
+		Find(&targets).Error; err != nil {
+		return err
+	}
+	for i := range targets {
+		if err := s.deployTarget(rollout, &targets[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deployTarget pins the release on a device, deploying the agent there if
+// it is not yet. Errors that only concern the device fail the device rather
+// than the wave.
+func (s *FleetRolloutService) deployTarget(rollout *models.FleetRollout, target *models.FleetRolloutTarget) error {
+	now := time.Now()
+	updates := map[string]interface{}{"started_at": now}
+
+	var deployment models.Deployment
+	err := s.db.Where("buyer_id = ? AND agent_id = ? AND device_id = ? AND decommissioned_at IS NULL",
+		rollout.BuyerID, rollout.AgentID, target.DeviceID).First(&deployment).Error
+	switch err {
+	case nil:
+		if deployment.Version != rollout.Version {
+			if err := s.db.Model(&deployment).Update("version", rollout.Version).Error; err != nil {
+				return err
+			}
+		}
+	case gorm.ErrRecordNotFound:
+		created, err := s.metering.Deploy(rollout.BuyerID, rollout.AgentID, target.DeviceID, rollout.Version, "", uuid.Nil)
+		switch err {
+		case nil:
+			deployment = *created
+		case ErrFleetLimitReached, ErrAgentNotPurchasable, ErrAgentNotMetered, ErrVersionNotPublished:
+			updates["status"] = models.RolloutTargetStatusFailed
+			updates["error"] = err.Error()
+			updates["finished_at"] = now
+			return s.db.Model(target).Updates(updates).Error
+		default:
+			return err
+		}
+	default:
+		return err
+	}
+
+	updates["deployment_id"] = deployment.ID
+	updates["status"] = models.RolloutTargetStatusDeploying
+	if deployment.RunningVersion == rollout.Version {
+		updates["status"] = models.RolloutTargetStatusSucceeded
+		updates["finished_at"] = now
+	}
+	return s.db.Model(target).Updates(updates).Error
+}
+
+// checkRelease returns an error unless version is a published or staged
+// release of a published metered agent
+func (s *FleetRolloutService) checkRelease(agentID uuid.UUID, version string) error {
+	var agent models.Agent
+	if err := s.db.Select("id", "pricing_model").Where("id = ? AND status = ?", agentID, models.AgentStatusPublished).First(&agent).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return ErrAgentNotPurchasable
+		}
+		return err
+	}
+	if agent.PricingModel != models.PricingModelMetered {
+		return ErrAgentNotMetered
+	}
+
+	var release int64
+	if err := s.db.Model(&models.AgentVersion{}).
+		Where("agent_id = ? AND version = ? AND status IN ?", agentID, version,
+			[]models.AgentVersionStatus{models.AgentVersionStatusPublished, models.AgentVersionStatusStaged}).
+		Count(&release).Error; err != nil {
+		return err
+	}
+	if release == 0 {
+		return ErrVersionNotPublished
+	}
+	return nil
+}
+
+// rolloutDevices resolves the devices of a rollout, in the order given or,
+// for a group, in the order the devices were claimed
+func (s *FleetRolloutService) rolloutDevices(buyerID uuid.UUID, req FleetRolloutRequest) ([]string, error) {
+	group := strings.TrimSpace(req.Group)
+	if (len(req.DeviceIDs) > 0) == (group != "") {
+		return nil, ErrRolloutDevices
+	}
+
+	requested := req.DeviceIDs
+	if group != "" {
+		if err := s.db.Table("device_claims").
+			Joins("JOIN devices ON devices.id = device_claims.device_id").
+			Where("device_claims.user_id = ? AND device_claims.device_group = ? AND device_claims.released_at IS NULL", buyerID, group).
+			Order("device_claims.claimed_at").
+			Pluck("devices.serial", &requested).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[string]bool, len(requested))
+	devices := make([]string, 0, len(requested))
+	for _, device := range requested {
+		device = strings.TrimSpace(device)
+		if device == "" || seen[device] {
+			continue
+		}
+		seen[device] = true
+		devices = append(devices, device)
+	}
+	if len(devices) == 0 {
+		return nil, ErrRolloutDevices
+	}
+	if len(devices) > s.cfg.MaxDevices {
+		return nil, ErrTooManyRolloutDevices
+	}
+	return devices, nil
+}
+
+// rolloutWaves returns the cumulative percentages of devices each wave
+// reaches
+func rolloutWaves(req FleetRolloutRequest) (models.Percentages, error) {
+	switch req.Strategy {
+	case models.RolloutStrategyImmediate:
+		return models.Percentages{100}, nil
+	case models.RolloutStrategyCanary:
+		if req.CanaryPercent < 1 || req.CanaryPercent > 99 {
+			return nil, ErrInvalidRolloutPlan
+		}
+		return models.Percentages{req.CanaryPercent, 100}, nil
+	case models.RolloutStrategyWaves:
+		if len(req.Waves) < 2 || len(req.Waves) > maxRolloutWaves || req.Waves[len(req.Waves)-1] != 100 {
+			return nil, ErrInvalidRolloutPlan
+		}
+		for i, percent := range req.Waves {
+			if percent < 1 || (i > 0 && percent <= req.Waves[i-1]) {
+				return nil, ErrInvalidRolloutPlan
+			}
+		}
+		return models.Percentages(req.Waves), nil
+	default:
+		return nil, ErrInvalidRolloutPlan
+	}
+}
+
+// settleRolloutTarget records the outcome of the release on a device that
+// is being rolled out to
+func settleRolloutTarget(tx *gorm.DB, deploymentID uuid.UUID, status models.RolloutTargetStatus, reason string) error {
+	return tx.Model(&models.FleetRolloutTarget{}).
+		Where("deployment_id = ? AND status = ?", deploymentID, models.RolloutTargetStatusDeploying).
+		Updates(map[string]interface{}{
+			"status":      status,
+			"error":       reason,
+			"finished_at": time.Now(),
+		}).Error
+}
+
+func fleetRolloutEvent(rollout *models.FleetRollout) map[string]interface{} {
+	return map[string]interface{}{
+		"rollout_id": rollout.ID,
+		"agent_id":   rollout.AgentID,
+		"version":    rollout.Version,
+		"wave":       rollout.CurrentWave,
+	}
+}
@@ -0,0 +1,361 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrPurchaseBlocked is returned when a fraud rule blocks a checkout
+	ErrPurchaseBlocked = errors.New("purchase blocked by fraud rules")
+	// ErrReviewClosed is returned when reviewing an assessment that is not pending review
+	ErrReviewClosed = errors.New("assessment is not pending review")
+	// ErrOutcomeRecorded is returned when an assessment already has an outcome
+	ErrOutcomeRecorded = errors.New("outcome already recorded")
+)
+
+// disposableEmailDomains are always matched by disposable_email rules
+var disposableEmailDomains = []string{
+	"10minutemail.com",
+	"dispostable.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"mailinator.com",
+	"sharklasers.com",
+	"temp-mail.org",
+	"tempmail.com",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+// FraudInput is the checkout data fraud rules are evaluated against
+type FraudInput struct {
+	CheckoutSessionID uuid.UUID
+	BuyerID           uuid.UUID
+	Email             string
+	IP                string
+	IPCountry         string
+	BillingCountry    string
+}
+
+// FraudService evaluates fraud rules on checkouts and manages held purchases
+type FraudService struct {
+	db  *gorm.DB
+	cfg config.FraudConfig
+}
+
+// NewFraudService creates a new fraud service
+func NewFraudService(db *gorm.DB, cfg config.FraudConfig) *FraudService {
+	return &FraudService{db: db, cfg: cfg}
+}
+
+// Evaluate runs the enabled rules against a checkout. The returned assessment
+// carries the most severe action of the matching rules and is not saved yet.
+// It returns nil when fraud checks are disabled.
+func (s *FraudService) Evaluate(in FraudInput) (*models.FraudAssessment, error) {
+	if !s.cfg.Enabled {
+		return nil, nil
+	}
+
+	var rules []models.FraudRule
+	if err := s.db.Where("enabled = ?", true).Order("created_at").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+
+	assessment := &models.FraudAssessment{
+		CheckoutSessionID: in.CheckoutSessionID,
+		BuyerID:           in.BuyerID,
+		IP:                in.IP,
+		IPCountry:         strings.ToUpper(in.IPCountry),
+		BillingCountry:    strings.ToUpper(in.BillingCountry),
+		Decision:          models.FraudActionAllow,
+		ReviewStatus:      models.FraudReviewStatusNone,
+	}
+	for _, rule := range rules {
+		matched, err := s.matches(&rule, in)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.ID, err)
+		}
+		if !matched {
+			continue
+		}
+		assessment.MatchedRules = append(assessment.MatchedRules, rule)
+		if actionSeverity(rule.Action) > actionSeverity(assessment.Decision) {
+			assessment.Decision = rule.Action
+		}
+	}
+	if assessment.Decision == models.FraudActionReview {
+		assessment.ReviewStatus = models.FraudReviewStatusPending
+	}
+	return assessment, nil
+}
+
+// Record saves an assessment and counts the rule matches
+func (s *FraudService) Record(tx *gorm.DB, assessment *models.FraudAssessment) error {
+	if err := tx.Omit("MatchedRules.*").Create(assessment).Error; err != nil {
+		return err
+	}
+	if len(assessment.MatchedRules) == 0 {
+		return nil
+	}
+	return tx.Model(&models.FraudRule{}).
+		Where("id IN ?", matchedRuleIDs(assessment)).
+		Update("matches", gorm.Expr("matches + 1")).Error
+}
+
+// matches reports whether a checkout matches a rule
+func (s *FraudService) matches(rule *models.FraudRule, in FraudInput) (bool, error) {
+	switch rule.Type {
+	case models.FraudRuleTypeVelocity:
+		window, err := time.ParseDuration(rule.Params.Window)
+		if err != nil {
+			return false, err
+		}
+		query := s.db.Model(&models.FraudAssessment{}).Where("created_at >= ?", time.Now().Add(-window))
+		if rule.Params.Scope == "ip" {
+			if in.IP == "" {
+				return false, nil
+			}
+			query = query.Where("ip = ?", in.IP)
+		} else {
+			query = query.Where("buyer_id = ?", in.BuyerID)
+		}
+		var recent int64
+		if err := query.Count(&recent).Error; err != nil {
+			return false, err
+		}
+		return recent >= int64(rule.Params.Max), nil
+
+	case models.FraudRuleTypeCountryMismatch:
+		if in.IPCountry == "" || in.BillingCountry == "" {
+			return false, nil
+		}
+		return !strings.EqualFold(in.IPCountry, in.BillingCountry), nil
+
+	case models.FraudRuleTypeDisposableEmail:
+		_, domain, ok := strings.Cut(strings.ToLower(in.Email), "@")
+		if !ok {
+			return false, nil
+		}
+		return containsDomain(disposableEmailDomains, domain) || containsDomain(rule.Params.Domains, domain), nil
+	}
+	return false, fmt.Errorf("unknown rule type %s", rule.Type)
+}
+
+// containsDomain reports whether domains contains domain, ignoring case
+func containsDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// actionSeverity orders actions from least to most restrictive
+func actionSeverity(action models.FraudAction) int {
+	switch action {
+	case models.FraudActionReview:
+		return 1
+	case models.FraudActionBlock:
+		return 2
+	}
+	return 0
+}
+
+// ValidateRule checks a rule's type, action and parameters
+func (s *FraudService) ValidateRule(rule *models.FraudRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	switch rule.Action {
+	case models.FraudActionAllow, models.FraudActionReview, models.FraudActionBlock:
+	default:
+		return fmt.Errorf("unsupported action: %s", rule.Action)
+	}
+
+	switch rule.Type {
+	case models.FraudRuleTypeVelocity:
+		if rule.Params.Scope != "buyer" && rule.Params.Scope != "ip" {
+			return fmt.Errorf("velocity scope must be buyer or ip")
+		}
+		if rule.Params.Max <= 0 {
+			return fmt.Errorf("velocity max must be positive")
+		}
+		if window, err := time.ParseDuration(rule.Params.Window); err != nil || window <= 0 {
+			return fmt.Errorf("velocity window must be a positive duration")
+		}
+	case models.FraudRuleTypeCountryMismatch, models.FraudRuleTypeDisposableEmail:
+	default:
+		return fmt.Errorf("unsupported rule type: %s", rule.Type)
+	}
+	return nil
+}
+
+// GetRules returns all fraud rules
+func (s *FraudService) GetRules() ([]models.FraudRule, error) {
+	var rules []models.FraudRule
+	err := s.db.Order("created_at").Find(&rules).Error
+	return rules, err
+}
+
+// CreateRule creates a fraud rule
+func (s *FraudService) CreateRule(rule *models.FraudRule) error {
+	if err := s.ValidateRule(rule); err != nil {
+		return err
+	}
+	return s.db.Create(rule).Error
+}
+
+// UpdateRule replaces a rule's settings, keeping its feedback counters
+func (s *FraudService) UpdateRule(rule *models.FraudRule) error {
+	if err := s.ValidateRule(rule); err != nil {
+		return err
+	}
+	result := s.db.Model(rule).Select("name", "type", "params", "action", "enabled").Updates(rule)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+// DeleteRule soft-deletes a fraud rule so past assessments keep their matches
+func (s *FraudService) DeleteRule(id uuid.UUID) error {
+	result := s.db.Delete(&models.FraudRule{}, "id = ?", id)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+// GetReviewQueue returns the assessments of purchases held for review, oldest first
+func (s *FraudService) GetReviewQueue(page, limit int) ([]models.FraudAssessment, int64, error) {
+	var assessments []models.FraudAssessment
+	var total int64
+
+	query := s.db.Model(&models.FraudAssessment{}).Where("review_status = ?", models.FraudReviewStatusPending)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Preload("MatchedRules").Preload("Purchase").Preload("Buyer").
+		Order("created_at").Offset(offset).Limit(limit).Find(&assessments).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return assessments, total, nil
+}
+
+// ReviewPurchase releases or rejects a held purchase. The decision is also
+// recorded as the assessment's outcome.
+func (s *FraudService) ReviewPurchase(id, reviewerID uuid.UUID, approve bool, notes string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var assessment models.FraudAssessment
+		if err := tx.Preload("MatchedRules").First(&assessment, "id = ?", id).Error; err != nil {
+			return err
+		}
+		if assessment.ReviewStatus != models.FraudReviewStatusPending {
+			return ErrReviewClosed
+		}
+
+		status, purchaseStatus, outcome := models.FraudReviewStatusApproved, models.PurchaseStatusPending, models.FraudOutcomeLegitimate
+		if !approve {
+			status, purchaseStatus, outcome = models.FraudReviewStatusRejected, models.PurchaseStatusFailed, models.FraudOutcomeFraud
+		}
+
+		now := time.Now()
+		if err := tx.Model(&assessment).Updates(map[string]interface{}{
+			"review_status": status,
+			"reviewed_by":   reviewerID,
+			"reviewed_at":   now,
+			"notes":         notes,
+		}).Error; err != nil {
+			return err
+		}
+		if assessment.PurchaseID != nil {
+			var purchase models.Purchase
+			if err := tx.First(&purchase, "id = ?", *assessment.PurchaseID).Error; err != nil {
+				return err
+			}
+			if approve && purchase.CreditApplied > 0 && purchase.CreditApplied == purchase.Amount {
+				// Paid in full from credit, so there is no payment to wait for
+				purchaseStatus = models.PurchaseStatusCompleted
+			}
+			result := tx.Model(&models.Purchase{}).
+				Where("id = ? AND status = ?", purchase.ID, models.PurchaseStatusOnHold).
+				Update("status", purchaseStatus)
+			if result.Error != nil {
+				return result.Error
+			}
+			if !approve && result.RowsAffected > 0 {
+				if err := refundCredit(tx, &purchase, "Purchase cancelled"); err != nil {
+					return err
+				}
+			}
+			if approve && result.RowsAffected > 0 {
+				var agent models.Agent
+				if err := tx.Select("id", "name", "publisher_id").First(&agent, "id = ?", purchase.AgentID).Error; err != nil {
+					return err
+				}
+				if err := notifySale(tx, &agent, &purchase); err != nil {
+					return err
+				}
+			}
+		}
+		return s.recordOutcome(tx, &assessment, outcome)
+	})
+}
+
+// RecordOutcome records whether an assessed checkout turned out to be fraud,
+// e.g. after a chargeback, and updates the matched rules' feedback counters
+func (s *FraudService) RecordOutcome(id uuid.UUID, outcome models.FraudOutcome) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var assessment models.FraudAssessment
+		if err := tx.Preload("MatchedRules").First(&assessment, "id = ?", id).Error; err != nil {
+			return err
+		}
+		return s.recordOutcome(tx, &assessment, outcome)
+	})
+}
+
+// recordOutcome stores an assessment's outcome once
+func (s *FraudService) recordOutcome(tx *gorm.DB, assessment *models.FraudAssessment, outcome models.FraudOutcome) error {
+	result := tx.Model(&models.FraudAssessment{}).
+		Where("id = ? AND (outcome IS NULL OR outcome = '')", assessment.ID).
+		Update("outcome", outcome)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrOutcomeRecorded
+	}
+	if len(assessment.MatchedRules) == 0 {
+		return nil
+	}
+
+	counter := "false_positives"
+	if outcome == models.FraudOutcomeFraud {
+		counter = "confirmed_fraud"
+	}
+	return tx.Model(&models.FraudRule{}).
+		Where("id IN ?", matchedRuleIDs(assessment)).
+		Update(counter, gorm.Expr(counter+" + 1")).Error
+}
+
+// matchedRuleIDs returns the IDs of the rules an assessment matched
+func matchedRuleIDs(assessment *models.FraudAssessment) []uuid.UUID {
+	ids := make([]uuid.UUID, len(assessment.MatchedRules))
+	for i, rule := range assessment.MatchedRules {
+		ids[i] = rule.ID
+	}
+	return ids
+}
@@ -0,0 +1,215 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// ErrInvalidHistory is returned for a signed history that was not signed by
+// the marketplace or was altered
+var ErrInvalidHistory = errors.New("signed history is not valid")
+
+// History is a user's purchase, entitlement and review record, meant to be
+// attached to compliance audits
+type History struct {
+	UserID       uuid.UUID            `json:"user_id"`
+	Email        string               `json:"email"`
+	Company      string               `json:"company,omitempty"`
+	GeneratedAt  time.Time            `json:"generated_at"`
+	Purchases    []HistoryPurchase    `json:"purchases"`
+	Entitlements []HistoryEntitlement `json:"entitlements"`
+	Reviews      []HistoryReview      `json:"reviews"`
+}
+
+// HistoryPurchase is one purchase in a user's history
+type HistoryPurchase struct {
+	ID          uuid.UUID `json:"id"`
+	AgentID     uuid.UUID `json:"agent_id"`
+	AgentName   string    `json:"agent_name"`
+	Publisher   string    `json:"publisher"`
+	AmountMinor int64     `json:"amount_minor"`
+	Amount      string    `json:"amount"`
+	Currency    string    `json:"currency"`
+	Status      string    `json:"status"`
+	PurchasedAt time.Time `json:"purchased_at"`
+}
+
+// HistoryEntitlement is an agent the user may currently download, through
+// a completed purchase or an active metered deployment
+type HistoryEntitlement struct {
+	AgentID   uuid.UUID `json:"agent_id"`
+	AgentName string    `json:"agent_name"`
+	Publisher string    `json:"publisher"`
+	Source    string    `json:"source"` // "purchase" or "metered"
+	Since     time.Time `json:"since"`
+}
+
+// HistoryReview is one review the user wrote
+type HistoryReview struct {
+	ID        uuid.UUID `json:"id"`
+	AgentID   uuid.UUID `json:"agent_id"`
+	AgentName string    `json:"agent_name"`
+	Version   string    `json:"version,omitempty"`
+	Rating    int       `json:"rating"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HistoryClaims are the claims of a signed history: the whole document
+type HistoryClaims struct {
+	History History `json:"history"`
+	jwt.RegisteredClaims
+}
+
+// HistoryService builds users' history documents and signs them with the
+// marketplace signing key, so auditors can check they were not edited
+type HistoryService struct {
+	db     *gorm.DB
+	signer Signer
+	issuer string
+}
+
+// NewHistoryService creates a new history service
+func NewHistoryService(db *gorm.DB, signer Signer, issuer string) *HistoryService {
+	return &HistoryService{db: db, signer: signer, issuer: issuer}
+}
+
+// GetHistory builds the history document of a user as of now
+func (s *HistoryService) GetHistory(userID uuid.UUID) (*History, error) {
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return nil, err
+	}
+
+	history := &History{
+		UserID:       user.ID,
+		Email:        user.Email,
+		Company:      user.Company,
+		GeneratedAt:  time.Now().UTC().Truncate(time.Second),
+		Purchases:    []HistoryPurchase{},
+		Entitlements: []HistoryEntitlement{},
+		Reviews:      []HistoryReview{},
+	}
+
+	// Agents removed from the catalog since still belong in the record
+	unscoped := func(db *gorm.DB) *gorm.DB { return db.Unscoped() }
+
+	var purchases []models.Purchase
+	if err := s.db.Preload("Agent", unscoped).Preload("Agent.Publisher", unscoped).
+		Where("buyer_id = ?", userID).
+		Order("created_at").
+		Find(&purchases).Error; err != nil {
+		return nil, err
+	}
+	for _, p := range purchases {
+		history.Purchases = append(history.Purchases, HistoryPurchase{
+			ID:          p.ID,
+			AgentID:     p.AgentID,
+			AgentName:   p.Agent.Name,
+			Publisher:   publisherName(&p.Agent.Publisher),
+			AmountMinor: int64(p.Amount),
+			Amount:      models.FormatMoney(p.Amount, p.Currency),
+			Currency:    p.Currency,
+			Status:      string(p.Status),
+			PurchasedAt: p.CreatedAt.UTC(),
+		})
+		if p.Status == models.PurchaseStatusCompleted {
+			history.Entitlements = append(history.Entitlements, HistoryEntitlement{
+				AgentID:   p.AgentID,
+				AgentName: p.Agent.Name,
+				Publisher: publisherName(&p.Agent.Publisher),
+				Source:    "purchase",
+				Since:     p.CreatedAt.UTC(),
+			})
+		}
+	}
+
+	var deployments []models.Deployment
+	if err := s.db.Preload("Agent", unscoped).Preload("Agent.Publisher", unscoped).
+		Where("buyer_id = ? AND decommissioned_at IS NULL", userID).
+		Order("created_at").
+		Find(&deployments).Error; err != nil {
+		return nil, err
+	}
+	metered := make(map[uuid.UUID]bool)
+	for _, d := range deployments {
+		if metered[d.AgentID] {
+			continue
+		}
+		metered[d.AgentID] = true
+		history.Entitlements = append(history.Entitlements, HistoryEntitlement{
+			AgentID:   d.AgentID,
+			AgentName: d.Agent.Name,
+			Publisher: publisherName(&d.Agent.Publisher),
+			Source:    "metered",
+			Since:     d.CreatedAt.UTC(),
+		})
+	}
+
+	var reviews []models.Review
+	if err := s.db.Preload("Agent", unscoped).
+		Where("user_id = ?", userID).
+		Order("created_at").
+		Find(&reviews).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range reviews {
+		history.Reviews = append(history.Reviews, HistoryReview{
+			ID:        r.ID,
+			AgentID:   r.AgentID,
+			AgentName: r.Agent.Name,
+			Version:   r.Version,
+			Rating:    r.Rating,
+			Comment:   r.Comment,
+			CreatedAt: r.CreatedAt.UTC(),
+		})
+	}
+
+	return history, nil
+}
+
+// Sign returns a history as a JWS token signed with the marketplace key.
+// The token's payload holds the document itself.
+func (s *HistoryService) Sign(history *History) (string, error) {
+	claims := HistoryClaims{
+		History: *history,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   s.issuer,
+			Subject:  history.UserID.String(),
+			IssuedAt: jwt.NewNumericDate(history.GeneratedAt),
+		},
+	}
+
+	token := jwt.NewWithClaims(signerMethod{}, claims)
+	token.Header["kid"] = s.signer.KeyID()
+	return token.SignedString(s.signer)
+}
+
+// Verify checks a signed history and returns the document it holds
+func (s *HistoryService) Verify(tokenString string) (*History, error) {
+	claims := &HistoryClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if kid, _ := token.Header["kid"].(string); kid != s.signer.KeyID() {
+			return nil, errors.New("unknown signing key")
+		}
+		return s.signer.Public(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}), jwt.WithIssuer(s.issuer))
+	if err != nil {
+		return nil, ErrInvalidHistory
+	}
+	return &claims.History, nil
+}
+
+// publisherName is how a publisher is named in documents for third parties
+func publisherName(publisher *models.User) string {
+	if publisher.Company != "" {
+		return publisher.Company
+	}
+	return publisher.Username
+}
@@ -0,0 +1,487 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// ErrAgentActive is returned when keeping an agent that is neither flagged
+// as unsold nor archived for it
+var ErrAgentActive = errors.New("agent is not flagged as unsold or archived for inactivity")
+
+// HousekeepingService keeps publishers' catalogs tidy. It flags drafts
+// nobody has worked on for a while, tells their publisher and, if
+// configured, archives them; does the same for published agents nobody
+// downloads; and it reports what a publisher's agents are missing.
+type HousekeepingService struct {
+	db     *gorm.DB
+	cfg    config.StaleDraftsConfig
+	unsold config.UnsoldAgentsConfig
+	agents *AgentService
+}
+
+// NewHousekeepingService creates a new housekeeping service
+func NewHousekeepingService(db *gorm.DB, cfg config.StaleDraftsConfig, unsold config.UnsoldAgentsConfig, agents *AgentService) *HousekeepingService {
+	return &HousekeepingService{db: db, cfg: cfg, unsold: unsold, agents: agents}
+}
+
+// Run processes stale drafts, unless the scheduler does, and unsold agents
+// if that policy is enabled, every poll interval until ctx is done
+func (s *HousekeepingService) Run(ctx context.Context, staleDrafts bool) {
+	var drafts <-chan time.Time
+	if staleDrafts {
+		ticker := time.NewTicker(s.cfg.PollInterval)
+		defer ticker.Stop()
+		drafts = ticker.C
+	}
+
+	var unsold <-chan time.Time
+	if s.unsold.After > 0 {
+		unsoldTicker := time.NewTicker(s.unsold.PollInterval)
+		defer unsoldTicker.Stop()
+		unsold = unsoldTicker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-drafts:
+			if err := s.ProcessStaleDrafts(); err != nil {
+				log.Error().Err(err).Msg("Failed to process stale drafts")
+			}
+		case <-unsold:
+			if err := s.ProcessUnsoldAgents(); err != nil {
+				log.Error().Err(err).Msg("Failed to process unsold agents")
+			}
+		}
+	}
+}
+
+// ProcessStaleDrafts clears the flag of drafts edited since they were
+// flagged, flags drafts untouched for the configured age, and archives
+// drafts flagged for longer than the archive delay
+func (s *HousekeepingService) ProcessStaleDrafts() error {
+	if err := s.clearTouched(); err != nil {
+		return err
+	}
+	if err := s.flagStale(); err != nil {
+		return err
+	}
+	if s.cfg.ArchiveAfter > 0 {
+		return s.archiveStale()
+	}
+	return nil
+}
+
+// untouchedSince narrows a query on agents to those neither edited nor
+// given a new version since cutoff
+func untouchedSince(query *gorm.DB, cutoff time.Time) *gorm.DB {
+	return query.Where("agents.updated_at < ?", cutoff).
+		Where("NOT EXISTS (SELECT 1 FROM agent_versions WHERE agent_versions.agent_id = agents.id AND agent_versions.created_at >= ?)", cutoff)
+}
+
+func (s *HousekeepingService) clearTouched() error {
+	var ids []uuid.UUID
+	if err := s.db.Model(&models.Agent{}).
+		Where("stale_since IS NOT NULL").
+		Where("status <> ? OR updated_at > stale_since OR EXISTS (SELECT 1 FROM agent_versions WHERE agent_versions.agent_id = agents.id AND agent_versions.created_at > agents.stale_since)",
+			models.AgentStatusDraft).
+		Limit(s.cfg.BatchSize).
+		Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := s.db.Model(&models.Agent{}).Where("id IN ?", ids).UpdateColumn("stale_since", nil).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		s.agents.InvalidateAgent(id)
+	}
+	return nil
+}
+
+func (s *HousekeepingService) flagStale() error {
+	var drafts []models.Agent
+	if err := untouchedSince(s.db.Model(&models.Agent{}), time.Now().Add(-s.cfg.After)).
+		Where("agents.status = ? AND agents.stale_since IS NULL", models.AgentStatusDraft).
+		Order("agents.updated_at").
+		Limit(s.cfg.BatchSize).
+		Find(&drafts).Error; err != nil {
+		return err
+	}
+
+	for i := range drafts {
+		draft := &drafts[i]
+		now := time.Now()
+		body := fmt.Sprintf("%s has not been edited for %d days.", draft.Name, int(s.cfg.After.Hours()/24))
+		if s.cfg.ArchiveAfter > 0 {
+			body += fmt.Sprintf(" It will be archived on %s unless you update it.", now.Add(s.cfg.ArchiveAfter).Format("2006-01-02"))
+		}
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&models.Agent{}).Where("id = ? AND stale_since IS NULL", draft.ID).UpdateColumn("stale_since", now)
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			return notify(tx, &models.Notification{
+				UserID: draft.PublisherID,
+				Type:   models.NotificationTypeStaleDraft,
+				Title:  "Your draft " + draft.Name + " looks abandoned",
+				Body:   body,
+				Link:   fmt.Sprintf("/agents/%s", draft.ID),
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("agent %s: %w", draft.ID, err)
+		}
+		s.agents.InvalidateAgent(draft.ID)
+	}
+	return nil
+}
+
+func (s *HousekeepingService) archiveStale() error {
+	var drafts []models.Agent
+	if err := s.db.Model(&models.Agent{}).
+		Where("status = ? AND stale_since < ?", models.AgentStatusDraft, time.Now().Add(-s.cfg.ArchiveAfter)).
+		Order("stale_since").
+		Limit(s.cfg.BatchSize).
+		Find(&drafts).Error; err != nil {
+		return err
+	}
+
+	for i := range drafts {
+		draft := &drafts[i]
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			// Skipped if the publisher got back to it meanwhile
+			result := tx.Model(&models.Agent{}).
+				Where("id = ? AND status = ? AND updated_at = ?", draft.ID, models.AgentStatusDraft, draft.UpdatedAt).
+				Updates(map[string]interface{}{"status": models.AgentStatusArchived, "stale_since": nil})
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			return notify(tx, &models.Notification{
+				UserID: draft.PublisherID,
+				Type:   models.NotificationTypeStaleDraft,
+				Title:  "Your draft " + draft.Name + " was archived",
+				Body:   "Set its status back to draft to continue working on it.",
+				Link:   fmt.Sprintf("/agents/%s", draft.ID),
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("agent %s: %w", draft.ID, err)
+		}
+		s.agents.InvalidateAgent(draft.ID)
+	}
+	return nil
+}
+
+// ProcessUnsoldAgents clears the flag of agents downloaded or updated since
+// they were flagged, flags published agents without either for the
+// configured period, and archives agents flagged for longer than the grace
+// period
+func (s *HousekeepingService) ProcessUnsoldAgents() error {
+	if err := s.clearActive(); err != nil {
+		return err
+	}
+	if err := s.flagUnsold(); err != nil {
+		return err
+	}
+	return s.archiveUnsold()
+}
+
+// downloadedSince narrows a query on agents to those downloaded since
+// cutoff, or with NOT to those that were not
+const downloadedSince = "EXISTS (SELECT 1 FROM agent_downloads WHERE agent_downloads.agent_id = agents.id AND agent_downloads.created_at >= ?)"
+
+func (s *HousekeepingService) clearActive() error {
+	var ids []uuid.UUID
+	if err := s.db.Model(&models.Agent{}).
+		Where("inactive_since IS NOT NULL").
+		Where("status <> ? OR updated_at > inactive_since OR EXISTS (SELECT 1 FROM agent_versions WHERE agent_versions.agent_id = agents.id AND agent_versions.created_at > agents.inactive_since) OR "+
+			"EXISTS (SELECT 1 FROM agent_downloads WHERE agent_downloads.agent_id = agents.id AND agent_downloads.created_at > agents.inactive_since)",
+			models.AgentStatusPublished).
+		Limit(s.unsold.BatchSize).
+		Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	// An agent the publisher took out of the archive themselves can no
+	// longer be restored as if it had been archived for inactivity
+	var restored []uuid.UUID
+	if err := s.db.Model(&models.Agent{}).
+		Where("auto_archived_at IS NOT NULL AND status <> ?", models.AgentStatusArchived).
+		Limit(s.unsold.BatchSize).
+		Pluck("id", &restored).Error; err != nil {
+		return err
+	}
+
+	if len(ids) > 0 {
+		if err := s.db.Model(&models.Agent{}).Where("id IN ?", ids).UpdateColumn("inactive_since", nil).Error; err != nil {
+			return err
+		}
+	}
+	if len(restored) > 0 {
+		if err := s.db.Model(&models.Agent{}).Where("id IN ?", restored).UpdateColumn("auto_archived_at", nil).Error; err != nil {
+			return err
+		}
+	}
+	for _, id := range append(ids, restored...) {
+		s.agents.InvalidateAgent(id)
+	}
+	return nil
+}
+
+func (s *HousekeepingService) flagUnsold() error {
+	cutoff := time.Now().Add(-s.unsold.After)
+	var agents []models.Agent
+	if err := untouchedSince(s.db.Model(&models.Agent{}), cutoff).
+		Where("agents.status = ? AND agents.inactive_since IS NULL", models.AgentStatusPublished).
+		Where("agents.published_at IS NULL OR agents.published_at < ?", cutoff).
+		Where("NOT "+downloadedSince, cutoff).
+		Order("agents.updated_at").
+		Limit(s.unsold.BatchSize).
+		Find(&agents).Error; err != nil {
+		return err
+	}
+
+	days := int(s.unsold.After.Hours() / 24)
+	for i := range agents {
+		agent := &agents[i]
+		now := time.Now()
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&models.Agent{}).Where("id = ? AND inactive_since IS NULL", agent.ID).UpdateColumn("inactive_since", now)
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			return notify(tx, &models.Notification{
+				UserID: agent.PublisherID,
+				Type:   models.NotificationTypeUnsoldAgent,
+				Title:  agent.Name + " has had no downloads for " + fmt.Sprint(days) + " days",
+				Body: fmt.Sprintf("%s has had neither downloads nor updates for %d days. It will be archived on %s unless you update it or keep it listed.",
+					agent.Name, days, now.Add(s.unsold.GracePeriod).Format("2006-01-02")),
+				Link: fmt.Sprintf("/agents/%s", agent.ID),
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("agent %s: %w", agent.ID, err)
+		}
+		s.agents.InvalidateAgent(agent.ID)
+	}
+	return nil
+}
+
+func (s *HousekeepingService) archiveUnsold() error {
+	var agents []models.Agent
+	if err := s.db.Model(&models.Agent{}).
+		Where("status = ? AND inactive_since < ?", models.AgentStatusPublished, time.Now().Add(-s.unsold.GracePeriod)).
+		Order("inactive_since").
+		Limit(s.unsold.BatchSize).
+		Find(&agents).Error; err != nil {
+		return err
+	}
+
+	for i := range agents {
+		agent := &agents[i]
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			// Skipped if the publisher updated it meanwhile
+			result := tx.Model(&models.Agent{}).
+				Where("id = ? AND status = ? AND updated_at = ?", agent.ID, models.AgentStatusPublished, agent.UpdatedAt).
+				Where("NOT "+downloadedSince, *agent.InactiveSince).
+				Updates(map[string]interface{}{"status": models.AgentStatusArchived, "inactive_since": nil, "auto_archived_at": time.Now()})
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			return notify(tx, &models.Notification{
+				UserID: agent.PublisherID,
+				Type:   models.NotificationTypeUnsoldAgent,
+				Title:  agent.Name + " was archived",
+				Body:   "It is no longer listed. Its releases, purchases and reviews are kept, and you can restore it at any time.",
+				Link:   fmt.Sprintf("/agents/%s", agent.ID),
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("agent %s: %w", agent.ID, err)
+		}
+		s.agents.InvalidateAgent(agent.ID)
+	}
+	return nil
+}
+
+// KeepAgent undoes the unsold agent policy on an agent: a flagged agent
+// stays listed for another full period, and one archived for inactivity
+// is published again. Agents the publisher archived themselves are left
+// alone.
+func (s *HousekeepingService) KeepAgent(agent *models.Agent) error {
+	updates := map[string]interface{}{"inactive_since": nil}
+	query := s.db.Model(&models.Agent{}).Where("id = ?", agent.ID)
+	switch {
+	case agent.Status == models.AgentStatusPublished && agent.InactiveSince != nil:
+		query = query.Where("status = ? AND inactive_since IS NOT NULL", models.AgentStatusPublished)
+	case agent.Status == models.AgentStatusArchived && agent.AutoArchivedAt != nil:
+		if err := s.agents.tiers.CheckPublishLimit(agent.PublisherID); err != nil {
+			return err
+		}
+		query = query.Where("status = ? AND auto_archived_at IS NOT NULL", models.AgentStatusArchived)
+		updates["status"] = models.AgentStatusPublished
+		updates["auto_archived_at"] = nil
+	default:
+		return ErrAgentActive
+	}
+
+	// Updates also sets updated_at, which restarts the inactivity period
+	result := query.Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAgentActive
+	}
+	s.agents.InvalidateAgent(agent.ID)
+	return nil
+}
+
+// UnsoldAgent is a published agent flagged for having no downloads or
+// updates, and when it will be archived
+type UnsoldAgent struct {
+	AgentID       uuid.UUID `json:"agent_id"`
+	Name          string    `json:"name"`
+	InactiveSince time.Time `json:"inactive_since"`
+	ArchiveAt     time.Time `json:"archive_at"`
+}
+
+// StaleDraft is a draft left untouched, and when it will be archived
+type StaleDraft struct {
+	AgentID    uuid.UUID  `json:"agent_id"`
+	Name       string     `json:"name"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	StaleSince *time.Time `json:"stale_since,omitempty"` // nil until the job flags it
+	ArchiveAt  *time.Time `json:"archive_at,omitempty"`
+}
+
+// MissingArtifacts lists the files an agent has not been given: binary,
+// manifest, readme or icon
+type MissingArtifacts struct {
+	AgentID uuid.UUID          `json:"agent_id"`
+	Name    string             `json:"name"`
+	Status  models.AgentStatus `json:"status"`
+	Missing []string           `json:"missing"`
+}
+
+// UndocumentedVersion is a release without a changelog
+type UndocumentedVersion struct {
+	AgentID   uuid.UUID                 `json:"agent_id"`
+	AgentName string                    `json:"agent_name"`
+	Version   string                    `json:"version"`
+	Status    models.AgentVersionStatus `json:"status"`
+}
+
+// HousekeepingReport is what needs attention in a publisher's catalog
+type HousekeepingReport struct {
+	StaleDrafts              []StaleDraft          `json:"stale_drafts"`
+	UnsoldAgents             []UnsoldAgent         `json:"unsold_agents"`
+	MissingArtifacts         []MissingArtifacts    `json:"missing_artifacts"`
+	VersionsWithoutChangelog []UndocumentedVersion `json:"versions_without_changelog"`
+}
+
+// GetReport returns the housekeeping report of the agents a user manages:
+// their own, and those of organizations where they are an owner or
+// maintainer. Archived agents are left out.
+func (s *HousekeepingService) GetReport(userID uuid.UUID) (*HousekeepingReport, error) {
+	orgs := s.db.Model(&models.Membership{}).Select("organization_id").
+		Where("user_id = ? AND role IN ?", userID, []models.OrgRole{models.OrgRoleOwner, models.OrgRoleMaintainer})
+	managed := func() *gorm.DB {
+		return s.db.Model(&models.Agent{}).
+			Where("(agents.publisher_id = ? OR agents.organization_id IN (?))", userID, orgs).
+			Where("agents.status <> ?", models.AgentStatusArchived)
+	}
+	report := &HousekeepingReport{
+		StaleDrafts:              []StaleDraft{},
+		UnsoldAgents:             []UnsoldAgent{},
+		MissingArtifacts:         []MissingArtifacts{},
+		VersionsWithoutChangelog: []UndocumentedVersion{},
+	}
+
+	var drafts []models.Agent
+	if err := managed().
+		Where("agents.status = ?", models.AgentStatusDraft).
+		Where(untouchedSince(s.db, time.Now().Add(-s.cfg.After)).Or("agents.stale_since IS NOT NULL")).
+		Order("agents.updated_at").
+		Find(&drafts).Error; err != nil {
+		return nil, err
+	}
+	for _, draft := range drafts {
+		stale := StaleDraft{AgentID: draft.ID, Name: draft.Name, UpdatedAt: draft.UpdatedAt, StaleSince: draft.StaleSince}
+		if draft.StaleSince != nil && s.cfg.ArchiveAfter > 0 {
+			archiveAt := draft.StaleSince.Add(s.cfg.ArchiveAfter)
+			stale.ArchiveAt = &archiveAt
+		}
+		report.StaleDrafts = append(report.StaleDrafts, stale)
+	}
+
+	var unsold []models.Agent
+	if err := managed().
+		Where("agents.status = ? AND agents.inactive_since IS NOT NULL", models.AgentStatusPublished).
+		Order("agents.inactive_since").
+		Find(&unsold).Error; err != nil {
+		return nil, err
+	}
+	for _, agent := range unsold {
+		report.UnsoldAgents = append(report.UnsoldAgents, UnsoldAgent{
+			AgentID:       agent.ID,
+			Name:          agent.Name,
+			InactiveSince: *agent.InactiveSince,
+			ArchiveAt:     agent.InactiveSince.Add(s.unsold.GracePeriod),
+		})
+	}
+
+	var agents []models.Agent
+	if err := managed().
+		Where("agents.binary_url = '' OR agents.manifest_url = '' OR agents.readme_url = '' OR agents.icon_url = ''").
+		Order("agents.name").
+		Find(&agents).Error; err != nil {
+		return nil, err
+	}
+	for _, agent := range agents {
+		missing := []string{}
+		for _, artifact := range []struct {
+			name string
+			url  string
+		}{
+			{"binary", agent.BinaryURL},
+			{"manifest", agent.ManifestURL},
+			{"readme", agent.ReadmeURL},
+			{"icon", agent.IconURL},
+		} {
+			if artifact.url == "" {
+				missing = append(missing, artifact.name)
+			}
+		}
+		report.MissingArtifacts = append(report.MissingArtifacts, MissingArtifacts{
+			AgentID: agent.ID,
+			Name:    agent.Name,
+			Status:  agent.Status,
+			Missing: missing,
+		})
+	}
+
+	if err := s.db.Model(&models.AgentVersion{}).
+		Select("agent_versions.agent_id, agents.name AS agent_name, agent_versions.version, agent_versions.status").
+		Joins("JOIN agents ON agents.id = agent_versions.agent_id").
+		Where("agent_versions.agent_id IN (?)", managed().Select("agents.id")).
+		Where("TRIM(agent_versions.changelog) = '' OR agent_versions.changelog IS NULL").
+		Order("agents.name, agent_versions.created_at").
+		Scan(&report.VersionsWithoutChangelog).Error; err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,530 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// The job keys share a hash tag so scripts can move jobs between them on a
+// Redis cluster
+const (
+	// jobsPending lists the jobs ready to run, oldest last
+	jobsPending = "{jobs}:pending"
+	// jobsScheduled holds failed jobs waiting for their retry, scored by
+	// when it is due in Unix milliseconds
+	jobsScheduled = "{jobs}:scheduled"
+	// jobsActive holds running jobs, scored by when their lease runs out
+	jobsActive = "{jobs}:active"
+	// jobsDead lists jobs out of attempts, newest first
+	jobsDead = "{jobs}:dead"
+	// jobLeaseGrace is added to a job's timeout before its lease runs out
+	// and another worker takes it over
+	jobLeaseGrace = 30 * time.Second
+	// jobReclaimBatch is how many due retries or expired leases are handled
+	// per poll
+	jobReclaimBatch = 100
+)
+
+var (
+	// ErrJobQueueUnavailable is returned when Redis is down
+	ErrJobQueueUnavailable = errors.New("job queue is unavailable")
+	// ErrUnknownJobType is returned for a job type without a handler
+	ErrUnknownJobType = errors.New("unknown job type")
+	// ErrDeadJobNotFound is returned when retrying a job that is not on the
+	// dead-letter list
+	ErrDeadJobNotFound = errors.New("dead job not found")
+
+	errJobLeaseExpired = errors.New("job lease expired, its worker stopped")
+)
+
+var (
+	jobsQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "edgeplug_jobs",
+		Help: "Jobs in the queue by state: pending, scheduled, active or dead",
+	}, []string{"state"})
+	jobsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeplug_job_attempts_total",
+		Help: "Finished job attempts by type and outcome: succeeded, retried or dead",
+	}, []string{"type", "outcome"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "edgeplug_job_duration_seconds",
+		Help:    "Time job attempts ran, by type",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"type"})
+	jobWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "edgeplug_job_wait_seconds",
+		Help:    "Time jobs waited for a worker after they were due, by type",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(jobsQueued, jobsFinished, jobDuration, jobWait)
+}
+
+// takeJob moves the oldest pending job to the active set, leased until
+// ARGV[1]
+var takeJob = redis.NewScript(`
+local job = redis.call('RPOP', KEYS[1])
+if job then
+	redis.call('ZADD', KEYS[2], ARGV[1], job)
+end
+return job
+`)
+
+// failJob takes the job ARGV[1] off the active set and adds it as ARGV[2]
+// to the scheduled set, due at ARGV[3], or with ARGV[3] of 0 to the
+// dead-letter list capped at ARGV[4]. It returns 0 if the job was not active,
+// having been taken over by another worker.
+var failJob = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+if ARGV[3] == '0' then
+	redis.call('LPUSH', KEYS[3], ARGV[2])
+	redis.call('LTRIM', KEYS[3], 0, tonumber(ARGV[4]) - 1)
+else
+	redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+end
+return 1
+`)
+
+// promoteJobs moves up to ARGV[2] jobs due by ARGV[1] from the scheduled
+// set to the pending list
+var promoteJobs = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, job in ipairs(due) do
+	redis.call('ZREM', KEYS[1], job)
+	redis.call('LPUSH', KEYS[2], job)
+end
+return #due
+`)
+
+// retryDeadJob moves the dead job ARGV[1] to the pending list as ARGV[2]
+var retryDeadJob = redis.NewScript(`
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+redis.call('LPUSH', KEYS[2], ARGV[2])
+return 1
+`)
+
+// Job is a unit of background work
+type Job struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempt   int             `json:"attempt"` // failed attempts so far
+	CreatedAt time.Time       `json:"created_at"`
+	DueAt     time.Time       `json:"due_at"`
+	Error     string          `json:"error,omitempty"` // of the last failed attempt
+	FailedAt  *time.Time      `json:"failed_at,omitempty"`
+}
+
+// JobHandler runs a job of a type. A job whose handler returns an error is
+// retried, unless the error is a PermanentJobError.
+type JobHandler func(ctx context.Context, payload json.RawMessage) error
+
+// JobOptions tune how jobs of a type run. Zero fields take the configured
+// defaults.
+type JobOptions struct {
+	Timeout      time.Duration // per attempt
+	MaxAttempts  int
+	RetryBackoff time.Duration // doubled after each failed attempt
+	// OnDead, if set, runs when a job of the type goes to the dead-letter
+	// list, such as to undo a claim made when it was queued
+	OnDead func(ctx context.Context, job Job)
+}
+
+// permanentJobError is a job failure that retrying cannot fix
+type permanentJobError struct {
+	err error
+}
+
+func (e permanentJobError) Error() string { return e.err.Error() }
+func (e permanentJobError) Unwrap() error { return e.err }
+
+// PermanentJobError marks a job failure that retrying cannot fix, such as a
+// malformed payload, so the job goes straight to the dead-letter list
+func PermanentJobError(err error) error {
+	return permanentJobError{err: err}
+}
+
+// JobStats is the number of jobs in each state
+type JobStats struct {
+	Pending   int64 `json:"pending"`
+	Scheduled int64 `json:"scheduled"` // failed and waiting for a retry
+	Active    int64 `json:"active"`
+	Dead      int64 `json:"dead"`
+}
+
+type jobType struct {
+	handler JobHandler
+	opts    JobOptions
+}
+
+// JobQueue runs background work outside requests. Jobs are queued in Redis
+// and run by workers in servers, with jobs.embedded, and in `marketplace
+// worker` processes. A job that fails is retried with exponential backoff
+// until it runs out of attempts and goes to the dead-letter list, where
+// admins can inspect and retry it. A job whose worker dies is retried once
+// its lease runs out, so handlers must tolerate running twice.
+type JobQueue struct {
+	redis *RedisService
+	cfg   config.JobsConfig
+
+	mu    sync.RWMutex
+	types map[string]jobType
+}
+
+// NewJobQueue creates a new job queue
+func NewJobQueue(redisSvc *RedisService, cfg config.JobsConfig) *JobQueue {
+	return &JobQueue{redis: redisSvc, cfg: cfg, types: map[string]jobType{}}
+}
+
+// Register sets the handler of a job type. Servers and workers must register
+// the same types, since any of them may run a job.
+func (q *JobQueue) Register(name string, opts JobOptions, handler JobHandler) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = q.cfg.Timeout
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = q.cfg.MaxAttempts
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = q.cfg.RetryBackoff
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.types[name] = jobType{handler: handler, opts: opts}
+}
+
+// jobType returns the handler and options of a job type
+func (q *JobQueue) jobType(name string) (jobType, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	t, ok := q.types[name]
+	return t, ok
+}
+
+// Enqueue queues a job to run as soon as a worker is free and returns its ID
+func (q *JobQueue) Enqueue(ctx context.Context, name string, payload interface{}) (string, error) {
+	if _, ok := q.jobType(name); !ok {
+		return "", ErrUnknownJobType
+	}
+	if !q.redis.Available() {
+		return "", ErrJobQueueUnavailable
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	job := Job{ID: models.NewID().String(), Type: name, Payload: raw, CreatedAt: now, DueAt: now}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+	if err := q.redis.Client().LPush(ctx, jobsPending, data).Err(); err != nil {
+		return "", err
+	}
+	return job.ID, nil
+}
+
+// Work runs jobs, jobs.concurrency at once, until ctx is done, then waits
+// for the running ones to finish
+func (q *JobQueue) Work(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < q.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	q.maintain(ctx)
+	wg.Wait()
+}
+
+// work runs one job after another, waiting a poll interval whenever the
+// queue is empty
+func (q *JobQueue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		ran, err := q.runNext(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to take job")
+		}
+		if ran {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(q.cfg.PollInterval):
+		}
+	}
+}
+
+// runNext takes the oldest pending job and runs it, reporting whether there
+// was one
+func (q *JobQueue) runNext(ctx context.Context) (bool, error) {
+	if !q.redis.Available() {
+		return false, nil
+	}
+	lease := time.Now().Add(jobLeaseGrace).UnixMilli()
+	raw, err := takeJob.Run(ctx, q.redis.Client(), []string{jobsPending, jobsActive}, lease).Text()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// A job taken is finished even when the worker is stopping
+	q.run(context.WithoutCancel(ctx), raw)
+	return true, nil
+}
+
+// run runs an active job and records its outcome
+func (q *JobQueue) run(ctx context.Context, raw string) {
+	client := q.redis.Client()
+	var job Job
+	if err := json.Unmarshal([]byte(raw), &job); err != nil {
+		log.Error().Err(err).Str("job", raw).Msg("Dropping malformed job")
+		client.ZRem(ctx, jobsActive, raw)
+		return
+	}
+
+	// Unknown types are retried, in case workers of a newer release know them
+	t, ok := q.jobType(job.Type)
+	timeout := q.cfg.Timeout
+	if ok {
+		timeout = t.opts.Timeout
+	}
+	lease := time.Now().Add(timeout + jobLeaseGrace).UnixMilli()
+	if err := client.ZAddXX(ctx, jobsActive, redis.Z{Score: float64(lease), Member: raw}).Err(); err != nil {
+		log.Warn().Err(err).Str("job_id", job.ID).Msg("Failed to extend job lease")
+	}
+	jobWait.WithLabelValues(job.Type).Observe(time.Since(job.DueAt).Seconds())
+
+	start := time.Now()
+	err := ErrUnknownJobType
+	if ok {
+		runCtx, cancel := context.WithTimeout(ctx, timeout)
+		err = callJobHandler(runCtx, t.handler, job.Payload)
+		cancel()
+	}
+	jobDuration.WithLabelValues(job.Type).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		q.fail(ctx, job, raw, err)
+		return
+	}
+	removed, zremErr := client.ZRem(ctx, jobsActive, raw).Result()
+	switch {
+	case zremErr != nil:
+		log.Error().Err(zremErr).Str("job_id", job.ID).Msg("Failed to complete job, it will run again")
+	case removed == 0:
+		log.Warn().Str("job_id", job.ID).Str("type", job.Type).Msg("Job finished after its lease ran out and was retried")
+	}
+	jobsFinished.WithLabelValues(job.Type, "succeeded").Inc()
+}
+
+// callJobHandler runs a handler, turning a panic into an error
+func callJobHandler(ctx context.Context, handler JobHandler, payload json.RawMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx, payload)
+}
+
+// fail schedules the retry of a failed job, or moves it to the dead-letter
+// list once out of attempts. It does nothing if another worker took the job
+// over meanwhile.
+func (q *JobQueue) fail(ctx context.Context, job Job, raw string, cause error) {
+	opts := JobOptions{MaxAttempts: q.cfg.MaxAttempts, RetryBackoff: q.cfg.RetryBackoff}
+	if t, ok := q.jobType(job.Type); ok {
+		opts = t.opts
+	}
+	now := time.Now().UTC()
+	job.Attempt++
+	job.Error = cause.Error()
+	job.FailedAt = &now
+
+	var permanent permanentJobError
+	dead := job.Attempt >= opts.MaxAttempts || errors.As(cause, &permanent)
+	var retryAt int64
+	if !dead {
+		backoff := opts.RetryBackoff
+		for i := 1; i < job.Attempt && backoff < q.cfg.MaxBackoff; i++ {
+			backoff *= 2
+		}
+		job.DueAt = now.Add(min(backoff, q.cfg.MaxBackoff))
+		retryAt = job.DueAt.UnixMilli()
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		log.Error().Err(err).Str("job_id", job.ID).Msg("Failed to encode failed job")
+		return
+	}
+
+	moved, err := failJob.Run(ctx, q.redis.Client(), []string{jobsActive, jobsScheduled, jobsDead},
+		raw, data, retryAt, q.cfg.DeadLetterMax).Int()
+	if err != nil {
+		log.Error().Err(err).Str("job_id", job.ID).Msg("Failed to record job failure")
+		return
+	}
+	if moved == 0 {
+		return
+	}
+
+	event := log.Warn()
+	outcome := "retried"
+	if dead {
+		event = log.Error()
+		outcome = "dead"
+	}
+	event.Err(cause).Str("job_id", job.ID).Str("type", job.Type).Int("attempt", job.Attempt).Bool("dead", dead).Msg("Job failed")
+	jobsFinished.WithLabelValues(job.Type, outcome).Inc()
+	if dead && opts.OnDead != nil {
+		opts.OnDead(ctx, job)
+	}
+}
+
+// maintain queues due retries, takes back jobs whose lease ran out and
+// updates the queue metrics every poll interval until ctx is done
+func (q *JobQueue) maintain(ctx context.Context) {
+	ticker := time.NewTicker(q.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !q.redis.Available() {
+				continue
+			}
+			now := time.Now().UnixMilli()
+			if err := promoteJobs.Run(ctx, q.redis.Client(), []string{jobsScheduled, jobsPending}, now, jobReclaimBatch).Err(); err != nil {
+				log.Error().Err(err).Msg("Failed to queue due job retries")
+			}
+			if err := q.reclaim(ctx, now); err != nil {
+				log.Error().Err(err).Msg("Failed to take back expired jobs")
+			}
+			if stats, err := q.Stats(ctx); err == nil {
+				jobsQueued.WithLabelValues("pending").Set(float64(stats.Pending))
+				jobsQueued.WithLabelValues("scheduled").Set(float64(stats.Scheduled))
+				jobsQueued.WithLabelValues("active").Set(float64(stats.Active))
+				jobsQueued.WithLabelValues("dead").Set(float64(stats.Dead))
+			}
+		}
+	}
+}
+
+// reclaim fails the active jobs whose lease ran out by now, in Unix
+// milliseconds, because their worker stopped
+func (q *JobQueue) reclaim(ctx context.Context, now int64) error {
+	expired, err := q.redis.Client().ZRangeByScore(ctx, jobsActive, &redis.ZRangeBy{
+		Min: "-inf", Max: fmt.Sprint(now), Count: jobReclaimBatch,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, raw := range expired {
+		var job Job
+		if err := json.Unmarshal([]byte(raw), &job); err != nil {
+			q.redis.Client().ZRem(ctx, jobsActive, raw)
+			continue
+		}
+		q.fail(ctx, job, raw, errJobLeaseExpired)
+	}
+	return nil
+}
+
+// Stats returns the number of jobs in each state
+func (q *JobQueue) Stats(ctx context.Context) (*JobStats, error) {
+	if !q.redis.Available() {
+		return nil, ErrJobQueueUnavailable
+	}
+	var pending, scheduled, active, dead *redis.IntCmd
+	if _, err := q.redis.Client().Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pending = pipe.LLen(ctx, jobsPending)
+		scheduled = pipe.ZCard(ctx, jobsScheduled)
+		active = pipe.ZCard(ctx, jobsActive)
+		dead = pipe.LLen(ctx, jobsDead)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &JobStats{Pending: pending.Val(), Scheduled: scheduled.Val(), Active: active.Val(), Dead: dead.Val()}, nil
+}
+
+// DeadJobs returns up to limit jobs from the dead-letter list, newest first
+func (q *JobQueue) DeadJobs(ctx context.Context, limit int) ([]Job, error) {
+	if !q.redis.Available() {
+		return nil, ErrJobQueueUnavailable
+	}
+	raws, err := q.redis.Client().LRange(ctx, jobsDead, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(raws))
+	for _, raw := range raws {
+		var job Job
+		if err := json.Unmarshal([]byte(raw), &job); err != nil {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// RetryDead queues a dead job, or with id "all" every dead job, to run again
+// with fresh attempts, and returns how many were queued
+func (q *JobQueue) RetryDead(ctx context.Context, id string) (int, error) {
+	if !q.redis.Available() {
+		return 0, ErrJobQueueUnavailable
+	}
+	client := q.redis.Client()
+	raws, err := client.LRange(ctx, jobsDead, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	retried := 0
+	for _, raw := range raws {
+		var job Job
+		if err := json.Unmarshal([]byte(raw), &job); err != nil || (id != "all" && job.ID != id) {
+			continue
+		}
+		job.Attempt = 0
+		job.DueAt = time.Now().UTC()
+		data, err := json.Marshal(job)
+		if err != nil {
+			return retried, err
+		}
+		moved, err := retryDeadJob.Run(ctx, client, []string{jobsDead, jobsPending}, raw, data).Int()
+		if err != nil {
+			return retried, err
+		}
+		retried += moved
+	}
+	if retried == 0 && id != "all" {
+		return 0, ErrDeadJobNotFound
+	}
+	return retried, nil
+}
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+)
+
+const (
+	deviceJournalStream = "device:journal"
+	// deviceJournalLock is held by the instance replaying, so entries are
+	// applied once and in order
+	deviceJournalLock    = "device:journal:replay"
+	deviceJournalLockTTL = time.Minute
+	// databaseProbeTimeout bounds the ping telling an outage from a query
+	// that failed on its own
+	databaseProbeTimeout = time.Second
+)
+
+// Kinds of device API requests the journal keeps
+const (
+	JournalDeviceCheckIn   = "checkin"
+	JournalDeviceTelemetry = "telemetry"
+)
+
+// ErrJournalFull is returned when the journal holds its maximum number of
+// requests, and devices must retry later
+var ErrJournalFull = errors.New("device journal is full, retry later")
+
+var deviceJournalEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "edgeplug_device_journal_entries",
+	Help: "Device API requests journaled during a database outage and not replayed yet",
+})
+
+func init() {
+	prometheus.MustRegister(deviceJournalEntries)
+}
+
+// DeviceJournal keeps device API check-ins and telemetry in a Redis stream
+// while the database is down, and replays them once it answers again.
+// Requests are journaled with the fingerprint of the device certificate
+// they came with; the certificate's revocation is only checked on replay.
+type DeviceJournal struct {
+	db        *gorm.DB
+	redis     *RedisService
+	cfg       config.DeviceJournalConfig
+	certs     *DeviceCertService
+	checkIns  *DeviceCheckInService
+	telemetry *TelemetryService
+}
+
+// NewDeviceJournal creates a new device journal
+func NewDeviceJournal(db *gorm.DB, redisSvc *RedisService, cfg config.DeviceJournalConfig, certs *DeviceCertService, checkIns *DeviceCheckInService, telemetry *TelemetryService) *DeviceJournal {
+	return &DeviceJournal{db: db, redis: redisSvc, cfg: cfg, certs: certs, checkIns: checkIns, telemetry: telemetry}
+}
+
+// Accepts reports whether a request that failed with err should be
+// journaled: the journal is enabled and the database does not answer
+func (j *DeviceJournal) Accepts(err error) bool {
+	if !j.cfg.Enabled || err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+		return false
+	}
+	return !j.databaseUp(context.Background())
+}
+
+func (j *DeviceJournal) databaseUp(ctx context.Context) bool {
+	sqlDB, err := j.db.DB()
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, databaseProbeTimeout)
+	defer cancel()
+	return sqlDB.PingContext(ctx) == nil
+}
+
+// Append journals a request of a kind for the device with the certificate
+// fingerprint. The payload is what the request's service takes: a
+// DeviceReport or a batch of TelemetryInput.
+func (j *DeviceJournal) Append(ctx context.Context, kind, fingerprint string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := j.redis.Client()
+	length, err := client.XLen(ctx, deviceJournalStream).Result()
+	if err != nil {
+		return err
+	}
+	if length >= j.cfg.MaxEntries {
+		return ErrJournalFull
+	}
+	if err := client.XAdd(ctx, &redis.XAddArgs{
+		Stream: deviceJournalStream,
+		Values: map[string]interface{}{
+			"kind":        kind,
+			"fingerprint": fingerprint,
+			"received_at": time.Now().UTC().Format(time.RFC3339Nano),
+			"payload":     string(data),
+		},
+	}).Err(); err != nil {
+		return err
+	}
+	deviceJournalEntries.Set(float64(length + 1))
+	return nil
+}
+
+// Run replays journaled requests periodically until ctx is done
+func (j *DeviceJournal) Run(ctx context.Context) {
+	if !j.cfg.Enabled {
+		return
+	}
+	ticker := time.NewTicker(j.cfg.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			replayed, err := j.Replay(ctx)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to replay device journal")
+			}
+			if replayed > 0 {
+				log.Info().Int("replayed", replayed).Msg("Replayed journaled device requests")
+			}
+		}
+	}
+}
+
+// Replay applies a batch of journaled requests in the order they arrived,
+// if the database answers, and returns how many it removed from the
+// journal. A request that fails for another reason than the database, e.g.
+// from a device whose certificate was revoked meanwhile, is dropped.
+func (j *DeviceJournal) Replay(ctx context.Context) (int, error) {
+	client := j.redis.Client()
+	length, err := client.XLen(ctx, deviceJournalStream).Result()
+	if err != nil {
+		return 0, err
+	}
+	deviceJournalEntries.Set(float64(length))
+	if length == 0 || !j.databaseUp(ctx) {
+		return 0, nil
+	}
+
+	locked, err := client.SetNX(ctx, deviceJournalLock, 1, deviceJournalLockTTL).Result()
+	if err != nil || !locked {
+		return 0, err
+	}
+	defer client.Del(ctx, deviceJournalLock)
+
+	entries, err := client.XRangeN(ctx, deviceJournalStream, "-", "+", int64(j.cfg.ReplayBatch)).Result()
+	if err != nil {
+		return 0, err
+	}
+	done := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if err := j.apply(ctx, entry); err != nil {
+			// The database went down again; retry from here next round
+			if !errors.Is(err, gorm.ErrRecordNotFound) && !j.databaseUp(ctx) {
+				break
+			}
+			log.Warn().Err(err).Str("entry", entry.ID).Msg("Dropped journaled device request")
+		}
+		done = append(done, entry.ID)
+	}
+	if len(done) == 0 {
+		return 0, nil
+	}
+	if err := client.XDel(ctx, deviceJournalStream, done...).Err(); err != nil {
+		return 0, err
+	}
+	deviceJournalEntries.Set(float64(length - int64(len(done))))
+	return len(done), nil
+}
+
+// apply replays one journaled request as the device that sent it
+func (j *DeviceJournal) apply(ctx context.Context, entry redis.XMessage) error {
+	kind, _ := entry.Values["kind"].(string)
+	fingerprint, _ := entry.Values["fingerprint"].(string)
+	payload, _ := entry.Values["payload"].(string)
+	receivedAt, _ := entry.Values["received_at"].(string)
+	at, err := time.Parse(time.RFC3339Nano, receivedAt)
+	if err != nil {
+		return fmt.Errorf("invalid received_at %q", receivedAt)
+	}
+
+	cert, err := j.certs.Lookup(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case JournalDeviceCheckIn:
+		var report DeviceReport
+		if err := json.Unmarshal([]byte(payload), &report); err != nil {
+			return err
+		}
+		report.ReceivedAt = at
+		// The device gets its instructions on its next check-in
+		_, err := j.checkIns.CheckIn(ctx, &cert.Device, report)
+		return err
+	case JournalDeviceTelemetry:
+		var inputs []TelemetryInput
+		if err := json.Unmarshal([]byte(payload), &inputs); err != nil {
+			return err
+		}
+		_, _, err := j.telemetry.IngestFromDevice(&cert.Device, inputs)
+		return err
+	}
+	return fmt.Errorf("unknown journal entry kind %q", kind)
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrLegalHold is returned when deleting or purging data under an
+	// active legal hold
+	ErrLegalHold = errors.New("this data is under legal hold and cannot be deleted")
+	// ErrInvalidHoldSubject is returned for a subject type other than user,
+	// organization or agent
+	ErrInvalidHoldSubject = errors.New("subject_type must be user, organization or agent")
+	// ErrInvalidHoldExpiry is returned for an expiry that is not in the future
+	ErrInvalidHoldExpiry = errors.New("expires_at must be in the future")
+	// ErrHoldReleased is returned when releasing a hold that is no longer active
+	ErrHoldReleased = errors.New("legal hold was already released or has expired")
+)
+
+// holdSubject is something a legal hold can be placed on
+type holdSubject struct {
+	Type models.LegalHoldSubject
+	ID   uuid.UUID
+}
+
+// LegalHoldService places and releases legal holds. Every path that deletes
+// or purges users, organizations or agents checks them with checkLegalHold.
+type LegalHoldService struct {
+	db *gorm.DB
+}
+
+// NewLegalHoldService creates a new legal hold service
+func NewLegalHoldService(db *gorm.DB) *LegalHoldService {
+	return &LegalHoldService{db: db}
+}
+
+// PlaceHold places a hold on a user, organization or agent, deleted ones
+// included since soft-deleted data can still be purged. A hold without an
+// expiry lasts until it is released.
+func (s *LegalHoldService) PlaceHold(adminID uuid.UUID, subjectType models.LegalHoldSubject, subjectID uuid.UUID, reason string, expiresAt *time.Time) (*models.LegalHold, error) {
+	var model interface{}
+	switch subjectType {
+	case models.LegalHoldSubjectUser:
+		model = &models.User{}
+	case models.LegalHoldSubjectOrganization:
+		model = &models.Organization{}
+	case models.LegalHoldSubjectAgent:
+		model = &models.Agent{}
+	default:
+		return nil, ErrInvalidHoldSubject
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, ErrInvalidHoldExpiry
+	}
+
+	var count int64
+	if err := s.db.Unscoped().Model(model).Where("id = ?", subjectID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	hold := models.LegalHold{
+		SubjectType: subjectType,
+		SubjectID:   subjectID,
+		Reason:      reason,
+		PlacedBy:    adminID,
+		ExpiresAt:   expiresAt,
+	}
+	if err := s.db.Create(&hold).Error; err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("hold_id", hold.ID.String()).Str("subject_type", string(subjectType)).
+		Str("subject_id", subjectID.String()).Str("placed_by", adminID.String()).Msg("Legal hold placed")
+	return &hold, nil
+}
+
+// ReleaseHold ends an active hold early
+func (s *LegalHoldService) ReleaseHold(adminID, holdID uuid.UUID) (*models.LegalHold, error) {
+	var hold models.LegalHold
+	if err := s.db.First(&hold, "id = ?", holdID).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result := activeHolds(s.db.Model(&hold), now).Updates(map[string]interface{}{
+		"released_by": adminID,
+		"released_at": &now,
+	})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrHoldReleased
+	}
+	hold.ReleasedBy = &adminID
+	hold.ReleasedAt = &now
+
+	log.Info().Str("hold_id", hold.ID.String()).Str("released_by", adminID.String()).Msg("Legal hold released")
+	return &hold, nil
+}
+
+// GetHolds returns holds, newest first, optionally only those on one subject
+// or only active ones
+func (s *LegalHoldService) GetHolds(subjectType models.LegalHoldSubject, subjectID *uuid.UUID, activeOnly bool, page, limit int) ([]models.LegalHold, int64, error) {
+	query := s.db.Model(&models.LegalHold{})
+	if subjectType != "" {
+		query = query.Where("subject_type = ?", subjectType)
+	}
+	if subjectID != nil {
+		query = query.Where("subject_id = ?", *subjectID)
+	}
+	if activeOnly {
+		query = activeHolds(query, time.Now())
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var holds []models.LegalHold
+	if err := query.Order("created_at DESC").Offset((page - 1) * limit).Limit(limit).Find(&holds).Error; err != nil {
+		return nil, 0, err
+	}
+	return holds, total, nil
+}
+
+// activeHolds narrows a query to holds neither released nor expired at now
+func activeHolds(query *gorm.DB, now time.Time) *gorm.DB {
+	return query.Where("released_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", now)
+}
+
+// checkLegalHold returns ErrLegalHold if any of the subjects is under an
+// active hold
+func checkLegalHold(db *gorm.DB, subjects ...holdSubject) error {
+	if len(subjects) == 0 {
+		return nil
+	}
+	query := db.Where("1 = 0")
+	for _, subject := range subjects {
+		query = query.Or("subject_type = ? AND subject_id = ?", subject.Type, subject.ID)
+	}
+
+	var count int64
+	if err := activeHolds(db.Model(&models.LegalHold{}), time.Now()).Where(query).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrLegalHold
+	}
+	return nil
+}
+
+// agentHoldSubjects are the holds that freeze an agent: on the agent
+// itself, its publisher and its organization
+func agentHoldSubjects(agent *models.Agent) []holdSubject {
+	subjects := []holdSubject{
+		{Type: models.LegalHoldSubjectAgent, ID: agent.ID},
+		{Type: models.LegalHoldSubjectUser, ID: agent.PublisherID},
+	}
+	if agent.OrganizationID != nil {
+		subjects = append(subjects, holdSubject{Type: models.LegalHoldSubjectOrganization, ID: *agent.OrganizationID})
+	}
+	return subjects
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// ErrInvalidLicense is returned for a license key that was not signed by
+// the marketplace
+var ErrInvalidLicense = errors.New("license key is not valid")
+
+// LicenseClaims are the claims of a license key. The subject is the buyer.
+type LicenseClaims struct {
+	AgentID        uuid.UUID  `json:"agent_id"`
+	OrganizationID *uuid.UUID `json:"organization_id,omitempty"`
+	Seats          int        `json:"seats"`
+	jwt.RegisteredClaims
+}
+
+// LicenseVerification is the result of checking a license key
+type LicenseVerification struct {
+	Valid          bool       `json:"valid"`
+	Status         string     `json:"status"` // "valid", "expired", "revoked" or "agent_mismatch"
+	LicenseID      uuid.UUID  `json:"license_id"`
+	AgentID        uuid.UUID  `json:"agent_id"`
+	AgentName      string     `json:"agent_name"`
+	OrganizationID *uuid.UUID `json:"organization_id,omitempty"`
+	Seats          int        `json:"seats"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+}
+
+// LicenseService issues license keys for paid purchases and checks them.
+// Keys are issued the first time their buyer lists them and reissued as
+// they near expiry, for as long as the purchase is not refunded.
+type LicenseService struct {
+	db     *gorm.DB
+	cfg    config.LicensesConfig
+	signer Signer
+	issuer string
+}
+
+// NewLicenseService creates a new license service
+func NewLicenseService(db *gorm.DB, cfg config.LicensesConfig, signer Signer, issuer string) *LicenseService {
+	return &LicenseService{db: db, cfg: cfg, signer: signer, issuer: issuer}
+}
+
+// licensedPurchases narrows a query on purchases to the completed, paid
+// purchases a user is entitled to: their own, and those made for their
+// organizations. Reseller grants were paid for offline.
+func licensedPurchases(query *gorm.DB, userID uuid.UUID) *gorm.DB {
+	return query.Where("purchases.status = ? AND (purchases.amount_minor > 0 OR EXISTS (SELECT 1 FROM reseller_grants WHERE reseller_grants.purchase_id = purchases.id))", models.PurchaseStatusCompleted).
+		Where("(purchases.buyer_id = ? OR purchases.organization_id IN (SELECT organization_id FROM memberships WHERE user_id = ?))", userID, userID)
+}
+
+// GetLicenses returns the licenses of a user's paid purchases, issuing
+// missing keys and renewing those about to expire first
+func (s *LicenseService) GetLicenses(userID uuid.UUID, page, limit int) ([]models.License, int64, error) {
+	if err := s.sync(userID); err != nil {
+		return nil, 0, err
+	}
+
+	var licenses []models.License
+	var total int64
+	query := s.db.Model(&models.License{}).
+		Where("purchase_id IN (?)", licensedPurchases(s.db.Model(&models.Purchase{}), userID).Select("purchases.id"))
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Preload("Agent").Order("created_at DESC").Offset(offset).Limit(limit).Find(&licenses).Error; err != nil {
+		return nil, 0, err
+	}
+	return licenses, total, nil
+}
+
+func (s *LicenseService) sync(userID uuid.UUID) error {
+	var unlicensed []models.Purchase
+	if err := licensedPurchases(s.db.Model(&models.Purchase{}), userID).
+		Where("NOT EXISTS (SELECT 1 FROM licenses WHERE licenses.purchase_id = purchases.id)").
+		Find(&unlicensed).Error; err != nil {
+		return err
+	}
+	granted, err := grantedSeats(s.db, unlicensed)
+	if err != nil {
+		return err
+	}
+	for i := range unlicensed {
+		purchase := &unlicensed[i]
+		seats := s.cfg.Seats
+		if purchase.OrganizationID != nil {
+			seats = s.cfg.OrganizationSeats
+		}
+		if n, ok := granted[purchase.ID]; ok {
+			seats = n
+		}
+		license := models.License{
+			ID:             models.NewID(),
+			PurchaseID:     purchase.ID,
+			BuyerID:        purchase.BuyerID,
+			AgentID:        purchase.AgentID,
+			OrganizationID: purchase.OrganizationID,
+			Seats:          seats,
+		}
+		if err := s.sign(&license); err != nil {
+			return err
+		}
+		// Two concurrent listings may race to issue the same key
+		if err := s.db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "purchase_id"}},
+			DoNothing: true,
+		}).Create(&license).Error; err != nil {
+			return err
+		}
+	}
+
+	var expiring []models.License
+	if err := s.db.Where("expires_at < ?", time.Now().Add(s.cfg.RenewBefore)).
+		Where("purchase_id IN (?)", licensedPurchases(s.db.Model(&models.Purchase{}), userID).Select("purchases.id")).
+		Find(&expiring).Error; err != nil {
+		return err
+	}
+	for i := range expiring {
+		license := &expiring[i]
+		if err := s.sign(license); err != nil {
+			return err
+		}
+		if err := s.db.Model(license).Updates(map[string]interface{}{
+			"key":        license.Key,
+			"expires_at": license.ExpiresAt,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grantedSeats returns the seats resellers granted with purchases, by
+// purchase ID
+func grantedSeats(db *gorm.DB, purchases []models.Purchase) (map[uuid.UUID]int, error) {
+	if len(purchases) == 0 {
+		return nil, nil
+	}
+	ids := make([]uuid.UUID, len(purchases))
+	for i := range purchases {
+		ids[i] = purchases[i].ID
+	}
+	var grants []models.ResellerGrant
+	if err := db.Select("purchase_id", "seats").Where("purchase_id IN ?", ids).Find(&grants).Error; err != nil {
+		return nil, err
+	}
+	seats := make(map[uuid.UUID]int, len(grants))
+	for _, grant := range grants {
+		seats[grant.PurchaseID] = grant.Seats
+	}
+	return seats, nil
+}
+
+// sign sets a license's expiry a full validity period from now and signs
+// its key
+func (s *LicenseService) sign(license *models.License) error {
+	now := time.Now()
+	license.ExpiresAt = now.Add(s.cfg.Validity).Truncate(time.Second)
+	claims := LicenseClaims{
+		AgentID:        license.AgentID,
+		OrganizationID: license.OrganizationID,
+		Seats:          license.Seats,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   license.BuyerID.String(),
+			ExpiresAt: jwt.NewNumericDate(license.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        license.ID.String(),
+		},
+	}
+
+	token := jwt.NewWithClaims(signerMethod{}, claims)
+	token.Header["kid"] = s.signer.KeyID()
+	key, err := token.SignedString(s.signer)
+	if err != nil {
+		return err
+	}
+	license.Key = key
+	return nil
+}
+
+// Verify checks a license key's signature and expiry and whether its
+// purchase still stands. With a non-nil agentID, the key must also be for
+// that agent.
+func (s *LicenseService) Verify(key string, agentID *uuid.UUID) (*LicenseVerification, error) {
+	claims := &LicenseClaims{}
+	_, err := jwt.ParseWithClaims(key, claims, func(token *jwt.Token) (interface{}, error) {
+		if kid, _ := token.Header["kid"].(string); kid != s.signer.KeyID() {
+			return nil, errors.New("unknown signing key")
+		}
+		return s.signer.Public(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}), jwt.WithIssuer(s.issuer), jwt.WithExpirationRequired())
+	expired := errors.Is(err, jwt.ErrTokenExpired)
+	if err != nil && !expired {
+		return nil, ErrInvalidLicense
+	}
+	licenseID, err := uuid.Parse(claims.ID)
+	if err != nil {
+		return nil, ErrInvalidLicense
+	}
+
+	var license models.License
+	if err := s.db.Preload("Agent").First(&license, "id = ?", licenseID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidLicense
+		}
+		return nil, err
+	}
+	var purchase models.Purchase
+	if err := s.db.Select("status").First(&purchase, "id = ?", license.PurchaseID).Error; err != nil {
+		return nil, err
+	}
+
+	result := &LicenseVerification{
+		LicenseID:      license.ID,
+		AgentID:        claims.AgentID,
+		AgentName:      license.Agent.Name,
+		OrganizationID: claims.OrganizationID,
+		Seats:          claims.Seats,
+		ExpiresAt:      claims.ExpiresAt.Time,
+		Status:         "valid",
+	}
+	switch {
+	case purchase.Status != models.PurchaseStatusCompleted:
+		result.Status = "revoked"
+	case expired:
+		result.Status = "expired"
+	case agentID != nil && *agentID != claims.AgentID:
+		result.Status = "agent_mismatch"
+	}
+	result.Valid = result.Status == "valid"
+	return result, nil
+}
@@ -0,0 +1,292 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrInvalidLimitScope is returned for a scope that is not user:<id>
+	ErrInvalidLimitScope = errors.New("limit scope must be user:<id>")
+	// ErrUnknownLimit is returned for a limit name that does not exist
+	ErrUnknownLimit = errors.New("unknown limit")
+	// ErrInvalidLimitValue is returned for a negative limit
+	ErrInvalidLimitValue = errors.New("limits must not be negative")
+)
+
+// LimitNames lists every limit that can be overridden
+var LimitNames = []models.LimitName{
+	models.LimitMaxPublishedAgents,
+	models.LimitStorageQuotaMB,
+	models.LimitRequestsPerMinute,
+	models.LimitMaxFleetSize,
+	models.LimitMaxAPIKeys,
+	models.LimitAPIRequestsPerMinute,
+	models.LimitAPIRequestsPerDay,
+}
+
+// ScopeLimits are the limits in effect for a scope and the overrides that
+// set some of them
+type ScopeLimits struct {
+	Scope     string                     `json:"scope"`
+	Tier      models.PublisherTier       `json:"tier"`
+	Effective map[models.LimitName]int64 `json:"effective"`
+	Overrides []models.LimitOverride     `json:"overrides"`
+}
+
+// LimitService is the single source of the limits enforced on users: the
+// defaults of their plan tier and of the public API, unless an admin set an
+// override for them. Zero means unlimited.
+type LimitService struct {
+	db        *gorm.DB
+	tiers     map[string]config.TierConfig
+	publicAPI config.PublicAPIConfig
+	cfg       config.LimitsConfig
+
+	// Overrides per scope, dropped all at once every cache TTL
+	mu       sync.Mutex
+	loadedAt time.Time
+	cache    map[string]map[models.LimitName]int64
+}
+
+// NewLimitService creates a new limit service
+func NewLimitService(db *gorm.DB, tiers map[string]config.TierConfig, publicAPI config.PublicAPIConfig, cfg config.LimitsConfig) *LimitService {
+	return &LimitService{
+		db:        db,
+		tiers:     tiers,
+		publicAPI: publicAPI,
+		cfg:       cfg,
+		cache:     make(map[string]map[models.LimitName]int64),
+	}
+}
+
+// UserScope returns the override scope of a user
+func UserScope(userID uuid.UUID) string {
+	return "user:" + userID.String()
+}
+
+// ParseUserScope returns the user of a user:<id> scope
+func ParseUserScope(scope string) (uuid.UUID, error) {
+	id, ok := strings.CutPrefix(scope, "user:")
+	if !ok {
+		return uuid.Nil, ErrInvalidLimitScope
+	}
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.Nil, ErrInvalidLimitScope
+	}
+	return userID, nil
+}
+
+// Default returns a limit's value before overrides. Limits that do not
+// depend on the tier ignore it.
+func (s *LimitService) Default(tier models.PublisherTier, name models.LimitName) int64 {
+	plan, ok := s.tiers[string(tier)]
+	if !ok {
+		plan = s.tiers[string(models.PublisherTierFree)]
+	}
+
+	switch name {
+	case models.LimitMaxPublishedAgents:
+		return int64(plan.MaxPublishedAgents)
+	case models.LimitStorageQuotaMB:
+		return plan.StorageQuotaMB
+	case models.LimitRequestsPerMinute:
+		return int64(plan.RequestsPerMinute)
+	case models.LimitMaxFleetSize:
+		return int64(plan.MaxFleetSize)
+	case models.LimitMaxAPIKeys:
+		return int64(s.publicAPI.MaxKeysPerUser)
+	case models.LimitAPIRequestsPerMinute:
+		return int64(s.publicAPI.RequestsPerMinute)
+	case models.LimitAPIRequestsPerDay:
+		return int64(s.publicAPI.RequestsPerDay)
+	default:
+		return 0
+	}
+}
+
+// Defaults returns the default of every limit for each tier
+func (s *LimitService) Defaults() map[string]map[models.LimitName]int64 {
+	defaults := make(map[string]map[models.LimitName]int64, len(s.tiers))
+	for tier := range s.tiers {
+		values := make(map[models.LimitName]int64, len(LimitNames))
+		for _, name := range LimitNames {
+			values[name] = s.Default(models.PublisherTier(tier), name)
+		}
+		defaults[tier] = values
+	}
+	return defaults
+}
+
+// Get returns the limit in effect for a user on a tier. If overrides
+// cannot be loaded, the default applies.
+func (s *LimitService) Get(userID uuid.UUID, tier models.PublisherTier, name models.LimitName) int64 {
+	overrides, err := s.overrides(UserScope(userID))
+	if err != nil {
+		log.Error().Err(err).Str("user_id", userID.String()).Msg("Failed to load limit overrides")
+	} else if value, ok := overrides[name]; ok {
+		return value
+	}
+	return s.Default(tier, name)
+}
+
+// Effective returns every limit in effect for a user on a tier
+func (s *LimitService) Effective(userID uuid.UUID, tier models.PublisherTier) map[models.LimitName]int64 {
+	values := make(map[models.LimitName]int64, len(LimitNames))
+	for _, name := range LimitNames {
+		values[name] = s.Get(userID, tier, name)
+	}
+	return values
+}
+
+// GetScope returns the limits in effect for a scope and its overrides
+func (s *LimitService) GetScope(scope string) (*ScopeLimits, error) {
+	userID, err := ParseUserScope(scope)
+	if err != nil {
+		return nil, err
+	}
+	var user models.User
+	if err := s.db.Select("id", "tier").First(&user, "id = ?", userID).Error; err != nil {
+		return nil, err
+	}
+
+	var overrides []models.LimitOverride
+	if err := s.db.Where("scope = ?", scope).Order("name").Find(&overrides).Error; err != nil {
+		return nil, err
+	}
+
+	limits := &ScopeLimits{
+		Scope:     scope,
+		Tier:      user.Tier,
+		Effective: make(map[models.LimitName]int64, len(LimitNames)),
+		Overrides: overrides,
+	}
+	for _, name := range LimitNames {
+		limits.Effective[name] = s.Default(user.Tier, name)
+	}
+	for _, o := range overrides {
+		limits.Effective[o.Name] = o.Value
+	}
+	return limits, nil
+}
+
+// SetOverrides sets overrides for a scope. A nil value removes the
+// override, restoring the default; limits left out are unchanged.
+func (s *LimitService) SetOverrides(scope string, values map[models.LimitName]*int64, reason string, adminID uuid.UUID) error {
+	userID, err := ParseUserScope(scope)
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		if !knownLimit(name) {
+			return ErrUnknownLimit
+		}
+		if value != nil && *value < 0 {
+			return ErrInvalidLimitValue
+		}
+	}
+	var count int64
+	if err := s.db.Model(&models.User{}).Where("id = ?", userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for name, value := range values {
+			if value == nil {
+				if err := tx.Where("scope = ? AND name = ?", scope, name).Delete(&models.LimitOverride{}).Error; err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "scope"}, {Name: "name"}},
+				DoUpdates: clause.AssignmentColumns([]string{"value", "reason", "updated_by", "updated_at"}),
+			}).Create(&models.LimitOverride{
+				Scope:     scope,
+				Name:      name,
+				Value:     *value,
+				Reason:    reason,
+				UpdatedBy: adminID,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.forget(scope)
+	return nil
+}
+
+// ClearOverrides removes all overrides of a scope
+func (s *LimitService) ClearOverrides(scope string) error {
+	if _, err := ParseUserScope(scope); err != nil {
+		return err
+	}
+	if err := s.db.Where("scope = ?", scope).Delete(&models.LimitOverride{}).Error; err != nil {
+		return err
+	}
+	s.forget(scope)
+	return nil
+}
+
+// overrides returns the overrides of a scope, from the cache when fresh.
+// Other instances see changes once their cache expires.
+func (s *LimitService) overrides(scope string) (map[models.LimitName]int64, error) {
+	s.mu.Lock()
+	if time.Since(s.loadedAt) > s.cfg.CacheTTL {
+		s.cache = make(map[string]map[models.LimitName]int64)
+		s.loadedAt = time.Now()
+	}
+	values, ok := s.cache[scope]
+	s.mu.Unlock()
+	if ok {
+		return values, nil
+	}
+
+	var overrides []models.LimitOverride
+	if err := s.db.Where("scope = ?", scope).Find(&overrides).Error; err != nil {
+		return nil, err
+	}
+	values = make(map[models.LimitName]int64, len(overrides))
+	for _, o := range overrides {
+		values[o.Name] = o.Value
+	}
+
+	s.mu.Lock()
+	s.cache[scope] = values
+	s.mu.Unlock()
+	return values, nil
+}
+
+// forget drops a scope's cached overrides on this instance
+func (s *LimitService) forget(scope string) {
+	s.mu.Lock()
+	delete(s.cache, scope)
+	s.mu.Unlock()
+}
+
+func knownLimit(name models.LimitName) bool {
+	for _, known := range LimitNames {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
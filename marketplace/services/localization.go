@@ -0,0 +1,126 @@
+package services
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// LocalizationService manages the per-locale READMEs and media of agents
+type LocalizationService struct {
+	db *gorm.DB
+}
+
+// NewLocalizationService creates a new localization service
+func NewLocalizationService(db *gorm.DB) *LocalizationService {
+	return &LocalizationService{db: db}
+}
+
+// GetLocalizations returns an agent's localizations ordered by locale
+func (s *LocalizationService) GetLocalizations(agentID uuid.UUID) ([]models.AgentLocalization, error) {
+	var localizations []models.AgentLocalization
+	if err := s.db.Where("agent_id = ?", agentID).Order("locale").Find(&localizations).Error; err != nil {
+		return nil, err
+	}
+	return localizations, nil
+}
+
+// GetReadme returns the localization of an agent that best matches the
+// preferred locales, falling back to the agent's default locale, along with
+// all locales available. It returns a nil localization if there are none.
+func (s *LocalizationService) GetReadme(agent *models.Agent, preferred []string) (*models.AgentLocalization, []string, error) {
+	localizations, err := s.GetLocalizations(agent.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	available := make([]string, len(localizations))
+	for i, l := range localizations {
+		available[i] = l.Locale
+	}
+	match := models.MatchLocale(preferred, available, agent.DefaultLocale)
+	for i := range localizations {
+		if localizations[i].Locale == match {
+			return &localizations[i], available, nil
+		}
+	}
+	return nil, available, nil
+}
+
+// SaveLocalization creates or replaces an agent's README and media for a locale
+func (s *LocalizationService) SaveLocalization(localization *models.AgentLocalization) error {
+	localization.UpdatedAt = time.Now()
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "agent_id"}, {Name: "locale"}},
+		DoUpdates: clause.AssignmentColumns([]string{"readme", "media", "updated_at"}),
+	}).Create(localization).Error
+}
+
+// DeleteLocalization removes an agent's localization for a locale
+func (s *LocalizationService) DeleteLocalization(agentID uuid.UUID, locale string) error {
+	result := s.db.Where("agent_id = ? AND locale = ?", agentID, locale).Delete(&models.AgentLocalization{})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+// LocaleCoverage describes how complete one locale's translation is
+type LocaleCoverage struct {
+	Locale     string    `json:"locale"`
+	HasReadme  bool      `json:"has_readme"`
+	MediaCount int       `json:"media_count"`
+	Complete   bool      `json:"complete"` // has a README and as much media as the default locale
+	Outdated   bool      `json:"outdated"` // last updated before the default locale
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// TranslationCoverage summarizes the locales an agent is available in
+type TranslationCoverage struct {
+	DefaultLocale string           `json:"default_locale"`
+	Locales       []LocaleCoverage `json:"locales"`
+	Complete      int              `json:"complete"` // number of complete locales
+}
+
+// GetCoverage reports the translation coverage of an agent's localizations
+// relative to its default locale
+func (s *LocalizationService) GetCoverage(agent *models.Agent) (*TranslationCoverage, error) {
+	localizations, err := s.GetLocalizations(agent.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var reference *models.AgentLocalization
+	for i := range localizations {
+		if localizations[i].Locale == agent.DefaultLocale {
+			reference = &localizations[i]
+		}
+	}
+
+	coverage := TranslationCoverage{
+		DefaultLocale: agent.DefaultLocale,
+		Locales:       make([]LocaleCoverage, 0, len(localizations)),
+	}
+	for _, l := range localizations {
+		lc := LocaleCoverage{
+			Locale:     l.Locale,
+			HasReadme:  l.Readme != "",
+			MediaCount: len(l.Media),
+			UpdatedAt:  l.UpdatedAt,
+		}
+		lc.Complete = lc.HasReadme
+		if reference != nil && l.Locale != reference.Locale {
+			lc.Complete = lc.Complete && lc.MediaCount >= len(reference.Media)
+			lc.Outdated = l.UpdatedAt.Before(reference.UpdatedAt)
+		}
+		if lc.Complete {
+			coverage.Complete++
+		}
+		coverage.Locales = append(coverage.Locales, lc)
+	}
+	return &coverage, nil
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/edgeplug/marketplace/config"
+)
+
+// LogSampler decides which share of requests the request log keeps. Its
+// rates can be changed while the server runs.
+type LogSampler struct {
+	mu  sync.RWMutex
+	cfg config.LogSamplingConfig
+}
+
+// NewLogSampler creates a new log sampler
+func NewLogSampler(cfg config.LogSamplingConfig) *LogSampler {
+	return &LogSampler{cfg: cfg}
+}
+
+// Apply switches to new sampling rates
+func (s *LogSampler) Apply(cfg config.LogSamplingConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+}
+
+// Rate returns the share of requests to path that are logged, for requests
+// that failed or succeeded. The tenant is the publisher the request was
+// made for or by, if any.
+func (s *LogSampler) Rate(path, tenant string, failed bool) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rate := s.cfg.Success
+	if failed {
+		rate = s.cfg.Errors
+	}
+
+	// The longest matching route group applies
+	longest := -1
+	var route config.LogSampleRates
+	for prefix, rates := range s.cfg.Routes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if len(prefix) <= longest || !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if len(path) > len(prefix) && path[len(prefix)] != '/' {
+			continue
+		}
+		longest, route = len(prefix), rates
+	}
+	rate = pickRate(route, rate, failed)
+	if rates, ok := s.cfg.Tenants[tenant]; ok && tenant != "" {
+		rate = pickRate(rates, rate, failed)
+	}
+	return rate
+}
+
+// pickRate returns the override's rate for the outcome, or inherited when
+// it does not set one
+func pickRate(rates config.LogSampleRates, inherited float64, failed bool) float64 {
+	override := rates.Success
+	if failed {
+		override = rates.Errors
+	}
+	if override == nil {
+		return inherited
+	}
+	return *override
+}
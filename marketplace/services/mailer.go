@@ -0,0 +1,115 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/config"
+)
+
+// Mailer sends plain-text email
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// NewMailer returns the mailer of the configured provider
+func NewMailer(cfg config.MailConfig) (Mailer, error) {
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mail sender address: %w", err)
+	}
+
+	switch cfg.Provider {
+	case "log":
+		return logMailer{}, nil
+	case "smtp":
+		return &smtpMailer{cfg: cfg.SMTP, from: from}, nil
+	default:
+		return nil, fmt.Errorf("unsupported mail provider: %s", cfg.Provider)
+	}
+}
+
+// logMailer records messages in the log instead of sending them. Bodies
+// carry reset tokens and signed links, so only their length is logged.
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	log.Info().Str("to", to).Str("subject", subject).Int("body_length", len(body)).Msg("Email not sent, mail provider is log")
+	return nil
+}
+
+// smtpMailer sends through an SMTP server, upgrading to TLS when the
+// server offers STARTTLS
+type smtpMailer struct {
+	cfg  config.SMTPConfig
+	from *mail.Address
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	addr := net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port))
+	return smtp.SendMail(addr, auth, m.from.Address, []string{to}, []byte(msg.String()))
+}
+
+// JobTypeEmail is the job sending an email
+const JobTypeEmail = "email.send"
+
+type emailJob struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// queuedMailer sends email through jobs, so sends that fail are retried. It
+// sends directly while the job queue is unavailable.
+type queuedMailer struct {
+	queue  *JobQueue
+	mailer Mailer
+}
+
+// QueueMail registers the job sending email through mailer and returns a
+// mailer queueing those jobs
+func QueueMail(queue *JobQueue, mailer Mailer) Mailer {
+	queue.Register(JobTypeEmail, JobOptions{}, func(ctx context.Context, payload json.RawMessage) error {
+		var email emailJob
+		if err := json.Unmarshal(payload, &email); err != nil {
+			return PermanentJobError(err)
+		}
+		return mailer.Send(email.To, email.Subject, email.Body)
+	})
+	return &queuedMailer{queue: queue, mailer: mailer}
+}
+
+func (m *queuedMailer) Send(to, subject, body string) error {
+	_, err := m.queue.Enqueue(context.Background(), JobTypeEmail, emailJob{To: to, Subject: subject, Body: body})
+	if err == nil {
+		return nil
+	}
+	if err != ErrJobQueueUnavailable {
+		log.Warn().Err(err).Msg("Failed to queue email, sending it directly")
+	}
+	return m.mailer.Send(to, subject, body)
+}
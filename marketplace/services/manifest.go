@@ -0,0 +1,235 @@
+package services
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrInvalidManifest is returned for a manifest that does not follow the
+	// EdgePlug manifest schema
+	ErrInvalidManifest = errors.New("invalid manifest")
+	// ErrManifestRequired is returned when publishing a release without an
+	// uploaded manifest
+	ErrManifestRequired = errors.New("upload a manifest before publishing this version")
+	// ErrManifestMismatch is returned when publishing a release whose
+	// manifest disagrees with the agent's declared specs
+	ErrManifestMismatch = errors.New("manifest does not match the agent")
+)
+
+// manifestSchemaV1 is the JSON Schema of version 1 of the manifest, published
+// for tooling. Parse enforces the same rules.
+//
+//go:embed schemas/manifest-v1.json
+var manifestSchemaV1 []byte
+
+var (
+	manifestEntryKinds  = map[string]bool{"init": true, "process": true, "shutdown": true}
+	manifestDirections  = map[string]bool{"input": true, "output": true}
+	manifestSymbol      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,127}$`)
+	manifestSafetyLevel = map[models.SafetyLevel]bool{
+		models.SafetyLevelBasic:    true,
+		models.SafetyLevelStandard: true,
+		models.SafetyLevelAdvanced: true,
+		models.SafetyLevelCritical: true,
+	}
+)
+
+// ManifestService parses agent manifests and checks them against the
+// release they ship with before it can be published
+type ManifestService struct{}
+
+// NewManifestService creates a new manifest service
+func NewManifestService() *ManifestService {
+	return &ManifestService{}
+}
+
+// Schema returns the JSON Schema of a manifest schema version
+func (s *ManifestService) Schema(version int) ([]byte, bool) {
+	if version != models.ManifestSchemaVersion {
+		return nil, false
+	}
+	return manifestSchemaV1, true
+}
+
+// Parse decodes and validates a manifest. Unknown fields are rejected so
+// typos do not go unnoticed.
+func (s *ManifestService) Parse(r io.Reader) (*models.AgentManifest, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+
+	var manifest models.AgentManifest
+	if err := decoder.Decode(&manifest); err != nil {
+		return nil, invalidManifest("%v", err)
+	}
+	if decoder.More() {
+		return nil, invalidManifest("unexpected data after the manifest")
+	}
+	if err := s.Validate(&manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// Validate checks a manifest against the current schema
+func (s *ManifestService) Validate(m *models.AgentManifest) error {
+	if m.SchemaVersion != models.ManifestSchemaVersion {
+		return invalidManifest("schema_version must be %d", models.ManifestSchemaVersion)
+	}
+	if m.Name == "" || len(m.Name) > 200 {
+		return invalidManifest("name must be 1 to 200 characters")
+	}
+	if !versionPattern.MatchString(m.Version) {
+		return invalidManifest("version must be 1-64 letters, digits, '.', '+', '_' or '-'")
+	}
+
+	if len(m.EntryPoints) == 0 {
+		return invalidManifest("entry_points must declare at least a process entry point")
+	}
+	kinds := make(map[string]bool, len(m.EntryPoints))
+	for i, entry := range m.EntryPoints {
+		if !manifestEntryKinds[entry.Kind] {
+			return invalidManifest("entry_points[%d].kind must be one of init, process, shutdown", i)
+		}
+		if kinds[entry.Kind] {
+			return invalidManifest("entry_points[%d]: duplicate %s entry point", i, entry.Kind)
+		}
+		kinds[entry.Kind] = true
+		if !manifestSymbol.MatchString(entry.Symbol) {
+			return invalidManifest("entry_points[%d].symbol must be a C identifier", i)
+		}
+		if entry.PeriodUS < 0 || (entry.PeriodUS > 0 && entry.Kind != "process") {
+			return invalidManifest("entry_points[%d].period_us must be positive and only set on process", i)
+		}
+	}
+	if !kinds["process"] {
+		return invalidManifest("entry_points must declare a process entry point")
+	}
+
+	if m.Memory.FlashBytes <= 0 || m.Memory.SRAMBytes <= 0 {
+		return invalidManifest("memory.flash_bytes and memory.sram_bytes must be positive")
+	}
+
+	names := make(map[string]bool, len(m.Signals))
+	channels := make(map[string]bool, len(m.Signals))
+	for i, signal := range m.Signals {
+		if !capabilityNamePattern.MatchString(signal.Name) {
+			return invalidManifest("signals[%d].name must be a snake_case identifier", i)
+		}
+		if names[signal.Name] {
+			return invalidManifest("signals[%d]: duplicate name %q", i, signal.Name)
+		}
+		names[signal.Name] = true
+		if !manifestDirections[signal.Direction] {
+			return invalidManifest("signals[%d].direction must be input or output", i)
+		}
+		if !capabilitySignalTypes[signal.Type] {
+			return invalidManifest("signals[%d].type must be one of digital, analog, waveform, event, counter", i)
+		}
+		if signal.Channel == "" || len(signal.Channel) > 64 {
+			return invalidManifest("signals[%d].channel must be 1 to 64 characters", i)
+		}
+		// Two outputs driving one channel would fight over it
+		if signal.Direction == "output" {
+			if channels[signal.Channel] {
+				return invalidManifest("signals[%d]: channel %q is already driven by another output", i, signal.Channel)
+			}
+			channels[signal.Channel] = true
+		}
+	}
+
+	if !manifestSafetyLevel[m.SafetyLevel] {
+		return invalidManifest("safety_level must be one of basic, standard, advanced, critical")
+	}
+	return nil
+}
+
+// Check returns nil if a release may be published: it has a manifest and
+// the manifest declares the memory and safety level the agent lists in the
+// catalog
+func (s *ManifestService) Check(manifest *models.AgentManifest, release string, flashSize, sramSize int, safetyLevel models.SafetyLevel) error {
+	if manifest == nil {
+		return ErrManifestRequired
+	}
+	if manifest.Version != release {
+		return manifestMismatch("manifest is for version %s, not %s", manifest.Version, release)
+	}
+	if manifest.Memory.FlashBytes != flashSize {
+		return manifestMismatch("manifest needs %d bytes of flash but flash_size is %d", manifest.Memory.FlashBytes, flashSize)
+	}
+	if manifest.Memory.SRAMBytes != sramSize {
+		return manifestMismatch("manifest needs %d bytes of SRAM but sram_size is %d", manifest.Memory.SRAMBytes, sramSize)
+	}
+	if safetyLevel == "" {
+		safetyLevel = models.SafetyLevelBasic
+	}
+	if manifest.SafetyLevel != safetyLevel {
+		return manifestMismatch("manifest safety_level is %s but the agent's is %s", manifest.SafetyLevel, safetyLevel)
+	}
+	return nil
+}
+
+// ReleaseConfig is what an agent declares in the catalog about a release.
+// Its manifest must agree with it for the release to be published.
+type ReleaseConfig struct {
+	Version     string             `json:"version"`
+	FlashSize   int                `json:"flash_size"`
+	SRAMSize    int                `json:"sram_size"`
+	SafetyLevel models.SafetyLevel `json:"safety_level"`
+}
+
+// ValidateUpload validates a manifest as uploading it does, without
+// storing it
+func (s *ManifestService) ValidateUpload(r io.Reader) (*models.AgentManifest, error) {
+	manifest, _, err := s.read(r)
+	return manifest, err
+}
+
+// ValidateConfig validates a manifest as uploading it does, then checks it
+// against a release's config as publishing does, without storing anything
+func (s *ManifestService) ValidateConfig(r io.Reader, config ReleaseConfig) (*models.AgentManifest, error) {
+	manifest, err := s.ValidateUpload(r)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, s.Check(manifest, config.Version, config.FlashSize, config.SRAMSize, config.SafetyLevel)
+}
+
+// parseUpload reads an uploaded manifest into memory, so it can be both
+// validated and stored
+func (s *ManifestService) parseUpload(upload FileUpload) (*models.AgentManifest, []byte, error) {
+	return s.read(upload.Body)
+}
+
+// read reads a manifest of up to MaxAssetSize into memory and parses it
+func (s *ManifestService) read(r io.Reader) (*models.AgentManifest, []byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxAssetSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) > MaxAssetSize {
+		return nil, nil, ErrAssetTooLarge
+	}
+	manifest, err := s.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, data, nil
+}
+
+// invalidManifest returns an ErrInvalidManifest with details
+func invalidManifest(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidManifest}, args...)...)
+}
+
+// manifestMismatch returns an ErrManifestMismatch with details
+func manifestMismatch(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrManifestMismatch}, args...)...)
+}
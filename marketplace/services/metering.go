@@ -0,0 +1,453 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrAgentNotMetered is returned when deploying an agent that is not usage-priced
+	ErrAgentNotMetered = errors.New("agent does not use metered pricing")
+	// ErrAgentMetered is returned when checking out an agent that is billed by usage
+	ErrAgentMetered = errors.New("agent is billed per device-month and cannot be bought outright")
+	// ErrDeploymentExists is returned when the device already runs the agent
+	ErrDeploymentExists = errors.New("agent is already deployed on this device")
+	// ErrDecommissioned is returned for operations on a decommissioned deployment
+	ErrDecommissioned = errors.New("deployment is decommissioned")
+	// ErrFleetLimitReached is returned when deploying to a new device would
+	// exceed the buyer's fleet size limit
+	ErrFleetLimitReached = errors.New("device limit of your plan reached")
+)
+
+// MeteringService meters deployments of usage-priced agents and invoices
+// buyers monthly
+type MeteringService struct {
+	db     *gorm.DB
+	cfg    config.MeteringConfig
+	limits *LimitService
+}
+
+// NewMeteringService creates a new metering service
+func NewMeteringService(db *gorm.DB, cfg config.MeteringConfig, limits *LimitService) *MeteringService {
+	return &MeteringService{db: db, cfg: cfg, limits: limits}
+}
+
+// Deploy registers a metered agent on one of the buyer's devices, pinned to
+// a published or staged release. Without a version, the buyer gets the
+// release they are served, which depends on any rollout and their country.
+// With a nil traceID the deployment starts its own trace.
+func (s *MeteringService) Deploy(buyerID, agentID uuid.UUID, deviceID, version, country string, traceID uuid.UUID) (*models.Deployment, error) {
+	var agent models.Agent
+	if err := s.db.Where("id = ? AND status = ?", agentID, models.AgentStatusPublished).First(&agent).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrAgentNotPurchasable
+		}
+		return nil, err
+	}
+	if agent.PricingModel != models.PricingModelMetered {
+		return nil, ErrAgentNotMetered
+	}
+	if version == "" {
+		release, err := resolveRelease(s.db, &agent, buyerID, country)
+		if err != nil {
+			return nil, err
+		}
+		version = release.Version
+	} else {
+		var release models.AgentVersion
+		if err := s.db.Where("agent_id = ? AND version = ? AND status IN ?", agentID, version,
+			[]models.AgentVersionStatus{models.AgentVersionStatusPublished, models.AgentVersionStatusStaged}).
+			First(&release).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, ErrVersionNotPublished
+			}
+			return nil, err
+		}
+	}
+
+	var active int64
+	if err := s.db.Model(&models.Deployment{}).
+		Where("buyer_id = ? AND agent_id = ? AND device_id = ? AND decommissioned_at IS NULL", buyerID, agentID, deviceID).
+		Count(&active).Error; err != nil {
+		return nil, err
+	}
+	if active > 0 {
+		return nil, ErrDeploymentExists
+	}
+	if err := s.checkFleetSize(s.db, buyerID, deviceID); err != nil {
+		return nil, err
+	}
+
+	deployment := models.Deployment{
+		BuyerID:    buyerID,
+		AgentID:    agentID,
+		DeviceID:   deviceID,
+		Version:    version,
+		DeployedAt: time.Now(),
+		TraceID:    traceID,
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// The device joins the fleet with its first active deployment
+		var known int64
+		if err := tx.Model(&models.Deployment{}).
+			Where("buyer_id = ? AND device_id = ? AND decommissioned_at IS NULL", buyerID, deviceID).
+			Count(&known).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&deployment).Error; err != nil {
+			return err
+		}
+		if known > 0 {
+			return nil
+		}
+		return emitEvent(tx, buyerID, models.WebhookEventDeviceRegistered, map[string]interface{}{
+			"device_id":  deviceID,
+			"deployment": deviceDeployment{DeploymentID: deployment.ID, AgentID: agentID, Version: version},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &deployment, nil
+}
+
+// checkFleetSize returns ErrFleetLimitReached if deviceID is not yet part
+// of the buyer's fleet and the fleet is already at its size limit. The
+// fleet is the devices with an active metered deployment.
+func (s *MeteringService) checkFleetSize(db *gorm.DB, buyerID uuid.UUID, deviceID string) error {
+	var buyer models.User
+	if err := db.Select("id", "tier").First(&buyer, "id = ?", buyerID).Error; err != nil {
+		return err
+	}
+	limit := s.limits.Get(buyerID, buyer.Tier, models.LimitMaxFleetSize)
+	if limit == 0 {
+		return nil
+	}
+
+	var devices []string
+	if err := db.Model(&models.Deployment{}).
+		Where("buyer_id = ? AND decommissioned_at IS NULL", buyerID).
+		Distinct("device_id").
+		Pluck("device_id", &devices).Error; err != nil {
+		return err
+	}
+	for _, d := range devices {
+		if d == deviceID {
+			return nil
+		}
+	}
+	if int64(len(devices)) >= limit {
+		return ErrFleetLimitReached
+	}
+	return nil
+}
+
+// GetDeployments returns a buyer's deployments, most recent first
+func (s *MeteringService) GetDeployments(buyerID uuid.UUID, page, limit int) ([]models.Deployment, int64, error) {
+	var deployments []models.Deployment
+	var total int64
+
+	query := s.db.Model(&models.Deployment{}).Where("buyer_id = ?", buyerID)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Preload("Agent").Order("deployed_at DESC").Offset(offset).Limit(limit).Find(&deployments).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return deployments, total, nil
+}
+
+// getActiveDeployment loads a buyer's deployment that is not decommissioned
+func (s *MeteringService) getActiveDeployment(buyerID, id uuid.UUID) (*models.Deployment, error) {
+	var deployment models.Deployment
+	if err := s.db.Where("id = ? AND buyer_id = ?", id, buyerID).First(&deployment).Error; err != nil {
+		return nil, err
+	}
+	if deployment.DecommissionedAt != nil {
+		return nil, ErrDecommissioned
+	}
+	return &deployment, nil
+}
+
+// CheckInReport is what a device may report when checking in: the release
+// it runs, and why installing the pinned release failed
+type CheckInReport struct {
+	Version     string
+	UpdateError string
+	ReceivedAt  time.Time // zero for now
+}
+
+// RecordCheckIn records a telemetry check-in from a deployed device. A
+// device reporting the pinned release for the first time has applied an
+// update; one reporting an error failed to.
+func (s *MeteringService) RecordCheckIn(buyerID, id uuid.UUID, report CheckInReport) error {
+	deployment, err := s.getActiveDeployment(buyerID, id)
+	if err != nil {
+		return err
+	}
+
+	now := report.ReceivedAt
+	if now.IsZero() {
+		now = time.Now()
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{
+			"last_check_in_at": gorm.Expr("GREATEST(last_check_in_at, ?)", now),
+			"offline_at":       nil,
+		}
+		if err := s.recordUpdate(tx, deployment, report, updates); err != nil {
+			return err
+		}
+		if err := tx.Model(deployment).Updates(updates).Error; err != nil {
+			return err
+		}
+		// The device is back, so it can be reported offline again
+		if deployment.OfflineAt != nil {
+			if err := tx.Model(&models.Deployment{}).
+				Where("buyer_id = ? AND device_id = ? AND decommissioned_at IS NULL", buyerID, deployment.DeviceID).
+				Update("offline_at", nil).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "deployment_id"}, {Name: "day"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"check_ins": gorm.Expr("deployment_usages.check_ins + 1"),
+			}),
+		}).Create(&models.DeploymentUsage{
+			DeploymentID: deployment.ID,
+			Day:          now.UTC().Truncate(24 * time.Hour),
+			CheckIns:     1,
+		}).Error
+	})
+}
+
+// recordUpdate queues update.applied or update.failed for a check-in report
+// and adds the running version to the deployment's updates
+func (s *MeteringService) recordUpdate(tx *gorm.DB, deployment *models.Deployment, report CheckInReport, updates map[string]interface{}) error {
+	data := map[string]interface{}{
+		"device_id":  deployment.DeviceID,
+		"deployment": deviceDeployment{DeploymentID: deployment.ID, AgentID: deployment.AgentID, Version: deployment.Version},
+	}
+	if report.UpdateError != "" {
+		data["running_version"] = report.Version
+		data["error"] = report.UpdateError
+		if err := settleRolloutTarget(tx, deployment.ID, models.RolloutTargetStatusFailed, report.UpdateError); err != nil {
+			return err
+		}
+		return emitEvent(tx, deployment.BuyerID, models.WebhookEventUpdateFailed, data)
+	}
+	if report.Version == "" || report.Version == deployment.RunningVersion {
+		return nil
+	}
+
+	updates["running_version"] = report.Version
+	if report.Version != deployment.Version {
+		return nil
+	}
+	data["previous_version"] = deployment.RunningVersion
+	if err := settleRolloutTarget(tx, deployment.ID, models.RolloutTargetStatusSucceeded, ""); err != nil {
+		return err
+	}
+	return emitEvent(tx, deployment.BuyerID, models.WebhookEventUpdateApplied, data)
+}
+
+// Decommission stops billing a deployment from now on. The current month is
+// prorated to the days it was deployed.
+func (s *MeteringService) Decommission(buyerID, id uuid.UUID) (*models.Deployment, error) {
+	deployment, err := s.getActiveDeployment(buyerID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	deployment.DecommissionedAt = &now
+	if err := s.db.Model(deployment).Update("decommissioned_at", now).Error; err != nil {
+		return nil, err
+	}
+	return deployment, nil
+}
+
+// Run generates the previous month's invoices every poll interval until ctx
+// is done. Generation is idempotent, so repeated runs only fill in invoices
+// that are missing.
+func (s *MeteringService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now().UTC()
+			period := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+			if _, err := s.GenerateInvoices(period); err != nil {
+				log.Error().Err(err).Msg("Failed to generate usage invoices")
+			}
+		}
+	}
+}
+
+// GenerateInvoices invoices every buyer for the month starting at period.
+// A deployment is billed for the month if it checked in during the month,
+// prorated to the days it was deployed within the month. It returns the
+// number of invoices created.
+func (s *MeteringService) GenerateInvoices(period time.Time) (int, error) {
+	start := time.Date(period.Year(), period.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	if end.After(time.Now()) {
+		return 0, fmt.Errorf("period %s has not ended", start.Format("2006-01"))
+	}
+	daysInPeriod := int(end.Sub(start).Hours() / 24)
+
+	var usage []struct {
+		DeploymentID uuid.UUID
+		CheckInDays  int
+	}
+	if err := s.db.Model(&models.DeploymentUsage{}).
+		Select("deployment_id, COUNT(*) AS check_in_days").
+		Where("day >= ? AND day < ?", start, end).
+		Group("deployment_id").
+		Scan(&usage).Error; err != nil {
+		return 0, err
+	}
+
+	ids := make([]uuid.UUID, len(usage))
+	checkInDays := make(map[uuid.UUID]int, len(usage))
+	for i, u := range usage {
+		ids[i] = u.DeploymentID
+		checkInDays[u.DeploymentID] = u.CheckInDays
+	}
+	var deployments []models.Deployment
+	if len(ids) > 0 {
+		// Deleted agents are still billed for the days they ran
+		if err := s.db.Preload("Agent", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).
+			Where("id IN ?", ids).Find(&deployments).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	type invoiceKey struct {
+		buyerID  uuid.UUID
+		currency string
+	}
+	invoices := make(map[invoiceKey]*models.Invoice)
+	for _, deployment := range deployments {
+		// Bill whole UTC days from deployment through decommissioning
+		from := deployment.DeployedAt.UTC().Truncate(24 * time.Hour)
+		if from.Before(start) {
+			from = start
+		}
+		to := end
+		if deployment.DecommissionedAt != nil {
+			if last := deployment.DecommissionedAt.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour); last.Before(to) {
+				to = last
+			}
+		}
+		days := int(to.Sub(from) / (24 * time.Hour))
+		if days <= 0 {
+			continue
+		}
+
+		line := models.InvoiceLine{
+			DeploymentID: deployment.ID,
+			AgentID:      deployment.AgentID,
+			DeviceID:     deployment.DeviceID,
+			DaysBilled:   days,
+			DaysInPeriod: daysInPeriod,
+			CheckInDays:  checkInDays[deployment.ID],
+			UnitPrice:    deployment.Agent.Price,
+			Amount:       prorate(deployment.Agent.Price, days, daysInPeriod),
+			Currency:     deployment.Agent.Currency,
+		}
+
+		key := invoiceKey{deployment.BuyerID, deployment.Agent.Currency}
+		invoice, ok := invoices[key]
+		if !ok {
+			invoice = &models.Invoice{
+				BuyerID:     deployment.BuyerID,
+				PeriodStart: start,
+				PeriodEnd:   end,
+				Currency:    deployment.Agent.Currency,
+				Status:      models.InvoiceStatusIssued,
+			}
+			invoices[key] = invoice
+		}
+		invoice.Lines = append(invoice.Lines, line)
+		invoice.Total += line.Amount
+	}
+
+	created := 0
+	for _, invoice := range invoices {
+		// The unique buyer/period/currency index makes reruns skip invoices
+		// that already exist
+		var inserted bool
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Omit("Lines").Create(invoice)
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			for i := range invoice.Lines {
+				invoice.Lines[i].InvoiceID = invoice.ID
+			}
+			inserted = true
+			return tx.Create(&invoice.Lines).Error
+		})
+		if err != nil {
+			return created, err
+		}
+		if inserted {
+			created++
+		}
+	}
+
+	log.Info().Str("period", start.Format("2006-01")).Int("invoices", created).Msg("Generated usage invoices")
+	return created, nil
+}
+
+// prorate returns the share of a monthly price for days out of daysInPeriod,
+// rounded half up to the nearest minor unit
+func prorate(price models.Money, days, daysInPeriod int) models.Money {
+	return (price*models.Money(days)*2 + models.Money(daysInPeriod)) / (models.Money(daysInPeriod) * 2)
+}
+
+// GetInvoices returns a buyer's invoices, most recent first
+func (s *MeteringService) GetInvoices(buyerID uuid.UUID, page, limit int) ([]models.Invoice, int64, error) {
+	var invoices []models.Invoice
+	var total int64
+
+	query := s.db.Model(&models.Invoice{}).Where("buyer_id = ?", buyerID)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Order("period_start DESC").Offset(offset).Limit(limit).Find(&invoices).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return invoices, total, nil
+}
+
+// GetInvoice returns one of a buyer's invoices with its lines
+func (s *MeteringService) GetInvoice(buyerID, id uuid.UUID) (*models.Invoice, error) {
+	var invoice models.Invoice
+	if err := s.db.Preload("Lines").Where("id = ? AND buyer_id = ?", id, buyerID).First(&invoice).Error; err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
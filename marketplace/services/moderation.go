@@ -0,0 +1,258 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrInvalidReport is returned for a report with an unknown target type
+	// or reason
+	ErrInvalidReport = errors.New("target_type must be review, agent or user and reason one of spam, harassment, inappropriate, malware, impersonation, copyright or other")
+	// ErrReportTargetNotFound is returned when the reported content does not exist
+	ErrReportTargetNotFound = errors.New("reported content not found")
+	// ErrAlreadyReported is returned when the user has an open report about
+	// the same content
+	ErrAlreadyReported = errors.New("you have already reported this")
+	// ErrReportClosed is returned when deciding a report that was already decided
+	ErrReportClosed = errors.New("report has already been decided")
+	// ErrInvalidModerationAction is returned for an action that does not
+	// apply to the reported content
+	ErrInvalidModerationAction = errors.New("action must be none, hide, warn or ban, and only reviews and agents can be hidden")
+)
+
+// ModerationDecision is the outcome of resolving a report
+type ModerationDecision struct {
+	Action    models.ModerationAction `json:"action"`
+	AuthorID  uuid.UUID               `json:"author_id"` // who wrote or owns the content
+	Reports   int64                   `json:"reports"`   // open reports about the target settled
+	NewStatus models.UserStatus       `json:"-"`
+	Previous  models.UserStatus       `json:"-"` // the author's status before a ban
+}
+
+// ModerationService queues users' reports of abusive reviews, agents and
+// users and carries out admins' decisions on them
+type ModerationService struct {
+	db      *gorm.DB
+	reviews *ReviewService
+}
+
+// NewModerationService creates a new moderation service
+func NewModerationService(db *gorm.DB, reviews *ReviewService) *ModerationService {
+	return &ModerationService{db: db, reviews: reviews}
+}
+
+// CreateReport files a report. A user can only have one open report about
+// the same content.
+func (s *ModerationService) CreateReport(report *models.Report) error {
+	switch report.Reason {
+	case models.ReportReasonSpam, models.ReportReasonHarassment, models.ReportReasonInappropriate,
+		models.ReportReasonMalware, models.ReportReasonImpersonation, models.ReportReasonCopyright,
+		models.ReportReasonOther:
+	default:
+		return ErrInvalidReport
+	}
+	if _, err := s.author(s.db, report.TargetType, report.TargetID); err != nil {
+		return err
+	}
+
+	var open int64
+	if err := s.db.Model(&models.Report{}).
+		Where("reporter_id = ? AND target_type = ? AND target_id = ? AND status = ?",
+			report.ReporterID, report.TargetType, report.TargetID, models.ReportStatusOpen).
+		Count(&open).Error; err != nil {
+		return err
+	}
+	if open > 0 {
+		return ErrAlreadyReported
+	}
+
+	report.Status = models.ReportStatusOpen
+	return s.db.Create(report).Error
+}
+
+// GetReports returns reports, optionally of one status and target type.
+// Open reports come oldest first, as a queue; decided ones newest first.
+func (s *ModerationService) GetReports(status models.ReportStatus, targetType models.ReportTarget, page, limit int) ([]models.Report, int64, error) {
+	query := s.db.Model(&models.Report{})
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	order := "created_at DESC"
+	if status == models.ReportStatusOpen {
+		order = "created_at ASC"
+	}
+	var reports []models.Report
+	if err := query.Order(order).Offset((page - 1) * limit).Limit(limit).Find(&reports).Error; err != nil {
+		return nil, 0, err
+	}
+	return reports, total, nil
+}
+
+// Resolve carries out a moderator's decision on a report and settles every
+// open report about the same target with it. Warned and banned authors
+// are notified.
+func (s *ModerationService) Resolve(report *models.Report, moderatorID uuid.UUID, action models.ModerationAction, note string) (*ModerationDecision, error) {
+	switch action {
+	case models.ModerationActionNone, models.ModerationActionWarn, models.ModerationActionBan:
+	case models.ModerationActionHide:
+		if report.TargetType == models.ReportTargetUser {
+			return nil, ErrInvalidModerationAction
+		}
+	default:
+		return nil, ErrInvalidModerationAction
+	}
+
+	decision := &ModerationDecision{Action: action}
+	var hiddenReviewAgent *uuid.UUID
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(report, "id = ?", report.ID).Error; err != nil {
+			return err
+		}
+		if report.Status != models.ReportStatusOpen {
+			return ErrReportClosed
+		}
+
+		author, err := s.author(tx, report.TargetType, report.TargetID)
+		if err != nil {
+			return err
+		}
+		decision.AuthorID = author
+
+		switch action {
+		case models.ModerationActionHide:
+			if report.TargetType == models.ReportTargetReview {
+				var review models.Review
+				if err := tx.Select("id", "agent_id").First(&review, "id = ?", report.TargetID).Error; err != nil {
+					return err
+				}
+				if err := tx.Model(&review).Update("hidden_at", time.Now()).Error; err != nil {
+					return err
+				}
+				hiddenReviewAgent = &review.AgentID
+			} else if err := tx.Model(&models.Agent{}).Where("id = ?", report.TargetID).
+				Update("status", models.AgentStatusRejected).Error; err != nil {
+				return err
+			}
+		case models.ModerationActionWarn:
+			if err := tx.Model(&models.User{}).Where("id = ?", author).
+				UpdateColumn("warnings", gorm.Expr("warnings + 1")).Error; err != nil {
+				return err
+			}
+		case models.ModerationActionBan:
+			var user models.User
+			if err := tx.Select("id", "status").First(&user, "id = ?", author).Error; err != nil {
+				return err
+			}
+			decision.Previous = user.Status
+			decision.NewStatus = models.UserStatusBanned
+			if err := tx.Model(&user).Update("status", models.UserStatusBanned).Error; err != nil {
+				return err
+			}
+		}
+
+		if action == models.ModerationActionWarn || action == models.ModerationActionBan {
+			if err := notify(tx, moderationNotice(report, action, note, author)); err != nil {
+				return err
+			}
+		}
+
+		status := models.ReportStatusResolved
+		if action == models.ModerationActionNone {
+			status = models.ReportStatusDismissed
+		}
+		now := time.Now()
+		result := tx.Model(&models.Report{}).
+			Where("target_type = ? AND target_id = ? AND status = ?", report.TargetType, report.TargetID, models.ReportStatusOpen).
+			Updates(map[string]interface{}{
+				"status":         status,
+				"action":         action,
+				"moderator_id":   moderatorID,
+				"moderator_note": note,
+				"resolved_at":    now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		decision.Reports = result.RowsAffected
+
+		report.Status = status
+		report.Action = action
+		report.ModeratorID = &moderatorID
+		report.ModeratorNote = note
+		report.ResolvedAt = &now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A hidden review stops counting towards the agent's rating
+	if hiddenReviewAgent != nil {
+		if err := s.reviews.RebuildSummary(*hiddenReviewAgent); err != nil {
+			return decision, fmt.Errorf("review hidden but summary not rebuilt: %w", err)
+		}
+	}
+	return decision, nil
+}
+
+// author returns the user responsible for reported content: a review's
+// reviewer, an agent's publisher or the user themselves
+func (s *ModerationService) author(db *gorm.DB, targetType models.ReportTarget, targetID uuid.UUID) (uuid.UUID, error) {
+	var err error
+	var author uuid.UUID
+	switch targetType {
+	case models.ReportTargetReview:
+		var review models.Review
+		err = db.Select("user_id").First(&review, "id = ?", targetID).Error
+		author = review.UserID
+	case models.ReportTargetAgent:
+		var agent models.Agent
+		err = db.Select("publisher_id").First(&agent, "id = ?", targetID).Error
+		author = agent.PublisherID
+	case models.ReportTargetUser:
+		var user models.User
+		err = db.Select("id").First(&user, "id = ?", targetID).Error
+		author = user.ID
+	default:
+		return uuid.Nil, ErrInvalidReport
+	}
+	if err == gorm.ErrRecordNotFound {
+		return uuid.Nil, ErrReportTargetNotFound
+	}
+	return author, err
+}
+
+// moderationNotice is the notification telling an author they were warned
+// or banned
+func moderationNotice(report *models.Report, action models.ModerationAction, note string, author uuid.UUID) *models.Notification {
+	title := fmt.Sprintf("You received a warning about your %s", report.TargetType)
+	if action == models.ModerationActionBan {
+		title = "Your account has been banned"
+	}
+	body := fmt.Sprintf("A moderator reviewed reports of %s about your %s.", report.Reason, report.TargetType)
+	if note != "" {
+		body += "\n\n" + note
+	}
+	return &models.Notification{
+		UserID: author,
+		Type:   models.NotificationTypeModeration,
+		Title:  title,
+		Body:   body,
+	}
+}
@@ -0,0 +1,721 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// ErrInvalidNotificationSettings is returned for an unknown notification
+// type, frequency, channel or timezone, or a quiet hour outside 0-23
+var ErrInvalidNotificationSettings = errors.New("invalid notification settings")
+
+// notificationTypes lists the types users can set channels and a frequency
+// for
+var notificationTypes = []models.NotificationType{
+	models.NotificationTypeReviewReminder,
+	models.NotificationTypeCheckoutRecovery,
+	models.NotificationTypePublisherApplication,
+	models.NotificationTypeOrgInvitation,
+	models.NotificationTypeBinaryScan,
+	models.NotificationTypeOrgPurchase,
+	models.NotificationTypeStaleDraft,
+	models.NotificationTypeSubscription,
+	models.NotificationTypeAPIUsage,
+	models.NotificationTypeUnsoldAgent,
+	models.NotificationTypeReviewReply,
+	models.NotificationTypePlatformUpdate,
+	models.NotificationTypeModeration,
+	models.NotificationTypeAgentApproved,
+	models.NotificationTypeAgentRejected,
+	models.NotificationTypeNewReview,
+	models.NotificationTypeNewPurchase,
+	models.NotificationTypeDeploymentFinished,
+}
+
+// notificationChannels lists the channels notifications go to, all of
+// them unless the user turned some off for a type
+var notificationChannels = []models.NotificationChannel{
+	models.NotificationChannelInApp,
+	models.NotificationChannelEmail,
+	models.NotificationChannelWebhook,
+}
+
+// marketingNotifications are the notification types that are marketing,
+// only emailed to users who consent to it
+var marketingNotifications = map[models.NotificationType]bool{
+	models.NotificationTypeReviewReminder:   true,
+	models.NotificationTypeCheckoutRecovery: true,
+}
+
+// NotificationSettings are a user's notification settings
+type NotificationSettings struct {
+	Timezone        string                                                   `json:"timezone"`
+	QuietHoursStart *int                                                     `json:"quiet_hours_start"`
+	QuietHoursEnd   *int                                                     `json:"quiet_hours_end"`
+	Frequencies     map[models.NotificationType]models.DigestFrequency       `json:"frequencies"`
+	Channels        map[models.NotificationType][]models.NotificationChannel `json:"channels"`
+}
+
+// NotificationService lists users' in-app notifications and emails them.
+// Notifications of each type go out immediately, hourly or daily as the
+// user chose; the ones due together are combined into a single digest, and
+// none are sent during the user's quiet hours.
+type NotificationService struct {
+	db      *gorm.DB
+	mailer  Mailer
+	cfg     config.NotificationsConfig
+	consent *ConsentService
+}
+
+// NewNotificationService creates a new notification service
+func NewNotificationService(db *gorm.DB, mailer Mailer, cfg config.NotificationsConfig, consent *ConsentService) *NotificationService {
+	return &NotificationService{db: db, mailer: mailer, cfg: cfg, consent: consent}
+}
+
+// GetSettings returns a user's settings, with the default frequency and
+// channels filled in for every type
+func (s *NotificationService) GetSettings(userID uuid.UUID) (*NotificationSettings, error) {
+	var user models.User
+	if err := s.db.Select("id", "timezone", "quiet_hours_start", "quiet_hours_end").First(&user, "id = ?", userID).Error; err != nil {
+		return nil, err
+	}
+	prefs, err := s.preferences(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &NotificationSettings{
+		Timezone:        user.Timezone,
+		QuietHoursStart: user.QuietHoursStart,
+		QuietHoursEnd:   user.QuietHoursEnd,
+		Frequencies:     make(map[models.NotificationType]models.DigestFrequency, len(notificationTypes)),
+		Channels:        make(map[models.NotificationType][]models.NotificationChannel, len(notificationTypes)),
+	}
+	for _, t := range notificationTypes {
+		settings.Frequencies[t] = prefs[t].Frequency
+		settings.Channels[t] = channelsOf(prefs[t])
+	}
+	return settings, nil
+}
+
+// UpdateSettings replaces a user's settings. Types left out of Frequencies
+// or Channels keep their current frequency or channels.
+func (s *NotificationService) UpdateSettings(userID uuid.UUID, settings *NotificationSettings) error {
+	if _, err := time.LoadLocation(settings.Timezone); err != nil || settings.Timezone == "" {
+		return ErrInvalidNotificationSettings
+	}
+	if (settings.QuietHoursStart == nil) != (settings.QuietHoursEnd == nil) {
+		return ErrInvalidNotificationSettings
+	}
+	for _, hour := range []*int{settings.QuietHoursStart, settings.QuietHoursEnd} {
+		if hour != nil && (*hour < 0 || *hour > 23) {
+			return ErrInvalidNotificationSettings
+		}
+	}
+	for t, frequency := range settings.Frequencies {
+		if !knownNotificationType(t) {
+			return ErrInvalidNotificationSettings
+		}
+		switch frequency {
+		case models.DigestFrequencyImmediate, models.DigestFrequencyHourly, models.DigestFrequencyDaily:
+		default:
+			return ErrInvalidNotificationSettings
+		}
+	}
+	for t, channels := range settings.Channels {
+		if !knownNotificationType(t) {
+			return ErrInvalidNotificationSettings
+		}
+		for _, channel := range channels {
+			if !knownNotificationChannel(channel) {
+				return ErrInvalidNotificationSettings
+			}
+		}
+	}
+
+	prefs, err := s.preferences(userID)
+	if err != nil {
+		return err
+	}
+	changed := make(map[models.NotificationType]bool)
+	for t, frequency := range settings.Frequencies {
+		pref := prefs[t]
+		pref.Frequency = frequency
+		prefs[t] = pref
+		changed[t] = true
+	}
+	for t, channels := range settings.Channels {
+		pref := prefs[t]
+		pref.Channels = make(models.Tags, 0, len(channels))
+		for _, channel := range notificationChannels {
+			if hasChannel(channels, channel) {
+				pref.Channels = append(pref.Channels, string(channel))
+			}
+		}
+		prefs[t] = pref
+		changed[t] = true
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"timezone":          settings.Timezone,
+			"quiet_hours_start": settings.QuietHoursStart,
+			"quiet_hours_end":   settings.QuietHoursEnd,
+		}).Error; err != nil {
+			return err
+		}
+		for t := range changed {
+			pref := prefs[t]
+			pref.UserID, pref.Type = userID, t
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "user_id"}, {Name: "type"}},
+				DoUpdates: clause.AssignmentColumns([]string{"frequency", "channels"}),
+			}).Create(&pref).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Notify creates a notification on the channels its user wants for its
+// type
+func (s *NotificationService) Notify(notification *models.Notification) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return notify(tx, notification)
+	})
+}
+
+// GetNotifications returns a user's in-app notifications, most recent
+// first, optionally only the unread ones, with the number of unread ones
+func (s *NotificationService) GetNotifications(userID uuid.UUID, unreadOnly bool, page, limit int) ([]models.Notification, int64, int64, error) {
+	listed := s.db.Model(&models.Notification{}).Where("user_id = ? AND hide_in_app = ?", userID, false)
+
+	var unread int64
+	if err := listed.Session(&gorm.Session{}).Where("read_at IS NULL").Count(&unread).Error; err != nil {
+		return nil, 0, 0, err
+	}
+	query := listed
+	if unreadOnly {
+		query = query.Where("read_at IS NULL")
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, 0, err
+	}
+
+	var notifications []models.Notification
+	offset := (page - 1) * limit
+	if err := query.Order("created_at DESC, id").Offset(offset).Limit(limit).Find(&notifications).Error; err != nil {
+		return nil, 0, 0, err
+	}
+	return notifications, total, unread, nil
+}
+
+// MarkRead marks one of a user's notifications read, or unread again. It
+// returns gorm.ErrRecordNotFound for notifications of other users.
+func (s *NotificationService) MarkRead(userID, id uuid.UUID, read bool) (*models.Notification, error) {
+	var notification models.Notification
+	if err := s.db.Where("id = ? AND user_id = ? AND hide_in_app = ?", id, userID, false).First(&notification).Error; err != nil {
+		return nil, err
+	}
+	switch {
+	case read && notification.ReadAt == nil:
+		now := time.Now()
+		notification.ReadAt = &now
+	case !read && notification.ReadAt != nil:
+		notification.ReadAt = nil
+	default:
+		return &notification, nil
+	}
+	if err := s.db.Model(&notification).Update("read_at", notification.ReadAt).Error; err != nil {
+		return nil, err
+	}
+	return &notification, nil
+}
+
+// MarkAllRead marks every unread notification of a user read and returns
+// how many there were
+func (s *NotificationService) MarkAllRead(userID uuid.UUID) (int64, error) {
+	result := s.db.Model(&models.Notification{}).
+		Where("user_id = ? AND read_at IS NULL", userID).
+		Update("read_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
+// GetDigests returns the digests sent to a user, most recent first
+func (s *NotificationService) GetDigests(userID uuid.UUID, page, limit int) ([]models.NotificationDigest, int64, error) {
+	query := s.db.Model(&models.NotificationDigest{}).Where("user_id = ?", userID)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var digests []models.NotificationDigest
+	offset := (page - 1) * limit
+	if err := query.Order("sent_at DESC").Offset(offset).Limit(limit).Find(&digests).Error; err != nil {
+		return nil, 0, err
+	}
+	return digests, total, nil
+}
+
+// Run sends due notifications every poll interval until ctx is done
+func (s *NotificationService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.SendDue(time.Now()); err != nil {
+				log.Error().Err(err).Msg("Failed to send notification digests")
+			}
+		}
+	}
+}
+
+// SendDue sends the due notifications of every user with unsent ones,
+// loading users in batches
+func (s *NotificationService) SendDue(now time.Time) error {
+	after := uuid.Nil
+	for {
+		var userIDs []uuid.UUID
+		if err := s.db.Model(&models.Notification{}).
+			Where("digest_id IS NULL AND skip_email = ? AND user_id > ?", false, after).
+			Distinct("user_id").
+			Order("user_id").
+			Limit(s.cfg.BatchSize).
+			Pluck("user_id", &userIDs).Error; err != nil {
+			return err
+		}
+
+		for _, id := range userIDs {
+			if err := s.sendUser(id, now); err != nil {
+				log.Error().Err(err).Str("user_id", id.String()).Msg("Failed to send notifications")
+			}
+		}
+		if len(userIDs) < s.cfg.BatchSize {
+			return nil
+		}
+		after = userIDs[len(userIDs)-1]
+	}
+}
+
+// sendUser sends one digest per frequency that is due for a user
+func (s *NotificationService) sendUser(userID uuid.UUID, now time.Time) error {
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			// Deleted users are never emailed
+			return s.db.Where("user_id = ? AND digest_id IS NULL AND skip_email = ?", userID, false).Delete(&models.Notification{}).Error
+		}
+		return err
+	}
+
+	location, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	local := now.In(location)
+	if inQuietHours(local.Hour(), user.QuietHoursStart, user.QuietHoursEnd) {
+		return nil
+	}
+
+	prefs, err := s.preferences(userID)
+	if err != nil {
+		return err
+	}
+
+	var pending []models.Notification
+	if err := s.db.Where("user_id = ? AND digest_id IS NULL AND skip_email = ?", userID, false).
+		Order("created_at ASC").
+		Find(&pending).Error; err != nil {
+		return err
+	}
+	pending, err = s.withoutUnconsented(userID, pending)
+	if err != nil {
+		return err
+	}
+
+	batches := make(map[models.DigestFrequency][]models.Notification)
+	for _, n := range pending {
+		frequency := models.DigestFrequencyImmediate
+		if pref, ok := prefs[n.Type]; ok {
+			frequency = pref.Frequency
+		}
+		batches[frequency] = append(batches[frequency], n)
+	}
+
+	for _, frequency := range []models.DigestFrequency{models.DigestFrequencyImmediate, models.DigestFrequencyHourly, models.DigestFrequencyDaily} {
+		batch := batches[frequency]
+		if len(batch) == 0 {
+			continue
+		}
+		due, err := s.digestDue(userID, frequency, local)
+		if err != nil {
+			return err
+		}
+		if due {
+			if err := s.sendDigest(&user, frequency, batch, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// withoutUnconsented drops the marketing notifications from a user's
+// pending ones unless the user consents to marketing email. They are
+// deleted, so consenting later does not send a backlog of them.
+func (s *NotificationService) withoutUnconsented(userID uuid.UUID, pending []models.Notification) ([]models.Notification, error) {
+	var marketing []uuid.UUID
+	for _, n := range pending {
+		if marketingNotifications[n.Type] {
+			marketing = append(marketing, n.ID)
+		}
+	}
+	if len(marketing) == 0 {
+		return pending, nil
+	}
+	granted, err := s.consent.Granted(userID, models.ConsentMarketingEmail)
+	if err != nil || granted {
+		return pending, err
+	}
+
+	// Unless they are also in-app; those only stop being emailed
+	if err := s.db.Where("id IN ? AND digest_id IS NULL AND hide_in_app = ?", marketing, true).Delete(&models.Notification{}).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&models.Notification{}).Where("id IN ? AND digest_id IS NULL", marketing).Update("skip_email", true).Error; err != nil {
+		return nil, err
+	}
+	kept := pending[:0]
+	for _, n := range pending {
+		if !marketingNotifications[n.Type] {
+			kept = append(kept, n)
+		}
+	}
+	return kept, nil
+}
+
+// digestDue reports whether a digest of frequency can be sent to a user at
+// local time: hourly ones once per clock hour, daily ones once per local day
+// from the configured hour
+func (s *NotificationService) digestDue(userID uuid.UUID, frequency models.DigestFrequency, local time.Time) (bool, error) {
+	var since time.Time
+	switch frequency {
+	case models.DigestFrequencyHourly:
+		since = local.Truncate(time.Hour)
+	case models.DigestFrequencyDaily:
+		if local.Hour() < s.cfg.DailyHour {
+			return false, nil
+		}
+		since = time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	default:
+		return true, nil
+	}
+
+	var sent int64
+	if err := s.db.Model(&models.NotificationDigest{}).
+		Where("user_id = ? AND frequency = ? AND sent_at >= ?", userID, frequency, since).
+		Count(&sent).Error; err != nil {
+		return false, err
+	}
+	return sent == 0, nil
+}
+
+// sendDigest records a digest of notifications and emails it. The
+// notifications are claimed in the same transaction, so instances running
+// concurrently cannot send them twice.
+func (s *NotificationService) sendDigest(user *models.User, frequency models.DigestFrequency, batch []models.Notification, now time.Time) error {
+	digest := models.NotificationDigest{
+		ID:        models.NewID(),
+		UserID:    user.ID,
+		Frequency: frequency,
+		Count:     len(batch),
+		SentAt:    now,
+	}
+	digest.Subject, digest.Body = s.renderDigest(batch)
+
+	ids := make([]uuid.UUID, len(batch))
+	for i, n := range batch {
+		ids[i] = n.ID
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Notification{}).
+			Where("id IN ? AND digest_id IS NULL", ids).
+			Update("digest_id", digest.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != int64(len(ids)) {
+			// Another instance got some of them first; roll back and leave
+			// the rest for the next poll
+			return errDigestRaced
+		}
+		return tx.Create(&digest).Error
+	})
+	if err == errDigestRaced {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.mailer.Send(user.Email, digest.Subject, digest.Body); err != nil {
+		log.Error().Err(err).Str("digest_id", digest.ID.String()).Msg("Failed to email notification digest")
+	}
+	return nil
+}
+
+// errDigestRaced rolls back a digest whose notifications were partly claimed elsewhere
+var errDigestRaced = errors.New("notifications already claimed")
+
+// renderDigest renders the subject and plain-text body of a digest. A
+// single notification is sent as it is.
+func (s *NotificationService) renderDigest(batch []models.Notification) (string, string) {
+	base := strings.TrimSuffix(s.cfg.BaseURL, "/")
+
+	if len(batch) == 1 {
+		n := batch[0]
+		body := n.Body
+		if n.Link != "" {
+			body += "\n\n" + base + n.Link
+		}
+		return n.Title, body + "\n"
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Here is what happened on EdgePlug Marketplace:\n")
+	for _, n := range batch {
+		fmt.Fprintf(&body, "\n- %s\n", n.Title)
+		if n.Body != "" {
+			fmt.Fprintf(&body, "  %s\n", n.Body)
+		}
+		if n.Link != "" {
+			fmt.Fprintf(&body, "  %s%s\n", base, n.Link)
+		}
+	}
+	body.WriteString("\nYou can choose how often you get these emails in your notification settings.\n")
+	return fmt.Sprintf("You have %d new notifications", len(batch)), body.String()
+}
+
+// preferences returns the preference of each notification type for a
+// user: immediate on every channel unless set otherwise
+func (s *NotificationService) preferences(userID uuid.UUID) (map[models.NotificationType]models.NotificationPreference, error) {
+	var stored []models.NotificationPreference
+	if err := s.db.Where("user_id = ?", userID).Find(&stored).Error; err != nil {
+		return nil, err
+	}
+
+	prefs := make(map[models.NotificationType]models.NotificationPreference)
+	for _, t := range notificationTypes {
+		prefs[t] = defaultNotificationPreference(userID, t)
+	}
+	for _, p := range stored {
+		if p.Channels == nil {
+			p.Channels = defaultNotificationPreference(userID, p.Type).Channels
+		}
+		prefs[p.Type] = p
+	}
+	return prefs, nil
+}
+
+func defaultNotificationPreference(userID uuid.UUID, t models.NotificationType) models.NotificationPreference {
+	channels := make(models.Tags, len(notificationChannels))
+	for i, channel := range notificationChannels {
+		channels[i] = string(channel)
+	}
+	return models.NotificationPreference{UserID: userID, Type: t, Frequency: models.DigestFrequencyImmediate, Channels: channels}
+}
+
+// notificationEvent is the data of notification webhook events
+type notificationEvent struct {
+	NotificationID uuid.UUID               `json:"notification_id"`
+	Type           models.NotificationType `json:"type"`
+	Title          string                  `json:"title"`
+	Body           string                  `json:"body,omitempty"`
+	Link           string                  `json:"link,omitempty"`
+}
+
+func newNotificationEvent(n *models.Notification) notificationEvent {
+	return notificationEvent{NotificationID: n.ID, Type: n.Type, Title: n.Title, Body: n.Body, Link: n.Link}
+}
+
+// notify creates a notification on the channels its user wants for its
+// type, streams it live if one of them is in-app, and sends it to the
+// user's webhooks if one of them is webhook. Notifications the user turned
+// every channel off for are dropped. Call it in the transaction of the
+// change it reports, like emitWebhook.
+func notify(tx *gorm.DB, notification *models.Notification) error {
+	var pref models.NotificationPreference
+	err := tx.Where("user_id = ? AND type = ?", notification.UserID, notification.Type).First(&pref).Error
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		pref = defaultNotificationPreference(notification.UserID, notification.Type)
+	case err != nil:
+		return err
+	case pref.Channels == nil:
+		pref.Channels = defaultNotificationPreference(notification.UserID, notification.Type).Channels
+	}
+
+	channels := channelsOf(pref)
+	if len(channels) == 0 {
+		return nil
+	}
+	notification.HideInApp = !hasChannel(channels, models.NotificationChannelInApp)
+	notification.SkipEmail = !hasChannel(channels, models.NotificationChannelEmail)
+	if err := tx.Create(notification).Error; err != nil {
+		return err
+	}
+	if !notification.HideInApp {
+		if err := streamEvent(tx, notification.UserID, StreamEventNotification, notification); err != nil {
+			return err
+		}
+	}
+	if !hasChannel(channels, models.NotificationChannelWebhook) {
+		return nil
+	}
+	return emitWebhook(tx, notification.UserID, models.WebhookEventNotification, newNotificationEvent(notification))
+}
+
+// notifyAll notifies users of one type at once, as notify does for each,
+// and returns how many notifications it created
+func notifyAll(tx *gorm.DB, notifications []models.Notification) (int, error) {
+	if len(notifications) == 0 {
+		return 0, nil
+	}
+	t := notifications[0].Type
+	userIDs := make([]uuid.UUID, len(notifications))
+	for i, n := range notifications {
+		userIDs[i] = n.UserID
+	}
+
+	var stored []models.NotificationPreference
+	if err := tx.Where("type = ? AND user_id IN ?", t, userIDs).Find(&stored).Error; err != nil {
+		return 0, err
+	}
+	channels := make(map[uuid.UUID][]models.NotificationChannel, len(stored))
+	for _, pref := range stored {
+		if pref.Channels != nil {
+			channels[pref.UserID] = channelsOf(pref)
+		}
+	}
+
+	created := make([]models.Notification, 0, len(notifications))
+	for _, n := range notifications {
+		wanted, set := channels[n.UserID]
+		if !set {
+			wanted = notificationChannels
+		}
+		if len(wanted) == 0 {
+			continue
+		}
+		n.HideInApp = !hasChannel(wanted, models.NotificationChannelInApp)
+		n.SkipEmail = !hasChannel(wanted, models.NotificationChannelEmail)
+		created = append(created, n)
+	}
+	if len(created) == 0 {
+		return 0, nil
+	}
+	if err := tx.Create(&created).Error; err != nil {
+		return 0, err
+	}
+	var events []models.StreamEvent
+	for i := range created {
+		if created[i].HideInApp {
+			continue
+		}
+		event, err := newStreamEvent(created[i].UserID, StreamEventNotification, &created[i])
+		if err != nil {
+			return 0, err
+		}
+		events = append(events, event)
+	}
+	if len(events) > 0 {
+		if err := tx.CreateInBatches(events, 500).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	// Only users with active webhooks can get webhook events
+	var subscribed []uuid.UUID
+	if err := tx.Model(&models.WebhookSubscription{}).
+		Where("user_id IN ? AND active = ?", userIDs, true).
+		Distinct("user_id").
+		Pluck("user_id", &subscribed).Error; err != nil {
+		return 0, err
+	}
+	hooked := make(map[uuid.UUID]bool, len(subscribed))
+	for _, id := range subscribed {
+		hooked[id] = true
+	}
+	for _, n := range created {
+		wanted, set := channels[n.UserID]
+		if !hooked[n.UserID] || (set && !hasChannel(wanted, models.NotificationChannelWebhook)) {
+			continue
+		}
+		if err := emitWebhook(tx, n.UserID, models.WebhookEventNotification, newNotificationEvent(&n)); err != nil {
+			return 0, err
+		}
+	}
+	return len(created), nil
+}
+
+func channelsOf(pref models.NotificationPreference) []models.NotificationChannel {
+	channels := make([]models.NotificationChannel, len(pref.Channels))
+	for i, channel := range pref.Channels {
+		channels[i] = models.NotificationChannel(channel)
+	}
+	return channels
+}
+
+func hasChannel(channels []models.NotificationChannel, channel models.NotificationChannel) bool {
+	for _, c := range channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+func knownNotificationChannel(channel models.NotificationChannel) bool {
+	return hasChannel(notificationChannels, channel)
+}
+
+// inQuietHours reports whether a local hour falls in quiet hours running
+// from start up to end, possibly past midnight
+func inQuietHours(hour int, start, end *int) bool {
+	if start == nil || end == nil || *start == *end {
+		return false
+	}
+	if *start < *end {
+		return hour >= *start && hour < *end
+	}
+	return hour >= *start || hour < *end
+}
+
+func knownNotificationType(t models.NotificationType) bool {
+	for _, known := range notificationTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
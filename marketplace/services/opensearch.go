@@ -0,0 +1,240 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/edgeplug/marketplace/config"
+)
+
+// openSearchPageSize is the number of documents read per page when listing
+// the whole index
+const openSearchPageSize = 1000
+
+// openSearchMapping is the mapping of the agents index
+const openSearchMapping = `{
+  "mappings": {
+    "properties": {
+      "agent_id":        {"type": "keyword"},
+      "name":            {"type": "text", "fields": {"keyword": {"type": "keyword"}}},
+      "description":     {"type": "text"},
+      "category":        {"type": "keyword"},
+      "tags":            {"type": "keyword"},
+      "status":          {"type": "keyword"},
+      "publisher_id":    {"type": "keyword"},
+      "organization_id": {"type": "keyword"},
+      "version":         {"type": "keyword"},
+      "safety_level":    {"type": "keyword"},
+      "pricing_model":   {"type": "keyword"},
+      "rating":          {"type": "float"},
+      "review_count":    {"type": "integer"},
+      "updated_at":      {"type": "date"}
+    }
+  }
+}`
+
+// openSearchIndex is a SearchIndex kept in an OpenSearch index
+type openSearchIndex struct {
+	cfg    config.OpenSearchConfig
+	client *http.Client
+}
+
+func newOpenSearchIndex(cfg config.OpenSearchConfig) *openSearchIndex {
+	return &openSearchIndex{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}
+}
+
+func (o *openSearchIndex) EnsureIndex(ctx context.Context) error {
+	resp, err := o.do(ctx, http.MethodHead, "/"+o.cfg.Index, nil, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	return o.call(ctx, http.MethodPut, "/"+o.cfg.Index, strings.NewReader(openSearchMapping), "application/json", nil)
+}
+
+func (o *openSearchIndex) Upsert(ctx context.Context, docs []SearchDocument) error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, doc := range docs {
+		action := map[string]interface{}{"index": map[string]string{"_index": o.cfg.Index, "_id": doc.AgentID.String()}}
+		if err := encoder.Encode(action); err != nil {
+			return err
+		}
+		if err := encoder.Encode(doc); err != nil {
+			return err
+		}
+	}
+	return o.bulk(ctx, &body)
+}
+
+func (o *openSearchIndex) Delete(ctx context.Context, ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, id := range ids {
+		action := map[string]interface{}{"delete": map[string]string{"_index": o.cfg.Index, "_id": id.String()}}
+		if err := encoder.Encode(action); err != nil {
+			return err
+		}
+	}
+	return o.bulk(ctx, &body)
+}
+
+func (o *openSearchIndex) Search(ctx context.Context, query string, limit int) ([]uuid.UUID, error) {
+	request := map[string]interface{}{
+		"size":    limit,
+		"_source": false,
+		"query": map[string]interface{}{
+			"multi_match": map[string]interface{}{
+				"query":  query,
+				"fields": []string{"name^3", "tags^2", "category", "description"},
+			},
+		},
+	}
+
+	var result openSearchHits
+	if err := o.search(ctx, request, &result); err != nil {
+		return nil, err
+	}
+	ids := make([]uuid.UUID, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		if id, err := uuid.Parse(hit.ID); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (o *openSearchIndex) Versions(ctx context.Context) (map[uuid.UUID]time.Time, error) {
+	versions := make(map[uuid.UUID]time.Time)
+	var after []interface{}
+	for {
+		request := map[string]interface{}{
+			"size":    openSearchPageSize,
+			"_source": []string{"updated_at"},
+			"sort":    []map[string]string{{"agent_id": "asc"}},
+			"query":   map[string]interface{}{"match_all": map[string]interface{}{}},
+		}
+		if after != nil {
+			request["search_after"] = after
+		}
+
+		var result openSearchHits
+		if err := o.search(ctx, request, &result); err != nil {
+			return nil, err
+		}
+		for _, hit := range result.Hits.Hits {
+			id, err := uuid.Parse(hit.ID)
+			if err != nil {
+				continue
+			}
+			versions[id] = hit.Source.UpdatedAt
+		}
+		if len(result.Hits.Hits) < openSearchPageSize {
+			return versions, nil
+		}
+		after = result.Hits.Hits[len(result.Hits.Hits)-1].Sort
+	}
+}
+
+// openSearchHits is the part of a search response the index reads
+type openSearchHits struct {
+	Hits struct {
+		Hits []struct {
+			ID     string        `json:"_id"`
+			Sort   []interface{} `json:"sort"`
+			Source struct {
+				UpdatedAt time.Time `json:"updated_at"`
+			} `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+func (o *openSearchIndex) search(ctx context.Context, request interface{}, out interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return o.call(ctx, http.MethodPost, "/"+o.cfg.Index+"/_search", bytes.NewReader(body), "application/json", out)
+}
+
+// bulk sends a bulk request. Deleting a document that is not in the index
+// is not an error.
+func (o *openSearchIndex) bulk(ctx context.Context, body io.Reader) error {
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID     string `json:"_id"`
+			Status int    `json:"status"`
+			Error  struct {
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := o.call(ctx, http.MethodPost, "/_bulk", body, "application/x-ndjson", &result); err != nil {
+		return err
+	}
+	if !result.Errors {
+		return nil
+	}
+
+	for _, item := range result.Items {
+		for action, outcome := range item {
+			if outcome.Status < 300 || (action == "delete" && outcome.Status == http.StatusNotFound) {
+				continue
+			}
+			return fmt.Errorf("opensearch bulk %s of %s: %d: %s", action, outcome.ID, outcome.Status, outcome.Error.Reason)
+		}
+	}
+	return nil
+}
+
+func (o *openSearchIndex) call(ctx context.Context, method, path string, body io.Reader, contentType string, out interface{}) error {
+	resp, err := o.do(ctx, method, path, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("opensearch %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (o *openSearchIndex) do(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(o.cfg.URL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if o.cfg.Username != "" {
+		req.SetBasicAuth(o.cfg.Username, o.cfg.Password)
+	}
+	return o.client.Do(req)
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// OperationStatus is the state of an operation, the same for every kind
+type OperationStatus string
+
+const (
+	OperationPending   OperationStatus = "pending"
+	OperationRunning   OperationStatus = "running"
+	OperationSucceeded OperationStatus = "succeeded"
+	OperationFailed    OperationStatus = "failed"
+	OperationCanceled  OperationStatus = "canceled"
+)
+
+// Kinds of operations
+const (
+	OperationDeviceImport  = "device_import"
+	OperationFleetRollout  = "fleet_rollout"
+	OperationSearchReindex = "search_reindex"
+	OperationBinaryScan    = "binary_scan"
+)
+
+var (
+	// ErrOperationDone is returned when canceling an operation that has
+	// already finished
+	ErrOperationDone = errors.New("operation has already finished")
+	// ErrOperationNotCancelable is returned when canceling an operation of
+	// a kind that cannot be stopped
+	ErrOperationNotCancelable = errors.New("operation of this kind cannot be canceled")
+)
+
+// Operation is the common view of a request that is carried out in the
+// background. Its ID is that of the resource doing the work, such as a
+// device import, and Link is where the resource itself is served.
+type Operation struct {
+	ID         uuid.UUID       `json:"id"`
+	Kind       string          `json:"kind"`
+	Status     OperationStatus `json:"status"`
+	Done       bool            `json:"done"`
+	Progress   *int            `json:"progress,omitempty"` // percentage, when it can be told
+	Result     interface{}     `json:"result,omitempty"`   // once done
+	Error      string          `json:"error,omitempty"`
+	Cancelable bool            `json:"cancelable"`
+	Link       string          `json:"link"`
+	CreatedAt  time.Time       `json:"created_at"`
+	DoneAt     *time.Time      `json:"done_at,omitempty"`
+}
+
+// finish marks an operation done with its status, result and time
+func (op *Operation) finish(status OperationStatus, result interface{}, at *time.Time) {
+	op.Status = status
+	op.Done = true
+	op.Result = result
+	op.DoneAt = at
+	op.Cancelable = false
+}
+
+// percent returns done out of total as a percentage, or nil without a total
+func percent(done, total int64) *int {
+	if total <= 0 {
+		return nil
+	}
+	p := int(min(done, total) * 100 / total)
+	return &p
+}
+
+// OperationService reports the progress of background work of every kind
+// through one resource and cancels it where the kind allows. Each kind keeps
+// its state in its own table; operations are looked up there by ID, among
+// what the user may see.
+type OperationService struct {
+	db      *gorm.DB
+	authz   *AuthorizationService
+	imports *DeviceImportService
+	fleet   *FleetRolloutService
+	search  *SearchService
+}
+
+// NewOperationService creates a new operation service
+func NewOperationService(db *gorm.DB, authz *AuthorizationService, imports *DeviceImportService, fleet *FleetRolloutService, search *SearchService) *OperationService {
+	return &OperationService{db: db, authz: authz, imports: imports, fleet: fleet, search: search}
+}
+
+// GetOperation returns an operation the user may see, or
+// gorm.ErrRecordNotFound. Device imports and fleet rollouts are their
+// owner's, reindexes are admins', and binary scans are seen by those who
+// may inspect the agent.
+func (s *OperationService) GetOperation(id, userID uuid.UUID, role models.UserRole) (*Operation, error) {
+	imp, err := s.imports.GetImport(userID, id)
+	if err == nil {
+		return ImportOperation(imp), nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	rollout, err := s.fleet.GetRollout(userID, id)
+	if err == nil {
+		return RolloutOperation(rollout), nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	if role == models.UserRoleAdmin {
+		reindex, err := s.search.GetReindex(id)
+		if err == nil {
+			return ReindexOperation(reindex), nil
+		}
+		if err != gorm.ErrRecordNotFound {
+			return nil, err
+		}
+	}
+
+	var release models.AgentVersion
+	if err := s.db.First(&release, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	var agent models.Agent
+	if err := s.db.First(&agent, "id = ?", release.AgentID).Error; err != nil {
+		return nil, err
+	}
+	if err := s.authz.AuthorizeAgent(&agent, userID, role, AgentInspect); err != nil {
+		var denied *AccessError
+		if errors.As(err, &denied) {
+			return nil, gorm.ErrRecordNotFound
+		}
+		return nil, err
+	}
+	return ScanOperation(&release), nil
+}
+
+// CancelOperation stops an operation the user may see and returns it as it
+// stands. Work already done is kept: devices imported, waves rolled out and
+// agents indexed.
+func (s *OperationService) CancelOperation(id, userID uuid.UUID, role models.UserRole) (*Operation, error) {
+	op, err := s.GetOperation(id, userID, role)
+	if err != nil {
+		return nil, err
+	}
+	if op.Done {
+		return op, ErrOperationDone
+	}
+
+	switch op.Kind {
+	case OperationDeviceImport:
+		err = s.imports.CancelImport(userID, id)
+	case OperationFleetRollout:
+		_, err = s.fleet.HaltRollout(userID, id)
+		if err == ErrFleetRolloutFinished {
+			err = ErrOperationDone
+		}
+	case OperationSearchReindex:
+		err = s.search.CancelReindex(id)
+	default:
+		return op, ErrOperationNotCancelable
+	}
+	if err != nil {
+		return op, err
+	}
+	return s.GetOperation(id, userID, role)
+}
+
+// ImportOperation returns the operation of a device import
+func ImportOperation(imp *models.DeviceImport) *Operation {
+	op := &Operation{
+		ID:         imp.ID,
+		Kind:       OperationDeviceImport,
+		Status:     OperationPending,
+		Progress:   percent(int64(imp.Processed), int64(imp.Rows)),
+		Cancelable: true,
+		Link:       fmt.Sprintf("/api/v1/devices/imports/%s", imp.ID),
+		CreatedAt:  imp.CreatedAt,
+	}
+	switch imp.Status {
+	case models.DeviceImportStatusProcessing:
+		op.Status = OperationRunning
+	case models.DeviceImportStatusCompleted:
+		op.finish(OperationSucceeded, imp, imp.CompletedAt)
+	case models.DeviceImportStatusFailed:
+		op.finish(OperationFailed, imp, imp.CompletedAt)
+		op.Error = imp.Error
+	case models.DeviceImportStatusCanceled:
+		op.finish(OperationCanceled, imp, imp.CompletedAt)
+	}
+	return op
+}
+
+// RolloutOperation returns the operation of a fleet rollout. Its progress
+// is the share of devices that have settled.
+func RolloutOperation(rollout *FleetRolloutProgress) *Operation {
+	var total int64
+	for _, n := range rollout.Devices {
+		total += n
+	}
+	settled := rollout.Devices[models.RolloutTargetStatusSucceeded] + rollout.Devices[models.RolloutTargetStatusFailed]
+	op := &Operation{
+		ID:         rollout.ID,
+		Kind:       OperationFleetRollout,
+		Status:     OperationRunning,
+		Progress:   percent(settled, total),
+		Cancelable: true,
+		Link:       fmt.Sprintf("/api/v1/fleet-rollouts/%s", rollout.ID),
+		CreatedAt:  rollout.CreatedAt,
+	}
+	result := map[string]interface{}{"devices": rollout.Devices}
+	switch rollout.Status {
+	case models.FleetRolloutStatusCompleted:
+		op.finish(OperationSucceeded, result, rollout.FinishedAt)
+	case models.FleetRolloutStatusHalted:
+		if rollout.HaltReason == rolloutHaltedByBuyer {
+			op.finish(OperationCanceled, result, rollout.FinishedAt)
+			break
+		}
+		op.finish(OperationFailed, result, rollout.FinishedAt)
+		op.Error = rollout.HaltReason
+	}
+	return op
+}
+
+// ReindexOperation returns the operation of a search reindex
+func ReindexOperation(reindex *models.SearchReindex) *Operation {
+	op := &Operation{
+		ID:         reindex.ID,
+		Kind:       OperationSearchReindex,
+		Status:     OperationRunning,
+		Progress:   percent(reindex.Indexed, reindex.Total),
+		Error:      reindex.LastError,
+		Cancelable: true,
+		Link:       fmt.Sprintf("/api/v1/admin/search/reindex/%s", reindex.ID),
+		CreatedAt:  reindex.StartedAt,
+	}
+	switch reindex.Status {
+	case models.SearchReindexStatusCompleted:
+		op.finish(OperationSucceeded, reindex, reindex.CompletedAt)
+	case models.SearchReindexStatusCanceled:
+		op.finish(OperationCanceled, reindex, reindex.CompletedAt)
+	}
+	return op
+}
+
+// ScanOperation returns the operation of the malware scan of a release's
+// binary. The scan report stays with admins.
+func ScanOperation(release *models.AgentVersion) *Operation {
+	op := &Operation{
+		ID:        release.ID,
+		Kind:      OperationBinaryScan,
+		Status:    OperationRunning,
+		Link:      fmt.Sprintf("/api/v1/agents/%s/versions/%s", release.AgentID, release.Version),
+		CreatedAt: release.CreatedAt,
+	}
+	var doneAt *time.Time
+	if release.ScanReport != nil {
+		doneAt = release.ScanReport.CompletedAt
+		if release.ScanStatus == models.ScanStatusPending {
+			op.Error = release.ScanReport.LastError
+		}
+	}
+	result := map[string]interface{}{"scan_status": release.ScanStatus}
+	switch release.ScanStatus {
+	case models.ScanStatusPassed, models.ScanStatusSkipped:
+		op.finish(OperationSucceeded, result, doneAt)
+	case models.ScanStatusFailed:
+		op.finish(OperationFailed, result, doneAt)
+		op.Error = "the binary failed the malware scan"
+	}
+	return op
+}
@@ -0,0 +1,428 @@
+package services
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrInvalidOrgSlug is returned for a slug that is not 3 to 40 lowercase
+	// letters, digits and single hyphens
+	ErrInvalidOrgSlug = errors.New("slug must be 3 to 40 lowercase letters, digits and hyphens")
+	// ErrOrgSlugTaken is returned when another organization has the slug
+	ErrOrgSlugTaken = errors.New("an organization with this slug already exists")
+	// ErrInvalidOrgRole is returned for a role other than owner, maintainer or viewer
+	ErrInvalidOrgRole = errors.New("role must be owner, maintainer or viewer")
+	// ErrNotOrgMember is returned when a user is not a member of the
+	// organization. Handlers answer it like a missing organization.
+	ErrNotOrgMember = errors.New("not a member of this organization")
+	// ErrOrgPermission is returned when a member's role does not allow the action
+	ErrOrgPermission = errors.New("your role in this organization does not allow this")
+	// ErrAlreadyMember is returned when inviting a user who is already a member
+	ErrAlreadyMember = errors.New("user is already a member of this organization")
+	// ErrInvitationPending is returned when inviting a user who already has
+	// a pending invitation
+	ErrInvitationPending = errors.New("user already has a pending invitation")
+	// ErrInvitationClosed is returned when answering or revoking an
+	// invitation that is no longer pending
+	ErrInvitationClosed = errors.New("invitation is no longer pending")
+	// ErrLastOwner is returned when removing or demoting an organization's last owner
+	ErrLastOwner = errors.New("an organization needs at least one owner")
+	// ErrAgentInOrg is returned when transferring an agent that already
+	// belongs to an organization
+	ErrAgentInOrg = errors.New("agent already belongs to an organization")
+)
+
+var orgSlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// OrganizationService manages organizations, their members and the agents
+// they manage together. An organization's agents keep their publisher, who
+// is paid for them and whose plan limits apply.
+type OrganizationService struct {
+	db *gorm.DB
+}
+
+// NewOrganizationService creates a new organization service
+func NewOrganizationService(db *gorm.DB) *OrganizationService {
+	return &OrganizationService{db: db}
+}
+
+// CreateOrganization creates an organization with the user as its owner
+func (s *OrganizationService) CreateOrganization(userID uuid.UUID, name, slug string) (*models.Organization, error) {
+	slug = strings.ToLower(strings.TrimSpace(slug))
+	if len(slug) < 3 || len(slug) > 40 || !orgSlugPattern.MatchString(slug) {
+		return nil, ErrInvalidOrgSlug
+	}
+
+	// Slugs of deleted organizations are not reused
+	var taken int64
+	if err := s.db.Unscoped().Model(&models.Organization{}).Where("slug = ?", slug).Count(&taken).Error; err != nil {
+		return nil, err
+	}
+	if taken > 0 {
+		return nil, ErrOrgSlugTaken
+	}
+
+	org := models.Organization{Name: name, Slug: slug, CreatedBy: userID}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&org).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.Membership{
+			OrganizationID: org.ID,
+			UserID:         userID,
+			Role:           models.OrgRoleOwner,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// GetMemberships returns the organizations a user is a member of
+func (s *OrganizationService) GetMemberships(userID uuid.UUID) ([]models.Membership, error) {
+	var memberships []models.Membership
+	if err := s.db.Preload("Organization").
+		Joins("JOIN organizations ON organizations.id = memberships.organization_id AND organizations.deleted_at IS NULL").
+		Where("memberships.user_id = ?", userID).
+		Order("organizations.name").
+		Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+// GetOrganization returns an organization and its members for one of them
+func (s *OrganizationService) GetOrganization(orgID, userID uuid.UUID) (*models.Organization, []models.Membership, error) {
+	if _, err := s.Role(orgID, userID); err != nil {
+		return nil, nil, err
+	}
+
+	var org models.Organization
+	if err := s.db.First(&org, "id = ?", orgID).Error; err != nil {
+		return nil, nil, err
+	}
+	var members []models.Membership
+	if err := s.db.Preload("User").Where("organization_id = ?", orgID).Order("created_at").Find(&members).Error; err != nil {
+		return nil, nil, err
+	}
+	return &org, members, nil
+}
+
+// GetAgents returns an organization's agents, including drafts, for one of
+// its members
+func (s *OrganizationService) GetAgents(orgID, userID uuid.UUID) ([]models.Agent, error) {
+	if _, err := s.Role(orgID, userID); err != nil {
+		return nil, err
+	}
+
+	var agents []models.Agent
+	if err := s.db.Where("organization_id = ?", orgID).Order("name").Find(&agents).Error; err != nil {
+		return nil, err
+	}
+	return agents, nil
+}
+
+// Role returns a user's role in an organization, or ErrNotOrgMember
+func (s *OrganizationService) Role(orgID, userID uuid.UUID) (models.OrgRole, error) {
+	return orgRole(s.db, orgID, userID)
+}
+
+// Invite invites a user, found by email or username, to an organization.
+// Only owners can invite. The user is notified and joins on accepting.
+func (s *OrganizationService) Invite(orgID, inviterID uuid.UUID, login string, role models.OrgRole) (*models.OrgInvitation, error) {
+	if !validOrgRole(role) {
+		return nil, ErrInvalidOrgRole
+	}
+	if err := s.requireOwner(orgID, inviterID); err != nil {
+		return nil, err
+	}
+
+	var org models.Organization
+	if err := s.db.First(&org, "id = ?", orgID).Error; err != nil {
+		return nil, err
+	}
+	var invitee models.User
+	login = strings.TrimSpace(login)
+	if err := s.db.Where("LOWER(email) = ? OR username = ?", strings.ToLower(login), login).First(&invitee).Error; err != nil {
+		return nil, err
+	}
+
+	if _, err := s.Role(orgID, invitee.ID); err == nil {
+		return nil, ErrAlreadyMember
+	} else if err != ErrNotOrgMember {
+		return nil, err
+	}
+	var pending int64
+	if err := s.db.Model(&models.OrgInvitation{}).
+		Where("organization_id = ? AND user_id = ? AND status = ?", orgID, invitee.ID, models.OrgInvitationStatusPending).
+		Count(&pending).Error; err != nil {
+		return nil, err
+	}
+	if pending > 0 {
+		return nil, ErrInvitationPending
+	}
+
+	invitation := models.OrgInvitation{
+		OrganizationID: orgID,
+		UserID:         invitee.ID,
+		Role:           role,
+		Status:         models.OrgInvitationStatusPending,
+		InvitedBy:      inviterID,
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&invitation).Error; err != nil {
+			return err
+		}
+		return notify(tx, &models.Notification{
+			UserID: invitee.ID,
+			Type:   models.NotificationTypeOrgInvitation,
+			Title:  "You are invited to join " + org.Name,
+			Body:   "You were invited to join the " + org.Name + " organization as " + string(role) + ".",
+			Link:   "/orgs/invitations",
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// GetInvitations returns a user's pending invitations
+func (s *OrganizationService) GetInvitations(userID uuid.UUID) ([]models.OrgInvitation, error) {
+	var invitations []models.OrgInvitation
+	if err := s.db.Preload("Organization").
+		Where("user_id = ? AND status = ?", userID, models.OrgInvitationStatusPending).
+		Order("created_at DESC").
+		Find(&invitations).Error; err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+// RespondInvitation accepts or declines one of a user's pending invitations
+func (s *OrganizationService) RespondInvitation(invitationID, userID uuid.UUID, accept bool) error {
+	status := models.OrgInvitationStatusDeclined
+	if accept {
+		status = models.OrgInvitationStatusAccepted
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var invitation models.OrgInvitation
+		if err := tx.First(&invitation, "id = ? AND user_id = ?", invitationID, userID).Error; err != nil {
+			return err
+		}
+
+		result := tx.Model(&models.OrgInvitation{}).
+			Where("id = ? AND status = ?", invitationID, models.OrgInvitationStatusPending).
+			Updates(map[string]interface{}{"status": status, "responded_at": time.Now()})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvitationClosed
+		}
+		if !accept {
+			return nil
+		}
+		return tx.Create(&models.Membership{
+			OrganizationID: invitation.OrganizationID,
+			UserID:         userID,
+			Role:           invitation.Role,
+		}).Error
+	})
+}
+
+// RevokeInvitation withdraws a pending invitation. Only owners can revoke.
+func (s *OrganizationService) RevokeInvitation(orgID, ownerID, invitationID uuid.UUID) error {
+	if err := s.requireOwner(orgID, ownerID); err != nil {
+		return err
+	}
+
+	var invitation models.OrgInvitation
+	if err := s.db.First(&invitation, "id = ? AND organization_id = ?", invitationID, orgID).Error; err != nil {
+		return err
+	}
+	result := s.db.Model(&invitation).
+		Where("status = ?", models.OrgInvitationStatusPending).
+		Updates(map[string]interface{}{"status": models.OrgInvitationStatusRevoked, "responded_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvitationClosed
+	}
+	return nil
+}
+
+// UpdateMemberRole changes a member's role. Only owners can change roles.
+func (s *OrganizationService) UpdateMemberRole(orgID, ownerID, memberID uuid.UUID, role models.OrgRole) error {
+	if !validOrgRole(role) {
+		return ErrInvalidOrgRole
+	}
+	if err := s.requireOwner(orgID, ownerID); err != nil {
+		return err
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		current, err := orgRole(tx, orgID, memberID)
+		if err == ErrNotOrgMember {
+			return gorm.ErrRecordNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if current == models.OrgRoleOwner && role != models.OrgRoleOwner {
+			if err := lastOwnerCheck(tx, orgID, memberID); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.Membership{}).
+			Where("organization_id = ? AND user_id = ?", orgID, memberID).
+			Update("role", role).Error
+	})
+}
+
+// RemoveMember removes a member from an organization. Owners can remove
+// anyone; other members can only leave.
+func (s *OrganizationService) RemoveMember(orgID, actorID, memberID uuid.UUID) error {
+	if actorID != memberID {
+		if err := s.requireOwner(orgID, actorID); err != nil {
+			return err
+		}
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		role, err := orgRole(tx, orgID, memberID)
+		if err == ErrNotOrgMember {
+			return gorm.ErrRecordNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if role == models.OrgRoleOwner {
+			if err := lastOwnerCheck(tx, orgID, memberID); err != nil {
+				return err
+			}
+		}
+		return tx.Where("organization_id = ? AND user_id = ?", orgID, memberID).Delete(&models.Membership{}).Error
+	})
+}
+
+// TransferAgent moves one of a publisher's own agents into an organization
+// in which they are an owner or maintainer. The publisher stays the
+// agent's publisher.
+func (s *OrganizationService) TransferAgent(agent *models.Agent, userID, orgID uuid.UUID) error {
+	if agent.PublisherID != userID {
+		return gorm.ErrRecordNotFound
+	}
+	if agent.OrganizationID != nil {
+		return ErrAgentInOrg
+	}
+	role, err := s.Role(orgID, userID)
+	if err != nil {
+		return err
+	}
+	if role == models.OrgRoleViewer {
+		return ErrOrgPermission
+	}
+
+	result := s.db.Model(&models.Agent{}).
+		Where("id = ? AND organization_id IS NULL", agent.ID).
+		Update("organization_id", orgID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAgentInOrg
+	}
+	agent.OrganizationID = &orgID
+	return nil
+}
+
+// CanPublishFor returns nil if a user may create agents under an
+// organization, i.e. is an owner or maintainer of it
+func (s *OrganizationService) CanPublishFor(orgID, userID uuid.UUID) error {
+	role, err := s.Role(orgID, userID)
+	if err != nil {
+		return err
+	}
+	if role == models.OrgRoleViewer {
+		return ErrOrgPermission
+	}
+	return nil
+}
+
+// AgentRole returns the role a user has on an agent: owner for its
+// publisher, otherwise their role in the agent's organization. It returns
+// ErrNotOrgMember for anyone else.
+func (s *OrganizationService) AgentRole(agent *models.Agent, userID uuid.UUID) (models.OrgRole, error) {
+	return agentRole(s.db, agent, userID)
+}
+
+func (s *OrganizationService) requireOwner(orgID, userID uuid.UUID) error {
+	role, err := s.Role(orgID, userID)
+	if err != nil {
+		return err
+	}
+	if role != models.OrgRoleOwner {
+		return ErrOrgPermission
+	}
+	return nil
+}
+
+// agentRole implements AgentRole for services that check access to agents
+func agentRole(db *gorm.DB, agent *models.Agent, userID uuid.UUID) (models.OrgRole, error) {
+	if agent.PublisherID == userID {
+		return models.OrgRoleOwner, nil
+	}
+	if agent.OrganizationID == nil {
+		return "", ErrNotOrgMember
+	}
+	return orgRole(db, *agent.OrganizationID, userID)
+}
+
+// orgRole returns a user's role in an organization that is not deleted
+func orgRole(db *gorm.DB, orgID, userID uuid.UUID) (models.OrgRole, error) {
+	var membership models.Membership
+	err := db.Joins("JOIN organizations ON organizations.id = memberships.organization_id AND organizations.deleted_at IS NULL").
+		Where("memberships.organization_id = ? AND memberships.user_id = ?", orgID, userID).
+		First(&membership).Error
+	if err == gorm.ErrRecordNotFound {
+		return "", ErrNotOrgMember
+	}
+	if err != nil {
+		return "", err
+	}
+	return membership.Role, nil
+}
+
+// lastOwnerCheck returns ErrLastOwner if ownerID is the organization's only owner
+func lastOwnerCheck(tx *gorm.DB, orgID, ownerID uuid.UUID) error {
+	var others int64
+	if err := tx.Model(&models.Membership{}).
+		Where("organization_id = ? AND role = ? AND user_id <> ?", orgID, models.OrgRoleOwner, ownerID).
+		Count(&others).Error; err != nil {
+		return err
+	}
+	if others == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+func validOrgRole(role models.OrgRole) bool {
+	switch role {
+	case models.OrgRoleOwner, models.OrgRoleMaintainer, models.OrgRoleViewer:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,498 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// maxRequiredApprovals caps the approvals an organization can require
+const maxRequiredApprovals = 10
+
+var (
+	// ErrPurchaseRequestClosed is returned when deciding on or cancelling a
+	// purchase request that is no longer pending
+	ErrPurchaseRequestClosed = errors.New("purchase request is no longer pending")
+	// ErrPurchaseRequestPending is returned when requesting an agent the
+	// organization already has a pending request for
+	ErrPurchaseRequestPending = errors.New("a purchase request for this agent is already pending")
+	// ErrNotPurchaseApprover is returned when a member who cannot approve
+	// purchases decides on a request
+	ErrNotPurchaseApprover = errors.New("you are not a purchase approver of this organization")
+	// ErrSelfApproval is returned when requesters approve their own request
+	ErrSelfApproval = errors.New("purchase requests cannot be approved by their requester")
+	// ErrInvalidPurchasePolicy is returned for a policy with an out of range
+	// approval count, an auto-approval limit without a currency, or
+	// approvers who are not members
+	ErrInvalidPurchasePolicy = errors.New("required approvals must be 1 to 10, an auto-approval limit needs a currency, and approvers must be members")
+)
+
+// OrgPurchaseService runs the purchases members request on behalf of their
+// organization. Designated approvers, or the owners when none are
+// designated, approve each request; requests up to the policy's limit are
+// approved on creation. The payment authorized with the request is
+// captured once it is approved, and the purchase entitles every member.
+type OrgPurchaseService struct {
+	db       *gorm.DB
+	payments PaymentProvider
+	tiers    *TierService
+}
+
+// NewOrgPurchaseService creates a new organization purchase service
+func NewOrgPurchaseService(db *gorm.DB, payments PaymentProvider, tiers *TierService) *OrgPurchaseService {
+	return &OrgPurchaseService{db: db, payments: payments, tiers: tiers}
+}
+
+// GetPolicy returns an organization's purchase policy and the IDs of its
+// designated approvers (members only)
+func (s *OrgPurchaseService) GetPolicy(orgID, userID uuid.UUID) (*models.OrgPurchasePolicy, []uuid.UUID, error) {
+	if _, err := orgRole(s.db, orgID, userID); err != nil {
+		return nil, nil, err
+	}
+	policy, err := s.policy(orgID)
+	if err != nil {
+		return nil, nil, err
+	}
+	approvers := []uuid.UUID{}
+	if err := s.db.Model(&models.Membership{}).
+		Where("organization_id = ? AND purchase_approver = ?", orgID, true).
+		Pluck("user_id", &approvers).Error; err != nil {
+		return nil, nil, err
+	}
+	return policy, approvers, nil
+}
+
+// SetPolicy replaces an organization's purchase policy and designated
+// approvers (owners only)
+func (s *OrgPurchaseService) SetPolicy(orgID, ownerID uuid.UUID, policy *models.OrgPurchasePolicy, approvers []uuid.UUID) error {
+	if policy.RequiredApprovals < 1 || policy.RequiredApprovals > maxRequiredApprovals ||
+		policy.AutoApproveMinor < 0 || (policy.AutoApproveMinor > 0 && policy.AutoApproveCurrency == "") {
+		return ErrInvalidPurchasePolicy
+	}
+	role, err := orgRole(s.db, orgID, ownerID)
+	if err != nil {
+		return err
+	}
+	if role != models.OrgRoleOwner {
+		return ErrOrgPermission
+	}
+
+	policy.OrganizationID = orgID
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if len(approvers) > 0 {
+			var members int64
+			if err := tx.Model(&models.Membership{}).
+				Where("organization_id = ? AND user_id IN ?", orgID, approvers).
+				Count(&members).Error; err != nil {
+				return err
+			}
+			if int(members) != len(uniqueIDs(approvers)) {
+				return ErrInvalidPurchasePolicy
+			}
+		}
+
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(policy).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Membership{}).Where("organization_id = ?", orgID).
+			Update("purchase_approver", false).Error; err != nil {
+			return err
+		}
+		if len(approvers) == 0 {
+			return nil
+		}
+		return tx.Model(&models.Membership{}).Where("organization_id = ? AND user_id IN ?", orgID, approvers).
+			Update("purchase_approver", true).Error
+	})
+}
+
+// RequestPurchase records a member's request to buy an agent for their
+// organization, with a payment authorized for its price. The approvers are
+// notified, unless the policy approves it right away.
+func (s *OrgPurchaseService) RequestPurchase(ctx context.Context, orgID, userID, agentID uuid.UUID, justification, paymentID string) (*models.OrgPurchaseRequest, error) {
+	if _, err := orgRole(s.db, orgID, userID); err != nil {
+		return nil, err
+	}
+	var agent models.Agent
+	if err := s.db.Where("id = ? AND status = ?", agentID, models.AgentStatusPublished).First(&agent).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrAgentNotPurchasable
+		}
+		return nil, err
+	}
+	if agent.PricingModel == models.PricingModelMetered {
+		return nil, ErrAgentMetered
+	}
+
+	var owned int64
+	if err := s.db.Model(&models.Purchase{}).
+		Where("organization_id = ? AND agent_id = ? AND status = ?", orgID, agentID, models.PurchaseStatusCompleted).
+		Count(&owned).Error; err != nil {
+		return nil, err
+	}
+	if owned > 0 {
+		return nil, ErrAlreadyPurchased
+	}
+	if paymentID == "" && agent.Price > 0 {
+		return nil, ErrPaymentRequired
+	}
+
+	policy, err := s.policy(orgID)
+	if err != nil {
+		return nil, err
+	}
+	request := models.OrgPurchaseRequest{
+		OrganizationID: orgID,
+		RequesterID:    userID,
+		AgentID:        agentID,
+		Amount:         agent.Price,
+		Currency:       agent.Currency,
+		Justification:  justification,
+		PaymentID:      paymentID,
+		Status:         models.OrgPurchaseStatusPending,
+		AutoApproved:   agent.Price <= policy.AutoApproveMinor && agent.Currency == policy.AutoApproveCurrency,
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var pending int64
+		if err := tx.Model(&models.OrgPurchaseRequest{}).
+			Where("organization_id = ? AND agent_id = ? AND status IN ?", orgID, agentID,
+				[]models.OrgPurchaseStatus{models.OrgPurchaseStatusPending, models.OrgPurchaseStatusApproved}).
+			Count(&pending).Error; err != nil {
+			return err
+		}
+		if pending > 0 {
+			return ErrPurchaseRequestPending
+		}
+		if err := tx.Create(&request).Error; err != nil {
+			return err
+		}
+		if request.AutoApproved {
+			return nil
+		}
+
+		approvers, err := s.approvers(tx, orgID)
+		if err != nil {
+			return err
+		}
+		for _, approverID := range approvers {
+			if approverID == userID {
+				continue
+			}
+			if err := notify(tx, &models.Notification{
+				UserID: approverID,
+				Type:   models.NotificationTypeOrgPurchase,
+				Title:  "Purchase of " + agent.Name + " awaits your approval",
+				Body:   fmt.Sprintf("A member requested to buy %s for %s.", agent.Name, models.FormatMoney(agent.Price, agent.Currency)),
+				Link:   fmt.Sprintf("/orgs/%s/purchase-requests/%s", orgID, request.ID),
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if request.AutoApproved {
+		if err := s.execute(ctx, &request); err != nil {
+			return nil, err
+		}
+	}
+	request.AmountDisplay = models.FormatMoney(request.Amount, request.Currency)
+	return &request, nil
+}
+
+// GetRequests returns an organization's purchase requests, newest first,
+// optionally with one status (members only)
+func (s *OrgPurchaseService) GetRequests(orgID, userID uuid.UUID, status models.OrgPurchaseStatus, page, limit int) ([]models.OrgPurchaseRequest, int64, error) {
+	if _, err := orgRole(s.db, orgID, userID); err != nil {
+		return nil, 0, err
+	}
+
+	query := s.db.Model(&models.OrgPurchaseRequest{}).Where("organization_id = ?", orgID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var requests []models.OrgPurchaseRequest
+	if err := query.Preload("Agent").Preload("Requester").Preload("Approvals").
+		Order("created_at DESC").Offset((page - 1) * limit).Limit(limit).
+		Find(&requests).Error; err != nil {
+		return nil, 0, err
+	}
+	for i := range requests {
+		requests[i].AmountDisplay = models.FormatMoney(requests[i].Amount, requests[i].Currency)
+	}
+	return requests, total, nil
+}
+
+// Decide records an approver's approval or rejection of a pending request.
+// A rejection closes it; the approval that reaches the policy's count
+// captures the payment and completes the purchase.
+func (s *OrgPurchaseService) Decide(ctx context.Context, orgID, requestID, approverID uuid.UUID, approve bool, comment string) (*models.OrgPurchaseRequest, error) {
+	var request models.OrgPurchaseRequest
+	execute := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&request, "id = ? AND organization_id = ?", requestID, orgID).Error; err != nil {
+			return err
+		}
+		allowed, err := s.isApprover(tx, orgID, approverID)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return ErrNotPurchaseApprover
+		}
+		if request.Status != models.OrgPurchaseStatusPending {
+			return ErrPurchaseRequestClosed
+		}
+		if approve && request.RequesterID == approverID {
+			return ErrSelfApproval
+		}
+
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "request_id"}, {Name: "approver_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"approved", "comment", "created_at"}),
+		}).Create(&models.OrgPurchaseApproval{
+			RequestID:  requestID,
+			ApproverID: approverID,
+			Approved:   approve,
+			Comment:    comment,
+		}).Error; err != nil {
+			return err
+		}
+
+		if !approve {
+			now := time.Now()
+			request.Status = models.OrgPurchaseStatusRejected
+			request.DecidedAt = &now
+			if err := tx.Model(&request).Updates(map[string]interface{}{"status": request.Status, "decided_at": now}).Error; err != nil {
+				return err
+			}
+			body := "An approver rejected the request."
+			if comment != "" {
+				body += " " + comment
+			}
+			return s.notifyRequester(tx, &request, "Your purchase request was rejected", body)
+		}
+
+		policy, err := s.policy(orgID)
+		if err != nil {
+			return err
+		}
+		var approvals int64
+		if err := tx.Model(&models.OrgPurchaseApproval{}).
+			Where("request_id = ? AND approved = ?", requestID, true).
+			Count(&approvals).Error; err != nil {
+			return err
+		}
+		execute = approvals >= int64(policy.RequiredApprovals)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !approve {
+		s.release(ctx, &request)
+	} else if execute {
+		if err := s.execute(ctx, &request); err != nil {
+			return nil, err
+		}
+	}
+	request.AmountDisplay = models.FormatMoney(request.Amount, request.Currency)
+	return &request, nil
+}
+
+// Cancel withdraws a pending request (its requester or an owner)
+func (s *OrgPurchaseService) Cancel(ctx context.Context, orgID, requestID, userID uuid.UUID) (*models.OrgPurchaseRequest, error) {
+	role, err := orgRole(s.db, orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	var request models.OrgPurchaseRequest
+	if err := s.db.First(&request, "id = ? AND organization_id = ?", requestID, orgID).Error; err != nil {
+		return nil, err
+	}
+	if request.RequesterID != userID && role != models.OrgRoleOwner {
+		return nil, ErrOrgPermission
+	}
+
+	now := time.Now()
+	result := s.db.Model(&models.OrgPurchaseRequest{}).
+		Where("id = ? AND status = ?", requestID, models.OrgPurchaseStatusPending).
+		Updates(map[string]interface{}{"status": models.OrgPurchaseStatusCancelled, "decided_at": now})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrPurchaseRequestClosed
+	}
+	request.Status = models.OrgPurchaseStatusCancelled
+	request.DecidedAt = &now
+	s.release(ctx, &request)
+	request.AmountDisplay = models.FormatMoney(request.Amount, request.Currency)
+	return &request, nil
+}
+
+// execute captures an approved request's payment and records the purchase
+// for the organization. The status guard keeps it from running twice.
+func (s *OrgPurchaseService) execute(ctx context.Context, request *models.OrgPurchaseRequest) error {
+	now := time.Now()
+	claimed := s.db.Model(&models.OrgPurchaseRequest{}).
+		Where("id = ? AND status = ?", request.ID, models.OrgPurchaseStatusPending).
+		Updates(map[string]interface{}{"status": models.OrgPurchaseStatusApproved, "decided_at": now})
+	if claimed.Error != nil {
+		return claimed.Error
+	}
+	if claimed.RowsAffected == 0 {
+		return ErrPurchaseRequestClosed
+	}
+	request.Status = models.OrgPurchaseStatusApproved
+	request.DecidedAt = &now
+
+	var agent models.Agent
+	if err := s.db.Preload("Publisher").First(&agent, "id = ?", request.AgentID).Error; err != nil {
+		return err
+	}
+
+	if request.Amount > 0 {
+		if err := s.payments.Capture(ctx, "org-purchase-"+request.ID.String(), request.PaymentID, request.Amount); err != nil {
+			log.Error().Err(err).Str("request_id", request.ID.String()).Msg("Failed to capture organization purchase")
+			request.Status = models.OrgPurchaseStatusFailed
+			request.FailureReason = "The payment could not be captured; request the purchase again with a new payment."
+			return s.db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Model(request).Updates(map[string]interface{}{
+					"status":         request.Status,
+					"failure_reason": request.FailureReason,
+				}).Error; err != nil {
+					return err
+				}
+				return s.notifyRequester(tx, request, "Your purchase of "+agent.Name+" failed", request.FailureReason)
+			})
+		}
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		purchase := models.Purchase{
+			BuyerID:        request.RequesterID,
+			AgentID:        request.AgentID,
+			OrganizationID: &request.OrganizationID,
+			Amount:         request.Amount,
+			Currency:       request.Currency,
+			Status:         models.PurchaseStatusCompleted,
+			PaymentID:      request.PaymentID,
+			Commission:     s.tiers.Commission(agent.Publisher.Tier, request.Amount),
+		}
+		if err := tx.Create(&purchase).Error; err != nil {
+			return err
+		}
+		if err := notifySale(tx, &agent, &purchase); err != nil {
+			return err
+		}
+		request.Status = models.OrgPurchaseStatusCompleted
+		request.PurchaseID = &purchase.ID
+		if err := tx.Model(request).Updates(map[string]interface{}{
+			"status":      request.Status,
+			"purchase_id": purchase.ID,
+		}).Error; err != nil {
+			return err
+		}
+		return s.notifyRequester(tx, request, "Your purchase of "+agent.Name+" was approved",
+			agent.Name+" now belongs to your organization; every member can download it.")
+	})
+}
+
+// release cancels the payment authorization of a request that will not be
+// executed. A failure only leaves the authorization to expire.
+func (s *OrgPurchaseService) release(ctx context.Context, request *models.OrgPurchaseRequest) {
+	if request.PaymentID == "" {
+		return
+	}
+	if err := s.payments.CancelAuthorization(ctx, request.PaymentID); err != nil {
+		log.Warn().Err(err).Str("request_id", request.ID.String()).Msg("Failed to cancel payment authorization")
+	}
+}
+
+func (s *OrgPurchaseService) notifyRequester(tx *gorm.DB, request *models.OrgPurchaseRequest, title, body string) error {
+	return notify(tx, &models.Notification{
+		UserID: request.RequesterID,
+		Type:   models.NotificationTypeOrgPurchase,
+		Title:  title,
+		Body:   body,
+		Link:   fmt.Sprintf("/orgs/%s/purchase-requests/%s", request.OrganizationID, request.ID),
+	})
+}
+
+// policy returns an organization's purchase policy, or the default of a
+// single approval
+func (s *OrgPurchaseService) policy(orgID uuid.UUID) (*models.OrgPurchasePolicy, error) {
+	policy := models.OrgPurchasePolicy{OrganizationID: orgID, RequiredApprovals: 1}
+	err := s.db.First(&policy, "organization_id = ?", orgID).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// approvers returns the IDs of the members who can approve purchases: the
+// designated approvers, or the owners if none are designated
+func (s *OrgPurchaseService) approvers(tx *gorm.DB, orgID uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	if err := tx.Model(&models.Membership{}).
+		Where("organization_id = ? AND purchase_approver = ?", orgID, true).
+		Pluck("user_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		return ids, nil
+	}
+	err := tx.Model(&models.Membership{}).
+		Where("organization_id = ? AND role = ?", orgID, models.OrgRoleOwner).
+		Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+func (s *OrgPurchaseService) isApprover(tx *gorm.DB, orgID, userID uuid.UUID) (bool, error) {
+	if _, err := orgRole(tx, orgID, userID); err != nil {
+		return false, err
+	}
+	approvers, err := s.approvers(tx, orgID)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range approvers {
+		if id == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ownedBy narrows a purchase query to those a user is entitled by: their
+// own, and those of the organizations they are a member of
+func ownedBy(db *gorm.DB, query *gorm.DB, userID uuid.UUID) *gorm.DB {
+	orgs := db.Model(&models.Membership{}).Select("organization_id").Where("user_id = ?", userID)
+	return query.Where("(buyer_id = ? OR organization_id IN (?))", userID, orgs)
+}
+
+func uniqueIDs(ids []uuid.UUID) map[uuid.UUID]bool {
+	unique := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		unique[id] = true
+	}
+	return unique
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidCursor is returned for a pagination cursor that cannot be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is a position in a list paginated by keyset: the sort value and
+// ID of the last item of the previous page. Clients pass it back as the
+// opaque string from Encode.
+type Cursor struct {
+	Value interface{} `json:"v"`
+	ID    uuid.UUID   `json:"id"`
+}
+
+// NewCursor returns the cursor after an item
+func NewCursor(value interface{}, id uuid.UUID) *Cursor {
+	return &Cursor{Value: value, ID: id}
+}
+
+// Encode returns the cursor as a URL-safe string
+func (c *Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseCursor decodes a cursor from Encode. An empty string is the start
+// of the list, returned as nil.
+func ParseCursor(s string) (*Cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor Cursor
+	if err := json.Unmarshal(b, &cursor); err != nil || cursor.ID == uuid.Nil || cursor.Value == nil {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// Keyset orders a query by column, then ID to break ties, and narrows it
+// to the rows after cursor. It fetches limit+1 rows so the caller can tell
+// whether another page follows. column must not come from user input.
+func Keyset(query *gorm.DB, column string, desc bool, cursor *Cursor, limit int) *gorm.DB {
+	id := "id"
+	if table, _, qualified := strings.Cut(column, "."); qualified {
+		id = table + ".id"
+	}
+	op, direction := ">", " ASC"
+	if desc {
+		op, direction = "<", " DESC"
+	}
+
+	if cursor != nil {
+		query = query.Where("("+column+", "+id+") "+op+" (?, ?)", cursor.Value, cursor.ID)
+	}
+	return query.Order(column + direction + ", " + id + direction).Limit(limit + 1)
+}
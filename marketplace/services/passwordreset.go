@@ -0,0 +1,145 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// ErrInvalidResetToken is returned for an unknown, used or expired password reset token
+var ErrInvalidResetToken = errors.New("password reset link is invalid or has expired")
+
+// PasswordResetService lets users who forgot their password set a new one
+// through a link emailed to them
+type PasswordResetService struct {
+	db     *gorm.DB
+	auth   *AuthService
+	mailer Mailer
+	cfg    config.PasswordResetConfig
+}
+
+// NewPasswordResetService creates a new password reset service
+func NewPasswordResetService(db *gorm.DB, auth *AuthService, mailer Mailer, cfg config.PasswordResetConfig) *PasswordResetService {
+	return &PasswordResetService{db: db, auth: auth, mailer: mailer, cfg: cfg}
+}
+
+// RequestReset emails a reset link to the account with the given address.
+// It reports success whether or not the account exists, so the response
+// cannot be used to find registered addresses; only the email reveals it.
+func (s *PasswordResetService) RequestReset(email, ip string) error {
+	var user models.User
+	if err := s.db.Where("LOWER(email) = ?", strings.ToLower(strings.TrimSpace(email))).First(&user).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+	if user.Status != models.UserStatusActive {
+		return nil
+	}
+
+	var recent int64
+	if err := s.db.Model(&models.PasswordResetToken{}).
+		Where("user_id = ? AND created_at > ?", user.ID, time.Now().Add(-time.Hour)).
+		Count(&recent).Error; err != nil {
+		return err
+	}
+	if recent >= int64(s.cfg.MaxPerHour) {
+		log.Warn().Str("user_id", user.ID.String()).Msg("Password reset email limit reached")
+		return nil
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	if err := s.db.Create(&models.PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		RequestIP: ip,
+		ExpiresAt: time.Now().Add(s.cfg.TokenTTL),
+	}).Error; err != nil {
+		return err
+	}
+
+	link, err := url.Parse(s.cfg.ResetURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	body := fmt.Sprintf("Someone asked to reset the password of your EdgePlug Marketplace account.\n\n"+
+		"To choose a new password, open this link within %s:\n\n%s\n\n"+
+		"If you did not ask for this, you can ignore this email. Your password will not change.\n",
+		s.cfg.TokenTTL, link.String())
+
+	// Sent in the background so the response time does not reveal whether
+	// the account exists
+	go func() {
+		if err := s.mailer.Send(user.Email, "Reset your EdgePlug Marketplace password", body); err != nil {
+			log.Error().Err(err).Str("user_id", user.ID.String()).Msg("Failed to send password reset email")
+		}
+	}()
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token. The token and any
+// other outstanding reset tokens of the user stop working, and every
+// session of the user is ended.
+func (s *PasswordResetService) ResetPassword(ctx context.Context, token, password string) error {
+	var reset models.PasswordResetToken
+	if err := s.db.First(&reset, "token_hash = ?", hashToken(token)).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return ErrInvalidResetToken
+		}
+		return err
+	}
+	if reset.UsedAt != nil || time.Now().After(reset.ExpiresAt) {
+		return ErrInvalidResetToken
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		// Claim the token so it cannot be used twice concurrently
+		result := tx.Model(&models.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", reset.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidResetToken
+		}
+		if err := tx.Model(&models.PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", reset.UserID).
+			Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Where("id = ?", reset.UserID).Update("password_hash", string(hash)).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.auth.RevokeAllTokens(ctx, reset.UserID)
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// ErrPayoutsUnsupported is returned when the payment provider cannot pay
+// publishers out
+var ErrPayoutsUnsupported = errors.New("payouts are not supported by the payment provider")
+
+// PaymentProvider moves money through the external payment processor that
+// purchase payment IDs refer to
+type PaymentProvider interface {
+	// Name identifies the provider in transaction records
+	Name() string
+	// Refund refunds amount of a payment and returns the provider's refund
+	// ID. Retries with the same idempotency key refund only once.
+	Refund(ctx context.Context, idempotencyKey, paymentID string, amount models.Money, currency string) (string, error)
+	// Capture collects amount of a payment that was only authorized.
+	// Retries with the same idempotency key capture only once.
+	Capture(ctx context.Context, idempotencyKey, paymentID string, amount models.Money) error
+	// CancelAuthorization releases a payment that was authorized but will
+	// not be captured
+	CancelAuthorization(ctx context.Context, paymentID string) error
+	// CancelSubscription stops renewing a subscription at the end of its
+	// current period
+	CancelSubscription(ctx context.Context, subscriptionID string) error
+
+	// CreatePayoutAccount opens a connected account for a publisher to be
+	// paid into and returns its ID
+	CreatePayoutAccount(ctx context.Context, email string) (string, error)
+	// PayoutOnboardingURL returns a one-time link to the provider's
+	// onboarding of a connected account
+	PayoutOnboardingURL(ctx context.Context, accountID, returnURL string) (string, error)
+	// PayoutAccountReady reports whether a connected account can receive payouts
+	PayoutAccountReady(ctx context.Context, accountID string) (bool, error)
+	// Transfer pays amount into a connected account and returns the
+	// provider's transfer ID. Retries with the same idempotency key pay only once.
+	Transfer(ctx context.Context, idempotencyKey, accountID string, amount models.Money, currency string) (string, error)
+}
+
+// NewPaymentProvider returns the configured payment provider
+func NewPaymentProvider(cfg config.PaymentsConfig) (PaymentProvider, error) {
+	switch cfg.Provider {
+	case "manual":
+		return manualPayments{}, nil
+	case "stripe":
+		return &stripePayments{
+			secretKey: cfg.StripeSecretKey,
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported payment provider: %s", cfg.Provider)
+	}
+}
+
+// manualPayments leaves refunds to be paid out by hand, e.g. from the
+// processor's dashboard
+type manualPayments struct{}
+
+func (manualPayments) Name() string {
+	return "manual"
+}
+
+func (manualPayments) Refund(ctx context.Context, idempotencyKey, paymentID string, amount models.Money, currency string) (string, error) {
+	return "", nil
+}
+
+func (manualPayments) Capture(ctx context.Context, idempotencyKey, paymentID string, amount models.Money) error {
+	return nil
+}
+
+func (manualPayments) CancelAuthorization(ctx context.Context, paymentID string) error {
+	return nil
+}
+
+func (manualPayments) CancelSubscription(ctx context.Context, subscriptionID string) error {
+	return nil
+}
+
+func (manualPayments) CreatePayoutAccount(ctx context.Context, email string) (string, error) {
+	return "", ErrPayoutsUnsupported
+}
+
+func (manualPayments) PayoutOnboardingURL(ctx context.Context, accountID, returnURL string) (string, error) {
+	return "", ErrPayoutsUnsupported
+}
+
+func (manualPayments) PayoutAccountReady(ctx context.Context, accountID string) (bool, error) {
+	return false, ErrPayoutsUnsupported
+}
+
+func (manualPayments) Transfer(ctx context.Context, idempotencyKey, accountID string, amount models.Money, currency string) (string, error) {
+	return "", ErrPayoutsUnsupported
+}
+
+// stripePayments refunds Stripe payment intents
+type stripePayments struct {
+	secretKey string
+	client    *http.Client
+}
+
+func (p *stripePayments) Name() string {
+	return "stripe"
+}
+
+func (p *stripePayments) Refund(ctx context.Context, idempotencyKey, paymentID string, amount models.Money, currency string) (string, error) {
+	var refund struct {
+		ID string `json:"id"`
+	}
+	err := p.call(ctx, http.MethodPost, "/v1/refunds", url.Values{
+		"payment_intent": {paymentID},
+		"amount":         {strconv.FormatInt(int64(amount), 10)},
+	}, idempotencyKey, &refund)
+	return refund.ID, err
+}
+
+// Capture captures a payment intent created with capture_method=manual
+func (p *stripePayments) Capture(ctx context.Context, idempotencyKey, paymentID string, amount models.Money) error {
+	var intent struct {
+		ID string `json:"id"`
+	}
+	return p.call(ctx, http.MethodPost, "/v1/payment_intents/"+url.PathEscape(paymentID)+"/capture", url.Values{
+		"amount_to_capture": {strconv.FormatInt(int64(amount), 10)},
+	}, idempotencyKey, &intent)
+}
+
+func (p *stripePayments) CancelAuthorization(ctx context.Context, paymentID string) error {
+	var intent struct {
+		ID string `json:"id"`
+	}
+	return p.call(ctx, http.MethodPost, "/v1/payment_intents/"+url.PathEscape(paymentID)+"/cancel", url.Values{}, "", &intent)
+}
+
+func (p *stripePayments) CancelSubscription(ctx context.Context, subscriptionID string) error {
+	var subscription struct {
+		ID string `json:"id"`
+	}
+	return p.call(ctx, http.MethodPost, "/v1/subscriptions/"+url.PathEscape(subscriptionID), url.Values{
+		"cancel_at_period_end": {"true"},
+	}, "", &subscription)
+}
+
+// CreatePayoutAccount opens an Express account, whose onboarding and
+// dashboard are hosted by Stripe
+func (p *stripePayments) CreatePayoutAccount(ctx context.Context, email string) (string, error) {
+	var account struct {
+		ID string `json:"id"`
+	}
+	err := p.call(ctx, http.MethodPost, "/v1/accounts", url.Values{
+		"type":                               {"express"},
+		"email":                              {email},
+		"capabilities[transfers][requested]": {"true"},
+	}, "", &account)
+	return account.ID, err
+}
+
+func (p *stripePayments) PayoutOnboardingURL(ctx context.Context, accountID, returnURL string) (string, error) {
+	var link struct {
+		URL string `json:"url"`
+	}
+	err := p.call(ctx, http.MethodPost, "/v1/account_links", url.Values{
+		"account":     {accountID},
+		"type":        {"account_onboarding"},
+		"return_url":  {returnURL},
+		"refresh_url": {returnURL},
+	}, "", &link)
+	return link.URL, err
+}
+
+func (p *stripePayments) PayoutAccountReady(ctx context.Context, accountID string) (bool, error) {
+	var account struct {
+		PayoutsEnabled bool `json:"payouts_enabled"`
+	}
+	err := p.call(ctx, http.MethodGet, "/v1/accounts/"+url.PathEscape(accountID), nil, "", &account)
+	return account.PayoutsEnabled, err
+}
+
+func (p *stripePayments) Transfer(ctx context.Context, idempotencyKey, accountID string, amount models.Money, currency string) (string, error) {
+	var transfer struct {
+		ID string `json:"id"`
+	}
+	err := p.call(ctx, http.MethodPost, "/v1/transfers", url.Values{
+		"amount":      {strconv.FormatInt(int64(amount), 10)},
+		"currency":    {strings.ToLower(currency)},
+		"destination": {accountID},
+	}, idempotencyKey, &transfer)
+	return transfer.ID, err
+}
+
+// call sends a form-encoded request to the Stripe API and decodes the
+// response into out
+func (p *stripePayments) call(ctx context.Context, method, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://api.stripe.com"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.secretKey)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("stripe %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
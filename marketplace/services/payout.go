@@ -0,0 +1,331 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// ErrNoPayoutAccount is returned when a publisher has not connected a payout account
+var ErrNoPayoutAccount = errors.New("no payout account connected")
+
+// PayoutService pays publishers their earnings through the payment
+// provider's connected accounts
+type PayoutService struct {
+	db       *gorm.DB
+	payments PaymentProvider
+	cfg      config.PayoutsConfig
+}
+
+// NewPayoutService creates a new payout service
+func NewPayoutService(db *gorm.DB, payments PaymentProvider, cfg config.PayoutsConfig) *PayoutService {
+	return &PayoutService{db: db, payments: payments, cfg: cfg}
+}
+
+// GetAccount returns a publisher's payout account, first checking with the
+// provider whether a pending account finished onboarding
+func (s *PayoutService) GetAccount(ctx context.Context, publisherID uuid.UUID) (*models.PayoutAccount, error) {
+	var account models.PayoutAccount
+	if err := s.db.First(&account, "publisher_id = ?", publisherID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrNoPayoutAccount
+		}
+		return nil, err
+	}
+	if err := s.refreshAccount(ctx, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// ConnectAccount creates the publisher's payout account at the provider if
+// they have none, and returns a link to the provider's onboarding, where
+// the publisher enters their bank details
+func (s *PayoutService) ConnectAccount(ctx context.Context, publisherID uuid.UUID) (*models.PayoutAccount, string, error) {
+	var account models.PayoutAccount
+	err := s.db.First(&account, "publisher_id = ?", publisherID).Error
+	if err == gorm.ErrRecordNotFound {
+		var publisher models.User
+		if err := s.db.First(&publisher, "id = ?", publisherID).Error; err != nil {
+			return nil, "", err
+		}
+		externalID, err := s.payments.CreatePayoutAccount(ctx, publisher.Email)
+		if err != nil {
+			return nil, "", err
+		}
+		account = models.PayoutAccount{
+			PublisherID: publisherID,
+			Provider:    s.payments.Name(),
+			ExternalID:  externalID,
+			Status:      models.PayoutAccountStatusPending,
+		}
+		err = s.db.Create(&account).Error
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	url, err := s.payments.PayoutOnboardingURL(ctx, account.ExternalID, s.cfg.OnboardingReturnURL)
+	if err != nil {
+		return nil, "", err
+	}
+	return &account, url, nil
+}
+
+// ReplaceAccount creates a new payout account at the provider in place of
+// the publisher's current one, so payouts go elsewhere once the publisher
+// completes the onboarding at the returned link
+func (s *PayoutService) ReplaceAccount(ctx context.Context, publisherID uuid.UUID) (*models.PayoutAccount, string, error) {
+	var account models.PayoutAccount
+	if err := s.db.First(&account, "publisher_id = ?", publisherID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, "", ErrNoPayoutAccount
+		}
+		return nil, "", err
+	}
+	var publisher models.User
+	if err := s.db.First(&publisher, "id = ?", publisherID).Error; err != nil {
+		return nil, "", err
+	}
+
+	externalID, err := s.payments.CreatePayoutAccount(ctx, publisher.Email)
+	if err != nil {
+		return nil, "", err
+	}
+	account.Provider = s.payments.Name()
+	account.ExternalID = externalID
+	account.Status = models.PayoutAccountStatusPending
+	if err := s.db.Save(&account).Error; err != nil {
+		return nil, "", err
+	}
+
+	url, err := s.payments.PayoutOnboardingURL(ctx, account.ExternalID, s.cfg.OnboardingReturnURL)
+	if err != nil {
+		return nil, "", err
+	}
+	return &account, url, nil
+}
+
+// GetPayouts returns a publisher's payouts, most recent first
+func (s *PayoutService) GetPayouts(publisherID uuid.UUID, page, limit int) ([]models.Payout, int64, error) {
+	query := s.db.Model(&models.Payout{}).Where("publisher_id = ?", publisherID)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var payouts []models.Payout
+	offset := (page - 1) * limit
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&payouts).Error; err != nil {
+		return nil, 0, err
+	}
+	return payouts, total, nil
+}
+
+// Run creates and sends payouts every interval until ctx is done
+func (s *PayoutService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.CreatePayouts(time.Now()); err != nil {
+				log.Error().Err(err).Msg("Failed to create payouts")
+			}
+			if err := s.SendPayouts(ctx); err != nil {
+				log.Error().Err(err).Msg("Failed to send payouts")
+			}
+		}
+	}
+}
+
+// publisherEarnings is the unpaid balance of a publisher in one currency
+type publisherEarnings struct {
+	PublisherID uuid.UUID
+	Currency    string
+}
+
+// CreatePayouts adds up each publisher's completed purchases older than
+// the hold period, less commission and less refunds of purchases already
+// paid out, into a pending payout. Balances under the minimum carry over.
+func (s *PayoutService) CreatePayouts(now time.Time) error {
+	cutoff := now.Add(-s.cfg.HoldPeriod)
+
+	var earnings []publisherEarnings
+	if err := s.db.Model(&models.Purchase{}).
+		Select("DISTINCT agents.publisher_id, purchases.currency").
+		Joins("JOIN agents ON agents.id = purchases.agent_id").
+		Where("purchases.status = ? AND purchases.payout_id IS NULL AND purchases.created_at <= ?", models.PurchaseStatusCompleted, cutoff).
+		Scan(&earnings).Error; err != nil {
+		return err
+	}
+
+	created := 0
+	for _, e := range earnings {
+		ok, err := s.createPayout(e, cutoff)
+		if err != nil {
+			return err
+		}
+		if ok {
+			created++
+		}
+	}
+	if created > 0 {
+		log.Info().Int("count", created).Msg("Created publisher payouts")
+	}
+	return nil
+}
+
+// createPayout creates the payout of one publisher's balance, locking the
+// purchases it covers so a concurrent refund cannot slip between
+func (s *PayoutService) createPayout(e publisherEarnings, cutoff time.Time) (bool, error) {
+	created := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var earned []models.Purchase
+		if err := s.publisherPurchases(tx, e).
+			Where("purchases.status = ? AND purchases.payout_id IS NULL AND purchases.created_at <= ?", models.PurchaseStatusCompleted, cutoff).
+			Find(&earned).Error; err != nil {
+			return err
+		}
+		var reversed []models.Purchase
+		if err := s.publisherPurchases(tx, e).
+			Where("purchases.status = ? AND purchases.payout_id IS NOT NULL AND purchases.reversal_payout_id IS NULL", models.PurchaseStatusRefunded).
+			Find(&reversed).Error; err != nil {
+			return err
+		}
+
+		payout := models.Payout{
+			PublisherID:   e.PublisherID,
+			Currency:      e.Currency,
+			Status:        models.PayoutStatusPending,
+			PurchaseCount: len(earned),
+		}
+		for _, p := range earned {
+			payout.Gross += p.Amount
+			payout.Commission += p.Commission
+		}
+		for _, p := range reversed {
+			payout.Reversals += p.Amount - p.Commission
+		}
+		payout.Amount = payout.Gross - payout.Commission - payout.Reversals
+		if int64(payout.Amount) < s.cfg.MinimumMinor {
+			return nil
+		}
+
+		if err := tx.Create(&payout).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Purchase{}).Where("id IN ?", purchaseIDs(earned)).
+			Update("payout_id", payout.ID).Error; err != nil {
+			return err
+		}
+		if len(reversed) > 0 {
+			if err := tx.Model(&models.Purchase{}).Where("id IN ?", purchaseIDs(reversed)).
+				Update("reversal_payout_id", payout.ID).Error; err != nil {
+				return err
+			}
+		}
+		created = true
+		return nil
+	})
+	return created, err
+}
+
+// publisherPurchases selects and locks the purchases of a publisher's agents
+// in one currency
+func (s *PayoutService) publisherPurchases(tx *gorm.DB, e publisherEarnings) *gorm.DB {
+	return tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "purchases"}}).
+		Select("purchases.*").
+		Joins("JOIN agents ON agents.id = purchases.agent_id").
+		Where("agents.publisher_id = ? AND purchases.currency = ?", e.PublisherID, e.Currency)
+}
+
+// SendPayouts transfers pending payouts to publishers whose payout account
+// is active. A failed transfer stays pending and is retried next run under
+// the same idempotency key, so it is never paid twice.
+func (s *PayoutService) SendPayouts(ctx context.Context) error {
+	var payouts []models.Payout
+	if err := s.db.Where("status = ?", models.PayoutStatusPending).Order("created_at").Find(&payouts).Error; err != nil {
+		return err
+	}
+
+	accounts := make(map[uuid.UUID]*models.PayoutAccount)
+	for _, payout := range payouts {
+		account, seen := accounts[payout.PublisherID]
+		if !seen {
+			var err error
+			account, err = s.GetAccount(ctx, payout.PublisherID)
+			switch {
+			case err == nil:
+			case errors.Is(err, ErrNoPayoutAccount):
+				account = nil
+			default:
+				log.Warn().Err(err).Str("publisher_id", payout.PublisherID.String()).Msg("Failed to check payout account")
+				account = nil
+			}
+			accounts[payout.PublisherID] = account
+		}
+		if account == nil || account.Status != models.PayoutAccountStatusActive {
+			continue
+		}
+
+		transferID, err := s.payments.Transfer(ctx, payout.ID.String(), account.ExternalID, payout.Amount, payout.Currency)
+		if err != nil {
+			log.Warn().Err(err).Str("payout_id", payout.ID.String()).Msg("Payout transfer failed")
+			if err := s.db.Model(&payout).Update("failure_reason", err.Error()).Error; err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := s.db.Model(&payout).Updates(map[string]interface{}{
+			"status":         models.PayoutStatusPaid,
+			"external_id":    transferID,
+			"failure_reason": "",
+			"paid_at":        time.Now(),
+		}).Error; err != nil {
+			// The money has already moved, so this needs reconciling by hand
+			log.Error().Err(err).
+				Str("payout_id", payout.ID.String()).
+				Str("transfer_id", transferID).
+				Msg("Payout sent but not recorded")
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshAccount activates a pending payout account once the provider
+// reports it can receive payouts
+func (s *PayoutService) refreshAccount(ctx context.Context, account *models.PayoutAccount) error {
+	if account.Status == models.PayoutAccountStatusActive {
+		return nil
+	}
+	ready, err := s.payments.PayoutAccountReady(ctx, account.ExternalID)
+	if err != nil || !ready {
+		return err
+	}
+	account.Status = models.PayoutAccountStatusActive
+	return s.db.Model(account).Update("status", account.Status).Error
+}
+
+// purchaseIDs returns the IDs of purchases
+func purchaseIDs(purchases []models.Purchase) []uuid.UUID {
+	ids := make([]uuid.UUID, len(purchases))
+	for i, p := range purchases {
+		ids[i] = p.ID
+	}
+	return ids
+}
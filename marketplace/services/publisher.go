@@ -0,0 +1,165 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrAlreadyPublisher is returned when a publisher or admin applies to
+	// become a publisher
+	ErrAlreadyPublisher = errors.New("you are already a publisher")
+	// ErrApplicationPending is returned when applying while an earlier
+	// application is still being reviewed
+	ErrApplicationPending = errors.New("your publisher application is still being reviewed")
+	// ErrApplicationDecided is returned when deciding an application that is
+	// no longer pending
+	ErrApplicationDecided = errors.New("publisher application is already decided")
+	// ErrRejectionReason is returned when rejecting an application without a reason
+	ErrRejectionReason = errors.New("a reason is required to reject an application")
+)
+
+// PublisherApplicationService moves users to the publisher role: users
+// apply with their business details and an admin approves or rejects the
+// application. The applicant is notified of the decision.
+type PublisherApplicationService struct {
+	db *gorm.DB
+}
+
+// NewPublisherApplicationService creates a new publisher application service
+func NewPublisherApplicationService(db *gorm.DB) *PublisherApplicationService {
+	return &PublisherApplicationService{db: db}
+}
+
+// Apply submits an application for a user. A rejected user may apply again.
+func (s *PublisherApplicationService) Apply(userID uuid.UUID, application *models.PublisherApplication) error {
+	var user models.User
+	if err := s.db.Select("id", "role").First(&user, "id = ?", userID).Error; err != nil {
+		return err
+	}
+	if user.Role == models.UserRolePublisher || user.Role == models.UserRoleAdmin {
+		return ErrAlreadyPublisher
+	}
+
+	var pending int64
+	if err := s.db.Model(&models.PublisherApplication{}).
+		Where("user_id = ? AND status = ?", userID, models.PublisherApplicationStatusPending).
+		Count(&pending).Error; err != nil {
+		return err
+	}
+	if pending > 0 {
+		return ErrApplicationPending
+	}
+
+	application.ID = uuid.Nil
+	application.UserID = userID
+	application.Status = models.PublisherApplicationStatusPending
+	application.RejectionReason = ""
+	application.ReviewedBy = nil
+	application.ReviewedAt = nil
+	return s.db.Create(application).Error
+}
+
+// GetApplications returns a user's applications, most recent first
+func (s *PublisherApplicationService) GetApplications(userID uuid.UUID) ([]models.PublisherApplication, error) {
+	var applications []models.PublisherApplication
+	if err := s.db.Where("user_id = ?", userID).Order("created_at DESC").Find(&applications).Error; err != nil {
+		return nil, err
+	}
+	return applications, nil
+}
+
+// GetQueue returns applications in a status, oldest first, as the admin
+// review queue
+func (s *PublisherApplicationService) GetQueue(status models.PublisherApplicationStatus, page, limit int) ([]models.PublisherApplication, int64, error) {
+	query := s.db.Model(&models.PublisherApplication{}).Where("status = ?", status)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var applications []models.PublisherApplication
+	offset := (page - 1) * limit
+	if err := query.Preload("User").Order("created_at").Offset(offset).Limit(limit).Find(&applications).Error; err != nil {
+		return nil, 0, err
+	}
+	return applications, total, nil
+}
+
+// Approve makes the applicant a publisher. Their company is set from the
+// application.
+func (s *PublisherApplicationService) Approve(id, reviewerID uuid.UUID) (*models.PublisherApplication, error) {
+	return s.decide(id, reviewerID, models.PublisherApplicationStatusApproved, "")
+}
+
+// Reject closes an application with a reason shown to the applicant
+func (s *PublisherApplicationService) Reject(id, reviewerID uuid.UUID, reason string) (*models.PublisherApplication, error) {
+	if reason == "" {
+		return nil, ErrRejectionReason
+	}
+	return s.decide(id, reviewerID, models.PublisherApplicationStatusRejected, reason)
+}
+
+func (s *PublisherApplicationService) decide(id, reviewerID uuid.UUID, status models.PublisherApplicationStatus, reason string) (*models.PublisherApplication, error) {
+	var application models.PublisherApplication
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&application, "id = ?", id).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		result := tx.Model(&models.PublisherApplication{}).
+			Where("id = ? AND status = ?", id, models.PublisherApplicationStatusPending).
+			Updates(map[string]interface{}{
+				"status":           status,
+				"rejection_reason": reason,
+				"reviewed_by":      reviewerID,
+				"reviewed_at":      now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrApplicationDecided
+		}
+		application.Status = status
+		application.RejectionReason = reason
+		application.ReviewedBy = &reviewerID
+		application.ReviewedAt = &now
+
+		notification := models.Notification{
+			UserID: application.UserID,
+			Type:   models.NotificationTypePublisherApplication,
+			Link:   "/publisher/application",
+		}
+		if status == models.PublisherApplicationStatusApproved {
+			// Admins keep their role; they can publish already
+			if err := tx.Model(&models.User{}).
+				Where("id = ? AND role = ?", application.UserID, models.UserRoleUser).
+				Updates(map[string]interface{}{
+					"role":    models.UserRolePublisher,
+					"company": application.CompanyName,
+				}).Error; err != nil {
+				return err
+			}
+			notification.Title = "Your publisher application was approved"
+			notification.Body = fmt.Sprintf("You can now publish agents on EdgePlug Marketplace as %s.", application.CompanyName)
+		} else {
+			notification.Title = "Your publisher application was not approved"
+			notification.Body = fmt.Sprintf("Reason: %s\n\nYou can update your details and apply again.", reason)
+		}
+		return notify(tx, &notification)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &application, nil
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+const (
+	// rankingWeightsID is the primary key of the single weights row
+	rankingWeightsID = 1
+	// maxRankingWeight bounds each weight so that no single signal can be
+	// made to drown out the others by orders of magnitude
+	maxRankingWeight = 100
+	// maxRecencyHalfLife is the longest recency half-life, in hours
+	maxRecencyHalfLife = 365 * 24
+)
+
+// ErrInvalidRankingWeights is returned for a weight outside 0 to 100 or a
+// recency half-life outside an hour to a year
+var ErrInvalidRankingWeights = errors.New("invalid ranking weights")
+
+// RankingService scores published agents for the catalog listing and the
+// featured slots. The weights come from the config until an admin sets
+// them; they are read on every query so changes apply immediately on all
+// instances.
+type RankingService struct {
+	db  *gorm.DB
+	cfg config.RankingConfig
+}
+
+// NewRankingService creates a new ranking service
+func NewRankingService(db *gorm.DB, cfg config.RankingConfig) *RankingService {
+	return &RankingService{db: db, cfg: cfg}
+}
+
+// GetWeights returns the weights in effect. UpdatedBy is nil when they are
+// the configured defaults.
+func (s *RankingService) GetWeights() (*models.RankingWeights, error) {
+	var weights models.RankingWeights
+	err := s.db.First(&weights, rankingWeightsID).Error
+	switch err {
+	case nil:
+		return &weights, nil
+	case gorm.ErrRecordNotFound:
+		return s.defaults(), nil
+	default:
+		return nil, err
+	}
+}
+
+// SetWeights replaces the weights in effect
+func (s *RankingService) SetWeights(adminID uuid.UUID, weights *models.RankingWeights) error {
+	for _, weight := range []float64{weights.DownloadsWeight, weights.RatingWeight, weights.RecencyWeight, weights.VerifiedBoost} {
+		if weight < 0 || weight > maxRankingWeight {
+			return fmt.Errorf("%w: weights must be between 0 and %d", ErrInvalidRankingWeights, maxRankingWeight)
+		}
+	}
+	if weights.RecencyHalfLife < 1 || weights.RecencyHalfLife > maxRecencyHalfLife {
+		return fmt.Errorf("%w: recency half-life must be between 1 and %d hours", ErrInvalidRankingWeights, maxRecencyHalfLife)
+	}
+
+	weights.ID = rankingWeightsID
+	weights.UpdatedBy = &adminID
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(weights).Error
+}
+
+// ResetWeights restores the configured defaults
+func (s *RankingService) ResetWeights() error {
+	return s.db.Delete(&models.RankingWeights{}, rankingWeightsID).Error
+}
+
+// Order sorts a query on agents by descending ranking score: the log of
+// downloads, the rating, a recency bonus halving every half-life since
+// publication and a boost for verified publishers, each weighted
+func (s *RankingService) Order(query *gorm.DB) (*gorm.DB, error) {
+	weights, err := s.GetWeights()
+	if err != nil {
+		return nil, err
+	}
+
+	return query.Order(clause.OrderBy{Expression: clause.Expr{
+		SQL: "(? * LN(1 + agents.downloads) + ? * agents.rating" +
+			" + ? * POWER(0.5, EXTRACT(EPOCH FROM (now() - COALESCE(agents.published_at, agents.created_at))) / 3600.0 / ?)" +
+			" + CASE WHEN agents.publisher_id IN (SELECT id FROM users WHERE verified = true) THEN ? ELSE 0 END) DESC, agents.id",
+		Vars: []interface{}{
+			weights.DownloadsWeight,
+			weights.RatingWeight,
+			weights.RecencyWeight,
+			weights.RecencyHalfLife,
+			weights.VerifiedBoost,
+		},
+		WithoutParentheses: true,
+	}}), nil
+}
+
+func (s *RankingService) defaults() *models.RankingWeights {
+	return &models.RankingWeights{
+		ID:              rankingWeightsID,
+		DownloadsWeight: s.cfg.DownloadsWeight,
+		RatingWeight:    s.cfg.RatingWeight,
+		RecencyWeight:   s.cfg.RecencyWeight,
+		RecencyHalfLife: int(s.cfg.RecencyHalfLife / time.Hour),
+		VerifiedBoost:   s.cfg.VerifiedBoost,
+	}
+}
@@ -0,0 +1,80 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tokenBucketScript takes a token from the bucket in KEYS[1], refilling
+// ARGV[1] tokens evenly over ARGV[2] milliseconds. It returns whether the
+// request is allowed, the milliseconds until a token is available and the
+// tokens left.
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+
+local rate = capacity / window
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], window)
+return {allowed, retry, math.floor(tokens)}
+`)
+
+// RateLimitResult is the outcome of counting a request against a limit
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // until the next request is allowed, when rejected
+}
+
+// RateLimiter limits requests with token buckets stored in Redis, so the
+// limits hold across instances. A bucket holds up to the limit's number of
+// requests and refills evenly over its window.
+type RateLimiter struct {
+	redis *RedisService
+}
+
+// NewRateLimiter creates a Redis-backed rate limiter
+func NewRateLimiter(redisSvc *RedisService) *RateLimiter {
+	return &RateLimiter{redis: redisSvc}
+}
+
+// Allow takes a request from the bucket named key. When Redis is
+// unavailable, the failure policy decides: failing open allows the request.
+func (l *RateLimiter) Allow(ctx context.Context, key string, requests int, window time.Duration) (RateLimitResult, error) {
+	values, err := tokenBucketScript.Run(ctx, l.redis.Client(), []string{"ratelimit:" + key},
+		requests, window.Milliseconds(), time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		if err := l.redis.Degrade(err); err != nil {
+			return RateLimitResult{}, err
+		}
+		return RateLimitResult{Allowed: true, Remaining: requests}, nil
+	}
+
+	return RateLimitResult{
+		Allowed:    values[0] == 1,
+		RetryAfter: time.Duration(values[1]) * time.Millisecond,
+		Remaining:  int(values[2]),
+	}, nil
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrInvalidReceipt is returned for a receipt token that was not signed
+	// by the marketplace or names no purchase
+	ErrInvalidReceipt = errors.New("receipt is not valid")
+	// ErrNoReceipt is returned when asking for the receipt of a purchase
+	// that was never paid for, or for the token of one that is not completed
+	ErrNoReceipt = errors.New("only completed purchases have a receipt")
+)
+
+// ReceiptClaims are the claims of a purchase receipt token. They identify
+// the purchase but not the buyer.
+type ReceiptClaims struct {
+	PurchaseID uuid.UUID `json:"purchase_id"`
+	AgentID    uuid.UUID `json:"agent_id"`
+	jwt.RegisteredClaims
+}
+
+// ReceiptVerification is what a verifier learns about a receipt's purchase
+type ReceiptVerification struct {
+	Valid       bool      `json:"valid"`
+	PurchaseID  uuid.UUID `json:"purchase_id"`
+	AgentID     uuid.UUID `json:"agent_id"`
+	AgentName   string    `json:"agent_name"`
+	Publisher   string    `json:"publisher"`
+	PurchasedAt time.Time `json:"purchased_at"`
+	Status      string    `json:"status"` // "valid", or the purchase's status once it is not, e.g. "refunded"
+}
+
+// Receipt itemizes one of a buyer's purchases. Token is the signed receipt
+// to hand to third parties, set for completed purchases only.
+type Receipt struct {
+	PurchaseID     uuid.UUID             `json:"purchase_id"`
+	AgentID        uuid.UUID             `json:"agent_id"`
+	AgentName      string                `json:"agent_name"`
+	Publisher      string                `json:"publisher"`
+	OrganizationID *uuid.UUID            `json:"organization_id,omitempty"`
+	Status         models.PurchaseStatus `json:"status"`
+	Currency       string                `json:"currency"`
+	AmountMinor    models.Money          `json:"amount_minor"`
+	Amount         string                `json:"amount"`
+	CreditMinor    models.Money          `json:"credit_minor"`
+	Credit         string                `json:"credit"`
+	PaidMinor      models.Money          `json:"paid_minor"` // charged to the payment method
+	Paid           string                `json:"paid"`
+	PaymentID      string                `json:"payment_id,omitempty"`
+	PurchasedAt    time.Time             `json:"purchased_at"`
+	Token          string                `json:"token,omitempty"`
+}
+
+// ReceiptService issues and verifies receipts proving a purchase was made
+// on the marketplace. Receipts do not expire, so a refund is what makes a
+// receipt invalid.
+type ReceiptService struct {
+	db     *gorm.DB
+	signer Signer
+	issuer string
+}
+
+// NewReceiptService creates a new receipt service
+func NewReceiptService(db *gorm.DB, signer Signer, issuer string) *ReceiptService {
+	return &ReceiptService{db: db, signer: signer, issuer: issuer}
+}
+
+// GetReceipt returns the receipt of one of the buyer's completed or
+// refunded purchases. Receipts of refunded purchases carry no token.
+func (s *ReceiptService) GetReceipt(buyerID, purchaseID uuid.UUID) (*Receipt, error) {
+	var purchase models.Purchase
+	if err := s.db.Preload("Agent.Publisher").
+		First(&purchase, "id = ? AND buyer_id = ?", purchaseID, buyerID).Error; err != nil {
+		return nil, err
+	}
+	if purchase.Status != models.PurchaseStatusCompleted && purchase.Status != models.PurchaseStatusRefunded {
+		return nil, ErrNoReceipt
+	}
+
+	paid := purchase.Amount - purchase.CreditApplied
+	receipt := &Receipt{
+		PurchaseID:     purchase.ID,
+		AgentID:        purchase.AgentID,
+		AgentName:      purchase.Agent.Name,
+		Publisher:      publisherName(&purchase.Agent.Publisher),
+		OrganizationID: purchase.OrganizationID,
+		Status:         purchase.Status,
+		Currency:       purchase.Currency,
+		AmountMinor:    purchase.Amount,
+		Amount:         models.FormatMoney(purchase.Amount, purchase.Currency),
+		CreditMinor:    purchase.CreditApplied,
+		Credit:         models.FormatMoney(purchase.CreditApplied, purchase.Currency),
+		PaidMinor:      paid,
+		Paid:           models.FormatMoney(paid, purchase.Currency),
+		PaymentID:      purchase.PaymentID,
+		PurchasedAt:    purchase.CreatedAt,
+	}
+	if purchase.Status == models.PurchaseStatusCompleted {
+		token, err := s.Issue(&purchase)
+		if err != nil {
+			return nil, err
+		}
+		receipt.Token = token
+	}
+	return receipt, nil
+}
+
+// Issue signs a receipt token for a completed purchase
+func (s *ReceiptService) Issue(purchase *models.Purchase) (string, error) {
+	if purchase.Status != models.PurchaseStatusCompleted {
+		return "", ErrNoReceipt
+	}
+
+	claims := ReceiptClaims{
+		PurchaseID: purchase.ID,
+		AgentID:    purchase.AgentID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   s.issuer,
+			Subject:  purchase.ID.String(),
+			IssuedAt: jwt.NewNumericDate(purchase.CreatedAt),
+		},
+	}
+
+	token := jwt.NewWithClaims(signerMethod{}, claims)
+	token.Header["kid"] = s.signer.KeyID()
+	return token.SignedString(s.signer)
+}
+
+// Verify checks a receipt token's signature and looks up the current state
+// of its purchase
+func (s *ReceiptService) Verify(tokenString string) (*ReceiptVerification, error) {
+	claims := &ReceiptClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if kid, _ := token.Header["kid"].(string); kid != s.signer.KeyID() {
+			return nil, errors.New("unknown signing key")
+		}
+		return s.signer.Public(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}), jwt.WithIssuer(s.issuer))
+	if err != nil {
+		return nil, ErrInvalidReceipt
+	}
+
+	var purchase models.Purchase
+	if err := s.db.Preload("Agent.Publisher").
+		First(&purchase, "id = ? AND agent_id = ?", claims.PurchaseID, claims.AgentID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidReceipt
+		}
+		return nil, err
+	}
+
+	result := &ReceiptVerification{
+		Valid:       purchase.Status == models.PurchaseStatusCompleted,
+		PurchaseID:  purchase.ID,
+		AgentID:     purchase.AgentID,
+		AgentName:   purchase.Agent.Name,
+		Publisher:   publisherName(&purchase.Agent.Publisher),
+		PurchasedAt: purchase.CreatedAt.UTC().Truncate(24 * time.Hour),
+		Status:      "valid",
+	}
+	if !result.Valid {
+		result.Status = string(purchase.Status)
+	}
+	return result, nil
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/config"
+)
+
+// ErrRedisUnavailable is returned when Redis is down and the failure policy is closed
+var ErrRedisUnavailable = errors.New("redis is unavailable")
+
+var (
+	redisUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "edgeplug_redis_up",
+		Help: "Whether the last Redis health check succeeded (1) or failed (0)",
+	})
+	redisPingLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "edgeplug_redis_ping_seconds",
+		Help:    "Latency of Redis health check pings",
+		Buckets: prometheus.DefBuckets,
+	})
+	redisPoolStats = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "edgeplug_redis_pool",
+		Help: "Redis connection pool statistics",
+	}, []string{"stat"})
+)
+
+// renewLock extends the lock in KEYS[1] to ARGV[2] milliseconds if it is
+// still held with the token ARGV[1]
+var renewLock = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseLock deletes the lock in KEYS[1] if it is still held with the
+// token ARGV[1], so that a holder whose lock expired cannot release the
+// lock of the next one
+var releaseLock = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func init() {
+	prometheus.MustRegister(redisUp, redisPingLatency, redisPoolStats)
+}
+
+// RedisService wraps the Redis client for the configured topology and tracks its health
+type RedisService struct {
+	client    redis.UniversalClient
+	cfg       config.RedisConfig
+	available atomic.Bool
+}
+
+// NewRedisService creates a Redis client for the standalone, sentinel or cluster topology
+func NewRedisService(cfg config.RedisConfig) (*RedisService, error) {
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled {
+		var err error
+		if tlsConfig, err = buildRedisTLSConfig(cfg.TLS); err != nil {
+			return nil, err
+		}
+	}
+
+	var client redis.UniversalClient
+	switch cfg.Mode {
+	case "sentinel":
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.MasterName,
+			SentinelAddrs:    cfg.SentinelAddrs,
+			SentinelPassword: cfg.SentinelPassword,
+			Username:         cfg.Username,
+			Password:         cfg.Password,
+			DB:               cfg.DB,
+			PoolSize:         cfg.PoolSize,
+			DialTimeout:      cfg.DialTimeout,
+			ReadTimeout:      cfg.ReadTimeout,
+			WriteTimeout:     cfg.WriteTimeout,
+			TLSConfig:        tlsConfig,
+		})
+	case "cluster":
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        cfg.ClusterAddrs,
+			Username:     cfg.Username,
+			Password:     cfg.Password,
+			PoolSize:     cfg.PoolSize,
+			DialTimeout:  cfg.DialTimeout,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			TLSConfig:    tlsConfig,
+		})
+	default:
+		client = redis.NewClient(&redis.Options{
+			Addr:         cfg.GetRedisAddr(),
+			Username:     cfg.Username,
+			Password:     cfg.Password,
+			DB:           cfg.DB,
+			PoolSize:     cfg.PoolSize,
+			DialTimeout:  cfg.DialTimeout,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			TLSConfig:    tlsConfig,
+		})
+	}
+
+	s := &RedisService{client: client, cfg: cfg}
+	s.checkHealth(context.Background())
+	return s, nil
+}
+
+// buildRedisTLSConfig loads the CA bundle and client certificate for Redis TLS
+func buildRedisTLSConfig(cfg config.RedisTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Redis CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Client returns the underlying Redis client
+func (s *RedisService) Client() redis.UniversalClient {
+	return s.client
+}
+
+// Available reports whether the last health check succeeded
+func (s *RedisService) Available() bool {
+	return s.available.Load()
+}
+
+// FailOpen reports whether callers should proceed while Redis is unavailable
+func (s *RedisService) FailOpen() bool {
+	return s.cfg.FailOpen()
+}
+
+// Degrade maps a Redis error to the configured failure policy: nil when
+// failing open, ErrRedisUnavailable when failing closed
+func (s *RedisService) Degrade(err error) error {
+	if err == nil || errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	log.Warn().Err(err).Str("policy", s.cfg.FailurePolicy).Msg("Redis unavailable, degrading")
+	if s.FailOpen() {
+		return nil
+	}
+	return ErrRedisUnavailable
+}
+
+// Status returns the Redis connection state for health reporting
+func (s *RedisService) Status() map[string]interface{} {
+	status := "up"
+	if !s.Available() {
+		status = "down"
+	}
+	return map[string]interface{}{
+		"mode":   s.cfg.Mode,
+		"status": status,
+	}
+}
+
+// MonitorHealth pings Redis periodically and records health and pool metrics until ctx is done
+func (s *RedisService) MonitorHealth(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkHealth(ctx)
+		}
+	}
+}
+
+// checkHealth pings Redis once and updates the health state and metrics
+func (s *RedisService) checkHealth(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.DialTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := s.client.Ping(ctx).Err()
+	redisPingLatency.Observe(time.Since(start).Seconds())
+
+	wasAvailable := s.available.Swap(err == nil)
+	if err != nil {
+		redisUp.Set(0)
+		if wasAvailable {
+			log.Error().Err(err).Str("mode", s.cfg.Mode).Msg("Redis health check failed")
+		}
+	} else {
+		redisUp.Set(1)
+		if !wasAvailable {
+			log.Info().Str("mode", s.cfg.Mode).Msg("Redis connection healthy")
+		}
+	}
+
+	stats := s.client.PoolStats()
+	redisPoolStats.WithLabelValues("hits").Set(float64(stats.Hits))
+	redisPoolStats.WithLabelValues("misses").Set(float64(stats.Misses))
+	redisPoolStats.WithLabelValues("timeouts").Set(float64(stats.Timeouts))
+	redisPoolStats.WithLabelValues("total_conns").Set(float64(stats.TotalConns))
+	redisPoolStats.WithLabelValues("idle_conns").Set(float64(stats.IdleConns))
+	redisPoolStats.WithLabelValues("stale_conns").Set(float64(stats.StaleConns))
+}
+
+// Close closes the Redis client
+func (s *RedisService) Close() error {
+	return s.client.Close()
+}
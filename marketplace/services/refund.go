@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrNotRefundable is returned when refunding a purchase that is not completed
+	ErrNotRefundable = errors.New("only completed purchases can be refunded")
+	// ErrRefundPending is returned when a purchase already has an open refund request
+	ErrRefundPending = errors.New("a refund request for this purchase is already open")
+	// ErrRefundClosed is returned when deciding a refund request that is no longer pending
+	ErrRefundClosed = errors.New("refund request is already decided")
+	// ErrRefundFailed is returned when the payment provider did not refund the payment
+	ErrRefundFailed = errors.New("payment provider refund failed")
+)
+
+// RefundService handles buyers' refund requests and their approval
+type RefundService struct {
+	db       *gorm.DB
+	payments PaymentProvider
+}
+
+// NewRefundService creates a new refund service
+func NewRefundService(db *gorm.DB, payments PaymentProvider) *RefundService {
+	return &RefundService{db: db, payments: payments}
+}
+
+// RequestRefund opens a refund request for one of the buyer's completed purchases
+func (s *RefundService) RequestRefund(buyerID, purchaseID uuid.UUID, reason string) (*models.RefundRequest, error) {
+	var purchase models.Purchase
+	if err := s.db.First(&purchase, "id = ? AND buyer_id = ?", purchaseID, buyerID).Error; err != nil {
+		return nil, err
+	}
+	if purchase.Status != models.PurchaseStatusCompleted {
+		return nil, ErrNotRefundable
+	}
+
+	var open int64
+	if err := s.db.Model(&models.RefundRequest{}).
+		Where("purchase_id = ? AND status IN ?", purchase.ID, []models.RefundStatus{models.RefundStatusPending, models.RefundStatusProcessing}).
+		Count(&open).Error; err != nil {
+		return nil, err
+	}
+	if open > 0 {
+		return nil, ErrRefundPending
+	}
+
+	request := models.RefundRequest{
+		PurchaseID: purchase.ID,
+		BuyerID:    buyerID,
+		Reason:     reason,
+		Status:     models.RefundStatusPending,
+	}
+	if err := s.db.Create(&request).Error; err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// GetRefundRequests returns refund requests in a status, oldest first, as
+// the admin queue
+func (s *RefundService) GetRefundRequests(status models.RefundStatus, page, limit int) ([]models.RefundRequest, int64, error) {
+	query := s.db.Model(&models.RefundRequest{}).Where("status = ?", status)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var requests []models.RefundRequest
+	offset := (page - 1) * limit
+	if err := query.Preload("Purchase.Agent").Order("created_at").Offset(offset).Limit(limit).Find(&requests).Error; err != nil {
+		return nil, 0, err
+	}
+	return requests, total, nil
+}
+
+// DenyRefund closes a pending refund request without refunding
+func (s *RefundService) DenyRefund(id, reviewerID uuid.UUID, notes string) error {
+	result := s.db.Model(&models.RefundRequest{}).
+		Where("id = ? AND status = ?", id, models.RefundStatusPending).
+		Updates(map[string]interface{}{
+			"status":      models.RefundStatusDenied,
+			"reviewed_by": reviewerID,
+			"reviewed_at": time.Now(),
+			"notes":       notes,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return s.closedOrMissing(id)
+	}
+	return nil
+}
+
+// ApproveRefund refunds the purchase of a pending request. The part paid
+// through the payment provider is refunded there, the part paid with
+// credit is returned as credit. The purchase becomes refunded, which
+// revokes the buyer's entitlement to download the agent.
+func (s *RefundService) ApproveRefund(ctx context.Context, id, reviewerID uuid.UUID, notes string) (*models.RefundRequest, error) {
+	var request models.RefundRequest
+	if err := s.db.Preload("Purchase").First(&request, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	if request.Status != models.RefundStatusPending {
+		return nil, ErrRefundClosed
+	}
+	purchase := request.Purchase
+	if purchase == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if purchase.Status != models.PurchaseStatusCompleted {
+		return nil, ErrNotRefundable
+	}
+
+	// Claim the request so a concurrent approval cannot refund twice
+	result := s.db.Model(&models.RefundRequest{}).
+		Where("id = ? AND status = ?", id, models.RefundStatusPending).
+		Update("status", models.RefundStatusProcessing)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrRefundClosed
+	}
+
+	var refundID string
+	paid := purchase.Amount - purchase.CreditApplied
+	if paid > 0 && purchase.PaymentID != "" {
+		var err error
+		refundID, err = s.payments.Refund(ctx, request.ID.String(), purchase.PaymentID, paid, purchase.Currency)
+		if err != nil {
+			if err := s.db.Model(&request).Update("status", models.RefundStatusPending).Error; err != nil {
+				log.Error().Err(err).Str("refund_request_id", id.String()).Msg("Failed to release refund request")
+			}
+			return nil, fmt.Errorf("%w: %v", ErrRefundFailed, err)
+		}
+	}
+
+	metadata, err := json.Marshal(map[string]interface{}{
+		"refund_request_id": request.ID,
+		"payment_minor":     paid,
+		"credit_minor":      purchase.CreditApplied,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&request).Updates(map[string]interface{}{
+			"status":             models.RefundStatusApproved,
+			"reviewed_by":        reviewerID,
+			"reviewed_at":        now,
+			"notes":              notes,
+			"external_refund_id": refundID,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Purchase{}).Where("id = ?", purchase.ID).
+			Update("status", models.PurchaseStatusRefunded).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&models.Transaction{
+			PurchaseID:    purchase.ID,
+			Amount:        purchase.Amount,
+			Currency:      purchase.Currency,
+			Type:          models.TransactionTypeRefund,
+			Status:        models.TransactionStatusCompleted,
+			PaymentMethod: s.payments.Name(),
+			ExternalID:    refundID,
+			Metadata:      string(metadata),
+		}).Error; err != nil {
+			return err
+		}
+		return refundCredit(tx, purchase, "Purchase refunded")
+	})
+	if err != nil {
+		// The money has already moved, so this needs reconciling by hand
+		log.Error().Err(err).
+			Str("refund_request_id", id.String()).
+			Str("external_refund_id", refundID).
+			Msg("Refund paid out but not recorded")
+		return nil, err
+	}
+	return &request, nil
+}
+
+// closedOrMissing tells apart a decided refund request from a missing one
+func (s *RefundService) closedOrMissing(id uuid.UUID) error {
+	var count int64
+	if err := s.db.Model(&models.RefundRequest{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return ErrRefundClosed
+}
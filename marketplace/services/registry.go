@@ -0,0 +1,285 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+const (
+	// claimCodeLength is the length of generated claim codes
+	claimCodeLength = 10
+	// claimCodeAlphabet leaves out characters that are easily misread on a
+	// label: 0/O, 1/I/L
+	claimCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+)
+
+var (
+	// ErrInvalidSerial is returned for a serial that is not 3 to 64 letters,
+	// digits, dots, dashes and underscores
+	ErrInvalidSerial = errors.New("serial must be 3 to 64 letters, digits, '.', '-' or '_'")
+	// ErrDeviceExists is returned when provisioning a serial twice
+	ErrDeviceExists = errors.New("a device with this serial is already provisioned")
+	// ErrInvalidClaim is returned for an unknown serial or a wrong claim
+	// code, which are not told apart
+	ErrInvalidClaim = errors.New("serial or claim code is incorrect")
+	// ErrDeviceClaimed is returned when claiming a device someone has claimed
+	ErrDeviceClaimed = errors.New("device is already claimed; it must be released by its owner first")
+	// ErrDeviceInUse is returned when releasing a device with active deployments
+	ErrDeviceInUse = errors.New("decommission the device's deployments before releasing it")
+)
+
+var serialPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,64}$`)
+
+// FleetDevice is a device a user has claimed and the agents installed on it
+type FleetDevice struct {
+	models.DeviceClaim
+	Installed []InstalledAgent `json:"installed_agents"`
+}
+
+// InstalledAgent is an agent actively deployed on a device
+type InstalledAgent struct {
+	DeploymentID   uuid.UUID  `json:"deployment_id"`
+	AgentID        uuid.UUID  `json:"agent_id"`
+	Name           string     `json:"name"`
+	Version        string     `json:"version"`                   // pinned release
+	RunningVersion string     `json:"running_version,omitempty"` // last release the device reported
+	DeployedAt     time.Time  `json:"deployed_at"`
+	LastCheckInAt  *time.Time `json:"last_check_in_at,omitempty"`
+}
+
+// ProvisionDevice adds a device to the registry and returns its claim code,
+// which is only known at this point
+func (s *DeviceService) ProvisionDevice(adminID uuid.UUID, serial, hardwareModel string) (*models.Device, string, error) {
+	if !serialPattern.MatchString(serial) {
+		return nil, "", ErrInvalidSerial
+	}
+	var existing int64
+	if err := s.db.Model(&models.Device{}).Where("serial = ?", serial).Count(&existing).Error; err != nil {
+		return nil, "", err
+	}
+	if existing > 0 {
+		return nil, "", ErrDeviceExists
+	}
+
+	code, err := generateClaimCode()
+	if err != nil {
+		return nil, "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, "", err
+	}
+	device := models.Device{
+		Serial:        serial,
+		HardwareModel: hardwareModel,
+		ClaimCodeHash: string(hash),
+		ProvisionedBy: adminID,
+	}
+	if err := s.db.Create(&device).Error; err != nil {
+		return nil, "", err
+	}
+	return &device, code, nil
+}
+
+// ClaimDevice adds a registered device to a user's fleet, optionally in a
+// group
+func (s *DeviceService) ClaimDevice(userID uuid.UUID, serial, claimCode, name, group string) (*FleetDevice, error) {
+	var device models.Device
+	if err := s.db.First(&device, "serial = ?", serial).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidClaim
+		}
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(device.ClaimCodeHash), []byte(normalizeClaimCode(claimCode))) != nil {
+		return nil, ErrInvalidClaim
+	}
+
+	claim := models.DeviceClaim{
+		DeviceID:  device.ID,
+		UserID:    userID,
+		Name:      name,
+		Group:     group,
+		ClaimedAt: time.Now(),
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Locking the device serializes concurrent claims
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&models.Device{}, "id = ?", device.ID).Error; err != nil {
+			return err
+		}
+		var active int64
+		if err := tx.Model(&models.DeviceClaim{}).
+			Where("device_id = ? AND released_at IS NULL", device.ID).
+			Count(&active).Error; err != nil {
+			return err
+		}
+		if active > 0 {
+			return ErrDeviceClaimed
+		}
+		return tx.Create(&claim).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claim.Device = device
+	return &FleetDevice{DeviceClaim: claim, Installed: []InstalledAgent{}}, nil
+}
+
+// GetFleet returns the devices a user has claimed, most recent first,
+// optionally only those in a group
+func (s *DeviceService) GetFleet(userID uuid.UUID, group string, page, limit int) ([]FleetDevice, int64, error) {
+	query := s.db.Model(&models.DeviceClaim{}).Where("user_id = ? AND released_at IS NULL", userID)
+	if group != "" {
+		query = query.Where("device_group = ?", group)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var claims []models.DeviceClaim
+	if err := query.Preload("Device").Order("claimed_at DESC").Offset((page - 1) * limit).Limit(limit).Find(&claims).Error; err != nil {
+		return nil, 0, err
+	}
+
+	fleet, err := s.withInstalled(userID, claims)
+	if err != nil {
+		return nil, 0, err
+	}
+	return fleet, total, nil
+}
+
+// GetFleetDevice returns one of a user's claimed devices by serial
+func (s *DeviceService) GetFleetDevice(userID uuid.UUID, serial string) (*FleetDevice, error) {
+	claim, err := s.activeClaim(userID, serial)
+	if err != nil {
+		return nil, err
+	}
+	fleet, err := s.withInstalled(userID, []models.DeviceClaim{*claim})
+	if err != nil {
+		return nil, err
+	}
+	return &fleet[0], nil
+}
+
+// UpdateFleetDevice sets the name, group and site of one of a user's devices
+func (s *DeviceService) UpdateFleetDevice(userID uuid.UUID, serial, name, group, site string) (*FleetDevice, error) {
+	claim, err := s.activeClaim(userID, serial)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(claim).Updates(map[string]interface{}{"name": name, "device_group": group, "site": site}).Error; err != nil {
+		return nil, err
+	}
+	return s.GetFleetDevice(userID, serial)
+}
+
+// ReleaseDevice removes a device from a user's fleet, so it can be claimed
+// again with its claim code
+func (s *DeviceService) ReleaseDevice(userID uuid.UUID, serial string) error {
+	claim, err := s.activeClaim(userID, serial)
+	if err != nil {
+		return err
+	}
+
+	var deployed int64
+	if err := s.db.Model(&models.Deployment{}).
+		Where("buyer_id = ? AND device_id = ? AND decommissioned_at IS NULL", userID, serial).
+		Count(&deployed).Error; err != nil {
+		return err
+	}
+	if deployed > 0 {
+		return ErrDeviceInUse
+	}
+
+	now := time.Now()
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(claim).Where("released_at IS NULL").Update("released_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		// The next owner provisions its own certificates
+		return tx.Model(&models.DeviceCertificate{}).
+			Where("device_id = ? AND revoked_at IS NULL", claim.DeviceID).
+			Update("revoked_at", now).Error
+	})
+}
+
+func (s *DeviceService) activeClaim(userID uuid.UUID, serial string) (*models.DeviceClaim, error) {
+	var claim models.DeviceClaim
+	if err := s.db.Preload("Device").
+		Where("user_id = ? AND released_at IS NULL AND device_id = (SELECT id FROM devices WHERE serial = ?)", userID, serial).
+		First(&claim).Error; err != nil {
+		return nil, err
+	}
+	return &claim, nil
+}
+
+// withInstalled adds the agents actively deployed on each claimed device
+func (s *DeviceService) withInstalled(userID uuid.UUID, claims []models.DeviceClaim) ([]FleetDevice, error) {
+	fleet := make([]FleetDevice, len(claims))
+	if len(claims) == 0 {
+		return fleet, nil
+	}
+	bySerial := make(map[string]*FleetDevice, len(claims))
+	serials := make([]string, len(claims))
+	for i := range claims {
+		fleet[i] = FleetDevice{DeviceClaim: claims[i], Installed: []InstalledAgent{}}
+		bySerial[claims[i].Device.Serial] = &fleet[i]
+		serials[i] = claims[i].Device.Serial
+	}
+
+	var deployments []models.Deployment
+	if err := s.db.Preload("Agent", func(db *gorm.DB) *gorm.DB { return db.Unscoped().Select("id", "name") }).
+		Where("buyer_id = ? AND device_id IN ? AND decommissioned_at IS NULL", userID, serials).
+		Order("deployed_at").
+		Find(&deployments).Error; err != nil {
+		return nil, err
+	}
+	for _, d := range deployments {
+		device := bySerial[d.DeviceID]
+		device.Installed = append(device.Installed, InstalledAgent{
+			DeploymentID:   d.ID,
+			AgentID:        d.AgentID,
+			Name:           d.Agent.Name,
+			Version:        d.Version,
+			RunningVersion: d.RunningVersion,
+			DeployedAt:     d.DeployedAt,
+			LastCheckInAt:  d.LastCheckInAt,
+		})
+	}
+	return fleet, nil
+}
+
+// normalizeClaimCode accepts claim codes typed in lower case or with dashes
+func normalizeClaimCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// generateClaimCode returns a random claim code from claimCodeAlphabet
+func generateClaimCode() (string, error) {
+	raw := make([]byte, claimCodeLength)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := make([]byte, claimCodeLength)
+	for i, b := range raw {
+		// The modulo bias is small enough for a one-time code
+		code[i] = claimCodeAlphabet[int(b)%len(claimCodeAlphabet)]
+	}
+	return string(code), nil
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// ReviewReminderService prompts buyers to review agents some time after a
+// completed purchase
+type ReviewReminderService struct {
+	db      *gorm.DB
+	cfg     config.ReviewRemindersConfig
+	consent *ConsentService
+}
+
+// NewReviewReminderService creates a new review reminder service
+func NewReviewReminderService(db *gorm.DB, cfg config.ReviewRemindersConfig, consent *ConsentService) *ReviewReminderService {
+	return &ReviewReminderService{db: db, cfg: cfg, consent: consent}
+}
+
+// Run processes due reminders every poll interval until ctx is done
+func (s *ReviewReminderService) Run(ctx context.Context) {
+	if !s.cfg.Enabled {
+		return
+	}
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.ProcessDue(); err != nil {
+				log.Error().Err(err).Msg("Failed to process review reminders")
+			}
+		}
+	}
+}
+
+// ProcessDue sends reminders for completed purchases older than the
+// configured delay that have not been handled yet
+func (s *ReviewReminderService) ProcessDue() error {
+	var purchases []models.Purchase
+	if err := s.db.Preload("Agent").
+		Where("status = ? AND updated_at <= ?", models.PurchaseStatusCompleted, time.Now().Add(-s.cfg.Delay)).
+		Where("NOT EXISTS (SELECT 1 FROM review_reminders WHERE review_reminders.purchase_id = purchases.id)").
+		Order("updated_at").
+		Limit(s.cfg.BatchSize).
+		Find(&purchases).Error; err != nil {
+		return err
+	}
+
+	for i := range purchases {
+		if err := s.process(&purchases[i]); err != nil {
+			return fmt.Errorf("purchase %s: %w", purchases[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// process claims a purchase's reminder slot and delivers or suppresses it.
+// The unique purchase_id makes this safe to run on several instances.
+func (s *ReviewReminderService) process(purchase *models.Purchase) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		reminder := models.ReviewReminder{
+			PurchaseID:  purchase.ID,
+			UserID:      purchase.BuyerID,
+			AgentID:     purchase.AgentID,
+			Status:      models.ReviewReminderStatusSent,
+			ProcessedAt: time.Now(),
+		}
+
+		reason, err := s.suppressionReason(tx, purchase)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			reminder.Status = models.ReviewReminderStatusSuppressed
+			reminder.Reason = reason
+		}
+
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&reminder)
+		if result.Error != nil || result.RowsAffected == 0 || reason != "" {
+			return result.Error
+		}
+
+		return notify(tx, &models.Notification{
+			UserID: purchase.BuyerID,
+			Type:   models.NotificationTypeReviewReminder,
+			Title:  fmt.Sprintf("How is %s working for you?", purchase.Agent.Name),
+			Body:   "Your review helps other integrators choose the right agent.",
+			Link:   fmt.Sprintf("/agents/%s/reviews", purchase.AgentID),
+		})
+	})
+}
+
+// suppressionReason returns why no reminder should be sent, or "" to send it
+func (s *ReviewReminderService) suppressionReason(tx *gorm.DB, purchase *models.Purchase) (string, error) {
+	var user models.User
+	if err := tx.Select("review_reminder_opt_out").First(&user, "id = ?", purchase.BuyerID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return "user_deleted", nil
+		}
+		return "", err
+	}
+	if user.ReviewReminderOptOut {
+		return "opted_out", nil
+	}
+	granted, err := s.consent.Granted(purchase.BuyerID, models.ConsentMarketingEmail)
+	if err != nil {
+		return "", err
+	}
+	if !granted {
+		return "no_marketing_consent", nil
+	}
+
+	var reviews int64
+	if err := tx.Model(&models.Review{}).
+		Where("user_id = ? AND agent_id = ?", purchase.BuyerID, purchase.AgentID).
+		Count(&reviews).Error; err != nil {
+		return "", err
+	}
+	if reviews > 0 {
+		return "already_reviewed", nil
+	}
+
+	return "", nil
+}
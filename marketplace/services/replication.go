@@ -0,0 +1,63 @@
+package services
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/config"
+)
+
+// ReplicationService tracks whether this instance is the primary or a read-only standby
+type ReplicationService struct {
+	mu  sync.RWMutex
+	cfg config.ReplicationConfig
+}
+
+// NewReplicationService creates a new replication service
+func NewReplicationService(cfg config.ReplicationConfig) *ReplicationService {
+	return &ReplicationService{cfg: cfg}
+}
+
+// IsReadOnly reports whether writes must be rejected on this instance
+func (s *ReplicationService) IsReadOnly() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg.IsReplica()
+}
+
+// PrimaryURL returns the base URL of the primary region
+func (s *ReplicationService) PrimaryURL() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg.PrimaryURL
+}
+
+// Status returns the current replication role for health reporting
+func (s *ReplicationService) Status() map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return map[string]interface{}{
+		"mode":   s.cfg.Mode,
+		"region": s.cfg.Region,
+	}
+}
+
+// Apply switches to a new replication configuration and reports whether
+// the instance was promoted from replica to primary
+func (s *ReplicationService) Apply(cfg config.ReplicationConfig) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	promoted := s.cfg.IsReplica() && !cfg.IsReplica()
+	if s.cfg.Mode != cfg.Mode {
+		log.Warn().
+			Str("from", s.cfg.Mode).
+			Str("to", cfg.Mode).
+			Str("region", cfg.Region).
+			Msg("Replication mode changed")
+	}
+	s.cfg = cfg
+
+	return promoted
+}
@@ -0,0 +1,532 @@
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// maxGrantReferenceLength caps the reseller's order reference of a grant
+const maxGrantReferenceLength = 100
+
+var (
+	// ErrEntitlementBatchTooLarge is returned for a batch over the configured
+	// size or row limit
+	ErrEntitlementBatchTooLarge = errors.New("entitlement batch has too many bytes or rows")
+	// ErrInvalidEntitlementBatch is returned for a batch that is neither a
+	// CSV file with the expected header nor a JSON list of entitlements
+	ErrInvalidEntitlementBatch = errors.New("entitlements must be a CSV file with organization, agent_id, seats and reference columns, or JSON with an entitlements list")
+	// ErrEntitlementBatchRejected is returned when rows of a batch are
+	// invalid, in which case nothing is granted
+	ErrEntitlementBatchRejected = errors.New("some entitlements are invalid, so none were granted")
+	// ErrNotReseller is returned when recording a seat pool for a user who
+	// is not a reseller
+	ErrNotReseller = errors.New("user is not a reseller")
+	// ErrInvalidSeatPool is returned for a seat pool without seats or for an
+	// agent that is not published
+	ErrInvalidSeatPool = errors.New("seat pools need at least one seat of a published agent")
+)
+
+// entitlementColumns maps accepted CSV header names to columns
+var entitlementColumns = map[string]string{
+	"organization":    "organization",
+	"organization_id": "organization",
+	"org":             "organization",
+	"agent_id":        "agent_id",
+	"agent":           "agent_id",
+	"seats":           "seats",
+	"reference":       "reference",
+	"order":           "reference",
+}
+
+// EntitlementRequest is one entitlement of a bulk batch
+type EntitlementRequest struct {
+	Organization string `json:"organization"` // ID or slug
+	AgentID      string `json:"agent_id"`
+	Seats        int    `json:"seats"`
+	Reference    string `json:"reference"` // the reseller's order
+}
+
+// EntitlementError is why one entitlement of a batch is invalid
+type EntitlementError struct {
+	Row       int    `json:"row"` // 1 is the first entitlement
+	Reference string `json:"reference,omitempty"`
+	Error     string `json:"error"`
+}
+
+// BulkEntitlementResult is the outcome of a bulk entitlement batch. Rows
+// whose reference was granted before are listed as existing, so a batch can
+// be retried safely.
+type BulkEntitlementResult struct {
+	BatchID  uuid.UUID              `json:"batch_id"`
+	DryRun   bool                   `json:"dry_run"`
+	Granted  []models.ResellerGrant `json:"granted"`
+	Existing []models.ResellerGrant `json:"existing"`
+	Seats    int                    `json:"seats"` // granted by this batch
+	Errors   []EntitlementError     `json:"errors,omitempty"`
+}
+
+// SeatPoolUsage is a seat pool in a reconciliation report. GrantedTotal is
+// recounted from the pool's grants, so a pool is balanced when it matches
+// Used.
+type SeatPoolUsage struct {
+	models.SeatPool
+	Remaining       int  `json:"remaining"`
+	GrantedInPeriod int  `json:"granted_in_period"`
+	GrantedTotal    int  `json:"granted_total"`
+	Balanced        bool `json:"balanced"`
+}
+
+// ReconciliationReport is a reseller's seat pools and the entitlements
+// they granted over a period, to reconcile against their own sales
+type ReconciliationReport struct {
+	ResellerID uuid.UUID              `json:"reseller_id"`
+	From       time.Time              `json:"from"`
+	To         time.Time              `json:"to"`
+	Pools      []SeatPoolUsage        `json:"pools"`
+	Grants     []models.ResellerGrant `json:"grants"`
+	Seats      int                    `json:"seats"` // granted over the period
+}
+
+// ResellerService lets resellers grant entitlements to their customers'
+// organizations in bulk, from seat pools bought wholesale. A batch is
+// granted whole or not at all. Each grant is a completed purchase of the
+// agent for the organization, whose license carries the seats granted.
+type ResellerService struct {
+	db  *gorm.DB
+	cfg config.ResellersConfig
+}
+
+// NewResellerService creates a new reseller service
+func NewResellerService(db *gorm.DB, cfg config.ResellersConfig) *ResellerService {
+	return &ResellerService{db: db, cfg: cfg}
+}
+
+// CreateSeatPool records seats of an agent a reseller bought wholesale
+func (s *ResellerService) CreateSeatPool(adminID, resellerID, agentID uuid.UUID, seats int, reference string) (*models.SeatPool, error) {
+	var reseller models.User
+	if err := s.db.First(&reseller, "id = ?", resellerID).Error; err != nil {
+		return nil, err
+	}
+	if reseller.Role != models.UserRoleReseller {
+		return nil, ErrNotReseller
+	}
+	var agent models.Agent
+	if err := s.db.First(&agent, "id = ?", agentID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidSeatPool
+		}
+		return nil, err
+	}
+	if seats < 1 || agent.Status != models.AgentStatusPublished {
+		return nil, ErrInvalidSeatPool
+	}
+
+	pool := models.SeatPool{
+		ResellerID: resellerID,
+		AgentID:    agentID,
+		Seats:      seats,
+		Reference:  strings.TrimSpace(reference),
+		CreatedBy:  adminID,
+	}
+	if err := s.db.Create(&pool).Error; err != nil {
+		return nil, err
+	}
+	return &pool, nil
+}
+
+// GetSeatPools returns a reseller's seat pools, newest first
+func (s *ResellerService) GetSeatPools(resellerID uuid.UUID) ([]models.SeatPool, error) {
+	var pools []models.SeatPool
+	err := s.db.Preload("Agent").Where("reseller_id = ?", resellerID).Order("created_at DESC").Find(&pools).Error
+	return pools, err
+}
+
+// ReadEntitlements reads a batch of entitlements, as CSV with a header row
+// or as JSON
+func (s *ResellerService) ReadEntitlements(r io.Reader, isCSV bool) ([]EntitlementRequest, error) {
+	data, err := io.ReadAll(io.LimitReader(r, s.cfg.MaxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.cfg.MaxFileSize {
+		return nil, ErrEntitlementBatchTooLarge
+	}
+
+	var entries []EntitlementRequest
+	if isCSV {
+		entries, err = readEntitlementsCSV(data)
+	} else {
+		var body struct {
+			Entitlements []EntitlementRequest `json:"entitlements"`
+		}
+		if json.Unmarshal(data, &body) != nil || body.Entitlements == nil {
+			return nil, ErrInvalidEntitlementBatch
+		}
+		entries = body.Entitlements
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrInvalidEntitlementBatch
+	}
+	if len(entries) > s.cfg.MaxRows {
+		return nil, ErrEntitlementBatchTooLarge
+	}
+	return entries, nil
+}
+
+// readEntitlementsCSV reads entitlements from a CSV file. Seats that are
+// not a number are read as 0, which fails validation with the row.
+func readEntitlementsCSV(data []byte) ([]EntitlementRequest, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, ErrInvalidEntitlementBatch
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if column, ok := entitlementColumns[name]; ok {
+			if _, dup := columns[column]; dup {
+				return nil, ErrInvalidEntitlementBatch
+			}
+			columns[column] = i
+		}
+	}
+	if len(columns) != 4 {
+		return nil, ErrInvalidEntitlementBatch
+	}
+
+	var entries []EntitlementRequest
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, ErrInvalidEntitlementBatch
+		}
+		field := func(column string) string {
+			if i := columns[column]; i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		seats, _ := strconv.Atoi(field("seats"))
+		entries = append(entries, EntitlementRequest{
+			Organization: field("organization"),
+			AgentID:      field("agent_id"),
+			Seats:        seats,
+			Reference:    field("reference"),
+		})
+	}
+}
+
+// GrantEntitlements grants a batch of entitlements from a reseller's seat
+// pools. Every row is checked first: the organization and the published
+// agent must exist, the organization must not have the agent yet, and one
+// of the reseller's pools for the agent must have the seats left, the
+// oldest being used first. If any row is invalid, nothing is granted and
+// the result lists why with ErrEntitlementBatchRejected. A dry run only
+// checks the batch.
+func (s *ResellerService) GrantEntitlements(resellerID uuid.UUID, entries []EntitlementRequest, dryRun bool) (*BulkEntitlementResult, error) {
+	result := &BulkEntitlementResult{
+		BatchID:  models.NewID(),
+		DryRun:   dryRun,
+		Granted:  []models.ResellerGrant{},
+		Existing: []models.ResellerGrant{},
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Concurrent batches of the reseller wait for each other here
+		var pools []models.SeatPool
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("reseller_id = ?", resellerID).Order("created_at, id").Find(&pools).Error; err != nil {
+			return err
+		}
+
+		var orgKeys, references []string
+		var agentIDs []uuid.UUID
+		for _, entry := range entries {
+			orgKeys = append(orgKeys, strings.ToLower(strings.TrimSpace(entry.Organization)))
+			references = append(references, strings.TrimSpace(entry.Reference))
+			if id, err := uuid.Parse(strings.TrimSpace(entry.AgentID)); err == nil {
+				agentIDs = append(agentIDs, id)
+			}
+		}
+		orgs, err := findOrganizations(tx, orgKeys)
+		if err != nil {
+			return err
+		}
+		var agents []models.Agent
+		if err := tx.Where("id IN ? AND status = ?", agentIDs, models.AgentStatusPublished).Find(&agents).Error; err != nil {
+			return err
+		}
+		agentsByID := make(map[uuid.UUID]*models.Agent, len(agents))
+		for i := range agents {
+			agentsByID[agents[i].ID] = &agents[i]
+		}
+		var granted []models.ResellerGrant
+		if err := tx.Where("reseller_id = ? AND reference IN ?", resellerID, references).Find(&granted).Error; err != nil {
+			return err
+		}
+		grantsByReference := make(map[string]*models.ResellerGrant, len(granted))
+		for i := range granted {
+			grantsByReference[granted[i].Reference] = &granted[i]
+		}
+		owned, err := ownedAgents(tx, orgs, agentIDs)
+		if err != nil {
+			return err
+		}
+
+		seen := map[string]bool{}
+		remaining := make([]int, len(pools))
+		for i := range pools {
+			remaining[i] = pools[i].Remaining()
+		}
+		for i, entry := range entries {
+			reference := references[i]
+			grant, problem := s.planGrant(entry, reference, orgs[orgKeys[i]], agentsByID, pools, remaining, grantsByReference[reference], owned, seen)
+			switch {
+			case problem != "":
+				result.Errors = append(result.Errors, EntitlementError{Row: i + 1, Reference: reference, Error: problem})
+			case grant.ID != uuid.Nil:
+				result.Existing = append(result.Existing, *grant)
+			default:
+				grant.ResellerID = resellerID
+				grant.BatchID = result.BatchID
+				result.Granted = append(result.Granted, *grant)
+				result.Seats += grant.Seats
+			}
+		}
+		if len(result.Errors) > 0 {
+			return ErrEntitlementBatchRejected
+		}
+		if dryRun {
+			return nil
+		}
+
+		for i := range result.Granted {
+			grant := &result.Granted[i]
+			agent := agentsByID[grant.AgentID]
+			// Paid for offline, so there is no amount, commission or payout
+			purchase := models.Purchase{
+				BuyerID:        resellerID,
+				AgentID:        grant.AgentID,
+				OrganizationID: &grant.OrganizationID,
+				Currency:       agent.Currency,
+				Status:         models.PurchaseStatusCompleted,
+			}
+			if err := tx.Create(&purchase).Error; err != nil {
+				return err
+			}
+			grant.PurchaseID = purchase.ID
+			if err := tx.Create(grant).Error; err != nil {
+				return err
+			}
+		}
+		for i := range pools {
+			if used := pools[i].Remaining() - remaining[i]; used > 0 {
+				if err := tx.Model(&pools[i]).UpdateColumn("used", gorm.Expr("used + ?", used)).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil && err != ErrEntitlementBatchRejected {
+		return nil, err
+	}
+	return result, err
+}
+
+// planGrant checks one entitlement of a batch and returns the grant it
+// makes, drawing its seats from remaining, or the grant made before under
+// its reference, or why it is invalid
+func (s *ResellerService) planGrant(entry EntitlementRequest, reference string, org *models.Organization, agents map[uuid.UUID]*models.Agent,
+	pools []models.SeatPool, remaining []int, previous *models.ResellerGrant, owned, seen map[string]bool) (*models.ResellerGrant, string) {
+	switch {
+	case reference == "":
+		return nil, "reference is required"
+	case len(reference) > maxGrantReferenceLength:
+		return nil, fmt.Sprintf("reference must be at most %d characters", maxGrantReferenceLength)
+	case seen["ref:"+reference]:
+		return nil, "reference appears more than once in the batch"
+	}
+	seen["ref:"+reference] = true
+	if org == nil {
+		return nil, "organization not found"
+	}
+	agentID, _ := uuid.Parse(strings.TrimSpace(entry.AgentID))
+	agent := agents[agentID]
+	if agent == nil {
+		return nil, "agent not found or not published"
+	}
+	if entry.Seats < 1 || entry.Seats > s.cfg.MaxSeats {
+		return nil, fmt.Sprintf("seats must be 1 to %d", s.cfg.MaxSeats)
+	}
+
+	if previous != nil {
+		if previous.OrganizationID != org.ID || previous.AgentID != agent.ID || previous.Seats != entry.Seats {
+			return nil, "reference was already used for a different entitlement"
+		}
+		return previous, ""
+	}
+	key := org.ID.String() + ":" + agent.ID.String()
+	if owned[key] || seen[key] {
+		return nil, "organization already has this agent"
+	}
+	seen[key] = true
+
+	largest := 0
+	for i := range pools {
+		if pools[i].AgentID != agent.ID {
+			continue
+		}
+		if remaining[i] >= entry.Seats {
+			remaining[i] -= entry.Seats
+			return &models.ResellerGrant{
+				PoolID:         pools[i].ID,
+				OrganizationID: org.ID,
+				AgentID:        agent.ID,
+				Seats:          entry.Seats,
+				Reference:      reference,
+			}, ""
+		}
+		largest = max(largest, remaining[i])
+	}
+	return nil, fmt.Sprintf("no seat pool for this agent has %d seats left (the largest has %d)", entry.Seats, largest)
+}
+
+// findOrganizations looks up organizations by ID or slug, keyed by
+// whichever was given
+func findOrganizations(tx *gorm.DB, keys []string) (map[string]*models.Organization, error) {
+	var ids []uuid.UUID
+	var slugs []string
+	for _, key := range keys {
+		if id, err := uuid.Parse(key); err == nil {
+			ids = append(ids, id)
+		} else if key != "" {
+			slugs = append(slugs, key)
+		}
+	}
+	var orgs []models.Organization
+	if err := tx.Where("id IN ? OR slug IN ?", ids, slugs).Find(&orgs).Error; err != nil {
+		return nil, err
+	}
+	found := make(map[string]*models.Organization, len(orgs)*2)
+	for i := range orgs {
+		found[orgs[i].ID.String()] = &orgs[i]
+		found[orgs[i].Slug] = &orgs[i]
+	}
+	return found, nil
+}
+
+// ownedAgents returns which of the agents each organization already has a
+// completed purchase of, keyed by "<organization ID>:<agent ID>"
+func ownedAgents(tx *gorm.DB, orgs map[string]*models.Organization, agentIDs []uuid.UUID) (map[string]bool, error) {
+	var orgIDs []uuid.UUID
+	for _, org := range orgs {
+		orgIDs = append(orgIDs, org.ID)
+	}
+	var purchases []models.Purchase
+	if err := tx.Select("organization_id", "agent_id").
+		Where("organization_id IN ? AND agent_id IN ? AND status = ?", orgIDs, agentIDs, models.PurchaseStatusCompleted).
+		Find(&purchases).Error; err != nil {
+		return nil, err
+	}
+	owned := make(map[string]bool, len(purchases))
+	for _, purchase := range purchases {
+		owned[purchase.OrganizationID.String()+":"+purchase.AgentID.String()] = true
+	}
+	return owned, nil
+}
+
+// Reconcile reports a reseller's seat pools, with the seats granted from
+// each over [from, to) and in total, and the grants made over the period
+func (s *ResellerService) Reconcile(resellerID uuid.UUID, from, to time.Time) (*ReconciliationReport, error) {
+	report := &ReconciliationReport{ResellerID: resellerID, From: from, To: to, Pools: []SeatPoolUsage{}}
+	if err := s.db.Preload("Organization").Preload("Agent").
+		Where("reseller_id = ? AND created_at >= ? AND created_at < ?", resellerID, from, to).
+		Order("created_at, id").Find(&report.Grants).Error; err != nil {
+		return nil, err
+	}
+
+	var totals []struct {
+		PoolID uuid.UUID
+		Seats  int
+	}
+	if err := s.db.Model(&models.ResellerGrant{}).Select("pool_id, SUM(seats) AS seats").
+		Where("reseller_id = ?", resellerID).Group("pool_id").Scan(&totals).Error; err != nil {
+		return nil, err
+	}
+	granted := make(map[uuid.UUID]int, len(totals))
+	for _, total := range totals {
+		granted[total.PoolID] = total.Seats
+	}
+	inPeriod := map[uuid.UUID]int{}
+	for _, grant := range report.Grants {
+		inPeriod[grant.PoolID] += grant.Seats
+		report.Seats += grant.Seats
+	}
+
+	pools, err := s.GetSeatPools(resellerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		report.Pools = append(report.Pools, SeatPoolUsage{
+			SeatPool:        pool,
+			Remaining:       pool.Remaining(),
+			GrantedInPeriod: inPeriod[pool.ID],
+			GrantedTotal:    granted[pool.ID],
+			Balanced:        granted[pool.ID] == pool.Used,
+		})
+	}
+	return report, nil
+}
+
+// WriteReconciliationCSV writes the grants of a reconciliation report as
+// CSV, one row per grant
+func WriteReconciliationCSV(report *ReconciliationReport, w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"granted_at", "batch_id", "reference", "organization_id", "organization", "agent_id", "agent", "seats", "pool_id", "purchase_id"})
+	for _, grant := range report.Grants {
+		var orgName, agentName string
+		if grant.Organization != nil {
+			orgName = grant.Organization.Name
+		}
+		if grant.Agent != nil {
+			agentName = grant.Agent.Name
+		}
+		writer.Write([]string{
+			grant.CreatedAt.UTC().Format(time.RFC3339),
+			grant.BatchID.String(),
+			grant.Reference,
+			grant.OrganizationID.String(),
+			orgName,
+			grant.AgentID.String(),
+			agentName,
+			strconv.Itoa(grant.Seats),
+			grant.PoolID.String(),
+			grant.PurchaseID.String(),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,463 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// reviewBucket is the granularity of the review daily buckets
+const reviewBucket = 24 * time.Hour
+
+// trendDays is the length in days of each period compared in the review trend
+const trendDays = 30
+
+// ErrOwnReview is returned when a user votes on their own review
+var ErrOwnReview = errors.New("you cannot vote on your own review")
+
+// ReviewService handles review-related business logic
+type ReviewService struct {
+	db *gorm.DB
+}
+
+// NewReviewService creates a new review service
+func NewReviewService(db *gorm.DB) *ReviewService {
+	return &ReviewService{db: db}
+}
+
+// CreateReview stores a review and updates the agent's review aggregates in
+// the same transaction, and tells the agent's publisher. The review is
+// marked as a verified purchase when the reviewer has a completed purchase
+// of the agent.
+func (s *ReviewService) CreateReview(review *models.Review) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var purchases int64
+		if err := tx.Model(&models.Purchase{}).
+			Where("buyer_id = ? AND agent_id = ? AND status = ?", review.UserID, review.AgentID, models.PurchaseStatusCompleted).
+			Count(&purchases).Error; err != nil {
+			return err
+		}
+		review.VerifiedPurchase = purchases > 0
+
+		if err := tx.Create(review).Error; err != nil {
+			return err
+		}
+		if err := s.recordReview(tx, review); err != nil {
+			return err
+		}
+		if err := s.syncAgentRating(tx, review.AgentID); err != nil {
+			return err
+		}
+
+		var agent models.Agent
+		if err := tx.Select("id", "name", "publisher_id").First(&agent, "id = ?", review.AgentID).Error; err != nil {
+			return err
+		}
+		if agent.PublisherID == review.UserID {
+			return nil
+		}
+		return notify(tx, &models.Notification{
+			UserID: agent.PublisherID,
+			Type:   models.NotificationTypeNewReview,
+			Title:  fmt.Sprintf("New %d-star review of %s", review.Rating, agent.Name),
+			Body:   review.Comment,
+			Link:   fmt.Sprintf("/agents/%s", agent.ID),
+		})
+	})
+}
+
+// UpdateReview changes the rating and comment of a review and recomputes
+// the agent's aggregates in the same transaction
+func (s *ReviewService) UpdateReview(review *models.Review, rating int, comment string) error {
+	commented := review.Comment != "" || comment != ""
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(review).Updates(map[string]interface{}{"rating": rating, "comment": comment}).Error; err != nil {
+			return err
+		}
+		review.Rating, review.Comment = rating, comment
+		if err := s.rebuildSummary(tx, review.AgentID); err != nil {
+			return err
+		}
+		if commented {
+			if err := markInsightStale(tx, review.AgentID); err != nil {
+				return err
+			}
+		}
+		return s.syncAgentRating(tx, review.AgentID)
+	})
+}
+
+// DeleteReview removes a review with its votes, reply and attachments and
+// recomputes the agent's aggregates in the same transaction. It returns
+// the removed attachments, whose files the caller deletes from storage.
+func (s *ReviewService) DeleteReview(review *models.Review) ([]models.ReviewAttachment, error) {
+	var attachments []models.ReviewAttachment
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("review_id = ?", review.ID).Find(&attachments).Error; err != nil {
+			return err
+		}
+		for _, dependent := range []interface{}{&models.ReviewAttachment{}, &models.ReviewVote{}, &models.ReviewReply{}} {
+			if err := tx.Where("review_id = ?", review.ID).Delete(dependent).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(review).Error; err != nil {
+			return err
+		}
+		if err := s.rebuildSummary(tx, review.AgentID); err != nil {
+			return err
+		}
+		if review.Comment != "" {
+			if err := markInsightStale(tx, review.AgentID); err != nil {
+				return err
+			}
+		}
+		return s.syncAgentRating(tx, review.AgentID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// Reply sets the publisher's reply to a review, replacing the earlier one
+// if any, and returns whether it is new. The reviewer is notified of new
+// replies but not of edits. The review must have its agent loaded.
+func (s *ReviewService) Reply(review *models.Review, authorID uuid.UUID, body string) (*models.ReviewReply, bool, error) {
+	reply := &models.ReviewReply{}
+	created := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		switch err := tx.Where("review_id = ?", review.ID).First(reply).Error; err {
+		case nil:
+			reply.AuthorID = authorID
+			reply.Body = body
+			return tx.Save(reply).Error
+		case gorm.ErrRecordNotFound:
+		default:
+			return err
+		}
+
+		*reply = models.ReviewReply{ReviewID: review.ID, AuthorID: authorID, Body: body}
+		if err := tx.Create(reply).Error; err != nil {
+			return err
+		}
+		created = true
+		return notify(tx, &models.Notification{
+			UserID: review.UserID,
+			Type:   models.NotificationTypeReviewReply,
+			Title:  "The publisher of " + review.Agent.Name + " replied to your review",
+			Body:   body,
+			Link:   fmt.Sprintf("/agents/%s", review.AgentID),
+		})
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return reply, created, nil
+}
+
+// Vote records whether a user found a review helpful, replacing their
+// earlier vote, and updates the review's vote counts to match
+func (s *ReviewService) Vote(review *models.Review, userID uuid.UUID, helpful bool) error {
+	if review.UserID == userID {
+		return ErrOwnReview
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the review so that concurrent votes by one user serialize
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").
+			First(&models.Review{}, "id = ?", review.ID).Error; err != nil {
+			return err
+		}
+
+		var vote models.ReviewVote
+		err := tx.Where("review_id = ? AND user_id = ?", review.ID, userID).First(&vote).Error
+		switch err {
+		case nil:
+			if vote.Helpful == helpful {
+				return nil
+			}
+			if err := tx.Model(&vote).Update("helpful", helpful).Error; err != nil {
+				return err
+			}
+		case gorm.ErrRecordNotFound:
+			if err := tx.Create(&models.ReviewVote{ReviewID: review.ID, UserID: userID, Helpful: helpful}).Error; err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		counts := map[string]interface{}{voteColumn(helpful): gorm.Expr(voteColumn(helpful) + " + 1")}
+		if err == nil {
+			// The user changed their vote
+			counts[voteColumn(!helpful)] = gorm.Expr(voteColumn(!helpful) + " - 1")
+		}
+		if err := tx.Model(&models.Review{}).Where("id = ?", review.ID).UpdateColumns(counts).Error; err != nil {
+			return err
+		}
+		return tx.Select("helpful_count", "unhelpful_count").First(review, "id = ?", review.ID).Error
+	})
+}
+
+// voteColumn is the review column counting helpful or unhelpful votes
+func voteColumn(helpful bool) string {
+	if helpful {
+		return "helpful_count"
+	}
+	return "unhelpful_count"
+}
+
+// DeleteReply removes the reply to a review
+func (s *ReviewService) DeleteReply(reviewID uuid.UUID) error {
+	result := s.db.Where("review_id = ?", reviewID).Delete(&models.ReviewReply{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// recordReview adds a review to the agent summary and daily bucket
+func (s *ReviewService) recordReview(tx *gorm.DB, review *models.Review) error {
+	verified := 0
+	if review.VerifiedPurchase {
+		verified = 1
+	}
+
+	summary := models.ReviewSummary{
+		AgentID:       review.AgentID,
+		ReviewCount:   1,
+		RatingSum:     review.Rating,
+		VerifiedCount: verified,
+	}
+	switch review.Rating {
+	case 1:
+		summary.OneStar = 1
+	case 2:
+		summary.TwoStar = 1
+	case 3:
+		summary.ThreeStar = 1
+	case 4:
+		summary.FourStar = 1
+	default:
+		summary.FiveStar = 1
+	}
+
+	star := models.StarColumn(review.Rating)
+	if err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "agent_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"review_count":   gorm.Expr("review_summaries.review_count + 1"),
+			"rating_sum":     gorm.Expr("review_summaries.rating_sum + ?", review.Rating),
+			star:             gorm.Expr("review_summaries." + star + " + 1"),
+			"verified_count": gorm.Expr("review_summaries.verified_count + ?", verified),
+			"updated_at":     time.Now(),
+		}),
+	}).Create(&summary).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "agent_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"review_count": gorm.Expr("review_daily_stats.review_count + 1"),
+			"rating_sum":   gorm.Expr("review_daily_stats.rating_sum + ?", review.Rating),
+		}),
+	}).Create(&models.ReviewDailyStat{
+		AgentID:     review.AgentID,
+		Day:         review.CreatedAt.UTC().Truncate(reviewBucket),
+		ReviewCount: 1,
+		RatingSum:   review.Rating,
+	}).Error; err != nil {
+		return err
+	}
+
+	if review.Comment == "" {
+		return nil
+	}
+	return markInsightStale(tx, review.AgentID)
+}
+
+// RebuildSummary recomputes an agent's aggregates, and its rating and
+// review count, from its visible reviews. It is used to backfill agents
+// reviewed before aggregates were maintained and after a moderator hides a
+// review.
+func (s *ReviewService) RebuildSummary(agentID uuid.UUID) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.rebuildSummary(tx, agentID); err != nil {
+			return err
+		}
+		return s.syncAgentRating(tx, agentID)
+	})
+}
+
+// RebuildAllSummaries rebuilds the aggregates of every agent that has
+// reviews or a non-zero rating and returns the IDs of those it rebuilt,
+// also when it stops at an error
+func (s *ReviewService) RebuildAllSummaries() ([]uuid.UUID, error) {
+	var agentIDs []uuid.UUID
+	if err := s.db.Model(&models.Agent{}).
+		Where("rating <> 0 OR review_count <> 0 OR id IN (?)", s.db.Model(&models.Review{}).Select("agent_id")).
+		Pluck("id", &agentIDs).Error; err != nil {
+		return nil, err
+	}
+	for i, agentID := range agentIDs {
+		if err := s.RebuildSummary(agentID); err != nil {
+			return agentIDs[:i], fmt.Errorf("agent %s: %w", agentID, err)
+		}
+	}
+	return agentIDs, nil
+}
+
+// rebuildSummary replaces an agent's summary and daily buckets with ones
+// computed from its visible reviews
+func (s *ReviewService) rebuildSummary(tx *gorm.DB, agentID uuid.UUID) error {
+	if err := tx.Where("agent_id = ?", agentID).Delete(&models.ReviewSummary{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("agent_id = ?", agentID).Delete(&models.ReviewDailyStat{}).Error; err != nil {
+		return err
+	}
+
+	var reviews []models.Review
+	if err := tx.Where("agent_id = ? AND hidden_at IS NULL", agentID).Find(&reviews).Error; err != nil {
+		return err
+	}
+	for i := range reviews {
+		if err := s.recordReview(tx, &reviews[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncAgentRating sets the agent's rating and review count to the average
+// and number of its visible reviews. The agent row is locked first so that
+// concurrent reviews of one agent see each other's writes. updated_at is
+// left alone, as for download counts, since the listing did not change.
+func (s *ReviewService) syncAgentRating(tx *gorm.DB, agentID uuid.UUID) error {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").
+		First(&models.Agent{}, "id = ?", agentID).Error; err != nil {
+		return err
+	}
+
+	var totals struct {
+		Count   int
+		Average float64
+	}
+	if err := tx.Model(&models.Review{}).
+		Where("agent_id = ? AND hidden_at IS NULL", agentID).
+		Select("COUNT(*) AS count, COALESCE(AVG(rating), 0) AS average").
+		Scan(&totals).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.Agent{}).Where("id = ?", agentID).
+		UpdateColumns(map[string]interface{}{"rating": totals.Average, "review_count": totals.Count}).Error
+}
+
+// ReviewTrendPeriod summarizes the reviews received in one trend window
+type ReviewTrendPeriod struct {
+	Count   int     `json:"count"`
+	Average float64 `json:"average"`
+}
+
+// ReviewSummaryResult is the review summary returned to clients
+type ReviewSummaryResult struct {
+	AgentID               uuid.UUID         `json:"agent_id"`
+	Count                 int               `json:"count"`
+	Average               float64           `json:"average"`
+	Distribution          map[int]int       `json:"distribution"`
+	VerifiedPurchaseRatio float64           `json:"verified_purchase_ratio"`
+	Last30Days            ReviewTrendPeriod `json:"last_30_days"`
+	Previous30Days        ReviewTrendPeriod `json:"previous_30_days"`
+	Trend                 string            `json:"trend"` // "up", "down", "flat"
+}
+
+// GetSummary returns the review summary for an agent from the aggregate tables
+func (s *ReviewService) GetSummary(agentID uuid.UUID) (*ReviewSummaryResult, error) {
+	var summary models.ReviewSummary
+	err := s.db.Where("agent_id = ?", agentID).First(&summary).Error
+	if err == gorm.ErrRecordNotFound {
+		var reviews int64
+		if err := s.db.Model(&models.Review{}).Where("agent_id = ?", agentID).Count(&reviews).Error; err != nil {
+			return nil, err
+		}
+		if reviews > 0 {
+			if err := s.RebuildSummary(agentID); err != nil {
+				return nil, err
+			}
+			err = s.db.Where("agent_id = ?", agentID).First(&summary).Error
+		} else {
+			summary.AgentID = agentID
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReviewSummaryResult{
+		AgentID: agentID,
+		Count:   summary.ReviewCount,
+		Distribution: map[int]int{
+			1: summary.OneStar,
+			2: summary.TwoStar,
+			3: summary.ThreeStar,
+			4: summary.FourStar,
+			5: summary.FiveStar,
+		},
+		Trend: "flat",
+	}
+	if summary.ReviewCount > 0 {
+		result.Average = float64(summary.RatingSum) / float64(summary.ReviewCount)
+		result.VerifiedPurchaseRatio = float64(summary.VerifiedCount) / float64(summary.ReviewCount)
+	}
+
+	// The last period includes today's bucket
+	periodEnd := time.Now().UTC().Truncate(reviewBucket).Add(reviewBucket)
+	periodStart := periodEnd.Add(-trendDays * reviewBucket)
+	if result.Last30Days, err = s.trendPeriod(agentID, periodStart, periodEnd); err != nil {
+		return nil, err
+	}
+	if result.Previous30Days, err = s.trendPeriod(agentID, periodStart.Add(-trendDays*reviewBucket), periodStart); err != nil {
+		return nil, err
+	}
+	switch {
+	case result.Last30Days.Count == 0 || result.Previous30Days.Count == 0:
+	case result.Last30Days.Average > result.Previous30Days.Average:
+		result.Trend = "up"
+	case result.Last30Days.Average < result.Previous30Days.Average:
+		result.Trend = "down"
+	}
+
+	return result, nil
+}
+
+// trendPeriod sums the daily buckets in [from, to)
+func (s *ReviewService) trendPeriod(agentID uuid.UUID, from, to time.Time) (ReviewTrendPeriod, error) {
+	var totals struct {
+		Count     int
+		RatingSum int
+	}
+	if err := s.db.Model(&models.ReviewDailyStat{}).
+		Where("agent_id = ? AND day >= ? AND day < ?", agentID, from, to).
+		Select("COALESCE(SUM(review_count), 0) AS count, COALESCE(SUM(rating_sum), 0) AS rating_sum").
+		Scan(&totals).Error; err != nil {
+		return ReviewTrendPeriod{}, err
+	}
+
+	period := ReviewTrendPeriod{Count: totals.Count}
+	if totals.Count > 0 {
+		period.Average = float64(totals.RatingSum) / float64(totals.Count)
+	}
+	return period, nil
+}
@@ -0,0 +1,257 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrAttachmentTooLarge is returned for a review attachment over the
+	// configured size
+	ErrAttachmentTooLarge = errors.New("attachment is too large")
+	// ErrAttachmentType is returned for a review attachment whose content
+	// is not of an allowed type
+	ErrAttachmentType = errors.New("attachment type is not allowed")
+	// ErrTooManyAttachments is returned when a review already has the
+	// configured number of attachments
+	ErrTooManyAttachments = errors.New("review has too many attachments")
+	// ErrInvalidVisibility is returned for an unknown attachment visibility
+	ErrInvalidVisibility = errors.New("visibility must be public or publisher")
+)
+
+// AttachmentViewer is who review attachments are served to. A nil UserID is
+// an anonymous visitor.
+type AttachmentViewer struct {
+	UserID *uuid.UUID
+	Admin  bool
+}
+
+// ReviewAttachmentService stores the files attached to reviews and decides
+// who can retrieve them. Attachments are scanned by the ScanService before
+// they are served; files found infected are deleted from storage.
+type ReviewAttachmentService struct {
+	db       *gorm.DB
+	storage  Storage
+	cfg      config.ReviewAttachmentsConfig
+	scanning bool
+}
+
+// NewReviewAttachmentService creates a new review attachment service.
+// Without scanning, attachments are served as soon as they are uploaded.
+func NewReviewAttachmentService(db *gorm.DB, storage Storage, cfg config.ReviewAttachmentsConfig, scanning bool) *ReviewAttachmentService {
+	return &ReviewAttachmentService{db: db, storage: storage, cfg: cfg, scanning: scanning}
+}
+
+// Upload validates and stores a file attached by a reviewer to their own
+// review. It returns gorm.ErrRecordNotFound if the review is not theirs.
+func (s *ReviewAttachmentService) Upload(ctx context.Context, reviewID, userID uuid.UUID, fileName string, visibility models.AttachmentVisibility, upload FileUpload) (*models.ReviewAttachment, error) {
+	if visibility == "" {
+		visibility = models.AttachmentVisibilityPublic
+	}
+	if !validVisibility(visibility) {
+		return nil, ErrInvalidVisibility
+	}
+	if upload.Size > s.cfg.MaxSize {
+		return nil, ErrAttachmentTooLarge
+	}
+
+	var review models.Review
+	if err := s.db.Select("id").Where("id = ? AND user_id = ?", reviewID, userID).First(&review).Error; err != nil {
+		return nil, err
+	}
+	var count int64
+	if err := s.db.Model(&models.ReviewAttachment{}).Where("review_id = ?", reviewID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count >= int64(s.cfg.MaxPerReview) {
+		return nil, ErrTooManyAttachments
+	}
+
+	data, err := io.ReadAll(io.LimitReader(upload.Body, s.cfg.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.cfg.MaxSize {
+		return nil, ErrAttachmentTooLarge
+	}
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil || !s.allowedType(contentType) {
+		return nil, ErrAttachmentType
+	}
+
+	sum := sha256.Sum256(data)
+	attachment := models.ReviewAttachment{
+		ID:          models.NewID(),
+		ReviewID:    reviewID,
+		FileName:    attachmentName(fileName),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Checksum:    hex.EncodeToString(sum[:]),
+		Visibility:  visibility,
+		ScanStatus:  models.ScanStatusPending,
+	}
+	if !s.scanning {
+		attachment.ScanStatus = models.ScanStatusSkipped
+	}
+
+	key := attachmentKey(&attachment)
+	if _, err := s.storage.Put(ctx, key, bytes.NewReader(data), attachment.Size, contentType); err != nil {
+		return nil, err
+	}
+	if err := s.db.Create(&attachment).Error; err != nil {
+		if deleteErr := s.storage.Delete(ctx, key); deleteErr != nil {
+			log.Warn().Err(deleteErr).Str("key", key).Msg("Failed to delete unrecorded attachment")
+		}
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+// SetVisibility changes who can retrieve an attachment. Reviewers can
+// change their own attachments and admins any.
+func (s *ReviewAttachmentService) SetVisibility(reviewID, attachmentID uuid.UUID, viewer AttachmentViewer, visibility models.AttachmentVisibility) (*models.ReviewAttachment, error) {
+	if !validVisibility(visibility) {
+		return nil, ErrInvalidVisibility
+	}
+	attachment, err := s.editable(reviewID, attachmentID, viewer)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(attachment).Update("visibility", visibility).Error; err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// Delete removes an attachment and its file. Reviewers can delete their
+// own attachments and admins any.
+func (s *ReviewAttachmentService) Delete(ctx context.Context, reviewID, attachmentID uuid.UUID, viewer AttachmentViewer) error {
+	attachment, err := s.editable(reviewID, attachmentID, viewer)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Delete(attachment).Error; err != nil {
+		return err
+	}
+	if err := s.storage.Delete(ctx, attachmentKey(attachment)); err != nil && err != ErrObjectNotFound {
+		log.Warn().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Failed to delete attachment file")
+	}
+	return nil
+}
+
+// DeleteFiles removes the files of attachments whose rows are already
+// gone, e.g. those of a deleted review. Failures are only logged.
+func (s *ReviewAttachmentService) DeleteFiles(ctx context.Context, attachments []models.ReviewAttachment) {
+	for i := range attachments {
+		if err := s.storage.Delete(ctx, attachmentKey(&attachments[i])); err != nil && err != ErrObjectNotFound {
+			log.Warn().Err(err).Str("attachment_id", attachments[i].ID.String()).Msg("Failed to delete attachment file")
+		}
+	}
+}
+
+// Attach sets the attachments of reviews of one agent, published by
+// publisherID, that the viewer can see, with a retrieval URL on those that passed the scan. Public ones are
+// shown to everyone; the others only to the reviewer, the agent's
+// publisher and admins. Reviewers also see their own attachments that are
+// still being scanned or failed.
+func (s *ReviewAttachmentService) Attach(ctx context.Context, publisherID uuid.UUID, reviews []models.Review, viewer AttachmentViewer) error {
+	if len(reviews) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(reviews))
+	for i := range reviews {
+		ids[i] = reviews[i].ID
+	}
+	var attachments []models.ReviewAttachment
+	if err := s.db.Where("review_id IN ?", ids).Order("created_at").Find(&attachments).Error; err != nil {
+		return err
+	}
+
+	privileged := viewer.Admin || (viewer.UserID != nil && *viewer.UserID == publisherID)
+	byReview := make(map[uuid.UUID][]models.ReviewAttachment, len(reviews))
+	authors := make(map[uuid.UUID]uuid.UUID, len(reviews))
+	for i := range reviews {
+		authors[reviews[i].ID] = reviews[i].UserID
+	}
+	for _, attachment := range attachments {
+		author := viewer.UserID != nil && *viewer.UserID == authors[attachment.ReviewID]
+		servable := attachment.ScanStatus == models.ScanStatusPassed || attachment.ScanStatus == models.ScanStatusSkipped
+		if !author && (!servable || (attachment.Visibility != models.AttachmentVisibilityPublic && !privileged)) {
+			continue
+		}
+		if servable {
+			url, err := s.storage.PresignedURL(ctx, attachmentKey(&attachment), s.cfg.URLExpiry)
+			if err != nil {
+				return err
+			}
+			attachment.URL = url
+		}
+		byReview[attachment.ReviewID] = append(byReview[attachment.ReviewID], attachment)
+	}
+	for i := range reviews {
+		reviews[i].Attachments = byReview[reviews[i].ID]
+	}
+	return nil
+}
+
+// editable loads an attachment the viewer may change
+func (s *ReviewAttachmentService) editable(reviewID, attachmentID uuid.UUID, viewer AttachmentViewer) (*models.ReviewAttachment, error) {
+	var attachment models.ReviewAttachment
+	query := s.db.Model(&models.ReviewAttachment{}).
+		Where("review_attachments.id = ? AND review_attachments.review_id = ?", attachmentID, reviewID)
+	if !viewer.Admin {
+		if viewer.UserID == nil {
+			return nil, gorm.ErrRecordNotFound
+		}
+		query = query.Joins("JOIN reviews ON reviews.id = review_attachments.review_id").
+			Where("reviews.user_id = ?", *viewer.UserID)
+	}
+	if err := query.Select("review_attachments.*").First(&attachment).Error; err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+func (s *ReviewAttachmentService) allowedType(contentType string) bool {
+	for _, allowed := range s.cfg.ContentTypes {
+		if contentType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func validVisibility(visibility models.AttachmentVisibility) bool {
+	return visibility == models.AttachmentVisibilityPublic || visibility == models.AttachmentVisibilityPublisher
+}
+
+func attachmentKey(attachment *models.ReviewAttachment) string {
+	return "reviews/" + attachment.ReviewID.String() + "/" + attachment.ID.String()
+}
+
+// attachmentName keeps the base of an uploaded file's name, for display
+func attachmentName(name string) string {
+	name = strings.TrimSpace(path.Base(strings.ReplaceAll(name, "\\", "/")))
+	if name == "" || name == "." || name == "/" {
+		name = "attachment"
+	}
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	return name
+}
@@ -0,0 +1,399 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// ErrInsightsDisabled is returned for agents whose publisher opted out of review insights
+var ErrInsightsDisabled = errors.New("review insights are disabled for this agent")
+
+// JobTypeReviewInsight is the job recomputing an agent's review insight
+const JobTypeReviewInsight = "review_insight.compute"
+
+type reviewInsightJob struct {
+	AgentID uuid.UUID `json:"agent_id"`
+}
+
+// ReviewInsightService summarizes what each agent's reviews mention and how
+// positive they are. Agents are recomputed by jobs after new reviews, so
+// reads never analyze text.
+type ReviewInsightService struct {
+	db    *gorm.DB
+	queue *JobQueue
+	cfg   config.ReviewInsightsConfig
+}
+
+// NewReviewInsightService creates a new review insight service and
+// registers the job recomputing insights
+func NewReviewInsightService(db *gorm.DB, queue *JobQueue, cfg config.ReviewInsightsConfig) *ReviewInsightService {
+	s := &ReviewInsightService{db: db, queue: queue, cfg: cfg}
+	// ProcessStale cleared the stale flag when queueing the job, so a job
+	// out of attempts sets it again for a later poll to retry
+	onDead := func(ctx context.Context, job Job) {
+		var payload reviewInsightJob
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return
+		}
+		if err := markInsightStale(s.db, payload.AgentID); err != nil {
+			log.Error().Err(err).Str("agent_id", payload.AgentID.String()).Msg("Failed to mark review insight stale")
+		}
+	}
+	queue.Register(JobTypeReviewInsight, JobOptions{OnDead: onDead}, func(ctx context.Context, payload json.RawMessage) error {
+		var job reviewInsightJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return PermanentJobError(err)
+		}
+		return s.Compute(job.AgentID)
+	})
+	return s
+}
+
+// GetInsight returns the latest computed insight of an agent
+func (s *ReviewInsightService) GetInsight(agentID uuid.UUID) (*models.ReviewInsight, error) {
+	var agent models.Agent
+	if err := s.db.Preload("Publisher").First(&agent, "id = ?", agentID).Error; err != nil {
+		return nil, err
+	}
+	if !s.cfg.Enabled || !agent.Publisher.ReviewInsightsEnabled {
+		return nil, ErrInsightsDisabled
+	}
+
+	var insight models.ReviewInsight
+	if err := s.db.First(&insight, "agent_id = ? AND computed_at IS NOT NULL", agentID).Error; err != nil {
+		return nil, err
+	}
+	return &insight, nil
+}
+
+// SetPublisherEnabled applies a publisher's review insights setting to
+// their agents: turning it off drops the stored insights, turning it on
+// queues the agents for computation
+func (s *ReviewInsightService) SetPublisherEnabled(publisherID uuid.UUID, enabled bool) error {
+	if !enabled {
+		return s.db.Where("agent_id IN (?)", s.db.Model(&models.Agent{}).Select("id").Where("publisher_id = ?", publisherID)).
+			Delete(&models.ReviewInsight{}).Error
+	}
+
+	var agentIDs []uuid.UUID
+	if err := s.db.Model(&models.Agent{}).Where("publisher_id = ?", publisherID).Pluck("id", &agentIDs).Error; err != nil {
+		return err
+	}
+	for _, id := range agentIDs {
+		if err := markInsightStale(s.db, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run queues stale insights for recomputation every poll interval until ctx
+// is done
+func (s *ReviewInsightService) Run(ctx context.Context) {
+	if !s.cfg.Enabled {
+		return
+	}
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.ProcessStale(ctx); err != nil {
+				log.Error().Err(err).Msg("Failed to queue review insights")
+			}
+		}
+	}
+}
+
+// ProcessStale queues a job recomputing each of a batch of insights marked
+// stale by new reviews. While the job queue is unavailable it recomputes
+// them directly.
+func (s *ReviewInsightService) ProcessStale(ctx context.Context) error {
+	var agentIDs []uuid.UUID
+	if err := s.db.Model(&models.ReviewInsight{}).
+		Where("stale = ?", true).
+		Limit(s.cfg.BatchSize).
+		Pluck("agent_id", &agentIDs).Error; err != nil {
+		return err
+	}
+
+	for _, id := range agentIDs {
+		// Clearing the flag keeps the next polls from queueing the agent
+		// again; a review arriving later, or the job running out of
+		// attempts, sets it again
+		cleared := s.db.Model(&models.ReviewInsight{}).Where("agent_id = ? AND stale = ?", id, true).Update("stale", false)
+		if cleared.Error != nil {
+			return cleared.Error
+		}
+		if cleared.RowsAffected == 0 {
+			continue
+		}
+
+		_, err := s.queue.Enqueue(ctx, JobTypeReviewInsight, reviewInsightJob{AgentID: id})
+		if err == nil {
+			continue
+		}
+		if err != ErrJobQueueUnavailable {
+			log.Warn().Err(err).Str("agent_id", id.String()).Msg("Failed to queue review insight, computing it directly")
+		}
+		if err := s.Compute(id); err != nil {
+			log.Error().Err(err).Str("agent_id", id.String()).Msg("Failed to compute review insight")
+			if err := markInsightStale(s.db, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Compute analyzes an agent's review comments and stores the result
+func (s *ReviewInsightService) Compute(agentID uuid.UUID) error {
+	var agent models.Agent
+	if err := s.db.Preload("Publisher").First(&agent, "id = ?", agentID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return s.db.Where("agent_id = ?", agentID).Delete(&models.ReviewInsight{}).Error
+		}
+		return err
+	}
+	if !agent.Publisher.ReviewInsightsEnabled {
+		return s.db.Where("agent_id = ?", agentID).Delete(&models.ReviewInsight{}).Error
+	}
+
+	// Clear the flag first, so a review arriving during the analysis marks
+	// the agent stale again rather than being lost
+	if err := s.db.Model(&models.ReviewInsight{}).Where("agent_id = ?", agentID).Update("stale", false).Error; err != nil {
+		return err
+	}
+
+	var comments []string
+	if err := s.db.Model(&models.Review{}).
+		Where("agent_id = ? AND comment <> ''", agentID).
+		Pluck("comment", &comments).Error; err != nil {
+		return err
+	}
+
+	analysis := analyzeReviews(comments, s.cfg.MaxKeywords, s.cfg.MinMentions)
+	now := time.Now()
+	return s.db.Model(&models.ReviewInsight{}).Where("agent_id = ?", agentID).Updates(map[string]interface{}{
+		"keywords":       models.Tags(analysis.keywords),
+		"sentiment":      analysis.sentiment,
+		"positive_count": analysis.positive,
+		"negative_count": analysis.negative,
+		"review_count":   len(comments),
+		"computed_at":    now,
+	}).Error
+}
+
+// markInsightStale queues an agent's review insight for recomputation
+func markInsightStale(tx *gorm.DB, agentID uuid.UUID) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "agent_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"stale": true}),
+	}).Create(&models.ReviewInsight{AgentID: agentID, Stale: true}).Error
+}
+
+// reviewAnalysis is the result of analyzing a set of review comments
+type reviewAnalysis struct {
+	keywords  []string
+	sentiment float64
+	positive  int
+	negative  int
+}
+
+// analyzeReviews finds the phrases mentioned by at least minMentions
+// reviews, preferring two-word phrases such as "easy setup", and scores
+// each review's sentiment against a small word list
+func analyzeReviews(comments []string, maxKeywords, minMentions int) reviewAnalysis {
+	var result reviewAnalysis
+	mentions := make(map[string]int)
+	var total float64
+
+	for _, comment := range comments {
+		words := reviewWords(comment)
+
+		score := reviewSentiment(words)
+		total += score
+		switch {
+		case score > 0:
+			result.positive++
+		case score < 0:
+			result.negative++
+		}
+
+		for phrase := range reviewPhrases(words) {
+			mentions[phrase]++
+		}
+	}
+	if len(comments) > 0 {
+		result.sentiment = math.Round(total/float64(len(comments))*100) / 100
+	}
+
+	var candidates []string
+	for phrase, n := range mentions {
+		if n >= minMentions {
+			candidates = append(candidates, phrase)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if mentions[a] != mentions[b] {
+			return mentions[a] > mentions[b]
+		}
+		if pa, pb := strings.Contains(a, " "), strings.Contains(b, " "); pa != pb {
+			return pa
+		}
+		return a < b
+	})
+
+	for _, phrase := range candidates {
+		if len(result.keywords) == maxKeywords {
+			break
+		}
+		covered := false
+		for _, kept := range result.keywords {
+			if strings.Contains(" "+kept+" ", " "+phrase+" ") {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result.keywords = append(result.keywords, phrase)
+		}
+	}
+	return result
+}
+
+// reviewWords splits a comment into lower-case words, keeping apostrophes
+// so that negations like "doesn't" stay whole
+func reviewWords(comment string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(comment), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'' && r != '’'
+	})
+	words := fields[:0]
+	for _, f := range fields {
+		f = strings.Trim(strings.ReplaceAll(f, "’", "'"), "'")
+		if f != "" {
+			words = append(words, f)
+		}
+	}
+	return words
+}
+
+// reviewSentiment scores words from -1 (only negative terms) to 1 (only
+// positive terms). A negation flips the next few words.
+func reviewSentiment(words []string) float64 {
+	const negationWindow = 3
+
+	positive, negative := 0, 0
+	negated := 0
+	for _, w := range words {
+		if negationWords[w] {
+			negated = negationWindow
+			continue
+		}
+		polarity := 0
+		switch {
+		case positiveWords[w]:
+			polarity = 1
+		case negativeWords[w]:
+			polarity = -1
+		}
+		if negated > 0 {
+			polarity = -polarity
+			negated--
+		}
+		switch polarity {
+		case 1:
+			positive++
+		case -1:
+			negative++
+		}
+	}
+	if positive+negative == 0 {
+		return 0
+	}
+	return float64(positive-negative) / float64(positive+negative)
+}
+
+// reviewPhrases returns the distinct keyword candidates of a comment: pairs
+// of adjacent content words and single content words of four letters or more
+func reviewPhrases(words []string) map[string]bool {
+	phrases := make(map[string]bool)
+	for i, w := range words {
+		if !contentWord(w) {
+			continue
+		}
+		if len(w) >= 4 && !positiveWords[w] && !negativeWords[w] {
+			phrases[w] = true
+		}
+		if i+1 < len(words) && contentWord(words[i+1]) {
+			phrases[w+" "+words[i+1]] = true
+		}
+	}
+	return phrases
+}
+
+// contentWord reports whether a word can be part of a keyword
+func contentWord(w string) bool {
+	if len(w) < 2 || stopWords[w] || negationWords[w] {
+		return false
+	}
+	return strings.IndexFunc(w, unicode.IsLetter) >= 0
+}
+
+func wordSet(words ...string) map[string]bool {
+	set := make(map[string]bool, len(words))
+	for _, w := range words {
+		set[w] = true
+	}
+	return set
+}
+
+var negationWords = wordSet(
+	"not", "no", "never", "without", "hardly", "barely",
+	"don't", "doesn't", "didn't", "isn't", "wasn't", "aren't", "can't", "cannot", "won't", "wouldn't",
+)
+
+var positiveWords = wordSet(
+	"good", "great", "excellent", "easy", "accurate", "reliable", "fast", "quick", "love", "loved",
+	"perfect", "stable", "solid", "helpful", "simple", "smooth", "impressive", "efficient", "recommend",
+	"robust", "intuitive", "clear", "awesome", "nice", "precise", "useful", "best", "amazing", "flawless",
+	"works", "worked", "responsive", "lightweight", "well",
+)
+
+var negativeWords = wordSet(
+	"bad", "poor", "slow", "buggy", "bug", "bugs", "crash", "crashes", "crashed", "broken", "difficult",
+	"hard", "confusing", "unreliable", "inaccurate", "useless", "terrible", "awful", "fails", "failed",
+	"failure", "issue", "issues", "problem", "problems", "worse", "worst", "laggy", "unstable",
+	"expensive", "disappointing", "disappointed", "hate", "error", "errors", "freezes", "noisy",
+)
+
+var stopWords = wordSet(
+	"a", "an", "the", "and", "or", "but", "if", "then", "so", "of", "to", "in", "on", "at", "by", "for",
+	"with", "from", "as", "is", "are", "was", "were", "be", "been", "being", "am", "it", "its", "it's",
+	"this", "that", "these", "those", "i", "i'm", "i've", "me", "my", "we", "our", "you", "your", "they",
+	"them", "their", "he", "she", "his", "her", "has", "have", "had", "do", "does", "did", "will",
+	"would", "can", "could", "should", "just", "very", "really", "also", "too", "all", "any", "some",
+	"more", "most", "much", "many", "than", "out", "up", "down", "about", "after", "before", "into",
+	"over", "again", "only", "what", "which", "who", "when", "where", "how", "there", "here", "one",
+	"agent", "agents", "product", "thing", "things", "use", "used", "using", "get", "got", "bit", "lot",
+	"even", "still", "yet", "other", "like", "make", "made", "now", "need", "needs",
+)
@@ -0,0 +1,294 @@
+package services
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrInvalidRollout is returned for a rollout without an audience or
+	// with a malformed percentage or region
+	ErrInvalidRollout = errors.New("rollout needs a percentage from 1 to 99 or at least one two-letter country code")
+	// ErrRolloutInProgress is returned when staging a release while another
+	// release of the agent is staged
+	ErrRolloutInProgress = errors.New("another version of this agent is being rolled out")
+	// ErrNoStableVersion is returned when staging a release of an agent that
+	// has no published version for the rest of the audience
+	ErrNoStableVersion = errors.New("publish a first version before rolling out later ones")
+	// ErrVersionNotStaged is returned when promoting or halting a release
+	// that is not being rolled out
+	ErrVersionNotStaged = errors.New("version is not being rolled out")
+)
+
+// RolloutReport is what a publisher watches during a rollout: how the
+// staged release is received compared with the current version
+type RolloutReport struct {
+	Release *models.AgentVersion `json:"release"`
+	Staged  ReleaseHealth        `json:"staged"`
+	Current ReleaseHealth        `json:"current"`
+}
+
+// ReleaseHealth is how one release fared since a rollout started. Check-ins
+// are counted per device and day.
+type ReleaseHealth struct {
+	Version           string  `json:"version"`
+	ReviewCount       int64   `json:"review_count"`
+	AverageRating     float64 `json:"average_rating"`
+	ActiveDeployments int64   `json:"active_deployments"`
+	CheckIns          int64   `json:"check_ins"`
+}
+
+// StageVersion serves a draft release to part of the audience: users whose
+// bucket falls within percent, and users in one of regions. Calling it
+// again on the staged release changes its audience.
+func (s *AgentService) StageVersion(agent *models.Agent, release *models.AgentVersion, percent int, regions []string) error {
+	if release.Status != models.AgentVersionStatusDraft && release.Status != models.AgentVersionStatusStaged {
+		return ErrVersionNotPublished
+	}
+
+	normalized := make(models.Tags, 0, len(regions))
+	for _, region := range regions {
+		region = strings.ToUpper(strings.TrimSpace(region))
+		if len(region) != 2 || strings.IndexFunc(region, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+			return ErrInvalidRollout
+		}
+		normalized = append(normalized, region)
+	}
+	if percent < 0 || percent > 99 || (percent == 0 && len(normalized) == 0) {
+		return ErrInvalidRollout
+	}
+	if err := s.checkPublishable(release); err != nil {
+		return err
+	}
+
+	current, err := s.GetVersion(agent.ID, agent.Version)
+	if err == gorm.ErrRecordNotFound || (err == nil && current.Status != models.AgentVersionStatusPublished) {
+		return ErrNoStableVersion
+	}
+	if err != nil {
+		return err
+	}
+
+	var staged int64
+	if err := s.db.Model(&models.AgentVersion{}).
+		Where("agent_id = ? AND status = ? AND id <> ?", agent.ID, models.AgentVersionStatusStaged, release.ID).
+		Count(&staged).Error; err != nil {
+		return err
+	}
+	if staged > 0 {
+		return ErrRolloutInProgress
+	}
+
+	updates := map[string]interface{}{
+		"status":          models.AgentVersionStatusStaged,
+		"rollout_percent": percent,
+		"rollout_regions": normalized,
+	}
+	wave := *release
+	if release.StagedAt == nil {
+		now := time.Now()
+		updates["staged_at"] = &now
+		release.StagedAt = &now
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(release).Updates(updates).Error; err != nil {
+			return err
+		}
+		// Changing the audience of a staged release ends its current wave
+		if wave.Status != models.AgentVersionStatusStaged {
+			return nil
+		}
+		return emitWaveCompleted(tx, agent.PublisherID, &wave, map[string]interface{}{
+			"percent": percent,
+			"regions": normalized,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	release.Status = models.AgentVersionStatusStaged
+	release.RolloutPercent = percent
+	release.RolloutRegions = normalized
+	return nil
+}
+
+// HaltRollout stops serving a staged release and returns it to draft.
+// Users who already deployed it keep it.
+func (s *AgentService) HaltRollout(release *models.AgentVersion) error {
+	if release.Status != models.AgentVersionStatusStaged {
+		return ErrVersionNotStaged
+	}
+	if err := unstageVersions(s.db, release.AgentID); err != nil {
+		return err
+	}
+	release.Status = models.AgentVersionStatusDraft
+	release.RolloutPercent = 0
+	release.RolloutRegions = nil
+	release.StagedAt = nil
+	return nil
+}
+
+// PromoteVersion publishes a staged release to everyone, completing its
+// last rollout wave
+func (s *AgentService) PromoteVersion(release *models.AgentVersion) error {
+	if release.Status != models.AgentVersionStatusStaged {
+		return ErrVersionNotStaged
+	}
+	wave := *release
+	if err := s.PublishVersion(release); err != nil {
+		return err
+	}
+
+	var agent models.Agent
+	if err := s.db.Select("id", "publisher_id").First(&agent, "id = ?", release.AgentID).Error; err != nil {
+		return err
+	}
+	if err := emitWaveCompleted(s.db, agent.PublisherID, &wave, nil); err != nil {
+		log.Error().Err(err).Str("agent_id", release.AgentID.String()).Msg("Failed to queue rollout webhook")
+	}
+	return nil
+}
+
+// emitWaveCompleted queues rollout.wave_completed for the publisher of a
+// staged release, with the audience of the wave that ended and the next
+// one, or none when the release was promoted to everyone
+func emitWaveCompleted(tx *gorm.DB, publisherID uuid.UUID, wave *models.AgentVersion, next map[string]interface{}) error {
+	var deployments int64
+	if err := tx.Model(&models.Deployment{}).
+		Where("agent_id = ? AND version = ? AND decommissioned_at IS NULL", wave.AgentID, wave.Version).
+		Count(&deployments).Error; err != nil {
+		return err
+	}
+
+	regions := wave.RolloutRegions
+	if regions == nil {
+		regions = models.Tags{}
+	}
+	return emitEvent(tx, publisherID, models.WebhookEventRolloutWaveCompleted, map[string]interface{}{
+		"agent_id":           wave.AgentID,
+		"version":            wave.Version,
+		"wave":               map[string]interface{}{"percent": wave.RolloutPercent, "regions": regions, "staged_at": wave.StagedAt},
+		"next":               next,
+		"promoted":           next == nil,
+		"active_deployments": deployments,
+	})
+}
+
+// ResolveVersion returns the release of an agent a user is served: the
+// staged release when the user is in its audience, the current version
+// otherwise. country is the user's ISO country code, if known.
+func (s *AgentService) ResolveVersion(agent *models.Agent, userID uuid.UUID, country string) (*models.AgentVersion, error) {
+	return resolveRelease(s.db, agent, userID, country)
+}
+
+// GetRolloutReport compares the reviews and deployments of a staged release
+// with those of the agent's current version since the rollout started
+func (s *AgentService) GetRolloutReport(agent *models.Agent, release *models.AgentVersion) (*RolloutReport, error) {
+	if release.Status != models.AgentVersionStatusStaged || release.StagedAt == nil {
+		return nil, ErrVersionNotStaged
+	}
+
+	staged, err := s.releaseHealth(agent.ID, release.Version, *release.StagedAt)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.releaseHealth(agent.ID, agent.Version, *release.StagedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &RolloutReport{Release: release, Staged: *staged, Current: *current}, nil
+}
+
+// releaseHealth sums up the reviews and check-ins of one release since a time
+func (s *AgentService) releaseHealth(agentID uuid.UUID, version string, since time.Time) (*ReleaseHealth, error) {
+	health := &ReleaseHealth{Version: version}
+
+	var reviews struct {
+		Count   int64
+		Average float64
+	}
+	if err := s.db.Model(&models.Review{}).
+		Select("COUNT(*) AS count, COALESCE(AVG(rating), 0) AS average").
+		Where("agent_id = ? AND version = ? AND created_at >= ?", agentID, version, since).
+		Scan(&reviews).Error; err != nil {
+		return nil, err
+	}
+	health.ReviewCount = reviews.Count
+	health.AverageRating = math.Round(reviews.Average*100) / 100
+
+	if err := s.db.Model(&models.Deployment{}).
+		Where("agent_id = ? AND version = ? AND decommissioned_at IS NULL", agentID, version).
+		Count(&health.ActiveDeployments).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&models.DeploymentUsage{}).
+		Joins("JOIN deployments ON deployments.id = deployment_usages.deployment_id").
+		Where("deployments.agent_id = ? AND deployments.version = ? AND deployment_usages.day >= ?",
+			agentID, version, since.UTC().Truncate(24*time.Hour)).
+		Select("COALESCE(SUM(deployment_usages.check_ins), 0)").
+		Scan(&health.CheckIns).Error; err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+// resolveRelease implements ResolveVersion for services that deploy releases
+func resolveRelease(db *gorm.DB, agent *models.Agent, userID uuid.UUID, country string) (*models.AgentVersion, error) {
+	var staged models.AgentVersion
+	err := db.Where("agent_id = ? AND status = ?", agent.ID, models.AgentVersionStatusStaged).First(&staged).Error
+	switch {
+	case err == nil:
+		if inRollout(&staged, userID, country) {
+			return &staged, nil
+		}
+	case err != gorm.ErrRecordNotFound:
+		return nil, err
+	}
+
+	var current models.AgentVersion
+	if err := db.Where("agent_id = ? AND version = ?", agent.ID, agent.Version).First(&current).Error; err != nil {
+		return nil, err
+	}
+	return &current, nil
+}
+
+// inRollout reports whether a user is in a staged release's audience. Users
+// keep their bucket for the whole rollout, so widening the percentage only
+// adds users.
+func inRollout(release *models.AgentVersion, userID uuid.UUID, country string) bool {
+	for _, region := range release.RolloutRegions {
+		if country != "" && strings.EqualFold(region, country) {
+			return true
+		}
+	}
+	if userID == uuid.Nil || release.RolloutPercent == 0 {
+		return false
+	}
+
+	h := fnv.New32a()
+	h.Write(release.ID[:])
+	h.Write(userID[:])
+	return int(h.Sum32()%100) < release.RolloutPercent
+}
+
+// unstageVersions returns an agent's staged release, if any, to draft
+func unstageVersions(tx *gorm.DB, agentID uuid.UUID) error {
+	return tx.Model(&models.AgentVersion{}).
+		Where("agent_id = ? AND status = ?", agentID, models.AgentVersionStatusStaged).
+		Updates(map[string]interface{}{
+			"status":          models.AgentVersionStatusDraft,
+			"rollout_percent": 0,
+			"rollout_regions": models.Tags(nil),
+			"staged_at":       nil,
+		}).Error
+}
@@ -0,0 +1,524 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// clamdChunkSize is the size of the chunks a binary is streamed to clamd in
+const clamdChunkSize = 64 << 10
+
+var (
+	// ErrScanPending is returned when publishing a release whose binary has
+	// not been scanned yet
+	ErrScanPending = errors.New("the binary is still being scanned for malware")
+	// ErrScanFailed is returned when publishing a release whose binary
+	// failed a scan
+	ErrScanFailed = errors.New("the binary failed the malware scan; upload a new binary")
+)
+
+// Scanner inspects an uploaded binary. It returns what it found, nothing
+// for a clean binary, or an error if it could not reach a verdict, in
+// which case the scan is retried.
+type Scanner interface {
+	Name() string
+	Scan(ctx context.Context, r io.Reader) ([]string, error)
+}
+
+// scanners are the scanners that can be enabled in the configuration, by name
+var scanners = map[string]func(cfg config.ScanningConfig) Scanner{
+	"clamav": func(cfg config.ScanningConfig) Scanner { return &clamAVScanner{cfg: cfg.ClamAV} },
+}
+
+// Job types scanning uploaded files
+const (
+	// JobTypeScanRelease is the job scanning a release's binary
+	JobTypeScanRelease = "scan.release"
+	// JobTypeScanAttachment is the job scanning a review attachment
+	JobTypeScanAttachment = "scan.attachment"
+)
+
+type scanReleaseJob struct {
+	ReleaseID uuid.UUID `json:"release_id"`
+}
+
+type scanAttachmentJob struct {
+	AttachmentID uuid.UUID `json:"attachment_id"`
+}
+
+// ScanService scans the binaries of draft releases in the background. A
+// release can only be published once its binary passed every scanner; an
+// agent submitted for publishing in the meantime waits in pending.
+type ScanService struct {
+	db       *gorm.DB
+	storage  Storage
+	agents   *AgentService
+	queue    *JobQueue
+	cfg      config.ScanningConfig
+	scanners []Scanner
+}
+
+// NewScanService creates a new scan service with the configured scanners
+// and registers the jobs scanning releases and review attachments
+func NewScanService(db *gorm.DB, storage Storage, agents *AgentService, queue *JobQueue, cfg config.ScanningConfig) (*ScanService, error) {
+	s := &ScanService{db: db, storage: storage, agents: agents, queue: queue, cfg: cfg}
+	for _, name := range cfg.Scanners {
+		factory, ok := scanners[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown scanner %q", name)
+		}
+		s.scanners = append(s.scanners, factory(cfg))
+	}
+	queue.Register(JobTypeScanRelease, JobOptions{Timeout: s.scanTimeout()}, s.runReleaseScan)
+	queue.Register(JobTypeScanAttachment, JobOptions{Timeout: s.scanTimeout()}, s.runAttachmentScan)
+	return s, nil
+}
+
+// Run queues scans of due binaries and attachments until ctx is cancelled
+func (s *ScanService) Run(ctx context.Context) {
+	if !s.cfg.Enabled {
+		return
+	}
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.ScanDue(ctx); err != nil {
+				log.Error().Err(err).Msg("Failed to queue binary scans")
+			}
+			if _, err := s.ScanDueAttachments(ctx); err != nil {
+				log.Error().Err(err).Msg("Failed to queue review attachment scans")
+			}
+		}
+	}
+}
+
+// ScanDue claims a batch of draft releases whose binary is waiting for a
+// scan and queues a job scanning each. While the job queue is unavailable
+// it scans them directly. It returns the number claimed.
+func (s *ScanService) ScanDue(ctx context.Context) (int, error) {
+	now := time.Now()
+	var due []models.AgentVersion
+	if err := s.db.Where("status = ? AND scan_status = ? AND binary_checksum <> '' AND (scan_after IS NULL OR scan_after <= ?)",
+		models.AgentVersionStatusDraft, models.ScanStatusPending, now).
+		Order("created_at").
+		Limit(s.cfg.BatchSize).
+		Find(&due).Error; err != nil {
+		return 0, err
+	}
+
+	claimed := 0
+	for i := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		release := &due[i]
+		// The claim keeps the next polls from queueing the release again
+		// until its job had time to run
+		claim := s.db.Model(&models.AgentVersion{}).
+			Where("id = ? AND binary_checksum = ? AND scan_status = ? AND (scan_after IS NULL OR scan_after <= ?)",
+				release.ID, release.BinaryChecksum, models.ScanStatusPending, now).
+			Update("scan_after", now.Add(s.scanTimeout()))
+		if claim.Error != nil {
+			log.Error().Err(claim.Error).Str("release_id", release.ID.String()).Msg("Failed to claim binary scan")
+			continue
+		}
+		if claim.RowsAffected == 0 {
+			continue
+		}
+		claimed++
+
+		_, err := s.queue.Enqueue(ctx, JobTypeScanRelease, scanReleaseJob{ReleaseID: release.ID})
+		if err == nil {
+			continue
+		}
+		if err != ErrJobQueueUnavailable {
+			log.Warn().Err(err).Str("release_id", release.ID.String()).Msg("Failed to queue binary scan, scanning directly")
+		}
+		if err := s.scan(ctx, release); err != nil {
+			log.Error().Err(err).Str("release_id", release.ID.String()).Msg("Failed to record binary scan")
+		}
+	}
+	return claimed, nil
+}
+
+// scanTimeout is how long scanning one file may take with every scanner
+func (s *ScanService) scanTimeout() time.Duration {
+	return time.Duration(len(s.scanners)+1) * s.cfg.Timeout
+}
+
+// runReleaseScan runs the job scanning a release's binary
+func (s *ScanService) runReleaseScan(ctx context.Context, payload json.RawMessage) error {
+	var job scanReleaseJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return PermanentJobError(err)
+	}
+	var release models.AgentVersion
+	if err := s.db.First(&release, "id = ? AND scan_status = ?", job.ReleaseID, models.ScanStatusPending).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			// Deleted, or already scanned by a job queued twice
+			return nil
+		}
+		return err
+	}
+	return s.scan(ctx, &release)
+}
+
+// scan runs every scanner over a release's binary and records the result.
+// Scanner errors are recorded on the release, which is scanned again after
+// a backoff. A binary replaced or scanned elsewhere meanwhile is left
+// alone.
+func (s *ScanService) scan(ctx context.Context, release *models.AgentVersion) error {
+	report := models.ScanReport{Checksum: release.BinaryChecksum}
+	if release.ScanReport != nil && release.ScanReport.Checksum == release.BinaryChecksum {
+		report.Attempts = release.ScanReport.Attempts
+	}
+	report.Attempts++
+
+	current := s.db.Model(&models.AgentVersion{}).Where("id = ? AND binary_checksum = ? AND scan_status = ?",
+		release.ID, release.BinaryChecksum, models.ScanStatusPending)
+	results, err := s.runScanners(ctx, binaryKey(release))
+	if err != nil {
+		report.LastError = err.Error()
+		log.Warn().Err(err).Str("release_id", release.ID.String()).Int("attempts", report.Attempts).Msg("Binary scan failed, retrying")
+		return current.Updates(map[string]interface{}{
+			"scan_report": report,
+			"scan_after":  time.Now().Add(retryBackoff(s.cfg.RetryBackoff, report.Attempts-1)),
+		}).Error
+	}
+
+	completedAt := time.Now()
+	report.Results = results
+	report.CompletedAt = &completedAt
+	status := models.ScanStatusPassed
+	for _, result := range results {
+		if result.Verdict == models.ScanVerdictInfected {
+			status = models.ScanStatusFailed
+		}
+	}
+	updated := current.Updates(map[string]interface{}{
+		"scan_status": status,
+		"scan_report": report,
+		"scan_after":  nil,
+	})
+	if updated.Error != nil {
+		return updated.Error
+	}
+	if updated.RowsAffected == 0 {
+		return nil
+	}
+
+	log.Info().Str("release_id", release.ID.String()).Str("status", string(status)).Msg("Binary scanned")
+	return s.settle(release, status)
+}
+
+// runScanners runs each scanner over a fresh read of the object stored
+// under key
+func (s *ScanService) runScanners(ctx context.Context, key string) ([]models.ScanResult, error) {
+	results := make([]models.ScanResult, 0, len(s.scanners))
+	for _, scanner := range s.scanners {
+		started := time.Now()
+		findings, err := s.runScanner(ctx, scanner, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", scanner.Name(), err)
+		}
+		verdict := models.ScanVerdictClean
+		if len(findings) > 0 {
+			verdict = models.ScanVerdictInfected
+		}
+		results = append(results, models.ScanResult{
+			Scanner:   scanner.Name(),
+			Verdict:   verdict,
+			Findings:  findings,
+			Duration:  time.Since(started).Round(time.Millisecond).String(),
+			ScannedAt: time.Now(),
+		})
+	}
+	return results, nil
+}
+
+func (s *ScanService) runScanner(ctx context.Context, scanner Scanner, key string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	body, err := s.storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return scanner.Scan(ctx, body)
+}
+
+// ScanDueAttachments claims a batch of review attachments waiting for a
+// scan and queues a job scanning each. While the job queue is unavailable
+// it scans them directly. It returns the number claimed.
+func (s *ScanService) ScanDueAttachments(ctx context.Context) (int, error) {
+	now := time.Now()
+	var due []models.ReviewAttachment
+	if err := s.db.Where("scan_status = ? AND (scan_after IS NULL OR scan_after <= ?)", models.ScanStatusPending, now).
+		Order("created_at").
+		Limit(s.cfg.BatchSize).
+		Find(&due).Error; err != nil {
+		return 0, err
+	}
+
+	claimed := 0
+	for i := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		attachment := &due[i]
+		claim := s.db.Model(&models.ReviewAttachment{}).
+			Where("id = ? AND scan_status = ? AND (scan_after IS NULL OR scan_after <= ?)", attachment.ID, models.ScanStatusPending, now).
+			Update("scan_after", now.Add(s.scanTimeout()))
+		if claim.Error != nil {
+			log.Error().Err(claim.Error).Str("attachment_id", attachment.ID.String()).Msg("Failed to claim attachment scan")
+			continue
+		}
+		if claim.RowsAffected == 0 {
+			continue
+		}
+		claimed++
+
+		_, err := s.queue.Enqueue(ctx, JobTypeScanAttachment, scanAttachmentJob{AttachmentID: attachment.ID})
+		if err == nil {
+			continue
+		}
+		if err != ErrJobQueueUnavailable {
+			log.Warn().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Failed to queue attachment scan, scanning directly")
+		}
+		if err := s.scanAttachment(ctx, attachment); err != nil {
+			log.Error().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Failed to record attachment scan")
+		}
+	}
+	return claimed, nil
+}
+
+// runAttachmentScan runs the job scanning a review attachment
+func (s *ScanService) runAttachmentScan(ctx context.Context, payload json.RawMessage) error {
+	var job scanAttachmentJob
+	if err := json.Unmarshal(payload, &job); err != nil {
+		return PermanentJobError(err)
+	}
+	var attachment models.ReviewAttachment
+	if err := s.db.First(&attachment, "id = ? AND scan_status = ?", job.AttachmentID, models.ScanStatusPending).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+	return s.scanAttachment(ctx, &attachment)
+}
+
+// scanAttachment runs every scanner over a review attachment and records
+// the result. Infected files are deleted from storage; their record stays,
+// failed, so the reviewer can see why.
+func (s *ScanService) scanAttachment(ctx context.Context, attachment *models.ReviewAttachment) error {
+	key := attachmentKey(attachment)
+	pending := s.db.Model(&models.ReviewAttachment{}).Where("id = ? AND scan_status = ?", attachment.ID, models.ScanStatusPending)
+	results, err := s.runScanners(ctx, key)
+	if err != nil {
+		log.Warn().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Attachment scan failed, retrying")
+		return pending.Update("scan_after", time.Now().Add(s.cfg.RetryBackoff)).Error
+	}
+
+	status := models.ScanStatusPassed
+	for _, result := range results {
+		if result.Verdict == models.ScanVerdictInfected {
+			status = models.ScanStatusFailed
+		}
+	}
+	updated := pending.Updates(map[string]interface{}{"scan_status": status, "scan_after": nil})
+	if updated.Error != nil {
+		return updated.Error
+	}
+	if updated.RowsAffected == 0 {
+		return nil
+	}
+	if status == models.ScanStatusFailed {
+		if err := s.storage.Delete(ctx, key); err != nil && err != ErrObjectNotFound {
+			log.Error().Err(err).Str("attachment_id", attachment.ID.String()).Msg("Failed to delete infected attachment")
+		}
+	}
+	log.Info().Str("attachment_id", attachment.ID.String()).Str("status", string(status)).Msg("Review attachment scanned")
+	return nil
+}
+
+// settle publishes an agent that was waiting on its current version's scan
+// or, if the binary failed, rejects it. The publisher is told either way.
+func (s *ScanService) settle(release *models.AgentVersion, status models.ScanStatus) error {
+	var agent models.Agent
+	if err := s.db.Select("id", "name", "publisher_id", "status", "version").First(&agent, "id = ?", release.AgentID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+	waiting := agent.Status == models.AgentStatusPending && agent.Version == release.Version
+
+	notification := models.Notification{
+		UserID: agent.PublisherID,
+		Type:   models.NotificationTypeBinaryScan,
+		Title:  fmt.Sprintf("%s %s passed the malware scan", agent.Name, release.Version),
+		Body:   "The binary of " + agent.Name + " " + release.Version + " can now be published.",
+		Link:   fmt.Sprintf("/agents/%s/versions/%s", agent.ID, release.Version),
+	}
+	switch {
+	case status == models.ScanStatusFailed:
+		if waiting {
+			if err := s.agents.UpdateAgent(agent.ID, map[string]interface{}{"status": models.AgentStatusRejected}); err != nil {
+				return err
+			}
+		}
+		notification.Title = fmt.Sprintf("%s %s failed the malware scan", agent.Name, release.Version)
+		notification.Body = "The binary of " + agent.Name + " " + release.Version + " was flagged and cannot be published. Upload a new binary to have it scanned again."
+	case waiting:
+		notification.Body = agent.Name + " " + release.Version + " passed the malware scan and is now published."
+		if publishErr := s.agents.PublishAgent(agent.ID); publishErr != nil {
+			// Something else changed while the binary was scanned, e.g. the
+			// plan's limit was reached; the publisher has to submit it again
+			if err := s.agents.UpdateAgent(agent.ID, map[string]interface{}{"status": models.AgentStatusDraft}); err != nil {
+				return err
+			}
+			notification.Body = "The binary of " + agent.Name + " " + release.Version + " passed, but the agent could not be published: " + publishErr.Error()
+		}
+	}
+	if err := streamEvent(s.db, agent.PublisherID, StreamEventScanCompleted, map[string]interface{}{
+		"agent_id": agent.ID,
+		"version":  release.Version,
+		"status":   status,
+	}); err != nil {
+		return err
+	}
+	return notify(s.db, &notification)
+}
+
+// ListScans returns releases with a scan status, newest first (admin only)
+func (s *ScanService) ListScans(status models.ScanStatus, page, limit int) ([]models.AgentVersion, int64, error) {
+	query := s.db.Model(&models.AgentVersion{}).Where("binary_checksum <> ''")
+	if status != "" {
+		query = query.Where("scan_status = ?", status)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var releases []models.AgentVersion
+	if err := query.Order("created_at DESC").Offset((page - 1) * limit).Limit(limit).Find(&releases).Error; err != nil {
+		return nil, 0, err
+	}
+	return releases, total, nil
+}
+
+// GetScan returns a release along with its scan report (admin only)
+func (s *ScanService) GetScan(agentID uuid.UUID, version string) (*models.AgentVersion, error) {
+	var release models.AgentVersion
+	if err := s.db.Where("agent_id = ? AND version = ?", agentID, version).First(&release).Error; err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// Rescan queues a release's binary to be scanned again, e.g. after the
+// scanners' signatures were updated (admin only)
+func (s *ScanService) Rescan(agentID uuid.UUID, version string) (*models.AgentVersion, error) {
+	release, err := s.GetScan(agentID, version)
+	if err != nil {
+		return nil, err
+	}
+	if release.Status != models.AgentVersionStatusDraft {
+		return nil, ErrVersionImmutable
+	}
+	if err := s.db.Model(release).Updates(map[string]interface{}{
+		"scan_status": models.ScanStatusPending,
+		"scan_after":  nil,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+// clamAVScanner streams a binary to a clamd daemon with INSTREAM
+type clamAVScanner struct {
+	cfg config.ClamAVConfig
+}
+
+func (c *clamAVScanner) Name() string { return "clamav" }
+
+func (c *clamAVScanner) Scan(ctx context.Context, r io.Reader) ([]string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.cfg.Network, c.cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return nil, err
+	}
+	chunk := make([]byte, clamdChunkSize)
+	var size [4]byte
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := conn.Write(size[:]); err != nil {
+				return nil, err
+			}
+			if _, err := conn.Write(chunk[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// A zero length chunk ends the stream
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := conn.Write(size[:]); err != nil {
+		return nil, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return nil, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return []string{strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND")}, nil
+	default:
+		// e.g. "INSTREAM size limit exceeded. ERROR"
+		return nil, fmt.Errorf("clamd: %s", reply)
+	}
+}
@@ -0,0 +1,435 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// Tasks the scheduler can run
+const (
+	TaskStats         = "stats"          // refreshes the admin statistics
+	TaskExchangeRates = "exchange_rates" // syncs exchange rates
+	TaskStaleDrafts   = "stale_drafts"   // flags and archives stale drafts
+	TaskPayouts       = "payouts"        // creates and sends publisher payouts
+)
+
+const (
+	// schedulerLeader holds the ID of the replica running the schedule
+	schedulerLeader = "{scheduler}:leader"
+	// schedulerRunPrefix starts the keys claiming each run of a task, so a
+	// run is never repeated by a replica taking over leadership
+	schedulerRunPrefix = "{scheduler}:run:"
+	// schedulerRunClaimTTL is how long run claims are kept
+	schedulerRunClaimTTL = 24 * time.Hour
+	// cronSearchLimit bounds the search for a spec's next time, for specs
+	// such as Feb 30 that never match
+	cronSearchLimit = 5 * 366 * 24 * time.Hour
+)
+
+var (
+	schedulerIsLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "edgeplug_scheduler_leader",
+		Help: "Whether this replica runs the scheduled tasks",
+	})
+	scheduledRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "edgeplug_scheduled_task_runs_total",
+		Help: "Runs of scheduled tasks by task and outcome: succeeded or failed",
+	}, []string{"task", "outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(schedulerIsLeader, scheduledRuns)
+}
+
+// ScheduledTask is periodic work the scheduler runs at the times of its
+// cron spec
+type ScheduledTask struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// leaderLoop is a background loop run on the leader only
+type leaderLoop struct {
+	name string
+	run  func(ctx context.Context)
+}
+
+type scheduledTask struct {
+	ScheduledTask
+	schedule *CronSchedule
+	next     time.Time   // of the next run, while leader
+	running  atomic.Bool // a run has not finished yet
+}
+
+// Scheduler runs periodic tasks at the times of their cron specs on a
+// single replica. Replicas elect the leader through a Redis lease it keeps
+// renewing; when it stops, another takes over once the lease runs out.
+// Each run is also claimed in Redis, so a run is not repeated by a new
+// leader. Runs missed while there is no leader, such as while Redis is
+// down, are skipped rather than caught up. The leader also runs the
+// background loops that must not run on two replicas at once.
+type Scheduler struct {
+	redis *RedisService
+	cfg   config.SchedulerConfig
+	id    string
+	tasks []*scheduledTask
+	loops []leaderLoop
+}
+
+// NewScheduler creates a scheduler for the tasks with a spec in the
+// configuration. It fails on an invalid spec or on a spec for an unknown
+// task.
+func NewScheduler(redisSvc *RedisService, cfg config.SchedulerConfig, tasks []ScheduledTask) (*Scheduler, error) {
+	s := &Scheduler{redis: redisSvc, cfg: cfg, id: models.NewID().String()}
+	known := map[string]bool{}
+	for _, task := range tasks {
+		known[task.Name] = true
+		spec := strings.TrimSpace(cfg.Tasks[task.Name])
+		if spec == "" {
+			continue
+		}
+		schedule, err := ParseCron(spec)
+		if err != nil {
+			return nil, fmt.Errorf("scheduler task %s: %w", task.Name, err)
+		}
+		if schedule.Next(time.Now().UTC()).IsZero() {
+			return nil, fmt.Errorf("scheduler task %s: cron spec %q never matches", task.Name, spec)
+		}
+		s.tasks = append(s.tasks, &scheduledTask{ScheduledTask: task, schedule: schedule})
+	}
+	for name := range cfg.Tasks {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown scheduler task: %s", name)
+		}
+	}
+	return s, nil
+}
+
+// Scheduled reports whether a task runs on the schedule rather than on its
+// own interval
+func (s *Scheduler) Scheduled(name string) bool {
+	for _, task := range s.tasks {
+		if task.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// OnLeader adds a loop, such as a service's Run, that runs on the leader
+// only. It is started when the replica becomes leader and cancelled when it
+// loses leadership, and must return once its context is done. Loops are
+// added before Run.
+func (s *Scheduler) OnLeader(name string, run func(ctx context.Context)) {
+	s.loops = append(s.loops, leaderLoop{name: name, run: run})
+}
+
+// Run keeps trying to become the leader, and while leader runs the loops
+// and starts the tasks when due, until ctx is done. It then waits for the
+// running tasks and loops and gives up leadership.
+func (s *Scheduler) Run(ctx context.Context) {
+	if len(s.tasks) == 0 && len(s.loops) == 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	defer s.resign()
+	defer wg.Wait()
+
+	leader := false
+	stopLoops := func() {}
+	defer func() { stopLoops() }()
+	for {
+		now := time.Now().UTC()
+		if s.lead(ctx) {
+			if !leader {
+				log.Info().Str("scheduler_id", s.id).Strs("tasks", s.taskNames()).Strs("loops", s.loopNames()).Msg("Elected scheduler leader")
+				// Only runs due from now on; earlier ones belonged to the
+				// previous leader
+				for _, task := range s.tasks {
+					task.next = task.schedule.Next(now)
+				}
+				stopLoops = s.startLoops(ctx, &wg)
+			}
+			leader = true
+			s.startDue(ctx, now, &wg)
+		} else if leader {
+			log.Warn().Str("scheduler_id", s.id).Msg("Lost scheduler leadership")
+			leader = false
+			stopLoops()
+		}
+		if leader {
+			schedulerIsLeader.Set(1)
+		} else {
+			schedulerIsLeader.Set(0)
+		}
+
+		// The lease is renewed three times per TTL, or sooner for a run
+		wait := s.cfg.LeaseTTL / 3
+		if leader {
+			for _, task := range s.tasks {
+				wait = min(wait, max(time.Until(task.next), 0))
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// startLoops starts the leader's loops and returns the function that
+// stops them and waits for them to return. An iteration in progress still
+// finishes, so it may overlap briefly with the new leader's.
+func (s *Scheduler) startLoops(ctx context.Context, wg *sync.WaitGroup) func() {
+	loopCtx, cancel := context.WithCancel(ctx)
+	var running sync.WaitGroup
+	for _, loop := range s.loops {
+		wg.Add(1)
+		running.Add(1)
+		go func(loop leaderLoop) {
+			defer wg.Done()
+			defer running.Done()
+			loop.run(loopCtx)
+		}(loop)
+	}
+	return func() {
+		cancel()
+		running.Wait()
+	}
+}
+
+// lead takes or renews the leader's lease and reports whether the replica
+// holds it
+func (s *Scheduler) lead(ctx context.Context) bool {
+	if !s.redis.Available() {
+		return false
+	}
+	client := s.redis.Client()
+	held, err := renewLock.Run(ctx, client, []string{schedulerLeader}, s.id, s.cfg.LeaseTTL.Milliseconds()).Bool()
+	if err == nil && !held {
+		held, err = client.SetNX(ctx, schedulerLeader, s.id, s.cfg.LeaseTTL).Result()
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Warn().Err(err).Msg("Failed to renew scheduler leadership")
+		}
+		return false
+	}
+	return held
+}
+
+// resign gives up leadership so another replica takes over right away
+func (s *Scheduler) resign() {
+	schedulerIsLeader.Set(0)
+	if !s.redis.Available() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := releaseLock.Run(ctx, s.redis.Client(), []string{schedulerLeader}, s.id).Err(); err != nil {
+		log.Warn().Err(err).Msg("Failed to resign scheduler leadership")
+	}
+}
+
+// startDue starts the tasks whose time has come, each in its own goroutine
+// so the lease keeps being renewed. A task still running at its next time
+// skips that run.
+func (s *Scheduler) startDue(ctx context.Context, now time.Time, wg *sync.WaitGroup) {
+	for _, task := range s.tasks {
+		if task.next.After(now) {
+			continue
+		}
+		due := task.next
+		task.next = task.schedule.Next(now)
+		if task.running.Load() {
+			log.Warn().Str("task", task.Name).Time("due", due).Msg("Scheduled task still running, skipping run")
+			continue
+		}
+
+		claim := schedulerRunPrefix + task.Name + ":" + strconv.FormatInt(due.Unix(), 10)
+		claimed, err := s.redis.Client().SetNX(ctx, claim, s.id, schedulerRunClaimTTL).Result()
+		if err != nil {
+			log.Warn().Err(err).Str("task", task.Name).Msg("Failed to claim scheduled run")
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		task.running.Store(true)
+		wg.Add(1)
+		go func(task *scheduledTask) {
+			defer wg.Done()
+			defer task.running.Store(false)
+
+			start := time.Now()
+			if err := task.Run(ctx); err != nil {
+				scheduledRuns.WithLabelValues(task.Name, "failed").Inc()
+				log.Error().Err(err).Str("task", task.Name).Time("due", due).Msg("Scheduled task failed")
+				return
+			}
+			scheduledRuns.WithLabelValues(task.Name, "succeeded").Inc()
+			log.Info().Str("task", task.Name).Time("due", due).Dur("took", time.Since(start)).Msg("Scheduled task ran")
+		}(task)
+	}
+}
+
+// CronSchedule is a parsed cron spec: minute, hour, day of month, month and
+// day of week, each a set of allowed values
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit i set if value i is allowed
+	domAny, dowAny                bool   // the field was *
+}
+
+// cronMacros are the shorthand specs
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a five-field cron spec. Fields take *, values, ranges
+// (1-5), lists (1,15) and steps (*/10, 0-30/5). Days of the week run from 0
+// (Sunday) to 6, and 7 is Sunday too. As in cron, a time matches when both
+// day fields do, or either if neither is *.
+func ParseCron(spec string) (*CronSchedule, error) {
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron spec %q must have 5 fields", spec)
+	}
+
+	s := &CronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	bounds := []struct {
+		dest     *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	}
+	for i, field := range fields {
+		bits, err := parseCronField(field, bounds[i].min, bounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("cron spec %q: %w", spec, err)
+		}
+		*bounds[i].dest = bits
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parseCronField returns the values a field allows as a bit set
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		start, end := lo, hi
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if start, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid range in %q", part)
+				}
+			} else if step > 1 {
+				end = hi
+			}
+		}
+		if start < lo || end > hi || start > end {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, lo, hi)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first time after t that the schedule matches, to the
+// minute, or the zero time if none comes within five years
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay reports whether the day fields allow t's day
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// loopNames returns the names of the leader's loops, in the order added
+func (s *Scheduler) loopNames() []string {
+	names := make([]string, len(s.loops))
+	for i, loop := range s.loops {
+		names[i] = loop.name
+	}
+	return names
+}
+
+// taskNames returns the names of the scheduled tasks, sorted
+func (s *Scheduler) taskNames() []string {
+	names := make([]string, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		names = append(names, task.Name)
+	}
+	sort.Strings(names)
+	return names
+}
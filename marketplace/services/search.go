@@ -0,0 +1,516 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// maxRetryBackoff caps the wait before failed background work, such as an
+// outbox entry or a binary scan, is retried
+const maxRetryBackoff = time.Hour
+
+var (
+	// ErrSearchDisabled is returned for index operations with the database
+	// search backend
+	ErrSearchDisabled = errors.New("search index is not enabled")
+	// ErrReindexRunning is returned when starting a reindex while another
+	// one is running
+	ErrReindexRunning = errors.New("a reindex is already running")
+)
+
+// SearchIndex is an external full-text index of agents
+type SearchIndex interface {
+	// EnsureIndex creates the index if it does not exist
+	EnsureIndex(ctx context.Context) error
+	// Upsert adds or replaces documents
+	Upsert(ctx context.Context, docs []SearchDocument) error
+	// Delete removes documents; unknown IDs are ignored
+	Delete(ctx context.Context, ids []uuid.UUID) error
+	// Search returns the IDs of up to limit agents matching query, best
+	// first
+	Search(ctx context.Context, query string, limit int) ([]uuid.UUID, error)
+	// Versions returns the updated_at of every indexed agent
+	Versions(ctx context.Context) (map[uuid.UUID]time.Time, error)
+}
+
+// SearchDocument is an agent as it is indexed
+type SearchDocument struct {
+	AgentID        uuid.UUID           `json:"agent_id"`
+	Name           string              `json:"name"`
+	Description    string              `json:"description"`
+	Category       string              `json:"category"`
+	Tags           []string            `json:"tags"`
+	Status         models.AgentStatus  `json:"status"`
+	PublisherID    uuid.UUID           `json:"publisher_id"`
+	OrganizationID *uuid.UUID          `json:"organization_id,omitempty"`
+	Version        string              `json:"version"`
+	SafetyLevel    models.SafetyLevel  `json:"safety_level"`
+	PricingModel   models.PricingModel `json:"pricing_model"`
+	Rating         float64             `json:"rating"`
+	ReviewCount    int                 `json:"review_count"`
+	UpdatedAt      time.Time           `json:"updated_at"` // compared with the database by consistency checks
+}
+
+// SearchStatus is the state of the search index for admins
+type SearchStatus struct {
+	Backend         string                         `json:"backend"`
+	OutboxPending   int64                          `json:"outbox_pending"`
+	OutboxFailing   int64                          `json:"outbox_failing"` // entries that failed at least once
+	OldestPendingAt *time.Time                     `json:"oldest_pending_at,omitempty"`
+	Reindex         *models.SearchReindex          `json:"reindex,omitempty"` // latest
+	LastCheck       *models.SearchConsistencyCheck `json:"last_check,omitempty"`
+}
+
+// SearchService keeps the search index in sync with the database. Agent
+// changes are queued in an outbox by database triggers; the worker indexes
+// them, runs reindexes and checks the index against the database.
+type SearchService struct {
+	db    *gorm.DB
+	cfg   config.SearchConfig
+	index SearchIndex // nil with the database backend
+}
+
+// NewSearchService creates a new search service for the configured backend
+func NewSearchService(db *gorm.DB, cfg config.SearchConfig) *SearchService {
+	s := &SearchService{db: db, cfg: cfg}
+	if cfg.Backend == "opensearch" {
+		s.index = newOpenSearchIndex(cfg.OpenSearch)
+	}
+	return s
+}
+
+// Enabled reports whether searches go to an external index
+func (s *SearchService) Enabled() bool {
+	return s.index != nil
+}
+
+// MatchAgents returns the IDs of the agents matching a full-text query,
+// best first
+func (s *SearchService) MatchAgents(ctx context.Context, query string) ([]uuid.UUID, error) {
+	if !s.Enabled() {
+		return nil, ErrSearchDisabled
+	}
+	return s.index.Search(ctx, query, s.cfg.MaxMatches)
+}
+
+// Run indexes queued changes, advances a running reindex and checks the
+// index for consistency every poll interval until ctx is done
+func (s *SearchService) Run(ctx context.Context) {
+	if !s.Enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	ready := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !ready {
+			if err := s.index.EnsureIndex(ctx); err != nil {
+				log.Error().Err(err).Msg("Failed to create search index")
+				continue
+			}
+			ready = true
+		}
+		if _, err := s.ProcessOutbox(ctx); err != nil {
+			log.Error().Err(err).Msg("Failed to index agent changes")
+		}
+		if err := s.advanceReindex(ctx); err != nil {
+			log.Error().Err(err).Msg("Failed to advance search reindex")
+		}
+		if s.checkDue() {
+			if _, err := s.CheckConsistency(ctx); err != nil && err != ErrReindexRunning {
+				log.Error().Err(err).Msg("Failed to check search index consistency")
+			}
+		}
+	}
+}
+
+// ProcessOutbox indexes a batch of queued agent changes and returns how
+// many entries were processed. Entries that fail are retried with
+// exponential backoff.
+func (s *SearchService) ProcessOutbox(ctx context.Context) (int, error) {
+	if !s.Enabled() {
+		return 0, ErrSearchDisabled
+	}
+
+	var processed int
+	var indexErr error
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Other instances skip the entries locked here
+		var entries []models.SearchOutboxEntry
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("next_attempt_at <= ?", time.Now()).
+			Order("id").Limit(s.cfg.BatchSize).
+			Find(&entries).Error; err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+
+		entryIDs := make([]int64, len(entries))
+		seen := make(map[uuid.UUID]bool, len(entries))
+		agentIDs := make([]uuid.UUID, 0, len(entries))
+		attempts := 0
+		for i, entry := range entries {
+			entryIDs[i] = entry.ID
+			if entry.Attempts > attempts {
+				attempts = entry.Attempts
+			}
+			if !seen[entry.AgentID] {
+				seen[entry.AgentID] = true
+				agentIDs = append(agentIDs, entry.AgentID)
+			}
+		}
+
+		if indexErr = s.indexAgents(ctx, tx, agentIDs); indexErr != nil {
+			return tx.Model(&models.SearchOutboxEntry{}).Where("id IN ?", entryIDs).Updates(map[string]interface{}{
+				"attempts":        gorm.Expr("attempts + 1"),
+				"next_attempt_at": time.Now().Add(retryBackoff(s.cfg.RetryBackoff, attempts)),
+				"last_error":      indexErr.Error(),
+			}).Error
+		}
+		processed = len(entries)
+		return tx.Where("id IN ?", entryIDs).Delete(&models.SearchOutboxEntry{}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return processed, indexErr
+}
+
+// StartReindex starts rebuilding the index from the database. The worker
+// indexes it batch by batch; progress is kept on the returned reindex.
+func (s *SearchService) StartReindex(adminID uuid.UUID) (*models.SearchReindex, error) {
+	if !s.Enabled() {
+		return nil, ErrSearchDisabled
+	}
+
+	reindex := models.SearchReindex{
+		Status:      models.SearchReindexStatusRunning,
+		RequestedBy: adminID,
+		StartedAt:   time.Now(),
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var running int64
+		if err := tx.Model(&models.SearchReindex{}).
+			Where("status = ?", models.SearchReindexStatusRunning).
+			Count(&running).Error; err != nil {
+			return err
+		}
+		if running > 0 {
+			return ErrReindexRunning
+		}
+		if err := tx.Model(&models.Agent{}).Count(&reindex.Total).Error; err != nil {
+			return err
+		}
+		return tx.Create(&reindex).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &reindex, nil
+}
+
+// GetReindex returns a reindex and its progress
+func (s *SearchService) GetReindex(id uuid.UUID) (*models.SearchReindex, error) {
+	var reindex models.SearchReindex
+	if err := s.db.First(&reindex, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &reindex, nil
+}
+
+// CancelReindex stops a running reindex before its next batch. Agents
+// already indexed stay in the index, and orphaned documents are kept.
+func (s *SearchService) CancelReindex(id uuid.UUID) error {
+	result := s.db.Model(&models.SearchReindex{}).
+		Where("id = ? AND status = ?", id, models.SearchReindexStatusRunning).
+		Updates(map[string]interface{}{"status": models.SearchReindexStatusCanceled, "completed_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrOperationDone
+	}
+	return nil
+}
+
+// GetStatus returns the outbox backlog, the latest reindex and the latest
+// consistency check
+func (s *SearchService) GetStatus() (*SearchStatus, error) {
+	status := SearchStatus{Backend: s.cfg.Backend}
+	if !s.Enabled() {
+		return &status, nil
+	}
+
+	if err := s.db.Model(&models.SearchOutboxEntry{}).Count(&status.OutboxPending).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&models.SearchOutboxEntry{}).Where("attempts > 0").Count(&status.OutboxFailing).Error; err != nil {
+		return nil, err
+	}
+	var oldest models.SearchOutboxEntry
+	switch err := s.db.Order("id").First(&oldest).Error; err {
+	case nil:
+		status.OldestPendingAt = &oldest.CreatedAt
+	case gorm.ErrRecordNotFound:
+	default:
+		return nil, err
+	}
+
+	var reindex models.SearchReindex
+	switch err := s.db.Order("started_at DESC").First(&reindex).Error; err {
+	case nil:
+		status.Reindex = &reindex
+	case gorm.ErrRecordNotFound:
+	default:
+		return nil, err
+	}
+
+	var check models.SearchConsistencyCheck
+	switch err := s.db.Order("checked_at DESC").First(&check).Error; err {
+	case nil:
+		status.LastCheck = &check
+	case gorm.ErrRecordNotFound:
+	default:
+		return nil, err
+	}
+	return &status, nil
+}
+
+// CheckConsistency compares the index with the database and queues the
+// agents that are missing, out of date or deleted for indexing. It is
+// skipped while a reindex is running.
+func (s *SearchService) CheckConsistency(ctx context.Context) (*models.SearchConsistencyCheck, error) {
+	if !s.Enabled() {
+		return nil, ErrSearchDisabled
+	}
+
+	var running int64
+	if err := s.db.Model(&models.SearchReindex{}).Where("status = ?", models.SearchReindexStatusRunning).Count(&running).Error; err != nil {
+		return nil, err
+	}
+	if running > 0 {
+		return nil, ErrReindexRunning
+	}
+
+	indexed, err := s.index.Versions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var agents []struct {
+		ID        uuid.UUID
+		UpdatedAt time.Time
+	}
+	if err := s.db.Model(&models.Agent{}).Select("id", "updated_at").Find(&agents).Error; err != nil {
+		return nil, err
+	}
+
+	check := models.SearchConsistencyCheck{Agents: len(agents), Documents: len(indexed), CheckedAt: time.Now()}
+	var repair []models.SearchOutboxEntry
+	for _, agent := range agents {
+		updatedAt, ok := indexed[agent.ID]
+		delete(indexed, agent.ID)
+		switch {
+		case !ok:
+			check.Missing++
+		case !updatedAt.Equal(agent.UpdatedAt):
+			check.Stale++
+		default:
+			continue
+		}
+		repair = append(repair, models.SearchOutboxEntry{AgentID: agent.ID, NextAttemptAt: check.CheckedAt})
+	}
+	// What is left is indexed but no longer in the database
+	for id := range indexed {
+		check.Orphaned++
+		repair = append(repair, models.SearchOutboxEntry{AgentID: id, NextAttemptAt: check.CheckedAt})
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if len(repair) > 0 {
+			if err := tx.CreateInBatches(&repair, 500).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(&check).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(repair) > 0 {
+		log.Warn().Int("missing", check.Missing).Int("stale", check.Stale).Int("orphaned", check.Orphaned).
+			Msg("Search index out of sync, queued agents for indexing")
+	}
+	return &check, nil
+}
+
+// advanceReindex indexes the next batch of the running reindex. Once every
+// agent is indexed, documents of agents no longer in the database are
+// removed and the reindex completes.
+func (s *SearchService) advanceReindex(ctx context.Context) error {
+	var reindex models.SearchReindex
+	switch err := s.db.Where("status = ?", models.SearchReindexStatusRunning).Order("started_at").First(&reindex).Error; err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		return nil
+	default:
+		return err
+	}
+
+	query := s.db.Order("id").Limit(s.cfg.BatchSize)
+	if reindex.Cursor != nil {
+		query = query.Where("id > ?", *reindex.Cursor)
+	}
+	var agents []models.Agent
+	if err := query.Find(&agents).Error; err != nil {
+		return err
+	}
+
+	if len(agents) > 0 {
+		docs := make([]SearchDocument, len(agents))
+		for i := range agents {
+			docs[i] = searchDocument(&agents[i])
+		}
+		if err := s.index.Upsert(ctx, docs); err != nil {
+			s.db.Model(&reindex).Update("last_error", err.Error())
+			return err
+		}
+		return s.db.Model(&reindex).Where("status = ?", models.SearchReindexStatusRunning).Updates(map[string]interface{}{
+			"indexed":    gorm.Expr("indexed + ?", len(agents)),
+			"cursor":     agents[len(agents)-1].ID,
+			"last_error": "",
+		}).Error
+	}
+
+	removed, err := s.removeOrphans(ctx)
+	if err != nil {
+		s.db.Model(&reindex).Update("last_error", err.Error())
+		return err
+	}
+	now := time.Now()
+	if err := s.db.Model(&reindex).Where("status = ?", models.SearchReindexStatusRunning).Updates(map[string]interface{}{
+		"status":       models.SearchReindexStatusCompleted,
+		"removed":      removed,
+		"completed_at": &now,
+		"last_error":   "",
+	}).Error; err != nil {
+		return err
+	}
+	log.Info().Str("reindex_id", reindex.ID.String()).Int64("indexed", reindex.Indexed).Int("removed", removed).Msg("Search reindex completed")
+	return nil
+}
+
+// removeOrphans deletes the documents of agents no longer in the database
+func (s *SearchService) removeOrphans(ctx context.Context) (int, error) {
+	indexed, err := s.index.Versions(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var ids []uuid.UUID
+	if err := s.db.Model(&models.Agent{}).Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		delete(indexed, id)
+	}
+
+	orphans := make([]uuid.UUID, 0, len(indexed))
+	for id := range indexed {
+		orphans = append(orphans, id)
+	}
+	if err := s.index.Delete(ctx, orphans); err != nil {
+		return 0, err
+	}
+	return len(orphans), nil
+}
+
+// indexAgents brings the documents of agents up to date, deleting those of
+// deleted agents
+func (s *SearchService) indexAgents(ctx context.Context, tx *gorm.DB, ids []uuid.UUID) error {
+	var agents []models.Agent
+	if err := tx.Where("id IN ?", ids).Find(&agents).Error; err != nil {
+		return err
+	}
+
+	live := make(map[uuid.UUID]bool, len(agents))
+	docs := make([]SearchDocument, len(agents))
+	for i := range agents {
+		live[agents[i].ID] = true
+		docs[i] = searchDocument(&agents[i])
+	}
+	var deleted []uuid.UUID
+	for _, id := range ids {
+		if !live[id] {
+			deleted = append(deleted, id)
+		}
+	}
+
+	if err := s.index.Upsert(ctx, docs); err != nil {
+		return err
+	}
+	return s.index.Delete(ctx, deleted)
+}
+
+// checkDue reports whether the last consistency check is older than the
+// consistency interval
+func (s *SearchService) checkDue() bool {
+	var check models.SearchConsistencyCheck
+	switch err := s.db.Select("checked_at").Order("checked_at DESC").First(&check).Error; err {
+	case nil:
+		return time.Since(check.CheckedAt) >= s.cfg.ConsistencyInterval
+	case gorm.ErrRecordNotFound:
+		return true
+	default:
+		log.Error().Err(err).Msg("Failed to get last search consistency check")
+		return false
+	}
+}
+
+func searchDocument(agent *models.Agent) SearchDocument {
+	return SearchDocument{
+		AgentID:        agent.ID,
+		Name:           agent.Name,
+		Description:    agent.Description,
+		Category:       agent.Category,
+		Tags:           agent.Tags,
+		Status:         agent.Status,
+		PublisherID:    agent.PublisherID,
+		OrganizationID: agent.OrganizationID,
+		Version:        agent.Version,
+		SafetyLevel:    agent.SafetyLevel,
+		PricingModel:   agent.PricingModel,
+		Rating:         agent.Rating,
+		ReviewCount:    agent.ReviewCount,
+		UpdatedAt:      agent.UpdatedAt,
+	}
+}
+
+// retryBackoff is the wait after work that failed attempts times already
+func retryBackoff(base time.Duration, attempts int) time.Duration {
+	if attempts > 16 {
+		return maxRetryBackoff
+	}
+	backoff := base << attempts
+	if backoff <= 0 || backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,319 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+const (
+	// sitemapMaxURLs is the most URLs a single sitemap file may list
+	sitemapMaxURLs = 50000
+	sitemapXMLNS   = "http://www.sitemaps.org/schemas/sitemap/0.9"
+)
+
+// ErrSitemapPageNotFound is returned for a sitemap file past the last one
+var ErrSitemapPageNotFound = errors.New("sitemap page not found")
+
+// SEOService renders the public sitemap and the JSON-LD structured data of
+// published agents for search engines. Both are cached in process and
+// dropped on every instance when a published listing changes.
+type SEOService struct {
+	db  *gorm.DB
+	cfg config.SEOConfig
+
+	mu         sync.Mutex
+	sitemap    *renderedSitemap
+	structured map[uuid.UUID]structuredDataEntry
+}
+
+// renderedSitemap is the sitemap as served: a single file, or an index
+// followed by its files
+type renderedSitemap struct {
+	root      []byte
+	pages     [][]byte
+	expiresAt time.Time
+}
+
+type structuredDataEntry struct {
+	body      []byte
+	expiresAt time.Time
+}
+
+type sitemapEntry struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name       `xml:"urlset"`
+	XMLNS   string         `xml:"xmlns,attr"`
+	URLs    []sitemapEntry `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name       `xml:"sitemapindex"`
+	XMLNS    string         `xml:"xmlns,attr"`
+	Sitemaps []sitemapEntry `xml:"sitemap"`
+}
+
+// NewSEOService creates a new SEO service
+func NewSEOService(db *gorm.DB, cfg config.SEOConfig) *SEOService {
+	return &SEOService{db: db, cfg: cfg, structured: make(map[uuid.UUID]structuredDataEntry)}
+}
+
+// Sitemap returns sitemap.xml. Past sitemapMaxURLs pages it is a sitemap
+// index of the files served by SitemapPage.
+func (s *SEOService) Sitemap() ([]byte, error) {
+	sitemap, err := s.getSitemap()
+	if err != nil {
+		return nil, err
+	}
+	return sitemap.root, nil
+}
+
+// SitemapPage returns file n, from 1, of a sitemap split by an index
+func (s *SEOService) SitemapPage(n int) ([]byte, error) {
+	sitemap, err := s.getSitemap()
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 || n > len(sitemap.pages) {
+		return nil, ErrSitemapPageNotFound
+	}
+	return sitemap.pages[n-1], nil
+}
+
+// AgentStructuredData returns the schema.org SoftwareApplication of a
+// published agent as JSON-LD
+func (s *SEOService) AgentStructuredData(id uuid.UUID) ([]byte, error) {
+	s.mu.Lock()
+	entry, ok := s.structured[id]
+	s.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.body, nil
+	}
+
+	var agent models.Agent
+	if err := s.db.Preload("Publisher").
+		First(&agent, "id = ? AND status = ?", id, models.AgentStatusPublished).Error; err != nil {
+		return nil, err
+	}
+
+	url := s.agentURL(agent.ID)
+	price := models.FormatMoney(agent.Price, agent.Currency)
+	currency := models.NormalizeCurrency(agent.Currency)
+	offer := map[string]interface{}{
+		"@type":         "Offer",
+		"price":         price,
+		"priceCurrency": currency,
+		"url":           url,
+	}
+	if agent.PricingModel == models.PricingModelMetered {
+		offer["priceSpecification"] = map[string]interface{}{
+			"@type":         "UnitPriceSpecification",
+			"price":         price,
+			"priceCurrency": currency,
+			"unitText":      "device-month",
+		}
+	}
+	data := map[string]interface{}{
+		"@context":            "https://schema.org",
+		"@type":               "SoftwareApplication",
+		"name":                agent.Name,
+		"description":         agent.Description,
+		"url":                 url,
+		"softwareVersion":     agent.Version,
+		"applicationCategory": agent.Category,
+		"operatingSystem":     "Embedded",
+		"dateModified":        agent.UpdatedAt.UTC().Format(time.RFC3339),
+		"author": map[string]interface{}{
+			"@type": "Organization",
+			"name":  publisherName(&agent.Publisher),
+			"url":   s.publisherURL(agent.PublisherID),
+		},
+		"offers": offer,
+	}
+	if agent.PublishedAt != nil {
+		data["datePublished"] = agent.PublishedAt.UTC().Format(time.RFC3339)
+	}
+	if len(agent.Tags) > 0 {
+		data["keywords"] = strings.Join(agent.Tags, ", ")
+	}
+	if agent.ReviewCount > 0 {
+		data["aggregateRating"] = map[string]interface{}{
+			"@type":       "AggregateRating",
+			"ratingValue": agent.Rating,
+			"reviewCount": agent.ReviewCount,
+			"bestRating":  5,
+			"worstRating": 1,
+		}
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.structured[id] = structuredDataEntry{body: body, expiresAt: time.Now().Add(s.cfg.CacheTTL)}
+	s.mu.Unlock()
+	return body, nil
+}
+
+// CacheTTL returns how long rendered documents are cached
+func (s *SEOService) CacheTTL() time.Duration {
+	return s.cfg.CacheTTL
+}
+
+// Listen drops cached documents on the agent IDs notified by the agents
+// table triggers until ctx is done
+func (s *SEOService) Listen(ctx context.Context) {
+	listenChannel(ctx, s.db, s.cfg.InvalidationChannel, func(payload string) {
+		id, err := uuid.Parse(payload)
+		if err != nil {
+			log.Warn().Str("payload", payload).Msg("Ignoring malformed SEO invalidation")
+			return
+		}
+		s.mu.Lock()
+		s.sitemap = nil
+		delete(s.structured, id)
+		s.mu.Unlock()
+	}, s.flush)
+}
+
+// flush drops every cached document
+func (s *SEOService) flush() {
+	s.mu.Lock()
+	s.sitemap = nil
+	s.structured = make(map[uuid.UUID]structuredDataEntry)
+	s.mu.Unlock()
+}
+
+// getSitemap returns the cached sitemap, rendering it again once it
+// expires or is dropped. Concurrent callers wait for a single rendering.
+func (s *SEOService) getSitemap() (*renderedSitemap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sitemap != nil && time.Now().Before(s.sitemap.expiresAt) {
+		return s.sitemap, nil
+	}
+	sitemap, err := s.renderSitemap()
+	if err != nil {
+		return nil, err
+	}
+	s.sitemap = sitemap
+	return sitemap, nil
+}
+
+// renderSitemap lists the pages of published agents and of the publishers
+// who have any, last modified when the agent, or the publisher's latest
+// agent, was updated
+func (s *SEOService) renderSitemap() (*renderedSitemap, error) {
+	published := func() *gorm.DB {
+		return s.db.Model(&models.Agent{}).Where("status = ?", models.AgentStatusPublished)
+	}
+
+	var agents []struct {
+		ID        uuid.UUID
+		UpdatedAt time.Time
+	}
+	if err := published().Select("id, updated_at").Order("published_at, id").Scan(&agents).Error; err != nil {
+		return nil, err
+	}
+	var publishers []struct {
+		PublisherID uuid.UUID
+		UpdatedAt   time.Time
+	}
+	if err := published().Select("publisher_id, MAX(updated_at) AS updated_at").
+		Group("publisher_id").Order("publisher_id").
+		Scan(&publishers).Error; err != nil {
+		return nil, err
+	}
+
+	urls := make([]sitemapEntry, 0, len(agents)+len(publishers))
+	var lastMods []time.Time
+	for _, a := range agents {
+		urls = append(urls, sitemapEntry{Loc: s.agentURL(a.ID), LastMod: a.UpdatedAt.UTC().Format(time.RFC3339)})
+		lastMods = append(lastMods, a.UpdatedAt)
+	}
+	for _, p := range publishers {
+		urls = append(urls, sitemapEntry{Loc: s.publisherURL(p.PublisherID), LastMod: p.UpdatedAt.UTC().Format(time.RFC3339)})
+		lastMods = append(lastMods, p.UpdatedAt)
+	}
+
+	sitemap := &renderedSitemap{expiresAt: time.Now().Add(s.cfg.CacheTTL)}
+	if len(urls) <= sitemapMaxURLs {
+		root, err := renderXML(sitemapURLSet{XMLNS: sitemapXMLNS, URLs: urls})
+		if err != nil {
+			return nil, err
+		}
+		sitemap.root = root
+		return sitemap, nil
+	}
+
+	index := sitemapIndex{XMLNS: sitemapXMLNS}
+	for start := 0; start < len(urls); start += sitemapMaxURLs {
+		end := start + sitemapMaxURLs
+		if end > len(urls) {
+			end = len(urls)
+		}
+		page, err := renderXML(sitemapURLSet{XMLNS: sitemapXMLNS, URLs: urls[start:end]})
+		if err != nil {
+			return nil, err
+		}
+		sitemap.pages = append(sitemap.pages, page)
+
+		var lastMod time.Time
+		for _, t := range lastMods[start:end] {
+			if t.After(lastMod) {
+				lastMod = t
+			}
+		}
+		index.Sitemaps = append(index.Sitemaps, sitemapEntry{
+			Loc:     fmt.Sprintf("%s/sitemaps/%d.xml", s.baseURL(), len(sitemap.pages)),
+			LastMod: lastMod.UTC().Format(time.RFC3339),
+		})
+	}
+	root, err := renderXML(index)
+	if err != nil {
+		return nil, err
+	}
+	sitemap.root = root
+	return sitemap, nil
+}
+
+func (s *SEOService) baseURL() string {
+	return strings.TrimSuffix(s.cfg.BaseURL, "/")
+}
+
+func (s *SEOService) agentURL(id uuid.UUID) string {
+	return s.baseURL() + "/agents/" + id.String()
+}
+
+func (s *SEOService) publisherURL(id uuid.UUID) string {
+	return s.baseURL() + "/publishers/" + id.String()
+}
+
+// renderXML encodes a sitemap document with the XML declaration
+func renderXML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// serviceAccountPrefix starts every service account key, so they are told
+// apart from JWTs and leaked keys are easy to spot
+const serviceAccountPrefix = "esa_"
+
+// maxAssertionLifetime bounds how far in the future the expiry of a
+// service account's signed JWT may be
+const maxAssertionLifetime = 5 * time.Minute
+
+// serviceAccountScopes are the scopes a service account can be given
+var serviceAccountScopes = []models.ServiceAccountScope{
+	models.ServiceAccountScopePurchases,
+	models.ServiceAccountScopeAnalytics,
+}
+
+var (
+	// ErrInvalidServiceAccount is returned for an unknown or revoked service
+	// account key or an invalid signed JWT
+	ErrInvalidServiceAccount = errors.New("service account credentials are invalid or revoked")
+	// ErrInvalidScope is returned when creating a service account without
+	// scopes or with an unknown one
+	ErrInvalidScope = errors.New("scopes must be one or more of purchases:read and analytics:read")
+)
+
+// ServiceAccountService manages the read-only service accounts reporting
+// integrations authenticate as
+type ServiceAccountService struct {
+	db *gorm.DB
+}
+
+// NewServiceAccountService creates a new service account service
+func NewServiceAccountService(db *gorm.DB) *ServiceAccountService {
+	return &ServiceAccountService{db: db}
+}
+
+// Create creates a service account for a user. The key is only returned
+// here; afterwards only its prefix is known. A public key, if given, lets
+// the account authenticate with JWTs signed by its private key instead.
+func (s *ServiceAccountService) Create(ownerID uuid.UUID, name string, scopes []string, publicKey string) (*models.ServiceAccount, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", ErrInvalidScope
+	}
+	for _, scope := range scopes {
+		if !validScope(models.ServiceAccountScope(scope)) {
+			return nil, "", ErrInvalidScope
+		}
+	}
+	if publicKey = strings.TrimSpace(publicKey); publicKey != "" {
+		if _, _, err := parseSigningKey(publicKey); err != nil {
+			return nil, "", err
+		}
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	secret := serviceAccountPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	account := &models.ServiceAccount{
+		OwnerID:   ownerID,
+		Name:      name,
+		Scopes:    models.Tags(scopes),
+		Prefix:    secret[:len(serviceAccountPrefix)+6],
+		KeyHash:   hashToken(secret),
+		PublicKey: publicKey,
+	}
+	if err := s.db.Create(account).Error; err != nil {
+		return nil, "", err
+	}
+	return account, secret, nil
+}
+
+// List returns a user's service accounts that are not revoked
+func (s *ServiceAccountService) List(ownerID uuid.UUID) ([]models.ServiceAccount, error) {
+	var accounts []models.ServiceAccount
+	err := s.db.Where("owner_id = ? AND revoked_at IS NULL", ownerID).
+		Order("created_at DESC").
+		Find(&accounts).Error
+	return accounts, err
+}
+
+// Revoke permanently disables one of a user's service accounts
+func (s *ServiceAccountService) Revoke(ownerID, id uuid.UUID) (*models.ServiceAccount, error) {
+	var account models.ServiceAccount
+	if err := s.db.First(&account, "id = ? AND owner_id = ? AND revoked_at IS NULL", id, ownerID).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := s.db.Model(&account).Update("revoked_at", now).Error; err != nil {
+		return nil, err
+	}
+	account.RevokedAt = &now
+	return &account, nil
+}
+
+// Authenticate resolves a bearer credential, either a service account key
+// or a JWT signed by the account's private key, to the account and its
+// owner. The owner must still be active.
+func (s *ServiceAccountService) Authenticate(credential string) (*models.ServiceAccount, *models.User, error) {
+	var account models.ServiceAccount
+	if strings.HasPrefix(credential, serviceAccountPrefix) {
+		if err := s.db.First(&account, "key_hash = ? AND revoked_at IS NULL", hashToken(credential)).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, nil, ErrInvalidServiceAccount
+			}
+			return nil, nil, err
+		}
+	} else if err := s.verifyAssertion(credential, &account); err != nil {
+		return nil, nil, err
+	}
+
+	var owner models.User
+	if err := s.db.First(&owner, "id = ?", account.OwnerID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil, ErrInvalidServiceAccount
+		}
+		return nil, nil, err
+	}
+	if owner.Status != models.UserStatusActive {
+		return nil, nil, ErrUserInactive
+	}
+
+	now := time.Now()
+	if err := s.db.Model(&account).UpdateColumn("last_used_at", now).Error; err != nil {
+		return nil, nil, err
+	}
+	account.LastUsedAt = &now
+	return &account, &owner, nil
+}
+
+// verifyAssertion checks a JWT whose issuer is a service account ID
+// against the account's public key and loads the account into account.
+// The JWT must expire within maxAssertionLifetime.
+func (s *ServiceAccountService) verifyAssertion(assertion string, account *models.ServiceAccount) error {
+	var dbErr error
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(assertion, &claims, func(token *jwt.Token) (interface{}, error) {
+		id, err := uuid.Parse(claims.Issuer)
+		if err != nil {
+			return nil, ErrInvalidServiceAccount
+		}
+		if err := s.db.First(account, "id = ? AND revoked_at IS NULL AND public_key <> ''", id).Error; err != nil {
+			if err != gorm.ErrRecordNotFound {
+				dbErr = err
+			}
+			return nil, ErrInvalidServiceAccount
+		}
+		_, der, err := parseSigningKey(account.PublicKey)
+		if err != nil {
+			return nil, ErrInvalidServiceAccount
+		}
+		return x509.ParsePKIXPublicKey(der)
+	}, jwt.WithValidMethods([]string{"EdDSA", "ES256"}), jwt.WithExpirationRequired())
+	if dbErr != nil {
+		return dbErr
+	}
+	if err != nil || time.Until(claims.ExpiresAt.Time) > maxAssertionLifetime {
+		return ErrInvalidServiceAccount
+	}
+	return nil
+}
+
+// HasScope reports whether a service account was given a scope
+func HasScope(account *models.ServiceAccount, scope models.ServiceAccountScope) bool {
+	for _, granted := range account.Scopes {
+		if models.ServiceAccountScope(granted) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func validScope(scope models.ServiceAccountScope) bool {
+	for _, known := range serviceAccountScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
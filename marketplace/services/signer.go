@@ -0,0 +1,285 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/edgeplug/marketplace/config"
+)
+
+// kmsTimeout bounds each call to the KMS
+const kmsTimeout = 5 * time.Second
+
+// Signer is a P-256 signing key that may be held outside the process, in
+// a KMS or HSM. Sign takes a SHA-256 digest and returns an ASN.1 DER ECDSA
+// signature, as crypto.Signer does for ECDSA keys.
+type Signer interface {
+	crypto.Signer
+	// KeyID identifies the key to verifiers, e.g. as a JWT kid
+	KeyID() string
+}
+
+// NewSigner returns the signer of the configured provider
+func NewSigner(cfg config.SigningConfig) (Signer, error) {
+	switch cfg.Provider {
+	case "local":
+		return newLocalSigner(cfg)
+	case "aws_kms":
+		return newKMSSigner(cfg)
+	default:
+		return nil, fmt.Errorf("unsupported signing provider: %s", cfg.Provider)
+	}
+}
+
+// localSigner signs with a private key read from a PEM file
+type localSigner struct {
+	*ecdsa.PrivateKey
+	id string
+}
+
+func newLocalSigner(cfg config.SigningConfig) (*localSigner, error) {
+	var key *ecdsa.PrivateKey
+	if cfg.KeyFile == "" {
+		// Tokens signed with this key stop verifying on restart and are
+		// not accepted by other instances
+		log.Warn().Msg("No signing key configured, using an ephemeral key")
+		generated, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key = generated
+	} else {
+		data, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key: %w", err)
+		}
+		key, err = parseECPrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	id := cfg.KeyID
+	if id == "" {
+		id, _ = publicKeyID(&key.PublicKey)
+	}
+	return &localSigner{PrivateKey: key, id: id}, nil
+}
+
+func (s *localSigner) KeyID() string {
+	return s.id
+}
+
+// parseECPrivateKey parses a P-256 private key in SEC 1 or PKCS #8 PEM
+func parseECPrivateKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("signing key is not PEM encoded")
+	}
+
+	var key *ecdsa.PrivateKey
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		parsed, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key: %w", err)
+		}
+		key = parsed
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key: %w", err)
+		}
+		ecKey, ok := parsed.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("signing key is not an ECDSA key")
+		}
+		key = ecKey
+	default:
+		return nil, fmt.Errorf("unsupported signing key PEM type %q", block.Type)
+	}
+
+	if key.Curve != elliptic.P256() {
+		return nil, errors.New("signing key must use the P-256 curve")
+	}
+	return key, nil
+}
+
+// publicKeyID derives a key ID from the SHA-256 of the public key
+func publicKeyID(pub *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// kmsSigner signs with an asymmetric ECC_NIST_P256 key in AWS KMS, so the
+// private key never leaves the HSMs backing the KMS
+type kmsSigner struct {
+	endpoint  string
+	host      string
+	region    string
+	keyID     string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	public    *ecdsa.PublicKey
+}
+
+func newKMSSigner(cfg config.SigningConfig) (*kmsSigner, error) {
+	host := fmt.Sprintf("kms.%s.amazonaws.com", cfg.KMS.Region)
+	endpoint := "https://" + host + "/"
+	if cfg.KMS.Endpoint != "" {
+		endpoint = strings.TrimSuffix(cfg.KMS.Endpoint, "/") + "/"
+		host = strings.TrimSuffix(strings.SplitN(endpoint, "://", 2)[1], "/")
+	}
+	s := &kmsSigner{
+		endpoint:  endpoint,
+		host:      host,
+		region:    cfg.KMS.Region,
+		keyID:     cfg.KeyID,
+		accessKey: cfg.KMS.AccessKeyID,
+		secretKey: cfg.KMS.SecretAccessKey,
+		client:    &http.Client{Timeout: kmsTimeout},
+	}
+
+	var resp struct {
+		PublicKey string
+		KeySpec   string
+	}
+	if err := s.call("GetPublicKey", map[string]string{"KeyId": s.keyID}, &resp); err != nil {
+		return nil, fmt.Errorf("failed to get KMS public key: %w", err)
+	}
+	if resp.KeySpec != "ECC_NIST_P256" {
+		return nil, fmt.Errorf("KMS key spec must be ECC_NIST_P256, got %s", resp.KeySpec)
+	}
+	der, err := base64.StdEncoding.DecodeString(resp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("KMS key is not an ECDSA key")
+	}
+	s.public = ecPub
+	return s, nil
+}
+
+func (s *kmsSigner) KeyID() string {
+	return s.keyID
+}
+
+func (s *kmsSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *kmsSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, errors.New("KMS signer only signs SHA-256 digests")
+	}
+
+	var resp struct {
+		Signature string
+	}
+	if err := s.call("Sign", map[string]string{
+		"KeyId":            s.keyID,
+		"Message":          base64.StdEncoding.EncodeToString(digest),
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": "ECDSA_SHA_256",
+	}, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Signature)
+}
+
+// call invokes a KMS JSON API action, signing the request with Signature
+// Version 4
+func (s *kmsSigner) call(action string, input, output interface{}) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kmsTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	target := "TrentService." + action
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Target", target)
+
+	payloadHash := sha256.Sum256(body)
+	signedHeaders := "content-type;host;x-amz-date;x-amz-target"
+	canonicalRequest := strings.Join([]string{
+		http.MethodPost,
+		"/",
+		"",
+		"content-type:application/x-amz-json-1.1\nhost:" + s.host + "\nx-amz-date:" + amzDate + "\nx-amz-target:" + target + "\n",
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, sigV4Scope(now, s.region, "kms"), signedHeaders,
+		sigV4Signature(now, s.region, "kms", s.secretKey, canonicalRequest)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("kms %s: %s: %s", action, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(output)
+}
+
+// SigningKeyJWK returns the signer's public key as a JSON Web Key, for
+// verifiers to fetch
+func SigningKeyJWK(signer Signer) map[string]string {
+	pub := signer.Public().(*ecdsa.PublicKey)
+	coordinate := func(n interface{ FillBytes([]byte) []byte }) string {
+		return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32)))
+	}
+	return map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   coordinate(pub.X),
+		"y":   coordinate(pub.Y),
+		"kid": signer.KeyID(),
+		"alg": "ES256",
+		"use": "sig",
+	}
+}
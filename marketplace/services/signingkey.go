@@ -0,0 +1,214 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// maxSigningKeys caps the active signing keys of a publisher
+const maxSigningKeys = 10
+
+var (
+	// ErrInvalidSigningKey is returned for a public key that is not a PEM
+	// encoded Ed25519 or P-256 ECDSA key
+	ErrInvalidSigningKey = errors.New("signing key must be a PEM encoded Ed25519 or ECDSA P-256 public key")
+	// ErrSigningKeyExists is returned when registering a key twice
+	ErrSigningKeyExists = errors.New("signing key is already registered")
+	// ErrSigningKeyLimit is returned when a publisher has the maximum number
+	// of active keys
+	ErrSigningKeyLimit = errors.New("maximum number of signing keys reached")
+	// ErrSigningKeyRevoked is returned when a release was signed with a key
+	// revoked since
+	ErrSigningKeyRevoked = errors.New("the release's signing key was revoked; upload a binary signed with another key")
+	// ErrSignatureRequired is returned when publishing a release without a
+	// signed binary
+	ErrSignatureRequired = errors.New("upload a signed binary before publishing this version")
+	// ErrInvalidSignature is returned for a signature that does not verify
+	// against the binary with the given key
+	ErrInvalidSignature = errors.New("signature does not match the binary")
+)
+
+// BinarySignature is the detached signature uploaded with a binary
+type BinarySignature struct {
+	KeyID     uuid.UUID
+	Signature string // base64
+}
+
+// SigningKeyService manages the keys publishers sign agent binaries with
+type SigningKeyService struct {
+	db *gorm.DB
+}
+
+// NewSigningKeyService creates a new signing key service
+func NewSigningKeyService(db *gorm.DB) *SigningKeyService {
+	return &SigningKeyService{db: db}
+}
+
+// RegisterKey registers a publisher's public key. The algorithm is taken
+// from the key.
+func (s *SigningKeyService) RegisterKey(userID uuid.UUID, name, publicKey string) (*models.PublisherKey, error) {
+	algorithm, der, err := parseSigningKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	key := models.PublisherKey{
+		UserID:      userID,
+		Name:        name,
+		Algorithm:   algorithm,
+		PublicKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&models.PublisherKey{}).
+			Where("user_id = ? AND fingerprint = ?", userID, key.Fingerprint).
+			Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return ErrSigningKeyExists
+		}
+
+		var active int64
+		if err := tx.Model(&models.PublisherKey{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Count(&active).Error; err != nil {
+			return err
+		}
+		if active >= maxSigningKeys {
+			return ErrSigningKeyLimit
+		}
+		return tx.Create(&key).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// GetKeys returns a publisher's signing keys, revoked ones included
+func (s *SigningKeyService) GetKeys(userID uuid.UUID) ([]models.PublisherKey, error) {
+	var keys []models.PublisherKey
+	if err := s.db.Where("user_id = ?", userID).Order("created_at").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeKey revokes one of a publisher's keys. Releases already published
+// keep their signature; drafts and staged releases signed with it must be
+// signed again before they are published.
+func (s *SigningKeyService) RevokeKey(userID, id uuid.UUID) (*models.PublisherKey, error) {
+	var key models.PublisherKey
+	if err := s.db.First(&key, "id = ? AND user_id = ?", id, userID).Error; err != nil {
+		return nil, err
+	}
+	if key.RevokedAt != nil {
+		return &key, nil
+	}
+
+	now := time.Now()
+	if err := s.db.Model(&key).Update("revoked_at", &now).Error; err != nil {
+		return nil, err
+	}
+	key.RevokedAt = &now
+	return &key, nil
+}
+
+// signingKeyFor loads the key a binary of agent was signed with. It must be
+// active and belong to the publisher or to an owner or maintainer of the
+// agent's organization.
+func signingKeyFor(db *gorm.DB, agent *models.Agent, keyID uuid.UUID) (*models.PublisherKey, error) {
+	var key models.PublisherKey
+	if err := db.First(&key, "id = ?", keyID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrInvalidSignature
+		}
+		return nil, err
+	}
+	if key.RevokedAt != nil {
+		return nil, ErrSigningKeyRevoked
+	}
+
+	switch role, err := agentRole(db, agent, key.UserID); err {
+	case nil:
+		if role == models.OrgRoleViewer {
+			return nil, ErrInvalidSignature
+		}
+	case ErrNotOrgMember:
+		return nil, ErrInvalidSignature
+	default:
+		return nil, err
+	}
+	return &key, nil
+}
+
+// verifyBinarySignature checks a base64 signature of a binary's SHA-256
+// digest against key
+func verifyBinarySignature(key *models.PublisherKey, digest []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	block, _ := pem.Decode([]byte(key.PublicKey))
+	if block == nil {
+		return ErrInvalidSignature
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	switch pub := parsed.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, digest, sig)
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, digest, sig)
+	}
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// parseSigningKey parses a PKIX PEM public key, as written by cosign
+// generate-key-pair or openssl pkey -pubout
+func parseSigningKey(publicKey string) (models.SignatureAlgorithm, []byte, error) {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(publicKey)))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return "", nil, ErrInvalidSigningKey
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", nil, ErrInvalidSigningKey
+	}
+
+	switch pub := parsed.(type) {
+	case ed25519.PublicKey:
+		return models.SignatureAlgorithmEd25519, block.Bytes, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return "", nil, ErrInvalidSigningKey
+		}
+		return models.SignatureAlgorithmECDSAP256, block.Bytes, nil
+	default:
+		return "", nil, ErrInvalidSigningKey
+	}
+}
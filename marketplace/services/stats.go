@@ -0,0 +1,151 @@
+package services
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// OtherCategory groups categories too small to be reported on their own
+const OtherCategory = "other"
+
+// CategoryStats is the public statistics of one agent category
+type CategoryStats struct {
+	Category      string  `json:"category"`
+	Agents        int64   `json:"agents"`
+	Downloads     int64   `json:"downloads"`
+	AverageRating float64 `json:"average_rating"` // weighted by review count
+}
+
+// PublicStats is the anonymized health of the marketplace. It only holds
+// aggregates; categories with fewer agents than the configured minimum are
+// folded into "other" so no single publisher can be singled out.
+type PublicStats struct {
+	PublishedAgents int64           `json:"published_agents"`
+	Publishers      int64           `json:"publishers"`
+	TotalDownloads  int64           `json:"total_downloads"`
+	AverageRating   float64         `json:"average_rating"`
+	Categories      []CategoryStats `json:"categories"`
+	GeneratedAt     time.Time       `json:"generated_at"`
+}
+
+// PublicStatsService computes the public marketplace statistics and caches
+// them in process
+type PublicStatsService struct {
+	db  *gorm.DB
+	cfg config.PublicStatsConfig
+
+	mu        sync.Mutex
+	cached    *PublicStats
+	expiresAt time.Time
+}
+
+// NewPublicStatsService creates a new public stats service
+func NewPublicStatsService(db *gorm.DB, cfg config.PublicStatsConfig) *PublicStatsService {
+	return &PublicStatsService{db: db, cfg: cfg}
+}
+
+// Get returns the cached statistics, recomputing them once they expire.
+// Concurrent callers wait for a single recomputation.
+func (s *PublicStatsService) Get() (*PublicStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cached != nil && time.Now().Before(s.expiresAt) {
+		return s.cached, nil
+	}
+
+	stats, err := s.compute()
+	if err != nil {
+		return nil, err
+	}
+	s.cached = stats
+	s.expiresAt = stats.GeneratedAt.Add(s.cfg.CacheTTL)
+	return stats, nil
+}
+
+// ExpiresAt returns when the cached statistics will be recomputed
+func (s *PublicStatsService) ExpiresAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiresAt
+}
+
+// compute aggregates the statistics from the database
+func (s *PublicStatsService) compute() (*PublicStats, error) {
+	published := func() *gorm.DB {
+		return s.db.Model(&models.Agent{}).Where("status = ?", models.AgentStatusPublished)
+	}
+
+	var rows []struct {
+		Category  string
+		Agents    int64
+		Downloads int64
+		Reviews   int64
+		RatingSum float64
+	}
+	if err := published().
+		Select("category, COUNT(*) AS agents, COALESCE(SUM(downloads), 0) AS downloads, " +
+			"COALESCE(SUM(review_count), 0) AS reviews, COALESCE(SUM(rating * review_count), 0) AS rating_sum").
+		Group("category").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	stats := PublicStats{GeneratedAt: time.Now().UTC(), Categories: []CategoryStats{}}
+	if err := published().Distinct("publisher_id").Count(&stats.Publishers).Error; err != nil {
+		return nil, err
+	}
+
+	var other CategoryStats
+	var otherReviews int64
+	var otherRatingSum float64
+	var totalReviews int64
+	var totalRatingSum float64
+	for _, row := range rows {
+		stats.PublishedAgents += row.Agents
+		stats.TotalDownloads += row.Downloads
+		totalReviews += row.Reviews
+		totalRatingSum += row.RatingSum
+
+		if row.Agents < int64(s.cfg.MinCategorySize) || row.Category == OtherCategory {
+			other.Agents += row.Agents
+			other.Downloads += row.Downloads
+			otherReviews += row.Reviews
+			otherRatingSum += row.RatingSum
+			continue
+		}
+		stats.Categories = append(stats.Categories, CategoryStats{
+			Category:      row.Category,
+			Agents:        row.Agents,
+			Downloads:     row.Downloads,
+			AverageRating: averageRating(row.RatingSum, row.Reviews),
+		})
+	}
+
+	sort.Slice(stats.Categories, func(i, j int) bool {
+		return stats.Categories[i].Agents > stats.Categories[j].Agents
+	})
+	if other.Agents > 0 {
+		other.Category = OtherCategory
+		other.AverageRating = averageRating(otherRatingSum, otherReviews)
+		stats.Categories = append(stats.Categories, other)
+	}
+	stats.AverageRating = averageRating(totalRatingSum, totalReviews)
+	return &stats, nil
+}
+
+// averageRating returns a rating average rounded to two decimals, or 0
+// without reviews
+func averageRating(sum float64, reviews int64) float64 {
+	if reviews == 0 {
+		return 0
+	}
+	return math.Round(sum/float64(reviews)*100) / 100
+}
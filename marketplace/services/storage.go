@@ -0,0 +1,388 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgeplug/marketplace/config"
+)
+
+// LocalFilesPath is the URL path the local storage backend's files are served under
+const LocalFilesPath = "/files"
+
+// ErrObjectNotFound is returned when reading an object that is not stored
+var ErrObjectNotFound = errors.New("object not found")
+
+// Storage stores uploaded agent files
+type Storage interface {
+	// Put stores size bytes from r under key and returns the object's URL
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error)
+	// Get opens the object stored under key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key
+	Delete(ctx context.Context, key string) error
+	// PresignedURL returns a URL that reads the object stored under key
+	// without further authentication until it expires
+	PresignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// NewStorage creates the storage backend selected in the configuration
+func NewStorage(cfg config.StorageConfig) (Storage, error) {
+	switch cfg.Type {
+	case "local":
+		if err := os.MkdirAll(cfg.LocalDir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create storage directory: %w", err)
+		}
+		return &localStorage{dir: cfg.LocalDir, secret: []byte(cfg.URLSecret)}, nil
+	case "s3":
+		return &s3Storage{
+			scheme:    "https",
+			host:      fmt.Sprintf("%s.s3.%s.amazonaws.com", cfg.S3.Bucket, cfg.S3.Region),
+			region:    cfg.S3.Region,
+			accessKey: cfg.S3.AccessKeyID,
+			secretKey: cfg.S3.SecretAccessKey,
+			client:    &http.Client{},
+		}, nil
+	case "minio":
+		scheme := "http"
+		if cfg.MinIO.UseSSL {
+			scheme = "https"
+		}
+		return &s3Storage{
+			scheme:    scheme,
+			host:      cfg.MinIO.Endpoint,
+			bucket:    cfg.MinIO.Bucket,
+			region:    "us-east-1",
+			accessKey: cfg.MinIO.AccessKeyID,
+			secretKey: cfg.MinIO.SecretAccessKey,
+			client:    &http.Client{},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported storage type: %s", cfg.Type)
+	}
+}
+
+// localStorage keeps files in a directory on the local disk. It serves them
+// itself under LocalFilesPath, but only through URLs signed with its secret.
+type localStorage struct {
+	dir    string
+	secret []byte
+}
+
+func (s *localStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	// Write to a temporary file first so a failed upload never replaces
+	// the existing object
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return LocalFilesPath + "/" + key, nil
+}
+
+func (s *localStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return f, err
+}
+
+func (s *localStorage) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localStorage) PresignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	return LocalFilesPath + "/" + key + "?expires=" + expires + "&signature=" + s.signature(key, expires), nil
+}
+
+// ServeHTTP serves a file through a presigned URL, with LocalFilesPath
+// already stripped from the request path. Range requests are honored, so
+// downloads can be split and resumed.
+func (s *localStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	expires := r.URL.Query().Get("expires")
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix ||
+		!hmac.Equal([]byte(r.URL.Query().Get("signature")), []byte(s.signature(key, expires))) {
+		http.Error(w, "invalid or expired link", http.StatusForbidden)
+		return
+	}
+
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	// A strong ETag lets devices resume ranges with If-Range, so a file
+	// replaced in the meantime is sent whole rather than spliced
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	http.ServeContent(w, r, path.Base(key), info.ModTime(), f)
+}
+
+// path returns the file an object is kept in
+func (s *localStorage) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+// signature signs a key and expiry time for a presigned URL
+func (s *localStorage) signature(key, expires string) string {
+	return hex.EncodeToString(hmacSHA256(s.secret, key+"\n"+expires))
+}
+
+// s3Storage talks to Amazon S3 or an S3-compatible server such as MinIO
+// using Signature Version 4. The bucket is addressed through the host for
+// S3 and through the path otherwise.
+type s3Storage struct {
+	scheme    string
+	host      string
+	bucket    string // set for path-style addressing
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	url := s.objectURL(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, r)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	resp, err := s.do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return url, nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) PresignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := s.scope(now)
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    s.accessKey + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       strconv.Itoa(int(expiry.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := make([]string, len(names))
+	for i, name := range names {
+		params[i] = s3EscapeComponent(name) + "=" + s3EscapeComponent(query[name])
+	}
+	canonicalQuery := strings.Join(params, "&")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		s.objectPath(key),
+		canonicalQuery,
+		"host:" + s.host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	signature := s.signature(now, canonicalRequest)
+	return s.objectURL(key) + "?" + canonicalQuery + "&X-Amz-Signature=" + signature, nil
+}
+
+// objectPath returns the escaped request path of an object
+func (s *s3Storage) objectPath(key string) string {
+	path := "/" + s3Escape(key)
+	if s.bucket != "" {
+		path = "/" + s.bucket + path
+	}
+	return path
+}
+
+// objectURL returns the URL of an object
+func (s *s3Storage) objectURL(key string) string {
+	return s.scheme + "://" + s.host + s.objectPath(key)
+}
+
+// do signs and sends a request. Any non-2xx response is returned as an
+// error, otherwise the caller must close the response body.
+func (s *s3Storage) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ErrObjectNotFound
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("storage %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// sign adds a Signature Version 4 Authorization header to a request. The
+// payload is left unsigned so uploads can be streamed.
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{
+		"host":                 s.host,
+		"x-amz-content-sha256": "UNSIGNED-PAYLOAD",
+		"x-amz-date":           amzDate,
+	}
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		headers = append([]string{"content-type"}, headers...)
+		values["content-type"] = contentType
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headers {
+		canonicalHeaders.WriteString(name + ":" + values[name] + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, s.scope(now), signedHeaders, s.signature(now, canonicalRequest)))
+}
+
+// scope returns the credential scope of requests signed at now
+func (s *s3Storage) scope(now time.Time) string {
+	return sigV4Scope(now, s.region, "s3")
+}
+
+// signature signs a canonical request with the key derived for its day
+func (s *s3Storage) signature(now time.Time, canonicalRequest string) string {
+	return sigV4Signature(now, s.region, "s3", s.secretKey, canonicalRequest)
+}
+
+// sigV4Scope returns the Signature Version 4 credential scope of requests
+// to an AWS service signed at now
+func sigV4Scope(now time.Time, region, service string) string {
+	return now.Format("20060102") + "/" + region + "/" + service + "/aws4_request"
+}
+
+// sigV4Signature signs a canonical request with the key derived for its
+// day, region and service
+func sigV4Signature(now time.Time, region, service, secretKey, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + sigV4Scope(now, region, service) + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape URI-encodes an object key as SigV4 requires, leaving the
+// slashes between path segments
+func s3Escape(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3EscapeComponent URI-encodes a query parameter name or value
+func s3EscapeComponent(value string) string {
+	return strings.ReplaceAll(s3Escape(value), "/", "%2F")
+}
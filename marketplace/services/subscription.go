@@ -0,0 +1,493 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrInvalidPlan is returned for a pricing plan without a name, a known
+	// interval or a positive price
+	ErrInvalidPlan = errors.New("a plan needs a name, an interval of one_time, monthly, annual or per_device, and a positive price")
+	// ErrPlanNotAvailable is returned for a plan that is retired or whose
+	// agent is not published
+	ErrPlanNotAvailable = errors.New("pricing plan is not available")
+	// ErrPlanNotRecurring is returned when subscribing to a one-time plan,
+	// or checking out a recurring one
+	ErrPlanNotRecurring = errors.New("one-time plans are bought through checkout, recurring plans through a subscription")
+	// ErrAlreadySubscribed is returned when the buyer already has a
+	// subscription to the agent that is not canceled
+	ErrAlreadySubscribed = errors.New("already subscribed to this agent")
+	// ErrSubscriptionClosed is returned when canceling a subscription that
+	// already ended
+	ErrSubscriptionClosed = errors.New("subscription is already canceled")
+	// ErrInvalidQuantity is returned for a quantity other than 1 on a plan
+	// that is not per device
+	ErrInvalidQuantity = errors.New("only per-device plans cover more than one device")
+	// ErrInvalidPaymentEvent is returned for a webhook event whose signature
+	// does not match or is too old
+	ErrInvalidPaymentEvent = errors.New("payment event signature is not valid")
+	// ErrPaymentWebhookDisabled is returned for webhook events when no
+	// signing secret is configured
+	ErrPaymentWebhookDisabled = errors.New("payment webhooks are not configured")
+)
+
+// entitlingSubscriptions are the statuses in which a subscription entitles
+// its buyer. A past-due one does until the grace period ends.
+var entitlingSubscriptions = []models.SubscriptionStatus{
+	models.SubscriptionStatusActive,
+	models.SubscriptionStatusPastDue,
+}
+
+// SubscriptionService manages agents' pricing plans and buyers'
+// subscriptions to them. Billing is left to the payment provider, whose
+// webhook events activate, renew and end subscriptions.
+type SubscriptionService struct {
+	db            *gorm.DB
+	cfg           config.SubscriptionsConfig
+	webhookSecret string
+	payments      PaymentProvider
+}
+
+// NewSubscriptionService creates a new subscription service
+func NewSubscriptionService(db *gorm.DB, cfg config.SubscriptionsConfig, webhookSecret string, payments PaymentProvider) *SubscriptionService {
+	return &SubscriptionService{db: db, cfg: cfg, webhookSecret: webhookSecret, payments: payments}
+}
+
+// GetPlans returns an agent's pricing plans, cheapest first. Retired plans
+// are only included if asked for.
+func (s *SubscriptionService) GetPlans(agentID uuid.UUID, retired bool) ([]models.PricingPlan, error) {
+	var plans []models.PricingPlan
+	query := s.db.Where("agent_id = ?", agentID)
+	if !retired {
+		query = query.Where("active = ?", true)
+	}
+	if err := query.Order("price_minor, created_at").Find(&plans).Error; err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+// CreatePlan adds a pricing plan to an agent
+func (s *SubscriptionService) CreatePlan(agentID uuid.UUID, plan *models.PricingPlan) error {
+	switch plan.Interval {
+	case models.PlanIntervalOneTime, models.PlanIntervalMonthly, models.PlanIntervalAnnual, models.PlanIntervalPerDevice:
+	default:
+		return ErrInvalidPlan
+	}
+	if strings.TrimSpace(plan.Name) == "" || plan.Price <= 0 {
+		return ErrInvalidPlan
+	}
+	plan.AgentID = agentID
+	plan.Currency = models.NormalizeCurrency(plan.Currency)
+	plan.Active = true
+	if err := s.db.Create(plan).Error; err != nil {
+		return err
+	}
+	plan.PriceDisplay = models.FormatMoney(plan.Price, plan.Currency)
+	return nil
+}
+
+// RetirePlan stops a plan from taking new buyers. Its subscriptions renew
+// as before.
+func (s *SubscriptionService) RetirePlan(agentID, planID uuid.UUID) error {
+	result := s.db.Model(&models.PricingPlan{}).Where("id = ? AND agent_id = ?", planID, agentID).Update("active", false)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// availablePlan returns an active plan of a published agent
+func availablePlan(db *gorm.DB, planID uuid.UUID) (*models.PricingPlan, error) {
+	var plan models.PricingPlan
+	err := db.Where("id = ? AND active = ?", planID, true).
+		Where("agent_id IN (?)", db.Model(&models.Agent{}).Select("id").Where("status = ?", models.AgentStatusPublished)).
+		First(&plan).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrPlanNotAvailable
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// Subscribe records a buyer's subscription to a recurring plan, made with
+// the payment provider as providerID. It stays incomplete until the
+// provider reports its first payment.
+func (s *SubscriptionService) Subscribe(buyerID, planID uuid.UUID, providerID string, quantity int) (*models.Subscription, error) {
+	plan, err := availablePlan(s.db, planID)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Interval == models.PlanIntervalOneTime {
+		return nil, ErrPlanNotRecurring
+	}
+	if quantity < 1 || (quantity > 1 && plan.Interval != models.PlanIntervalPerDevice) {
+		return nil, ErrInvalidQuantity
+	}
+
+	subscription := models.Subscription{
+		BuyerID:                buyerID,
+		AgentID:                plan.AgentID,
+		PlanID:                 plan.ID,
+		ProviderSubscriptionID: providerID,
+		Quantity:               quantity,
+		Status:                 models.SubscriptionStatusIncomplete,
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		// Serializes a buyer's subscribing, so two requests cannot both pass the check
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&models.User{}, "id = ?", buyerID).Error; err != nil {
+			return err
+		}
+		var open int64
+		if err := tx.Model(&models.Subscription{}).
+			Where("buyer_id = ? AND agent_id = ? AND status <> ?", buyerID, plan.AgentID, models.SubscriptionStatusCanceled).
+			Count(&open).Error; err != nil {
+			return err
+		}
+		if open > 0 {
+			return ErrAlreadySubscribed
+		}
+		return tx.Create(&subscription).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	subscription.Plan = *plan
+	return &subscription, nil
+}
+
+// GetSubscriptions returns a buyer's subscriptions, newest first
+func (s *SubscriptionService) GetSubscriptions(buyerID uuid.UUID, page, limit int) ([]models.Subscription, int64, error) {
+	var subscriptions []models.Subscription
+	var total int64
+
+	query := s.db.Model(&models.Subscription{}).Where("buyer_id = ?", buyerID)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Preload("Plan").Preload("Agent").Order("created_at DESC").Offset(offset).Limit(limit).Find(&subscriptions).Error; err != nil {
+		return nil, 0, err
+	}
+	return subscriptions, total, nil
+}
+
+// Cancel stops a buyer's subscription from renewing. It stays entitled to
+// the end of the period already paid for; one never paid for ends now.
+func (s *SubscriptionService) Cancel(ctx context.Context, buyerID, id uuid.UUID) (*models.Subscription, error) {
+	var subscription models.Subscription
+	if err := s.db.First(&subscription, "id = ? AND buyer_id = ?", id, buyerID).Error; err != nil {
+		return nil, err
+	}
+	if subscription.Status == models.SubscriptionStatusCanceled {
+		return nil, ErrSubscriptionClosed
+	}
+	if err := s.payments.CancelSubscription(ctx, subscription.ProviderSubscriptionID); err != nil {
+		return nil, err
+	}
+
+	updates := map[string]interface{}{"cancel_at_period_end": true}
+	if subscription.Status == models.SubscriptionStatusIncomplete {
+		updates["status"] = models.SubscriptionStatusCanceled
+		updates["canceled_at"] = time.Now()
+	}
+	if err := s.db.Model(&subscription).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	return &subscription, s.db.Preload("Plan").First(&subscription, "id = ?", id).Error
+}
+
+// paymentEvent is a payment provider webhook event, in Stripe's format
+type paymentEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+type providerInvoice struct {
+	Subscription string `json:"subscription"`
+	Lines        struct {
+		Data []struct {
+			Period struct {
+				Start int64 `json:"start"`
+				End   int64 `json:"end"`
+			} `json:"period"`
+		} `json:"data"`
+	} `json:"lines"`
+}
+
+type providerSubscription struct {
+	ID                 string `json:"id"`
+	Status             string `json:"status"`
+	CurrentPeriodStart int64  `json:"current_period_start"`
+	CurrentPeriodEnd   int64  `json:"current_period_end"`
+	CancelAtPeriodEnd  bool   `json:"cancel_at_period_end"`
+}
+
+// HandleEvent applies a payment provider webhook event to the subscription
+// it concerns. signature is the "t=<unix time>,v1=<hex HMAC-SHA256>"
+// header. Events are applied once; redeliveries and events about other
+// payments are accepted and ignored.
+func (s *SubscriptionService) HandleEvent(payload []byte, signature string) error {
+	if s.webhookSecret == "" {
+		return ErrPaymentWebhookDisabled
+	}
+	if !s.validSignature(payload, signature) {
+		return ErrInvalidPaymentEvent
+	}
+	var event paymentEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.ID == "" {
+		return ErrInvalidPaymentEvent
+	}
+
+	var providerID string
+	var invoice providerInvoice
+	var update providerSubscription
+	switch event.Type {
+	case "invoice.paid", "invoice.payment_failed":
+		if err := json.Unmarshal(event.Data.Object, &invoice); err != nil {
+			return ErrInvalidPaymentEvent
+		}
+		providerID = invoice.Subscription
+	case "customer.subscription.updated", "customer.subscription.deleted":
+		if err := json.Unmarshal(event.Data.Object, &update); err != nil {
+			return ErrInvalidPaymentEvent
+		}
+		providerID = update.ID
+	default:
+		return nil
+	}
+	if providerID == "" {
+		return nil
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		recorded := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.PaymentEvent{
+			ID:         event.ID,
+			Type:       event.Type,
+			ReceivedAt: time.Now(),
+		})
+		if recorded.Error != nil || recorded.RowsAffected == 0 {
+			return recorded.Error
+		}
+
+		var subscription models.Subscription
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Agent").
+			First(&subscription, "provider_subscription_id = ?", providerID).Error
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if subscription.Status == models.SubscriptionStatusCanceled {
+			return nil
+		}
+
+		switch event.Type {
+		case "invoice.paid":
+			return s.renew(tx, &subscription, &invoice)
+		case "invoice.payment_failed":
+			return s.paymentFailed(tx, &subscription)
+		case "customer.subscription.deleted":
+			return s.end(tx, &subscription, "ended")
+		}
+		if update.Status == "canceled" {
+			return s.end(tx, &subscription, "ended")
+		}
+		updates := map[string]interface{}{"cancel_at_period_end": update.CancelAtPeriodEnd}
+		if update.CurrentPeriodEnd > 0 {
+			updates["current_period_start"] = time.Unix(update.CurrentPeriodStart, 0)
+			updates["current_period_end"] = time.Unix(update.CurrentPeriodEnd, 0)
+		}
+		return tx.Model(&subscription).Updates(updates).Error
+	})
+}
+
+// validSignature checks a webhook signature header against the payload,
+// refusing signatures older than the tolerance to stop replays
+func (s *SubscriptionService) validSignature(payload []byte, header string) bool {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(signedAt, 0)); age > s.cfg.WebhookTolerance || age < -s.cfg.WebhookTolerance {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.webhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	for _, signature := range signatures {
+		if sig, err := hex.DecodeString(signature); err == nil && hmac.Equal(sig, expected) {
+			return true
+		}
+	}
+	return false
+}
+
+// renew activates a subscription for the period an invoice paid for
+func (s *SubscriptionService) renew(tx *gorm.DB, subscription *models.Subscription, invoice *providerInvoice) error {
+	updates := map[string]interface{}{
+		"status":          models.SubscriptionStatusActive,
+		"failed_payments": 0,
+		"past_due_since":  nil,
+	}
+	var start, end int64
+	for _, line := range invoice.Lines.Data {
+		if start == 0 || line.Period.Start < start {
+			start = line.Period.Start
+		}
+		if line.Period.End > end {
+			end = line.Period.End
+		}
+	}
+	if end > 0 {
+		updates["current_period_start"] = time.Unix(start, 0)
+		updates["current_period_end"] = time.Unix(end, 0)
+	}
+	return tx.Model(subscription).Updates(updates).Error
+}
+
+// paymentFailed puts a subscription in dunning. Its buyer keeps access for
+// the grace period while the provider retries.
+func (s *SubscriptionService) paymentFailed(tx *gorm.DB, subscription *models.Subscription) error {
+	since := time.Now()
+	if subscription.PastDueSince != nil {
+		since = *subscription.PastDueSince
+	}
+	if err := tx.Model(subscription).Updates(map[string]interface{}{
+		"status":          models.SubscriptionStatusPastDue,
+		"past_due_since":  since,
+		"failed_payments": gorm.Expr("failed_payments + 1"),
+	}).Error; err != nil {
+		return err
+	}
+	return notify(tx, &models.Notification{
+		UserID: subscription.BuyerID,
+		Type:   models.NotificationTypeSubscription,
+		Title:  "Payment for your " + subscription.Agent.Name + " subscription failed",
+		Body: fmt.Sprintf("Update your payment method before %s to keep access to %s.",
+			since.Add(s.cfg.GracePeriod).Format("2006-01-02"), subscription.Agent.Name),
+		Link: "/subscriptions",
+	})
+}
+
+// end cancels a subscription now and tells its buyer why
+func (s *SubscriptionService) end(tx *gorm.DB, subscription *models.Subscription, why string) error {
+	if err := tx.Model(subscription).Updates(map[string]interface{}{
+		"status":      models.SubscriptionStatusCanceled,
+		"canceled_at": time.Now(),
+	}).Error; err != nil {
+		return err
+	}
+	return notify(tx, &models.Notification{
+		UserID: subscription.BuyerID,
+		Type:   models.NotificationTypeSubscription,
+		Title:  "Your " + subscription.Agent.Name + " subscription " + why,
+		Body:   "You no longer have access to new releases of " + subscription.Agent.Name + ".",
+		Link:   fmt.Sprintf("/agents/%s", subscription.AgentID),
+	})
+}
+
+// Run ends lapsed subscriptions every poll interval until ctx is done
+func (s *SubscriptionService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.ProcessLapsed(); err != nil {
+				log.Error().Err(err).Msg("Failed to end lapsed subscriptions")
+			}
+		}
+	}
+}
+
+// ProcessLapsed ends subscriptions past due for longer than the grace
+// period, canceled ones whose paid period is over, and ones never paid for
+// within the grace period, in case the provider's events were missed
+func (s *SubscriptionService) ProcessLapsed() error {
+	now := time.Now()
+	cutoff := now.Add(-s.cfg.GracePeriod)
+	lapsed := []struct {
+		why   string
+		where func(*gorm.DB) *gorm.DB
+	}{
+		{"ended after failed payments", func(q *gorm.DB) *gorm.DB {
+			return q.Where("status = ? AND past_due_since < ?", models.SubscriptionStatusPastDue, cutoff)
+		}},
+		{"ended", func(q *gorm.DB) *gorm.DB {
+			return q.Where("status = ? AND cancel_at_period_end AND current_period_end < ?", models.SubscriptionStatusActive, now)
+		}},
+		{"was never paid for", func(q *gorm.DB) *gorm.DB {
+			return q.Where("status = ? AND created_at < ?", models.SubscriptionStatusIncomplete, cutoff)
+		}},
+	}
+
+	for _, rule := range lapsed {
+		var ids []uuid.UUID
+		if err := rule.where(s.db.Model(&models.Subscription{})).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		for _, id := range ids {
+			err := s.db.Transaction(func(tx *gorm.DB) error {
+				var subscription models.Subscription
+				// Checked again under the lock, as an event may have renewed it
+				err := rule.where(tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Agent")).
+					First(&subscription, "id = ?", id).Error
+				if err == gorm.ErrRecordNotFound {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				return s.end(tx, &subscription, rule.why)
+			})
+			if err != nil {
+				return fmt.Errorf("subscription %s: %w", id, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+const (
+	// telemetryPartitionPrefix names the daily partitions, followed by the
+	// day as YYYYMMDD
+	telemetryPartitionPrefix = "telemetry_samples_"
+	// telemetryPartitionsAhead is how many days of partitions are created
+	// past today, so samples keep landing while the job is down
+	telemetryPartitionsAhead = 3
+	// telemetryClockSkew is how far in the future a device clock may be
+	telemetryClockSkew = 5 * time.Minute
+)
+
+var (
+	// ErrTelemetryBatchTooLarge is returned for a batch over the configured size
+	ErrTelemetryBatchTooLarge = errors.New("too many samples in one batch")
+	// ErrInvalidTelemetryRange is returned for an aggregation range that is
+	// empty or longer than the retention period
+	ErrInvalidTelemetryRange = errors.New("range must end after it starts and fit in the retention period")
+)
+
+// TelemetryInput is one runtime measurement reported for a deployment. The
+// version defaults to the release the device last reported running.
+type TelemetryInput struct {
+	DeploymentID     uuid.UUID
+	AgentID          uuid.UUID // identifies the deployment on the device API
+	Version          string
+	RecordedAt       time.Time
+	InferenceLatency *int
+	TripEvents       int
+	MemoryUsed       *int64
+}
+
+// TelemetryRejection is a sample of a batch that was not stored, by its
+// position in the batch
+type TelemetryRejection struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// VersionTelemetry is the real-world runtime of one release of an agent
+// over a period. Latencies are in microseconds.
+type VersionTelemetry struct {
+	Version    string   `json:"version"`
+	Samples    int64    `json:"samples"`
+	Devices    int64    `json:"devices"`
+	LatencyP50 *float64 `json:"latency_p50"`
+	LatencyP95 *float64 `json:"latency_p95"`
+	LatencyP99 *float64 `json:"latency_p99"`
+	LatencyMax *int     `json:"latency_max"`
+	TripEvents int64    `json:"trip_events"`
+	MemoryAvg  *float64 `json:"memory_avg"` // in bytes
+	MemoryMax  *int64   `json:"memory_max"`
+}
+
+// TelemetryBucket is the runtime of a release over one hour or day
+type TelemetryBucket struct {
+	Start      time.Time `json:"start"`
+	Version    string    `json:"version"`
+	Samples    int64     `json:"samples"`
+	LatencyP50 *float64  `json:"latency_p50"`
+	LatencyP95 *float64  `json:"latency_p95"`
+	LatencyP99 *float64  `json:"latency_p99"`
+	TripEvents int64     `json:"trip_events"`
+}
+
+// TelemetrySharing is whether the telemetry of a buyer's deployments of an
+// agent reaches its publisher
+type TelemetrySharing struct {
+	AgentID   uuid.UUID `json:"agent_id"`
+	AgentName string    `json:"agent_name"`
+	OptedOut  bool      `json:"opted_out"`
+	Shared    bool      `json:"shared"` // consented and not opted out
+}
+
+// TelemetryService ingests agent runtime telemetry from devices and
+// aggregates it for publishers, from the buyers who consent to sharing it
+type TelemetryService struct {
+	db      *gorm.DB
+	cfg     config.TelemetryConfig
+	consent *ConsentService
+}
+
+// NewTelemetryService creates a new telemetry service
+func NewTelemetryService(db *gorm.DB, cfg config.TelemetryConfig, consent *ConsentService) *TelemetryService {
+	return &TelemetryService{db: db, cfg: cfg, consent: consent}
+}
+
+// Ingest stores a batch of samples for a buyer's deployments. Samples for
+// other deployments, or recorded outside the accepted window, are rejected
+// one by one; the rest of the batch is stored.
+func (s *TelemetryService) Ingest(buyerID uuid.UUID, inputs []TelemetryInput) (int, []TelemetryRejection, error) {
+	if len(inputs) > s.cfg.MaxBatchSize {
+		return 0, nil, ErrTelemetryBatchTooLarge
+	}
+
+	ids := make([]uuid.UUID, 0, len(inputs))
+	for _, input := range inputs {
+		ids = append(ids, input.DeploymentID)
+	}
+	var deployments []models.Deployment
+	if err := s.db.Where("buyer_id = ? AND id IN ?", buyerID, ids).Find(&deployments).Error; err != nil {
+		return 0, nil, err
+	}
+	byID := make(map[uuid.UUID]*models.Deployment, len(deployments))
+	for i := range deployments {
+		byID[deployments[i].ID] = &deployments[i]
+	}
+	return s.store(inputs, func(input TelemetryInput) *models.Deployment {
+		return byID[input.DeploymentID]
+	})
+}
+
+// IngestFromDevice stores a batch of samples reported on the device API,
+// where a device names the agent rather than the deployment
+func (s *TelemetryService) IngestFromDevice(device *models.Device, inputs []TelemetryInput) (int, []TelemetryRejection, error) {
+	if len(inputs) > s.cfg.MaxBatchSize {
+		return 0, nil, ErrTelemetryBatchTooLarge
+	}
+
+	var claim models.DeviceClaim
+	if err := s.db.Where("device_id = ? AND released_at IS NULL", device.ID).First(&claim).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return 0, nil, ErrDeviceNotClaimed
+		}
+		return 0, nil, err
+	}
+	var deployments []models.Deployment
+	if err := s.db.Where("buyer_id = ? AND device_id = ? AND decommissioned_at IS NULL", claim.UserID, device.Serial).
+		Find(&deployments).Error; err != nil {
+		return 0, nil, err
+	}
+	byAgent := make(map[uuid.UUID]*models.Deployment, len(deployments))
+	for i := range deployments {
+		byAgent[deployments[i].AgentID] = &deployments[i]
+	}
+	return s.store(inputs, func(input TelemetryInput) *models.Deployment {
+		return byAgent[input.AgentID]
+	})
+}
+
+// store validates each sample against its deployment and inserts the
+// valid ones
+func (s *TelemetryService) store(inputs []TelemetryInput, deploymentOf func(TelemetryInput) *models.Deployment) (int, []TelemetryRejection, error) {
+	now := time.Now()
+	oldest := now.Add(-s.cfg.MaxSampleAge)
+	samples := make([]models.TelemetrySample, 0, len(inputs))
+	rejected := []TelemetryRejection{}
+	for i, input := range inputs {
+		deployment := deploymentOf(input)
+		switch {
+		case deployment == nil:
+			rejected = append(rejected, TelemetryRejection{Index: i, Error: "deployment not found"})
+			continue
+		case input.RecordedAt.Before(oldest) || input.RecordedAt.After(now.Add(telemetryClockSkew)):
+			rejected = append(rejected, TelemetryRejection{Index: i, Error: "recorded_at is outside the accepted window"})
+			continue
+		case deployment.DecommissionedAt != nil && input.RecordedAt.After(*deployment.DecommissionedAt):
+			rejected = append(rejected, TelemetryRejection{Index: i, Error: "deployment was decommissioned before recorded_at"})
+			continue
+		}
+
+		version := input.Version
+		if version == "" {
+			version = deployment.RunningVersion
+		}
+		if version == "" {
+			version = deployment.Version
+		}
+		samples = append(samples, models.TelemetrySample{
+			DeploymentID:     deployment.ID,
+			AgentID:          deployment.AgentID,
+			Version:          version,
+			RecordedAt:       input.RecordedAt.UTC(),
+			InferenceLatency: input.InferenceLatency,
+			TripEvents:       input.TripEvents,
+			MemoryUsed:       input.MemoryUsed,
+			ReceivedAt:       now,
+		})
+	}
+
+	if len(samples) > 0 {
+		if err := s.db.CreateInBatches(samples, 100).Error; err != nil {
+			return 0, nil, err
+		}
+	}
+	return len(samples), rejected, nil
+}
+
+// GetVersionTelemetry aggregates an agent's shared samples recorded in
+// [from, to) per release, optionally of a single release
+func (s *TelemetryService) GetVersionTelemetry(agentID uuid.UUID, version string, from, to time.Time) ([]VersionTelemetry, error) {
+	if err := s.checkRange(from, to); err != nil {
+		return nil, err
+	}
+
+	stats := []VersionTelemetry{}
+	err := s.shared(agentID, version, from, to).
+		Select("t.version AS version, COUNT(*) AS samples, COUNT(DISTINCT t.deployment_id) AS devices, "+
+			"percentile_cont(0.5) WITHIN GROUP (ORDER BY t.inference_latency) AS latency_p50, "+
+			"percentile_cont(0.95) WITHIN GROUP (ORDER BY t.inference_latency) AS latency_p95, "+
+			"percentile_cont(0.99) WITHIN GROUP (ORDER BY t.inference_latency) AS latency_p99, "+
+			"MAX(t.inference_latency) AS latency_max, COALESCE(SUM(t.trip_events), 0) AS trip_events, "+
+			"AVG(t.memory_used) AS memory_avg, MAX(t.memory_used) AS memory_max").
+		Group("t.version").
+		Having("COUNT(DISTINCT d.buyer_id) >= ?", s.cfg.MinShareBuyers).
+		Order("version").
+		Scan(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// GetTelemetrySeries aggregates an agent's shared samples recorded in
+// [from, to) per hour or day and release
+func (s *TelemetryService) GetTelemetrySeries(agentID uuid.UUID, version, bucket string, from, to time.Time) ([]TelemetryBucket, error) {
+	if err := s.checkRange(from, to); err != nil {
+		return nil, err
+	}
+
+	series := []TelemetryBucket{}
+	err := s.shared(agentID, version, from, to).
+		Select("date_trunc(?, t.recorded_at AT TIME ZONE 'UTC') AS start, t.version AS version, COUNT(*) AS samples, "+
+			"percentile_cont(0.5) WITHIN GROUP (ORDER BY t.inference_latency) AS latency_p50, "+
+			"percentile_cont(0.95) WITHIN GROUP (ORDER BY t.inference_latency) AS latency_p95, "+
+			"percentile_cont(0.99) WITHIN GROUP (ORDER BY t.inference_latency) AS latency_p99, "+
+			"COALESCE(SUM(t.trip_events), 0) AS trip_events", bucket).
+		Group("start, t.version").
+		Having("COUNT(DISTINCT d.buyer_id) >= ?", s.cfg.MinShareBuyers).
+		Order("start, version").
+		Scan(&series).Error
+	if err != nil {
+		return nil, err
+	}
+	return series, nil
+}
+
+// shared returns the samples of an agent that its publisher may see, as t
+// joined with their deployment as d: those of buyers who consent to
+// sharing telemetry and did not opt out for this agent. It is the privacy
+// filter of every publisher view, which must also group rows so that none
+// identifies a device and drop groups of fewer than MinShareBuyers buyers.
+func (s *TelemetryService) shared(agentID uuid.UUID, version string, from, to time.Time) *gorm.DB {
+	query := s.db.Table("telemetry_samples AS t").
+		Joins("JOIN deployments AS d ON d.id = t.deployment_id").
+		Where("t.agent_id = ? AND t.recorded_at >= ? AND t.recorded_at < ?", agentID, from, to).
+		Where("d.buyer_id IN (?)", s.consent.ConsentingUsers(models.ConsentTelemetrySharing)).
+		Where("NOT EXISTS (SELECT 1 FROM telemetry_sharing_opt_outs AS o WHERE o.buyer_id = d.buyer_id AND o.agent_id = d.agent_id)")
+	if version != "" {
+		query = query.Where("t.version = ?", version)
+	}
+	return query
+}
+
+// GetSharing returns whether a buyer consents to sharing telemetry and,
+// for each agent they deployed, whether its telemetry reaches the publisher
+func (s *TelemetryService) GetSharing(buyerID uuid.UUID) (bool, []TelemetrySharing, error) {
+	consented, err := s.consent.Granted(buyerID, models.ConsentTelemetrySharing)
+	if err != nil {
+		return false, nil, err
+	}
+
+	sharing := []TelemetrySharing{}
+	if err := s.db.Table("deployments AS d").
+		Joins("JOIN agents AS a ON a.id = d.agent_id").
+		Joins("LEFT JOIN telemetry_sharing_opt_outs AS o ON o.buyer_id = d.buyer_id AND o.agent_id = d.agent_id").
+		Where("d.buyer_id = ?", buyerID).
+		Select("DISTINCT d.agent_id AS agent_id, a.name AS agent_name, o.agent_id IS NOT NULL AS opted_out").
+		Order("agent_name").
+		Scan(&sharing).Error; err != nil {
+		return false, nil, err
+	}
+	for i := range sharing {
+		sharing[i].Shared = consented && !sharing[i].OptedOut
+	}
+	return consented, sharing, nil
+}
+
+// SetSharing opts a buyer's deployments of an agent in or out of sharing
+// telemetry with its publisher. Opting in has no effect without consent.
+func (s *TelemetryService) SetSharing(buyerID, agentID uuid.UUID, shared bool) error {
+	var deployment models.Deployment
+	if err := s.db.Select("id").Where("buyer_id = ? AND agent_id = ?", buyerID, agentID).
+		First(&deployment).Error; err != nil {
+		return err
+	}
+
+	if shared {
+		return s.db.Where("buyer_id = ? AND agent_id = ?", buyerID, agentID).
+			Delete(&models.TelemetrySharingOptOut{}).Error
+	}
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.TelemetrySharingOptOut{BuyerID: buyerID, AgentID: agentID}).Error
+}
+
+func (s *TelemetryService) checkRange(from, to time.Time) error {
+	if !to.After(from) || to.Sub(from) > s.cfg.Retention {
+		return ErrInvalidTelemetryRange
+	}
+	return nil
+}
+
+// Run creates upcoming daily partitions and drops those past the retention
+// period, now and then every poll interval until ctx is done. Hypertables
+// are left to TimescaleDB.
+func (s *TelemetryService) Run(ctx context.Context) {
+	if s.cfg.TimescaleDB || s.db.Dialector.Name() != "postgres" {
+		return
+	}
+
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.MaintainPartitions(time.Now()); err != nil {
+			log.Error().Err(err).Msg("Failed to maintain telemetry partitions")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// MaintainPartitions makes sure a partition exists for every day a sample
+// may be accepted for, and drops partitions entirely past the retention
+// period
+func (s *TelemetryService) MaintainPartitions(now time.Time) error {
+	today := now.UTC().Truncate(24 * time.Hour)
+	first := now.Add(-s.cfg.MaxSampleAge).UTC().Truncate(24 * time.Hour)
+	for day := first; !day.After(today.AddDate(0, 0, telemetryPartitionsAhead)); day = day.AddDate(0, 0, 1) {
+		if err := s.db.Exec(fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS %s PARTITION OF telemetry_samples FOR VALUES FROM ('%s') TO ('%s')`,
+			telemetryPartitionPrefix+day.Format("20060102"),
+			day.Format(time.RFC3339), day.AddDate(0, 0, 1).Format(time.RFC3339),
+		)).Error; err != nil {
+			return err
+		}
+	}
+
+	var partitions []string
+	if err := s.db.Raw(`SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'telemetry_samples'::regclass`).Scan(&partitions).Error; err != nil {
+		return err
+	}
+	expired := now.Add(-s.cfg.Retention).UTC()
+	for _, name := range partitions {
+		day, err := time.Parse("20060102", strings.TrimPrefix(name, telemetryPartitionPrefix))
+		if err != nil || !day.AddDate(0, 0, 1).Before(expired) {
+			continue
+		}
+		if err := s.db.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS %s`, name)).Error; err != nil {
+			return err
+		}
+		log.Info().Str("partition", name).Msg("Dropped expired telemetry partition")
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// MaxTemplateArchiveSize caps the size of an uploaded template archive
+const MaxTemplateArchiveSize = 32 << 20
+
+var (
+	// ErrInvalidSlug is returned for a template slug that is not lowercase letters, digits and dashes
+	ErrInvalidSlug = errors.New("slug must be 1-64 lowercase letters, digits or '-'")
+	// ErrTemplateExists is returned when creating a template with a slug in use
+	ErrTemplateExists = errors.New("template slug already exists")
+	// ErrTemplateNotUploaded is returned when downloading a template without any archive
+	ErrTemplateNotUploaded = errors.New("template has no uploaded version")
+	// ErrArchiveTooLarge is returned for a template archive over MaxTemplateArchiveSize
+	ErrArchiveTooLarge = errors.New("archive is larger than 32 MiB")
+)
+
+// templateSlugPattern matches template slugs, which the CLI takes as the
+// template name
+var templateSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// templateArchiveKey returns the storage key of a template version's archive
+func templateArchiveKey(templateID uuid.UUID, version string) string {
+	return fmt.Sprintf("templates/%s/%s/archive", templateID, version)
+}
+
+// TemplateService manages starter agent templates and their downloads
+type TemplateService struct {
+	db            *gorm.DB
+	storage       Storage
+	presignExpiry time.Duration
+	consent       *ConsentService
+}
+
+// NewTemplateService creates a new template service
+func NewTemplateService(db *gorm.DB, storage Storage, presignExpiry time.Duration, consent *ConsentService) *TemplateService {
+	return &TemplateService{db: db, storage: storage, presignExpiry: presignExpiry, consent: consent}
+}
+
+// GetTemplates returns templates with at least one uploaded version,
+// optionally filtered by MCU family and category
+func (s *TemplateService) GetTemplates(page, limit int, mcuFamily, category string) ([]models.Template, int64, error) {
+	query := s.db.Model(&models.Template{}).Where("version <> ''")
+	if mcuFamily != "" {
+		query = query.Where("mcu_family = ?", mcuFamily)
+	}
+	if category != "" {
+		query = query.Where("category = ?", category)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var templates []models.Template
+	offset := (page - 1) * limit
+	if err := query.Order("downloads DESC, name").Offset(offset).Limit(limit).Find(&templates).Error; err != nil {
+		return nil, 0, err
+	}
+	return templates, total, nil
+}
+
+// GetTemplate returns a template by ID or slug with its versions, newest first
+func (s *TemplateService) GetTemplate(idOrSlug string) (*models.Template, error) {
+	query := s.db.Preload("Versions", func(db *gorm.DB) *gorm.DB { return db.Order("created_at DESC") })
+	if id, err := uuid.Parse(idOrSlug); err == nil {
+		query = query.Where("id = ?", id)
+	} else {
+		query = query.Where("slug = ?", idOrSlug)
+	}
+
+	var template models.Template
+	if err := query.First(&template).Error; err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+// CreateTemplate adds a template. It is not listed until a version is uploaded.
+func (s *TemplateService) CreateTemplate(template *models.Template) error {
+	if !templateSlugPattern.MatchString(template.Slug) {
+		return ErrInvalidSlug
+	}
+
+	var existing int64
+	if err := s.db.Unscoped().Model(&models.Template{}).Where("slug = ?", template.Slug).Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return ErrTemplateExists
+	}
+
+	template.Version = ""
+	return s.db.Create(template).Error
+}
+
+// UpdateTemplate updates a template's descriptive fields
+func (s *TemplateService) UpdateTemplate(id uuid.UUID, updates map[string]interface{}) error {
+	result := s.db.Model(&models.Template{}).Where("id = ?", id).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteTemplate soft-deletes a template, keeping its archives and analytics
+func (s *TemplateService) DeleteTemplate(id uuid.UUID) error {
+	result := s.db.Delete(&models.Template{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// UploadVersion stores a new archive of a template and makes it the
+// template's current version
+func (s *TemplateService) UploadVersion(ctx context.Context, template *models.Template, release *models.TemplateVersion, upload FileUpload) error {
+	if !versionPattern.MatchString(release.Version) {
+		return ErrInvalidVersion
+	}
+	if upload.Size > MaxTemplateArchiveSize {
+		return ErrArchiveTooLarge
+	}
+
+	var existing int64
+	if err := s.db.Model(&models.TemplateVersion{}).
+		Where("template_id = ? AND version = ?", template.ID, release.Version).
+		Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return ErrVersionExists
+	}
+
+	key := templateArchiveKey(template.ID, release.Version)
+	hash := sha256.New()
+	body := io.TeeReader(io.LimitReader(upload.Body, upload.Size), hash)
+	url, err := s.storage.Put(ctx, key, body, upload.Size, upload.ContentType)
+	if err != nil {
+		return fmt.Errorf("failed to store template archive: %w", err)
+	}
+
+	release.TemplateID = template.ID
+	release.ArchiveURL = url
+	release.ArchiveSize = upload.Size
+	release.ArchiveChecksum = hex.EncodeToString(hash.Sum(nil))
+	release.ContentType = upload.ContentType
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(release).Error; err != nil {
+			return err
+		}
+		return tx.Model(template).Update("version", release.Version).Error
+	})
+	if err != nil {
+		return err
+	}
+	template.Version = release.Version
+	return nil
+}
+
+// TemplateDownloadLink is a presigned link to a template archive
+type TemplateDownloadLink struct {
+	Version   *models.TemplateVersion `json:"version"`
+	URL       string                  `json:"url"`
+	ExpiresIn int                     `json:"expires_in"` // in seconds
+}
+
+// Download returns a presigned link to a version of a template, the current
+// one if version is empty. The download is recorded unless record is false,
+// as on a read-only replica, and only attributed to users who consent to
+// usage analytics.
+func (s *TemplateService) Download(ctx context.Context, template *models.Template, version string, userID *uuid.UUID, client string, record bool) (*TemplateDownloadLink, error) {
+	if version == "" {
+		version = template.Version
+	}
+	if version == "" {
+		return nil, ErrTemplateNotUploaded
+	}
+
+	var release models.TemplateVersion
+	if err := s.db.Where("template_id = ? AND version = ?", template.ID, version).First(&release).Error; err != nil {
+		return nil, err
+	}
+
+	url, err := s.storage.PresignedURL(ctx, templateArchiveKey(template.ID, release.Version), s.presignExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	link := &TemplateDownloadLink{
+		Version:   &release,
+		URL:       url,
+		ExpiresIn: int(s.presignExpiry.Seconds()),
+	}
+	if !record {
+		return link, nil
+	}
+	if userID != nil {
+		granted, err := s.consent.Granted(*userID, models.ConsentUsageAnalytics)
+		if err != nil {
+			return nil, err
+		}
+		if !granted {
+			userID = nil
+		}
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&models.TemplateDownload{
+			TemplateID: template.ID,
+			Version:    release.Version,
+			UserID:     userID,
+			Client:     client,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Template{}).Where("id = ?", template.ID).
+			Update("downloads", gorm.Expr("downloads + 1")).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// TemplateUsageCount is a number of downloads grouped by one dimension
+type TemplateUsageCount struct {
+	Key       string `json:"key"`
+	Downloads int64  `json:"downloads"`
+}
+
+// TemplateUsageStats summarizes a template's downloads over a period
+type TemplateUsageStats struct {
+	Downloads    int64                `json:"downloads"`
+	UniqueUsers  int64                `json:"unique_users"`
+	ByVersion    []TemplateUsageCount `json:"by_version"`
+	ByClient     []TemplateUsageCount `json:"by_client"`
+	ByDay        []TemplateUsageCount `json:"by_day"`
+	LastDownload *time.Time           `json:"last_download,omitempty"`
+}
+
+// GetUsageStats returns download analytics for a template since the given time
+func (s *TemplateService) GetUsageStats(templateID uuid.UUID, since time.Time) (*TemplateUsageStats, error) {
+	downloads := func() *gorm.DB {
+		return s.db.Model(&models.TemplateDownload{}).Where("template_id = ? AND created_at >= ?", templateID, since)
+	}
+
+	var stats TemplateUsageStats
+	var totals struct {
+		Downloads    int64
+		UniqueUsers  int64
+		LastDownload *time.Time
+	}
+	if err := downloads().
+		Select("COUNT(*) AS downloads, COUNT(DISTINCT user_id) AS unique_users, MAX(created_at) AS last_download").
+		Scan(&totals).Error; err != nil {
+		return nil, err
+	}
+	stats.Downloads = totals.Downloads
+	stats.UniqueUsers = totals.UniqueUsers
+	stats.LastDownload = totals.LastDownload
+
+	for column, counts := range map[string]*[]TemplateUsageCount{
+		"version":                           &stats.ByVersion,
+		"client":                            &stats.ByClient,
+		"TO_CHAR(created_at, 'YYYY-MM-DD')": &stats.ByDay,
+	} {
+		*counts = []TemplateUsageCount{}
+		if err := downloads().
+			Select(column + " AS key, COUNT(*) AS downloads").
+			Group(column).
+			Order("key").
+			Scan(counts).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &stats, nil
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrAgentLimitReached is returned when publishing would exceed the publisher's tier limit
+	ErrAgentLimitReached = errors.New("published agent limit of the publisher's plan reached")
+	// ErrStorageQuotaExceeded is returned when an upload would exceed the publisher's storage quota
+	ErrStorageQuotaExceeded = errors.New("storage quota of the publisher's plan exceeded")
+	// ErrUnknownTier is returned for a tier that is not configured
+	ErrUnknownTier = errors.New("unknown publisher tier")
+)
+
+// TierService applies the commission rates and limits of publisher plan
+// tiers. Limits come from the limit service, so per-user overrides apply.
+type TierService struct {
+	db     *gorm.DB
+	tiers  map[string]config.TierConfig
+	limits *LimitService
+
+	// Per-user request counts for the current minute
+	mu     sync.Mutex
+	window time.Time
+	counts map[uuid.UUID]int
+}
+
+// NewTierService creates a new tier service
+func NewTierService(db *gorm.DB, tiers map[string]config.TierConfig, limits *LimitService) *TierService {
+	return &TierService{
+		db:     db,
+		tiers:  tiers,
+		limits: limits,
+		counts: make(map[uuid.UUID]int),
+	}
+}
+
+// Plan returns the settings of a tier, falling back to the free tier
+func (s *TierService) Plan(tier models.PublisherTier) config.TierConfig {
+	if plan, ok := s.tiers[string(tier)]; ok {
+		return plan
+	}
+	return s.tiers[string(models.PublisherTierFree)]
+}
+
+// Plans returns the settings of all tiers
+func (s *TierService) Plans() map[string]config.TierConfig {
+	return s.tiers
+}
+
+// SetTier assigns a tier to a user
+func (s *TierService) SetTier(userID uuid.UUID, tier models.PublisherTier) error {
+	if _, ok := s.tiers[string(tier)]; !ok {
+		return ErrUnknownTier
+	}
+	result := s.db.Model(&models.User{}).Where("id = ?", userID).Update("tier", tier)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+// Commission returns the marketplace commission on an amount for a tier,
+// rounded half up to the nearest minor unit
+func (s *TierService) Commission(tier models.PublisherTier, amount models.Money) models.Money {
+	return (amount*models.Money(s.Plan(tier).CommissionBps) + 5000) / 10000
+}
+
+// CheckPublishLimit returns ErrAgentLimitReached if the publisher cannot
+// publish another agent on their plan
+func (s *TierService) CheckPublishLimit(publisherID uuid.UUID) error {
+	var publisher models.User
+	if err := s.db.Select("id", "tier").First(&publisher, "id = ?", publisherID).Error; err != nil {
+		return err
+	}
+	limit := s.limits.Get(publisherID, publisher.Tier, models.LimitMaxPublishedAgents)
+	if limit == 0 {
+		return nil
+	}
+
+	var published int64
+	if err := s.db.Model(&models.Agent{}).
+		Where("publisher_id = ? AND status = ?", publisherID, models.AgentStatusPublished).
+		Count(&published).Error; err != nil {
+		return err
+	}
+	if published >= limit {
+		return ErrAgentLimitReached
+	}
+	return nil
+}
+
+// CheckStorageQuota returns ErrStorageQuotaExceeded if storing additional
+// bytes would take the publisher over their plan's quota
+func (s *TierService) CheckStorageQuota(publisherID uuid.UUID, additional int64) error {
+	var publisher models.User
+	if err := s.db.Select("id", "tier", "storage_used_bytes").First(&publisher, "id = ?", publisherID).Error; err != nil {
+		return err
+	}
+	quotaMB := s.limits.Get(publisherID, publisher.Tier, models.LimitStorageQuotaMB)
+	if quotaMB == 0 {
+		return nil
+	}
+	if publisher.StorageUsedBytes+additional > quotaMB<<20 {
+		return ErrStorageQuotaExceeded
+	}
+	return nil
+}
+
+// AllowRequest counts an API request against the user's per-minute limit
+// and reports whether it is allowed. Counts are kept per instance.
+func (s *TierService) AllowRequest(userID uuid.UUID, tier models.PublisherTier) bool {
+	limit := s.limits.Get(userID, tier, models.LimitRequestsPerMinute)
+	if limit == 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if window := time.Now().Truncate(time.Minute); !window.Equal(s.window) {
+		s.window = window
+		s.counts = make(map[uuid.UUID]int)
+	}
+	if int64(s.counts[userID]) >= limit {
+		return false
+	}
+	s.counts[userID]++
+	return true
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+// Trace is the trail of records sharing a trace ID: the purchases that
+// started it, what entitled and refunded them, and the downloads and
+// deployments that followed. Each list is in order of creation.
+type Trace struct {
+	TraceID          uuid.UUID                   `json:"trace_id"`
+	Purchases        []models.Purchase           `json:"purchases"`
+	PurchaseRequests []models.OrgPurchaseRequest `json:"purchase_requests"` // approvals of purchases made for an organization
+	Licenses         []models.License            `json:"licenses"`
+	Refunds          []models.RefundRequest      `json:"refunds"`
+	Downloads        []models.AgentDownload      `json:"downloads"`
+	Deployments      []models.Deployment         `json:"deployments"`
+	Transfers        []models.DeploymentTransfer `json:"transfers"`
+}
+
+// TraceService follows a purchase through to the devices it runs on, for
+// support and compliance audits
+type TraceService struct {
+	db *gorm.DB
+}
+
+// NewTraceService creates a new trace service
+func NewTraceService(db *gorm.DB) *TraceService {
+	return &TraceService{db: db}
+}
+
+// GetTrace returns the trail of a trace ID. Users see traces they bought
+// or deployed something in, or that their organizations bought something
+// in; admins see every trace. Otherwise gorm.ErrRecordNotFound is returned.
+func (s *TraceService) GetTrace(id, userID uuid.UUID, admin bool) (*Trace, error) {
+	trace := &Trace{TraceID: id}
+	if err := s.db.Where("trace_id = ?", id).Order("created_at").Find(&trace.Purchases).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Where("trace_id = ?", id).Order("created_at").Find(&trace.Deployments).Error; err != nil {
+		return nil, err
+	}
+	if len(trace.Purchases) == 0 && len(trace.Deployments) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	if !admin {
+		visible, err := s.visible(trace, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !visible {
+			return nil, gorm.ErrRecordNotFound
+		}
+	}
+
+	purchaseIDs := make([]uuid.UUID, len(trace.Purchases))
+	for i, purchase := range trace.Purchases {
+		purchaseIDs[i] = purchase.ID
+	}
+	deploymentIDs := make([]uuid.UUID, len(trace.Deployments))
+	for i, deployment := range trace.Deployments {
+		deploymentIDs[i] = deployment.ID
+	}
+
+	if err := s.db.Preload("Approvals").Where("purchase_id IN ?", purchaseIDs).Order("created_at").Find(&trace.PurchaseRequests).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Where("purchase_id IN ?", purchaseIDs).Order("created_at").Find(&trace.Licenses).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Where("purchase_id IN ?", purchaseIDs).Order("created_at").Find(&trace.Refunds).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Where("trace_id = ?", id).Order("created_at").Find(&trace.Downloads).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Where("from_deployment_id IN ? OR to_deployment_id IN ?", deploymentIDs, deploymentIDs).
+		Order("created_at").Find(&trace.Transfers).Error; err != nil {
+		return nil, err
+	}
+	return trace, nil
+}
+
+// visible reports whether a user bought or deployed anything in a trace,
+// or is a member of an organization that bought something in it
+func (s *TraceService) visible(trace *Trace, userID uuid.UUID) (bool, error) {
+	var orgIDs []uuid.UUID
+	for _, purchase := range trace.Purchases {
+		if purchase.BuyerID == userID {
+			return true, nil
+		}
+		if purchase.OrganizationID != nil {
+			orgIDs = append(orgIDs, *purchase.OrganizationID)
+		}
+	}
+	for _, deployment := range trace.Deployments {
+		if deployment.BuyerID == userID {
+			return true, nil
+		}
+	}
+	if len(orgIDs) == 0 {
+		return false, nil
+	}
+
+	var count int64
+	if err := s.db.Model(&models.Membership{}).
+		Where("user_id = ? AND organization_id IN ?", userID, orgIDs).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
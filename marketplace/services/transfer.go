@@ -0,0 +1,213 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrSameDevice is returned when transferring a deployment to the
+	// device it is on
+	ErrSameDevice = errors.New("the new device must differ from the replaced one")
+	// ErrDeviceStillActive is returned when the replaced device still checks
+	// in and its certificates are not revoked
+	ErrDeviceStillActive = errors.New("the replaced device is still checking in; revoke its certificates or wait until it has been quiet long enough")
+	// ErrTransferLimitReached is returned when the buyer already moved the
+	// agent to new devices as often as allowed in the period
+	ErrTransferLimitReached = errors.New("transfer limit for this agent reached; try again later")
+)
+
+// TransferService moves a metered deployment, the license of an agent on
+// one device, to the device replacing it. Only a device shown to be out of
+// service can give up its license, and each buyer can move an agent a
+// limited number of times per period.
+type TransferService struct {
+	db       *gorm.DB
+	cfg      config.TransfersConfig
+	metering *MeteringService
+}
+
+// NewTransferService creates a new transfer service
+func NewTransferService(db *gorm.DB, cfg config.TransfersConfig, metering *MeteringService) *TransferService {
+	return &TransferService{db: db, cfg: cfg, metering: metering}
+}
+
+// Transfer decommissions one of a buyer's deployments and deploys the same
+// release of the agent on deviceID, recording the transfer for the agent's
+// publisher. It returns the transfer and the new deployment.
+func (s *TransferService) Transfer(buyerID, deploymentID uuid.UUID, deviceID, reason string) (*models.DeploymentTransfer, *models.Deployment, error) {
+	var transfer models.DeploymentTransfer
+	var replacement models.Deployment
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var deployment models.Deployment
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND buyer_id = ?", deploymentID, buyerID).
+			First(&deployment).Error; err != nil {
+			return err
+		}
+		if deployment.DecommissionedAt != nil {
+			return ErrDecommissioned
+		}
+		if deployment.DeviceID == deviceID {
+			return ErrSameDevice
+		}
+
+		var recent int64
+		if err := tx.Model(&models.DeploymentTransfer{}).
+			Where("buyer_id = ? AND agent_id = ? AND created_at > ?", buyerID, deployment.AgentID, time.Now().Add(-s.cfg.Period)).
+			Count(&recent).Error; err != nil {
+			return err
+		}
+		if recent >= int64(s.cfg.MaxPerPeriod) {
+			return ErrTransferLimitReached
+		}
+
+		verification, lastSeen, err := s.verify(tx, &deployment)
+		if err != nil {
+			return err
+		}
+
+		var active int64
+		if err := tx.Model(&models.Deployment{}).
+			Where("buyer_id = ? AND agent_id = ? AND device_id = ? AND decommissioned_at IS NULL", buyerID, deployment.AgentID, deviceID).
+			Count(&active).Error; err != nil {
+			return err
+		}
+		if active > 0 {
+			return ErrDeploymentExists
+		}
+
+		now := time.Now()
+		if err := tx.Model(&deployment).Update("decommissioned_at", now).Error; err != nil {
+			return err
+		}
+		// Checked once the old device has left, so a one-for-one
+		// replacement fits in a full fleet
+		if err := s.metering.checkFleetSize(tx, buyerID, deviceID); err != nil {
+			return err
+		}
+		var known int64
+		if err := tx.Model(&models.Deployment{}).
+			Where("buyer_id = ? AND device_id = ? AND decommissioned_at IS NULL", buyerID, deviceID).
+			Count(&known).Error; err != nil {
+			return err
+		}
+
+		replacement = models.Deployment{
+			BuyerID:    buyerID,
+			AgentID:    deployment.AgentID,
+			DeviceID:   deviceID,
+			Version:    deployment.Version,
+			DeployedAt: now,
+			TraceID:    deployment.TraceID,
+		}
+		if err := tx.Create(&replacement).Error; err != nil {
+			return err
+		}
+		transfer = models.DeploymentTransfer{
+			BuyerID:          buyerID,
+			AgentID:          deployment.AgentID,
+			FromDeploymentID: deployment.ID,
+			ToDeploymentID:   replacement.ID,
+			FromDeviceID:     deployment.DeviceID,
+			ToDeviceID:       deviceID,
+			Verification:     verification,
+			LastSeenAt:       lastSeen,
+			Reason:           reason,
+		}
+		if err := tx.Create(&transfer).Error; err != nil {
+			return err
+		}
+
+		if known > 0 {
+			return nil
+		}
+		return emitEvent(tx, buyerID, models.WebhookEventDeviceRegistered, map[string]interface{}{
+			"device_id":  deviceID,
+			"deployment": deviceDeployment{DeploymentID: replacement.ID, AgentID: replacement.AgentID, Version: replacement.Version},
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &transfer, &replacement, nil
+}
+
+// GetAgentTransfers returns the transfers of an agent's deployments, most
+// recent first
+func (s *TransferService) GetAgentTransfers(agentID uuid.UUID, page, limit int) ([]models.DeploymentTransfer, int64, error) {
+	var transfers []models.DeploymentTransfer
+	var total int64
+
+	query := s.db.Model(&models.DeploymentTransfer{}).Where("agent_id = ?", agentID)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * limit
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&transfers).Error; err != nil {
+		return nil, 0, err
+	}
+	return transfers, total, nil
+}
+
+// verify checks that the device of a deployment is out of service, and
+// returns how along with when it was last seen. A registered device whose
+// certificates were all revoked, and that has not checked in since, can no
+// longer reach the device API; any other device must have been quiet for
+// the configured period.
+func (s *TransferService) verify(tx *gorm.DB, deployment *models.Deployment) (models.TransferVerification, *time.Time, error) {
+	var seen struct {
+		LastCheckInAt *time.Time
+	}
+	if err := tx.Model(&models.Deployment{}).
+		Select("MAX(last_check_in_at) AS last_check_in_at").
+		Where("buyer_id = ? AND device_id = ?", deployment.BuyerID, deployment.DeviceID).
+		Scan(&seen).Error; err != nil {
+		return "", nil, err
+	}
+	lastSeen := seen.LastCheckInAt
+
+	var device models.Device
+	err := tx.Where("serial = ? AND id IN (SELECT device_id FROM device_claims WHERE user_id = ? AND released_at IS NULL)",
+		deployment.DeviceID, deployment.BuyerID).
+		First(&device).Error
+	switch err {
+	case nil:
+		if device.LastSeenAt != nil && (lastSeen == nil || device.LastSeenAt.After(*lastSeen)) {
+			lastSeen = device.LastSeenAt
+		}
+		var certs []models.DeviceCertificate
+		if err := tx.Where("device_id = ?", device.ID).Find(&certs).Error; err != nil {
+			return "", nil, err
+		}
+		var revoked *time.Time
+		for _, cert := range certs {
+			if cert.RevokedAt == nil {
+				revoked = nil
+				break
+			}
+			if revoked == nil || cert.RevokedAt.After(*revoked) {
+				revoked = cert.RevokedAt
+			}
+		}
+		if revoked != nil && (lastSeen == nil || lastSeen.Before(*revoked)) {
+			return models.TransferVerificationRevoked, lastSeen, nil
+		}
+	case gorm.ErrRecordNotFound:
+	default:
+		return "", nil, err
+	}
+
+	if lastSeen != nil && lastSeen.After(time.Now().Add(-s.cfg.QuietPeriod)) {
+		return "", nil, ErrDeviceStillActive
+	}
+	return models.TransferVerificationQuiet, lastSeen, nil
+}
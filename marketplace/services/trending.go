@@ -0,0 +1,141 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+// trendingBatchSize is the number of scores written per statement
+const trendingBatchSize = 500
+
+// TrendingService scores published agents by their recent activity. Each
+// download, purchase and review within the window counts by its weight,
+// halving every half-life, so agents gaining traction rise above those
+// with a large but old following.
+type TrendingService struct {
+	db  *gorm.DB
+	cfg config.TrendingConfig
+}
+
+// NewTrendingService creates a new trending service
+func NewTrendingService(db *gorm.DB, cfg config.TrendingConfig) *TrendingService {
+	return &TrendingService{db: db, cfg: cfg}
+}
+
+// Run recomputes the scores every poll interval until ctx is done
+func (s *TrendingService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Compute(); err != nil {
+				log.Error().Err(err).Msg("Failed to compute trending scores")
+			}
+		}
+	}
+}
+
+// trendingActivity is one kind of activity of an agent within the window:
+// how much there was, and its sum decayed by age
+type trendingActivity struct {
+	AgentID uuid.UUID
+	Count   int64
+	Decayed float64
+}
+
+// Compute replaces the scores of all published agents and returns how many
+// agents have one. Agents whose activity left the window lose their score.
+func (s *TrendingService) Compute() (int, error) {
+	// Whole seconds, so the stored time compares equal to now
+	now := time.Now().UTC().Truncate(time.Second)
+	since := now.Add(-s.cfg.Window)
+	halfLife := s.cfg.HalfLife.Seconds()
+
+	var downloads, purchases, reviews []trendingActivity
+	if err := s.db.Model(&models.AgentDownloadDay{}).
+		Select("agent_id, SUM(downloads) AS count, SUM(downloads * POWER(0.5, EXTRACT(EPOCH FROM (? - day)) / ?)) AS decayed", now, halfLife).
+		Where("day >= ?", since.Truncate(24*time.Hour)).
+		Group("agent_id").
+		Scan(&downloads).Error; err != nil {
+		return 0, err
+	}
+	if err := s.db.Model(&models.Purchase{}).
+		Select("agent_id, COUNT(*) AS count, SUM(POWER(0.5, EXTRACT(EPOCH FROM (? - created_at)) / ?)) AS decayed", now, halfLife).
+		Where("status = ? AND created_at >= ?", models.PurchaseStatusCompleted, since).
+		Group("agent_id").
+		Scan(&purchases).Error; err != nil {
+		return 0, err
+	}
+	if err := s.db.Model(&models.ReviewDailyStat{}).
+		Select("agent_id, SUM(review_count) AS count, SUM(rating_sum / 5.0 * POWER(0.5, EXTRACT(EPOCH FROM (? - day)) / ?)) AS decayed", now, halfLife).
+		Where("day >= ?", since.Truncate(24*time.Hour)).
+		Group("agent_id").
+		Scan(&reviews).Error; err != nil {
+		return 0, err
+	}
+
+	var published []uuid.UUID
+	if err := s.db.Model(&models.Agent{}).
+		Where("status = ? AND deleted_at IS NULL", models.AgentStatusPublished).
+		Pluck("id", &published).Error; err != nil {
+		return 0, err
+	}
+	listed := make(map[uuid.UUID]bool, len(published))
+	for _, id := range published {
+		listed[id] = true
+	}
+	scores := make(map[uuid.UUID]*models.AgentPopularity)
+	add := func(activities []trendingActivity, weight float64, count func(*models.AgentPopularity) *int64) {
+		for _, activity := range activities {
+			if !listed[activity.AgentID] {
+				continue
+			}
+			popularity := scores[activity.AgentID]
+			if popularity == nil {
+				popularity = &models.AgentPopularity{AgentID: activity.AgentID, ComputedAt: now}
+				scores[activity.AgentID] = popularity
+			}
+			popularity.Score += weight * activity.Decayed
+			*count(popularity) += activity.Count
+		}
+	}
+	add(downloads, s.cfg.DownloadWeight, func(p *models.AgentPopularity) *int64 { return &p.Downloads })
+	add(purchases, s.cfg.PurchaseWeight, func(p *models.AgentPopularity) *int64 { return &p.Purchases })
+	add(reviews, s.cfg.ReviewWeight, func(p *models.AgentPopularity) *int64 { return &p.Reviews })
+
+	rows := make([]models.AgentPopularity, 0, len(scores))
+	for _, popularity := range scores {
+		rows = append(rows, *popularity)
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if len(rows) > 0 {
+			if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(rows, trendingBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Where("computed_at < ?", now).Delete(&models.AgentPopularity{}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// Order sorts a query on agents by descending trending score. Agents
+// without a score come last.
+func (s *TrendingService) Order(query *gorm.DB) *gorm.DB {
+	return query.Joins("LEFT JOIN agent_popularities ON agent_popularities.agent_id = agents.id").
+		Order("COALESCE(agent_popularities.score, 0) DESC, agents.id")
+}
@@ -1,14 +1,20 @@
 package services
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/edgeplug/marketplace/models"
 )
 
+// ErrEmailTaken is returned when changing to an email address another
+// account uses
+var ErrEmailTaken = errors.New("email address is already in use")
+
 // UserService handles user-related business logic
 type UserService struct {
 	db *gorm.DB
@@ -56,8 +62,33 @@ func (s *UserService) UpdateUser(id uuid.UUID, updates map[string]interface{}) e
 	return s.db.Model(&models.User{}).Where("id = ?", id).Updates(updates).Error
 }
 
-// DeleteUser deletes a user (soft delete)
+// EmailTaken reports whether an account other than the user's, including
+// a deleted one, uses an email address
+func (s *UserService) EmailTaken(id uuid.UUID, email string) (bool, error) {
+	var taken int64
+	err := s.db.Unscoped().Model(&models.User{}).
+		Where("LOWER(email) = LOWER(?) AND id <> ?", email, id).
+		Count(&taken).Error
+	return taken > 0, err
+}
+
+// ChangeEmail changes a user's email address unless it is taken
+func (s *UserService) ChangeEmail(id uuid.UUID, email string) error {
+	taken, err := s.EmailTaken(id, email)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrEmailTaken
+	}
+	return s.db.Model(&models.User{}).Where("id = ?", id).Update("email", email).Error
+}
+
+// DeleteUser deletes a user (soft delete) unless they are under legal hold
 func (s *UserService) DeleteUser(id uuid.UUID) error {
+	if err := checkLegalHold(s.db, holdSubject{Type: models.LegalHoldSubjectUser, ID: id}); err != nil {
+		return err
+	}
 	return s.db.Delete(&models.User{}, id).Error
 }
 
@@ -171,12 +202,13 @@ func (s *UserService) GetUserAgents(userID uuid.UUID, page, limit int) ([]models
 	return agents, total, nil
 }
 
-// GetUserPurchases gets all purchases made by a user
-func (s *UserService) GetUserPurchases(userID uuid.UUID, page, limit int) ([]models.Purchase, int64, error) {
+// GetUserPurchases gets the purchases made by a user, newest first,
+// optionally only those in one of statuses
+func (s *UserService) GetUserPurchases(userID uuid.UUID, statuses []models.PurchaseStatus, page, limit int) ([]models.Purchase, int64, error) {
 	var purchases []models.Purchase
 	var total int64
 
-	query := s.db.Model(&models.Purchase{}).Where("buyer_id = ?", userID).Preload("Agent")
+	query := userPurchases(s.db, userID, statuses)
 
 	// Get total count
 	if err := query.Count(&total).Error; err != nil {
@@ -185,13 +217,49 @@ func (s *UserService) GetUserPurchases(userID uuid.UUID, page, limit int) ([]mod
 
 	// Get purchases with pagination
 	offset := (page - 1) * limit
-	if err := query.Offset(offset).Limit(limit).Find(&purchases).Error; err != nil {
+	if err := query.Order("purchases.created_at DESC, purchases.id DESC").Offset(offset).Limit(limit).Find(&purchases).Error; err != nil {
 		return nil, 0, err
 	}
+	formatPurchases(purchases)
 
 	return purchases, total, nil
 }
 
+// GetUserPurchasesAfter gets a page of a user's purchases, newest first,
+// after a cursor. The extra row fetched by Keyset tells whether more follow;
+// the cursor of the next page is nil on the last one.
+func (s *UserService) GetUserPurchasesAfter(userID uuid.UUID, statuses []models.PurchaseStatus, cursor *Cursor, limit int) ([]models.Purchase, *Cursor, error) {
+	var purchases []models.Purchase
+	query := userPurchases(s.db, userID, statuses)
+	if err := Keyset(query, "purchases.created_at", true, cursor, limit).Find(&purchases).Error; err != nil {
+		return nil, nil, err
+	}
+	formatPurchases(purchases)
+
+	var next *Cursor
+	if len(purchases) > limit {
+		purchases = purchases[:limit]
+		last := purchases[limit-1]
+		next = NewCursor(last.CreatedAt, last.ID)
+	}
+	return purchases, next, nil
+}
+
+// userPurchases queries a buyer's purchases, with their agents
+func userPurchases(db *gorm.DB, userID uuid.UUID, statuses []models.PurchaseStatus) *gorm.DB {
+	query := db.Model(&models.Purchase{}).Where("buyer_id = ?", userID).Preload("Agent")
+	if len(statuses) > 0 {
+		query = query.Where("status IN ?", statuses)
+	}
+	return query
+}
+
+func formatPurchases(purchases []models.Purchase) {
+	for i := range purchases {
+		purchases[i].AmountDisplay = models.FormatMoney(purchases[i].Amount, purchases[i].Currency)
+	}
+}
+
 // GetUserReviews gets all reviews written by a user
 func (s *UserService) GetUserReviews(userID uuid.UUID, page, limit int) ([]models.Review, int64, error) {
 	var reviews []models.Review
@@ -218,7 +286,7 @@ func (s *UserService) GetUserFavorites(userID uuid.UUID, page, limit int) ([]mod
 	var favorites []models.Favorite
 	var total int64
 
-	query := s.db.Model(&models.Favorite{}).Where("user_id = ?", userID).Preload("Agent")
+	query := s.db.Model(&models.Favorite{}).Where("user_id = ?", userID).Preload("Agent").Order("created_at DESC")
 
 	// Get total count
 	if err := query.Count(&total).Error; err != nil {
@@ -234,13 +302,14 @@ func (s *UserService) GetUserFavorites(userID uuid.UUID, page, limit int) ([]mod
 	return favorites, total, nil
 }
 
-// AddFavorite adds an agent to user's favorites
+// AddFavorite adds an agent to user's favorites. Adding it again is a
+// no-op.
 func (s *UserService) AddFavorite(userID, agentID uuid.UUID) error {
 	favorite := models.Favorite{
 		UserID:  userID,
 		AgentID: agentID,
 	}
-	return s.db.Create(&favorite).Error
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&favorite).Error
 }
 
 // RemoveFavorite removes an agent from user's favorites
@@ -312,7 +381,8 @@ func (s *UserService) GetUserActivity(userID uuid.UUID, limit int) ([]map[string
 			"type":       "purchase",
 			"agent_id":   purchase.AgentID,
 			"agent_name": purchase.Agent.Name,
-			"amount":     purchase.Amount,
+			"amount":     purchase.AmountDisplay,
+			"currency":   purchase.Currency,
 			"timestamp":  purchase.CreatedAt,
 		})
 	}
@@ -0,0 +1,302 @@
+package services
+
+import (
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrInvalidVersion is returned for a version string that cannot be used in a URL
+	ErrInvalidVersion = errors.New("version must be 1-64 letters, digits, '.', '+', '_' or '-'")
+	// ErrVersionExists is returned when creating a release with an existing version
+	ErrVersionExists = errors.New("version already exists")
+	// ErrVersionNotPublished is returned when pinning or publishing a release in the wrong status
+	ErrVersionNotPublished = errors.New("version is not published")
+	// ErrCurrentVersion is returned when deprecating the agent's current release
+	ErrCurrentVersion = errors.New("the current version cannot be deprecated")
+	// ErrNotEntitled is returned when downloading an agent the user has not bought
+	ErrNotEntitled = errors.New("agent has not been purchased")
+)
+
+// versionPattern matches version strings that are safe to use as a path segment
+var versionPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+_-]{0,63}$`)
+
+// GetVersions returns an agent's releases, newest first. Drafts are only
+// included for the publisher.
+func (s *AgentService) GetVersions(agentID uuid.UUID, includeDrafts bool) ([]models.AgentVersion, error) {
+	query := s.db.Where("agent_id = ?", agentID)
+	if !includeDrafts {
+		query = query.Where("status <> ?", models.AgentVersionStatusDraft)
+	}
+
+	var versions []models.AgentVersion
+	if err := query.Order("created_at DESC").Find(&versions).Error; err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// GetVersion returns one release of an agent
+func (s *AgentService) GetVersion(agentID uuid.UUID, version string) (*models.AgentVersion, error) {
+	var release models.AgentVersion
+	if err := s.db.Preload("SigningKey").Where("agent_id = ? AND version = ?", agentID, version).First(&release).Error; err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// GetPublishedVersion returns a release that can be newly deployed
+func (s *AgentService) GetPublishedVersion(agentID uuid.UUID, version string) (*models.AgentVersion, error) {
+	release, err := s.GetVersion(agentID, version)
+	if err != nil {
+		return nil, err
+	}
+	if release.Status != models.AgentVersionStatusPublished {
+		return nil, ErrVersionNotPublished
+	}
+	return release, nil
+}
+
+// CreateVersion adds a draft release to an agent. Asking to publish it right
+// away fails with ErrManifestRequired: the manifest is uploaded afterwards.
+func (s *AgentService) CreateVersion(release *models.AgentVersion, publish bool) error {
+	if !versionPattern.MatchString(release.Version) {
+		return ErrInvalidVersion
+	}
+
+	var existing int64
+	if err := s.db.Model(&models.AgentVersion{}).
+		Where("agent_id = ? AND version = ?", release.AgentID, release.Version).
+		Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 {
+		return ErrVersionExists
+	}
+
+	if publish {
+		return ErrManifestRequired
+	}
+
+	release.Status = models.AgentVersionStatusDraft
+	return s.db.Create(release).Error
+}
+
+// PublishVersion publishes a draft or staged release to everyone and makes
+// it the agent's current version. Buyers pinned to earlier releases keep
+// them; a rollout of another release is called off.
+func (s *AgentService) PublishVersion(release *models.AgentVersion) error {
+	if release.Status != models.AgentVersionStatusDraft && release.Status != models.AgentVersionStatusStaged {
+		return ErrVersionNotPublished
+	}
+	if err := s.checkPublishable(release); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(release).Updates(map[string]interface{}{
+			"status":          models.AgentVersionStatusPublished,
+			"published_at":    &now,
+			"rollout_percent": 0,
+			"rollout_regions": models.Tags(nil),
+			"staged_at":       nil,
+		}).Error; err != nil {
+			return err
+		}
+		if err := unstageVersions(tx, release.AgentID); err != nil {
+			return err
+		}
+		return tx.Model(&models.Agent{}).Where("id = ?", release.AgentID).Updates(map[string]interface{}{
+			"version":             release.Version,
+			"binary_url":          release.BinaryURL,
+			"binary_size":         release.BinarySize,
+			"binary_checksum":     release.BinaryChecksum,
+			"binary_content_type": release.BinaryContentType,
+			"binary_signature":    release.BinarySignature,
+			"signing_key_id":      release.SigningKeyID,
+			"manifest_url":        release.ManifestURL,
+			"flash_size":          release.FlashSize,
+			"sram_size":           release.SRAMSize,
+			"max_latency":         release.MaxLatency,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	release.Status = models.AgentVersionStatusPublished
+	release.PublishedAt = &now
+	release.RolloutPercent = 0
+	release.RolloutRegions = nil
+	release.StagedAt = nil
+	s.InvalidateAgent(release.AgentID)
+	return nil
+}
+
+// DeprecateVersion stops a published release from being newly deployed
+func (s *AgentService) DeprecateVersion(agent *models.Agent, release *models.AgentVersion) error {
+	if release.Version == agent.Version {
+		return ErrCurrentVersion
+	}
+	if release.Status != models.AgentVersionStatusPublished {
+		return ErrVersionNotPublished
+	}
+	release.Status = models.AgentVersionStatusDeprecated
+	return s.db.Model(release).Update("status", release.Status).Error
+}
+
+// PublishCurrentVersion publishes the draft release matching an agent's
+// version when the agent itself is published
+func (s *AgentService) PublishCurrentVersion(agentID uuid.UUID) error {
+	now := time.Now()
+	return s.db.Model(&models.AgentVersion{}).
+		Where("agent_id = ? AND status = ? AND version = (SELECT version FROM agents WHERE id = ?)",
+			agentID, models.AgentVersionStatusDraft, agentID).
+		Updates(map[string]interface{}{
+			"status":       models.AgentVersionStatusPublished,
+			"published_at": &now,
+		}).Error
+}
+
+// CheckPublishable returns nil if an agent's current version may be
+// published: its manifest matches the specs the agent is listed with and
+// its binary is signed and passed the malware scan
+func (s *AgentService) CheckPublishable(agent *models.Agent) error {
+	release, err := s.GetVersion(agent.ID, agent.Version)
+	if err == gorm.ErrRecordNotFound {
+		return ErrManifestRequired
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.manifests.Check(release.Manifest, release.Version, agent.FlashSize, agent.SRAMSize, agent.SafetyLevel); err != nil {
+		return err
+	}
+	if err := s.checkSignature(agent, release); err != nil {
+		return err
+	}
+	return checkScan(release)
+}
+
+// checkPublishable checks a release before it is served. Publishing copies
+// the release's specs onto the agent, so the manifest is checked against
+// those and the agent's safety level.
+func (s *AgentService) checkPublishable(release *models.AgentVersion) error {
+	var agent models.Agent
+	if err := s.db.Select("id", "publisher_id", "organization_id", "safety_level").First(&agent, "id = ?", release.AgentID).Error; err != nil {
+		return err
+	}
+	if err := s.manifests.Check(release.Manifest, release.Version, release.FlashSize, release.SRAMSize, agent.SafetyLevel); err != nil {
+		return err
+	}
+	if err := s.checkSignature(&agent, release); err != nil {
+		return err
+	}
+	return checkScan(release)
+}
+
+// checkScan returns nil once a release's binary passed its scan, or was
+// uploaded while scanning was off
+func checkScan(release *models.AgentVersion) error {
+	switch release.ScanStatus {
+	case models.ScanStatusPassed, models.ScanStatusSkipped:
+		return nil
+	case models.ScanStatusFailed:
+		return ErrScanFailed
+	default:
+		return ErrScanPending
+	}
+}
+
+// checkSignature verifies a release's binary signature again, as its key
+// may have been revoked or have left the organization since the upload
+func (s *AgentService) checkSignature(agent *models.Agent, release *models.AgentVersion) error {
+	if release.BinarySignature == "" || release.SigningKeyID == nil {
+		return ErrSignatureRequired
+	}
+	digest, err := hex.DecodeString(release.BinaryChecksum)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	key, err := signingKeyFor(s.db, agent, *release.SigningKeyID)
+	if err != nil {
+		return err
+	}
+	return verifyBinarySignature(key, digest, release.BinarySignature)
+}
+
+// CheckEntitlement returns ErrNotEntitled unless the user may download the
+// agent's releases: its publisher or a member of its organization, a buyer
+// of a completed purchase or a member of the organization it was bought
+// for, a subscriber in good standing, a user with a metered deployment, or
+// anyone for a free one-time agent without paid plans
+func (s *AgentService) CheckEntitlement(agent *models.Agent, userID uuid.UUID) error {
+	switch _, err := agentRole(s.db, agent, userID); err {
+	case nil:
+		return nil
+	case ErrNotOrgMember:
+	default:
+		return err
+	}
+
+	var count int64
+	if err := s.db.Model(&models.Subscription{}).
+		Where("buyer_id = ? AND agent_id = ? AND status IN ?", userID, agent.ID, entitlingSubscriptions).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	if agent.PricingModel != models.PricingModelMetered && agent.Price == 0 {
+		if err := s.db.Model(&models.PricingPlan{}).Where("agent_id = ? AND active = ?", agent.ID, true).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+	}
+
+	query := ownedBy(s.db, s.db.Model(&models.Purchase{}), userID).
+		Where("agent_id = ? AND status = ?", agent.ID, models.PurchaseStatusCompleted)
+	if agent.PricingModel == models.PricingModelMetered {
+		query = s.db.Model(&models.Deployment{}).
+			Where("buyer_id = ? AND agent_id = ? AND decommissioned_at IS NULL", userID, agent.ID)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotEntitled
+	}
+	return nil
+}
+
+// EntitlementTrace returns the trace ID of the latest purchase entitling a
+// user to an agent, or of their latest active deployment of a metered
+// agent. It returns nil when no purchase is involved.
+func (s *AgentService) EntitlementTrace(agent *models.Agent, userID uuid.UUID) (*uuid.UUID, error) {
+	query := ownedBy(s.db, s.db.Model(&models.Purchase{}), userID).
+		Where("agent_id = ? AND status = ?", agent.ID, models.PurchaseStatusCompleted)
+	if agent.PricingModel == models.PricingModelMetered {
+		query = s.db.Model(&models.Deployment{}).
+			Where("buyer_id = ? AND agent_id = ? AND decommissioned_at IS NULL", userID, agent.ID)
+	}
+
+	var traceIDs []uuid.UUID
+	if err := query.Order("created_at DESC").Limit(1).Pluck("trace_id", &traceIDs).Error; err != nil {
+		return nil, err
+	}
+	if len(traceIDs) == 0 {
+		return nil, nil
+	}
+	return &traceIDs[0], nil
+}
@@ -0,0 +1,507 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/models"
+)
+
+var (
+	// ErrInvalidWebhookURL is returned for a webhook URL that is not an
+	// absolute https URL
+	ErrInvalidWebhookURL = errors.New("webhook URL must be an absolute https URL")
+	// ErrUnknownWebhookEvent is returned when subscribing to an event type
+	// that does not exist
+	ErrUnknownWebhookEvent = errors.New("unknown webhook event")
+	// ErrTooManyWebhooks is returned when a user has as many subscriptions
+	// as allowed
+	ErrTooManyWebhooks = errors.New("webhook subscription limit reached")
+)
+
+// errPrivateAddress is returned when a webhook URL resolves to an address
+// inside the marketplace's network
+var errPrivateAddress = errors.New("webhook URL resolves to a private address")
+
+// WebhookEvents lists the events that can be subscribed to
+var WebhookEvents = []models.WebhookEvent{
+	models.WebhookEventDeviceRegistered,
+	models.WebhookEventDeviceOffline,
+	models.WebhookEventRolloutWaveCompleted,
+	models.WebhookEventFleetRolloutCompleted,
+	models.WebhookEventFleetRolloutHalted,
+	models.WebhookEventUpdateApplied,
+	models.WebhookEventUpdateFailed,
+	models.WebhookEventNotification,
+}
+
+// WebhookPayload is the JSON body of a webhook delivery. ID is the same for
+// every subscription the event is sent to, so receivers can deduplicate.
+type WebhookPayload struct {
+	ID        uuid.UUID           `json:"id"`
+	Event     models.WebhookEvent `json:"event"`
+	CreatedAt time.Time           `json:"created_at"`
+	Data      interface{}         `json:"data"`
+}
+
+// WebhookService manages users' webhook subscriptions and delivers their
+// events. Events are queued as deliveries in the transaction of the change
+// that caused them, and sent by the worker with retries.
+type WebhookService struct {
+	db     *gorm.DB
+	cfg    config.WebhooksConfig
+	client *http.Client
+}
+
+// NewWebhookService creates a new webhook service
+func NewWebhookService(db *gorm.DB, cfg config.WebhooksConfig) *WebhookService {
+	dialer := &net.Dialer{Timeout: cfg.Timeout, Control: denyPrivateAddress}
+	return &WebhookService{
+		db:  db,
+		cfg: cfg,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+			// Redirects could lead to internal addresses the URL check did not see
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+}
+
+// CreateSubscription subscribes a user's URL to events. The returned secret
+// signs every delivery and is only shown here.
+func (s *WebhookService) CreateSubscription(userID uuid.UUID, rawURL string, events []models.WebhookEvent) (*models.WebhookSubscription, string, error) {
+	if err := validateWebhook(rawURL, events); err != nil {
+		return nil, "", err
+	}
+
+	var count int64
+	if err := s.db.Model(&models.WebhookSubscription{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		return nil, "", err
+	}
+	if count >= int64(s.cfg.MaxPerUser) {
+		return nil, "", ErrTooManyWebhooks
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	secret := "whsec_" + hex.EncodeToString(raw)
+
+	subscription := models.WebhookSubscription{
+		UserID: userID,
+		URL:    rawURL,
+		Secret: secret,
+		Events: webhookEventTags(events),
+		Active: true,
+	}
+	if err := s.db.Create(&subscription).Error; err != nil {
+		return nil, "", err
+	}
+	return &subscription, secret, nil
+}
+
+// GetSubscriptions returns a user's subscriptions
+func (s *WebhookService) GetSubscriptions(userID uuid.UUID) ([]models.WebhookSubscription, error) {
+	var subscriptions []models.WebhookSubscription
+	if err := s.db.Where("user_id = ?", userID).Order("created_at").Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// UpdateSubscription changes the URL, events or active flag of one of a
+// user's subscriptions
+func (s *WebhookService) UpdateSubscription(userID, id uuid.UUID, rawURL string, events []models.WebhookEvent, active bool) (*models.WebhookSubscription, error) {
+	if err := validateWebhook(rawURL, events); err != nil {
+		return nil, err
+	}
+
+	var subscription models.WebhookSubscription
+	if err := s.db.First(&subscription, "id = ? AND user_id = ?", id, userID).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&subscription).Updates(map[string]interface{}{
+		"url":    rawURL,
+		"events": webhookEventTags(events),
+		"active": active,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// DeleteSubscription removes one of a user's subscriptions and its pending
+// deliveries
+func (s *WebhookService) DeleteSubscription(userID, id uuid.UUID) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND user_id = ?", id, userID).Delete(&models.WebhookSubscription{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Where("subscription_id = ?", id).Delete(&models.WebhookDelivery{}).Error
+	})
+}
+
+// GetDeliveries returns the deliveries of one of a user's subscriptions,
+// most recent first
+func (s *WebhookService) GetDeliveries(userID, id uuid.UUID, page, limit int) ([]models.WebhookDelivery, int64, error) {
+	var count int64
+	if err := s.db.Model(&models.WebhookSubscription{}).Where("id = ? AND user_id = ?", id, userID).Count(&count).Error; err != nil {
+		return nil, 0, err
+	}
+	if count == 0 {
+		return nil, 0, gorm.ErrRecordNotFound
+	}
+
+	query := s.db.Model(&models.WebhookDelivery{}).Where("subscription_id = ?", id)
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var deliveries []models.WebhookDelivery
+	offset := (page - 1) * limit
+	if err := query.Order("created_at DESC").Offset(offset).Limit(limit).Find(&deliveries).Error; err != nil {
+		return nil, 0, err
+	}
+	return deliveries, total, nil
+}
+
+// Run delivers due webhooks and reports devices gone offline every poll
+// interval until ctx is done
+func (s *WebhookService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.DetectOffline(); err != nil {
+				log.Error().Err(err).Msg("Failed to detect offline devices")
+			}
+			if _, err := s.DeliverDue(ctx); err != nil {
+				log.Error().Err(err).Msg("Failed to deliver webhooks")
+			}
+		}
+	}
+}
+
+// DetectOffline queues device.offline for devices none of whose active
+// deployments checked in within the offline threshold. A device is reported
+// once until it checks in again. It returns the number of devices reported.
+func (s *WebhookService) DetectOffline() (int, error) {
+	type offlineDevice struct {
+		BuyerID       uuid.UUID
+		DeviceID      string
+		LastCheckInAt time.Time
+	}
+
+	cutoff := time.Now().Add(-s.cfg.OfflineAfter)
+	var devices []offlineDevice
+	if err := s.db.Model(&models.Deployment{}).
+		Select("buyer_id, device_id, MAX(last_check_in_at) AS last_check_in_at").
+		Where("decommissioned_at IS NULL AND last_check_in_at IS NOT NULL").
+		Group("buyer_id, device_id").
+		Having("MAX(last_check_in_at) < ? AND COUNT(offline_at) < COUNT(*)", cutoff).
+		Limit(s.cfg.BatchSize).
+		Scan(&devices).Error; err != nil {
+		return 0, err
+	}
+
+	reported := 0
+	for _, device := range devices {
+		now := time.Now()
+		marked := false
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			var deployments []models.Deployment
+			if err := tx.Where("buyer_id = ? AND device_id = ? AND decommissioned_at IS NULL", device.BuyerID, device.DeviceID).
+				Find(&deployments).Error; err != nil {
+				return err
+			}
+			result := tx.Model(&models.Deployment{}).
+				Where("buyer_id = ? AND device_id = ? AND decommissioned_at IS NULL AND offline_at IS NULL", device.BuyerID, device.DeviceID).
+				Where("last_check_in_at IS NULL OR last_check_in_at < ?", cutoff).
+				Update("offline_at", now)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				// Checked in or reported by another instance meanwhile
+				return nil
+			}
+
+			agents := make([]deviceDeployment, 0, len(deployments))
+			for _, d := range deployments {
+				agents = append(agents, deviceDeployment{DeploymentID: d.ID, AgentID: d.AgentID, Version: d.Version})
+			}
+			marked = true
+			return emitEvent(tx, device.BuyerID, models.WebhookEventDeviceOffline, map[string]interface{}{
+				"device_id":        device.DeviceID,
+				"last_check_in_at": device.LastCheckInAt.UTC(),
+				"deployments":      agents,
+			})
+		})
+		if err != nil {
+			log.Error().Err(err).Str("device_id", device.DeviceID).Msg("Failed to report offline device")
+			continue
+		}
+		if marked {
+			reported++
+		}
+	}
+	return reported, nil
+}
+
+// DeliverDue sends the deliveries that are due. Each one is claimed for the
+// length of an attempt first, so instances do not send it twice. It returns
+// the number of deliveries sent successfully.
+func (s *WebhookService) DeliverDue(ctx context.Context) (int, error) {
+	var due []models.WebhookDelivery
+	if err := s.db.Where("status = ? AND next_attempt_at <= ?", models.WebhookDeliveryStatusPending, time.Now()).
+		Order("next_attempt_at").
+		Limit(s.cfg.BatchSize).
+		Find(&due).Error; err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for i := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		ok, err := s.deliver(ctx, &due[i])
+		if err != nil {
+			log.Error().Err(err).Str("delivery_id", due[i].ID.String()).Msg("Failed to record webhook delivery")
+		}
+		if ok {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+// deliver claims and sends one delivery, recording the outcome
+func (s *WebhookService) deliver(ctx context.Context, delivery *models.WebhookDelivery) (bool, error) {
+	claimed := s.db.Model(&models.WebhookDelivery{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", delivery.ID, models.WebhookDeliveryStatusPending, delivery.NextAttemptAt).
+		Update("next_attempt_at", time.Now().Add(2*s.cfg.Timeout))
+	if claimed.Error != nil {
+		return false, claimed.Error
+	}
+	if claimed.RowsAffected == 0 {
+		return false, nil
+	}
+
+	var subscription models.WebhookSubscription
+	if err := s.db.First(&subscription, "id = ?", delivery.SubscriptionID).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			return false, err
+		}
+		return false, s.db.Delete(delivery).Error
+	}
+
+	attempts := delivery.Attempts + 1
+	updates := map[string]interface{}{"attempts": attempts}
+	code, err := s.send(ctx, &subscription, delivery)
+	updates["response_code"] = code
+	if err == nil {
+		updates["status"] = models.WebhookDeliveryStatusDelivered
+		updates["delivered_at"] = time.Now()
+		updates["last_error"] = ""
+	} else {
+		updates["last_error"] = err.Error()
+		if attempts >= s.cfg.MaxAttempts || !subscription.Active {
+			updates["status"] = models.WebhookDeliveryStatusFailed
+		} else {
+			updates["next_attempt_at"] = time.Now().Add(s.cfg.RetryBackoff << (attempts - 1))
+		}
+	}
+	return err == nil, s.db.Model(delivery).Updates(updates).Error
+}
+
+// send POSTs a delivery's payload to its subscription. The signature header
+// is "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">" keyed with
+// the subscription's secret.
+func (s *WebhookService) send(ctx context.Context, subscription *models.WebhookSubscription, delivery *models.WebhookDelivery) (int, error) {
+	if !subscription.Active {
+		return 0, errors.New("subscription is paused")
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(subscription.Secret))
+	mac.Write([]byte(timestamp + "." + delivery.Payload))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "EdgePlug-Webhooks/1")
+	req.Header.Set("X-EdgePlug-Event", string(delivery.Event))
+	req.Header.Set("X-EdgePlug-Delivery", delivery.ID.String())
+	req.Header.Set("X-EdgePlug-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// SendTest sends a ping to a subscription right away, outside the delivery
+// queue, and returns the receiver's status code
+func (s *WebhookService) SendTest(ctx context.Context, id uuid.UUID) (int, error) {
+	var subscription models.WebhookSubscription
+	if err := s.db.First(&subscription, "id = ?", id).Error; err != nil {
+		return 0, err
+	}
+
+	delivery := models.WebhookDelivery{ID: models.NewID(), SubscriptionID: subscription.ID, Event: models.WebhookEventPing}
+	payload, err := json.Marshal(WebhookPayload{
+		ID:        delivery.ID,
+		Event:     delivery.Event,
+		CreatedAt: time.Now().UTC(),
+		Data:      map[string]interface{}{"subscription_id": subscription.ID},
+	})
+	if err != nil {
+		return 0, err
+	}
+	delivery.Payload = string(payload)
+	return s.send(ctx, &subscription, &delivery)
+}
+
+// deviceDeployment identifies a deployment in device event data
+type deviceDeployment struct {
+	DeploymentID uuid.UUID `json:"deployment_id"`
+	AgentID      uuid.UUID `json:"agent_id"`
+	Version      string    `json:"version"`
+}
+
+// emitWebhook queues an event for each of a user's active subscriptions to
+// it. Call it in the transaction of the change the event reports, so events
+// are only sent for changes that were committed.
+func emitWebhook(tx *gorm.DB, userID uuid.UUID, event models.WebhookEvent, data interface{}) error {
+	var subscriptions []models.WebhookSubscription
+	if err := tx.Where("user_id = ? AND active = ?", userID, true).Find(&subscriptions).Error; err != nil {
+		return err
+	}
+
+	var deliveries []models.WebhookDelivery
+	var payload []byte
+	for _, subscription := range subscriptions {
+		if !subscribedTo(&subscription, event) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			payload, err = json.Marshal(WebhookPayload{
+				ID:        models.NewID(),
+				Event:     event,
+				CreatedAt: time.Now().UTC(),
+				Data:      data,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		deliveries = append(deliveries, models.WebhookDelivery{
+			SubscriptionID: subscription.ID,
+			Event:          event,
+			Payload:        string(payload),
+			Status:         models.WebhookDeliveryStatusPending,
+			NextAttemptAt:  time.Now(),
+		})
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return tx.Create(&deliveries).Error
+}
+
+func subscribedTo(subscription *models.WebhookSubscription, event models.WebhookEvent) bool {
+	for _, e := range subscription.Events {
+		if models.WebhookEvent(e) == event {
+			return true
+		}
+	}
+	return false
+}
+
+func validateWebhook(rawURL string, events []models.WebhookEvent) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		return ErrInvalidWebhookURL
+	}
+	if len(events) == 0 {
+		return ErrUnknownWebhookEvent
+	}
+	for _, event := range events {
+		if !knownWebhookEvent(event) {
+			return fmt.Errorf("%w: %s", ErrUnknownWebhookEvent, event)
+		}
+	}
+	return nil
+}
+
+func knownWebhookEvent(event models.WebhookEvent) bool {
+	for _, known := range WebhookEvents {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+func webhookEventTags(events []models.WebhookEvent) models.Tags {
+	tags := make(models.Tags, 0, len(events))
+	for _, event := range events {
+		tags = append(tags, string(event))
+	}
+	return tags
+}
+
+// denyPrivateAddress stops webhook connections to loopback, private and
+// link-local addresses, whatever name resolved to them
+func denyPrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return errPrivateAddress
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+
+	"github.com/edgeplug/marketplace/config"
+	"github.com/edgeplug/marketplace/services"
+)
+
+// jobServices are the job queue and the services that queue its jobs
+type jobServices struct {
+	queue     *services.JobQueue
+	mailer    services.Mailer
+	artifacts *services.ArtifactService
+	scans     *services.ScanService
+	insights  *services.ReviewInsightService
+}
+
+// setupJobs creates the job queue with the handlers of every job type, which
+// servers and workers must agree on, and the services that queue those jobs
+func setupJobs(cfg *config.Config, db *gorm.DB, redisSvc *services.RedisService, storage services.Storage, agents *services.AgentService) (*jobServices, error) {
+	queue := services.NewJobQueue(redisSvc, cfg.Jobs)
+	mailer, err := services.NewMailer(cfg.Mail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure mail: %w", err)
+	}
+	scans, err := services.NewScanService(db, storage, agents, queue, cfg.Scanning)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure binary scanners: %w", err)
+	}
+	return &jobServices{
+		queue:     queue,
+		mailer:    services.QueueMail(queue, mailer),
+		artifacts: services.NewArtifactService(db, storage, queue, cfg.Downloads, cfg.Storage.PresignExpiry),
+		scans:     scans,
+		insights:  services.NewReviewInsightService(db, queue, cfg.ReviewInsights),
+	}, nil
+}
+
+// runWorker runs background jobs without serving requests until SIGINT or
+// SIGTERM, then waits up to jobs.timeout for the running ones, and returns
+// the process exit code. Jobs still running then are retried elsewhere once
+// their lease runs out.
+func runWorker(cfg *config.Config, db *gorm.DB) int {
+	redisSvc, err := services.NewRedisService(cfg.Redis)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to configure Redis")
+		return 1
+	}
+	if !redisSvc.Available() {
+		log.Warn().Msg("Redis unavailable at startup, waiting for it")
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go redisSvc.MonitorHealth(ctx)
+
+	storage, err := services.NewStorage(cfg.Storage)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to configure storage")
+		return 1
+	}
+	tierSvc := services.NewTierService(db, cfg.Tiers, services.NewLimitService(db, cfg.Tiers, cfg.PublicAPI, cfg.Limits))
+	agentSvc := services.NewAgentService(db, services.NewAgentCache(db, cfg.Cache), tierSvc, storage, cfg.Storage.PresignExpiry, cfg.Scanning.Enabled)
+	jobs, err := setupJobs(cfg, db, redisSvc, storage, agentSvc)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to set up jobs")
+		return 1
+	}
+	if cfg.Metrics.Enabled {
+		go startMetricsServer(cfg)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		jobs.queue.Work(ctx)
+		close(done)
+	}()
+	log.Info().Int("concurrency", cfg.Jobs.Concurrency).Msg("Worker started")
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	log.Info().Msg("Shutting down worker...")
+	stop()
+	select {
+	case <-done:
+	case <-time.After(cfg.Jobs.Timeout):
+		log.Warn().Msg("Worker stopped with jobs still running")
+	}
+	if err := redisSvc.Close(); err != nil {
+		log.Error().Err(err).Msg("Failed to close Redis client")
+	}
+
+	log.Info().Msg("Worker exited")
+	return 0
+}